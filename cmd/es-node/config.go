@@ -14,6 +14,7 @@ import (
 	"github.com/ethereum/go-ethereum/common"
 	"github.com/ethereum/go-ethereum/ethclient"
 	"github.com/ethereum/go-ethereum/log"
+	"github.com/ethstorage/go-ethstorage/ethstorage"
 	"github.com/ethstorage/go-ethstorage/ethstorage/archiver"
 	"github.com/ethstorage/go-ethstorage/ethstorage/db"
 	"github.com/ethstorage/go-ethstorage/ethstorage/downloader"
@@ -226,6 +227,9 @@ func NewRollupConfig(ctx *cli.Context) (*rollup.EsConfig, error) {
 		config := rollup.EsConfig{
 			L2ChainID: new(big.Int).SetUint64(ctx.GlobalUint64(flags.L2ChainId.Name)),
 		}
+		if err := loadSyncConfig(ctx, &config.Sync); err != nil {
+			return nil, err
+		}
 
 		return &config, nil
 	}
@@ -241,9 +245,33 @@ func NewRollupConfig(ctx *cli.Context) (*rollup.EsConfig, error) {
 	if err := json.NewDecoder(file).Decode(&rollupConfig); err != nil {
 		return nil, fmt.Errorf("failed to decode rollup config: %w", err)
 	}
+	if err := loadSyncConfig(ctx, &rollupConfig.Sync); err != nil {
+		return nil, err
+	}
 	return &rollupConfig, nil
 }
 
+// loadSyncConfig fills the sync config fields not set by the rollup config with the p2p sync flags, so the
+// defaults are only applied by the validation to the fields set by neither of them.
+func loadSyncConfig(ctx *cli.Context, config *rollup.SyncConfig) error {
+	if config.MaxPeers == 0 {
+		config.MaxPeers = ctx.GlobalInt(flags.PeersHi.Name)
+	}
+	if config.MinBatchSize == 0 {
+		config.MinBatchSize = ctx.GlobalUint64(flags.SyncMinRangeBatchSize.Name)
+	}
+	if config.MaxBatchSize == 0 {
+		config.MaxBatchSize = ctx.GlobalUint64(flags.SyncMaxRangeBatchSize.Name)
+	}
+	if config.MaxRetries == 0 {
+		config.MaxRetries = ctx.GlobalInt(flags.SyncMaxHealAttempts.Name)
+	}
+	if err := config.Validate(); err != nil {
+		return fmt.Errorf("invalid sync config: %w", err)
+	}
+	return nil
+}
+
 func NewStorageConfig(ctx *cli.Context, client *ethclient.Client) (*storage.StorageConfig, error) {
 	l1Contract := common.HexToAddress(ctx.GlobalString(flags.StorageL1Contract.Name))
 	miner := common.HexToAddress(ctx.GlobalString(flags.StorageMiner.Name))
@@ -254,6 +282,17 @@ func NewStorageConfig(ctx *cli.Context, client *ethclient.Client) (*storage.Stor
 		return nil, err
 	}
 	storageCfg.Filenames = ctx.GlobalStringSlice(flags.StorageFiles.Name)
+	fsyncMode, err := ethstorage.ParseFsyncMode(ctx.GlobalString(flags.StorageFsync.Name))
+	if err != nil {
+		return nil, err
+	}
+	storageCfg.Fsync = ethstorage.FsyncPolicy{
+		Mode:          fsyncMode,
+		BatchWrites:   ctx.GlobalInt(flags.StorageFsyncBatchWrites.Name),
+		BatchInterval: ctx.GlobalDuration(flags.StorageFsyncBatchInterval.Name),
+	}
+	storageCfg.Warmup = ctx.GlobalBool(flags.StorageWarmup.Name)
+	storageCfg.MinFreeDisk = ctx.GlobalUint64(flags.StorageMinFreeDisk.Name)
 	return storageCfg, nil
 }
 
@@ -90,6 +90,10 @@ func main() {
 					Name:  shardIndexFlagName,
 					Usage: "Indexes of shards to mine. Will create one data file per shard.",
 				},
+				cli.BoolFlag{
+					Name:  preallocateFlagName,
+					Usage: "Preallocate the full size of the data files on disk to avoid fragmentation and running out of space during sync.",
+				},
 				flags.DataDir,
 				flags.L1NodeAddr,
 				flags.StorageL1Contract,
@@ -258,7 +262,9 @@ func EsNodeInit(ctx *cli.Context) error {
 		}
 		shardIdxList = shardList
 	}
-	files, err := createDataFile(storageCfg, shardIdxList, datadir, encodingType)
+	preallocate := ctx.Bool(preallocateFlagName)
+	log.Info("Read flag", "name", preallocateFlagName, "value", preallocate)
+	files, err := createDataFile(storageCfg, shardIdxList, datadir, encodingType, preallocate)
 	if err != nil {
 		log.Error("Failed to create data file", "error", err)
 		return err
@@ -27,6 +27,7 @@ const (
 	shardLenFlagName     = "shard_len"
 	shardIndexFlagName   = "shard_index"
 	encodingTypeFlagName = "encoding_type"
+	preallocateFlagName  = "preallocate"
 )
 
 func initStorageConfig(ctx context.Context, client *ethclient.Client, l1Contract, miner common.Address) (*storage.StorageConfig, error) {
@@ -142,7 +143,7 @@ func getDifficulty(ctx context.Context, client *ethclient.Client, contract commo
 	return res[1].(*big.Int), nil
 }
 
-func createDataFile(cfg *storage.StorageConfig, shardIdxList []uint64, datadir string, encodingType int) ([]string, error) {
+func createDataFile(cfg *storage.StorageConfig, shardIdxList []uint64, datadir string, encodingType int, preallocate bool) ([]string, error) {
 	log.Info("Creating data files", "shardIdxList", shardIdxList, "dataDir", datadir)
 	if _, err := os.Stat(datadir); os.IsNotExist(err) {
 		if err := os.Mkdir(datadir, 0755); err != nil {
@@ -166,9 +167,13 @@ func createDataFile(cfg *storage.StorageConfig, shardIdxList []uint64, datadir s
 		chunkPerKv := cfg.KvSize / cfg.ChunkSize
 		startChunkId := shardIdx * cfg.KvEntriesPerShard * chunkPerKv
 		chunkIdxLen := chunkPerKv * cfg.KvEntriesPerShard
-		log.Info("Creating data file", "chunkIdxStart", startChunkId, "chunkIdxLen", chunkIdxLen, "chunkSize", cfg.ChunkSize, "miner", cfg.Miner, "encodeType", encodingType)
+		log.Info("Creating data file", "chunkIdxStart", startChunkId, "chunkIdxLen", chunkIdxLen, "chunkSize", cfg.ChunkSize, "miner", cfg.Miner, "encodeType", encodingType, "preallocate", preallocate)
 
-		df, err := es.Create(dataFile, startChunkId, chunkPerKv*cfg.KvEntriesPerShard, 0, cfg.KvSize, uint64(encodingType), cfg.Miner, cfg.ChunkSize)
+		create := es.Create
+		if preallocate {
+			create = es.CreatePreallocated
+		}
+		df, err := create(dataFile, startChunkId, chunkPerKv*cfg.KvEntriesPerShard, 0, cfg.KvSize, uint64(encodingType), cfg.Miner, cfg.ChunkSize)
 		if err != nil {
 			log.Error("Creating data file", "error", err)
 			return nil, err
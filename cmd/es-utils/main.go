@@ -117,6 +117,12 @@ var BlobUploadCmd = &cobra.Command{
 	Run:   runUploadBlobs,
 }
 
+var MigrateFilledBitmapCmd = &cobra.Command{
+	Use:   "migrate_filled_bitmap",
+	Short: "Keep the bitmap of the empty filled kvs in data files created before it is kept",
+	Run:   runMigrateFilledBitmap,
+}
+
 func init() {
 	kvLen = CreateCmd.Flags().Uint64("kv_len", 0, "kv idx len to create")
 	chunkLen = CreateCmd.Flags().Uint64("chunk_len", 0, "Chunks idx len to create")
@@ -341,6 +347,30 @@ func initDataShard() *es.DataShard {
 	return ds
 }
 
+// runMigrateFilledBitmap writes the bitmap of the empty filled kvs derived from the metas to the data files, so it is
+// loaded without reading the metas once the data files are opened by the node.
+func runMigrateFilledBitmap(cmd *cobra.Command, args []string) {
+	setupLogger()
+
+	if len(*filenames) == 0 {
+		log.Crit("Must provide a filename")
+	}
+	for _, filename := range *filenames {
+		df, err := es.OpenDataFile(filename)
+		if err != nil {
+			log.Crit("Open failed", "file", filename, "error", err)
+		}
+		migrated, err := df.MigrateFilledBitmap()
+		if err != nil {
+			log.Crit("Migrate failed", "file", filename, "error", err)
+		}
+		if err := df.Close(); err != nil {
+			log.Crit("Close failed", "file", filename, "error", err)
+		}
+		log.Info("Filled bitmap migrated", "file", filename, "migrated", migrated)
+	}
+}
+
 func runShardWrite(cmd *cobra.Command, args []string) {
 	setupLogger()
 
@@ -531,6 +561,7 @@ func init() {
 	rootCmd.AddCommand(BlobWriteCmd)
 	rootCmd.AddCommand(BlobUploadCmd)
 	rootCmd.AddCommand(KVReadCmd)
+	rootCmd.AddCommand(MigrateFilledBitmapCmd)
 }
 
 func main() {
@@ -6,11 +6,17 @@ package ethstorage
 import (
 	"bytes"
 	"encoding/binary"
+	"errors"
 	"fmt"
+	"io"
 	"os"
+	"sync"
+	"syscall"
+	"time"
 
 	"github.com/detailyang/go-fallocate"
 	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/log"
 )
 
 const (
@@ -27,8 +33,59 @@ const (
 	HEADER_SIZE = 4096
 
 	SampleSizeBits = 5 // 32 bytes
+
+	// STATUS_REENCODING is set in the header status while the data file is re-encoded to another encode type
+	STATUS_REENCODING = uint64(1)
+	// STATUS_FILLED_BITMAP is set in the header status once the bitmap of the empty filled kvs is kept after the metas
+	STATUS_FILLED_BITMAP = uint64(2)
+
+	// filledFlushUpdates is the number of the updates of the bitmap of the empty filled kvs written to disk at once
+	filledFlushUpdates = 256
+	// reEncodeCheckpointKvs is the number of the kvs re-encoded between the writes of the progress to the header
+	reEncodeCheckpointKvs = 64
 )
 
+// FsyncMode is when the blobs written to a data file are flushed to disk by fsync.
+type FsyncMode int
+
+const (
+	FsyncNever   FsyncMode = iota // the writes are left to the OS to flush, which may lose them on a crash
+	FsyncAlways                   // each blob written is flushed
+	FsyncBatched                  // the blobs written are flushed in batches
+)
+
+func (m FsyncMode) String() string {
+	switch m {
+	case FsyncNever:
+		return "never"
+	case FsyncAlways:
+		return "always"
+	case FsyncBatched:
+		return "batched"
+	default:
+		return fmt.Sprintf("unknown(%d)", int(m))
+	}
+}
+
+// ParseFsyncMode parses the fsync mode of its name, i.e. never, always or batched.
+func ParseFsyncMode(name string) (FsyncMode, error) {
+	for _, m := range []FsyncMode{FsyncNever, FsyncAlways, FsyncBatched} {
+		if m.String() == name {
+			return m, nil
+		}
+	}
+	return FsyncNever, fmt.Errorf("unknown fsync mode %q", name)
+}
+
+// FsyncPolicy trades the crash safety of the blobs written to a data file for the write throughput. In FsyncBatched
+// mode, the blobs written are flushed once BatchWrites blobs are written or BatchInterval passed since the last
+// flush, which is checked on each blob written, and the blobs left are flushed by Sync or Close.
+type FsyncPolicy struct {
+	Mode          FsyncMode
+	BatchWrites   int           // blobs written to flush a batch, 0 means no limit
+	BatchInterval time.Duration // interval since the last flush to flush a batch, 0 means no limit
+}
+
 // A DataFile represents a local file for a consecutive chunks
 type DataFile struct {
 	file          *os.File
@@ -39,6 +96,23 @@ type DataFile struct {
 	chunkSize     uint64
 	metaSize      uint64         // per KV meta size (like commit)
 	miner         common.Address // storage provider key
+
+	status        uint64
+	reEncodeType  uint64 // encode type the data file is re-encoded to if STATUS_REENCODING is set
+	reEncodeNext  uint64 // the kvs below it are re-encoded already if STATUS_REENCODING is set
+	reEncodeSaved uint64 // reEncodeNext last written to the header
+
+	syncMu   sync.Mutex // protect fsync, unsynced and lastSync
+	fsync    FsyncPolicy
+	unsynced int       // blobs written since the last flush
+	lastSync time.Time // time of the last flush
+
+	filledMu      sync.Mutex // protect filled, filledKept and the dirty range of filled
+	filled        []byte     // bit i%8 of byte i/8 is set if the i-th kv of the data file is filled with an empty blob, nil until loaded
+	filledKept    bool       // the bitmap is kept on disk, i.e. STATUS_FILLED_BITMAP is set
+	filledDirtyLo int        // the bytes of filled in [filledDirtyLo, filledDirtyHi) are not written to disk yet
+	filledDirtyHi int
+	filledPending int // updates of filled not written to disk yet
 }
 
 type DataFileHeader struct {
@@ -52,6 +126,8 @@ type DataFileHeader struct {
 	metaSize      uint64
 	miner         common.Address
 	status        uint64
+	reEncodeType  uint64
+	reEncodeNext  uint64
 }
 
 // Mask the data in place.  Padding zeros to userData if the len of userData is smaller than that of maskData,
@@ -76,7 +152,19 @@ func UnmaskDataInPlace(userData []byte, maskData []byte) []byte {
 	return maskData[:len(userData)]
 }
 
+// Create creates a data file whose disk space is allocated lazily when the data is written.
 func Create(filename string, chunkIdxStart, chunkIdxLen, epoch, maxKvSize, encodeType uint64, miner common.Address, chunkSize uint64) (*DataFile, error) {
+	return create(filename, chunkIdxStart, chunkIdxLen, maxKvSize, encodeType, miner, chunkSize, false)
+}
+
+// CreatePreallocated creates a data file and preallocates the full extent of it on disk, which avoids fragmentation
+// and running out of space in the middle of sync. It falls back to the lazy allocation of Create where the
+// preallocation is not supported by the platform or filesystem.
+func CreatePreallocated(filename string, chunkIdxStart, chunkIdxLen, epoch, maxKvSize, encodeType uint64, miner common.Address, chunkSize uint64) (*DataFile, error) {
+	return create(filename, chunkIdxStart, chunkIdxLen, maxKvSize, encodeType, miner, chunkSize, true)
+}
+
+func create(filename string, chunkIdxStart, chunkIdxLen, maxKvSize, encodeType uint64, miner common.Address, chunkSize uint64, preallocate bool) (*DataFile, error) {
 	if chunkSize > maxKvSize {
 		return nil, fmt.Errorf("chunkSize must be smaller than maxKvSize")
 	}
@@ -94,10 +182,21 @@ func Create(filename string, chunkIdxStart, chunkIdxLen, epoch, maxKvSize, encod
 	if err != nil {
 		return nil, err
 	}
-	// actual initialization is done when synchronize
-	err = fallocate.Fallocate(file, int64((chunkSize+32)*chunkIdxLen), int64(HEADER_SIZE))
-	if err != nil {
-		return nil, err
+	dataSize := int64((chunkSize + 32) * chunkIdxLen)
+	if preallocate {
+		err = fallocate.Fallocate(file, 0, dataSize+HEADER_SIZE)
+		if errors.Is(err, syscall.ENOSPC) {
+			return nil, err
+		} else if err != nil {
+			log.Warn("Preallocate data file failed, fall back to lazy allocation", "file", filename, "err", err)
+		}
+	}
+	if !preallocate || err != nil {
+		// actual initialization is done when synchronize
+		err = fallocate.Fallocate(file, dataSize, int64(HEADER_SIZE))
+		if err != nil {
+			return nil, err
+		}
 	}
 	dataFile := &DataFile{
 		file:          file,
@@ -108,7 +207,10 @@ func Create(filename string, chunkIdxStart, chunkIdxLen, epoch, maxKvSize, encod
 		miner:         miner,
 		chunkSize:     chunkSize,
 		metaSize:      32,
+		status:        STATUS_FILLED_BITMAP,
+		filledKept:    true,
 	}
+	dataFile.filled = make([]byte, (dataFile.KvIdxEnd()-dataFile.KvIdxStart()+7)/8)
 	dataFile.writeHeader()
 	return dataFile, nil
 }
@@ -121,7 +223,11 @@ func OpenDataFile(filename string) (*DataFile, error) {
 	dataFile := &DataFile{
 		file: file,
 	}
-	return dataFile, dataFile.readHeader()
+	if err := dataFile.readHeader(); err != nil {
+		return dataFile, err
+	}
+	dataFile.filledKept = dataFile.status&STATUS_FILLED_BITMAP != 0
+	return dataFile, nil
 }
 
 func (df *DataFile) Contains(chunkIdx uint64) bool {
@@ -223,8 +329,157 @@ func (df *DataFile) WriteMeta(kvIdx uint64, b []byte) error {
 		return fmt.Errorf("write meta too large")
 	}
 
-	_, err := df.file.WriteAt(b, int64(HEADER_SIZE+df.chunkIdxLen*df.chunkSize+(kvIdx-df.KvIdxStart())*df.metaSize))
-	return err
+	offset := int64(HEADER_SIZE + df.chunkIdxLen*df.chunkSize + (kvIdx-df.KvIdxStart())*df.metaSize)
+	if _, err := df.file.WriteAt(b, offset); err != nil {
+		return err
+	}
+	return df.setFilled(kvIdx, isEmptyFilledMeta(b))
+}
+
+// isEmptyFilledMeta returns whether the meta is of a kv filled with an empty blob by fill empty.
+func isEmptyFilledMeta(meta []byte) bool {
+	var empty common.Hash
+	empty[HashSizeInContract] = blobFillingMask
+	return common.BytesToHash(meta) == empty
+}
+
+// filledOffset returns the offset of the bitmap of the empty filled kvs, which is right after the space allocated for
+// the metas. The bitmap is not allocated, so the bytes not written yet are beyond the end of the file.
+func (df *DataFile) filledOffset() int64 {
+	return int64(HEADER_SIZE + (df.chunkSize+32)*df.chunkIdxLen)
+}
+
+// loadFilledBitmap loads the bitmap of the empty filled kvs once it is first used, or derives it from the metas for a
+// data file created before the bitmap is kept, which is not written to disk until it is migrated, see
+// MigrateFilledBitmap. The caller must hold filledMu.
+func (df *DataFile) loadFilledBitmap() error {
+	if df.filled != nil {
+		return nil
+	}
+	kvCount := df.KvIdxEnd() - df.KvIdxStart()
+	filled := make([]byte, (kvCount+7)/8)
+	if df.filledKept {
+		n, err := df.file.ReadAt(filled, df.filledOffset())
+		if err != nil && !errors.Is(err, io.EOF) {
+			return err
+		}
+		// the bytes beyond the end of the file are not written yet
+		clear(filled[n:])
+		df.filled = filled
+		return nil
+	}
+
+	for i := uint64(0); i < kvCount; i++ {
+		meta, err := df.ReadMeta(df.KvIdxStart() + i)
+		if err != nil {
+			return err
+		}
+		if isEmptyFilledMeta(meta) {
+			filled[i/8] |= 1 << (i % 8)
+		}
+	}
+	df.filled = filled
+	return nil
+}
+
+// MigrateFilledBitmap writes the bitmap of the empty filled kvs derived from the metas to a data file created before
+// the bitmap is kept, so it is loaded without reading the metas afterward. It returns false if the bitmap is kept
+// already.
+func (df *DataFile) MigrateFilledBitmap() (bool, error) {
+	df.filledMu.Lock()
+	defer df.filledMu.Unlock()
+	if df.filledKept {
+		return false, nil
+	}
+	if err := df.loadFilledBitmap(); err != nil {
+		return false, err
+	}
+	if _, err := df.file.WriteAt(df.filled, df.filledOffset()); err != nil {
+		return false, err
+	}
+	status := df.status
+	df.status |= STATUS_FILLED_BITMAP
+	if err := df.writeHeader(); err != nil {
+		df.status = status
+		return false, err
+	}
+	df.filledKept = true
+	return true, nil
+}
+
+// FilledBitmapKept returns whether the bitmap of the empty filled kvs is kept on disk, otherwise it is derived from the
+// metas until the data file is migrated by MigrateFilledBitmap.
+func (df *DataFile) FilledBitmapKept() bool {
+	df.filledMu.Lock()
+	defer df.filledMu.Unlock()
+	return df.filledKept
+}
+
+// setFilled updates the bit of the kv in the bitmap of the empty filled kvs. The updates are written to disk in
+// batches of filledFlushUpdates, and once the data file is flushed or closed. The bitmap of a data file not migrated
+// is derived from the metas once loaded, so it is only updated in memory if loaded already.
+func (df *DataFile) setFilled(kvIdx uint64, filled bool) error {
+	df.filledMu.Lock()
+	defer df.filledMu.Unlock()
+	if df.filled == nil {
+		if !df.filledKept {
+			return nil
+		}
+		if err := df.loadFilledBitmap(); err != nil {
+			return err
+		}
+	}
+	i := kvIdx - df.KvIdxStart()
+	b := df.filled[i/8]
+	if filled {
+		b |= 1 << (i % 8)
+	} else {
+		b &^= 1 << (i % 8)
+	}
+	if b == df.filled[i/8] {
+		return nil
+	}
+	df.filled[i/8] = b
+	if !df.filledKept {
+		return nil
+	}
+	if df.filledDirtyLo >= df.filledDirtyHi {
+		df.filledDirtyLo, df.filledDirtyHi = int(i/8), int(i/8)+1
+	} else {
+		df.filledDirtyLo, df.filledDirtyHi = min(df.filledDirtyLo, int(i/8)), max(df.filledDirtyHi, int(i/8)+1)
+	}
+	df.filledPending++
+	if df.filledPending >= filledFlushUpdates {
+		return df.flushFilledBitmap()
+	}
+	return nil
+}
+
+// flushFilledBitmap writes the bytes of the bitmap updated since the last flush to disk in a single write. The caller
+// must hold filledMu.
+func (df *DataFile) flushFilledBitmap() error {
+	if df.filledDirtyLo >= df.filledDirtyHi {
+		return nil
+	}
+	if _, err := df.file.WriteAt(df.filled[df.filledDirtyLo:df.filledDirtyHi], df.filledOffset()+int64(df.filledDirtyLo)); err != nil {
+		return err
+	}
+	df.filledDirtyLo, df.filledDirtyHi, df.filledPending = 0, 0, 0
+	return nil
+}
+
+// IsFilled returns whether the kv is filled with an empty blob, without reading its meta if the bitmap is kept.
+func (df *DataFile) IsFilled(kvIdx uint64) (bool, error) {
+	df.filledMu.Lock()
+	defer df.filledMu.Unlock()
+	if !df.ContainsKv(kvIdx) {
+		return false, nil
+	}
+	if err := df.loadFilledBitmap(); err != nil {
+		return false, err
+	}
+	i := kvIdx - df.KvIdxStart()
+	return df.filled[i/8]&(1<<(i%8)) != 0, nil
 }
 
 func (df *DataFile) writeHeader() error {
@@ -238,7 +493,9 @@ func (df *DataFile) writeHeader() error {
 		chunkSize:     df.chunkSize,
 		metaSize:      df.metaSize,
 		miner:         df.miner,
-		status:        0,
+		status:        df.status,
+		reEncodeType:  df.reEncodeType,
+		reEncodeNext:  df.reEncodeNext,
 	}
 
 	buf := new(bytes.Buffer)
@@ -276,6 +533,12 @@ func (df *DataFile) writeHeader() error {
 	if err := binary.Write(buf, binary.BigEndian, header.status); err != nil {
 		return err
 	}
+	if err := binary.Write(buf, binary.BigEndian, header.reEncodeType); err != nil {
+		return err
+	}
+	if err := binary.Write(buf, binary.BigEndian, header.reEncodeNext); err != nil {
+		return err
+	}
 	if _, err := df.file.WriteAt(buf.Bytes(), 0); err != nil {
 		return err
 	}
@@ -329,6 +592,12 @@ func (df *DataFile) readHeader() error {
 	if err := binary.Read(buf, binary.BigEndian, &header.status); err != nil {
 		return err
 	}
+	if err := binary.Read(buf, binary.BigEndian, &header.reEncodeType); err != nil {
+		return err
+	}
+	if err := binary.Read(buf, binary.BigEndian, &header.reEncodeNext); err != nil {
+		return err
+	}
 
 	// Sanity check
 	if header.magic != MAGIC {
@@ -337,9 +606,12 @@ func (df *DataFile) readHeader() error {
 	if header.version > VERSION {
 		return fmt.Errorf("unsupported version")
 	}
-	if header.encodeType > ENCODE_END {
+	if !isSupportedEncodeType(header.encodeType) {
 		return fmt.Errorf("unknown mask type")
 	}
+	if header.status&STATUS_REENCODING != 0 && !isSupportedEncodeType(header.reEncodeType) {
+		return fmt.Errorf("unknown re-encode mask type")
+	}
 
 	df.chunkIdxStart = header.chunkIdxStart
 	df.chunkIdxLen = header.chunkIdxLen
@@ -348,15 +620,189 @@ func (df *DataFile) readHeader() error {
 	df.chunkSize = header.chunkSize
 	df.metaSize = header.metaSize
 	df.miner = header.miner
+	df.status = header.status
+	df.reEncodeType = header.reEncodeType
+	df.reEncodeNext = header.reEncodeNext
+	df.reEncodeSaved = header.reEncodeNext
 
 	return nil
 }
 
+// IsReEncoding returns whether the data file is being re-encoded to another encode type.
+func (df *DataFile) IsReEncoding() bool {
+	return df.status&STATUS_REENCODING != 0
+}
+
+// EncodeTypeOf returns the encode type of the kv, which is the encode type re-encoded to if the kv is re-encoded.
+func (df *DataFile) EncodeTypeOf(kvIdx uint64) uint64 {
+	if df.IsReEncoding() && kvIdx < df.reEncodeNext {
+		return df.reEncodeType
+	}
+	return df.encodeType
+}
+
+// targetEncodeType returns the encode type of the data file once the re-encoding in progress is finished.
+func (df *DataFile) targetEncodeType() uint64 {
+	if df.IsReEncoding() {
+		return df.reEncodeType
+	}
+	return df.encodeType
+}
+
+// setReEncodeNext marks the kvs below next as re-encoded to encodeType in the header, so the re-encoding can be
+// resumed from next if interrupted.
+func (df *DataFile) setReEncodeNext(encodeType, next uint64) error {
+	status, reEncodeType, reEncodeNext := df.status, df.reEncodeType, df.reEncodeNext
+	df.status |= STATUS_REENCODING
+	df.reEncodeType, df.reEncodeNext = encodeType, next
+	if err := df.writeHeader(); err != nil {
+		df.status, df.reEncodeType, df.reEncodeNext = status, reEncodeType, reEncodeNext
+		return err
+	}
+	df.reEncodeSaved = next
+	return nil
+}
+
+// advanceReEncode marks the kvs below next as re-encoded, which is written to the header every reEncodeCheckpointKvs
+// kvs and once all the kvs of the data file are re-encoded.
+func (df *DataFile) advanceReEncode(next uint64) error {
+	df.reEncodeNext = next
+	if next-df.reEncodeSaved >= reEncodeCheckpointKvs || next >= df.KvIdxEnd() {
+		return df.checkpointReEncode()
+	}
+	return nil
+}
+
+// checkpointReEncode writes the kvs marked as re-encoded since the last checkpoint to the header.
+func (df *DataFile) checkpointReEncode() error {
+	if !df.IsReEncoding() || df.reEncodeNext == df.reEncodeSaved {
+		return nil
+	}
+	return df.setReEncodeNext(df.reEncodeType, df.reEncodeNext)
+}
+
+// finishReEncode switches the encode type of the data file to the one re-encoded to once all its kvs are re-encoded.
+func (df *DataFile) finishReEncode() error {
+	if !df.IsReEncoding() {
+		return nil
+	}
+	if df.reEncodeNext < df.KvIdxEnd() {
+		return fmt.Errorf("data file is re-encoded up to kv %d of %d", df.reEncodeNext, df.KvIdxEnd())
+	}
+	encodeType, status, reEncodeType, reEncodeNext := df.encodeType, df.status, df.reEncodeType, df.reEncodeNext
+	df.encodeType = df.reEncodeType
+	df.status &^= STATUS_REENCODING
+	df.reEncodeType, df.reEncodeNext = 0, 0
+	if err := df.writeHeader(); err != nil {
+		df.encodeType, df.status, df.reEncodeType, df.reEncodeNext = encodeType, status, reEncodeType, reEncodeNext
+		return err
+	}
+	return nil
+}
+
+// SetFsyncPolicy sets the policy to flush the blobs written to the data file, which is FsyncNever by default.
+func (df *DataFile) SetFsyncPolicy(policy FsyncPolicy) {
+	df.syncMu.Lock()
+	defer df.syncMu.Unlock()
+	df.fsync = policy
+	df.lastSync = time.Now()
+}
+
+// Sync flushes the blobs written to the data file since the last flush to disk regardless of the fsync policy.
+func (df *DataFile) Sync() error {
+	df.syncMu.Lock()
+	defer df.syncMu.Unlock()
+	return df.sync()
+}
+
+// Warmup validates the data file is still intact on disk and reads its metas into the page cache, so a data file
+// corrupted or truncated since it is opened is reported before it is served, and the first serves of it do not hit
+// the disk for the metas.
+func (df *DataFile) Warmup() error {
+	info, err := df.file.Stat()
+	if err != nil {
+		return err
+	}
+	if info.Size() < df.filledOffset() {
+		return fmt.Errorf("data file truncated, size %d, expected at least %d", info.Size(), df.filledOffset())
+	}
+	header := &DataFile{file: df.file}
+	if err := header.readHeader(); err != nil {
+		return fmt.Errorf("read header error: %w", err)
+	}
+	if header.chunkIdxStart != df.chunkIdxStart || header.chunkIdxLen != df.chunkIdxLen ||
+		header.maxKvSize != df.maxKvSize || header.chunkSize != df.chunkSize || header.miner != df.miner {
+		return fmt.Errorf("header changed since the data file is opened")
+	}
+	metaOffset := int64(HEADER_SIZE + df.chunkIdxLen*df.chunkSize)
+	metas := io.NewSectionReader(df.file, metaOffset, int64((df.KvIdxEnd()-df.KvIdxStart())*df.metaSize))
+	if _, err := io.Copy(io.Discard, metas); err != nil {
+		return fmt.Errorf("read metas error: %w", err)
+	}
+	return nil
+}
+
+// blobWritten counts a blob written to the data file, and flushes the blobs written by the fsync policy.
+func (df *DataFile) blobWritten() error {
+	df.syncMu.Lock()
+	defer df.syncMu.Unlock()
+	df.unsynced++
+	switch df.fsync.Mode {
+	case FsyncAlways:
+		return df.sync()
+	case FsyncBatched:
+		if (df.fsync.BatchWrites > 0 && df.unsynced >= df.fsync.BatchWrites) ||
+			(df.fsync.BatchInterval > 0 && time.Since(df.lastSync) >= df.fsync.BatchInterval) {
+			return df.sync()
+		}
+	}
+	return nil
+}
+
+func (df *DataFile) sync() error {
+	if df.file == nil {
+		return nil
+	}
+	// the bitmap updates are flushed along with the blobs, so it is not behind them once synced
+	df.filledMu.Lock()
+	err := df.flushFilledBitmap()
+	df.filledMu.Unlock()
+	if err != nil {
+		return err
+	}
+	if df.unsynced == 0 {
+		return nil
+	}
+	if err := df.file.Sync(); err != nil {
+		return fmt.Errorf("sync data file %s error: %w", df.file.Name(), err)
+	}
+	df.unsynced = 0
+	df.lastSync = time.Now()
+	return nil
+}
+
 func (df *DataFile) Close() error {
+	var syncErr error
+	df.syncMu.Lock()
+	if df.fsync.Mode != FsyncNever {
+		// flush the blobs left by FsyncBatched mode
+		syncErr = df.sync()
+	} else if df.file != nil {
+		df.filledMu.Lock()
+		syncErr = df.flushFilledBitmap()
+		df.filledMu.Unlock()
+	}
+	df.syncMu.Unlock()
+	if df.file != nil {
+		// the progress of the re-encoding since the last checkpoint is kept, so it is resumed from where it stops
+		if err := df.checkpointReEncode(); err != nil && syncErr == nil {
+			syncErr = err
+		}
+	}
 	if df.file != nil {
 		if err := df.file.Close(); err != nil {
 			return fmt.Errorf("close data file %s error: %w", df.file.Name(), err)
 		}
 	}
-	return nil
+	return syncErr
 }
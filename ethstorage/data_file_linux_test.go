@@ -0,0 +1,54 @@
+// Copyright 2022-2023, EthStorage.
+// For license information, see https://github.com/ethstorage/es-node/blob/main/LICENSE
+
+package ethstorage
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"syscall"
+	"testing"
+
+	"github.com/ethereum/go-ethereum/common"
+)
+
+func TestCreatePreallocated(t *testing.T) {
+	var (
+		dir         = t.TempDir()
+		kvSize      = uint64(1 << 17)
+		kvEntries   = uint64(16)
+		expectedLen = int64((kvSize+32)*kvEntries) + HEADER_SIZE
+	)
+
+	// skip the test if the filesystem of the temp dir does not support fallocate
+	probe, err := os.Create(filepath.Join(dir, "probe"))
+	if err != nil {
+		t.Fatalf("create probe file failed: %v", err)
+	}
+	err = syscall.Fallocate(int(probe.Fd()), 0, 0, 4096)
+	probe.Close()
+	if errors.Is(err, syscall.EOPNOTSUPP) {
+		t.Skip("fallocate is not supported by the filesystem")
+	}
+
+	fileName := filepath.Join(dir, "shard-0.dat")
+	df, err := CreatePreallocated(fileName, 0, kvEntries, 0, kvSize, ENCODE_BLOB_POSEIDON, common.Address{}, kvSize)
+	if err != nil {
+		t.Fatalf("create preallocated data file failed: %v", err)
+	}
+	defer df.Close()
+
+	info, err := os.Stat(fileName)
+	if err != nil {
+		t.Fatalf("stat data file failed: %v", err)
+	}
+	if info.Size() != expectedLen {
+		t.Fatalf("data file size is not match, expected: %d, actual: %d", expectedLen, info.Size())
+	}
+	// st_blocks is always in the unit of 512 bytes
+	allocated := info.Sys().(*syscall.Stat_t).Blocks * 512
+	if allocated < expectedLen {
+		t.Fatalf("data file is not preallocated, expected at least: %d, allocated: %d", expectedLen, allocated)
+	}
+}
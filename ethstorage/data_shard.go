@@ -7,10 +7,12 @@ import (
 	"bytes"
 	"fmt"
 	"math/big"
+	"sync/atomic"
 
 	"github.com/ethereum/go-ethereum/common"
 	"github.com/ethereum/go-ethereum/crypto"
 	"github.com/ethereum/go-ethereum/crypto/kzg4844"
+	"github.com/ethereum/go-ethereum/log"
 	"github.com/ethstorage/go-ethstorage/ethstorage/encoder"
 	"github.com/ethstorage/go-ethstorage/ethstorage/pora"
 	"github.com/protolambda/go-kzg/eth"
@@ -26,6 +28,7 @@ type DataShard struct {
 	kvEntries   uint64
 	dataFiles   []*DataFile
 	chunkSize   uint64
+	reEncoding  atomic.Bool // any data file is being re-encoded, read by the writes and the mining without the storage manager locked
 }
 
 func NewDataShard(shardIdx uint64, kvSize uint64, kvEntries uint64, chunkSize uint64) *DataShard {
@@ -42,7 +45,7 @@ func (ds *DataShard) AddDataFile(df *DataFile) error {
 		if ds.dataFiles[0].miner != df.miner {
 			return fmt.Errorf("mismatched data file SP")
 		}
-		if ds.dataFiles[0].encodeType != df.encodeType {
+		if ds.dataFiles[0].targetEncodeType() != df.targetEncodeType() {
 			return fmt.Errorf("mismatched data file encode type")
 		}
 		if ds.dataFiles[0].maxKvSize != df.maxKvSize {
@@ -51,6 +54,9 @@ func (ds *DataShard) AddDataFile(df *DataFile) error {
 		// TODO: May check if not overlapped?
 	}
 	ds.dataFiles = append(ds.dataFiles, df)
+	if df.IsReEncoding() {
+		ds.reEncoding.Store(true)
+	}
 	return nil
 }
 
@@ -82,12 +88,33 @@ func (ds *DataShard) Miner() common.Address {
 	}
 }
 
+// EncodeType returns the encode type of the shard, which is the encode type before re-encoding while the shard is
+// being re-encoded, as some of its kvs are not re-encoded yet. Use EncodeTypeOf for the encode type of a kv.
 func (ds *DataShard) EncodeType() uint64 {
 	if len(ds.dataFiles) == 0 {
 		return NO_ENCODE
-	} else {
-		return ds.dataFiles[0].encodeType
 	}
+	for _, df := range ds.dataFiles {
+		if df.IsReEncoding() {
+			return df.encodeType
+		}
+	}
+	return ds.dataFiles[0].encodeType
+}
+
+// EncodeTypeOf returns the encode type of the kv, which differs from that of the shard if the kv is re-encoded.
+func (ds *DataShard) EncodeTypeOf(kvIdx uint64) uint64 {
+	for _, df := range ds.dataFiles {
+		if df.ContainsKv(kvIdx) {
+			return df.EncodeTypeOf(kvIdx)
+		}
+	}
+	return ds.EncodeType()
+}
+
+// IsReEncoding returns whether the shard is being re-encoded to another encode type.
+func (ds *DataShard) IsReEncoding() bool {
+	return ds.reEncoding.Load()
 }
 
 func (ds *DataShard) Contains(kvIdx uint64) bool {
@@ -120,9 +147,12 @@ func (ds *DataShard) ReadChunkEncoded(kvIdx uint64, chunkIdx uint64) ([]byte, er
 
 // ReadChunk read the encoded data from storage and decode it.
 func (ds *DataShard) ReadChunk(kvIdx uint64, chunkIdx uint64, commit common.Hash) ([]byte, error) {
+	if encodeType := ds.EncodeTypeOf(kvIdx); encodeType > ENCODE_END {
+		return nil, fmt.Errorf("chunk of custom encode type %d cannot be decoded alone", encodeType)
+	}
 	return ds.readChunkWith(kvIdx, chunkIdx, func(cdata []byte, chunkIdx uint64) []byte {
 		encodeKey := calcEncodeKey(commit, chunkIdx, ds.dataFiles[0].miner)
-		return decodeChunk(ds.chunkSize, cdata, ds.dataFiles[0].encodeType, encodeKey)
+		return decodeChunk(ds.chunkSize, cdata, ds.EncodeTypeOf(kvIdx), encodeKey)
 	})
 }
 
@@ -150,12 +180,34 @@ func (ds *DataShard) ReadEncoded(kvIdx uint64, readLen int) ([]byte, error) {
 	})
 }
 
+// ReadEncodedAt read the encoded data of readLen bytes from storage starting at the chunk aligned offset of the kv
+// and return it.
+func (ds *DataShard) ReadEncodedAt(kvIdx uint64, offset uint64, readLen int) ([]byte, error) {
+	if !ds.Contains(kvIdx) {
+		return nil, fmt.Errorf("kv not found")
+	}
+	if offset%ds.chunkSize != 0 {
+		return nil, fmt.Errorf("offset %d is not aligned to chunk size %d", offset, ds.chunkSize)
+	}
+	if readLen < 0 || offset+uint64(readLen) > ds.kvSize {
+		return nil, fmt.Errorf("read range out of kv size, offset %d, readLen %d, kvSize %d", offset, readLen, ds.kvSize)
+	}
+	data := make([]byte, 0, readLen)
+	for chunkIdx := kvIdx*ds.chunksPerKv + offset/ds.chunkSize; readLen > 0; chunkIdx++ {
+		chunkReadLen := min(readLen, int(ds.chunkSize))
+		cdata, err := ds.readChunk(chunkIdx, chunkReadLen)
+		if err != nil {
+			return nil, err
+		}
+		data = append(data, cdata...)
+		readLen -= chunkReadLen
+	}
+	return data, nil
+}
+
 // Read the encoded data from storage and decode it.
 func (ds *DataShard) Read(kvIdx uint64, readLen int, commit common.Hash) ([]byte, error) {
-	bs, err := ds.readWith(kvIdx, int(ds.kvSize), func(cdata []byte, chunkIdx uint64) []byte {
-		encodeKey := calcEncodeKey(commit, chunkIdx, ds.dataFiles[0].miner)
-		return decodeChunk(ds.chunkSize, cdata, ds.dataFiles[0].encodeType, encodeKey)
-	})
+	bs, err := ds.readDecoded(kvIdx, commit, ds.EncodeTypeOf(kvIdx))
 	if err != nil {
 		return nil, err
 	}
@@ -172,10 +224,7 @@ func (ds *DataShard) ReadWithMeta(kvIdx uint64, readLen int) ([]byte, []byte, er
 	if err != nil {
 		return nil, nil, err
 	}
-	bs, err := ds.readWith(kvIdx, int(ds.kvSize), func(cdata []byte, chunkIdx uint64) []byte {
-		encodeKey := calcEncodeKey(common.BytesToHash(commit), chunkIdx, ds.dataFiles[0].miner)
-		return decodeChunk(ds.chunkSize, cdata, ds.dataFiles[0].encodeType, encodeKey)
-	})
+	bs, err := ds.readDecoded(kvIdx, common.BytesToHash(commit), ds.EncodeTypeOf(kvIdx))
 	if err != nil {
 		return nil, nil, err
 	}
@@ -186,6 +235,54 @@ func (ds *DataShard) ReadWithMeta(kvIdx uint64, readLen int) ([]byte, []byte, er
 	return bs[0:readLen], commit, nil
 }
 
+// readDecoded reads the whole kv and decodes it with the encode type. A kv of a custom encode type is decoded as a
+// whole by the registered decoder, while the built-in ones are decoded chunk by chunk.
+func (ds *DataShard) readDecoded(kvIdx uint64, commit common.Hash, encodeType uint64) ([]byte, error) {
+	miner := ds.dataFiles[0].miner
+	if encodeType <= ENCODE_END {
+		return ds.readWith(kvIdx, int(ds.kvSize), func(cdata []byte, chunkIdx uint64) []byte {
+			return decodeChunk(ds.chunkSize, cdata, encodeType, calcEncodeKey(commit, chunkIdx, miner))
+		})
+	}
+	decode, ok := customCodec(encodeType, false)
+	if !ok {
+		return nil, fmt.Errorf("unsupported encode type %d", encodeType)
+	}
+	encoded, err := ds.ReadEncoded(kvIdx, int(ds.kvSize))
+	if err != nil {
+		return nil, err
+	}
+	decoded, _, err := decode(kvIdx, encoded, commit, miner, encodeType)
+	return decoded, err
+}
+
+// writeEncoded encodes the kv with the encode type and writes it. A kv of a custom encode type is encoded as a whole
+// by the registered encoder, while the built-in ones are encoded chunk by chunk.
+func (ds *DataShard) writeEncoded(kvIdx uint64, b []byte, commit common.Hash, encodeType uint64) error {
+	miner := ds.dataFiles[0].miner
+	if encodeType <= ENCODE_END {
+		return ds.WriteWith(kvIdx, b, commit, func(cdata []byte, chunkIdx uint64) []byte {
+			return encodeChunk(ds.chunkSize, cdata, encodeType, calcEncodeKey(commit, chunkIdx, miner))
+		})
+	}
+	encode, ok := customCodec(encodeType, true)
+	if !ok {
+		return fmt.Errorf("unsupported encode type %d", encodeType)
+	}
+	if uint64(len(b)) > ds.kvSize {
+		return fmt.Errorf("write data too large")
+	}
+	cb := make([]byte, ds.kvSize)
+	copy(cb, b)
+	encoded, _, err := encode(kvIdx, cb, commit, miner, encodeType)
+	if err != nil {
+		return err
+	}
+	return ds.WriteWith(kvIdx, encoded, commit, func(cdata []byte, chunkIdx uint64) []byte {
+		return cdata
+	})
+}
+
 // readWith read the encoded data from storage with a decoder.
 func (ds *DataShard) readWith(kvIdx uint64, readLen int, decoder func([]byte, uint64) []byte) ([]byte, error) {
 	if !ds.Contains(kvIdx) {
@@ -383,16 +480,122 @@ func (ds *DataShard) WriteWith(kvIdx uint64, b []byte, commit common.Hash, encod
 		}
 	}
 	// This is not atomic, but we should get error since we already pre-allocate the space
-	return ds.WriteMeta(kvIdx, commit[:])
+	if err := ds.WriteMeta(kvIdx, commit[:]); err != nil {
+		return err
+	}
+	for _, df := range ds.dataFiles {
+		if df.ContainsKv(kvIdx) {
+			return df.blobWritten()
+		}
+	}
+	return nil
 }
 
 // Write a value of the KV to the store.  The value will be encoded with kvIdx and SP address.
 func (ds *DataShard) Write(kvIdx uint64, b []byte, commit common.Hash) error {
-	return ds.WriteWith(kvIdx, b, commit, func(cdata []byte, chunkIdx uint64) []byte {
-		encodeKey := calcEncodeKey(commit, chunkIdx, ds.Miner())
-		encodedChunk := encodeChunk(ds.chunkSize, cdata, ds.EncodeType(), encodeKey)
-		return encodedChunk
-	})
+	return ds.writeEncoded(kvIdx, b, commit, ds.EncodeTypeOf(kvIdx))
+}
+
+// StartReEncode marks the data files of the shard to be re-encoded to encodeType, and the kvs are read with the
+// encode type before re-encoding until re-encoded by ReEncodeKV. It resumes the re-encoding to encodeType if
+// interrupted, and returns false if the shard is of encodeType already.
+func (ds *DataShard) StartReEncode(encodeType uint64) (bool, error) {
+	if !isSupportedEncodeType(encodeType) {
+		return false, fmt.Errorf("unsupported encode type %d", encodeType)
+	}
+	if len(ds.dataFiles) == 0 {
+		return false, fmt.Errorf("shard %d has no data file", ds.shardIdx)
+	}
+	if target := ds.dataFiles[0].targetEncodeType(); ds.IsReEncoding() && target != encodeType {
+		return false, fmt.Errorf("shard %d is being re-encoded to encode type %d", ds.shardIdx, target)
+	}
+	started := false
+	for _, df := range ds.dataFiles {
+		if df.IsReEncoding() {
+			started = true
+		} else if df.encodeType != encodeType {
+			// the writes are rejected before any kv is re-encoded
+			ds.reEncoding.Store(true)
+			if err := df.setReEncodeNext(encodeType, df.KvIdxStart()); err != nil {
+				return false, err
+			}
+			started = true
+		}
+	}
+	return started, nil
+}
+
+// ReEncodeKV re-encodes the kv to the encode type the shard is re-encoded to and marks it re-encoded, the kvs must
+// be re-encoded in order. It returns true if the kv is rewritten, while the kvs never written are marked only.
+// The progress is written to the header of the data file every reEncodeCheckpointKvs kvs, so if the re-encoding was
+// interrupted, the kvs rewritten since the last checkpoint do not match their commits with the encode type before
+// re-encoding, and they are checked with the new one and not rewritten again. A corrupt kv is re-encoded as is, and
+// left to be healed.
+func (ds *DataShard) ReEncodeKV(kvIdx uint64) (bool, error) {
+	var df *DataFile
+	for _, f := range ds.dataFiles {
+		if f.ContainsKv(kvIdx) {
+			df = f
+			break
+		}
+	}
+	if df == nil {
+		return false, fmt.Errorf("kv not found: the shard is not completed?")
+	}
+	if !df.IsReEncoding() || kvIdx < df.reEncodeNext {
+		return false, nil
+	}
+	if kvIdx > df.reEncodeNext {
+		return false, fmt.Errorf("kv %d is re-encoded out of order, next kv %d", kvIdx, df.reEncodeNext)
+	}
+
+	meta, err := df.ReadMeta(kvIdx)
+	if err != nil {
+		return false, err
+	}
+	commit := common.BytesToHash(meta)
+	rewrite := commit != (common.Hash{})
+	if rewrite {
+		blob, err := ds.readDecoded(kvIdx, commit, df.encodeType)
+		if err != nil {
+			return false, err
+		}
+		if err = checkCommit(commit, blob); err != nil {
+			if reEncoded, rerr := ds.readDecoded(kvIdx, commit, df.reEncodeType); rerr == nil && checkCommit(commit, reEncoded) == nil {
+				rewrite = false
+			} else {
+				log.Warn("Re-encoding corrupt blob", "kvIndex", kvIdx, "err", err)
+			}
+		}
+		if rewrite {
+			if err = ds.writeEncoded(kvIdx, blob, commit, df.reEncodeType); err != nil {
+				return false, err
+			}
+		}
+	}
+	return rewrite, df.advanceReEncode(kvIdx + 1)
+}
+
+// CheckpointReEncode writes the progress of the re-encoding not written yet to the headers of the data files, e.g.
+// once the re-encoding is stopped.
+func (ds *DataShard) CheckpointReEncode() error {
+	for _, df := range ds.dataFiles {
+		if err := df.checkpointReEncode(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// FinishReEncode switches the encode type of the shard to the one re-encoded to once all its kvs are re-encoded.
+func (ds *DataShard) FinishReEncode() error {
+	for _, df := range ds.dataFiles {
+		if err := df.finishReEncode(); err != nil {
+			return err
+		}
+	}
+	ds.reEncoding.Store(false)
+	return nil
 }
 
 func (ds *DataShard) readChunk(chunkIdx uint64, readLen int) ([]byte, error) {
@@ -431,6 +634,39 @@ func (ds *DataShard) ReadMeta(kvIdx uint64) ([]byte, error) {
 	return nil, fmt.Errorf("kv not found: the shard is not completed?")
 }
 
+// FilledBitmap returns the bitmap of the kvs of the shard filled with an empty blob, in the same format as
+// StorageManager.ShardOccupancy. The kvs not covered by the data files are unset.
+func (ds *DataShard) FilledBitmap() ([]byte, error) {
+	bitmap := make([]byte, (ds.kvEntries+7)/8)
+	first := ds.shardIdx * ds.kvEntries
+	for _, df := range ds.dataFiles {
+		for kvIdx := df.KvIdxStart(); kvIdx < df.KvIdxEnd(); kvIdx++ {
+			i := kvIdx - first
+			if i >= ds.kvEntries {
+				continue
+			}
+			filled, err := df.IsFilled(kvIdx)
+			if err != nil {
+				return nil, err
+			}
+			if filled {
+				bitmap[i/8] |= 1 << (i % 8)
+			}
+		}
+	}
+	return bitmap, nil
+}
+
+// Sync flushes the blobs written to the data files of the shard to disk regardless of the fsync policy.
+func (ds *DataShard) Sync() error {
+	for _, df := range ds.dataFiles {
+		if err := df.Sync(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
 func (ds *DataShard) Close() error {
 	for _, df := range ds.dataFiles {
 		if err := df.Close(); err != nil {
@@ -0,0 +1,15 @@
+// Copyright 2022-2023, EthStorage.
+// For license information, see https://github.com/ethstorage/es-node/blob/main/LICENSE
+
+//go:build !linux && !darwin
+
+package ethstorage
+
+import (
+	"errors"
+)
+
+// freeDiskSpace is not supported on the platform, so the free disk check is skipped.
+func freeDiskSpace(path string) (uint64, error) {
+	return 0, errors.New("free disk space is not supported on the platform")
+}
@@ -0,0 +1,19 @@
+// Copyright 2022-2023, EthStorage.
+// For license information, see https://github.com/ethstorage/es-node/blob/main/LICENSE
+
+//go:build linux || darwin
+
+package ethstorage
+
+import (
+	"syscall"
+)
+
+// freeDiskSpace returns the bytes available to the unprivileged users on the file system of the path.
+func freeDiskSpace(path string) (uint64, error) {
+	var st syscall.Statfs_t
+	if err := syscall.Statfs(path, &st); err != nil {
+		return 0, err
+	}
+	return st.Bavail * uint64(st.Bsize), nil
+}
@@ -0,0 +1,118 @@
+// Copyright 2022-2023, EthStorage.
+// For license information, see https://github.com/ethstorage/es-node/blob/main/LICENSE
+
+package ethstorage
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/crypto"
+)
+
+// benchmarkBlobSize is the size of the blob to benchmark the encode types, which is the size of an EIP-4844 blob.
+const benchmarkBlobSize = 4096 * 32
+
+// EncodeBenchmark is the throughput of an encode type on the local hardware measured by BenchmarkEncode.
+type EncodeBenchmark struct {
+	EncodeType     uint64
+	Iterations     int
+	EncodeNsPerOp  int64   // time to encode a blob in nanoseconds
+	DecodeNsPerOp  int64   // time to decode a blob in nanoseconds
+	EncodeMBPerSec float64 // blob bytes encoded per second in MB
+	DecodeMBPerSec float64 // blob bytes decoded per second in MB
+}
+
+func (b *EncodeBenchmark) String() string {
+	return fmt.Sprintf("encodeType %d, iterations %d, encode %d ns/op %.2f MB/s, decode %d ns/op %.2f MB/s",
+		b.EncodeType, b.Iterations, b.EncodeNsPerOp, b.EncodeMBPerSec, b.DecodeNsPerOp, b.DecodeMBPerSec)
+}
+
+// BenchmarkEncode measures the throughput to encode and decode a blob of the encode type on the local hardware by
+// EncodeKV and DecodeKV, so operators can choose an encode type for their capacity. Each blob is encoded and decoded
+// with a distinct commit and kv index as a miner does, so the mask of ENCODE_ETHASH and ENCODE_BLOB_POSEIDON is not
+// reused between the iterations. It may take a long time for ENCODE_ETHASH as the ethash dataset is generated.
+func BenchmarkEncode(encodeType uint64, iterations int) (*EncodeBenchmark, error) {
+	if !isSupportedEncodeType(encodeType) {
+		return nil, fmt.Errorf("unsupported encode type %d", encodeType)
+	}
+	if iterations <= 0 {
+		return nil, errors.New("iterations should be positive")
+	}
+
+	// a standalone shard manager, so it is not registered to ContractToShardManager
+	kvSize, kvEntries := uint64(benchmarkBlobSize), nextPow2(uint64(iterations))
+	sm := &ShardManager{
+		shardMap:        map[uint64]*DataShard{0: NewDataShard(0, kvSize, kvEntries, kvSize)},
+		kvSizeBits:      checkAndGetBits(kvSize),
+		kvSize:          kvSize,
+		chunksPerKvBits: 0,
+		chunksPerKv:     1,
+		kvEntriesBits:   checkAndGetBits(kvEntries),
+		kvEntries:       kvEntries,
+		chunkSize:       kvSize,
+		chunkSizeBits:   checkAndGetBits(kvSize),
+	}
+
+	blob := make([]byte, kvSize)
+	if _, err := rand.Read(blob); err != nil {
+		return nil, err
+	}
+	// keep each 32 bytes a valid BLS field element as the blobs of EIP-4844
+	for i := 0; i < len(blob); i += 32 {
+		blob[i] = 0
+	}
+	miner := common.BytesToAddress(crypto.Keccak256(blob)[:common.AddressLength])
+
+	commits := make([]common.Hash, iterations)
+	encoded := make([][]byte, iterations)
+	for i := range commits {
+		commits[i] = crypto.Keccak256Hash(blob, binary.BigEndian.AppendUint64(nil, uint64(i)))
+	}
+
+	start := time.Now()
+	for i := 0; i < iterations; i++ {
+		data, ok, err := sm.EncodeKV(uint64(i), blob, commits[i], miner, encodeType)
+		if !ok || err != nil {
+			return nil, fmt.Errorf("encode blob failed: %v", err)
+		}
+		encoded[i] = data
+	}
+	encodeDur := time.Since(start)
+
+	start = time.Now()
+	for i := 0; i < iterations; i++ {
+		data, ok, err := sm.DecodeKV(uint64(i), encoded[i], commits[i], miner, encodeType)
+		if !ok || err != nil {
+			return nil, fmt.Errorf("decode blob failed: %v", err)
+		}
+		if !bytes.Equal(data, blob) {
+			return nil, errors.New("decoded blob does not match the original blob")
+		}
+	}
+	decodeDur := time.Since(start)
+
+	total := float64(kvSize) * float64(iterations)
+	return &EncodeBenchmark{
+		EncodeType:     encodeType,
+		Iterations:     iterations,
+		EncodeNsPerOp:  encodeDur.Nanoseconds() / int64(iterations),
+		DecodeNsPerOp:  decodeDur.Nanoseconds() / int64(iterations),
+		EncodeMBPerSec: total / 1e6 / encodeDur.Seconds(),
+		DecodeMBPerSec: total / 1e6 / decodeDur.Seconds(),
+	}, nil
+}
+
+// nextPow2 returns the smallest power of 2 not less than v.
+func nextPow2(v uint64) uint64 {
+	n := uint64(1)
+	for n < v {
+		n <<= 1
+	}
+	return n
+}
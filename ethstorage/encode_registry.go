@@ -0,0 +1,76 @@
+// Copyright 2022-2023, EthStorage.
+// For license information, see https://github.com/ethstorage/es-node/blob/main/LICENSE
+
+package ethstorage
+
+import (
+	"fmt"
+	"sync"
+
+	"github.com/ethereum/go-ethereum/common"
+)
+
+// DecoderFunc decodes the encoded kv data b of the kv index with the commit hash and the provider address, the same
+// as ShardManager.DecodeKV does with a built-in encode type.
+type DecoderFunc func(kvIdx uint64, b []byte, hash common.Hash, providerAddr common.Address, encodeType uint64) ([]byte, bool, error)
+
+// EncoderFunc encodes the raw kv data b of the kv index with the commit hash and the provider address, the same
+// as ShardManager.EncodeKV does with a built-in encode type.
+type EncoderFunc func(kvIdx uint64, b []byte, hash common.Hash, providerAddr common.Address, encodeType uint64) ([]byte, bool, error)
+
+var (
+	customCodecMu  sync.RWMutex
+	customDecoders = make(map[uint64]DecoderFunc)
+	customEncoders = make(map[uint64]EncoderFunc)
+)
+
+// RegisterDecoder registers fn to decode the kv data of the custom encode type by DecodeKV, so new encode types can be
+// experimented without forking. It panics if the encode type is a built-in one or fn is nil. The data files accept
+// the custom encode type once both its encoder and decoder are registered, and its kvs are encoded as a whole instead
+// of chunk by chunk.
+func RegisterDecoder(encodeType uint64, fn DecoderFunc) {
+	checkCustomEncodeType(encodeType, fn == nil)
+	customCodecMu.Lock()
+	defer customCodecMu.Unlock()
+	customDecoders[encodeType] = fn
+}
+
+// RegisterEncoder registers fn to encode the kv data of the custom encode type by EncodeKV, see RegisterDecoder.
+func RegisterEncoder(encodeType uint64, fn EncoderFunc) {
+	checkCustomEncodeType(encodeType, fn == nil)
+	customCodecMu.Lock()
+	defer customCodecMu.Unlock()
+	customEncoders[encodeType] = fn
+}
+
+func checkCustomEncodeType(encodeType uint64, nilFn bool) {
+	if encodeType <= ENCODE_END {
+		panic(fmt.Sprintf("cannot register built-in encode type %d", encodeType))
+	}
+	if nilFn {
+		panic(fmt.Sprintf("cannot register nil codec of encode type %d", encodeType))
+	}
+}
+
+// isSupportedEncodeType returns whether the encode type is a built-in one, or a custom one with both the encoder and
+// the decoder registered.
+func isSupportedEncodeType(encodeType uint64) bool {
+	if encodeType <= ENCODE_END {
+		return true
+	}
+	_, encoder := customCodec(encodeType, true)
+	_, decoder := customCodec(encodeType, false)
+	return encoder && decoder
+}
+
+// customCodec returns the registered decoder, or the encoder if encode, of the custom encode type.
+func customCodec(encodeType uint64, encode bool) (func(uint64, []byte, common.Hash, common.Address, uint64) ([]byte, bool, error), bool) {
+	customCodecMu.RLock()
+	defer customCodecMu.RUnlock()
+	if encode {
+		fn, ok := customEncoders[encodeType]
+		return fn, ok
+	}
+	fn, ok := customDecoders[encodeType]
+	return fn, ok
+}
@@ -188,6 +188,35 @@ var (
 		Value:  0,
 		EnvVar: prefixEnvVar("STORAGE_KV_ENTRIES"),
 	}
+	StorageFsync = cli.StringFlag{
+		Name:   "storage.fsync",
+		Usage:  "When to fsync the blobs written to the data files: never, always or batched",
+		Value:  "never",
+		EnvVar: prefixEnvVar("STORAGE_FSYNC"),
+	}
+	StorageFsyncBatchWrites = cli.IntFlag{
+		Name:   "storage.fsync-batch-writes",
+		Usage:  "Blobs written to fsync a batch in batched fsync mode, 0 means no limit",
+		Value:  64,
+		EnvVar: prefixEnvVar("STORAGE_FSYNC_BATCH_WRITES"),
+	}
+	StorageFsyncBatchInterval = cli.DurationFlag{
+		Name:   "storage.fsync-batch-interval",
+		Usage:  "Interval since the last fsync to fsync a batch in batched fsync mode, 0 means no limit",
+		Value:  time.Second,
+		EnvVar: prefixEnvVar("STORAGE_FSYNC_BATCH_INTERVAL"),
+	}
+	StorageWarmup = cli.BoolFlag{
+		Name:   "storage.warmup",
+		Usage:  "Validate the data files and read their metas into the page cache on startup, failing to start on a broken data file",
+		EnvVar: prefixEnvVar("STORAGE_WARMUP"),
+	}
+	StorageMinFreeDisk = cli.Uint64Flag{
+		Name:   "storage.min-free-disk",
+		Usage:  "Min free disk space in bytes of the data files to write the blobs, the sync of a shard is paused below it, 0 means no check",
+		Value:  0,
+		EnvVar: prefixEnvVar("STORAGE_MIN_FREE_DISK"),
+	}
 	L1EpochPollIntervalFlag = cli.DurationFlag{
 		Name:   "l1.epoch-poll-interval",
 		Usage:  "Poll interval for retrieving new L1 epoch updates such as safe and finalized block changes. Disabled if 0 or negative.",
@@ -255,6 +284,11 @@ var optionalFlags = []cli.Flag{
 	StorageKvSize,
 	StorageChunkSize,
 	StorageKvEntries,
+	StorageFsync,
+	StorageFsyncBatchWrites,
+	StorageFsyncBatchInterval,
+	StorageWarmup,
+	StorageMinFreeDisk,
 	RPCListenAddr,
 	RPCListenPort,
 	RPCESCallURL,
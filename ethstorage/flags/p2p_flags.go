@@ -177,6 +177,31 @@ var (
 		Value:    0,
 		EnvVar:   p2pEnv("Fill_Empty_Concurrency"),
 	}
+	FillEmptyConcurrencyWithPeers = cli.IntFlag{
+		Name: "p2p.fill-empty.concurrency-with-peers",
+		Usage: "The number of threads to fill encoded empty blobs while peers serving the unfinished sync tasks are " +
+			"connected, so that resources are pivoted to downloading real data. The default value 0 means fill empty " +
+			"always uses p2p.fill-empty.concurrency threads.",
+		Required: false,
+		Value:    0,
+		EnvVar:   p2pEnv("FILL_EMPTY_CONCURRENCY_WITH_PEERS"),
+	}
+	DecodeConcurrency = cli.IntFlag{
+		Name: "p2p.sync.decode-concurrency",
+		Usage: "The number of workers to concurrently decode and verify the blobs received from peers, so the " +
+			"decode overlaps with the network receive. The default value 0 means NumCPU.",
+		Required: false,
+		Value:    0,
+		EnvVar:   p2pEnv("SYNC_DECODE_CONCURRENCY"),
+	}
+	SyncWriteQueueSize = cli.IntFlag{
+		Name: "p2p.sync.write-queue-size",
+		Usage: "The number of batches of the decoded blobs queued to be written to disk, the receive of the blobs " +
+			"from peers blocks when the queue is full, so the memory is bounded when the disk is slower than the network.",
+		Required: false,
+		Value:    16,
+		EnvVar:   p2pEnv("SYNC_WRITE_QUEUE_SIZE"),
+	}
 	MetaDownloadBatchSize = cli.Uint64Flag{
 		Name:     "p2p.meta.download.batch",
 		Usage:    "Batch size for requesting the blob metadatas stored in the storage contract in one RPC call.",
@@ -184,6 +209,234 @@ var (
 		Value:    8000, // The upper limit of devnet-11 geth node
 		EnvVar:   p2pEnv("META_BATCH_SIZE"),
 	}
+	SyncVerifyStrictness = cli.StringFlag{
+		Name: "p2p.sync.verify",
+		Usage: "Per-shard verification strictness of synced blobs in the format of [<contract>:]<shardId>:<level>;..., " +
+			"where level is one of full (verify all blobs), sampled (verify a fraction of blobs) or trusted (verify " +
+			"blobs from suspicious peers and 1% of the others). Shards without a contract are of the storage contract. Shards not listed use full.",
+		Required: false,
+		Value:    "",
+		EnvVar:   p2pEnv("SYNC_VERIFY"),
+	}
+	SyncIndexHeaderShards = cli.StringFlag{
+		Name: "p2p.sync.index-header-shards",
+		Usage: "Comma separated shards in the format of [<contract>:]<shardId> whose blobs embed the contract address and " +
+			"the big endian kv index at the start, the embedded header of the synced blobs of these shards is checked " +
+			"against the requested kv index. Shards without a contract are of the storage contract.",
+		Required: false,
+		Value:    "",
+		EnvVar:   p2pEnv("SYNC_INDEX_HEADER_SHARDS"),
+	}
+	SyncMaxInvalidBlobsPerPeer = cli.IntFlag{
+		Name: "p2p.sync.max-invalid-blobs-per-peer",
+		Usage: "The number of the blobs failing the commit verification allowed from a peer, once exceeded the peer " +
+			"is disconnected and banned. The value 0 means peers are never banned for invalid blobs.",
+		Required: false,
+		Value:    16,
+		EnvVar:   p2pEnv("SYNC_MAX_INVALID_BLOBS_PER_PEER"),
+	}
+	SyncSchedulePolicy = cli.StringFlag{
+		Name: "p2p.sync.schedule",
+		Usage: "How the requests to the idle peers are shared among the shards to sync, one of round-robin (serve the " +
+			"shards in turn) or weighted (serve the shards in proportion to their remaining blobs).",
+		Required: false,
+		Value:    "round-robin",
+		EnvVar:   p2pEnv("SYNC_SCHEDULE"),
+	}
+	SyncEncodeTypePolicy = cli.StringFlag{
+		Name: "p2p.sync.encode-type-policy",
+		Usage: "How the peers storing a shard with a different encode type are requested, one of re-encode (request " +
+			"any peer and re-encode the blobs), reject-mismatch (never request such peers) or prefer-match (request " +
+			"the peers with the same encode type first).",
+		Required: false,
+		Value:    "re-encode",
+		EnvVar:   p2pEnv("SYNC_ENCODE_TYPE_POLICY"),
+	}
+	SyncStatusAddr = cli.StringFlag{
+		Name:     "p2p.sync.status.addr",
+		Usage:    "Address (host:port) of the http server to serve the sync status as JSON at /sync/status, empty to disable it.",
+		Required: false,
+		Value:    "",
+		EnvVar:   p2pEnv("SYNC_STATUS_ADDR"),
+	}
+	SyncServeSnapshot = cli.BoolFlag{
+		Name:     "p2p.sync.status.serve-snapshot",
+		Usage:    "Serve the gzip-compressed snapshots of the local shards at /sync/snapshot?shard=<index> of the sync status server, for new nodes to bootstrap the shards from.",
+		Required: false,
+		EnvVar:   p2pEnv("SYNC_STATUS_SERVE_SNAPSHOT"),
+	}
+	SyncSelfTest = cli.BoolFlag{
+		Name:     "p2p.sync.self-test",
+		Usage:    "Validate the sync end to end on startup by syncing synthetic blobs between in-process peers, the node fails to start if it does not pass.",
+		Required: false,
+		EnvVar:   p2pEnv("SYNC_SELF_TEST"),
+	}
+	SyncVerifySampleRate = cli.Float64Flag{
+		Name:     "p2p.sync.verify.sample-rate",
+		Usage:    "Fraction of blobs to verify for shards using the sampled verification strictness, in the range of (0, 1].",
+		Required: false,
+		Value:    0.1,
+		EnvVar:   p2pEnv("SYNC_VERIFY_SAMPLE_RATE"),
+	}
+	SyncListBatchSize = cli.Uint64Flag{
+		Name: "p2p.sync.list-batch-size",
+		Usage: "The max number of blobs in a blobs by list request when requesting a list of blobs from peers, the " +
+			"default value 0 means the number of blobs fit in p2p.request.size.",
+		Required: false,
+		Value:    0,
+		EnvVar:   p2pEnv("SYNC_LIST_BATCH_SIZE"),
+	}
+	SyncMinRangeBatchSize = cli.Uint64Flag{
+		Name:     "p2p.sync.min-range-batch-size",
+		Usage:    "The min number of blobs in a blobs by range request, as the batch size is adapted to the latency of each peer.",
+		Required: false,
+		Value:    0,
+		EnvVar:   p2pEnv("SYNC_MIN_RANGE_BATCH_SIZE"),
+	}
+	SyncMaxRangeBatchSize = cli.Uint64Flag{
+		Name: "p2p.sync.max-range-batch-size",
+		Usage: "The max number of blobs in a blobs by range request, as the batch size is adapted to the latency of each " +
+			"peer, the default value 0 means twice of the blobs fit in a max sized response.",
+		Required: false,
+		Value:    0,
+		EnvVar:   p2pEnv("SYNC_MAX_RANGE_BATCH_SIZE"),
+	}
+	SyncMinVerifiedRatio = cli.Float64Flag{
+		Name: "p2p.sync.min-verified-ratio",
+		Usage: "Fraction of the blobs below the last kv index of a shard that must be present and verified locally before " +
+			"the shard is advertised as synced to the miner, in the range of (0, 1].",
+		Required: false,
+		Value:    1,
+		EnvVar:   p2pEnv("SYNC_MIN_VERIFIED_RATIO"),
+	}
+	SyncSummaryLogInterval = cli.DurationFlag{
+		Name:     "p2p.sync.summary-interval",
+		Usage:    "Interval to log a summary of the sync health, including peers, shards done, download rate, heal backlog and ETA.",
+		Required: false,
+		Value:    time.Minute,
+		EnvVar:   p2pEnv("SYNC_SUMMARY_INTERVAL"),
+	}
+	SyncStallTimeout = cli.DurationFlag{
+		Name:     "p2p.sync.stall-timeout",
+		Usage:    "Interval without any blob synced from peers before the sync is treated as stalled and new peers are discovered.",
+		Required: false,
+		Value:    5 * time.Minute,
+		EnvVar:   p2pEnv("SYNC_STALL_TIMEOUT"),
+	}
+	SyncProgressSaveInterval = cli.DurationFlag{
+		Name: "p2p.sync.progress-save-interval",
+		Usage: "Delay to save the sync status after blobs are committed, so a failure in the middle of a large sync " +
+			"task resumes from the last committed blob instead of the start of the task.",
+		Required: false,
+		Value:    10 * time.Second,
+		EnvVar:   p2pEnv("SYNC_PROGRESS_SAVE_INTERVAL"),
+	}
+	SyncMaxDispatchJitter = cli.DurationFlag{
+		Name: "p2p.sync.max-jitter",
+		Usage: "Max random delay added to a sync request dispatched in a burst, e.g. many sync tasks become ready at " +
+			"once on restart, to spread the load on peers. Sparse requests are not delayed, and 0 disables the jitter.",
+		Required: false,
+		Value:    50 * time.Millisecond,
+		EnvVar:   p2pEnv("SYNC_MAX_JITTER"),
+	}
+	SyncMaxHealAttempts = cli.IntFlag{
+		Name: "p2p.sync.max-heal-attempts",
+		Usage: "Max requests of a blob failed to fetch before it is given up as permanently missing and reported, " +
+			"instead of being retried forever. 0 retries forever.",
+		Required: false,
+		Value:    32,
+		EnvVar:   p2pEnv("SYNC_MAX_HEAL_ATTEMPTS"),
+	}
+	SyncMinPeers = cli.IntFlag{
+		Name: "p2p.sync.min-peers",
+		Usage: "Min number of peers serving the local shards connected before the sync starts, so the sync does " +
+			"not start with a single flaky peer. 0 starts the sync at once.",
+		Required: false,
+		Value:    0,
+		EnvVar:   p2pEnv("SYNC_MIN_PEERS"),
+	}
+	SyncMinPeersTimeout = cli.DurationFlag{
+		Name:     "p2p.sync.min-peers-timeout",
+		Usage:    "Max time to wait for p2p.sync.min-peers peers, after which the sync starts anyway.",
+		Required: false,
+		Value:    time.Minute,
+		EnvVar:   p2pEnv("SYNC_MIN_PEERS_TIMEOUT"),
+	}
+	SyncMaxLoad = cli.Float64Flag{
+		Name: "p2p.sync.max-load",
+		Usage: "Max 1-minute load average of the system per CPU, above which the sync backs off to a single in-flight " +
+			"request to leave the CPU and disk to the other services on a shared machine. 0 never throttles the sync.",
+		Required: false,
+		Value:    0,
+		EnvVar:   p2pEnv("SYNC_MAX_LOAD"),
+	}
+	SyncMaxPeersPerSubTask = cli.IntFlag{
+		Name: "p2p.sync.max-peers-per-subtask",
+		Usage: "Max number of idle peers the rest of a subTask is split among to request in parallel, so a subTask " +
+			"finishes faster with many peers. 1 requests a subTask from one peer at a time.",
+		Required: false,
+		Value:    1,
+		EnvVar:   p2pEnv("SYNC_MAX_PEERS_PER_SUBTASK"),
+	}
+	SyncMaxStatusSize = cli.IntFlag{
+		Name:     "p2p.sync.max-status-size",
+		Usage:    "Max size in bytes of the sync status saved to the DB, above which a warning is logged.",
+		Required: false,
+		Value:    16 * 1024 * 1024,
+		EnvVar:   p2pEnv("SYNC_MAX_STATUS_SIZE"),
+	}
+	SyncFollow = cli.BoolFlag{
+		Name: "p2p.sync.follow",
+		Usage: "Keep following the growth of the last kv index after the sync is done, and sync the blobs appended " +
+			"to the contract from peers, so the node stays current without a restart.",
+		Required: false,
+		EnvVar:   p2pEnv("SYNC_FOLLOW"),
+	}
+	SyncRetryCooldown = cli.DurationFlag{
+		Name: "p2p.sync.retry-cooldown",
+		Usage: "Time the retries of the blobs failed by a peer are routed to the other capable peers before the peer " +
+			"is requested again.",
+		Required: false,
+		Value:    30 * time.Second,
+		EnvVar:   p2pEnv("SYNC_RETRY_COOLDOWN"),
+	}
+	SyncKeepAliveInterval = cli.DurationFlag{
+		Name: "p2p.sync.keep-alive-interval",
+		Usage: "Interval to ping the idle sync peers, so their connections are not dropped by NATs and firewalls " +
+			"while there is nothing to sync. 0 disables the keep-alive.",
+		Required: false,
+		Value:    0,
+		EnvVar:   p2pEnv("SYNC_KEEP_ALIVE_INTERVAL"),
+	}
+	SyncFollowInterval = cli.DurationFlag{
+		Name:     "p2p.sync.follow-interval",
+		Usage:    "Interval to check the growth of the last kv index with p2p.sync.follow.",
+		Required: false,
+		Value:    30 * time.Second,
+		EnvVar:   p2pEnv("SYNC_FOLLOW_INTERVAL"),
+	}
+	SyncAllowlist = cli.StringFlag{
+		Name: "p2p.sync.allowlist",
+		Usage: "Comma-separated peer IDs to sync blobs with. If set, the other peers are still connected for gossip, " +
+			"but they are not used to sync and their sync requests are rejected. Empty to sync with all the peers.",
+		Required: false,
+		EnvVar:   p2pEnv("SYNC_ALLOWLIST"),
+	}
+	SyncPeersOvershoot = cli.IntFlag{
+		Name: "p2p.sync.peers-overshoot",
+		Usage: "The number of extra peers allowed beyond p2p.peers.hi while syncing to grab more seeders, the extra " +
+			"peers are disconnected once the sync is done.",
+		Required: false,
+		Value:    0,
+		EnvVar:   p2pEnv("SYNC_PEERS_OVERSHOOT"),
+	}
+	SyncPreferRange = cli.BoolFlag{
+		Name: "p2p.sync.prefer-range",
+		Usage: "Advertise to peers that blobs by range requests are preferred, as the sequential IO is cheaper to serve " +
+			"than blobs by list requests, so peers send contiguous indexes as a range request.",
+		Required: false,
+		EnvVar:   p2pEnv("SYNC_PREFER_RANGE"),
+	}
 	PeersLo = cli.UintFlag{
 		Name:     "p2p.peers.lo",
 		Usage:    "Low-tide peer count. The node actively searches for new peer connections if below this amount.",
@@ -261,6 +514,20 @@ var (
 		Value:     "esnode_discovery_db",
 		EnvVar:    p2pEnv("DISCOVERY_PATH"),
 	}
+	DiscoveryDialConcurrency = cli.UintFlag{
+		Name:     "p2p.discovery.dial-concurrency",
+		Usage:    "Number of the discovered peers dialed concurrently.",
+		Required: false,
+		Value:    4,
+		EnvVar:   p2pEnv("DISCOVERY_DIAL_CONCURRENCY"),
+	}
+	DiscoveryDialsPerMinute = cli.UintFlag{
+		Name:     "p2p.discovery.dials-per-minute",
+		Usage:    "Max dials of the discovered peers in a minute, the peers serving more local shards are dialed first. 0 means unlimited.",
+		Required: false,
+		Value:    0,
+		EnvVar:   p2pEnv("DISCOVERY_DIALS_PER_MINUTE"),
+	}
 	SequencerP2PKeyFlag = cli.StringFlag{
 		Name:     "p2p.sequencer.key",
 		Usage:    "Hex-encoded private key for signing off on p2p application messages as sequencer.",
@@ -348,7 +615,40 @@ var p2pFlags = []cli.Flag{
 	InitRequestSize,
 	SyncConcurrency,
 	FillEmptyConcurrency,
+	FillEmptyConcurrencyWithPeers,
+	DecodeConcurrency,
+	SyncWriteQueueSize,
 	MetaDownloadBatchSize,
+	SyncVerifyStrictness,
+	SyncIndexHeaderShards,
+	SyncMaxInvalidBlobsPerPeer,
+	SyncSchedulePolicy,
+	SyncEncodeTypePolicy,
+	SyncStatusAddr,
+	SyncServeSnapshot,
+	SyncSelfTest,
+	SyncVerifySampleRate,
+	SyncMinVerifiedRatio,
+	SyncSummaryLogInterval,
+	SyncStallTimeout,
+	SyncProgressSaveInterval,
+	SyncMaxDispatchJitter,
+	SyncMaxHealAttempts,
+	SyncMinPeers,
+	SyncMinPeersTimeout,
+	SyncMaxLoad,
+	SyncMaxPeersPerSubTask,
+	SyncMaxStatusSize,
+	SyncRetryCooldown,
+	SyncKeepAliveInterval,
+	SyncFollow,
+	SyncFollowInterval,
+	SyncAllowlist,
+	SyncPeersOvershoot,
+	SyncListBatchSize,
+	SyncMinRangeBatchSize,
+	SyncMaxRangeBatchSize,
+	SyncPreferRange,
 	PeersLo,
 	PeersHi,
 	PeersGrace,
@@ -359,6 +659,8 @@ var p2pFlags = []cli.Flag{
 	TimeoutDial,
 	PeerstorePath,
 	DiscoveryPath,
+	DiscoveryDialConcurrency,
+	DiscoveryDialsPerMinute,
 	SequencerP2PKeyFlag,
 	GossipMeshDFlag,
 	GossipMeshDloFlag,
@@ -38,6 +38,12 @@ type Metricer interface {
 	ClientOnBlobsByRange(peerID string, reqCount, getBlobCount, insertedCount uint64, duration time.Duration)
 	ClientOnBlobsByList(peerID string, reqCount, getBlobCount, insertedCount uint64, duration time.Duration)
 	ClientRecordTimeUsed(method string) func()
+	ClientBlobsReceived(count, bytes uint64)
+	ClientSetHealTaskSize(contract common.Address, shardId uint64, size int)
+	ClientAltEncodeTypeDecode(encodeType uint64, recovered bool)
+	ClientSetWriteQueueDepth(depth int)
+	ClientResponseFailure(peerID string, failure string)
+	ClientCommitMismatch(peerID string)
 	IncDropPeerCount()
 	IncPeerCount()
 	DecPeerCount()
@@ -45,6 +51,9 @@ type Metricer interface {
 	ServerGetBlobsByListEvent(peerID string, resultCode byte, duration time.Duration)
 	ServerReadBlobs(peerID string, read, sucRead uint64, timeUse time.Duration)
 	ServerRecordTimeUsed(method string) func()
+	ServerBlobsServed(count, bytes uint64)
+	ServerBlobCacheLookup(hit bool)
+	ServerSetStreams(active, queued int)
 	Document() []metrics.DocumentedMetric
 	RecordGossipEvent(evType int32)
 	SetPeerScores(map[string]float64)
@@ -85,6 +94,15 @@ type Metrics struct {
 	SyncClientPerfCallTotal           *prometheus.CounterVec
 	SyncClientPerfCallDurationSeconds *prometheus.HistogramVec
 
+	SyncClientBlobsReceivedTotal prometheus.Counter
+	SyncClientBytesInTotal       prometheus.Counter
+	SyncClientHealTaskSize       *prometheus.GaugeVec
+	SyncClientAltEncodeTotal     *prometheus.CounterVec
+	SyncClientWriteQueueDepth    prometheus.Gauge
+
+	SyncClientResponseFailuresTotal *prometheus.CounterVec
+	SyncClientCommitMismatchesTotal *prometheus.CounterVec
+
 	PeerCount      prometheus.Gauge
 	DropPeerCount  prometheus.Counter
 	BandwidthTotal *prometheus.GaugeVec
@@ -97,6 +115,10 @@ type Metrics struct {
 	SyncServerHandleReqStatePerPeer           *prometheus.GaugeVec
 	SyncServerPerfCallTotal                   *prometheus.CounterVec
 	SyncServerPerfCallDurationSeconds         *prometheus.HistogramVec
+	SyncServerBlobsServedTotal                prometheus.Counter
+	SyncServerBytesOutTotal                   prometheus.Counter
+	SyncServerBlobCacheTotal                  *prometheus.CounterVec
+	SyncServerStreams                         *prometheus.GaugeVec
 
 	Info *prometheus.GaugeVec
 	Up   prometheus.Gauge
@@ -294,6 +316,66 @@ func NewMetrics(procName string) *Metrics {
 			"method",
 		}),
 
+		SyncClientBlobsReceivedTotal: factory.NewCounter(prometheus.CounterOpts{
+			Namespace: ns,
+			Subsystem: SyncClientSubsystem,
+			Name:      "blobs_received_total",
+			Help:      "Number of blobs received from peers",
+		}),
+
+		SyncClientBytesInTotal: factory.NewCounter(prometheus.CounterOpts{
+			Namespace: ns,
+			Subsystem: SyncClientSubsystem,
+			Name:      "bytes_in_total",
+			Help:      "Bytes of encoded blobs received from peers",
+		}),
+
+		SyncClientHealTaskSize: factory.NewGaugeVec(prometheus.GaugeOpts{
+			Namespace: ns,
+			Subsystem: SyncClientSubsystem,
+			Name:      "heal_task_size",
+			Help:      "Number of blobs waiting to be healed of shards",
+		}, []string{
+			"contract",
+			"shard_id",
+		}),
+
+		SyncClientAltEncodeTotal: factory.NewCounterVec(prometheus.CounterOpts{
+			Namespace: ns,
+			Subsystem: SyncClientSubsystem,
+			Name:      "alt_encode_decode_total",
+			Help:      "Number of attempts to decode blobs failed verification with an alternative encode type",
+		}, []string{
+			"encode_type",
+			"result",
+		}),
+
+		SyncClientWriteQueueDepth: factory.NewGauge(prometheus.GaugeOpts{
+			Namespace: ns,
+			Subsystem: SyncClientSubsystem,
+			Name:      "write_queue_depth",
+			Help:      "Number of batches of the received blobs waiting to be written to disk",
+		}),
+
+		SyncClientResponseFailuresTotal: factory.NewCounterVec(prometheus.CounterOpts{
+			Namespace: ns,
+			Subsystem: SyncClientSubsystem,
+			Name:      "response_failures_total",
+			Help:      "Number of the responses failed by stream resets, partial or malformed responses of a peer",
+		}, []string{
+			"peer_id",
+			"failure",
+		}),
+
+		SyncClientCommitMismatchesTotal: factory.NewCounterVec(prometheus.CounterOpts{
+			Namespace: ns,
+			Subsystem: SyncClientSubsystem,
+			Name:      "commit_mismatches_total",
+			Help:      "Number of the blobs delivered by a peer which mismatch their commits and are healed from the other peers",
+		}, []string{
+			"peer_id",
+		}),
+
 		PeerCount: factory.NewGauge(prometheus.GaugeOpts{
 			Namespace: ns,
 			Subsystem: SyncClientSubsystem,
@@ -390,6 +472,38 @@ func NewMetrics(procName string) *Metrics {
 			"method",
 		}),
 
+		SyncServerBlobsServedTotal: factory.NewCounter(prometheus.CounterOpts{
+			Namespace: ns,
+			Subsystem: SyncServerSubsystem,
+			Name:      "blobs_served_total",
+			Help:      "Number of blobs served to peers",
+		}),
+
+		SyncServerBytesOutTotal: factory.NewCounter(prometheus.CounterOpts{
+			Namespace: ns,
+			Subsystem: SyncServerSubsystem,
+			Name:      "bytes_out_total",
+			Help:      "Bytes of encoded blobs served to peers",
+		}),
+
+		SyncServerBlobCacheTotal: factory.NewCounterVec(prometheus.CounterOpts{
+			Namespace: ns,
+			Subsystem: SyncServerSubsystem,
+			Name:      "blob_cache_total",
+			Help:      "Number of encoded blob cache lookups grouped by result",
+		}, []string{
+			"result",
+		}),
+
+		SyncServerStreams: factory.NewGaugeVec(prometheus.GaugeOpts{
+			Namespace: ns,
+			Subsystem: SyncServerSubsystem,
+			Name:      "streams",
+			Help:      "Number of the sync streams being served or queued for a handler slot",
+		}, []string{
+			"state",
+		}),
+
 		PeerScores: factory.NewGaugeVec(prometheus.GaugeOpts{
 			Namespace: ns,
 			Subsystem: "p2p",
@@ -547,6 +661,35 @@ func (m *Metrics) ClientRecordTimeUsed(method string) func() {
 	}
 }
 
+func (m *Metrics) ClientBlobsReceived(count, bytes uint64) {
+	m.SyncClientBlobsReceivedTotal.Add(float64(count))
+	m.SyncClientBytesInTotal.Add(float64(bytes))
+}
+
+func (m *Metrics) ClientSetHealTaskSize(contract common.Address, shardId uint64, size int) {
+	m.SyncClientHealTaskSize.WithLabelValues(contract.Hex(), fmt.Sprintf("%d", shardId)).Set(float64(size))
+}
+
+func (m *Metrics) ClientAltEncodeTypeDecode(encodeType uint64, recovered bool) {
+	result := "failed"
+	if recovered {
+		result = "recovered"
+	}
+	m.SyncClientAltEncodeTotal.WithLabelValues(fmt.Sprintf("%d", encodeType), result).Inc()
+}
+
+func (m *Metrics) ClientSetWriteQueueDepth(depth int) {
+	m.SyncClientWriteQueueDepth.Set(float64(depth))
+}
+
+func (m *Metrics) ClientResponseFailure(peerID string, failure string) {
+	m.SyncClientResponseFailuresTotal.WithLabelValues(peerID, failure).Inc()
+}
+
+func (m *Metrics) ClientCommitMismatch(peerID string) {
+	m.SyncClientCommitMismatchesTotal.WithLabelValues(peerID).Inc()
+}
+
 func (m *Metrics) IncDropPeerCount() {
 	m.DropPeerCount.Inc()
 }
@@ -596,6 +739,24 @@ func (m *Metrics) ServerRecordTimeUsed(method string) func() {
 	}
 }
 
+func (m *Metrics) ServerBlobsServed(count, bytes uint64) {
+	m.SyncServerBlobsServedTotal.Add(float64(count))
+	m.SyncServerBytesOutTotal.Add(float64(bytes))
+}
+
+func (m *Metrics) ServerBlobCacheLookup(hit bool) {
+	result := "miss"
+	if hit {
+		result = "hit"
+	}
+	m.SyncServerBlobCacheTotal.WithLabelValues(result).Inc()
+}
+
+func (m *Metrics) ServerSetStreams(active, queued int) {
+	m.SyncServerStreams.WithLabelValues("active").Set(float64(active))
+	m.SyncServerStreams.WithLabelValues("queued").Set(float64(queued))
+}
+
 func (m *Metrics) RecordBandwidth(ctx context.Context, bwc *libp2pmetrics.BandwidthCounter) {
 	tick := time.NewTicker(10 * time.Second)
 	defer tick.Stop()
@@ -662,6 +823,24 @@ func (n *noopMetricer) ClientRecordTimeUsed(method string) func() {
 	return func() {}
 }
 
+func (n *noopMetricer) ClientBlobsReceived(count, bytes uint64) {
+}
+
+func (n *noopMetricer) ClientSetHealTaskSize(contract common.Address, shardId uint64, size int) {
+}
+
+func (n *noopMetricer) ClientAltEncodeTypeDecode(encodeType uint64, recovered bool) {
+}
+
+func (n *noopMetricer) ClientSetWriteQueueDepth(depth int) {
+}
+
+func (n *noopMetricer) ClientResponseFailure(peerID string, failure string) {
+}
+
+func (n *noopMetricer) ClientCommitMismatch(peerID string) {
+}
+
 func (n *noopMetricer) IncDropPeerCount() {
 }
 
@@ -684,6 +863,15 @@ func (n *noopMetricer) ServerRecordTimeUsed(method string) func() {
 	return func() {}
 }
 
+func (n *noopMetricer) ServerBlobsServed(count, bytes uint64) {
+}
+
+func (n *noopMetricer) ServerBlobCacheLookup(hit bool) {
+}
+
+func (n *noopMetricer) ServerSetStreams(active, queued int) {
+}
+
 func (m *noopMetricer) RecordGossipEvent(evType int32) {
 }
 
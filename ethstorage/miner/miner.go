@@ -59,6 +59,7 @@ type Miner struct {
 	exitCh      chan struct{}
 	startCh     chan struct{}
 	stopCh      chan struct{}
+	addShardCh  chan uint64
 	ChainHeadCh chan eth.L1BlockRef
 	wg          sync.WaitGroup
 	lg          log.Logger
@@ -82,6 +83,7 @@ func New(
 		exitCh:      make(chan struct{}),
 		startCh:     make(chan struct{}),
 		stopCh:      make(chan struct{}),
+		addShardCh:  make(chan uint64),
 		lg:          lg,
 		worker:      newWorker(*config, db, storageMgr, api, dr, chainHeadCh, prover, lg),
 	}
@@ -91,9 +93,9 @@ func New(
 }
 
 // update keeps track of the downloader events. Please be aware that this is a one shot type of update loop.
-// It's entered once and as soon as `Done` or `Failed` has been broadcasted the events are unregistered and
-// the loop is exited. This to prevent a major security vuln where external parties can DOS you with blocks
-// and halt your mining operation for as long as the DOS continues.
+// It's entered once and as soon as `Done` or `Failed` has been broadcasted the events are unregistered. This
+// to prevent a major security vuln where external parties can DOS you with blocks and halt your mining operation
+// for as long as the DOS continues. The shards added to the sync at runtime are delivered by AddShard instead.
 func (miner *Miner) update() {
 	// Subscribe es SyncDone event
 	syncEventCh := make(chan protocol.EthStorageSyncDone)
@@ -106,21 +108,26 @@ func (miner *Miner) update() {
 
 	shouldStart := false
 	canStart := false
+	shardReady := func(shardId uint64) {
+		miner.worker.startCh <- shardId
+		miner.lg.Info("Miner update loop", "shardIsReady", shardId)
+		canStart = true
+		if shouldStart && !miner.worker.isRunning() {
+			miner.worker.start()
+		}
+	}
 
 	for {
 		miner.lg.Debug("Miner update loop", "shouldStart", shouldStart, "canStart", canStart)
 		select {
 		case syncDone := <-syncEventCh:
 			if syncDone.DoneType == protocol.SingleShardDone {
-				miner.worker.startCh <- syncDone.ShardId
-				miner.lg.Info("Miner update loop", "shardIsReady", syncDone.ShardId)
-				canStart = true
-				if shouldStart && !miner.worker.isRunning() {
-					miner.worker.start()
-				}
+				shardReady(syncDone.ShardId)
 			} else {
 				sub.Unsubscribe()
 			}
+		case shardId := <-miner.addShardCh:
+			shardReady(shardId)
 		case <-miner.startCh:
 			if canStart {
 				miner.worker.start()
@@ -136,6 +143,16 @@ func (miner *Miner) update() {
 	}
 }
 
+// AddShard starts mining a shard added to the sync at runtime once it is synced, e.g. notified by
+// SyncClient.OnShardSynced, as the SyncDone events are no longer handled after all the shards are done.
+// It is a no-op for a shard already mined.
+func (miner *Miner) AddShard(shardId uint64) {
+	select {
+	case miner.addShardCh <- shardId:
+	case <-miner.exitCh:
+	}
+}
+
 // miner must be started before p2p sync so that it can receive the SyncDone event
 func (miner *Miner) Start() {
 	miner.startCh <- struct{}{}
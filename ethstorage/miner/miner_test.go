@@ -106,7 +106,7 @@ func TestMiner_update(t *testing.T) {
 	})
 	// worker started
 	checkMiningState(t, miner, true)
-	if _, ok := miner.worker.shardTaskMap[shard[0]]; !ok {
+	if !miner.worker.hasShardTask(shard[0]) {
 		t.Error("Shard should be in the shardTaskMap")
 	}
 	miner.Stop()
@@ -120,7 +120,7 @@ func TestMiner_update(t *testing.T) {
 	// not start
 	checkMiningState(t, miner, false)
 	// but task is ready to start
-	if _, ok := miner.worker.shardTaskMap[shard[1]]; !ok {
+	if !miner.worker.hasShardTask(shard[1]) {
 		t.Errorf("Shard %d should be in the shardTaskMap", shard[1])
 	}
 	miner.Start()
@@ -137,8 +137,17 @@ func TestMiner_update(t *testing.T) {
 	})
 	checkMiningState(t, miner, true)
 	// No effect since unsubscribed
-	if _, ok := miner.worker.shardTaskMap[shard[2]]; ok {
-		t.Errorf("Shard %d should NOT be in the shardTaskMap", shard[1])
+	if miner.worker.hasShardTask(shard[2]) {
+		t.Errorf("Shard %d should NOT be in the shardTaskMap", shard[2])
+	}
+
+	//  Case: shard added at runtime after AllShardDone
+	miner.AddShard(shard[2])
+	for i := 0; i < 100 && !miner.worker.hasShardTask(shard[2]); i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if !miner.worker.hasShardTask(shard[2]) {
+		t.Errorf("Shard %d should be in the shardTaskMap", shard[2])
 	}
 	miner.Close()
 	checkMiningState(t, miner, false)
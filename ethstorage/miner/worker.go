@@ -106,7 +106,8 @@ type worker struct {
 	startCh     chan uint64
 	exitCh      chan struct{}
 
-	shardTaskMap map[uint64]task
+	shardTaskLock sync.RWMutex
+	shardTaskMap  map[uint64]task // written by newWorkLoop under shardTaskLock, read by others under it
 
 	resultCh   chan struct{}
 	resultLock sync.Mutex
@@ -184,6 +185,14 @@ func (w *worker) isRunning() bool {
 	return atomic.LoadInt32(&w.running) == 1
 }
 
+// hasShardTask returns whether the task loops of the shard are started.
+func (w *worker) hasShardTask(shardIdx uint64) bool {
+	w.shardTaskLock.RLock()
+	defer w.shardTaskLock.RUnlock()
+	_, ok := w.shardTaskMap[shardIdx]
+	return ok
+}
+
 func (w *worker) close() {
 	w.stop()
 	w.lg.Warn("Worker is being closed...")
@@ -230,6 +239,9 @@ func (w *worker) newWorkLoop() {
 	for {
 		select {
 		case shardIdx := <-w.startCh:
+			if _, ok := w.shardTaskMap[shardIdx]; ok {
+				break
+			}
 			miner, _ := w.storageMgr.GetShardMiner(shardIdx)
 			var taskChs []chan *taskItem
 			for i := uint64(0); i < w.config.ThreadsPerShard; i++ {
@@ -245,7 +257,9 @@ func (w *worker) newWorkLoop() {
 				shardIdx: shardIdx,
 				taskChs:  taskChs,
 			}
+			w.shardTaskLock.Lock()
 			w.shardTaskMap[shardIdx] = task
+			w.shardTaskLock.Unlock()
 		case block := <-w.chainHeadCh:
 			if !w.isRunning() {
 				break
@@ -255,6 +269,11 @@ func (w *worker) newWorkLoop() {
 			// 1) a mining tx is already submitted; or
 			// 2) if the last mining time is too close (the reward is not enough).
 			for shardIdx, task := range w.shardTaskMap {
+				// the samples of a shard being re-encoded are of different encode types until it is finished
+				if w.storageMgr.IsShardReEncoding(shardIdx) {
+					w.lg.Warn("Skip mining the shard being re-encoded", "shard", shardIdx, "block", block.Number)
+					continue
+				}
 				reqDiff, err := w.updateDifficulty(shardIdx, block.Time)
 				if err != nil {
 					continue
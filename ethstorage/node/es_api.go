@@ -40,6 +40,12 @@ func NewESAPI(config *RPCConfig, sm *ethstorage.StorageManager, dl *downloader.D
 	}
 }
 
+// GetShardOccupancy returns the occupancy bitmap of a local shard for monitoring, see
+// StorageManager.ShardOccupancy for the format.
+func (api *esAPI) GetShardOccupancy(shardIdx uint64) (hexutil.Bytes, error) {
+	return api.sm.ShardOccupancy(shardIdx)
+}
+
 func (api *esAPI) GetBlob(kvIndex uint64, blobHash common.Hash, decodeType DecodeType, off, size uint64) (hexutil.Bytes, error) {
 	blob := api.dl.Cache.GetKeyValueByIndex(kvIndex, blobHash)
 
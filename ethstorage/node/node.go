@@ -13,6 +13,7 @@ import (
 	"time"
 
 	"github.com/ethereum/go-ethereum"
+	"github.com/ethereum/go-ethereum/common"
 	"github.com/ethereum/go-ethereum/core/rawdb"
 	"github.com/ethereum/go-ethereum/ethdb"
 	"github.com/ethereum/go-ethereum/event"
@@ -233,6 +234,16 @@ func (n *EsNode) initP2P(ctx context.Context, cfg *Config) error {
 		if n.p2pNode.Dv5Udp() != nil {
 			go n.p2pNode.DiscoveryProcess(n.resourcesCtx, n.log, cfg.L1.L1ChainID, cfg.P2P.TargetPeers())
 		}
+		if addr := cfg.P2P.StatusAddr(); addr != "" {
+			if err := n.p2pNode.ServeStatus(addr, cfg.P2P.ServeSnapshot()); err != nil {
+				return fmt.Errorf("failed to serve sync status: %w", err)
+			}
+		}
+		if cfg.P2P.SyncSelfTest() {
+			if err := n.p2pNode.SelfTest(ctx); err != nil {
+				return fmt.Errorf("sync self-test failed: %w", err)
+			}
+		}
 	}
 	return nil
 }
@@ -250,19 +261,31 @@ func (n *EsNode) initStorageManager(ctx context.Context, cfg *Config) error {
 			log.Error("Miners mismatch", "fromDataFile", df.Miner(), "fromConfig", cfg.Storage.Miner)
 			return fmt.Errorf("miner mismatches datafile")
 		}
+		if !df.FilledBitmapKept() {
+			log.Warn("Filled bitmap is not kept by the data file, run `es-utils migrate_filled_bitmap` to skip reading its metas on startup",
+				"file", filename)
+		}
 		shardManager.AddDataFileAndShard(df)
 	}
 
 	if shardManager.IsComplete() != nil {
 		return fmt.Errorf("shard is not completed")
 	}
+	shardManager.SetFsyncPolicy(cfg.Storage.Fsync)
+	shardManager.SetMinFreeDisk(cfg.Storage.MinFreeDisk)
+	if cfg.Storage.Warmup {
+		if err := shardManager.Warmup(); err != nil {
+			return fmt.Errorf("warm up data files failed: %w", err)
+		}
+	}
 
 	log.Info("Initialized storage",
 		"miner", cfg.Storage.Miner,
 		"l1contract", cfg.Storage.L1Contract,
 		"kvSize", shardManager.MaxKvSize(),
 		"chunkSize", shardManager.ChunkSize(),
-		"kvsPerShard", shardManager.KvEntries())
+		"kvsPerShard", shardManager.KvEntries(),
+		"fsync", cfg.Storage.Fsync.Mode)
 
 	n.storageManager = ethstorage.NewStorageManager(shardManager, n.l1Source)
 	return nil
@@ -310,6 +333,16 @@ func (n *EsNode) initMiner(ctx context.Context, cfg *Config) error {
 	)
 	br := blobs.NewBlobReader(n.blobCache, n.storageManager, n.log)
 	n.miner = miner.New(cfg.Mining, n.db, n.storageManager, l1api, br, &pvr, n.feed, n.log)
+	if n.p2pNode != nil {
+		// the SyncDone events are unsubscribed by the miner once all the shards are done, so the shards added to
+		// the sync at runtime are delivered to the miner once synced
+		contract := n.storageManager.ContractAddress()
+		n.p2pNode.OnShardSynced(func(c common.Address, shardIdx uint64) {
+			if c == contract {
+				n.miner.AddShard(shardIdx)
+			}
+		})
+	}
 	n.log.Info("Initialized miner")
 	return nil
 }
@@ -18,6 +18,7 @@ import (
 	"github.com/ipfs/go-datastore/sync"
 	leveldb "github.com/ipfs/go-ds-leveldb"
 	"github.com/libp2p/go-libp2p/core/crypto"
+	"github.com/libp2p/go-libp2p/core/peer"
 	"github.com/multiformats/go-multiaddr"
 	"github.com/urfave/cli"
 )
@@ -71,6 +72,9 @@ func NewConfig(ctx *cli.Context, blockTime uint64) (*p2p.Config, error) {
 	if err := loadSyncerParams(conf, ctx); err != nil {
 		return nil, fmt.Errorf("failed to load syncer params: %w", err)
 	}
+	conf.StatusListenAddr = ctx.GlobalString(flags.SyncStatusAddr.Name)
+	conf.SnapshotEnabled = ctx.GlobalBool(flags.SyncServeSnapshot.Name)
+	conf.SelfTestEnabled = ctx.GlobalBool(flags.SyncSelfTest.Name)
 
 	conf.ConnGater = p2p.DefaultConnGater
 	conf.ConnMngr = p2p.DefaultConnManager
@@ -209,6 +213,12 @@ func loadDiscoveryOpts(conf *p2p.Config, ctx *cli.Context) error {
 		return fmt.Errorf("failed to open discovery db: %w", err)
 	}
 
+	conf.DialConcurrency = ctx.GlobalUint(flags.DiscoveryDialConcurrency.Name)
+	if conf.DialConcurrency == 0 {
+		return errors.New("discovery dial concurrency must be positive")
+	}
+	conf.DialsPerMinute = ctx.GlobalUint(flags.DiscoveryDialsPerMinute.Name)
+
 	conf.Bootnodes = p2p.DefaultBootnodes
 	records := strings.Split(ctx.GlobalString(flags.Bootnodes.Name), ",")
 	for i, recordB64 := range records {
@@ -370,12 +380,114 @@ func loadSyncerParams(conf *p2p.Config, ctx *cli.Context) error {
 	if syncConcurrency < 1 {
 		return fmt.Errorf("p2p.sync.concurrency param is invalid: the value should larger than 0")
 	}
+	verifyStrictness, err := protocol.ParseShardVerifyStrictness(ctx.GlobalString(flags.SyncVerifyStrictness.Name))
+	if err != nil {
+		return fmt.Errorf("p2p.sync.verify param is invalid: %w", err)
+	}
+	indexHeaderShards, err := protocol.ParseShardIds(ctx.GlobalString(flags.SyncIndexHeaderShards.Name))
+	if err != nil {
+		return fmt.Errorf("p2p.sync.index-header-shards param is invalid: %w", err)
+	}
+	schedulePolicy, err := protocol.ParseSchedulePolicy(ctx.GlobalString(flags.SyncSchedulePolicy.Name))
+	if err != nil {
+		return fmt.Errorf("p2p.sync.schedule param is invalid: %w", err)
+	}
+	encodeTypePolicy, err := protocol.ParseEncodeTypePolicy(ctx.GlobalString(flags.SyncEncodeTypePolicy.Name))
+	if err != nil {
+		return fmt.Errorf("p2p.sync.encode-type-policy param is invalid: %w", err)
+	}
+	verifySampleRate := ctx.GlobalFloat64(flags.SyncVerifySampleRate.Name)
+	if verifySampleRate <= 0 || verifySampleRate > 1 {
+		return fmt.Errorf("p2p.sync.verify.sample-rate param is invalid: the value should be in the range of (0, 1]")
+	}
+	maxInvalidBlobsPerPeer := ctx.GlobalInt(flags.SyncMaxInvalidBlobsPerPeer.Name)
+	if maxInvalidBlobsPerPeer < 0 {
+		return fmt.Errorf("p2p.sync.max-invalid-blobs-per-peer param is invalid: the value should not be negative")
+	}
+	minVerifiedRatio := ctx.GlobalFloat64(flags.SyncMinVerifiedRatio.Name)
+	if minVerifiedRatio <= 0 || minVerifiedRatio > 1 {
+		return fmt.Errorf("p2p.sync.min-verified-ratio param is invalid: the value should be in the range of (0, 1]")
+	}
+	maxLoad := ctx.GlobalFloat64(flags.SyncMaxLoad.Name)
+	if maxLoad < 0 {
+		return fmt.Errorf("p2p.sync.max-load param is invalid: the value should not be negative")
+	}
+	maxPeersPerSubTask := ctx.GlobalInt(flags.SyncMaxPeersPerSubTask.Name)
+	if maxPeersPerSubTask <= 0 {
+		return fmt.Errorf("p2p.sync.max-peers-per-subtask param is invalid: the value should be positive")
+	}
+	maxStatusSize := ctx.GlobalInt(flags.SyncMaxStatusSize.Name)
+	if maxStatusSize <= 0 {
+		return fmt.Errorf("p2p.sync.max-status-size param is invalid: the value should be positive")
+	}
+	retryCooldown := ctx.GlobalDuration(flags.SyncRetryCooldown.Name)
+	if retryCooldown <= 0 {
+		return fmt.Errorf("p2p.sync.retry-cooldown param is invalid: the value should be positive")
+	}
+	keepAliveInterval := ctx.GlobalDuration(flags.SyncKeepAliveInterval.Name)
+	if keepAliveInterval < 0 {
+		return fmt.Errorf("p2p.sync.keep-alive-interval param is invalid: the value should not be negative")
+	}
+	followInterval := ctx.GlobalDuration(flags.SyncFollowInterval.Name)
+	if followInterval <= 0 {
+		return fmt.Errorf("p2p.sync.follow-interval param is invalid: the value should be positive")
+	}
+	writeQueueSize := ctx.GlobalInt(flags.SyncWriteQueueSize.Name)
+	if writeQueueSize <= 0 {
+		return fmt.Errorf("p2p.sync.write-queue-size param is invalid: the value should be positive")
+	}
+	maxHealAttempts := ctx.GlobalInt(flags.SyncMaxHealAttempts.Name)
+	if maxHealAttempts < 0 {
+		return fmt.Errorf("p2p.sync.max-heal-attempts param is invalid: the value should not be negative")
+	}
+	allowlist := make([]peer.ID, 0)
+	for _, v := range strings.Split(ctx.GlobalString(flags.SyncAllowlist.Name), ",") {
+		v = strings.TrimSpace(v)
+		if v == "" {
+			continue
+		}
+		id, err := peer.Decode(v)
+		if err != nil {
+			return fmt.Errorf("p2p.sync.allowlist param is invalid: bad peer id %q: %w", v, err)
+		}
+		allowlist = append(allowlist, id)
+	}
 	conf.SyncParams = &protocol.SyncerParams{
-		MaxPeers:              maxPeers,
-		InitRequestSize:       initRequestSize,
-		SyncConcurrency:       syncConcurrency,
-		FillEmptyConcurrency:  fillEmptyConcurrency,
-		MetaDownloadBatchSize: metaDownloadBatchSize,
+		MaxPeers:               maxPeers,
+		PeersOvershoot:         ctx.GlobalInt(flags.SyncPeersOvershoot.Name),
+		InitRequestSize:        initRequestSize,
+		SyncConcurrency:        syncConcurrency,
+		FillEmptyConcurrency:   fillEmptyConcurrency,
+		FillEmptyWithPeers:     ctx.GlobalInt(flags.FillEmptyConcurrencyWithPeers.Name),
+		DecodeConcurrency:      ctx.GlobalInt(flags.DecodeConcurrency.Name),
+		WriteQueueSize:         writeQueueSize,
+		MetaDownloadBatchSize:  metaDownloadBatchSize,
+		ShardVerifyStrictness:  verifyStrictness,
+		IndexHeaderShards:      indexHeaderShards,
+		VerifySampleRate:       verifySampleRate,
+		PreferRange:            ctx.GlobalBool(flags.SyncPreferRange.Name),
+		MaxListBatchSize:       ctx.GlobalUint64(flags.SyncListBatchSize.Name),
+		MinVerifiedRatio:       minVerifiedRatio,
+		SummaryLogInterval:     ctx.GlobalDuration(flags.SyncSummaryLogInterval.Name),
+		StallTimeout:           ctx.GlobalDuration(flags.SyncStallTimeout.Name),
+		ProgressSaveInterval:   ctx.GlobalDuration(flags.SyncProgressSaveInterval.Name),
+		MinRangeBatchSize:      ctx.GlobalUint64(flags.SyncMinRangeBatchSize.Name),
+		MaxRangeBatchSize:      ctx.GlobalUint64(flags.SyncMaxRangeBatchSize.Name),
+		SchedulePolicy:         schedulePolicy,
+		MaxInvalidBlobsPerPeer: maxInvalidBlobsPerPeer,
+		MaxDispatchJitter:      ctx.GlobalDuration(flags.SyncMaxDispatchJitter.Name),
+		Allowlist:              allowlist,
+		MaxHealAttempts:        maxHealAttempts,
+		MinPeersBeforeSync:     ctx.GlobalInt(flags.SyncMinPeers.Name),
+		MinPeersTimeout:        ctx.GlobalDuration(flags.SyncMinPeersTimeout.Name),
+		EncodeTypePolicy:       encodeTypePolicy,
+		MaxLoad:                maxLoad,
+		FollowMode:             ctx.GlobalBool(flags.SyncFollow.Name),
+		FollowInterval:         followInterval,
+		MaxPeersPerSubTask:     maxPeersPerSubTask,
+		MaxStatusSize:          maxStatusSize,
+		RetryCooldown:          retryCooldown,
+		KeepAliveInterval:      keepAliveInterval,
 	}
 	return nil
 }
@@ -49,7 +49,15 @@ type SetupP2P interface {
 	// Discovery creates a disc-v5 service. Returns nil, nil, false, nil if discovery is disabled.
 	Discovery(log log.Logger, l1ChainID uint64, tcpPort uint16, fallbackIP net.IP) (*enode.LocalNode, *discover.UDPv5, bool, error)
 	TargetPeers() uint
+	// DiscoveryDials returns the number of the discovered peers dialed concurrently and the max dials in a minute.
+	DiscoveryDials() (concurrency uint, perMinute uint)
 	SyncerParams() *protocol.SyncerParams
+	// StatusAddr is the address to serve the sync status over http, empty if disabled.
+	StatusAddr() string
+	// ServeSnapshot reports whether to serve the shard snapshots by the sync status server.
+	ServeSnapshot() bool
+	// SyncSelfTest reports whether to validate the sync by NodeP2P.SelfTest on startup.
+	SyncSelfTest() bool
 	GossipSetupConfigurables
 }
 
@@ -86,6 +94,11 @@ type Config struct {
 	Bootnodes        []*enode.Node
 	DiscoveryDB      *enode.DB
 
+	// Number of the discovered peers dialed concurrently
+	DialConcurrency uint
+	// Max dials of the discovered peers in a minute, 0 means unlimited
+	DialsPerMinute uint
+
 	StaticPeers []core.Multiaddr
 
 	HostMux             []libp2p.Option
@@ -119,6 +132,15 @@ type Config struct {
 	// Syncer params
 	SyncParams *protocol.SyncerParams
 
+	// Address of the http server of the sync status, empty to disable it
+	StatusListenAddr string
+
+	// Serve the shard snapshots by the http server of the sync status
+	SnapshotEnabled bool
+
+	// Validate the sync end to end with synthetic blobs on startup
+	SelfTestEnabled bool
+
 	// Underlying store that hosts connection-gater and peerstore data.
 	Store ds.Batching
 
@@ -166,6 +188,10 @@ func (conf *Config) TargetPeers() uint {
 	return conf.PeersLo
 }
 
+func (conf *Config) DiscoveryDials() (uint, uint) {
+	return conf.DialConcurrency, conf.DialsPerMinute
+}
+
 func (conf *Config) Disabled() bool {
 	return conf.DisableP2P
 }
@@ -190,6 +216,18 @@ func (conf *Config) SyncerParams() *protocol.SyncerParams {
 	return conf.SyncParams
 }
 
+func (conf *Config) StatusAddr() string {
+	return conf.StatusListenAddr
+}
+
+func (conf *Config) ServeSnapshot() bool {
+	return conf.SnapshotEnabled
+}
+
+func (conf *Config) SyncSelfTest() bool {
+	return conf.SelfTestEnabled
+}
+
 const maxMeshParam = 1000
 
 func (conf *Config) Check() error {
@@ -9,10 +9,12 @@ import (
 	"io"
 	"math/rand"
 	"net"
+	"sort"
 	"strconv"
 	"time"
 
 	decredSecp "github.com/decred/dcrd/dcrec/secp256k1/v4"
+	"github.com/ethereum/go-ethereum/common"
 	gcrypto "github.com/ethereum/go-ethereum/crypto"
 	"github.com/ethereum/go-ethereum/log"
 	"github.com/ethereum/go-ethereum/p2p/discover"
@@ -24,6 +26,7 @@ import (
 	"github.com/libp2p/go-libp2p/core/crypto"
 	"github.com/libp2p/go-libp2p/core/network"
 	"github.com/libp2p/go-libp2p/core/peer"
+	"github.com/libp2p/go-libp2p/core/peerstore"
 	"github.com/multiformats/go-multiaddr"
 	ma "github.com/multiformats/go-multiaddr"
 )
@@ -217,21 +220,8 @@ func FilterEnodes(log log.Logger, l1ChainID uint64) func(node *enode.Node) bool
 			log.Trace("Discovered node record has no matching Version", "node", node.ID(), "got", dat.Version, "expected", p2pVersion)
 			return false
 		}
-		shards := ethstorage.Shards()
-		for _, cs := range dat.Shards {
-			ss, ok := shards[cs.Contract]
-			if !ok {
-				continue
-			}
-			for _, sid := range ss {
-				for _, rsid := range cs.ShardIds {
-					if sid == rsid {
-						return true
-					}
-				}
-			}
-		}
-		return false
+		// ignore the nodes which cannot serve any local shard
+		return protocol.ShardOverlap(ethstorage.Shards(), dat.Shards) > 0
 	}
 }
 
@@ -273,22 +263,17 @@ func (n *NodeP2P) DiscoveryProcess(ctx context.Context, log log.Logger, l1ChainI
 
 	// We try to connect to peers in parallel: some may be slow to respond
 	connAttempts := make(chan peer.ID, connectionBufferSize)
-	connectWorker := func(ctx context.Context) {
-		for {
-			id, ok := <-connAttempts
-			if !ok {
-				return
-			}
-			addrs := n.Host().Peerstore().Addrs(id)
-			log.Debug("Attempting connection", "peer", id, "Addr", addrs)
-			ctx, cancel := context.WithTimeout(ctx, time.Second*10)
-			err := n.Host().Connect(ctx, peer.AddrInfo{ID: id, Addrs: addrs})
-			cancel()
-			if err != nil {
-				log.Debug("Failed connection attempt", "peer", id, "Addr", addrs, "err", err)
-			}
+	connect := func(ctx context.Context, id peer.ID) {
+		addrs := n.Host().Peerstore().Addrs(id)
+		log.Debug("Attempting connection", "peer", id, "Addr", addrs)
+		ctx, cancel := context.WithTimeout(ctx, time.Second*10)
+		err := n.Host().Connect(ctx, peer.AddrInfo{ID: id, Addrs: addrs})
+		cancel()
+		if err != nil {
+			log.Debug("Failed connection attempt", "peer", id, "Addr", addrs, "err", err)
 		}
 	}
+	budget := newDialBudget(int(n.dialsPerMinute))
 
 	go func() {
 		if n.isIPSet {
@@ -315,8 +300,12 @@ func (n *NodeP2P) DiscoveryProcess(ctx context.Context, log log.Logger, l1ChainI
 	// stops all the workers when we are done
 	defer close(connAttempts)
 	// start workers to try connect to peers
-	for i := 0; i < connectionWorkerCount; i++ {
-		go connectWorker(ctx)
+	workers := int(n.dialWorkers)
+	if workers <= 0 {
+		workers = connectionWorkerCount
+	}
+	for i := 0; i < workers; i++ {
+		go dialWorker(ctx, connAttempts, connect)
 	}
 
 	// buffer discovered nodes, so don't stall on the dht iteration as much
@@ -346,23 +335,73 @@ func (n *NodeP2P) DiscoveryProcess(ctx context.Context, log log.Logger, l1ChainI
 	// Walk the DHT in parallel, the discv5 interface does not use channels for the iteration
 	go bufferNodes()
 
+	// take the table and feed it into the discovery process
+	feedTable := func() {
+		nodes := make([]*enode.Node, 0)
+		for _, rec := range n.dv5Udp.AllNodes() {
+			if filter(rec) {
+				nodes = append(nodes, rec)
+			}
+		}
+		// feed the nodes which can serve more local shards first
+		protocol.RankNodesByShardOverlap(nodes, ethstorage.Shards())
+		for _, rec := range nodes {
+			select {
+			case randomNodesCh <- rec:
+				continue
+			case <-ctx.Done():
+				return
+			}
+		}
+	}
 	// Kick off by trying the nodes we have in our table (previous nodes from last run and/or bootnodes)
 	go func() {
 		<-time.After(tableKickoffDelay)
 		// At the start we might have trouble walking the DHT,
-		// but we do have a table with some nodes,
-		// so take the table and feed it into the discovery process
-		for _, rec := range n.dv5Udp.AllNodes() {
-			if filter(rec) {
-				select {
-				case randomNodesCh <- rec:
-					continue
-				case <-ctx.Done():
-					return
-				}
+		// but we do have a table with some nodes
+		feedTable()
+	}()
+
+	dialPeers := func(connected []peer.ID) {
+		peersWithAddrs := n.Host().Peerstore().PeersWithAddrs()
+		if err := shufflePeers(peersWithAddrs); err != nil {
+			return
+		}
+		// dial the peers which can serve more local shards first, so fewer connections are wasted
+		rankPeersByShardOverlap(n.Host().Peerstore(), peersWithAddrs, ethstorage.Shards())
+
+		existing := make(map[peer.ID]struct{})
+		for _, p := range connected {
+			existing[p] = struct{}{}
+		}
+
+		// Keep using these peers, and don't try new discovery/connections.
+		// We don't need to search for more peers and try new connections if we already have plenty
+		ctx, cancel := context.WithTimeout(ctx, collectiveDialTimeout)
+		defer cancel()
+		skip := func(id peer.ID) bool {
+			// never dial ourselves
+			if n.Host().ID() == id {
+				return true
+			}
+			// skip peers that we are already connected to
+			if _, ok := existing[id]; ok {
+				return true
 			}
+			// skip peers that we were just connected to
+			return n.Host().Network().Connectedness(id) == network.CannotConnect
 		}
-	}()
+		if scheduled, exhausted := scheduleDials(ctx, peersWithAddrs, skip, budget, connAttempts); exhausted {
+			log.Debug("Dial budget exhausted", "scheduled", scheduled, "dialsPerMinute", n.dialsPerMinute)
+		}
+	}
+
+	// re-seed the peers when the sync is stalled, as the connected peers may be unable to serve the blobs
+	stalledCh := make(chan protocol.SyncStalled, 1)
+	if n.syncCl != nil {
+		sub := n.syncCl.SubscribeSyncStalled(stalledCh)
+		defer sub.Unsubscribe()
+	}
 
 	pstore := n.Host().Peerstore()
 	for {
@@ -398,6 +437,12 @@ func (n *NodeP2P) DiscoveryProcess(ctx context.Context, log log.Logger, l1ChainI
 			// There is no tag score decay yet, so just set it to 42.
 			n.ConnectionManager().TagPeer(info.ID, fmt.Sprintf("ethstorage-%d-%d", dat.ChainID, dat.Version), 42)
 			log.Debug("Discovered peer", "peer", info.ID, "nodeID", node.ID(), "addr", info.Addrs[0])
+		case <-stalledCh:
+			log.Info("Storage sync stalled, re-seeding peers", "connected", len(n.Host().Network().Peers()))
+			faster()
+			go feedTable()
+			// dial the known peers even if the connect goal is reached, the connection manager prunes the useless ones
+			dialPeers(n.Host().Network().Peers())
 		case <-connectTicker.C:
 			connected := n.Host().Network().Peers()
 			log.Debug("Peering tick", "connected", len(connected),
@@ -407,42 +452,7 @@ func (n *NodeP2P) DiscoveryProcess(ctx context.Context, log log.Logger, l1ChainI
 			if uint(len(connected)) < connectGoal {
 				// Start looking for more peers more actively again
 				faster()
-
-				peersWithAddrs := n.Host().Peerstore().PeersWithAddrs()
-				if err := shufflePeers(peersWithAddrs); err != nil {
-					continue
-				}
-
-				existing := make(map[peer.ID]struct{})
-				for _, p := range connected {
-					existing[p] = struct{}{}
-				}
-
-				// Keep using these peers, and don't try new discovery/connections.
-				// We don't need to search for more peers and try new connections if we already have plenty
-				ctx, cancel := context.WithTimeout(ctx, collectiveDialTimeout)
-			peerLoop:
-				for _, id := range peersWithAddrs {
-					// never dial ourselves
-					if n.Host().ID() == id {
-						continue
-					}
-					// skip peers that we are already connected to
-					if _, ok := existing[id]; ok {
-						continue
-					}
-					// skip peers that we were just connected to
-					if n.Host().Network().Connectedness(id) == network.CannotConnect {
-						continue
-					}
-					// schedule, if there is still space to schedule (this may block)
-					select {
-					case connAttempts <- id:
-					case <-ctx.Done():
-						break peerLoop
-					}
-				}
-				cancel()
+				dialPeers(connected)
 			} else {
 				// we have enough connections, slow down actively filling the peerstore
 				slower()
@@ -451,6 +461,65 @@ func (n *NodeP2P) DiscoveryProcess(ctx context.Context, log log.Logger, l1ChainI
 	}
 }
 
+// dialWorker dials the peers scheduled to the attempts one at a time until the attempts are closed.
+func dialWorker(ctx context.Context, attempts <-chan peer.ID, dial func(ctx context.Context, id peer.ID)) {
+	for id := range attempts {
+		dial(ctx, id)
+	}
+}
+
+// scheduleDials schedules the dials of the ranked candidates not skipped to the attempts in order, so the budget
+// goes to the most useful candidates first. It returns the number of the dials scheduled, and whether it stopped
+// as the budget is exhausted.
+func scheduleDials(ctx context.Context, candidates []peer.ID, skip func(id peer.ID) bool, budget *dialBudget,
+	attempts chan<- peer.ID) (int, bool) {
+	scheduled := 0
+	for _, id := range candidates {
+		if skip(id) {
+			continue
+		}
+		if !budget.take(time.Now()) {
+			return scheduled, true
+		}
+		// schedule, if there is still space to schedule (this may block)
+		select {
+		case attempts <- id:
+			scheduled++
+		case <-ctx.Done():
+			return scheduled, false
+		}
+	}
+	return scheduled, false
+}
+
+// dialBudget limits the dials of the discovered peers to perMinute in any minute, so the network is not hammered
+// while bootstrapping. It is not safe for concurrent use.
+type dialBudget struct {
+	perMinute int         // max dials in a minute, 0 means unlimited
+	dials     []time.Time // times of the dials taken in the last minute
+}
+
+func newDialBudget(perMinute int) *dialBudget {
+	return &dialBudget{perMinute: perMinute}
+}
+
+// take reports whether a dial is allowed at now, and counts the dial if so.
+func (b *dialBudget) take(now time.Time) bool {
+	if b.perMinute <= 0 {
+		return true
+	}
+	i := 0
+	for i < len(b.dials) && now.Sub(b.dials[i]) >= time.Minute {
+		i++
+	}
+	b.dials = b.dials[i:]
+	if len(b.dials) >= b.perMinute {
+		return false
+	}
+	b.dials = append(b.dials, now)
+	return true
+}
+
 // shuffle the slice of peer IDs in-place with a RNG seeded by secure randomness.
 func shufflePeers(ids peer.IDSlice) error {
 	var x [8]byte // shuffling is not critical, just need to avoid basic predictability by outside peers
@@ -461,3 +530,22 @@ func shufflePeers(ids peer.IDSlice) error {
 	rng.Shuffle(len(ids), ids.Swap)
 	return nil
 }
+
+// rankPeersByShardOverlap sorts the peer IDs in place in the descending order of the overlap between the shards
+// of the peers in the peerstore and the local shards. The sort is stable, so the shuffled order is kept for the
+// peers with the same overlap.
+func rankPeersByShardOverlap(pstore peerstore.Peerstore, ids peer.IDSlice, local map[common.Address][]uint64) {
+	overlaps := make(map[peer.ID]int, len(ids))
+	for _, id := range ids {
+		css, err := pstore.Get(id, protocol.EthStorageENRKey)
+		if err != nil {
+			continue
+		}
+		if shards, ok := css.([]*protocol.ContractShards); ok {
+			overlaps[id] = protocol.ShardOverlap(local, shards)
+		}
+	}
+	sort.SliceStable(ids, func(i, j int) bool {
+		return overlaps[ids[i]] > overlaps[ids[j]]
+	})
+}
@@ -0,0 +1,90 @@
+package p2p
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/libp2p/go-libp2p/core/peer"
+)
+
+// TestDiscoveryDials tests that the ranked candidates are dialed by at most the configured concurrent workers, and
+// that only the top candidates within the dial budget are dialed until the budget is refilled a minute later.
+func TestDiscoveryDials(t *testing.T) {
+	var (
+		concurrency = 3
+		perMinute   = 8
+		candidates  = make([]peer.ID, 20)
+		attempts    = make(chan peer.ID, connectionBufferSize)
+		ctx, cancel = context.WithCancel(context.Background())
+		wg          sync.WaitGroup
+		lock        sync.Mutex
+		dialed      = make([]peer.ID, 0)
+		running     atomic.Int32
+		maxRunning  atomic.Int32
+	)
+	defer cancel()
+	for i := range candidates {
+		candidates[i] = peer.ID(fmt.Sprintf("candidate-%02d", i))
+	}
+	dial := func(ctx context.Context, id peer.ID) {
+		defer wg.Done()
+		n := running.Add(1)
+		defer running.Add(-1)
+		for {
+			m := maxRunning.Load()
+			if n <= m || maxRunning.CompareAndSwap(m, n) {
+				break
+			}
+		}
+		time.Sleep(20 * time.Millisecond)
+		lock.Lock()
+		dialed = append(dialed, id)
+		lock.Unlock()
+	}
+	for i := 0; i < concurrency; i++ {
+		go dialWorker(ctx, attempts, dial)
+	}
+
+	// the first candidate is skipped, e.g. as it is connected already
+	skip := func(id peer.ID) bool {
+		return id == candidates[0]
+	}
+	budget := newDialBudget(perMinute)
+	wg.Add(perMinute)
+	scheduled, exhausted := scheduleDials(ctx, candidates, skip, budget, attempts)
+	if scheduled != perMinute || !exhausted {
+		t.Fatalf("dials scheduled %d, exhausted %v, expected %d dials until the budget is exhausted", scheduled, exhausted, perMinute)
+	}
+	wg.Wait()
+	if int(maxRunning.Load()) > concurrency {
+		t.Fatalf("concurrent dials %d exceed the concurrency %d", maxRunning.Load(), concurrency)
+	}
+	expected := make(map[peer.ID]struct{})
+	for _, id := range candidates[1 : perMinute+1] {
+		expected[id] = struct{}{}
+	}
+	for _, id := range dialed {
+		if _, ok := expected[id]; !ok {
+			t.Fatalf("candidate %s is dialed out of the top %d candidates", id, perMinute)
+		}
+		delete(expected, id)
+	}
+	if len(expected) != 0 {
+		t.Fatalf("top candidates are not dialed: %v", expected)
+	}
+
+	if budget.take(time.Now()) {
+		t.Fatalf("dial should not be allowed within the minute once the budget is exhausted")
+	}
+	if !budget.take(time.Now().Add(time.Minute)) {
+		t.Fatalf("dial should be allowed a minute later")
+	}
+	if unlimited := newDialBudget(0); !unlimited.take(time.Now()) {
+		t.Fatalf("dial should always be allowed without a budget")
+	}
+	close(attempts)
+}
@@ -5,9 +5,11 @@ import (
 	"errors"
 	"fmt"
 	"net"
+	"net/http"
 	"strconv"
 	"time"
 
+	"github.com/ethereum-optimism/optimism/op-service/httputil"
 	"github.com/ethereum/go-ethereum/common"
 	"github.com/ethereum/go-ethereum/ethdb"
 	"github.com/ethereum/go-ethereum/event"
@@ -28,6 +30,13 @@ import (
 	ma "github.com/multiformats/go-multiaddr"
 )
 
+const (
+	// syncServerDrainTimeout is the max time to wait for the in-flight sync requests to finish when closing.
+	syncServerDrainTimeout = 10 * time.Second
+	// statusServerShutdownTimeout is the max time to wait for the sync status requests to finish when closing.
+	statusServerShutdownTimeout = 5 * time.Second
+)
+
 // NodeP2P is a p2p node, which can be used to gossip messages.
 type NodeP2P struct {
 	host    host.Host           // p2p host (optional, may be nil)
@@ -41,7 +50,13 @@ type NodeP2P struct {
 	syncCl         *protocol.SyncClient
 	syncSrv        *protocol.SyncServer
 	storageManager *ethstorage.StorageManager
+	statusServer   *http.Server // optional http server of the sync status, started by ServeStatus
 	resCtx         context.Context
+	networkSecret  string // shared secret of a private network to authenticate the sync streams
+	rollupCfg      *rollup.EsConfig
+	syncParams     *protocol.SyncerParams
+	dialWorkers    uint // discovered peers dialed concurrently
+	dialsPerMinute uint // max dials of the discovered peers in a minute, 0 means unlimited
 }
 
 // NewNodeP2P creates a new p2p node, and returns a reference to it. If the p2p is disabled, it returns nil.
@@ -70,6 +85,10 @@ func (n *NodeP2P) init(resourcesCtx context.Context, rollupCfg *rollup.EsConfig,
 	bwc := p2pmetrics.NewBandwidthCounter()
 	n.storageManager = storageManager
 	n.resCtx = resourcesCtx
+	n.networkSecret = rollupCfg.NetworkSecret
+	n.rollupCfg = rollupCfg
+	n.syncParams = setup.SyncerParams()
+	n.dialWorkers, n.dialsPerMinute = setup.DiscoveryDials()
 
 	var err error
 	// nil if disabled.
@@ -90,6 +109,27 @@ func (n *NodeP2P) init(resourcesCtx context.Context, rollupCfg *rollup.EsConfig,
 
 		// Activate the P2P req-resp sync
 		n.syncCl = protocol.NewSyncClient(log, rollupCfg, n.host.NewStream, storageManager, setup.SyncerParams(), db, m, feed)
+		n.syncCl.SetAllowlist(setup.SyncerParams().Allowlist)
+		if n.gater != nil {
+			n.syncCl.SetPeerBanner(func(id peer.ID) error {
+				if err := n.gater.BlockPeer(id); err != nil {
+					return err
+				}
+				return n.host.Network().ClosePeer(id)
+			})
+		}
+		storageManager.OnLastKvIndexChanged(func(lastKvIdx uint64) {
+			n.syncCl.OnLastKvIndexChanged(storageManager.ContractAddress(), lastKvIdx)
+		})
+		// flush the blobs left by the batched fsync once a shard is synced
+		n.syncCl.OnShardSynced(func(contract common.Address, shardIdx uint64) {
+			if contract != storageManager.ContractAddress() {
+				return
+			}
+			if err := storageManager.SyncShard(shardIdx); err != nil {
+				log.Warn("Failed to sync shard to disk", "shard", shardIdx, "err", err)
+			}
+		})
 		n.host.Network().Notify(&network.NotifyBundle{
 			ConnectedF: func(nw network.Network, conn network.Conn) {
 				var (
@@ -103,6 +143,11 @@ func (n *NodeP2P) init(resourcesCtx context.Context, rollupCfg *rollup.EsConfig,
 					log.Debug("No addresses to get shard list, return without close conn", "peer", remotePeerId)
 					return
 				}
+				if !n.syncCl.IsAllowed(remotePeerId) {
+					// keep the connection for gossip, but do not sync with the peer
+					log.Debug("Peer is not in the sync allowlist, return without close conn", "peer", remotePeerId)
+					return
+				}
 				css, err := n.Host().Peerstore().Get(remotePeerId, protocol.EthStorageENRKey)
 				if err != nil {
 					// for node which is new to the ethstorage network, and it dial the nodes which do not contain
@@ -124,6 +169,12 @@ func (n *NodeP2P) init(resourcesCtx context.Context, rollupCfg *rollup.EsConfig,
 				if !added {
 					log.Debug("Close connection as AddPeer fail", "peer", remotePeerId)
 					conn.Close()
+					return
+				}
+				// the connection may be closed while the shard list is requested, in which case the peer may be
+				// removed before it is added, so remove it again if no connection to the peer is left
+				if nw.Connectedness(remotePeerId) != network.Connected {
+					n.syncCl.RemovePeer(remotePeerId)
 				}
 			},
 			DisconnectedF: func(nw network.Network, conn network.Conn) {
@@ -131,12 +182,20 @@ func (n *NodeP2P) init(resourcesCtx context.Context, rollupCfg *rollup.EsConfig,
 					log.Debug("No addresses in peer store, return without remove peer", "peer", conn.RemotePeer())
 					return
 				}
+				// the peer reconnected before the old connection is closed is kept with the new connection
+				if nw.Connectedness(conn.RemotePeer()) == network.Connected {
+					log.Debug("Peer is still connected, return without remove peer", "peer", conn.RemotePeer())
+					return
+				}
 				n.syncCl.RemovePeer(conn.RemotePeer())
 			},
 		})
 
 		// the host may already be connected to peers, add them all to the sync client
 		for _, conn := range n.host.Network().Conns() {
+			if !n.syncCl.IsAllowed(conn.RemotePeer()) {
+				continue
+			}
 			shards := make(map[common.Address][]uint64)
 			css, err := n.host.Peerstore().Get(conn.RemotePeer(), protocol.EthStorageENRKey)
 			if err != nil {
@@ -152,13 +211,38 @@ func (n *NodeP2P) init(resourcesCtx context.Context, rollupCfg *rollup.EsConfig,
 		}
 		go n.syncCl.ReportPeerSummary()
 		n.syncSrv = protocol.NewSyncServer(rollupCfg, storageManager, db, m)
+		n.syncSrv.SetPreferRange(setup.SyncerParams().PreferRange)
+		storageManager.OnBlobWritten(n.syncSrv.BlobWritten)
 
 		blobByRangeHandler := protocol.MakeStreamHandler(resourcesCtx, log.New("serve", "blobs_by_range"), n.syncSrv.HandleGetBlobsByRangeRequest)
-		n.host.SetStreamHandler(protocol.GetProtocolID(protocol.RequestBlobsByRangeProtocolID, rollupCfg.L2ChainID), blobByRangeHandler)
+		n.host.SetStreamHandler(protocol.GetProtocolID(protocol.RequestBlobsByRangeProtocolID, rollupCfg.L2ChainID), n.authSync(n.allowSync(blobByRangeHandler)))
+		streamedBlobByRangeHandler := protocol.MakeStreamHandler(resourcesCtx, log.New("serve", "streamed_blobs_by_range"), n.syncSrv.HandleGetStreamedBlobsByRangeRequest)
+		n.host.SetStreamHandler(protocol.GetProtocolID(protocol.RequestStreamedBlobsByRangeProtocolID, rollupCfg.L2ChainID), n.authSync(n.allowSync(streamedBlobByRangeHandler)))
+		if rollupCfg.CompressionEnabled {
+			compressedBlobByRangeHandler := protocol.MakeStreamHandler(resourcesCtx, log.New("serve", "compressed_blobs_by_range"), n.syncSrv.HandleGetCompressedBlobsByRangeRequest)
+			n.host.SetStreamHandler(protocol.GetProtocolID(protocol.RequestCompressedBlobsByRangeProtocolID, rollupCfg.L2ChainID), n.authSync(n.allowSync(compressedBlobByRangeHandler)))
+			compressedStreamedBlobByRangeHandler := protocol.MakeStreamHandler(resourcesCtx, log.New("serve", "compressed_streamed_blobs_by_range"), n.syncSrv.HandleGetCompressedStreamedBlobsByRangeRequest)
+			n.host.SetStreamHandler(protocol.GetProtocolID(protocol.RequestCompressedStreamedBlobsByRangeProtocolID, rollupCfg.L2ChainID), n.authSync(n.allowSync(compressedStreamedBlobByRangeHandler)))
+		}
 		blobByListHandler := protocol.MakeStreamHandler(resourcesCtx, log.New("serve", "blobs_by_list"), n.syncSrv.HandleGetBlobsByListRequest)
-		n.host.SetStreamHandler(protocol.GetProtocolID(protocol.RequestBlobsByListProtocolID, rollupCfg.L2ChainID), blobByListHandler)
+		n.host.SetStreamHandler(protocol.GetProtocolID(protocol.RequestBlobsByListProtocolID, rollupCfg.L2ChainID), n.authSync(n.allowSync(blobByListHandler)))
+		blobByCommitHandler := protocol.MakeStreamHandler(resourcesCtx, log.New("serve", "blobs_by_commit"), n.syncSrv.HandleGetBlobsByCommitRequest)
+		n.host.SetStreamHandler(protocol.GetProtocolID(protocol.RequestBlobsByCommitProtocolID, rollupCfg.L2ChainID), n.authSync(n.allowSync(blobByCommitHandler)))
+		availabilityHandler := protocol.MakeStreamHandler(resourcesCtx, log.New("serve", "availability"), n.syncSrv.HandleGetAvailabilityRequest)
+		n.host.SetStreamHandler(protocol.GetProtocolID(protocol.RequestAvailabilityProtocolID, rollupCfg.L2ChainID), n.authSync(n.allowSync(availabilityHandler)))
 		requestShardListHandler := protocol.MakeStreamHandler(resourcesCtx, log.New("serve", "get_shard_list"), n.syncSrv.HandleRequestShardList)
-		n.host.SetStreamHandler(protocol.RequestShardList, requestShardListHandler)
+		n.host.SetStreamHandler(protocol.RequestShardList, n.authSync(requestShardListHandler))
+		requestCapabilitiesHandler := protocol.MakeStreamHandler(resourcesCtx, log.New("serve", "get_capabilities"), n.syncSrv.HandleRequestCapabilities)
+		n.host.SetStreamHandler(protocol.RequestCapabilities, n.authSync(n.allowSync(requestCapabilitiesHandler)))
+		requestLastKvIndexHandler := protocol.MakeStreamHandler(resourcesCtx, log.New("serve", "get_last_kv_index"), n.syncSrv.HandleRequestLastKvIndex)
+		n.host.SetStreamHandler(protocol.RequestLastKvIndex, n.authSync(n.allowSync(requestLastKvIndexHandler)))
+		pingHandler := protocol.MakeStreamHandler(resourcesCtx, log.New("serve", "ping"), n.syncSrv.HandlePing)
+		n.host.SetStreamHandler(protocol.RequestPing, n.authSync(n.allowSync(pingHandler)))
+		updateShardListHandler := protocol.MakeStreamHandler(resourcesCtx, log.New("serve", "update_shard_list"), n.syncCl.HandleUpdateShardList)
+		n.host.SetStreamHandler(protocol.UpdateShardList, n.authSync(n.allowSync(updateShardListHandler)))
+		// light clients are not sync peers, so the chunk proofs are served regardless of the sync allowlist
+		chunkProofHandler := protocol.MakeStreamHandler(resourcesCtx, log.New("serve", "chunk_proof"), n.syncSrv.HandleGetChunkProofRequest)
+		n.host.SetStreamHandler(protocol.GetProtocolID(protocol.RequestChunkProofProtocolID, rollupCfg.L2ChainID), n.authSync(chunkProofHandler))
 
 		// notify of any new connections/streams/etc.
 		// TODO: use metric
@@ -191,7 +275,8 @@ func (n *NodeP2P) init(resourcesCtx context.Context, rollupCfg *rollup.EsConfig,
 	return nil
 }
 
-// PurgeBadPeers will close peers that have no addresses in the host.peerstore due to expired ttl.
+// PurgeBadPeers will close peers that have no addresses in the host.peerstore due to expired ttl, and the
+// extra peers trimmed by the sync client once the sync is done.
 func (n *NodeP2P) PurgeBadPeers() {
 	ticker := time.NewTicker(time.Minute)
 	defer ticker.Stop()
@@ -209,6 +294,13 @@ func (n *NodeP2P) PurgeBadPeers() {
 					log.Info("Purge bad peer failed", "peer", p.String(), "error", err.Error())
 				}
 			}
+			// close the extra peers allowed by the overshoot during the sync
+			for _, p := range n.syncCl.TrimPeers() {
+				err := n.host.Network().ClosePeer(p)
+				if err != nil {
+					log.Info("Close trimmed peer failed", "peer", p.String(), "error", err.Error())
+				}
+			}
 		case <-n.resCtx.Done():
 			log.Info("P2P PurgeBadPeers stop")
 			return
@@ -216,6 +308,32 @@ func (n *NodeP2P) PurgeBadPeers() {
 	}
 }
 
+// allowSync wraps the handler of a sync protocol to reset the streams from the peers out of the sync allowlist,
+// as the connections of those peers are kept for gossip.
+func (n *NodeP2P) allowSync(handler network.StreamHandler) network.StreamHandler {
+	return func(stream network.Stream) {
+		if !n.syncCl.IsAllowed(stream.Conn().RemotePeer()) {
+			stream.Reset()
+			return
+		}
+		handler(stream)
+	}
+}
+
+// authSync wraps the handler of a sync protocol to serve only the streams authenticated by the secret of a private
+// network, see protocol.AuthStreamHandler.
+func (n *NodeP2P) authSync(handler network.StreamHandler) network.StreamHandler {
+	return protocol.AuthStreamHandler(n.networkSecret, handler)
+}
+
+// OnShardSynced registers fn to be called once for each shard synced, see SyncClient.OnShardSynced. It should be
+// called before Start.
+func (n *NodeP2P) OnShardSynced(fn func(contract common.Address, shardIdx uint64)) {
+	if n.syncCl != nil {
+		n.syncCl.OnShardSynced(fn)
+	}
+}
+
 func (n *NodeP2P) RequestL2Range(ctx context.Context, start, end uint64) (uint64, error) {
 	return n.syncCl.RequestL2Range(start, end)
 }
@@ -226,7 +344,7 @@ func (n *NodeP2P) RequestShardList(remotePeer peer.ID) ([]*protocol.ContractShar
 	ctx, cancel := context.WithTimeout(context.Background(), protocol.NewStreamTimeout)
 	defer cancel()
 
-	s, err := n.Host().NewStream(ctx, remotePeer, protocol.RequestShardList)
+	s, err := protocol.AuthNewStream(n.networkSecret, n.Host().NewStream)(ctx, remotePeer, protocol.RequestShardList)
 	if err != nil {
 		return remoteShardList, err
 	}
@@ -270,8 +388,40 @@ func (n *NodeP2P) Start() error {
 	return nil
 }
 
+// ServeStatus starts an http server listening on addr, which serves the sync status as JSON at /sync/status, and
+// the shard snapshots at /sync/snapshot if snapshot is set. The server is shut down when the node is closed.
+func (n *NodeP2P) ServeStatus(addr string, snapshot bool) error {
+	if n.syncCl == nil {
+		return errors.New("sync client is not initialized")
+	}
+	listener, err := net.Listen("tcp", addr)
+	if err != nil {
+		return err
+	}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/sync/status", n.syncCl.HandleStatus)
+	if snapshot {
+		mux.HandleFunc("/sync/snapshot", n.HandleShardSnapshot)
+	}
+	n.statusServer = httputil.NewHttpServer(mux)
+	go func() {
+		if err := n.statusServer.Serve(listener); err != nil && !errors.Is(err, http.ErrServerClosed) {
+			log.Error("Serve sync status failed", "err", err)
+		}
+	}()
+	log.Info("Sync status server started", "address", listener.Addr().String())
+	return nil
+}
+
 func (n *NodeP2P) Close() error {
 	var result *multierror.Error
+	if n.statusServer != nil {
+		ctx, cancel := context.WithTimeout(context.Background(), statusServerShutdownTimeout)
+		if err := n.statusServer.Shutdown(ctx); err != nil {
+			result = multierror.Append(result, fmt.Errorf("failed to close sync status server cleanly: %w", err))
+		}
+		cancel()
+	}
 	if n.dv5Udp != nil {
 		n.dv5Udp.Close()
 	}
@@ -281,6 +431,14 @@ func (n *NodeP2P) Close() error {
 	// 	}
 	// }
 	if n.host != nil {
+		if n.syncSrv != nil {
+			// let the in-flight requests finish before the host closes the streams
+			ctx, cancel := context.WithTimeout(context.Background(), syncServerDrainTimeout)
+			if err := n.syncSrv.Drain(ctx); err != nil {
+				log.Warn("Drain p2p sync server timeout", "err", err)
+			}
+			cancel()
+		}
 		if err := n.host.Close(); err != nil {
 			result = multierror.Append(result, fmt.Errorf("failed to close p2p host cleanly: %w", err))
 		}
@@ -0,0 +1,77 @@
+// Copyright 2022-2023, EthStorage.
+// For license information, see https://github.com/ethstorage/es-node/blob/main/LICENSE
+
+package protocol
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"io"
+	"time"
+
+	"github.com/ethereum/go-ethereum/log"
+	"github.com/libp2p/go-libp2p/core/network"
+	"github.com/libp2p/go-libp2p/core/peer"
+	"github.com/libp2p/go-libp2p/core/protocol"
+)
+
+const (
+	// networkAuthSize is the size of the auth token a sync stream of a private network opens with
+	networkAuthSize = sha256.Size
+
+	// networkAuthTimeout is the max time to wait for the auth token of a sync stream
+	networkAuthTimeout = 5 * time.Second
+)
+
+// networkAuthToken returns the token proving the opener of a stream from peer from to peer to knows the network
+// secret. The token is bound to both peers, which are authenticated by the secure transport, so a leaked token is
+// of no use to the other peers.
+func networkAuthToken(secret string, from, to peer.ID) []byte {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(from))
+	mac.Write([]byte(to))
+	return mac.Sum(nil)
+}
+
+// AuthNewStream wraps newStream to open the sync streams with the auth token of the network secret, so they are
+// served by the peers of the same private network. newStream is returned as is if the secret is empty.
+func AuthNewStream(secret string, newStream newStreamFn) newStreamFn {
+	if secret == "" {
+		return newStream
+	}
+	return func(ctx context.Context, peerId peer.ID, protocolId ...protocol.ID) (network.Stream, error) {
+		stream, err := newStream(ctx, peerId, protocolId...)
+		if err != nil {
+			return nil, err
+		}
+		token := networkAuthToken(secret, stream.Conn().LocalPeer(), stream.Conn().RemotePeer())
+		if _, err := stream.Write(token); err != nil {
+			stream.Reset()
+			return nil, err
+		}
+		return stream, nil
+	}
+}
+
+// AuthStreamHandler wraps the handler of a sync protocol to serve only the streams opened with the auth token of the
+// network secret by AuthNewStream, the other streams are reset. handler is returned as is if the secret is empty.
+func AuthStreamHandler(secret string, handler network.StreamHandler) network.StreamHandler {
+	if secret == "" {
+		return handler
+	}
+	return func(stream network.Stream) {
+		token := make([]byte, networkAuthSize)
+		_ = stream.SetReadDeadline(time.Now().Add(networkAuthTimeout))
+		_, err := io.ReadFull(stream, token)
+		_ = stream.SetReadDeadline(time.Time{})
+		remote := stream.Conn().RemotePeer()
+		if err != nil || !hmac.Equal(token, networkAuthToken(secret, remote, stream.Conn().LocalPeer())) {
+			log.Debug("Reject sync stream failing the network auth", "peer", shortPeerID(remote),
+				"protocol", stream.Protocol(), "err", err)
+			stream.Reset()
+			return
+		}
+		handler(stream)
+	}
+}
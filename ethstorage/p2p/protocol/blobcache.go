@@ -0,0 +1,75 @@
+// Copyright 2022-2023, EthStorage.
+// For license information, see https://github.com/ethstorage/es-node/blob/main/LICENSE
+
+package protocol
+
+import (
+	"math"
+	"sync"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/hashicorp/golang-lru/v2/simplelru"
+)
+
+type blobCacheKey struct {
+	contract common.Address
+	kvIdx    uint64
+}
+
+// blobCache is a LRU cache of the encoded blobs recently served to peers, capped by the total size of the blobs
+// in bytes, so the hot blobs requested by many peers are not read from disk repeatedly.
+type blobCache struct {
+	blobs   *simplelru.LRU[blobCacheKey, []byte]
+	size    uint64 // total size of the cached blobs
+	maxSize uint64
+	gen     uint64 // increased on each invalidation, so the blobs read before an overwrite are not cached
+	lock    sync.Mutex
+}
+
+func newBlobCache(maxSize uint64) *blobCache {
+	c := &blobCache{maxSize: maxSize}
+	// the number of blobs is bounded by maxSize instead
+	c.blobs, _ = simplelru.NewLRU[blobCacheKey, []byte](math.MaxInt, func(_ blobCacheKey, blob []byte) {
+		c.size -= uint64(len(blob))
+	})
+	return c
+}
+
+// get returns the cached blob of the key, and the cache generation which should be passed to add if the blob
+// is not cached and read from disk.
+func (c *blobCache) get(key blobCacheKey) ([]byte, uint64, bool) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	blob, ok := c.blobs.Get(key)
+	return blob, c.gen, ok
+}
+
+// add caches the blob of the key if the cache is not invalidated since gen is returned by get.
+func (c *blobCache) add(key blobCacheKey, blob []byte, gen uint64) {
+	if uint64(len(blob)) > c.maxSize {
+		return
+	}
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if gen != c.gen {
+		return
+	}
+	if old, ok := c.blobs.Peek(key); ok {
+		c.size -= uint64(len(old))
+	}
+	c.blobs.Add(key, blob)
+	c.size += uint64(len(blob))
+	for c.size > c.maxSize {
+		c.blobs.RemoveOldest()
+	}
+}
+
+// invalidate removes the cached blobs of the kv indexes of the contract.
+func (c *blobCache) invalidate(contract common.Address, kvIndices []uint64) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.gen++
+	for _, idx := range kvIndices {
+		c.blobs.Remove(blobCacheKey{contract: contract, kvIdx: idx})
+	}
+}
@@ -0,0 +1,51 @@
+// Copyright 2022-2023, EthStorage.
+// For license information, see https://github.com/ethstorage/es-node/blob/main/LICENSE
+
+package protocol
+
+import (
+	"sync"
+)
+
+// blobFrameOverhead is the max size of the rlp encoding of a BlobPayload beyond its blob, which is the list and the
+// blob headers, the miner address, the blob index, the blob commit and the encode type.
+const blobFrameOverhead = 128
+
+// blobBufferPool reuses the buffers of the frames of the streamed range responses, each holds a blob with its
+// metadata, so syncing the large blobs does not allocate a buffer of the kv size per blob. The server returns a
+// buffer once its frame is written, and the client once its frame is decoded. The pool is bounded as only the
+// buffers of its size are pooled, and the idle ones are released by the GC as sync.Pool does.
+//
+// A buffer got from the pool is zeroed, so the content of a blob never leaks into the frame of another index even
+// if the frame is not fully written.
+type blobBufferPool struct {
+	size int
+	pool sync.Pool
+}
+
+// newBlobBufferPool creates a pool of the buffers of the frames holding the blobs of up to maxKvSize.
+func newBlobBufferPool(maxKvSize uint64) *blobBufferPool {
+	return &blobBufferPool{size: int(maxKvSize) + blobFrameOverhead}
+}
+
+// get returns a zeroed buffer of n bytes, which is allocated if n is larger than the pooled buffers.
+func (p *blobBufferPool) get(n int) []byte {
+	if p == nil || n > p.size {
+		return make([]byte, n)
+	}
+	if b, ok := p.pool.Get().(*[]byte); ok {
+		buf := (*b)[:n]
+		clear(buf)
+		return buf
+	}
+	return make([]byte, n, p.size)
+}
+
+// put returns the buffer to the pool once it is no longer referenced, the buffers not of the pool size are dropped.
+func (p *blobBufferPool) put(b []byte) {
+	if p == nil || cap(b) != p.size {
+		return
+	}
+	b = b[:0]
+	p.pool.Put(&b)
+}
@@ -0,0 +1,98 @@
+// Copyright 2022-2023, EthStorage.
+// For license information, see https://github.com/ethstorage/es-node/blob/main/LICENSE
+
+package protocol
+
+import (
+	"sort"
+	"sync"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethstorage/go-ethstorage/ethstorage"
+)
+
+// commitIndex maps the commits of the local blobs to their kv indexes, so a blob can be served by its commit
+// without the kv index. Only the first HashSizeInContract bytes of a commit are kept in the meta, so the commits
+// are keyed by them. The same blob may be stored at several kv indexes, so a commit maps to all of them.
+type commitIndex struct {
+	kvIdxs  map[common.Hash][]uint64 // kv indexes of each commit, sorted
+	commits map[uint64]common.Hash   // commit of each indexed kv, to drop it when the kv is overwritten
+	indexed chan struct{}            // closed once the commits of the local blobs are indexed in the background
+	lock    sync.RWMutex
+}
+
+func newCommitIndex() *commitIndex {
+	return &commitIndex{
+		kvIdxs:  make(map[common.Hash][]uint64),
+		commits: make(map[uint64]common.Hash),
+		indexed: make(chan struct{}),
+	}
+}
+
+// commitKey returns the part of the commit kept in the meta, the empty blobs have no commit to index.
+func commitKey(commit common.Hash) (common.Hash, bool) {
+	var key common.Hash
+	copy(key[:ethstorage.HashSizeInContract], commit[:ethstorage.HashSizeInContract])
+	return key, key != (common.Hash{})
+}
+
+// update sets the commit of the kv, and drops its previous commit if the kv is overwritten.
+func (c *commitIndex) update(kvIdx uint64, commit common.Hash) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.set(kvIdx, commit)
+}
+
+// fill sets the commit of the kv read by readCommit. The commit is read with the index locked, so it is never older
+// than the commit of an update following the write of the kv, which is applied after it.
+func (c *commitIndex) fill(kvIdx uint64, readCommit func(kvIdx uint64) (common.Hash, bool)) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if commit, ok := readCommit(kvIdx); ok {
+		c.set(kvIdx, commit)
+	}
+}
+
+func (c *commitIndex) set(kvIdx uint64, commit common.Hash) {
+	key, ok := commitKey(commit)
+	if prev, exist := c.commits[kvIdx]; exist {
+		if ok && prev == key {
+			return
+		}
+		c.remove(prev, kvIdx)
+	}
+	if !ok {
+		return
+	}
+	c.commits[kvIdx] = key
+	idxs := c.kvIdxs[key]
+	i := sort.Search(len(idxs), func(i int) bool { return idxs[i] >= kvIdx })
+	c.kvIdxs[key] = append(idxs[:i], append([]uint64{kvIdx}, idxs[i:]...)...)
+}
+
+func (c *commitIndex) remove(key common.Hash, kvIdx uint64) {
+	delete(c.commits, kvIdx)
+	idxs := c.kvIdxs[key]
+	for i, idx := range idxs {
+		if idx == kvIdx {
+			idxs = append(idxs[:i], idxs[i+1:]...)
+			break
+		}
+	}
+	if len(idxs) == 0 {
+		delete(c.kvIdxs, key)
+	} else {
+		c.kvIdxs[key] = idxs
+	}
+}
+
+// lookup returns the kv indexes of the commit in ascending order.
+func (c *commitIndex) lookup(commit common.Hash) []uint64 {
+	key, ok := commitKey(commit)
+	if !ok {
+		return nil
+	}
+	c.lock.RLock()
+	defer c.lock.RUnlock()
+	return append([]uint64(nil), c.kvIdxs[key]...)
+}
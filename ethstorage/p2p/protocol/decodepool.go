@@ -0,0 +1,51 @@
+// Copyright 2022-2023, EthStorage.
+// For license information, see https://github.com/ethstorage/es-node/blob/main/LICENSE
+
+package protocol
+
+import (
+	"context"
+	"sync"
+)
+
+// decodePool is a bounded pool of workers to decode and verify the received blobs, so the CPU heavy decode
+// (e.g. ENCODE_ETHASH) of a response runs concurrently and overlaps with the network receive of other responses.
+// The blobs are independent of each other, so no ordering is kept between the jobs. A nil pool runs the jobs inline.
+type decodePool struct {
+	slots chan struct{} // a slot is taken by each running job, so the jobs exceeding the pool size are queued
+	wg    sync.WaitGroup
+}
+
+func newDecodePool(workers int) *decodePool {
+	return &decodePool{slots: make(chan struct{}, workers)}
+}
+
+// submit runs the job in the pool once a worker is available, and returns false without running the job if
+// ctx is done before that, so the queued jobs are dropped on cancellation.
+func (p *decodePool) submit(ctx context.Context, job func()) bool {
+	if p == nil {
+		job()
+		return true
+	}
+	select {
+	case p.slots <- struct{}{}:
+	case <-ctx.Done():
+		return false
+	}
+	p.wg.Add(1)
+	go func() {
+		defer func() {
+			<-p.slots
+			p.wg.Done()
+		}()
+		job()
+	}()
+	return true
+}
+
+// wait waits for the running jobs to finish.
+func (p *decodePool) wait() {
+	if p != nil {
+		p.wg.Wait()
+	}
+}
@@ -0,0 +1,83 @@
+// Copyright 2022-2023, EthStorage.
+// For license information, see https://github.com/ethstorage/es-node/blob/main/LICENSE
+
+package protocol
+
+import (
+	"fmt"
+	"os"
+	"runtime"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// throttledInFlight is the max number of the requests in flight while the sync is throttled by the LoadController
+	throttledInFlight = 1
+
+	// loadCheckInterval is the interval to re-read the load average, as it changes slowly
+	loadCheckInterval = time.Second
+)
+
+// LoadController tells the sync client to back off while the system is busy, e.g. the CPU or disk of a shared
+// machine is saturated by the other services. ShouldThrottle is consulted before each request is dispatched with
+// the lock of the sync client held, so it should return quickly.
+type LoadController interface {
+	// ShouldThrottle returns true if the sync should reduce the requests in flight.
+	ShouldThrottle() bool
+}
+
+// CPULoadController is the default LoadController, which throttles the sync while the 1-minute load average of
+// the system per CPU exceeds maxLoad. The load average on Linux counts the processes waiting for the disk as well,
+// so it catches the IO saturation too. The systems without /proc/loadavg are never throttled.
+type CPULoadController struct {
+	maxLoad  float64
+	numCPU   int
+	readLoad func() (float64, error)
+
+	lock     sync.Mutex
+	checked  time.Time // Time instance when the load average was last read
+	throttle bool      // Whether the last load average read exceeds maxLoad
+}
+
+// NewCPULoadController creates a CPULoadController throttling the sync above maxLoad load average per CPU.
+func NewCPULoadController(maxLoad float64) *CPULoadController {
+	return &CPULoadController{
+		maxLoad:  maxLoad,
+		numCPU:   runtime.NumCPU(),
+		readLoad: readLoadAvg,
+	}
+}
+
+// ShouldThrottle implements LoadController.
+func (c *CPULoadController) ShouldThrottle() bool {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	if time.Since(c.checked) < loadCheckInterval {
+		return c.throttle
+	}
+	c.checked = time.Now()
+	load, err := c.readLoad()
+	if err != nil {
+		c.throttle = false
+		return false
+	}
+	c.throttle = load/float64(c.numCPU) > c.maxLoad
+	return c.throttle
+}
+
+// readLoadAvg returns the 1-minute load average of the system.
+func readLoadAvg() (float64, error) {
+	data, err := os.ReadFile("/proc/loadavg")
+	if err != nil {
+		return 0, err
+	}
+	fields := strings.Fields(string(data))
+	if len(fields) == 0 {
+		return 0, fmt.Errorf("malformed load average %q", data)
+	}
+	return strconv.ParseFloat(fields[0], 64)
+}
@@ -7,26 +7,67 @@ import (
 	"context"
 	"math"
 	"math/big"
+	"slices"
+	"sync/atomic"
+	"time"
 
 	"github.com/ethereum/go-ethereum/common"
 	"github.com/ethereum/go-ethereum/log"
+	"github.com/klauspost/compress/zstd"
 	"github.com/libp2p/go-libp2p/core/network"
 	"github.com/libp2p/go-libp2p/core/peer"
+	"github.com/libp2p/go-libp2p/core/protocol"
 )
 
 // Peer is a collection of relevant information we have about a `storage` peer.
 type Peer struct {
-	id             peer.ID // Unique ID for the peer, cached
-	newStreamFn    newStreamFn
-	chainId        *big.Int
-	direction      network.Direction
-	version        uint                        // Protocol version negotiated
-	shards         map[common.Address][]uint64 // shards of this node support
-	minRequestSize float64
-	tracker        *Tracker
-	resCtx         context.Context
-	resCancel      context.CancelFunc
-	logger         log.Logger // Contextual logger with the peer id injected
+	id              peer.ID // Unique ID for the peer, cached
+	newStreamFn     newStreamFn
+	chainId         *big.Int
+	direction       network.Direction
+	version         uint                        // Protocol version negotiated
+	shards          map[common.Address][]uint64 // shards of this node support
+	lastKvIndex     map[common.Address]uint64   // last kv index of the contracts of the peer, protected by SyncClient.lock
+	lastKvIndexTime time.Time                   // time the last kv indexes are last requested, protected by SyncClient.lock
+	minRequestSize  float64
+	preferRange     bool                          // the peer prefers range requests to list requests, protected by SyncClient.lock
+	compression     bool                          // request the compressed range responses, falling back to uncompressed if not supported
+	streaming       bool                          // request the streamed range responses, falling back to the whole response if not supported
+	checksum        atomic.Bool                   // request the checksum footer of the blobs responses, set if the peer supports it
+	maxFrameSize    uint64                        // max size of a frame of the streamed range responses accepted from the peer
+	bufPool         *blobBufferPool               // buffers of the frames of the streamed range responses, nil to allocate them
+	zstdDecoder     func() (*zstd.Decoder, error) // decoder of the compressed range responses from the peer
+	maxDecodedSize  uint64                        // max decompressed size of a compressed range response from the peer
+	rangeBatch      uint64                        // blobs per range request adapted to the link, protected by SyncClient.lock
+	rtt             time.Duration                 // smoothed round trip time of the range requests, protected by SyncClient.lock
+	tracker         *Tracker
+	resCtx          context.Context
+	resCancel       context.CancelFunc
+	logger          log.Logger // Contextual logger with the peer id injected
+
+	encodeTypes map[common.Address]map[uint64]uint64 // known encode types of the shards, protected by SyncClient.lock
+	stats       PeerStats                            // failed responses of the peer, protected by SyncClient.lock
+	caps        atomic.Pointer[Capabilities]         // capabilities of the peer from the handshake, nil if not known
+
+	noAvailability atomic.Bool                      // the peer does not serve the availability requests, so it is not asked again
+	availability   atomic.Pointer[peerAvailability] // the last availability answered by the peer, nil if not asked yet
+}
+
+// peerAvailability is an availability answered by a peer, which is reused for the requests of the indexes in its range
+// until availabilityTTL passes, as the peer may sync the blobs missing meanwhile.
+type peerAvailability struct {
+	contract common.Address
+	shardId  uint64
+	origin   uint64
+	limit    uint64
+	bitmap   AvailabilityBitmap
+	time     time.Time
+}
+
+// covers returns whether the availability answers the indexes in range [origin, limit] of the shard.
+func (a *peerAvailability) covers(contract common.Address, shardId, origin, limit uint64) bool {
+	return a != nil && a.contract == contract && a.shardId == shardId && a.origin <= origin && limit <= a.limit &&
+		time.Since(a.time) < availabilityTTL
 }
 
 // NewPeer create a wrapper for a network connection and negotiated  protocol version.
@@ -40,7 +81,13 @@ func NewPeer(version uint, chainId *big.Int, peerId peer.ID, newStream newStream
 		direction:      direction,
 		version:        version,
 		shards:         shards,
+		lastKvIndex:    make(map[common.Address]uint64),
+		encodeTypes:    make(map[common.Address]map[uint64]uint64),
 		minRequestSize: float64(minRequestSize),
+		rangeBatch:     initRequestSize / minRequestSize,
+		maxFrameSize:   defaultMaxFrameSize,
+		zstdDecoder:    defaultZstdDecoder,
+		maxDecodedSize: defaultMaxDecodedSize,
 		tracker:        NewTracker(peerId.String(), float64(initRequestSize)/(p2pReadWriteTimeout.Seconds()*rttEstimateFactor)),
 		resCtx:         ctx,
 		resCancel:      cancel,
@@ -75,6 +122,20 @@ func (p *Peer) IsShardExist(contract common.Address, shardId uint64) bool {
 	return false
 }
 
+// EncodeType returns the encode type of the shard stored by the peer, and whether it is known from the capabilities
+// or the blobs delivered by the peer. The caller should hold SyncClient.lock.
+func (p *Peer) EncodeType(contract common.Address, shardId uint64) (uint64, bool) {
+	encodeType, ok := p.encodeTypes[contract][shardId]
+	return encodeType, ok
+}
+
+func (p *Peer) setEncodeType(contract common.Address, shardId uint64, encodeType uint64) {
+	if _, ok := p.encodeTypes[contract]; !ok {
+		p.encodeTypes[contract] = make(map[uint64]uint64)
+	}
+	p.encodeTypes[contract][shardId] = encodeType
+}
+
 // Log overrides the P2P logger with the higher level one containing only the id.
 func (p *Peer) Log() log.Logger {
 	return p.logger
@@ -87,14 +148,69 @@ func (p *Peer) getRequestSize() uint64 {
 // RequestBlobsByRange fetches a batch of kvs using a list of kv index
 func (p *Peer) RequestBlobsByRange(id uint64, contract common.Address, shardId uint64, origin uint64, limit uint64,
 	blobs *BlobsByRangePacket) (byte, error) {
+	return p.RequestBlobsByRangeWithContext(context.Background(), id, contract, shardId, origin, limit, blobs)
+}
+
+// RequestBlobsByRangeWithContext works as RequestBlobsByRange, and the request is aborted once ctx is done, including
+// while reading the streamed response, in which case the error of ctx is returned.
+func (p *Peer) RequestBlobsByRangeWithContext(ctx context.Context, id uint64, contract common.Address, shardId uint64,
+	origin uint64, limit uint64, blobs *BlobsByRangePacket) (byte, error) {
+	return p.requestBlobsByRange(ctx, id, contract, shardId, origin, limit, 0, blobs)
+}
+
+// RequestBlobPrefixesByRange fetches a range of kvs but only the first maxBytesPerBlob bytes of each encoded blob,
+// e.g. to check the header of blobs with less bandwidth. The returned blobs are partial, so they can not be
+// decoded or committed to the local storage.
+func (p *Peer) RequestBlobPrefixesByRange(id uint64, contract common.Address, shardId uint64, origin uint64, limit uint64,
+	maxBytesPerBlob uint64, blobs *BlobsByRangePacket) (byte, error) {
+	return p.RequestBlobPrefixesByRangeWithContext(context.Background(), id, contract, shardId, origin, limit, maxBytesPerBlob, blobs)
+}
+
+// RequestBlobPrefixesByRangeWithContext works as RequestBlobPrefixesByRange, and the request is aborted once ctx is
+// done, in which case the error of ctx is returned.
+func (p *Peer) RequestBlobPrefixesByRangeWithContext(ctx context.Context, id uint64, contract common.Address, shardId uint64,
+	origin uint64, limit uint64, maxBytesPerBlob uint64, blobs *BlobsByRangePacket) (byte, error) {
+	return p.requestBlobsByRange(ctx, id, contract, shardId, origin, limit, maxBytesPerBlob, blobs)
+}
+
+func (p *Peer) requestBlobsByRange(ctx context.Context, id uint64, contract common.Address, shardId uint64, origin uint64,
+	limit uint64, maxBytesPerBlob uint64, blobs *BlobsByRangePacket) (byte, error) {
 	p.logger.Trace("Fetching KVs", "reqId", id, "contract", contract,
-		"shardId", shardId, "origin", origin, "limit", limit)
+		"shardId", shardId, "origin", origin, "limit", limit, "maxBytesPerBlob", maxBytesPerBlob)
 
-	ctx, cancel := context.WithTimeout(p.resCtx, NewStreamTimeout)
+	// the request is aborted once either the caller is done or the peer is removed, only the error of the caller's
+	// ctx is returned as is, so the requests aborted by the removal of the peer still fail as reset
+	reqCtx, cancel := context.WithCancel(ctx)
 	defer cancel()
+	stopPeer := context.AfterFunc(p.resCtx, cancel)
+	defer stopPeer()
+
+	streamCtx, streamCancel := context.WithTimeout(reqCtx, NewStreamTimeout)
+	defer streamCancel()
 
-	stream, err := p.newStreamFn(ctx, p.id, GetProtocolID(RequestBlobsByRangeProtocolID, p.chainId))
+	compressedStreamedID := GetProtocolID(RequestCompressedStreamedBlobsByRangeProtocolID, p.chainId)
+	compressedID := GetProtocolID(RequestCompressedBlobsByRangeProtocolID, p.chainId)
+	streamedID := GetProtocolID(RequestStreamedBlobsByRangeProtocolID, p.chainId)
+	// the first protocol supported by the peer is selected in the order of compressed streamed, compressed, streamed
+	// and the whole response, so a peer without compression or streaming serves the whole response uncompressed. The
+	// compressed protocols are only requested if both the nodes enable compression.
+	protocolIDs := make([]protocol.ID, 0, 4)
+	compressed := p.compression && p.supportsCompression()
+	if compressed && p.streaming {
+		protocolIDs = append(protocolIDs, compressedStreamedID)
+	}
+	if compressed {
+		protocolIDs = append(protocolIDs, compressedID)
+	}
+	if p.streaming {
+		protocolIDs = append(protocolIDs, streamedID)
+	}
+	protocolIDs = append(protocolIDs, GetProtocolID(RequestBlobsByRangeProtocolID, p.chainId))
+	stream, err := p.newStreamFn(streamCtx, p.id, protocolIDs...)
 	if err != nil {
+		if ctx.Err() != nil {
+			return streamError, ctx.Err()
+		}
 		return streamError, err
 	}
 	defer func() {
@@ -102,28 +218,107 @@ func (p *Peer) RequestBlobsByRange(id uint64, contract common.Address, shardId u
 			stream.Close()
 		}
 	}()
+	// reset the stream to abort the request in flight once the peer is removed, e.g. by a reconnect, or ctx is done
+	stopReset := context.AfterFunc(reqCtx, func() { stream.Reset() })
+	defer stopReset()
 
 	requestSize := p.getRequestSize()
-	return SendRPC(stream, &GetBlobsByRangePacket{
+	req := &GetBlobsByRangePacket{
 		ID:       id,
 		Contract: contract,
 		ShardId:  shardId,
 		Origin:   origin,
 		Limit:    limit,
 		Bytes:    requestSize,
-	}, blobs)
+
+		MaxBytesPerBlob: maxBytesPerBlob,
+		Checksum:        p.checksum.Load(),
+	}
+	var returnCode byte
+	switch stream.Protocol() {
+	case compressedID:
+		returnCode, err = SendCompressedRPC(stream, p.zstdDecoder, p.maxDecodedSize, req, blobs)
+	case compressedStreamedID:
+		returnCode, err = sendStreamedRPC(ctx, stream, req, true, p.maxFrameSize, p.bufPool, blobs)
+	case streamedID:
+		returnCode, err = sendStreamedRPC(ctx, stream, req, false, p.maxFrameSize, p.bufPool, blobs)
+	default:
+		returnCode, err = SendRPC(stream, req, blobs)
+	}
+	if err != nil && ctx.Err() != nil {
+		return returnCode, ctx.Err()
+	}
+	if err == nil && req.Checksum {
+		err = verifyBlobsChecksum(blobs.Blobs, blobs.Checksum)
+	}
+	return returnCode, err
 }
 
 // RequestBlobsByList fetches a batch of kvs using a list of kv index
 func (p *Peer) RequestBlobsByList(id uint64, contract common.Address, shardId uint64, kvList []uint64,
 	blobs *BlobsByListPacket) (byte, error) {
+	return p.RequestBlobsByListWithContext(context.Background(), id, contract, shardId, kvList, blobs)
+}
+
+// RequestBlobsByListWithContext works as RequestBlobsByList, and the request is aborted once ctx is done, including
+// while waiting for the response, in which case the error of ctx is returned.
+func (p *Peer) RequestBlobsByListWithContext(ctx context.Context, id uint64, contract common.Address, shardId uint64,
+	kvList []uint64, blobs *BlobsByListPacket) (byte, error) {
 	p.logger.Trace("Fetching KVs", "reqId", id, "contract", contract,
 		"shardId", shardId, "count", len(kvList))
 
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	stopPeer := context.AfterFunc(p.resCtx, cancel)
+	defer stopPeer()
+
+	streamCtx, streamCancel := context.WithTimeout(ctx, NewStreamTimeout)
+	defer streamCancel()
+
+	stream, err := p.newStreamFn(streamCtx, p.id, GetProtocolID(RequestBlobsByListProtocolID, p.chainId))
+	if err != nil {
+		if ctx.Err() != nil {
+			return streamError, ctx.Err()
+		}
+		return streamError, err
+	}
+	defer stream.Close()
+	// reset the stream to unblock the read of the response once ctx is done
+	stopReset := context.AfterFunc(ctx, func() { stream.Reset() })
+	defer stopReset()
+
+	requestSize := p.getRequestSize()
+	checksum := p.checksum.Load()
+	returnCode, err := SendRPC(stream, &GetBlobsByListPacket{
+		ID:       id,
+		Contract: contract,
+		ShardId:  shardId,
+		BlobList: kvList,
+		Bytes:    requestSize,
+		Checksum: checksum,
+	}, blobs)
+	if err != nil && ctx.Err() != nil {
+		return returnCode, ctx.Err()
+	}
+	if err == nil && checksum {
+		err = verifyBlobsChecksum(blobs.Blobs, blobs.Checksum)
+	}
+	return returnCode, err
+}
+
+// supportsCompression returns whether the peer advertises the compression of the range responses, the peer without
+// the known capabilities is offered the compressed protocol and falls back to the uncompressed one if not supported.
+func (p *Peer) supportsCompression() bool {
+	caps := p.caps.Load()
+	return caps == nil || slices.Contains(caps.Compression, compressionZstd)
+}
+
+// RequestCapabilities fetches the capabilities of the peer by the capabilities handshake.
+func (p *Peer) RequestCapabilities(caps *Capabilities) (byte, error) {
 	ctx, cancel := context.WithTimeout(p.resCtx, NewStreamTimeout)
 	defer cancel()
 
-	stream, err := p.newStreamFn(ctx, p.id, GetProtocolID(RequestBlobsByListProtocolID, p.chainId))
+	stream, err := p.newStreamFn(ctx, p.id, RequestCapabilities)
 	if err != nil {
 		return streamError, err
 	}
@@ -133,12 +328,119 @@ func (p *Peer) RequestBlobsByList(id uint64, contract common.Address, shardId ui
 		}
 	}()
 
-	requestSize := p.getRequestSize()
-	return SendRPC(stream, &GetBlobsByListPacket{
+	return SendRPC(stream, make([]byte, 0), caps)
+}
+
+// RequestChunkProof fetches the chunk of a blob with its KZG proof from the peer.
+func (p *Peer) RequestChunkProof(contract common.Address, kvIdx, chunkIdx uint64, res *ChunkProofPacket) (byte, error) {
+	ctx, cancel := context.WithTimeout(p.resCtx, NewStreamTimeout)
+	defer cancel()
+
+	stream, err := p.newStreamFn(ctx, p.id, GetProtocolID(RequestChunkProofProtocolID, p.chainId))
+	if err != nil {
+		return streamError, err
+	}
+	defer func() {
+		if stream != nil {
+			stream.Close()
+		}
+	}()
+
+	return SendRPC(stream, &GetChunkProofPacket{Contract: contract, KvIdx: kvIdx, ChunkIdx: chunkIdx}, res)
+}
+
+// RequestBlobsByCommit fetches the blobs of the commits from the peer, the commits not found by the peer are
+// omitted from the response.
+func (p *Peer) RequestBlobsByCommit(id uint64, contract common.Address, commits []common.Hash, res *BlobsByCommitPacket) (byte, error) {
+	ctx, cancel := context.WithTimeout(p.resCtx, NewStreamTimeout)
+	defer cancel()
+
+	stream, err := p.newStreamFn(ctx, p.id, GetProtocolID(RequestBlobsByCommitProtocolID, p.chainId))
+	if err != nil {
+		return streamError, err
+	}
+	defer stream.Close()
+
+	return SendRPC(stream, &GetBlobsByCommitPacket{
+		ID:       id,
+		Contract: contract,
+		Commits:  commits,
+		Bytes:    p.getRequestSize(),
+	}, res)
+}
+
+// RequestAvailability fetches the bitmap of the blobs the peer holds in range [origin, limit] of the shard.
+func (p *Peer) RequestAvailability(id uint64, contract common.Address, shardId, origin, limit uint64, res *AvailabilityPacket) (byte, error) {
+	ctx, cancel := context.WithTimeout(p.resCtx, NewStreamTimeout)
+	defer cancel()
+
+	stream, err := p.newStreamFn(ctx, p.id, GetProtocolID(RequestAvailabilityProtocolID, p.chainId))
+	if err != nil {
+		return streamError, err
+	}
+	defer stream.Close()
+
+	return SendRPC(stream, &GetAvailabilityPacket{
 		ID:       id,
 		Contract: contract,
 		ShardId:  shardId,
-		BlobList: kvList,
-		Bytes:    requestSize,
-	}, blobs)
+		Origin:   origin,
+		Limit:    limit,
+	}, res)
+}
+
+// Ping sends a ping to the peer to keep the connection alive, and returns the return code of the peer.
+func (p *Peer) Ping() (byte, error) {
+	ctx, cancel := context.WithTimeout(p.resCtx, NewStreamTimeout)
+	defer cancel()
+
+	stream, err := p.newStreamFn(ctx, p.id, RequestPing)
+	if err != nil {
+		return streamError, err
+	}
+	defer stream.Close()
+
+	stream, err = Send(stream, make([]byte, 0))
+	if err != nil {
+		return clientError, err
+	}
+	_, returnCode, err := ReadMsg(stream)
+	return returnCode, err
+}
+
+// UpdateShardList pushes the shards of the local node to the peer, and returns the return code of the peer.
+func (p *Peer) UpdateShardList(shards map[common.Address][]uint64) (byte, error) {
+	ctx, cancel := context.WithTimeout(p.resCtx, NewStreamTimeout)
+	defer cancel()
+
+	stream, err := p.newStreamFn(ctx, p.id, UpdateShardList)
+	if err != nil {
+		return streamError, err
+	}
+	defer stream.Close()
+
+	stream, err = Send(stream, ConvertToContractShards(shards))
+	if err != nil {
+		return clientError, err
+	}
+	_, returnCode, err := ReadMsg(stream)
+	return returnCode, err
+}
+
+// RequestLastKvIndex fetches the last kv indexes of the contracts in the local view of the peer
+func (p *Peer) RequestLastKvIndex(indexes *[]*ContractLastKvIndex) (byte, error) {
+	ctx, cancel := context.WithTimeout(p.resCtx, NewStreamTimeout)
+	defer cancel()
+
+	stream, err := p.newStreamFn(ctx, p.id, RequestLastKvIndex)
+	if err != nil {
+		return streamError, err
+	}
+	defer func() {
+		if stream != nil {
+			stream.Close()
+		}
+	}()
+
+	return SendRPC(stream, make([]byte, 0), indexes)
 }
@@ -0,0 +1,121 @@
+// Copyright 2022-2023, EthStorage.
+// For license information, see https://github.com/ethstorage/es-node/blob/main/LICENSE
+
+package protocol
+
+import (
+	"encoding/json"
+	"fmt"
+	"slices"
+	"strings"
+)
+
+// DiffSyncStatus decodes two sync statuses saved by saveSyncStatus under SyncTasksKey, and reports the changes from
+// before to after a line each: the tasks added, removed and completed, and the subTasks advanced, done and added.
+// The heal indexes are saved in the heal logs instead of the status, so they are not compared. It helps to debug
+// the sync stalls across restarts.
+func DiffSyncStatus(before, after []byte) string {
+	tasksBefore, err := decodeStatusTasks(before)
+	if err != nil {
+		return fmt.Sprintf("failed to decode the status before: %v\n", err)
+	}
+	tasksAfter, err := decodeStatusTasks(after)
+	if err != nil {
+		return fmt.Sprintf("failed to decode the status after: %v\n", err)
+	}
+
+	var sb strings.Builder
+	names := make([]string, 0, len(tasksBefore)+len(tasksAfter))
+	for name := range tasksBefore {
+		names = append(names, name)
+	}
+	for name := range tasksAfter {
+		if _, ok := tasksBefore[name]; !ok {
+			names = append(names, name)
+		}
+	}
+	slices.Sort(names)
+	for _, name := range names {
+		tb, ta := tasksBefore[name], tasksAfter[name]
+		if tb == nil {
+			fmt.Fprintf(&sb, "%s: task added\n", name)
+			continue
+		}
+		if ta == nil {
+			fmt.Fprintf(&sb, "%s: task removed\n", name)
+			continue
+		}
+		diffStatusRanges(&sb, name, "subTask", subTaskRanges(tb), subTaskRanges(ta))
+		diffStatusRanges(&sb, name, "empty subTask", subEmptyTaskRanges(tb), subEmptyTaskRanges(ta))
+		if !statusTaskDone(tb) && statusTaskDone(ta) {
+			fmt.Fprintf(&sb, "%s: task completed\n", name)
+		}
+	}
+	if sb.Len() == 0 {
+		return "no changes\n"
+	}
+	return sb.String()
+}
+
+// decodeStatusTasks decodes the tasks of a saved sync status keyed by their contract and shard.
+func decodeStatusTasks(status []byte) (map[string]*task, error) {
+	var progress SyncProgress
+	if err := json.Unmarshal(status, &progress); err != nil {
+		return nil, err
+	}
+	tasks := make(map[string]*task, len(progress.Tasks))
+	for _, t := range progress.Tasks {
+		tasks[fmt.Sprintf("contract %s shard %d", t.Contract.Hex(), t.ShardId)] = t
+	}
+	return tasks, nil
+}
+
+// statusTaskDone returns whether no blob of the decoded task is left to sync or to fill.
+func statusTaskDone(t *task) bool {
+	return len(t.SubTasks) == 0 && len(t.SubEmptyTasks) == 0
+}
+
+// subTaskRanges returns the First of the subTasks of the task keyed by their Last, which is kept while the subTask
+// advances.
+func subTaskRanges(t *task) map[uint64]uint64 {
+	ranges := make(map[uint64]uint64, len(t.SubTasks))
+	for _, st := range t.SubTasks {
+		ranges[st.Last] = st.First
+	}
+	return ranges
+}
+
+// subEmptyTaskRanges returns the First of the subEmptyTasks of the task keyed by their Last.
+func subEmptyTaskRanges(t *task) map[uint64]uint64 {
+	ranges := make(map[uint64]uint64, len(t.SubEmptyTasks))
+	for _, st := range t.SubEmptyTasks {
+		ranges[st.Last] = st.First
+	}
+	return ranges
+}
+
+// diffStatusRanges reports the subTasks of a task advanced, done or added, the subTasks are matched by their Last.
+func diffStatusRanges(sb *strings.Builder, name, kind string, before, after map[uint64]uint64) {
+	lasts := make([]uint64, 0, len(before)+len(after))
+	for last := range before {
+		lasts = append(lasts, last)
+	}
+	for last := range after {
+		if _, ok := before[last]; !ok {
+			lasts = append(lasts, last)
+		}
+	}
+	slices.Sort(lasts)
+	for _, last := range lasts {
+		firstBefore, okBefore := before[last]
+		firstAfter, okAfter := after[last]
+		switch {
+		case !okBefore:
+			fmt.Fprintf(sb, "%s: %s [%d, %d) added\n", name, kind, firstAfter, last)
+		case !okAfter:
+			fmt.Fprintf(sb, "%s: %s [%d, %d) done\n", name, kind, firstBefore, last)
+		case firstAfter != firstBefore:
+			fmt.Fprintf(sb, "%s: %s [%d, %d) advanced to %d\n", name, kind, firstBefore, last, firstAfter)
+		}
+	}
+}
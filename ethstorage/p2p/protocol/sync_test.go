@@ -7,11 +7,22 @@ import (
 	"bytes"
 	"context"
 	"encoding/binary"
+	"encoding/json"
 	"errors"
 	"fmt"
+	"io"
+	"math"
 	"math/big"
 	"math/rand"
+	"net/http"
+	"net/http/httptest"
 	"os"
+	"path/filepath"
+	"reflect"
+	"slices"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
 
@@ -19,17 +30,25 @@ import (
 	"github.com/ethereum/go-ethereum"
 	"github.com/ethereum/go-ethereum/common"
 	"github.com/ethereum/go-ethereum/core/rawdb"
+	"github.com/ethereum/go-ethereum/crypto"
 	"github.com/ethereum/go-ethereum/ethdb"
 	"github.com/ethereum/go-ethereum/event"
 	"github.com/ethereum/go-ethereum/log"
+	"github.com/ethereum/go-ethereum/p2p/enode"
+	"github.com/ethereum/go-ethereum/p2p/enr"
+	"github.com/ethereum/go-ethereum/rlp"
 	"github.com/ethstorage/go-ethstorage/ethstorage"
 	"github.com/ethstorage/go-ethstorage/ethstorage/metrics"
 	prv "github.com/ethstorage/go-ethstorage/ethstorage/prover"
 	"github.com/ethstorage/go-ethstorage/ethstorage/rollup"
 	"github.com/libp2p/go-libp2p/core/host"
 	"github.com/libp2p/go-libp2p/core/network"
+	"github.com/libp2p/go-libp2p/core/peer"
+	"github.com/libp2p/go-libp2p/core/protocol"
 	bhost "github.com/libp2p/go-libp2p/p2p/host/blank"
 	swarmt "github.com/libp2p/go-libp2p/p2p/net/swarm/testing"
+	ma "github.com/multiformats/go-multiaddr"
+	"github.com/prometheus/client_golang/prometheus/testutil"
 )
 
 const (
@@ -47,6 +66,26 @@ var (
 	prover   = prv.NewKZGProver(testLog)
 )
 
+// TestMain runs the tests in a temporary directory, so the meta file and the data files created by the tests in
+// the working directory are removed once the tests are done, and the tree is left clean.
+func TestMain(m *testing.M) {
+	dir, err := os.MkdirTemp("", "sync-test")
+	if err != nil {
+		panic(fmt.Sprintf("create temp dir fail with err %s", err.Error()))
+	}
+	wd, err := os.Getwd()
+	if err != nil {
+		panic(fmt.Sprintf("get working dir fail with err %s", err.Error()))
+	}
+	if err := os.Chdir(dir); err != nil {
+		panic(fmt.Sprintf("change working dir fail with err %s", err.Error()))
+	}
+	code := m.Run()
+	os.Chdir(wd)
+	os.RemoveAll(dir)
+	os.Exit(code)
+}
+
 type remotePeer struct {
 	shards       []uint64            // shards the remote peer support
 	excludedList map[uint64]struct{} // excludedList a list of blob indexes whose data is not exist in the remote peer
@@ -130,9 +169,18 @@ type mockStorageManagerReader struct {
 	contractAddress common.Address
 	shardMiner      common.Address
 	blobPayloads    map[uint64]*BlobPayloadWithRowData
+	lastKvIndex     uint64
+	readDelay       time.Duration // delay of each TryReadEncoded to simulate a slow server
+	reads           atomic.Uint64 // count of TryReadEncoded calls
+	readIdxs        sync.Map      // kv indexes read by TryReadEncoded
 }
 
 func (s *mockStorageManagerReader) TryReadEncoded(kvIdx uint64, readLen int) ([]byte, bool, error) {
+	s.reads.Add(1)
+	s.readIdxs.Store(kvIdx, struct{}{})
+	if s.readDelay > 0 {
+		time.Sleep(s.readDelay)
+	}
 	if blobPayload, ok := s.blobPayloads[kvIdx]; ok {
 		data := blobPayload.EncodedBlob
 		if len(data) > readLen {
@@ -152,6 +200,10 @@ func (s *mockStorageManagerReader) TryReadMeta(kvIdx uint64) ([]byte, bool, erro
 	}
 }
 
+func (s *mockStorageManagerReader) LastKvIndex() uint64 {
+	return s.lastKvIndex
+}
+
 func (s *mockStorageManagerReader) KvEntries() uint64 {
 	return s.kvEntries
 }
@@ -176,6 +228,14 @@ func (s *mockStorageManagerReader) GetShardEncodeType(shardIdx uint64) (uint64,
 	return s.encodeType, true
 }
 
+func (s *mockStorageManagerReader) DecodeKV(kvIdx uint64, b []byte, hash common.Hash, providerAddr common.Address, encodeType uint64) ([]byte, bool, error) {
+	if blobPayload, ok := s.blobPayloads[kvIdx]; ok {
+		return blobPayload.RowData, true, nil
+	} else {
+		return nil, false, ethereum.NotFound
+	}
+}
+
 type BlobPayloadWithRowData struct {
 	MinerAddress common.Address `json:"minerAddress"`
 	BlobIndex    uint64         `json:"blobIndex"`
@@ -194,7 +254,7 @@ func createEthStorage(contract common.Address, shardIdxList []uint64, chunkSize,
 	files := make([]string, 0)
 	for _, shardIdx := range shardIdxList {
 		sm.AddDataShard(shardIdx)
-		fileName := fmt.Sprintf(".\\ss%d.dat", shardIdx)
+		fileName := fmt.Sprintf(".\\ss-%s-%d.dat", contract.Hex(), shardIdx)
 		files = append(files, fileName)
 		startChunkId := shardIdx * chunkPerKv * kvEntries
 		_, err := ethstorage.Create(fileName, startChunkId, kvEntries*chunkPerKv, 0, kvSize, encodeType, miner, sm.ChunkSize())
@@ -575,19 +635,22 @@ func TestSync_RequestL2Range(t *testing.T) {
 	verifyKVs(data, excludedList, t)
 }
 
-// TestSync_RequestL2Range test peer RequestBlobsByList func and verify result
-func TestSync_RequestL2List(t *testing.T) {
+// TestSync_RequestL2RangeWithResults test RequestL2RangeWithResults classify the outcome of each blob in the range
+func TestSync_RequestL2RangeWithResults(t *testing.T) {
 	var (
-		kvSize       = defaultChunkSize
-		kvEntries    = uint64(16)
-		lastKvIndex  = uint64(16)
-		ctx, cancel  = context.WithCancel(context.Background())
-		excludedList = make(map[uint64]struct{})
-		db           = rawdb.NewMemoryDatabase()
-		mux          = new(event.Feed)
-		shards       = make(map[common.Address][]uint64)
-		m            = metrics.NewMetrics("sync_test")
-		rollupCfg    = &rollup.EsConfig{
+		kvSize        = defaultChunkSize
+		kvEntries     = uint64(16)
+		lastKvIndex   = uint64(16)
+		ctx, cancel   = context.WithCancel(context.Background())
+		db            = rawdb.NewMemoryDatabase()
+		mux           = new(event.Feed)
+		shards        = make(map[common.Address][]uint64)
+		m             = metrics.NewMetrics("sync_test")
+		presentList   = []uint64{1, 2}
+		failedIdx     = uint64(5)
+		missingIdx    = uint64(7)
+		remoteExclude = map[uint64]struct{}{missingIdx: {}}
+		rollupCfg     = &rollup.EsConfig{
 			L2ChainID: new(big.Int).SetUint64(3333),
 		}
 	)
@@ -604,15 +667,21 @@ func TestSync_RequestL2List(t *testing.T) {
 	if shardManager == nil {
 		t.Fatalf("createEthStorage failed")
 	}
+	shards[shardManager.ContractAddress()] = shardManager.ShardIds()
 
 	defer func(files []string) {
 		for _, file := range files {
 			os.Remove(file)
 		}
 	}(files)
-	shards[shardManager.ContractAddress()] = shardManager.ShardIds()
 
 	data := makeKVStorage(contract, []uint64{0}, defaultChunkSize, kvSize, kvEntries, lastKvIndex, common.Address{}, defaultEncodeType, metafile)
+	remoteData := copyShardData(data[contract], []uint64{0}, kvEntries, remoteExclude)
+	corrupted := *remoteData[failedIdx]
+	corrupted.EncodedBlob = make([]byte, len(remoteData[failedIdx].EncodedBlob))
+	copy(corrupted.EncodedBlob, remoteData[failedIdx].EncodedBlob)
+	corrupted.EncodedBlob[100] = ^corrupted.EncodedBlob[100]
+	remoteData[failedIdx] = &corrupted
 
 	l1 := NewMockL1Source(lastKvIndex, metafileName)
 	sm := ethstorage.NewStorageManager(shardManager, l1)
@@ -623,7 +692,7 @@ func TestSync_RequestL2List(t *testing.T) {
 		shards:          []uint64{0},
 		contractAddress: contract,
 		shardMiner:      common.Address{},
-		blobPayloads:    data[contract],
+		blobPayloads:    remoteData,
 	}
 
 	// create local and remote hosts, set up sync client and server
@@ -635,41 +704,87 @@ func TestSync_RequestL2List(t *testing.T) {
 		t.Fatal("Download blob metadata failed", "error", err)
 		return
 	}
+	// commit some blobs to local storage before the request
+	blobs, commits := make([][]byte, 0), make([]common.Hash, 0)
+	for _, idx := range presentList {
+		blobs = append(blobs, data[contract][idx].RowData)
+		commits = append(commits, data[contract][idx].BlobCommit)
+	}
+	if inserted, err := sm.CommitBlobs(presentList, blobs, commits); err != nil || len(inserted) != len(presentList) {
+		t.Fatalf("commit present blobs failed, inserted %v, err %v", inserted, err)
+	}
 	remoteHost := createRemoteHost(t, ctx, rollupCfg, smr, db, m, testLog)
 	connect(t, localHost, remoteHost, shards, shards)
 
-	indexes := make([]uint64, 0)
-	for i := uint64(0); i < 16; i++ {
-		indexes = append(indexes, i)
-	}
 	time.Sleep(2 * time.Second)
 	// send request
-	_, err = syncCl.RequestL2List(indexes)
+	// the range ends beyond the shard, whose blobs are not served
+	_, results, err := syncCl.RequestL2RangeWithResults(0, kvEntries+1)
 	if err != nil {
 		t.Fatal(err)
 	}
-	verifyKVs(data, excludedList, t)
+	if uint64(len(results)) != kvEntries+2 {
+		t.Fatalf("result count mismatch, expected %d, real %d", kvEntries+2, len(results))
+	}
+	for _, result := range results {
+		expected := BlobCommitted
+		switch result.Index {
+		case presentList[0], presentList[1]:
+			expected = BlobAlreadyPresent
+		case failedIdx:
+			expected = BlobFailed
+			if result.Reason == "" {
+				t.Fatalf("failed blob %d should have a reason", result.Index)
+			}
+		case missingIdx:
+			expected = BlobNotReturned
+		case kvEntries, kvEntries + 1:
+			expected = BlobNotServed
+		}
+		if result.Outcome != expected {
+			t.Fatalf("outcome of blob %d mismatch, expected %s, real %s", result.Index, expected, result.Outcome)
+		}
+	}
+	if _, ok := syncCl.tasks[0].healTask.Indexes[missingIdx]; ok {
+		t.Fatalf("blob %d should not be added to heal task by the request", missingIdx)
+	}
+	syncCl.HealIndexes(contract, []uint64{missingIdx})
+	if _, ok := syncCl.tasks[0].healTask.Indexes[missingIdx]; !ok {
+		t.Fatalf("blob %d should be added to heal task", missingIdx)
+	}
 }
 
-// TestSaveAndLoadSyncStatus test save sync state to DB for tasks and load sync state from DB for tasks.
-func TestSaveAndLoadSyncStatus(t *testing.T) {
+// TestSync_RequestL2RangeFromPeer test RequestL2RangeFromPeer requests the range from the chosen peer only,
+// and rejects the peers not connected or not serving the shard, and RequestBlobPrefixesFromPeer returns the
+// blob prefixes without committing them
+func TestSync_RequestL2RangeFromPeer(t *testing.T) {
 	var (
-		entries             = uint64(1) << 10
-		kvSize              = defaultChunkSize
-		lastKvIndex         = entries*3 - 20
-		db                  = rawdb.NewMemoryDatabase()
-		mux                 = new(event.Feed)
-		m                   = metrics.NewMetrics("sync_test")
-		expectedSecondsUsed = uint64(10)
-		rollupCfg           = &rollup.EsConfig{
+		kvSize      = defaultChunkSize
+		kvEntries   = uint64(16)
+		lastKvIndex = uint64(16)
+		readLen     = uint64(1024)
+		ctx, cancel = context.WithCancel(context.Background())
+		db          = rawdb.NewMemoryDatabase()
+		mux         = new(event.Feed)
+		shards      = make(map[common.Address][]uint64)
+		m           = metrics.NewMetrics("sync_test")
+		rollupCfg   = &rollup.EsConfig{
 			L2ChainID: new(big.Int).SetUint64(3333),
 		}
 	)
-	// create ethstorage and generate data
-	shardManager, files := createEthStorage(contract, []uint64{0, 1, 2}, defaultChunkSize, kvSize, entries, common.Address{}, defaultEncodeType)
+	defer cancel()
+
+	metafile, err := CreateMetaFile(metafileName, int64(kvEntries))
+	if err != nil {
+		t.Error("Create metafileName fail", err.Error())
+	}
+	defer metafile.Close()
+
+	shardManager, files := createEthStorage(contract, []uint64{0}, defaultChunkSize, kvSize, kvEntries, common.Address{}, defaultEncodeType)
 	if shardManager == nil {
 		t.Fatalf("createEthStorage failed")
 	}
+	shards[shardManager.ContractAddress()] = shardManager.ShardIds()
 
 	defer func(files []string) {
 		for _, file := range files {
@@ -677,124 +792,119 @@ func TestSaveAndLoadSyncStatus(t *testing.T) {
 		}
 	}(files)
 
+	data := makeKVStorage(contract, []uint64{0}, defaultChunkSize, kvSize, kvEntries, lastKvIndex, common.Address{}, defaultEncodeType, metafile)
+
 	l1 := NewMockL1Source(lastKvIndex, metafileName)
 	sm := ethstorage.NewStorageManager(shardManager, l1)
-	sm.Reset(0)
-	_, syncCl := createLocalHostAndSyncClient(t, testLog, rollupCfg, db, sm, m, mux)
+	localHost, syncCl := createLocalHostAndSyncClient(t, testLog, rollupCfg, db, sm, m, mux)
 	syncCl.loadSyncStatus()
-	indexes := []uint64{30, 5, 8}
-	syncCl.tasks[0].healTask.insert(indexes)
-	syncCl.tasks[0].SubTasks[0].First = 1
-	syncCl.tasks[0].SubTasks[0].next = 33
-	syncCl.tasks[0].state.PeerCount = 60
-	syncCl.tasks[0].state.FillEmptySeconds = expectedSecondsUsed
-	syncCl.tasks[0].state.BlobsSynced = 30
-	syncCl.tasks[0].state.SyncedSeconds = expectedSecondsUsed
-	syncCl.tasks[1].SubTasks = make([]*subTask, 0)
-	syncCl.tasks[1].state.BlobsSynced = entries
-	syncCl.tasks[1].state.SyncedSeconds = expectedSecondsUsed
-
-	tasks := syncCl.tasks
-	syncCl.cleanTasks()
-	if !syncCl.tasks[1].done {
-		t.Fatalf("task 1 should be done.")
+	sm.Reset(0)
+	if err := sm.DownloadAllMetas(context.Background(), 16); err != nil {
+		t.Fatal("Download blob metadata failed", "error", err)
 	}
-	syncCl.saveSyncStatus()
 
-	syncCl.tasks = make([]*task, 0)
-	syncCl.loadSyncStatus()
-	tasks[0].healTask.Indexes = make(map[uint64]int64)
-	tasks[0].SubTasks[0].First = 5
-	tasks[0].SubTasks[0].next = 5
-	tasks[1].done = false
+	smrs := make([]*mockStorageManagerReader, 2)
+	hosts := make([]host.Host, 2)
+	for i := range smrs {
+		smrs[i] = &mockStorageManagerReader{
+			kvEntries:       kvEntries,
+			maxKvSize:       kvSize,
+			encodeType:      defaultEncodeType,
+			shards:          []uint64{0},
+			contractAddress: contract,
+			shardMiner:      common.Address{},
+			blobPayloads:    copyShardData(data[contract], []uint64{0}, kvEntries, make(map[uint64]struct{})),
+		}
+		hosts[i] = createRemoteHost(t, ctx, rollupCfg, smrs[i], db, m, testLog)
+		connect(t, localHost, hosts[i], shards, shards)
+	}
+	time.Sleep(2 * time.Second)
 
-	if err := compareTasks(tasks, syncCl.tasks); err != nil {
-		t.Fatalf("compare kv task fail. err: %s", err.Error())
+	if _, _, err := syncCl.RequestL2RangeFromPeer(ctx, localHost.ID(), 0, kvEntries-1); err == nil {
+		t.Fatalf("request from a peer not connected should fail")
 	}
-	if syncCl.tasks[0].state.PeerCount != 0 {
-		t.Fatalf("compare PeerCount fail, expect %d, real %d, the peer count should be clean when reload.", 0, &syncCl.tasks[0].state.PeerCount)
+	if _, _, err := syncCl.RequestL2RangeFromPeer(ctx, hosts[1].ID(), kvEntries, 2*kvEntries-1); err == nil {
+		t.Fatalf("request from a peer not serving the shard should fail")
 	}
-	if syncCl.tasks[0].state.BlobsSynced != 30 {
-		t.Fatalf("compare BlobsSynced fail, expect %d, real %d", 30, syncCl.tasks[0].state.BlobsSynced)
+
+	// the blob prefixes are returned as is, without being committed to the local storage
+	if _, err := syncCl.RequestBlobPrefixesFromPeer(ctx, hosts[1].ID(), 0, kvEntries-1, 0); err == nil {
+		t.Fatalf("request of the empty blob prefixes should fail")
 	}
-	if syncCl.tasks[0].state.SyncedSeconds != expectedSecondsUsed {
-		t.Fatalf("compare totalSecondsUsed fail, expect %d, real %d", expectedSecondsUsed, syncCl.tasks[0].state.SyncedSeconds)
+	prefixes, err := syncCl.RequestBlobPrefixesFromPeer(ctx, hosts[1].ID(), 0, kvEntries-1, readLen)
+	if err != nil {
+		t.Fatal(err)
 	}
-	if syncCl.tasks[1].state.BlobsSynced != entries {
-		t.Fatalf("compare BlobsSynced fail, expect %d, real %d", entries, syncCl.tasks[1].state.BlobsSynced)
+	if uint64(len(prefixes)) != kvEntries {
+		t.Fatalf("prefix count mismatch, expected %d, real %d", kvEntries, len(prefixes))
 	}
-	if syncCl.tasks[1].state.SyncedSeconds != expectedSecondsUsed {
-		t.Fatalf("compare totalSecondsUsed fail, expect %d, real %d", expectedSecondsUsed, syncCl.tasks[1].state.SyncedSeconds)
+	for _, blob := range prefixes {
+		expected, _, _ := smrs[1].TryReadEncoded(blob.BlobIndex, int(readLen))
+		if !bytes.Equal(blob.EncodedBlob, expected) {
+			t.Fatalf("blob %d prefix is not match, expected len: %d, actual len: %d", blob.BlobIndex, readLen, len(blob.EncodedBlob))
+		}
 	}
-}
 
-// TestReadWrite tests a basic eth storage read/write
-func TestReadWrite(t *testing.T) {
-	var (
-		kvSize    = defaultChunkSize
-		kvEntries = uint64(16)
-		val       = make([]byte, kvSize)
-	)
-	shards, files := createEthStorage(contract, []uint64{0}, defaultChunkSize, kvSize, kvEntries, common.Address{}, defaultEncodeType)
-	if shards == nil {
-		t.Fatalf("createEthStorage failed")
+	// the blobs are committed by the range request, as the prefixes above are not
+	_, results, err := syncCl.RequestL2RangeFromPeer(ctx, hosts[1].ID(), 0, kvEntries-1)
+	if err != nil {
+		t.Fatal(err)
 	}
-
-	defer func(files []string) {
-		for _, file := range files {
-			os.Remove(file)
+	if uint64(len(results)) != kvEntries {
+		t.Fatalf("result count mismatch, expected %d, real %d", kvEntries, len(results))
+	}
+	for _, result := range results {
+		if result.Outcome != BlobCommitted {
+			t.Fatalf("outcome of blob %d mismatch, expected %s, real %s", result.Index, BlobCommitted, result.Outcome)
+		}
+		if _, ok := smrs[1].readIdxs.Load(result.Index); !ok {
+			t.Fatalf("blob %d should be requested from the chosen peer", result.Index)
 		}
-	}(files)
-
-	val[0] = 1
-	root, _ := prover.GetRoot(val, 1, 1)
-	commit := generateMetadata(root)
-	sm := ethstorage.ContractToShardManager[contract]
-	success, err := sm.TryWrite(0, val, commit)
-	if !success || err != nil {
-		t.Fatalf("failed to write")
 	}
-	rdata, success, err := sm.TryRead(0, 1, commit)
-	if !success || err != nil {
-		t.Fatalf("failed to read")
+	if reads := smrs[0].reads.Load(); reads != 0 {
+		t.Fatalf("blobs should not be requested from the other peer, reads %d", reads)
 	}
-	if !bytes.Equal([]byte{1}, rdata) {
-		t.Fatalf("failed to compare")
+	verifyKVs(data, make(map[uint64]struct{}), t)
+
+	// the request in flight is aborted once ctx is done, instead of waiting for the slow peer
+	smrs[0].readDelay = 200 * time.Millisecond
+	reqCtx, reqCancel := context.WithTimeout(ctx, 300*time.Millisecond)
+	defer reqCancel()
+	begin := time.Now()
+	if _, _, err := syncCl.RequestL2RangeFromPeer(reqCtx, hosts[0].ID(), 0, kvEntries-1); !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("request should be aborted by the deadline of ctx, err %v", err)
+	}
+	if elapsed := time.Since(begin); elapsed > 2*time.Second {
+		t.Fatalf("request should be aborted once ctx is done, elapsed %s", elapsed)
 	}
 }
 
-// testSync sync test with a general process:
-// 1. create a storage manager and a local node, then start the sync client;
-// 2. prepare test data which need to sync to the local node;
-// 3. copy data for remote peers (only copy the data for shard remote peer supported, exclude data whose
-// blob index in the excluded list) and create storage manager reader for remote peers;
-// 4. create remote peers with storage manager reader and connect to local node;
-// 5. wait for sync client syncDone or time out
-// 6. verify blobs synced to local node with test data
-func testSync(t *testing.T, chunkSize, kvSize, kvEntries uint64, localShards []uint64, lastKvIndex uint64,
-	encodeType uint64, waitTime time.Duration, remotePeers []*remotePeer, expectedState bool) {
+// TestSync_RequestL2Range test peer RequestBlobsByList func and verify result
+func TestSync_RequestL2List(t *testing.T) {
 	var (
-		db            = rawdb.NewMemoryDatabase()
-		ctx, cancel   = context.WithCancel(context.Background())
-		mux           = new(event.Feed)
-		localShardMap = make(map[common.Address][]uint64)
-		m             = metrics.NewMetrics("sync_test")
-		rollupCfg     = &rollup.EsConfig{
+		kvSize       = defaultChunkSize
+		kvEntries    = uint64(16)
+		lastKvIndex  = uint64(16)
+		ctx, cancel  = context.WithCancel(context.Background())
+		excludedList = make(map[uint64]struct{})
+		db           = rawdb.NewMemoryDatabase()
+		mux          = new(event.Feed)
+		shards       = make(map[common.Address][]uint64)
+		m            = metrics.NewMetrics("sync_test")
+		rollupCfg    = &rollup.EsConfig{
 			L2ChainID: new(big.Int).SetUint64(3333),
 		}
 	)
+	defer cancel()
 
-	metafile, err := CreateMetaFile(metafileName, int64(kvEntries)*int64(len(localShards)))
+	metafile, err := CreateMetaFile(metafileName, int64(kvEntries))
 	if err != nil {
 		t.Error("Create metafileName fail", err.Error())
 	}
-	defer func() {
-		metafile.Close()
-		os.Remove(metafileName)
-	}()
+	defer metafile.Close()
 
-	localShardMap[contract] = localShards
-	shardManager, files := createEthStorage(contract, localShards, chunkSize, kvSize, kvEntries, common.Address{}, encodeType)
+	// create ethstorage and generate data
+	shardManager, files := createEthStorage(contract, []uint64{0}, defaultChunkSize, kvSize, kvEntries, common.Address{}, defaultEncodeType)
 	if shardManager == nil {
 		t.Fatalf("createEthStorage failed")
 	}
@@ -804,213 +914,8196 @@ func testSync(t *testing.T, chunkSize, kvSize, kvEntries uint64, localShards []u
 			os.Remove(file)
 		}
 	}(files)
+	shards[shardManager.ContractAddress()] = shardManager.ShardIds()
+
+	data := makeKVStorage(contract, []uint64{0}, defaultChunkSize, kvSize, kvEntries, lastKvIndex, common.Address{}, defaultEncodeType, metafile)
 
 	l1 := NewMockL1Source(lastKvIndex, metafileName)
 	sm := ethstorage.NewStorageManager(shardManager, l1)
-	sm.Reset(0)
-	data := makeKVStorage(contract, localShards, chunkSize, kvSize, kvEntries, lastKvIndex, common.Address{}, encodeType, metafile)
-	localHost, syncCl := createLocalHostAndSyncClient(t, testLog, rollupCfg, db, sm, m, mux)
-	syncCl.Start()
-
-	finalExcludedList := remotePeers[0].excludedList
-	for _, rPeer := range remotePeers {
-		// fill empty to excludedList for verify KVs
-		fillEmpty(shardManager, rPeer.excludedList)
-		finalExcludedList = mergeExcludedList(finalExcludedList, rPeer.excludedList)
-		pData := copyShardData(data[contract], rPeer.shards, kvEntries, rPeer.excludedList)
-		smr := &mockStorageManagerReader{
-			kvEntries:       kvEntries,
-			maxKvSize:       kvSize,
-			encodeType:      encodeType,
-			shards:          rPeer.shards,
-			contractAddress: contract,
-			shardMiner:      common.Address{},
-			blobPayloads:    pData,
-		}
-		rShardMap := make(map[common.Address][]uint64)
-		rShardMap[contract] = rPeer.shards
-		remoteHost := createRemoteHost(t, ctx, rollupCfg, smr, db, m, testLog)
-		connect(t, localHost, remoteHost, localShardMap, rShardMap)
+	smr := &mockStorageManagerReader{
+		kvEntries:       kvEntries,
+		maxKvSize:       kvSize,
+		encodeType:      defaultEncodeType,
+		shards:          []uint64{0},
+		contractAddress: contract,
+		shardMiner:      common.Address{},
+		blobPayloads:    data[contract],
 	}
 
-	checkStall(t, waitTime, mux, cancel)
-
-	if syncCl.syncDone != expectedState {
-		t.Fatalf("sync state %v is not match with expected state %v, peer count %d", syncCl.syncDone, expectedState, len(syncCl.peers))
+	// create local and remote hosts, set up sync client and server
+	localHost, syncCl := createLocalHostAndSyncClient(t, testLog, rollupCfg, db, sm, m, mux)
+	syncCl.loadSyncStatus()
+	sm.Reset(0)
+	err = sm.DownloadAllMetas(context.Background(), 16)
+	if err != nil {
+		t.Fatal("Download blob metadata failed", "error", err)
+		return
 	}
-	verifyKVs(data, finalExcludedList, t)
+	remoteHost := createRemoteHost(t, ctx, rollupCfg, smr, db, m, testLog)
+	connect(t, localHost, remoteHost, shards, shards)
+
+	indexes := make([]uint64, 0)
+	for i := uint64(0); i < 16; i++ {
+		indexes = append(indexes, i)
+	}
+	time.Sleep(2 * time.Second)
+	// send request
+	_, err = syncCl.RequestL2List(indexes)
+	if err != nil {
+		t.Fatal(err)
+	}
+	verifyKVs(data, excludedList, t)
 }
 
-// TestSimpleSync test sync process with local node support a single small (its task contains only 1 subTask) shard
-// and sync data from 1 remote peer, it should be sync done.
-func TestSimpleSync(t *testing.T) {
+// TestSync_RequestL2ListCancel test RequestL2ListWithContext returns promptly with the partial count once the
+// context is canceled in the middle of the list.
+func TestSync_RequestL2ListCancel(t *testing.T) {
 	var (
 		kvSize      = defaultChunkSize
 		kvEntries   = uint64(16)
 		lastKvIndex = uint64(16)
+		ctx, cancel = context.WithCancel(context.Background())
+		db          = rawdb.NewMemoryDatabase()
+		mux         = new(event.Feed)
+		shards      = map[common.Address][]uint64{contract: {0}}
+		m           = metrics.NewMetrics("sync_test")
+		rollupCfg   = &rollup.EsConfig{
+			L2ChainID: new(big.Int).SetUint64(3333),
+		}
 	)
-	remotePeers := []*remotePeer{{
-		shards:       []uint64{0},
-		excludedList: make(map[uint64]struct{}),
-	}}
+	defer cancel()
 
-	testSync(t, defaultChunkSize, kvSize, kvEntries, []uint64{0}, lastKvIndex, defaultEncodeType, 4, remotePeers, true)
-}
+	metafile, err := CreateMetaFile(metafileName, int64(kvEntries))
+	if err != nil {
+		t.Error("Create metafileName fail", err.Error())
+	}
+	defer metafile.Close()
 
-// TestMultiSubTasksSync test sync process with local node support a single big (its task contains multi subTask) shard
-// and sync data from 1 remote peer, it should be sync done.
-func TestMultiSubTasksSync(t *testing.T) {
-	var (
-		kvSize      = defaultChunkSize
-		kvEntries   = uint64(64)
-		lastKvIndex = uint64(64)
-	)
-	remotePeers := []*remotePeer{{
-		shards:       []uint64{0},
-		excludedList: make(map[uint64]struct{}),
-	}}
+	shardManager, files := createEthStorage(contract, []uint64{0}, defaultChunkSize, kvSize, kvEntries, common.Address{}, defaultEncodeType)
+	if shardManager == nil {
+		t.Fatalf("createEthStorage failed")
+	}
+	defer func(files []string) {
+		for _, file := range files {
+			os.Remove(file)
+		}
+	}(files)
 
-	testSync(t, defaultChunkSize, kvSize, kvEntries, []uint64{0}, lastKvIndex, defaultEncodeType, 6, remotePeers, true)
-}
+	data := makeKVStorage(contract, []uint64{0}, defaultChunkSize, kvSize, kvEntries, lastKvIndex, common.Address{}, defaultEncodeType, metafile)
+	sm := ethstorage.NewStorageManager(shardManager, NewMockL1Source(lastKvIndex, metafileName))
+	// a slow server, so each batch of 2 blobs takes about 200ms
+	smr := &mockStorageManagerReader{
+		kvEntries:       kvEntries,
+		maxKvSize:       kvSize,
+		encodeType:      defaultEncodeType,
+		shards:          []uint64{0},
+		contractAddress: contract,
+		shardMiner:      common.Address{},
+		blobPayloads:    data[contract],
+		readDelay:       100 * time.Millisecond,
+	}
 
-// TestMultiSync test sync process with local node support two shards and sync shard data from two remote peers,
-// it should be sync done.
-func TestMultiSync(t *testing.T) {
-	var (
-		kvSize      = defaultChunkSize
-		kvEntries   = uint64(16)
-		lastKvIndex = uint64(32)
-	)
-	remotePeers := []*remotePeer{
-		{
-			shards:       []uint64{0},
-			excludedList: make(map[uint64]struct{}),
-		},
-		{
-			shards:       []uint64{1},
-			excludedList: make(map[uint64]struct{}),
-		},
+	localHost, syncCl := createLocalHostAndSyncClient(t, testLog, rollupCfg, db, sm, m, mux)
+	syncCl.loadSyncStatus()
+	syncCl.maxListBatchSize = 2
+	sm.Reset(0)
+	err = sm.DownloadAllMetas(context.Background(), 16)
+	if err != nil {
+		t.Fatal("Download blob metadata failed", "error", err)
 	}
+	remoteHost := createRemoteHost(t, ctx, rollupCfg, smr, db, m, testLog)
+	connect(t, localHost, remoteHost, shards, shards)
+	time.Sleep(500 * time.Millisecond)
 
-	testSync(t, defaultChunkSize, kvSize, kvEntries, []uint64{0, 1}, lastKvIndex, defaultEncodeType, 4, remotePeers, true)
+	indexes := make([]uint64, 0)
+	for i := uint64(0); i < lastKvIndex; i++ {
+		indexes = append(indexes, i)
+	}
+	reqCtx, reqCancel := context.WithCancel(context.Background())
+	time.AfterFunc(300*time.Millisecond, reqCancel)
+	start := time.Now()
+	synced, err := syncCl.RequestL2ListWithContext(reqCtx, indexes)
+	elapsed := time.Since(start)
+	if !errors.Is(err, context.Canceled) {
+		t.Fatalf("expected context canceled error, got %v", err)
+	}
+	if synced >= lastKvIndex {
+		t.Fatalf("the list should not be completed after canceled, synced %d", synced)
+	}
+	if elapsed > time.Second {
+		t.Fatalf("RequestL2ListWithContext should return promptly after canceled, took %s", elapsed)
+	}
 }
 
-// TestSyncWithFewerResult test sync process with shard which is not full (lastKvIndex < kvSize), it should be sync done.
-func TestSyncWithFewerResult(t *testing.T) {
+// TestSync_RequestL2ListPipelined test RequestL2List splits a large list of indexes into batches and pipelines
+// them across two peers with disjoint holes, the blobs missing from one peer are fetched from the other one.
+func TestSync_RequestL2ListPipelined(t *testing.T) {
 	var (
 		kvSize      = defaultChunkSize
-		kvEntries   = uint64(16)
-		lastKvIndex = uint64(14)
+		kvEntries   = uint64(1024)
+		lastKvIndex = uint64(1000)
+		encodeType  = uint64(ethstorage.NO_ENCODE)
+		ctx, cancel = context.WithCancel(context.Background())
+		db          = rawdb.NewMemoryDatabase()
+		mux         = new(event.Feed)
+		shards      = []uint64{0}
+		shardMap    = map[common.Address][]uint64{contract: shards}
+		m           = metrics.NewMetrics("sync_test")
+		rollupCfg   = &rollup.EsConfig{
+			L2ChainID: new(big.Int).SetUint64(3333),
+		}
+		syncParams = params
 	)
-	remotePeers := []*remotePeer{
-		{
-			shards:       []uint64{0},
-			excludedList: make(map[uint64]struct{}),
-		},
-	}
+	defer cancel()
+	// skip the verification of the blobs to keep the test fast
+	syncParams.ShardVerifyStrictness = map[ShardKey]VerifyStrictness{{ShardId: 0}: VerifyTrusted}
+	syncParams.MaxListBatchSize = 16
 
-	testSync(t, defaultChunkSize, kvSize, kvEntries, []uint64{0}, lastKvIndex, defaultEncodeType, 4, remotePeers, true)
-}
+	metafile, err := CreateMetaFile(metafileName, int64(kvEntries))
+	if err != nil {
+		t.Error("Create metafileName fail", err.Error())
+	}
+	defer metafile.Close()
 
-// TestSyncWithPeerShardsOverlay test sync process with local node support multi shards and sync from multi remote peers,
-// and shards supported by remote peers have overlaid, it should be sync done.
-func TestSyncWithPeerShardsOverlay(t *testing.T) {
-	var (
-		kvSize      = defaultChunkSize
-		kvEntries   = uint64(16)
-		lastKvIndex = kvEntries*4 - 10
-	)
-	remotePeers := []*remotePeer{
-		{
-			shards:       []uint64{0, 1, 2},
-			excludedList: make(map[uint64]struct{}),
-		},
-		{
-			shards:       []uint64{2, 3},
-			excludedList: make(map[uint64]struct{}),
-		},
+	shardManager, files := createEthStorage(contract, shards, defaultChunkSize, kvSize, kvEntries, common.Address{}, encodeType)
+	if shardManager == nil {
+		t.Fatalf("createEthStorage failed")
 	}
+	defer func(files []string) {
+		for _, file := range files {
+			os.Remove(file)
+		}
+	}(files)
 
-	testSync(t, defaultChunkSize, kvSize, kvEntries, []uint64{0, 1, 2, 3}, lastKvIndex, defaultEncodeType, 6, remotePeers, true)
-}
+	data := makeKVStorage(contract, shards, defaultChunkSize, kvSize, kvEntries, lastKvIndex, common.Address{}, encodeType, metafile)
+	sm := ethstorage.NewStorageManager(shardManager, NewMockL1Source(lastKvIndex, metafileName))
+	localHost := getNetHost(t)
+	syncCl := NewSyncClient(testLog, rollupCfg, localHost.NewStream, sm, &syncParams, db, m, mux)
+	syncCl.loadSyncStatus()
+	sm.Reset(0)
+	err = sm.DownloadAllMetas(context.Background(), 16)
+	if err != nil {
+		t.Fatal("Download blob metadata failed", "error", err)
+	}
 
-// TestSyncWithExcludedDataOverlay test sync process with local node support multi shards and sync from multi remote peers,
-// and shards supported by peers have overlaid and their excluded list do not have overlaid, it should be sync done.
-func TestSyncWithExcludedListNotOverlay(t *testing.T) {
-	var (
-		kvSize      = defaultChunkSize
-		kvEntries   = uint64(16)
-		lastKvIndex = kvEntries * 4
-	)
-	excludedList0 := getRandomU64InRange(make(map[uint64]struct{}), 16, 47, 3)
-	excludedList1 := getRandomU64InRange(excludedList0, 16, 47, 3)
-	remotePeers := []*remotePeer{
-		{
-			shards:       []uint64{0, 1, 2},
-			excludedList: excludedList0,
-		},
-		{
-			shards:       []uint64{1, 2, 3},
-			excludedList: excludedList1,
-		},
+	holes0 := getRandomU64InRange(make(map[uint64]struct{}), 0, lastKvIndex, 100)
+	holes1 := getRandomU64InRange(holes0, 0, lastKvIndex, 100)
+	for _, holes := range []map[uint64]struct{}{holes0, holes1} {
+		smr := &mockStorageManagerReader{
+			kvEntries:       kvEntries,
+			maxKvSize:       kvSize,
+			encodeType:      encodeType,
+			shards:          shards,
+			contractAddress: contract,
+			shardMiner:      common.Address{},
+			blobPayloads:    copyShardData(data[contract], shards, kvEntries, holes),
+		}
+		remoteHost := createRemoteHost(t, ctx, rollupCfg, smr, db, m, testLog)
+		connect(t, localHost, remoteHost, shardMap, shardMap)
+		if !syncCl.AddPeer(remoteHost.ID(), shardMap, network.DirOutbound) {
+			t.Fatalf("add peer failed")
+		}
 	}
 
-	testSync(t, defaultChunkSize, kvSize, kvEntries, []uint64{0, 1, 2, 3}, lastKvIndex, defaultEncodeType, 6, remotePeers, true)
+	indexes := make([]uint64, 0)
+	requested := make(map[uint64]*BlobPayloadWithRowData)
+	for i := uint64(0); i < lastKvIndex; i++ {
+		indexes = append(indexes, i)
+		requested[i] = data[contract][i]
+	}
+	synced, err := syncCl.RequestL2List(indexes)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if synced != lastKvIndex {
+		t.Fatalf("synced blob count is not match, expected: %d, actual: %d", lastKvIndex, synced)
+	}
+	verifyKVs(map[common.Address]map[uint64]*BlobPayloadWithRowData{contract: requested},
+		mergeExcludedList(holes0, holes1), t)
 }
 
-// TestSyncWithExcludedList test sync process with local node support a shard and sync data from 1 remote peer
-// which has excluded list, it should not be sync done.
-func TestSyncWithExcludedList(t *testing.T) {
+// TestSync_RequestL2ListTimeout tests that the batch of a list request to a slow peer is abandoned after the list
+// request timeout, and the blobs are served by another peer.
+func TestSync_RequestL2ListTimeout(t *testing.T) {
 	var (
 		kvSize      = defaultChunkSize
 		kvEntries   = uint64(16)
 		lastKvIndex = uint64(16)
+		encodeType  = uint64(ethstorage.NO_ENCODE)
+		ctx, cancel = context.WithCancel(context.Background())
+		db          = rawdb.NewMemoryDatabase()
+		mux         = new(event.Feed)
+		shards      = []uint64{0}
+		shardMap    = map[common.Address][]uint64{contract: shards}
+		m           = metrics.NewMetrics("sync_test")
+		rollupCfg   = &rollup.EsConfig{
+			L2ChainID: new(big.Int).SetUint64(3333),
+			Sync:      rollup.SyncConfig{RequestTimeout: 300 * time.Millisecond},
+		}
+		syncParams = params
 	)
-	remotePeers := []*remotePeer{{
-		shards:       []uint64{0},
-		excludedList: getRandomU64InRange(make(map[uint64]struct{}), 0, 15, 3),
-	}}
+	defer cancel()
+	syncParams.ShardVerifyStrictness = map[ShardKey]VerifyStrictness{{ShardId: 0}: VerifyTrusted}
+	syncParams.MaxListBatchSize = 4
 
-	testSync(t, defaultChunkSize, kvSize, kvEntries, []uint64{0}, lastKvIndex, defaultEncodeType, 3, remotePeers, false)
-}
+	metafile, err := CreateMetaFile(metafileName, int64(kvEntries))
+	if err != nil {
+		t.Error("Create metafileName fail", err.Error())
+	}
+	defer metafile.Close()
 
-// TestSyncDiffEncodeType test sync process with local node support a shard and sync data from 1 remote peer
-// with different encode type, they should sync done.
-func TestSyncDiffEncodeType(t *testing.T) {
-	var (
-		kvSize      = defaultChunkSize
-		kvEntries   = uint64(16)
-		lastKvIndex = uint64(16)
-	)
-	remotePeers := []*remotePeer{{
-		shards:       []uint64{0},
-		excludedList: make(map[uint64]struct{}),
-	}}
+	shardManager, files := createEthStorage(contract, shards, defaultChunkSize, kvSize, kvEntries, common.Address{}, encodeType)
+	if shardManager == nil {
+		t.Fatalf("createEthStorage failed")
+	}
+	defer func(files []string) {
+		for _, file := range files {
+			os.Remove(file)
+		}
+	}(files)
 
-	testSync(t, defaultChunkSize, kvSize, kvEntries, []uint64{0}, lastKvIndex, ethstorage.ENCODE_KECCAK_256, 4, remotePeers, true)
-	testSync(t, defaultChunkSize, kvSize, kvEntries, []uint64{0}, lastKvIndex, ethstorage.ENCODE_BLOB_POSEIDON, 4, remotePeers, true)
-}
+	data := makeKVStorage(contract, shards, defaultChunkSize, kvSize, kvEntries, lastKvIndex, common.Address{}, encodeType, metafile)
+	sm := ethstorage.NewStorageManager(shardManager, NewMockL1Source(lastKvIndex, metafileName))
+	localHost := getNetHost(t)
+	syncCl := NewSyncClient(testLog, rollupCfg, localHost.NewStream, sm, &syncParams, db, m, mux)
+	syncCl.loadSyncStatus()
+	sm.Reset(0)
+	err = sm.DownloadAllMetas(context.Background(), 16)
+	if err != nil {
+		t.Fatal("Download blob metadata failed", "error", err)
+	}
 
-// TestAddPeerDuringSyncing test sync process with local node support a shard and sync data from first remote peer
-// which has excluded list. After first peer sync finish (blob indexes in excluded list included in heal task),
-// the second peer connect and sync the rest of the blobs. The local node should sync done.
-func TestAddPeerDuringSyncing(t *testing.T) {
-	var (
-		kvSize       = defaultChunkSize
-		kvEntries    = uint64(16)
-		lastKvIndex  = uint64(16)
+	// each worker requests its batch from its own peer first, so one of the batches is sent to the slow peer
+	var fast *mockStorageManagerReader
+	for _, delay := range []time.Duration{2 * time.Second, 0} {
+		smr := &mockStorageManagerReader{
+			kvEntries:       kvEntries,
+			maxKvSize:       kvSize,
+			encodeType:      encodeType,
+			shards:          shards,
+			contractAddress: contract,
+			shardMiner:      common.Address{},
+			blobPayloads:    data[contract],
+			readDelay:       delay,
+		}
+		remoteHost := createRemoteHost(t, ctx, rollupCfg, smr, db, m, testLog)
+		connect(t, localHost, remoteHost, shardMap, shardMap)
+		if !syncCl.AddPeer(remoteHost.ID(), shardMap, network.DirOutbound) {
+			t.Fatalf("add peer failed")
+		}
+		fast = smr
+	}
+
+	indexes := []uint64{0, 1, 2, 3, 4, 5, 6, 7}
+	start := time.Now()
+	synced, err := syncCl.RequestL2List(indexes)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if synced != uint64(len(indexes)) {
+		t.Fatalf("synced blob count is not match, expected: %d, actual: %d", len(indexes), synced)
+	}
+	if elapsed := time.Since(start); elapsed >= 2*time.Second {
+		t.Fatalf("the slow peer is waited for %s", elapsed)
+	}
+	for _, idx := range indexes {
+		if _, ok := fast.readIdxs.Load(idx); !ok {
+			t.Errorf("blob %d is not served by the fast peer", idx)
+		}
+	}
+}
+
+// TestSaveAndLoadSyncStatus test save sync state to DB for tasks and load sync state from DB for tasks.
+func TestSaveAndLoadSyncStatus(t *testing.T) {
+	var (
+		entries             = uint64(1) << 10
+		kvSize              = defaultChunkSize
+		lastKvIndex         = entries*3 - 20
+		db                  = rawdb.NewMemoryDatabase()
+		mux                 = new(event.Feed)
+		m                   = metrics.NewMetrics("sync_test")
+		expectedSecondsUsed = uint64(10)
+		rollupCfg           = &rollup.EsConfig{
+			L2ChainID: new(big.Int).SetUint64(3333),
+		}
+	)
+	metafile, err := CreateMetaFile(metafileName, int64(entries*3))
+	if err != nil {
+		t.Error("Create metafileName fail", err.Error())
+	}
+	defer metafile.Close()
+
+	// create ethstorage and generate data
+	shardManager, files := createEthStorage(contract, []uint64{0, 1, 2}, defaultChunkSize, kvSize, entries, common.Address{}, defaultEncodeType)
+	if shardManager == nil {
+		t.Fatalf("createEthStorage failed")
+	}
+
+	defer func(files []string) {
+		for _, file := range files {
+			os.Remove(file)
+		}
+	}(files)
+
+	l1 := NewMockL1Source(lastKvIndex, metafileName)
+	sm := ethstorage.NewStorageManager(shardManager, l1)
+	sm.Reset(0)
+	_, syncCl := createLocalHostAndSyncClient(t, testLog, rollupCfg, db, sm, m, mux)
+	syncCl.loadSyncStatus()
+	indexes := []uint64{30, 5, 8}
+	syncCl.tasks[0].healTask.insert(indexes)
+	syncCl.tasks[0].SubTasks[0].First = 1
+	syncCl.tasks[0].SubTasks[0].next = 33
+	syncCl.tasks[0].state.PeerCount = 60
+	syncCl.tasks[0].state.FillEmptySeconds = expectedSecondsUsed
+	syncCl.tasks[0].state.BlobsSynced = 30
+	syncCl.tasks[0].state.SyncedSeconds = expectedSecondsUsed
+	syncCl.tasks[1].SubTasks = make([]*subTask, 0)
+	syncCl.tasks[1].state.BlobsSynced = entries
+	syncCl.tasks[1].state.SyncedSeconds = expectedSecondsUsed
+
+	tasks := syncCl.tasks
+	syncCl.cleanTasks()
+	if !syncCl.tasks[1].done {
+		t.Fatalf("task 1 should be done.")
+	}
+	syncCl.saveSyncStatus()
+
+	syncCl.tasks = make([]*task, 0)
+	syncCl.loadSyncStatus()
+	tasks[0].SubTasks[0].First = 5
+	tasks[0].SubTasks[0].next = 5
+	tasks[1].done = false
+
+	if err := compareTasks(tasks, syncCl.tasks); err != nil {
+		t.Fatalf("compare kv task fail. err: %s", err.Error())
+	}
+	if syncCl.tasks[0].state.PeerCount != 0 {
+		t.Fatalf("compare PeerCount fail, expect %d, real %d, the peer count should be clean when reload.", 0, &syncCl.tasks[0].state.PeerCount)
+	}
+	if syncCl.tasks[0].state.BlobsSynced != 30 {
+		t.Fatalf("compare BlobsSynced fail, expect %d, real %d", 30, syncCl.tasks[0].state.BlobsSynced)
+	}
+	if syncCl.tasks[0].state.SyncedSeconds != expectedSecondsUsed {
+		t.Fatalf("compare totalSecondsUsed fail, expect %d, real %d", expectedSecondsUsed, syncCl.tasks[0].state.SyncedSeconds)
+	}
+	if syncCl.tasks[1].state.BlobsSynced != entries {
+		t.Fatalf("compare BlobsSynced fail, expect %d, real %d", entries, syncCl.tasks[1].state.BlobsSynced)
+	}
+	if syncCl.tasks[1].state.SyncedSeconds != expectedSecondsUsed {
+		t.Fatalf("compare totalSecondsUsed fail, expect %d, real %d", expectedSecondsUsed, syncCl.tasks[1].state.SyncedSeconds)
+	}
+}
+
+// TestDiffSyncStatus tests that the diff of two saved sync statuses lists the subTasks advanced, done and added,
+// and the tasks completed, added and removed.
+func TestDiffSyncStatus(t *testing.T) {
+	entries := uint64(1) << 10
+	status := func(tasks ...*task) []byte {
+		b, err := json.Marshal(&SyncProgress{Tasks: tasks})
+		if err != nil {
+			t.Fatalf("encode sync status failed: %s", err.Error())
+		}
+		return b
+	}
+	before := status(
+		&task{Contract: contract, ShardId: 0, SubTasks: []*subTask{{First: 1, Last: entries / 2}, {First: entries / 2, Last: entries}}},
+		&task{Contract: contract, ShardId: 1, SubTasks: []*subTask{{First: entries, Last: entries * 2}}},
+		&task{Contract: contract, ShardId: 2, SubEmptyTasks: []*subEmptyTask{{First: entries * 2, Last: entries * 3}}},
+	)
+	after := status(
+		&task{Contract: contract, ShardId: 0, SubTasks: []*subTask{{First: 33, Last: entries / 2}}},
+		&task{Contract: contract, ShardId: 1},
+		&task{Contract: contract, ShardId: 2, SubEmptyTasks: []*subEmptyTask{{First: entries*2 + 100, Last: entries * 3}}},
+		&task{Contract: contract, ShardId: 3, SubTasks: []*subTask{{First: entries * 3, Last: entries * 4}}},
+	)
+
+	shard := func(id uint64) string {
+		return fmt.Sprintf("contract %s shard %d: ", contract.Hex(), id)
+	}
+	expected := shard(0) + "subTask [1, 512) advanced to 33\n" +
+		shard(0) + "subTask [512, 1024) done\n" +
+		shard(1) + "subTask [1024, 2048) done\n" +
+		shard(1) + "task completed\n" +
+		shard(2) + "empty subTask [2048, 3072) advanced to 2148\n" +
+		shard(3) + "task added\n"
+	if diff := DiffSyncStatus(before, after); diff != expected {
+		t.Fatalf("diff is not match, expected:\n%s\nactual:\n%s", expected, diff)
+	}
+	if diff := DiffSyncStatus(after, before); !strings.Contains(diff, shard(3)+"task removed") {
+		t.Fatalf("the removed task is not listed in the diff:\n%s", diff)
+	}
+	if diff := DiffSyncStatus(after, after); diff != "no changes\n" {
+		t.Fatalf("diff of the same status should list no changes:\n%s", diff)
+	}
+}
+
+// TestSaveLargeHealRanges tests that the large contiguous ranges of heal indexes are saved compactly and reloaded,
+// and that the encoded ranges out of the shard are rejected.
+func TestSaveLargeHealRanges(t *testing.T) {
+	var (
+		entries     = uint64(1) << 10
+		kvSize      = defaultChunkSize
+		lastKvIndex = entries
+		db          = rawdb.NewMemoryDatabase()
+		m           = metrics.NewMetrics("sync_test")
+		rollupCfg   = &rollup.EsConfig{
+			L2ChainID: new(big.Int).SetUint64(3333),
+		}
+	)
+	metafile, err := CreateMetaFile(metafileName, int64(entries))
+	if err != nil {
+		t.Error("Create metafileName fail", err.Error())
+	}
+	defer metafile.Close()
+
+	shardManager, files := createEthStorage(contract, []uint64{0}, defaultChunkSize, kvSize, entries, common.Address{}, defaultEncodeType)
+	if shardManager == nil {
+		t.Fatalf("createEthStorage failed")
+	}
+	defer func(files []string) {
+		for _, file := range files {
+			os.Remove(file)
+		}
+	}(files)
+
+	sm := ethstorage.NewStorageManager(shardManager, NewMockL1Source(lastKvIndex, metafileName))
+	sm.Reset(0)
+	_, syncCl := createLocalHostAndSyncClient(t, testLog, rollupCfg, db, sm, m, new(event.Feed))
+	syncCl.loadSyncStatus()
+	indexes := make([]uint64, 0)
+	for idx := uint64(0); idx < 300; idx++ {
+		indexes = append(indexes, idx, idx+500)
+	}
+	indexes = append(indexes, 1000)
+	slices.Sort(indexes)
+	syncCl.tasks[0].healTask.insert(indexes)
+
+	encoded := encodeIndexRanges(indexes)
+	plain, _ := json.Marshal(indexes)
+	if len(encoded)*100 > len(plain) {
+		t.Fatalf("heal indexes are not encoded compactly, encoded %d bytes, plain %d bytes", len(encoded), len(plain))
+	}
+	decoded, err := decodeIndexRanges(encoded, 0, entries)
+	if err != nil {
+		t.Fatalf("decode index ranges failed: %s", err.Error())
+	}
+	if !slices.Equal(decoded, indexes) {
+		t.Fatalf("decoded indexes mismatch, expected %d indexes, real %d", len(indexes), len(decoded))
+	}
+	if _, err := decodeIndexRanges(append(slices.Clone(encoded), 1), 0, entries); err == nil {
+		t.Fatalf("decode truncated index ranges should fail")
+	}
+	if _, err := decodeIndexRanges(encoded, 1, entries); err == nil {
+		t.Fatalf("decode index ranges before the shard should fail")
+	}
+	// a run of a huge length is rejected before the indexes are allocated
+	huge := binary.AppendUvarint(binary.AppendUvarint(nil, 0), math.MaxUint64)
+	if _, err := decodeIndexRanges(huge, 0, entries); err == nil {
+		t.Fatalf("decode index ranges beyond the shard should fail")
+	}
+
+	syncCl.saveSyncStatus()
+	_, cl := createLocalHostAndSyncClient(t, testLog, rollupCfg, db, sm, m, new(event.Feed))
+	cl.loadSyncStatus()
+	if err := compareTasks(syncCl.tasks, cl.tasks); err != nil {
+		t.Fatalf("compare kv task fail. err: %s", err.Error())
+	}
+	for _, idx := range indexes {
+		if _, ok := cl.tasks[0].healTask.Indexes[idx]; !ok {
+			t.Fatalf("heal index %d is not reloaded", idx)
+		}
+	}
+}
+
+// TestIncrementalHealLog tests that the heal indexes healed one by one are saved to the heal log without rewriting
+// the sync status, that the heal log is compacted once it exceeds maxHealLogRecords, and that the heal indexes
+// reloaded from the heal log match.
+func TestIncrementalHealLog(t *testing.T) {
+	var (
+		entries     = uint64(1) << 10
+		kvSize      = defaultChunkSize
+		lastKvIndex = entries
+		db          = rawdb.NewMemoryDatabase()
+		m           = metrics.NewMetrics("sync_test")
+		rollupCfg   = &rollup.EsConfig{
+			L2ChainID: new(big.Int).SetUint64(3333),
+		}
+	)
+	metafile, err := CreateMetaFile(metafileName, int64(entries))
+	if err != nil {
+		t.Error("Create metafileName fail", err.Error())
+	}
+	defer metafile.Close()
+
+	shardManager, files := createEthStorage(contract, []uint64{0}, defaultChunkSize, kvSize, entries, common.Address{}, defaultEncodeType)
+	if shardManager == nil {
+		t.Fatalf("createEthStorage failed")
+	}
+	defer func(files []string) {
+		for _, file := range files {
+			os.Remove(file)
+		}
+	}(files)
+
+	sm := ethstorage.NewStorageManager(shardManager, NewMockL1Source(lastKvIndex, metafileName))
+	sm.Reset(0)
+	_, syncCl := createLocalHostAndSyncClient(t, testLog, rollupCfg, db, sm, m, new(event.Feed))
+	syncCl.loadSyncStatus()
+	indexes := make([]uint64, 0)
+	for idx := uint64(0); idx < 200; idx++ {
+		indexes = append(indexes, idx*3)
+	}
+	syncCl.tasks[0].healTask.insert(indexes)
+	syncCl.saveSyncStatus()
+	status, _ := db.Get(SyncTasksKey)
+
+	logRecords := func() int {
+		it := db.NewIterator(healLogPrefix(contract, 0), nil)
+		defer it.Release()
+		count := 0
+		for it.Next() {
+			count++
+		}
+		return count
+	}
+	checkReloaded := func() {
+		_, cl := createLocalHostAndSyncClient(t, testLog, rollupCfg, db, sm, m, new(event.Feed))
+		cl.loadSyncStatus()
+		expected, reloaded := syncCl.tasks[0].healTask.sortedIndexes(), cl.tasks[0].healTask.sortedIndexes()
+		if !slices.Equal(expected, reloaded) {
+			t.Fatalf("reloaded heal indexes mismatch, expected %d indexes, real %d", len(expected), len(reloaded))
+		}
+	}
+
+	// heal the indexes one by one, and queue one of them again in the middle
+	for i, idx := range indexes[:150] {
+		syncCl.tasks[0].healTask.remove([]uint64{idx})
+		if i == 100 {
+			syncCl.tasks[0].healTask.insert([]uint64{indexes[0]})
+		}
+		syncCl.cleanTasks()
+		if records := logRecords(); records > maxHealLogRecords {
+			t.Fatalf("heal log should be compacted, records %d", records)
+		}
+		if i%50 == 0 {
+			checkReloaded()
+		}
+	}
+	if saved, _ := db.Get(SyncTasksKey); !bytes.Equal(saved, status) {
+		t.Fatalf("sync status should not be rewritten by healing the indexes")
+	}
+	checkReloaded()
+
+	// the heal indexes are only saved in the heal log, which is checkpointed along with the sync status
+	syncCl.tasks[0].healTask.remove(indexes[150:160])
+	syncCl.saveSyncStatus()
+	if saved, _ := db.Get(SyncTasksKey); !bytes.Equal(saved, status) {
+		t.Fatalf("heal indexes should not be saved in the sync status")
+	}
+	checkReloaded()
+}
+
+// TestStableSyncStatus tests that the sync status loaded from the tasks saved in different orders is saved in
+// the same stable order, sorted by contract, shard id and the first blob of the subTasks.
+func TestStableSyncStatus(t *testing.T) {
+	var (
+		entries     = uint64(1) << 10
+		kvSize      = defaultChunkSize
+		lastKvIndex = entries*3 - 20
+		m           = metrics.NewMetrics("sync_test")
+		rollupCfg   = &rollup.EsConfig{
+			L2ChainID: new(big.Int).SetUint64(3333),
+		}
+	)
+	metafile, err := CreateMetaFile(metafileName, int64(entries*3))
+	if err != nil {
+		t.Error("Create metafileName fail", err.Error())
+	}
+	defer metafile.Close()
+
+	shardManager, files := createEthStorage(contract, []uint64{0, 1, 2}, defaultChunkSize, kvSize, entries, common.Address{}, defaultEncodeType)
+	if shardManager == nil {
+		t.Fatalf("createEthStorage failed")
+	}
+	defer func(files []string) {
+		for _, file := range files {
+			os.Remove(file)
+		}
+	}(files)
+
+	sm := ethstorage.NewStorageManager(shardManager, NewMockL1Source(lastKvIndex, metafileName))
+	sm.Reset(0)
+	_, syncCl := createLocalHostAndSyncClient(t, testLog, rollupCfg, rawdb.NewMemoryDatabase(), sm, m, new(event.Feed))
+	syncCl.loadSyncStatus()
+	if len(syncCl.tasks[2].SubEmptyTasks) == 0 {
+		t.Fatalf("the last task should have subEmptyTasks")
+	}
+
+	// save the same tasks in the reversed and the rotated orders
+	reversed, rotated := slices.Clone(syncCl.tasks), slices.Clone(syncCl.tasks)
+	slices.Reverse(reversed)
+	rotated = append(rotated[1:], rotated[0])
+	saved := make([][]byte, 0, 2)
+	for i, tasks := range [][]*task{reversed, rotated} {
+		for _, tk := range tasks {
+			subTasks, subEmptyTasks := slices.Clone(tk.SubTasks), slices.Clone(tk.SubEmptyTasks)
+			if i == 0 {
+				slices.Reverse(subTasks)
+				slices.Reverse(subEmptyTasks)
+			} else if len(subTasks) > 1 {
+				subTasks = append(subTasks[1:], subTasks[0])
+			}
+			tk.SubTasks, tk.SubEmptyTasks = subTasks, subEmptyTasks
+		}
+		status, err := json.Marshal(&SyncProgress{Tasks: tasks})
+		if err != nil {
+			t.Fatalf("encode sync status failed: %s", err.Error())
+		}
+		db := rawdb.NewMemoryDatabase()
+		if err := db.Put(SyncTasksKey, status); err != nil {
+			t.Fatalf("save sync status failed: %s", err.Error())
+		}
+
+		_, cl := createLocalHostAndSyncClient(t, testLog, rollupCfg, db, sm, m, new(event.Feed))
+		cl.loadSyncStatus()
+		cl.saveSyncStatus()
+		status, _ = db.Get(SyncTasksKey)
+		saved = append(saved, status)
+	}
+	if !bytes.Equal(saved[0], saved[1]) {
+		t.Fatalf("sync status is not saved in a stable order:\n%s\n%s", saved[0], saved[1])
+	}
+
+	var progress SyncProgress
+	if err := json.Unmarshal(saved[0], &progress); err != nil {
+		t.Fatalf("decode sync status failed: %s", err.Error())
+	}
+	for i, tk := range progress.Tasks {
+		if tk.ShardId != uint64(i) {
+			t.Fatalf("task %d is of shard %d", i, tk.ShardId)
+		}
+		for j := 1; j < len(tk.SubTasks); j++ {
+			if tk.SubTasks[j-1].First >= tk.SubTasks[j].First {
+				t.Fatalf("subTasks of shard %d are not sorted", tk.ShardId)
+			}
+		}
+		for j := 1; j < len(tk.SubEmptyTasks); j++ {
+			if tk.SubEmptyTasks[j-1].First >= tk.SubEmptyTasks[j].First {
+				t.Fatalf("subEmptyTasks of shard %d are not sorted", tk.ShardId)
+			}
+		}
+	}
+}
+
+// TestNormalizeSubTasks test the subTasks loaded are sorted, the done ones are dropped, and the overlapping or
+// adjacent ones are merged.
+func TestNormalizeSubTasks(t *testing.T) {
+	type rng struct {
+		first, next, last uint64
+	}
+	tests := []struct {
+		name     string
+		subTasks []rng
+		expected []rng
+	}{
+		{
+			name:     "disjoint",
+			subTasks: []rng{{32, 32, 48}, {0, 0, 16}},
+			expected: []rng{{0, 0, 16}, {32, 32, 48}},
+		},
+		{
+			name:     "overlap",
+			subTasks: []rng{{0, 0, 20}, {10, 10, 30}},
+			expected: []rng{{0, 0, 30}},
+		},
+		{
+			name:     "adjacency",
+			subTasks: []rng{{16, 16, 32}, {0, 0, 16}},
+			expected: []rng{{0, 0, 32}},
+		},
+		{
+			name:     "containment",
+			subTasks: []rng{{0, 0, 64}, {16, 16, 32}, {60, 60, 64}},
+			expected: []rng{{0, 0, 64}},
+		},
+		{
+			name:     "done",
+			subTasks: []rng{{0, 0, 16}, {16, 32, 32}, {40, 40, 40}, {48, 48, 64}},
+			expected: []rng{{0, 0, 16}, {48, 48, 64}},
+		},
+		{
+			name:     "partially synced",
+			subTasks: []rng{{0, 8, 16}, {32, 40, 48}},
+			expected: []rng{{0, 8, 16}, {32, 40, 48}},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			subTasks := make([]*subTask, 0)
+			for _, r := range tt.subTasks {
+				subTasks = append(subTasks, &subTask{First: r.first, next: r.next, Last: r.last})
+			}
+			normalized := normalizeSubTasks(subTasks)
+			if len(normalized) != len(tt.expected) {
+				t.Fatalf("subTask count is not match, expected: %d, actual: %d", len(tt.expected), len(normalized))
+			}
+			for i, r := range tt.expected {
+				st := normalized[i]
+				if st.First != r.first || st.next != r.next || st.Last != r.last {
+					t.Fatalf("subTask %d is not match, expected: %v, actual: {%d %d %d}", i, r, st.First, st.next, st.Last)
+				}
+			}
+		})
+	}
+}
+
+// TestReadWrite tests a basic eth storage read/write
+func TestReadWrite(t *testing.T) {
+	var (
+		kvSize    = defaultChunkSize
+		kvEntries = uint64(16)
+		val       = make([]byte, kvSize)
+	)
+	shards, files := createEthStorage(contract, []uint64{0}, defaultChunkSize, kvSize, kvEntries, common.Address{}, defaultEncodeType)
+	if shards == nil {
+		t.Fatalf("createEthStorage failed")
+	}
+
+	defer func(files []string) {
+		for _, file := range files {
+			os.Remove(file)
+		}
+	}(files)
+
+	val[0] = 1
+	root, _ := prover.GetRoot(val, 1, 1)
+	commit := generateMetadata(root)
+	sm := ethstorage.ContractToShardManager[contract]
+	success, err := sm.TryWrite(0, val, commit)
+	if !success || err != nil {
+		t.Fatalf("failed to write")
+	}
+	rdata, success, err := sm.TryRead(0, 1, commit)
+	if !success || err != nil {
+		t.Fatalf("failed to read")
+	}
+	if !bytes.Equal([]byte{1}, rdata) {
+		t.Fatalf("failed to compare")
+	}
+}
+
+// testSync sync test with a general process:
+// 1. create a storage manager and a local node, then start the sync client;
+// 2. prepare test data which need to sync to the local node;
+// 3. copy data for remote peers (only copy the data for shard remote peer supported, exclude data whose
+// blob index in the excluded list) and create storage manager reader for remote peers;
+// 4. create remote peers with storage manager reader and connect to local node;
+// 5. wait for sync client syncDone or time out
+// 6. verify blobs synced to local node with test data
+func testSync(t *testing.T, chunkSize, kvSize, kvEntries uint64, localShards []uint64, lastKvIndex uint64,
+	encodeType uint64, waitTime time.Duration, remotePeers []*remotePeer, expectedState bool) {
+	var (
+		db            = rawdb.NewMemoryDatabase()
+		ctx, cancel   = context.WithCancel(context.Background())
+		mux           = new(event.Feed)
+		localShardMap = make(map[common.Address][]uint64)
+		m             = metrics.NewMetrics("sync_test")
+		rollupCfg     = &rollup.EsConfig{
+			L2ChainID: new(big.Int).SetUint64(3333),
+		}
+	)
+
+	metafile, err := CreateMetaFile(metafileName, int64(kvEntries)*int64(len(localShards)))
+	if err != nil {
+		t.Error("Create metafileName fail", err.Error())
+	}
+	defer func() {
+		metafile.Close()
+		os.Remove(metafileName)
+	}()
+
+	localShardMap[contract] = localShards
+	shardManager, files := createEthStorage(contract, localShards, chunkSize, kvSize, kvEntries, common.Address{}, encodeType)
+	if shardManager == nil {
+		t.Fatalf("createEthStorage failed")
+	}
+
+	defer func(files []string) {
+		for _, file := range files {
+			os.Remove(file)
+		}
+	}(files)
+
+	l1 := NewMockL1Source(lastKvIndex, metafileName)
+	sm := ethstorage.NewStorageManager(shardManager, l1)
+	sm.Reset(0)
+	data := makeKVStorage(contract, localShards, chunkSize, kvSize, kvEntries, lastKvIndex, common.Address{}, encodeType, metafile)
+	localHost, syncCl := createLocalHostAndSyncClient(t, testLog, rollupCfg, db, sm, m, mux)
+	syncCl.Start()
+
+	finalExcludedList := remotePeers[0].excludedList
+	for _, rPeer := range remotePeers {
+		// fill empty to excludedList for verify KVs
+		fillEmpty(shardManager, rPeer.excludedList)
+		finalExcludedList = mergeExcludedList(finalExcludedList, rPeer.excludedList)
+		pData := copyShardData(data[contract], rPeer.shards, kvEntries, rPeer.excludedList)
+		smr := &mockStorageManagerReader{
+			kvEntries:       kvEntries,
+			maxKvSize:       kvSize,
+			encodeType:      encodeType,
+			shards:          rPeer.shards,
+			contractAddress: contract,
+			shardMiner:      common.Address{},
+			blobPayloads:    pData,
+		}
+		rShardMap := make(map[common.Address][]uint64)
+		rShardMap[contract] = rPeer.shards
+		remoteHost := createRemoteHost(t, ctx, rollupCfg, smr, db, m, testLog)
+		connect(t, localHost, remoteHost, localShardMap, rShardMap)
+	}
+
+	checkStall(t, waitTime, mux, cancel)
+
+	if syncCl.syncDone != expectedState {
+		t.Fatalf("sync state %v is not match with expected state %v, peer count %d", syncCl.syncDone, expectedState, len(syncCl.peers))
+	}
+	verifyKVs(data, finalExcludedList, t)
+}
+
+// TestSimpleSync test sync process with local node support a single small (its task contains only 1 subTask) shard
+// and sync data from 1 remote peer, it should be sync done.
+func TestSimpleSync(t *testing.T) {
+	var (
+		kvSize      = defaultChunkSize
+		kvEntries   = uint64(16)
+		lastKvIndex = uint64(16)
+	)
+	remotePeers := []*remotePeer{{
+		shards:       []uint64{0},
+		excludedList: make(map[uint64]struct{}),
+	}}
+
+	testSync(t, defaultChunkSize, kvSize, kvEntries, []uint64{0}, lastKvIndex, defaultEncodeType, 4, remotePeers, true)
+}
+
+// TestMultiSubTasksSync test sync process with local node support a single big (its task contains multi subTask) shard
+// and sync data from 1 remote peer, it should be sync done.
+func TestMultiSubTasksSync(t *testing.T) {
+	var (
+		kvSize      = defaultChunkSize
+		kvEntries   = uint64(64)
+		lastKvIndex = uint64(64)
+	)
+	remotePeers := []*remotePeer{{
+		shards:       []uint64{0},
+		excludedList: make(map[uint64]struct{}),
+	}}
+
+	testSync(t, defaultChunkSize, kvSize, kvEntries, []uint64{0}, lastKvIndex, defaultEncodeType, 6, remotePeers, true)
+}
+
+// TestMultiSync test sync process with local node support two shards and sync shard data from two remote peers,
+// it should be sync done.
+func TestMultiSync(t *testing.T) {
+	var (
+		kvSize      = defaultChunkSize
+		kvEntries   = uint64(16)
+		lastKvIndex = uint64(32)
+	)
+	remotePeers := []*remotePeer{
+		{
+			shards:       []uint64{0},
+			excludedList: make(map[uint64]struct{}),
+		},
+		{
+			shards:       []uint64{1},
+			excludedList: make(map[uint64]struct{}),
+		},
+	}
+
+	testSync(t, defaultChunkSize, kvSize, kvEntries, []uint64{0, 1}, lastKvIndex, defaultEncodeType, 4, remotePeers, true)
+}
+
+// TestSyncWithFewerResult test sync process with shard which is not full (lastKvIndex < kvSize), it should be sync done.
+func TestSyncWithFewerResult(t *testing.T) {
+	var (
+		kvSize      = defaultChunkSize
+		kvEntries   = uint64(16)
+		lastKvIndex = uint64(14)
+	)
+	remotePeers := []*remotePeer{
+		{
+			shards:       []uint64{0},
+			excludedList: make(map[uint64]struct{}),
+		},
+	}
+
+	testSync(t, defaultChunkSize, kvSize, kvEntries, []uint64{0}, lastKvIndex, defaultEncodeType, 4, remotePeers, true)
+}
+
+// TestSyncWithPeerShardsOverlay test sync process with local node support multi shards and sync from multi remote peers,
+// and shards supported by remote peers have overlaid, it should be sync done.
+func TestSyncWithPeerShardsOverlay(t *testing.T) {
+	var (
+		kvSize      = defaultChunkSize
+		kvEntries   = uint64(16)
+		lastKvIndex = kvEntries*4 - 10
+	)
+	remotePeers := []*remotePeer{
+		{
+			shards:       []uint64{0, 1, 2},
+			excludedList: make(map[uint64]struct{}),
+		},
+		{
+			shards:       []uint64{2, 3},
+			excludedList: make(map[uint64]struct{}),
+		},
+	}
+
+	testSync(t, defaultChunkSize, kvSize, kvEntries, []uint64{0, 1, 2, 3}, lastKvIndex, defaultEncodeType, 6, remotePeers, true)
+}
+
+// TestSyncWithExcludedDataOverlay test sync process with local node support multi shards and sync from multi remote peers,
+// and shards supported by peers have overlaid and their excluded list do not have overlaid, it should be sync done.
+func TestSyncWithExcludedListNotOverlay(t *testing.T) {
+	var (
+		kvSize      = defaultChunkSize
+		kvEntries   = uint64(16)
+		lastKvIndex = kvEntries * 4
+	)
+	excludedList0 := getRandomU64InRange(make(map[uint64]struct{}), 16, 47, 3)
+	excludedList1 := getRandomU64InRange(excludedList0, 16, 47, 3)
+	remotePeers := []*remotePeer{
+		{
+			shards:       []uint64{0, 1, 2},
+			excludedList: excludedList0,
+		},
+		{
+			shards:       []uint64{1, 2, 3},
+			excludedList: excludedList1,
+		},
+	}
+
+	testSync(t, defaultChunkSize, kvSize, kvEntries, []uint64{0, 1, 2, 3}, lastKvIndex, defaultEncodeType, 6, remotePeers, true)
+}
+
+// TestSyncWithExcludedList test sync process with local node support a shard and sync data from 1 remote peer
+// which has excluded list, it should not be sync done.
+func TestSyncWithExcludedList(t *testing.T) {
+	var (
+		kvSize      = defaultChunkSize
+		kvEntries   = uint64(16)
+		lastKvIndex = uint64(16)
+	)
+	remotePeers := []*remotePeer{{
+		shards:       []uint64{0},
+		excludedList: getRandomU64InRange(make(map[uint64]struct{}), 0, 15, 3),
+	}}
+
+	testSync(t, defaultChunkSize, kvSize, kvEntries, []uint64{0}, lastKvIndex, defaultEncodeType, 3, remotePeers, false)
+}
+
+// TestSyncDiffEncodeType test sync process with local node support a shard and sync data from 1 remote peer
+// with different encode type, they should sync done.
+func TestSyncDiffEncodeType(t *testing.T) {
+	var (
+		kvSize      = defaultChunkSize
+		kvEntries   = uint64(16)
+		lastKvIndex = uint64(16)
+	)
+	remotePeers := []*remotePeer{{
+		shards:       []uint64{0},
+		excludedList: make(map[uint64]struct{}),
+	}}
+
+	testSync(t, defaultChunkSize, kvSize, kvEntries, []uint64{0}, lastKvIndex, ethstorage.ENCODE_KECCAK_256, 4, remotePeers, true)
+	testSync(t, defaultChunkSize, kvSize, kvEntries, []uint64{0}, lastKvIndex, ethstorage.ENCODE_BLOB_POSEIDON, 4, remotePeers, true)
+}
+
+// TestAddPeerDuringSyncing test sync process with local node support a shard and sync data from first remote peer
+// which has excluded list. After first peer sync finish (blob indexes in excluded list included in heal task),
+// the second peer connect and sync the rest of the blobs. The local node should sync done.
+func TestAddPeerDuringSyncing(t *testing.T) {
+	var (
+		kvSize       = defaultChunkSize
+		kvEntries    = uint64(16)
+		lastKvIndex  = uint64(16)
+		encodeType   = uint64(defaultEncodeType)
+		db           = rawdb.NewMemoryDatabase()
+		ctx, cancel  = context.WithCancel(context.Background())
+		mux          = new(event.Feed)
+		shards       = []uint64{0}
+		shardMap     = make(map[common.Address][]uint64)
+		excludedList = getRandomU64InRange(make(map[uint64]struct{}), 0, 15, 3)
+		m            = metrics.NewMetrics("sync_test")
+		rollupCfg    = &rollup.EsConfig{
+			L2ChainID: new(big.Int).SetUint64(3333),
+		}
+	)
+
+	metafile, err := CreateMetaFile(metafileName, int64(kvEntries))
+	if err != nil {
+		t.Error("Create metafileName fail", err.Error())
+	}
+	defer metafile.Close()
+
+	shardMap[contract] = shards
+	shardManager, files := createEthStorage(contract, shards, defaultChunkSize, kvSize, kvEntries, common.Address{}, defaultEncodeType)
+	if shardManager == nil {
+		t.Fatalf("createEthStorage failed")
+	}
+
+	defer func(files []string) {
+		for _, file := range files {
+			os.Remove(file)
+		}
+	}(files)
+
+	l1 := NewMockL1Source(lastKvIndex, metafileName)
+	data := makeKVStorage(contract, shards, defaultChunkSize, kvSize, kvEntries, lastKvIndex, common.Address{}, encodeType, metafile)
+	sm := ethstorage.NewStorageManager(shardManager, l1)
+	sm.Reset(0)
+	// fill empty to excludedList for verify KVs
+	fillEmpty(shardManager, excludedList)
+
+	localHost, syncCl := createLocalHostAndSyncClient(t, testLog, rollupCfg, db, sm, m, mux)
+	syncCl.Start()
+
+	pData := copyShardData(data[contract], shards, kvEntries, excludedList)
+	smr0 := &mockStorageManagerReader{
+		kvEntries:       kvEntries,
+		maxKvSize:       kvSize,
+		encodeType:      encodeType,
+		shards:          shards,
+		contractAddress: contract,
+		shardMiner:      common.Address{},
+		blobPayloads:    pData,
+	}
+	remoteHost0 := createRemoteHost(t, ctx, rollupCfg, smr0, db, m, testLog)
+	connect(t, localHost, remoteHost0, shardMap, shardMap)
+	time.Sleep(3 * time.Second)
+
+	if syncCl.syncDone {
+		t.Fatalf("sync state %v is not match with expected state %v, peer count %d", syncCl.syncDone, false, len(syncCl.peers))
+	}
+	verifyKVs(data, excludedList, t)
+
+	smr1 := &mockStorageManagerReader{
+		kvEntries:       kvEntries,
+		maxKvSize:       kvSize,
+		encodeType:      encodeType,
+		shards:          shards,
+		contractAddress: contract,
+		shardMiner:      common.Address{},
+		blobPayloads:    data[contract],
+	}
+	remoteHost1 := createRemoteHost(t, ctx, rollupCfg, smr1, db, m, testLog)
+	connect(t, localHost, remoteHost1, shardMap, shardMap)
+	checkStall(t, 4, mux, cancel)
+
+	if !syncCl.syncDone {
+		t.Fatalf("sync state %v is not match with expected state %v, peer count %d", syncCl.syncDone, true, len(syncCl.peers))
+	}
+	verifyKVs(data, make(map[uint64]struct{}), t)
+}
+
+// TestCloseSyncWhileFillEmpty test the sync can be cancel while the fill empty is running.
+func TestCloseSyncWhileFillEmpty(t *testing.T) {
+	var (
+		kvSize      = defaultChunkSize
+		kvEntries   = uint64(512)
+		lastKvIndex = uint64(0)
+		db          = rawdb.NewMemoryDatabase()
+		mux         = new(event.Feed)
+		shards      = []uint64{0}
+		shardMap    = make(map[common.Address][]uint64)
+		m           = metrics.NewMetrics("sync_test")
+		rollupCfg   = &rollup.EsConfig{
+			L2ChainID: new(big.Int).SetUint64(3333),
+		}
+	)
+
+	metafile, err := CreateMetaFile(metafileName, int64(kvEntries))
+	if err != nil {
+		t.Error("Create metafileName fail", err.Error())
+	}
+	defer metafile.Close()
+
+	shardMap[contract] = shards
+	shardManager, files := createEthStorage(contract, shards, defaultChunkSize, kvSize, kvEntries, common.Address{}, defaultEncodeType)
+	if shardManager == nil {
+		t.Fatalf("createEthStorage failed")
+	}
+	defer func(files []string) {
+		for _, file := range files {
+			os.Remove(file)
+		}
+	}(files)
+
+	makeKVStorage(contract, shards, defaultChunkSize, kvSize, kvEntries, lastKvIndex, common.Address{}, defaultEncodeType, metafile)
+
+	l1 := NewMockL1Source(lastKvIndex, metafileName)
+	sm := ethstorage.NewStorageManager(shardManager, l1)
+	sm.Reset(0)
+	_, syncCl := createLocalHostAndSyncClient(t, testLog, rollupCfg, db, sm, m, mux)
+	syncCl.Start()
+	time.Sleep(10 * time.Millisecond)
+	syncCl.Close()
+
+	t.Log("Fill empty status", "filled", syncCl.tasks[0].state.EmptyFilled, "toFill", syncCl.tasks[0].state.EmptyToFill)
+	if syncCl.syncDone {
+		t.Fatalf("fill empty should be cancel")
+	}
+}
+
+// TestAddPeerAfterSyncDone test add peer after sync done, the peer should add successfully (the connection is kept),
+// as the remote peer may need to sync data from this local peer, we also need to use the sync client to control
+// the peer count.
+func TestAddPeerAfterSyncDone(t *testing.T) {
+	var (
+		kvSize       = defaultChunkSize
+		kvEntries    = uint64(16)
+		lastKvIndex  = uint64(16)
+		encodeType   = uint64(defaultEncodeType)
+		db           = rawdb.NewMemoryDatabase()
+		ctx, cancel  = context.WithCancel(context.Background())
+		mux          = new(event.Feed)
+		shards       = []uint64{0}
+		shardMap     = make(map[common.Address][]uint64)
+		excludedList = make(map[uint64]struct{})
+		m            = metrics.NewMetrics("sync_test")
+		rollupCfg    = &rollup.EsConfig{
+			L2ChainID: new(big.Int).SetUint64(3333),
+		}
+	)
+
+	metafile, err := CreateMetaFile(metafileName, int64(kvEntries))
+	if err != nil {
+		t.Error("Create metafileName fail", err.Error())
+	}
+	defer metafile.Close()
+
+	shardMap[contract] = shards
+	shardManager, files := createEthStorage(contract, shards, defaultChunkSize, kvSize, kvEntries, common.Address{}, defaultEncodeType)
+	if shardManager == nil {
+		t.Fatalf("createEthStorage failed")
+	}
+
+	defer func(files []string) {
+		for _, f := range files {
+			os.Remove(f)
+		}
+	}(files)
+
+	l1 := NewMockL1Source(lastKvIndex, metafileName)
+	data := makeKVStorage(contract, shards, defaultChunkSize, kvSize, kvEntries, lastKvIndex, common.Address{}, encodeType, metafile)
+
+	sm := ethstorage.NewStorageManager(shardManager, l1)
+	sm.Reset(0)
+	// fill empty to excludedList for verify KVs
+	fillEmpty(shardManager, excludedList)
+
+	localHost, syncCl := createLocalHostAndSyncClient(t, testLog, rollupCfg, db, sm, m, mux)
+	syncCl.Start()
+
+	smr0 := &mockStorageManagerReader{
+		kvEntries:       kvEntries,
+		maxKvSize:       kvSize,
+		encodeType:      encodeType,
+		shards:          shards,
+		contractAddress: contract,
+		shardMiner:      common.Address{},
+		blobPayloads:    data[contract],
+	}
+	remoteHost0 := createRemoteHost(t, ctx, rollupCfg, smr0, db, m, testLog)
+	connect(t, localHost, remoteHost0, shardMap, shardMap)
+	checkStall(t, 4, mux, cancel)
+
+	if !syncCl.syncDone {
+		t.Fatalf("sync state %v is not match with expected state %v, peer count %d", syncCl.syncDone, true, len(syncCl.peers))
+	}
+	verifyKVs(data, excludedList, t)
+
+	smr1 := &mockStorageManagerReader{
+		kvEntries:       kvEntries,
+		maxKvSize:       kvSize,
+		encodeType:      encodeType,
+		shards:          shards,
+		contractAddress: contract,
+		shardMiner:      common.Address{},
+		blobPayloads:    data[contract],
+	}
+	remoteHost1 := createRemoteHost(t, ctx, rollupCfg, smr1, db, m, testLog)
+	connect(t, localHost, remoteHost1, shardMap, shardMap)
+
+	time.Sleep(10 * time.Millisecond)
+	if len(syncCl.peers) != 2 {
+		t.Fatalf("sync client peers count is not match, expected: %d, actual count %d;", 2, len(syncCl.peers))
+	}
+}
+
+// TestKeepAlivePing test the idle peers kept connected after the sync is done are pinged every keep-alive interval,
+// and remain the peers of the sync client.
+func TestKeepAlivePing(t *testing.T) {
+	var (
+		kvSize       = defaultChunkSize
+		kvEntries    = uint64(16)
+		lastKvIndex  = uint64(16)
 		encodeType   = uint64(defaultEncodeType)
 		db           = rawdb.NewMemoryDatabase()
 		ctx, cancel  = context.WithCancel(context.Background())
 		mux          = new(event.Feed)
-		shards       = []uint64{0}
-		shardMap     = make(map[common.Address][]uint64)
-		excludedList = getRandomU64InRange(make(map[uint64]struct{}), 0, 15, 3)
+		shards       = []uint64{0}
+		shardMap     = make(map[common.Address][]uint64)
+		excludedList = make(map[uint64]struct{})
+		m            = metrics.NewMetrics("sync_test")
+		pings        atomic.Uint64
+		rollupCfg    = &rollup.EsConfig{
+			L2ChainID: new(big.Int).SetUint64(3333),
+		}
+	)
+
+	metafile, err := CreateMetaFile(metafileName, int64(kvEntries))
+	if err != nil {
+		t.Error("Create metafileName fail", err.Error())
+	}
+	defer metafile.Close()
+
+	shardMap[contract] = shards
+	shardManager, files := createEthStorage(contract, shards, defaultChunkSize, kvSize, kvEntries, common.Address{}, defaultEncodeType)
+	if shardManager == nil {
+		t.Fatalf("createEthStorage failed")
+	}
+
+	defer func(files []string) {
+		for _, f := range files {
+			os.Remove(f)
+		}
+	}(files)
+
+	l1 := NewMockL1Source(lastKvIndex, metafileName)
+	data := makeKVStorage(contract, shards, defaultChunkSize, kvSize, kvEntries, lastKvIndex, common.Address{}, encodeType, metafile)
+
+	sm := ethstorage.NewStorageManager(shardManager, l1)
+	sm.Reset(0)
+	fillEmpty(shardManager, excludedList)
+
+	localHost, syncCl := createLocalHostAndSyncClient(t, testLog, rollupCfg, db, sm, m, mux)
+	syncCl.keepAliveInterval = 100 * time.Millisecond
+	syncCl.Start()
+	defer syncCl.Close()
+
+	smr := &mockStorageManagerReader{
+		kvEntries:       kvEntries,
+		maxKvSize:       kvSize,
+		encodeType:      encodeType,
+		shards:          shards,
+		contractAddress: contract,
+		shardMiner:      common.Address{},
+		blobPayloads:    data[contract],
+	}
+	remoteHost := createRemoteHost(t, ctx, rollupCfg, smr, db, m, testLog)
+	syncSrv := NewSyncServer(rollupCfg, smr, db, m)
+	remoteHost.SetStreamHandler(RequestPing, MakeStreamHandler(ctx, testLog, func(ctx context.Context, log log.Logger, stream network.Stream) {
+		pings.Add(1)
+		syncSrv.HandlePing(ctx, log, stream)
+	}))
+	connect(t, localHost, remoteHost, shardMap, shardMap)
+	checkStall(t, 4, mux, cancel)
+	if !syncCl.syncDone {
+		t.Fatalf("sync state %v is not match with expected state %v, peer count %d", syncCl.syncDone, true, len(syncCl.peers))
+	}
+
+	// the peer is idle after the sync is done, so it is pinged repeatedly
+	for start := time.Now(); pings.Load() < 3; time.Sleep(50 * time.Millisecond) {
+		if time.Since(start) > 5*time.Second {
+			t.Fatalf("idle peer should be pinged, pings %d", pings.Load())
+		}
+	}
+	syncCl.lock.Lock()
+	_, ok := syncCl.peers[remoteHost.ID()]
+	syncCl.lock.Unlock()
+	if !ok {
+		t.Fatalf("pinged peer should remain in the sync client peers")
+	}
+}
+
+func TestFillEmpty(t *testing.T) {
+	var (
+		kvSize      = defaultChunkSize
+		kvEntries   = uint64(256)
+		lastKvIndex = uint64(12)
+		db          = rawdb.NewMemoryDatabase()
+		mux         = new(event.Feed)
+		shards      = []uint64{0}
+		shardMap    = make(map[common.Address][]uint64)
+		m           = metrics.NewMetrics("sync_test")
+		rollupCfg   = &rollup.EsConfig{
+			L2ChainID: new(big.Int).SetUint64(3333),
+		}
+	)
+
+	metafile, err := CreateMetaFile(metafileName, int64(kvEntries))
+	if err != nil {
+		t.Error("Create metafileName fail", err.Error())
+	}
+	defer metafile.Close()
+
+	shardMap[contract] = shards
+	shardManager, files := createEthStorage(contract, shards, defaultChunkSize, kvSize, kvEntries, common.Address{}, defaultEncodeType)
+	if shardManager == nil {
+		t.Fatalf("createEthStorage failed")
+	}
+	defer func(files []string) {
+		for _, file := range files {
+			os.Remove(file)
+		}
+	}(files)
+
+	makeKVStorage(contract, shards, defaultChunkSize, kvSize, kvEntries, lastKvIndex, common.Address{}, defaultEncodeType, metafile)
+
+	l1 := NewMockL1Source(lastKvIndex, metafileName)
+	sm := ethstorage.NewStorageManager(shardManager, l1)
+	sm.Reset(0)
+	_, syncCl := createLocalHostAndSyncClient(t, testLog, rollupCfg, db, sm, m, mux)
+	syncCl.Start()
+	for i := 0; i < 4; i++ {
+		time.Sleep(500 * time.Millisecond)
+		l1.lastBlobIndex = l1.lastBlobIndex + rand.Uint64()%(kvEntries/4)
+		sm.Reset(1)
+	}
+	time.Sleep(8 * time.Second)
+
+	if len(syncCl.tasks[0].SubEmptyTasks) > 0 {
+		t.Fatalf("fill empty should be done")
+	}
+	if syncCl.tasks[0].state.EmptyToFill != 0 {
+		t.Fatalf("emptyBlobsToFill should be 0, value %d", syncCl.tasks[0].state.EmptyToFill)
+	}
+	if syncCl.tasks[0].state.EmptyFilled != (kvEntries - lastKvIndex) {
+		t.Fatalf("emptyBlobsFilled is wrong, expect %d, value %d", kvEntries-lastKvIndex, syncCl.tasks[0].state.EmptyFilled)
+	}
+}
+
+// TestShardVerifyStrictness tests that the sync client verifies the blobs of shards with different
+// verify strictness differently: full shard verifies all blobs, sampled shard verifies a fraction of them
+// and trusted shard verifies blobs from suspicious peers and a small fraction of the others.
+func TestShardVerifyStrictness(t *testing.T) {
+	var (
+		kvSize      = defaultChunkSize
+		kvEntries   = uint64(16)
+		lastKvIndex = uint64(0)
+		rounds      = 2000
+		sampleRate  = 0.25
+		db          = rawdb.NewMemoryDatabase()
+		shards      = []uint64{0, 1, 2}
+		pid         = peer.ID("suspicious-peer")
+		rollupCfg   = &rollup.EsConfig{
+			L2ChainID: new(big.Int).SetUint64(3333),
+		}
+		syncParams = params
+	)
+	syncParams.ShardVerifyStrictness = map[ShardKey]VerifyStrictness{{ShardId: 0}: VerifyFull, {ShardId: 1}: VerifySampled, {ShardId: 2}: VerifyTrusted}
+	syncParams.VerifySampleRate = sampleRate
+
+	metafile, err := CreateMetaFile(metafileName, int64(kvEntries*uint64(len(shards))))
+	if err != nil {
+		t.Error("Create metafileName fail", err.Error())
+	}
+	defer metafile.Close()
+
+	shardManager, files := createEthStorage(contract, shards, defaultChunkSize, kvSize, kvEntries, common.Address{}, defaultEncodeType)
+	if shardManager == nil {
+		t.Fatalf("createEthStorage failed")
+	}
+	defer func(files []string) {
+		for _, file := range files {
+			os.Remove(file)
+		}
+	}(files)
+
+	sm := ethstorage.NewStorageManager(shardManager, NewMockL1Source(lastKvIndex, metafileName))
+	syncCl := NewSyncClient(testLog, rollupCfg, nil, sm, &syncParams, db, nil, nil)
+
+	verified := make(map[uint64]int)
+	for i := 0; i < rounds; i++ {
+		for _, shardId := range shards {
+			if syncCl.shouldVerify(ShardKey{Contract: contract, ShardId: shardId}, pid) {
+				verified[shardId]++
+			}
+		}
+	}
+	if verified[0] != rounds {
+		t.Fatalf("full shard should verify all blobs, expected %d, verified %d", rounds, verified[0])
+	}
+	lo, hi := int(float64(rounds)*sampleRate/2), int(float64(rounds)*sampleRate*2)
+	if verified[1] < lo || verified[1] > hi {
+		t.Fatalf("sampled shard should verify a fraction of blobs, expected in range [%d, %d], verified %d", lo, hi, verified[1])
+	}
+	if verified[2] == 0 || verified[2] >= lo {
+		t.Fatalf("trusted shard should verify a small fraction of blobs from unsuspicious peer, verified %d", verified[2])
+	}
+	// the strictness is configured for the shards of the contract only
+	other := ShardKey{Contract: common.HexToAddress("0x0000000000000000000000000000000003330002"), ShardId: 2}
+	if !syncCl.shouldVerify(other, pid) {
+		t.Fatalf("the same shard of another contract should use full")
+	}
+
+	syncCl.markPeerSuspicious(pid)
+	for _, shardId := range shards {
+		if !syncCl.shouldVerify(ShardKey{Contract: contract, ShardId: shardId}, pid) {
+			t.Fatalf("blobs from suspicious peer should always be verified, shard %d", shardId)
+		}
+	}
+}
+
+// TestTrustedShardCorruptBlob tests a corrupt blob of a trusted shard delivered by a peer not suspicious is committed
+// unless it is sampled for the verification, and once it is sampled, it is rejected and the peer is marked suspicious,
+// so all the blobs from the peer are verified since then.
+func TestTrustedShardCorruptBlob(t *testing.T) {
+	var (
+		kvSize      = defaultChunkSize
+		kvEntries   = uint64(16)
+		lastKvIndex = uint64(16)
+		db          = rawdb.NewMemoryDatabase()
+		mux         = new(event.Feed)
+		m           = metrics.NewMetrics("sync_test")
+		pid         = peer.ID("trusted-peer")
+		rollupCfg   = &rollup.EsConfig{
+			L2ChainID: new(big.Int).SetUint64(3333),
+		}
+	)
+
+	metafile, err := CreateMetaFile(metafileName, int64(kvEntries))
+	if err != nil {
+		t.Error("Create metafileName fail", err.Error())
+	}
+	defer metafile.Close()
+
+	shardManager, files := createEthStorage(contract, []uint64{0}, defaultChunkSize, kvSize, kvEntries, common.Address{}, defaultEncodeType)
+	if shardManager == nil {
+		t.Fatalf("createEthStorage failed")
+	}
+	defer func(files []string) {
+		for _, file := range files {
+			os.Remove(file)
+		}
+	}(files)
+
+	data := makeKVStorage(contract, []uint64{0}, defaultChunkSize, kvSize, kvEntries, lastKvIndex, common.Address{}, defaultEncodeType, metafile)
+
+	sm := ethstorage.NewStorageManager(shardManager, NewMockL1Source(lastKvIndex, metafileName))
+	_, syncCl := createLocalHostAndSyncClient(t, testLog, rollupCfg, db, sm, m, mux)
+	sm.Reset(0)
+	if err := sm.DownloadAllMetas(context.Background(), 16); err != nil {
+		t.Fatal("Download blob metadata failed", "error", err)
+	}
+	syncCl.verifyStrictness = map[ShardKey]VerifyStrictness{{Contract: contract, ShardId: 0}: VerifyTrusted}
+	corrupt := func(idx uint64) []*BlobPayload {
+		d := data[contract][idx]
+		encoded := bytes.Clone(d.EncodedBlob)
+		encoded[0] ^= 0xff
+		return []*BlobPayload{{
+			MinerAddress: d.MinerAddress,
+			BlobIndex:    d.BlobIndex,
+			BlobCommit:   d.BlobCommit,
+			EncodeType:   d.EncodeType,
+			EncodedBlob:  encoded,
+		}}
+	}
+
+	// the corrupt blob is not sampled, so it is committed without verification
+	syncCl.trustedVerifySampleRate = 0
+	_, _, inserted, failures, err := syncCl.processBlobs(context.Background(), pid, contract, corrupt(1), false)
+	if err != nil {
+		t.Fatalf("process blobs failed: %s", err.Error())
+	}
+	if len(inserted) != 1 || len(failures) != 0 {
+		t.Fatalf("corrupt blob not sampled should be committed, inserted %v, failures %v", inserted, failures)
+	}
+
+	// the corrupt blob is sampled, so it is rejected and the peer is marked suspicious
+	syncCl.trustedVerifySampleRate = 1
+	_, _, inserted, failures, err = syncCl.processBlobs(context.Background(), pid, contract, corrupt(2), false)
+	if err != nil {
+		t.Fatalf("process blobs failed: %s", err.Error())
+	}
+	if len(inserted) != 0 || failures[2] != failureCommitMismatch {
+		t.Fatalf("corrupt blob sampled should be rejected, inserted %v, failures %v", inserted, failures)
+	}
+	if _, ok := syncCl.suspiciousPeers[pid]; !ok {
+		t.Fatalf("peer delivering the corrupt blob should be marked as suspicious")
+	}
+
+	// all the blobs from the suspicious peer are verified, even if not sampled
+	syncCl.trustedVerifySampleRate = 0
+	_, _, inserted, failures, err = syncCl.processBlobs(context.Background(), pid, contract, corrupt(3), false)
+	if err != nil {
+		t.Fatalf("process blobs failed: %s", err.Error())
+	}
+	if len(inserted) != 0 || failures[3] != failureCommitMismatch {
+		t.Fatalf("corrupt blob from suspicious peer should be rejected, inserted %v, failures %v", inserted, failures)
+	}
+	if mismatches := testutil.ToFloat64(m.SyncClientCommitMismatchesTotal.WithLabelValues(pid.String())); mismatches != 2 {
+		t.Fatalf("commit mismatches of the peer should be 2, real %v", mismatches)
+	}
+}
+
+// TestParseShardVerifyStrictness tests the verify strictness and the index header shards are parsed with an
+// optional contract, and the shards without a contract are of the primary contract.
+func TestParseShardVerifyStrictness(t *testing.T) {
+	contract2 := common.HexToAddress("0x0000000000000000000000000000000003330002")
+	levels, err := ParseShardVerifyStrictness("0:sampled; " + contract2.Hex() + ":0:trusted")
+	if err != nil {
+		t.Fatalf("parse verify strictness failed: %s", err.Error())
+	}
+	expected := map[ShardKey]VerifyStrictness{{ShardId: 0}: VerifySampled, {Contract: contract2, ShardId: 0}: VerifyTrusted}
+	if !reflect.DeepEqual(levels, expected) {
+		t.Fatalf("verify strictness is not match, expected: %v, actual: %v", expected, levels)
+	}
+	resolved := primaryShardKeys(levels, contract)
+	if resolved[ShardKey{Contract: contract, ShardId: 0}] != VerifySampled || resolved[ShardKey{Contract: contract2, ShardId: 0}] != VerifyTrusted {
+		t.Fatalf("shards without a contract should be of the primary contract, actual: %v", resolved)
+	}
+	for _, str := range []string{"0", "x:0:full", "0:unknown"} {
+		if _, err := ParseShardVerifyStrictness(str); err == nil {
+			t.Fatalf("invalid verify strictness %s should be rejected", str)
+		}
+	}
+
+	ids, err := ParseShardIds("1, " + contract2.Hex() + ":2")
+	if err != nil {
+		t.Fatalf("parse shard ids failed: %s", err.Error())
+	}
+	if !reflect.DeepEqual(ids, map[ShardKey]struct{}{{ShardId: 1}: {}, {Contract: contract2, ShardId: 2}: {}}) {
+		t.Fatalf("shard ids are not match, actual: %v", ids)
+	}
+}
+
+// fillEmptyWithWorkers starts a sync client without peers to fill the whole shard with empty blobs
+// using the given number of fill empty workers, and waits until the fill empty is done.
+func fillEmptyWithWorkers(tb testing.TB, workers int, kvEntries uint64) (*ethstorage.StorageManager, *SyncClient) {
+	var (
+		kvSize      = defaultChunkSize
+		lastKvIndex = uint64(0)
+		db          = rawdb.NewMemoryDatabase()
+		mux         = new(event.Feed)
+		shards      = []uint64{0}
+		rollupCfg   = &rollup.EsConfig{
+			L2ChainID: new(big.Int).SetUint64(3333),
+		}
+		syncParams = params
+	)
+	syncParams.FillEmptyConcurrency = workers
+
+	metafile, err := CreateMetaFile(metafileName, int64(kvEntries))
+	if err != nil {
+		tb.Fatalf("Create metafileName fail: %s", err.Error())
+	}
+	defer metafile.Close()
+
+	shardManager, files := createEthStorage(contract, shards, defaultChunkSize, kvSize, kvEntries, common.Address{}, defaultEncodeType)
+	if shardManager == nil {
+		tb.Fatalf("createEthStorage failed")
+	}
+	tb.Cleanup(func() {
+		for _, file := range files {
+			os.Remove(file)
+		}
+	})
+
+	makeKVStorage(contract, shards, defaultChunkSize, kvSize, kvEntries, lastKvIndex, common.Address{}, defaultEncodeType, metafile)
+
+	sm := ethstorage.NewStorageManager(shardManager, NewMockL1Source(lastKvIndex, metafileName))
+	sm.Reset(0)
+	syncCl := NewSyncClient(testLog, rollupCfg, nil, sm, &syncParams, db, nil, mux)
+	if syncCl.fillEmptyWorkers != workers {
+		tb.Fatalf("fill empty workers mismatch, expected %d, real %d", workers, syncCl.fillEmptyWorkers)
+	}
+
+	dlEventCh := make(chan EthStorageSyncDone, 16)
+	events := mux.Subscribe(dlEventCh)
+	defer events.Unsubscribe()
+	syncCl.Start()
+	defer syncCl.Close()
+	for {
+		select {
+		case <-time.After(60 * time.Second):
+			tb.Fatalf("fill empty timeout")
+		case ev := <-dlEventCh:
+			if ev.DoneType == AllShardDone {
+				return sm, syncCl
+			}
+		}
+	}
+}
+
+// TestFillEmptyWithWorkers tests all the kv indexes are filled with the empty commit when
+// fill empty is running with multiple workers.
+func TestFillEmptyWithWorkers(t *testing.T) {
+	var (
+		kvEntries   = uint64(512)
+		emptyCommit = common.Hash{}
+	)
+	emptyCommit[ethstorage.HashSizeInContract] = emptyCommit[ethstorage.HashSizeInContract] | blobEmptyFillingMask
+
+	sm, syncCl := fillEmptyWithWorkers(t, 8, kvEntries)
+	if syncCl.tasks[0].state.EmptyFilled != kvEntries {
+		t.Fatalf("emptyBlobsFilled is wrong, expect %d, value %d", kvEntries, syncCl.tasks[0].state.EmptyFilled)
+	}
+	for i := uint64(0); i < kvEntries; i++ {
+		meta, success, err := sm.TryReadMeta(i)
+		if !success || err != nil {
+			t.Fatalf("read meta of kv %d failed: %v", i, err)
+		}
+		if common.BytesToHash(meta) != emptyCommit {
+			t.Fatalf("kv %d is not filled with empty commit, meta %s", i, common.Bytes2Hex(meta))
+		}
+	}
+}
+
+func BenchmarkFillEmpty(b *testing.B) {
+	for _, workers := range []int{1, 4, 16} {
+		b.Run(fmt.Sprintf("workers-%d", workers), func(b *testing.B) {
+			for i := 0; i < b.N; i++ {
+				fillEmptyWithWorkers(b, workers, 512)
+			}
+		})
+	}
+}
+
+// BenchmarkProcessBlobsEthash compares decoding the ENCODE_ETHASH blobs of a response inline with decoding them
+// in the decode pool.
+func BenchmarkProcessBlobsEthash(b *testing.B) {
+	var (
+		kvSize      = defaultChunkSize
+		kvEntries   = uint64(16)
+		lastKvIndex = uint64(16)
+		db          = rawdb.NewMemoryDatabase()
+		mux         = new(event.Feed)
+		pid         = peer.ID("ethash-peer")
+		rollupCfg   = &rollup.EsConfig{
+			L2ChainID: new(big.Int).SetUint64(3333),
+		}
+	)
+
+	metafile, err := CreateMetaFile(metafileName, int64(kvEntries))
+	if err != nil {
+		b.Fatalf("Create metafileName fail: %s", err.Error())
+	}
+	defer metafile.Close()
+
+	shardManager, files := createEthStorage(contract, []uint64{0}, defaultChunkSize, kvSize, kvEntries, common.Address{}, ethstorage.ENCODE_ETHASH)
+	if shardManager == nil {
+		b.Fatalf("createEthStorage failed")
+	}
+	defer func(files []string) {
+		for _, file := range files {
+			os.Remove(file)
+		}
+	}(files)
+
+	data := makeKVStorage(contract, []uint64{0}, defaultChunkSize, kvSize, kvEntries, lastKvIndex, common.Address{}, ethstorage.ENCODE_ETHASH, metafile)
+	sm := ethstorage.NewStorageManager(shardManager, NewMockL1Source(lastKvIndex, metafileName))
+	sm.Reset(0)
+	if err := sm.DownloadAllMetas(context.Background(), 16); err != nil {
+		b.Fatalf("Download blob metadata failed: %s", err.Error())
+	}
+
+	blobs := make([]*BlobPayload, 0)
+	for idx := uint64(0); idx < lastKvIndex; idx++ {
+		d := data[contract][idx]
+		blobs = append(blobs, &BlobPayload{
+			MinerAddress: d.MinerAddress,
+			BlobIndex:    d.BlobIndex,
+			BlobCommit:   d.BlobCommit,
+			EncodeType:   d.EncodeType,
+			EncodedBlob:  d.EncodedBlob,
+		})
+	}
+
+	for _, pooled := range []bool{false, true} {
+		name := "inline"
+		if pooled {
+			name = "pooled"
+		}
+		b.Run(name, func(b *testing.B) {
+			syncCl := NewSyncClient(testLog, rollupCfg, nil, sm, &params, db, nil, mux)
+			if !pooled {
+				syncCl.decodePool = nil
+			}
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				_, _, _, failures, err := syncCl.processBlobs(context.Background(), pid, contract, blobs, false)
+				if err != nil || len(failures) != 0 {
+					b.Fatalf("process blobs failed, err %v, failures %v", err, failures)
+				}
+			}
+		})
+	}
+}
+
+// TestFillEmptyYieldToSync test fill empty uses all the workers while no peer is connected, and yields to
+// sync once a peer serving the unfinished task is connected.
+func TestFillEmptyYieldToSync(t *testing.T) {
+	var (
+		kvSize      = defaultChunkSize
+		kvEntries   = uint64(64)
+		lastKvIndex = uint64(16)
+		encodeType  = uint64(defaultEncodeType)
+		db          = rawdb.NewMemoryDatabase()
+		ctx, cancel = context.WithCancel(context.Background())
+		mux         = new(event.Feed)
+		shards      = []uint64{0}
+		shardMap    = map[common.Address][]uint64{contract: shards}
+		m           = metrics.NewMetrics("sync_test")
+		rollupCfg   = &rollup.EsConfig{
+			L2ChainID: new(big.Int).SetUint64(3333),
+		}
+		syncParams = params
+	)
+	defer cancel()
+	syncParams.FillEmptyConcurrency = 4
+	syncParams.FillEmptyWithPeers = 1
+
+	metafile, err := CreateMetaFile(metafileName, int64(kvEntries))
+	if err != nil {
+		t.Error("Create metafileName fail", err.Error())
+	}
+	defer metafile.Close()
+
+	shardManager, files := createEthStorage(contract, shards, defaultChunkSize, kvSize, kvEntries, common.Address{}, defaultEncodeType)
+	if shardManager == nil {
+		t.Fatalf("createEthStorage failed")
+	}
+	defer func(files []string) {
+		for _, file := range files {
+			os.Remove(file)
+		}
+	}(files)
+
+	data := makeKVStorage(contract, shards, defaultChunkSize, kvSize, kvEntries, lastKvIndex, common.Address{}, encodeType, metafile)
+	sm := ethstorage.NewStorageManager(shardManager, NewMockL1Source(lastKvIndex, metafileName))
+	sm.Reset(0)
+	if err := sm.DownloadAllMetas(context.Background(), 16); err != nil {
+		t.Fatal("Download blob metadata failed", "error", err)
+	}
+
+	localHost := getNetHost(t)
+	syncCl := NewSyncClient(testLog, rollupCfg, localHost.NewStream, sm, &syncParams, db, m, mux)
+	syncCl.Start()
+	defer syncCl.Close()
+
+	syncCl.lock.Lock()
+	workers := syncCl.fillEmptyWorkerLimit()
+	syncCl.lock.Unlock()
+	if workers != syncParams.FillEmptyConcurrency {
+		t.Fatalf("fill empty should use all the workers without peers, expected %d, real %d",
+			syncParams.FillEmptyConcurrency, workers)
+	}
+
+	smr := &mockStorageManagerReader{
+		kvEntries:       kvEntries,
+		maxKvSize:       kvSize,
+		encodeType:      encodeType,
+		shards:          shards,
+		contractAddress: contract,
+		shardMiner:      common.Address{},
+		blobPayloads:    data[contract],
+	}
+	remoteHost := createRemoteHost(t, ctx, rollupCfg, smr, db, m, testLog)
+	// the sync is paused while the peer joins, so the task served by the peer is not done before the yield is checked
+	syncCl.Pause()
+	connect(t, localHost, remoteHost, shardMap, shardMap)
+	if !syncCl.AddPeer(remoteHost.ID(), shardMap, network.DirOutbound) {
+		t.Fatalf("add peer failed")
+	}
+
+	syncCl.lock.Lock()
+	workers = syncCl.fillEmptyWorkerLimit()
+	syncCl.lock.Unlock()
+	if workers != syncParams.FillEmptyWithPeers {
+		t.Fatalf("fill empty should yield to sync with peers, expected %d, real %d", syncParams.FillEmptyWithPeers, workers)
+	}
+	syncCl.Resume()
+
+	checkStall(t, 10, mux, cancel)
+	if !syncCl.syncDone {
+		t.Fatalf("sync state %v is not match with expected state %v", syncCl.syncDone, true)
+	}
+	verifyKVs(data, make(map[uint64]struct{}), t)
+}
+
+// TestAddShardAtRuntime test a shard added to the storage manager at runtime is synced from a peer serving it
+// after SyncClient.AddShard, and the task of the new shard is saved to the DB.
+func TestAddShardAtRuntime(t *testing.T) {
+	var (
+		kvSize      = defaultChunkSize
+		kvEntries   = uint64(16)
+		lastKvIndex = uint64(32)
+		encodeType  = uint64(defaultEncodeType)
+		db          = rawdb.NewMemoryDatabase()
+		ctx, cancel = context.WithCancel(context.Background())
+		mux         = new(event.Feed)
+		m           = metrics.NewMetrics("sync_test")
+		localShards = map[common.Address][]uint64{contract: {0}}
+		peerShards  = map[common.Address][]uint64{contract: {0, 1}}
+		rollupCfg   = &rollup.EsConfig{
+			L2ChainID: new(big.Int).SetUint64(3333),
+		}
+	)
+	defer cancel()
+
+	metafile, err := CreateMetaFile(metafileName, int64(kvEntries*2))
+	if err != nil {
+		t.Error("Create metafileName fail", err.Error())
+	}
+	defer metafile.Close()
+
+	shardManager, files := createEthStorage(contract, []uint64{0, 1}, defaultChunkSize, kvSize, kvEntries, common.Address{}, defaultEncodeType)
+	if shardManager == nil {
+		t.Fatalf("createEthStorage failed")
+	}
+	defer func(files []string) {
+		for _, file := range files {
+			os.Remove(file)
+		}
+	}(files)
+
+	data := makeKVStorage(contract, []uint64{0, 1}, defaultChunkSize, kvSize, kvEntries, lastKvIndex, common.Address{}, encodeType, metafile)
+	// the local node starts with shard 0 only, shard 1 is added to the shard manager at runtime
+	shard1 := shardManager.ShardMap()[1]
+	delete(shardManager.ShardMap(), 1)
+
+	sm := ethstorage.NewStorageManager(shardManager, NewMockL1Source(lastKvIndex, metafileName))
+	sm.Reset(0)
+	localHost, syncCl := createLocalHostAndSyncClient(t, testLog, rollupCfg, db, sm, m, mux)
+	syncCl.Start()
+	defer syncCl.Close()
+
+	smr := &mockStorageManagerReader{
+		kvEntries:       kvEntries,
+		maxKvSize:       kvSize,
+		encodeType:      encodeType,
+		shards:          []uint64{0, 1},
+		contractAddress: contract,
+		shardMiner:      common.Address{},
+		blobPayloads:    data[contract],
+	}
+	remoteHost := createRemoteHost(t, ctx, rollupCfg, smr, db, m, testLog)
+	connect(t, localHost, remoteHost, localShards, peerShards)
+	checkStall(t, 6, mux, cancel)
+	if !syncCl.syncDone {
+		t.Fatalf("sync state %v is not match with expected state %v", syncCl.syncDone, true)
+	}
+
+	// the shard added after the sync is done is announced done for the miner
+	doneCh := make(chan EthStorageSyncDone, 16)
+	doneSub := mux.Subscribe(doneCh)
+	defer doneSub.Unsubscribe()
+	shardManager.ShardMap()[1] = shard1
+	if err := syncCl.AddShard(contract, 1); err != nil {
+		t.Fatalf("add shard failed: %s", err.Error())
+	}
+	if err := syncCl.AddShard(contract, 1); err == nil {
+		t.Fatalf("add shard twice should fail")
+	}
+	if syncCl.tasks[1].state.PeerCount != 1 {
+		t.Fatalf("the connected peer should be counted to the new task, peer count %d", syncCl.tasks[1].state.PeerCount)
+	}
+	checkStall(t, 6, mux, cancel)
+	if !syncCl.syncDone {
+		t.Fatalf("sync state %v is not match with expected state %v", syncCl.syncDone, true)
+	}
+	verifyKVs(data, make(map[uint64]struct{}), t)
+	announced := false
+	for len(doneCh) > 0 {
+		if ev := <-doneCh; ev.DoneType == SingleShardDone && ev.ShardId == 1 {
+			announced = true
+		}
+	}
+	if !announced {
+		t.Fatalf("the added shard is not announced done")
+	}
+
+	syncCl.saveSyncStatus()
+	var states map[uint64]*SyncState
+	status, _ := db.Get(SyncStatusKey)
+	if err := json.Unmarshal(status, &states); err != nil {
+		t.Fatalf("decode sync status failed: %s", err.Error())
+	}
+	if state, ok := states[1]; !ok || state.BlobsSynced != kvEntries {
+		t.Fatalf("the state of shard 1 should be saved, state %v", state)
+	}
+
+	if err := syncCl.RemoveShard(contract, 1); err != nil {
+		t.Fatalf("remove shard failed: %s", err.Error())
+	}
+	if len(syncCl.tasks) != 1 || syncCl.tasks[0].ShardId != 0 {
+		t.Fatalf("the task of shard 1 should be removed")
+	}
+	states = nil
+	status, _ = db.Get(SyncStatusKey)
+	if err := json.Unmarshal(status, &states); err != nil {
+		t.Fatalf("decode sync status failed: %s", err.Error())
+	}
+	if _, ok := states[1]; ok {
+		t.Fatalf("the state of the removed shard 1 should not be saved")
+	}
+}
+
+// TestCancelShard test a shard cancelled mid-sync by SyncClient.CancelShard is no longer requested and is removed
+// from the saved status, while the other shard completes its sync.
+func TestCancelShard(t *testing.T) {
+	var (
+		kvSize      = defaultChunkSize
+		kvEntries   = uint64(16)
+		lastKvIndex = uint64(32)
+		db          = rawdb.NewMemoryDatabase()
+		ctx, cancel = context.WithCancel(context.Background())
+		mux         = new(event.Feed)
+		m           = metrics.NewMetrics("sync_test")
+		localShards = map[common.Address][]uint64{contract: {0, 1}}
+		rollupCfg   = &rollup.EsConfig{
+			L2ChainID: new(big.Int).SetUint64(3333),
+		}
+	)
+	defer cancel()
+
+	metafile, err := CreateMetaFile(metafileName, int64(kvEntries*2))
+	if err != nil {
+		t.Error("Create metafileName fail", err.Error())
+	}
+	defer metafile.Close()
+
+	shardManager, files := createEthStorage(contract, []uint64{0, 1}, defaultChunkSize, kvSize, kvEntries, common.Address{}, defaultEncodeType)
+	if shardManager == nil {
+		t.Fatalf("createEthStorage failed")
+	}
+	defer func(files []string) {
+		for _, file := range files {
+			os.Remove(file)
+		}
+	}(files)
+
+	data := makeKVStorage(contract, []uint64{0, 1}, defaultChunkSize, kvSize, kvEntries, lastKvIndex, common.Address{}, defaultEncodeType, metafile)
+	sm := ethstorage.NewStorageManager(shardManager, NewMockL1Source(lastKvIndex, metafileName))
+	sm.Reset(0)
+	localHost, syncCl := createLocalHostAndSyncClient(t, testLog, rollupCfg, db, sm, m, mux)
+	syncCl.Start()
+	defer syncCl.Close()
+
+	// shard 1 is served by a slow peer, so it is still syncing when it is cancelled
+	smrs := make([]*mockStorageManagerReader, 0)
+	for _, shardIdx := range []uint64{0, 1} {
+		smr := &mockStorageManagerReader{
+			kvEntries:       kvEntries,
+			maxKvSize:       kvSize,
+			encodeType:      defaultEncodeType,
+			shards:          []uint64{shardIdx},
+			contractAddress: contract,
+			shardMiner:      common.Address{},
+			blobPayloads:    data[contract],
+		}
+		if shardIdx == 1 {
+			smr.readDelay = 200 * time.Millisecond
+		}
+		remoteHost := createRemoteHost(t, ctx, rollupCfg, smr, db, m, testLog)
+		connect(t, localHost, remoteHost, localShards, map[common.Address][]uint64{contract: {shardIdx}})
+		smrs = append(smrs, smr)
+	}
+	for start := time.Now(); smrs[1].reads.Load() == 0; time.Sleep(10 * time.Millisecond) {
+		if time.Since(start) > 6*time.Second {
+			t.Fatalf("shard 1 is not requested")
+		}
+	}
+
+	if err := syncCl.CancelShard(contract, 1); err != nil {
+		t.Fatalf("cancel shard failed: %s", err.Error())
+	}
+	if err := syncCl.CancelShard(contract, 1); err == nil {
+		t.Fatalf("cancel shard twice should fail")
+	}
+	reads := smrs[1].reads.Load()
+	checkStall(t, 6, mux, cancel)
+	if !syncCl.syncDone {
+		t.Fatalf("sync state %v is not match with expected state %v", syncCl.syncDone, true)
+	}
+	if smrs[1].reads.Load() != reads {
+		t.Fatalf("cancelled shard is requested, reads %d before and %d after the cancel", reads, smrs[1].reads.Load())
+	}
+	shard0 := map[common.Address]map[uint64]*BlobPayloadWithRowData{contract: {}}
+	for idx, blob := range data[contract] {
+		if idx < kvEntries {
+			shard0[contract][idx] = blob
+		}
+	}
+	verifyKVs(shard0, make(map[uint64]struct{}), t)
+
+	var progress SyncProgress
+	status, _ := db.Get(SyncTasksKey)
+	if err := json.Unmarshal(status, &progress); err != nil {
+		t.Fatalf("decode sync tasks failed: %s", err.Error())
+	}
+	for _, tk := range progress.Tasks {
+		if tk.ShardId == 1 {
+			t.Fatalf("the task of the cancelled shard should not be saved")
+		}
+	}
+	var states map[uint64]*SyncState
+	status, _ = db.Get(SyncStatusKey)
+	if err := json.Unmarshal(status, &states); err != nil {
+		t.Fatalf("decode sync status failed: %s", err.Error())
+	}
+	if _, ok := states[1]; ok {
+		t.Fatalf("the state of the cancelled shard should not be saved")
+	}
+}
+
+// TestMultiContractSync test the shards of multiple contracts are synced by a sync client, each from the peer
+// serving the contract, and the tasks are grouped by contract and shard id.
+func TestMultiContractSync(t *testing.T) {
+	var (
+		kvSize        = defaultChunkSize
+		kvEntries     = uint64(16)
+		lastKvIndex   = uint64(12)
+		contract2     = common.HexToAddress("0x0000000000000000000000000000000003330002")
+		metafileName2 = "metafile2.dat.meta"
+		contracts     = []common.Address{contract, contract2}
+		metafileNames = []string{metafileName, metafileName2}
+		db            = rawdb.NewMemoryDatabase()
+		ctx, cancel   = context.WithCancel(context.Background())
+		mux           = new(event.Feed)
+		localShards   = map[common.Address][]uint64{contract: {0}, contract2: {0}}
+		m             = metrics.NewMetrics("sync_test")
+		rollupCfg     = &rollup.EsConfig{
+			L2ChainID: new(big.Int).SetUint64(3333),
+		}
+	)
+	defer cancel()
+	defer delete(ethstorage.ContractToShardManager, contract2)
+
+	var (
+		sms  = make([]*ethstorage.StorageManager, 0)
+		data = make(map[common.Address]map[uint64]*BlobPayloadWithRowData)
+	)
+	for i, c := range contracts {
+		metafile, err := CreateMetaFile(metafileNames[i], int64(kvEntries))
+		if err != nil {
+			t.Fatal("Create metafileName fail", err.Error())
+		}
+		defer func(metafile *os.File) {
+			metafile.Close()
+			os.Remove(metafile.Name())
+		}(metafile)
+
+		shardManager, files := createEthStorage(c, []uint64{0}, defaultChunkSize, kvSize, kvEntries, common.Address{}, defaultEncodeType)
+		if shardManager == nil {
+			t.Fatalf("createEthStorage failed")
+		}
+		defer func(files []string) {
+			for _, file := range files {
+				os.Remove(file)
+			}
+		}(files)
+
+		data[c] = makeKVStorage(c, []uint64{0}, defaultChunkSize, kvSize, kvEntries, lastKvIndex, common.Address{}, defaultEncodeType, metafile)[c]
+		sm := ethstorage.NewStorageManager(shardManager, NewMockL1Source(lastKvIndex, metafileNames[i]))
+		sm.Reset(0)
+		sms = append(sms, sm)
+	}
+
+	localHost, syncCl := createLocalHostAndSyncClient(t, testLog, rollupCfg, db, sms[0], m, mux)
+	if err := syncCl.AddContract(sms[1]); err != nil {
+		t.Fatalf("add contract failed: %s", err.Error())
+	}
+	if err := syncCl.AddContract(sms[1]); err == nil {
+		t.Fatalf("add the same contract twice should fail")
+	}
+	syncCl.Start()
+	defer syncCl.Close()
+	if err := syncCl.AddContract(sms[1]); err == nil {
+		t.Fatalf("add contract after start should fail")
+	}
+
+	// the peer serves both contracts
+	var syncSrv *SyncServer
+	for _, c := range contracts {
+		smr := &mockStorageManagerReader{
+			kvEntries:       kvEntries,
+			maxKvSize:       kvSize,
+			encodeType:      defaultEncodeType,
+			shards:          []uint64{0},
+			contractAddress: c,
+			shardMiner:      common.Address{},
+			blobPayloads:    data[c],
+		}
+		if syncSrv == nil {
+			syncSrv = NewSyncServer(rollupCfg, smr, rawdb.NewMemoryDatabase(), m)
+		} else if err := syncSrv.AddContract(smr); err != nil {
+			t.Fatalf("add contract to sync server failed: %s", err.Error())
+		}
+	}
+	defer syncSrv.Close()
+	remoteHost := getNetHost(t)
+	remoteHost.SetStreamHandler(GetProtocolID(RequestBlobsByRangeProtocolID, rollupCfg.L2ChainID),
+		MakeStreamHandler(ctx, testLog, syncSrv.HandleGetBlobsByRangeRequest))
+	remoteHost.SetStreamHandler(GetProtocolID(RequestBlobsByListProtocolID, rollupCfg.L2ChainID),
+		MakeStreamHandler(ctx, testLog, syncSrv.HandleGetBlobsByListRequest))
+	connect(t, localHost, remoteHost, localShards, localShards)
+
+	checkStall(t, 20, mux, cancel)
+	if !syncCl.syncDone {
+		t.Fatalf("sync state %v is not match with expected state %v", syncCl.syncDone, true)
+	}
+	if len(syncCl.tasks) != len(contracts) {
+		t.Fatalf("task count is not match, expected: %d, actual: %d", len(contracts), len(syncCl.tasks))
+	}
+	for i, task := range syncCl.tasks {
+		if task.Contract != contracts[i] || task.ShardId != 0 || !task.done {
+			t.Fatalf("task %d is not match, contract: %s, shard: %d, done: %v", i, task.Contract.Hex(), task.ShardId, task.done)
+		}
+	}
+	verifyKVs(data, make(map[uint64]struct{}), t)
+
+	// the sync states are saved per contract
+	syncCl.saveSyncStatus()
+	for _, c := range contracts {
+		var states map[uint64]*SyncState
+		status, _ := db.Get(syncCl.syncStatusKey(c))
+		if err := json.Unmarshal(status, &states); err != nil {
+			t.Fatalf("decode sync states of contract %s failed: %v", c.Hex(), err)
+		}
+		if state, ok := states[0]; !ok || state.BlobsSynced != lastKvIndex {
+			t.Fatalf("sync state of contract %s is not match, actual: %v", c.Hex(), states)
+		}
+	}
+}
+
+// TestConvertShardList test the shard list of multiple contracts round-trips through the encoding exchanged
+// between peers, and the shards of a contract listed more than once are merged.
+func TestConvertShardList(t *testing.T) {
+	var (
+		contract2 = common.HexToAddress("0x0000000000000000000000000000000003330002")
+		shards    = map[common.Address][]uint64{contract2: {0, 2}, contract: {1}}
+	)
+
+	css := ConvertToContractShards(shards)
+	if len(css) != len(shards) || css[0].Contract != contract || css[1].Contract != contract2 {
+		t.Fatalf("contract shards should be sorted by contract, actual: %v", css)
+	}
+	bs, err := rlp.EncodeToBytes(css)
+	if err != nil {
+		t.Fatalf("encode contract shards failed: %s", err.Error())
+	}
+	var decoded []*ContractShards
+	if err := rlp.DecodeBytes(bs, &decoded); err != nil {
+		t.Fatalf("decode contract shards failed: %s", err.Error())
+	}
+	if converted := ConvertToShardList(decoded); !reflect.DeepEqual(converted, shards) {
+		t.Fatalf("shard list is not match, expected: %v, actual: %v", shards, converted)
+	}
+
+	duplicated := append(decoded, &ContractShards{Contract: contract2, ShardIds: []uint64{2, 3}})
+	expected := map[common.Address][]uint64{contract2: {0, 2, 3}, contract: {1}}
+	if converted := ConvertToShardList(duplicated); !reflect.DeepEqual(converted, expected) {
+		t.Fatalf("shard list is not match, expected: %v, actual: %v", expected, converted)
+	}
+}
+
+// TestAddPeerMalformedShards test a peer advertising malformed shards, e.g. too many contracts or shards, or a shard
+// out of the kv index range of a local contract, is not added for sync duties.
+func TestAddPeerMalformedShards(t *testing.T) {
+	var (
+		kvSize      = defaultChunkSize
+		kvEntries   = uint64(16)
+		lastKvIndex = uint64(0)
+		db          = rawdb.NewMemoryDatabase()
+		pid         = peer.ID("malformed-peer")
+		rollupCfg   = &rollup.EsConfig{
+			L2ChainID: new(big.Int).SetUint64(3333),
+		}
+	)
+
+	metafile, err := CreateMetaFile(metafileName, int64(kvEntries))
+	if err != nil {
+		t.Fatalf("Create metafileName fail: %s", err.Error())
+	}
+	defer func() {
+		metafile.Close()
+		os.Remove(metafileName)
+	}()
+
+	shardManager, files := createEthStorage(contract, []uint64{0}, defaultChunkSize, kvSize, kvEntries, common.Address{}, defaultEncodeType)
+	if shardManager == nil {
+		t.Fatalf("createEthStorage failed")
+	}
+	defer func(files []string) {
+		for _, file := range files {
+			os.Remove(file)
+		}
+	}(files)
+
+	sm := ethstorage.NewStorageManager(shardManager, NewMockL1Source(lastKvIndex, metafileName))
+	syncCl := NewSyncClient(testLog, rollupCfg, nil, sm, &params, db, nil, nil)
+
+	manyContracts := make([]*ContractShards, 0, maxAdvertisedContracts+1)
+	for i := 0; i <= maxAdvertisedContracts; i++ {
+		manyContracts = append(manyContracts, &ContractShards{Contract: common.BigToAddress(big.NewInt(int64(i + 1))), ShardIds: []uint64{0}})
+	}
+	manyShards := make([]uint64, maxAdvertisedShards+1)
+	for i := range manyShards {
+		manyShards[i] = uint64(i)
+	}
+	malformed := map[string][]*ContractShards{
+		"too many contracts": append(manyContracts, &ContractShards{Contract: contract, ShardIds: []uint64{0}}),
+		"too many shards":    {{Contract: contract, ShardIds: manyShards}},
+		"shard out of range": {{Contract: contract, ShardIds: []uint64{0, math.MaxUint64 / kvEntries}}},
+	}
+	for name, css := range malformed {
+		if syncCl.AddPeer(pid, ConvertToShardList(css), network.DirOutbound) {
+			t.Fatalf("peer advertising %s should not be added", name)
+		}
+		if _, ok := syncCl.peers[pid]; ok {
+			t.Fatalf("peer advertising %s should not be registered", name)
+		}
+	}
+	if err := syncCl.validateShards(ConvertToShardList([]*ContractShards{{Contract: contract, ShardIds: []uint64{0, 1}}})); err != nil {
+		t.Fatalf("valid shards should pass the validation: %s", err.Error())
+	}
+}
+
+// TestPeersOvershoot test the sync client accepts peers beyond MaxPeers within the overshoot allowance while
+// syncing, and trims the peers back to MaxPeers after sync done.
+func TestPeersOvershoot(t *testing.T) {
+	var (
+		kvSize      = defaultChunkSize
+		kvEntries   = uint64(16)
+		lastKvIndex = uint64(16)
+		encodeType  = uint64(defaultEncodeType)
+		db          = rawdb.NewMemoryDatabase()
+		ctx, cancel = context.WithCancel(context.Background())
+		mux         = new(event.Feed)
+		shards      = []uint64{0}
+		shardMap    = map[common.Address][]uint64{contract: shards}
+		m           = metrics.NewMetrics("sync_test")
+		rollupCfg   = &rollup.EsConfig{
+			L2ChainID: new(big.Int).SetUint64(3333),
+		}
+		syncParams = params
+	)
+	defer cancel()
+	syncParams.MaxPeers = 1
+	syncParams.PeersOvershoot = 1
+
+	metafile, err := CreateMetaFile(metafileName, int64(kvEntries))
+	if err != nil {
+		t.Error("Create metafileName fail", err.Error())
+	}
+	defer metafile.Close()
+
+	shardManager, files := createEthStorage(contract, shards, defaultChunkSize, kvSize, kvEntries, common.Address{}, defaultEncodeType)
+	if shardManager == nil {
+		t.Fatalf("createEthStorage failed")
+	}
+	defer func(files []string) {
+		for _, file := range files {
+			os.Remove(file)
+		}
+	}(files)
+
+	data := makeKVStorage(contract, shards, defaultChunkSize, kvSize, kvEntries, lastKvIndex, common.Address{}, encodeType, metafile)
+	sm := ethstorage.NewStorageManager(shardManager, NewMockL1Source(lastKvIndex, metafileName))
+	sm.Reset(0)
+
+	localHost := getNetHost(t)
+	syncCl := NewSyncClient(testLog, rollupCfg, localHost.NewStream, sm, &syncParams, db, m, mux)
+	// only the peer limit decides whether a peer is needed
+	syncCl.minPeersPerShard = 0
+	// subscribe before the sync starts, so the sync done event is not missed however fast the sync is
+	dlEventCh := make(chan EthStorageSyncDone, 16)
+	events := mux.Subscribe(dlEventCh)
+	defer events.Unsubscribe()
+	syncCl.Start()
+	defer syncCl.Close()
+
+	addRemotePeer := func() bool {
+		smr := &mockStorageManagerReader{
+			kvEntries:       kvEntries,
+			maxKvSize:       kvSize,
+			encodeType:      encodeType,
+			shards:          shards,
+			contractAddress: contract,
+			shardMiner:      common.Address{},
+			blobPayloads:    data[contract],
+		}
+		remoteHost := createRemoteHost(t, ctx, rollupCfg, smr, db, m, testLog)
+		connect(t, localHost, remoteHost, shardMap, shardMap)
+		return syncCl.AddPeer(remoteHost.ID(), shardMap, network.DirOutbound)
+	}
+	for i := 0; i < syncParams.MaxPeers+syncParams.PeersOvershoot; i++ {
+		if !addRemotePeer() {
+			t.Fatalf("peer %d should be added within the overshoot allowance while syncing", i)
+		}
+	}
+	if addRemotePeer() {
+		t.Fatalf("peer beyond the overshoot allowance should not be added")
+	}
+
+	for done := false; !done; {
+		select {
+		case <-time.After(60 * time.Second):
+			t.Fatalf("sync is not done")
+		case ev := <-dlEventCh:
+			done = ev.DoneType == AllShardDone
+		}
+	}
+	verifyKVs(data, make(map[uint64]struct{}), t)
+
+	trimmed := syncCl.TrimPeers()
+	if len(trimmed) != syncParams.PeersOvershoot {
+		t.Fatalf("trimmed peers count is not match, expected: %d, actual count %d", syncParams.PeersOvershoot, len(trimmed))
+	}
+	if len(syncCl.Peers()) != syncParams.MaxPeers {
+		t.Fatalf("sync client peers count is not match, expected: %d, actual count %d", syncParams.MaxPeers, len(syncCl.Peers()))
+	}
+	if addRemotePeer() {
+		t.Fatalf("peer beyond the max peers should not be added after sync done")
+	}
+}
+
+// TestPeersForIndex test the peers advertising the shard of a heal index are found, while the peers without the
+// shard are excluded.
+func TestPeersForIndex(t *testing.T) {
+	var (
+		kvSize      = defaultChunkSize
+		kvEntries   = uint64(16)
+		lastKvIndex = uint64(32)
+		healIndex   = kvEntries + 5
+		encodeType  = uint64(defaultEncodeType)
+		db          = rawdb.NewMemoryDatabase()
+		ctx, cancel = context.WithCancel(context.Background())
+		mux         = new(event.Feed)
+		shards      = []uint64{0, 1}
+		m           = metrics.NewMetrics("sync_test")
+		rollupCfg   = &rollup.EsConfig{
+			L2ChainID: new(big.Int).SetUint64(3333),
+		}
+	)
+	defer cancel()
+
+	metafile, err := CreateMetaFile(metafileName, int64(lastKvIndex))
+	if err != nil {
+		t.Error("Create metafileName fail", err.Error())
+	}
+	defer metafile.Close()
+
+	shardManager, files := createEthStorage(contract, shards, defaultChunkSize, kvSize, kvEntries, common.Address{}, defaultEncodeType)
+	if shardManager == nil {
+		t.Fatalf("createEthStorage failed")
+	}
+	defer func(files []string) {
+		for _, file := range files {
+			os.Remove(file)
+		}
+	}(files)
+
+	data := makeKVStorage(contract, shards, defaultChunkSize, kvSize, kvEntries, lastKvIndex, common.Address{}, encodeType, metafile)
+	sm := ethstorage.NewStorageManager(shardManager, NewMockL1Source(lastKvIndex, metafileName))
+	sm.Reset(0)
+	localHost, syncCl := createLocalHostAndSyncClient(t, testLog, rollupCfg, db, sm, m, mux)
+	syncCl.Start()
+	defer syncCl.Close()
+
+	// the peer of shard 0 only, and the peer of both shards which misses the blob of healIndex
+	shard0Map := map[common.Address][]uint64{contract: {0}}
+	shard0Host := createRemoteHost(t, ctx, rollupCfg, &mockStorageManagerReader{
+		kvEntries:       kvEntries,
+		maxKvSize:       kvSize,
+		encodeType:      encodeType,
+		shards:          []uint64{0},
+		contractAddress: contract,
+		shardMiner:      common.Address{},
+		blobPayloads:    data[contract],
+	}, db, m, testLog)
+	allShardsMap := map[common.Address][]uint64{contract: shards}
+	payloads := make(map[uint64]*BlobPayloadWithRowData)
+	for idx, payload := range data[contract] {
+		if idx != healIndex {
+			payloads[idx] = payload
+		}
+	}
+	allShardsHost := createRemoteHost(t, ctx, rollupCfg, &mockStorageManagerReader{
+		kvEntries:       kvEntries,
+		maxKvSize:       kvSize,
+		encodeType:      encodeType,
+		shards:          shards,
+		contractAddress: contract,
+		shardMiner:      common.Address{},
+		blobPayloads:    payloads,
+	}, db, m, testLog)
+	connect(t, localHost, shard0Host, allShardsMap, shard0Map)
+	connect(t, localHost, allShardsHost, allShardsMap, allShardsMap)
+
+	inHeal := func() bool {
+		syncCl.lock.Lock()
+		defer syncCl.lock.Unlock()
+		for _, tk := range syncCl.tasks {
+			if _, ok := tk.healTask.Indexes[healIndex]; ok && tk.ShardId == 1 {
+				return true
+			}
+		}
+		return false
+	}
+	// the blob is queued to heal only after the range response of shard 1 is verified and persisted, which takes
+	// seconds on a slow machine, so wait for it on a generous deadline
+	deadline := time.Now().Add(30 * time.Second)
+	for !inHeal() {
+		if time.Now().After(deadline) {
+			t.Fatalf("blob %d is not queued to heal", healIndex)
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+
+	peers := syncCl.PeersForIndex(contract, healIndex)
+	if len(peers) != 1 || peers[0] != allShardsHost.ID() {
+		t.Fatalf("peers for index %d are not match, expected: %v, actual: %v", healIndex, []peer.ID{allShardsHost.ID()}, peers)
+	}
+	if peers = syncCl.PeersForIndex(contract, 0); len(peers) != 2 {
+		t.Fatalf("peers count for index 0 is not match, expected: %d, actual: %d", 2, len(peers))
+	}
+	if peers = syncCl.PeersForIndex(common.HexToAddress("0x0000000000000000000000000000000003330009"), 0); len(peers) != 0 {
+		t.Fatalf("no peer should be returned for a contract not synced, actual: %v", peers)
+	}
+}
+
+// TestAdaptiveRangeBatch test the number of blobs in the range requests to a fast peer grows from the initial
+// request size, bounded by the max range batch size, and the round trip time of the peer is tracked.
+func TestAdaptiveRangeBatch(t *testing.T) {
+	var (
+		kvSize      = defaultChunkSize
+		kvEntries   = uint64(32)
+		lastKvIndex = uint64(32)
+		encodeType  = uint64(defaultEncodeType)
+		db          = rawdb.NewMemoryDatabase()
+		ctx, cancel = context.WithCancel(context.Background())
+		mux         = new(event.Feed)
+		shards      = []uint64{0}
+		shardMap    = map[common.Address][]uint64{contract: shards}
+		m           = metrics.NewMetrics("sync_test")
+		rollupCfg   = &rollup.EsConfig{
+			L2ChainID: new(big.Int).SetUint64(3333),
+		}
+		syncParams = params
+	)
+	defer cancel()
+	syncParams.InitRequestSize = 4 * kvSize
+	syncParams.MinRangeBatchSize = 2
+	syncParams.MaxRangeBatchSize = 32
+
+	metafile, err := CreateMetaFile(metafileName, int64(kvEntries))
+	if err != nil {
+		t.Error("Create metafileName fail", err.Error())
+	}
+	defer metafile.Close()
+
+	shardManager, files := createEthStorage(contract, shards, defaultChunkSize, kvSize, kvEntries, common.Address{}, defaultEncodeType)
+	if shardManager == nil {
+		t.Fatalf("createEthStorage failed")
+	}
+	defer func(files []string) {
+		for _, file := range files {
+			os.Remove(file)
+		}
+	}(files)
+
+	data := makeKVStorage(contract, shards, defaultChunkSize, kvSize, kvEntries, lastKvIndex, common.Address{}, encodeType, metafile)
+	sm := ethstorage.NewStorageManager(shardManager, NewMockL1Source(lastKvIndex, metafileName))
+	sm.Reset(0)
+	if err := sm.DownloadAllMetas(context.Background(), 16); err != nil {
+		t.Fatal("Download blob metadata failed", "error", err)
+	}
+
+	localHost := getNetHost(t)
+	syncCl := NewSyncClient(testLog, rollupCfg, localHost.NewStream, sm, &syncParams, db, m, mux)
+	syncCl.Start()
+	defer syncCl.Close()
+
+	// a fast peer with a small delay on each blob read
+	smr := &mockStorageManagerReader{
+		kvEntries:       kvEntries,
+		maxKvSize:       kvSize,
+		encodeType:      encodeType,
+		shards:          shards,
+		contractAddress: contract,
+		shardMiner:      common.Address{},
+		blobPayloads:    data[contract],
+		readDelay:       time.Millisecond,
+	}
+	remoteHost := createRemoteHost(t, ctx, rollupCfg, smr, db, m, testLog)
+	connect(t, localHost, remoteHost, shardMap, shardMap)
+	if !syncCl.AddPeer(remoteHost.ID(), shardMap, network.DirOutbound) {
+		t.Fatalf("add peer failed")
+	}
+
+	checkStall(t, 20, mux, cancel)
+	if !syncCl.syncDone {
+		t.Fatalf("sync state %v is not match with expected state %v", syncCl.syncDone, true)
+	}
+	verifyKVs(data, make(map[uint64]struct{}), t)
+
+	syncCl.lock.Lock()
+	pr, ok := syncCl.peers[remoteHost.ID()]
+	if !ok {
+		syncCl.lock.Unlock()
+		t.Fatalf("peer %s is not found", remoteHost.ID())
+	}
+	batch, rtt := pr.rangeBatch, pr.rtt
+	syncCl.lock.Unlock()
+	if batch <= 4 || batch > syncParams.MaxRangeBatchSize {
+		t.Fatalf("range batch should grow from %d up to %d, actual: %d", 4, syncParams.MaxRangeBatchSize, batch)
+	}
+	if rtt <= 0 || rtt >= rangeBatchTargetRTT {
+		t.Fatalf("rtt of the fast peer is not tracked, actual: %v", rtt)
+	}
+}
+
+// TestSchedulePolicy test the request slots are shared equally among the tasks in round-robin, and in proportion
+// to the remaining work of the tasks if weighted, so the lagging shard gets most of the requests over a window.
+func TestSchedulePolicy(t *testing.T) {
+	newTask := func(shardId, remaining, healing uint64) *task {
+		tk := &task{Contract: contract, ShardId: shardId}
+		tk.healTask = &healTask{Indexes: make(map[uint64]int64), task: tk}
+		tk.SubTasks = []*subTask{{task: tk, First: 0, Last: remaining, next: 0}}
+		for i := uint64(0); i < healing; i++ {
+			tk.healTask.Indexes[remaining+i] = 0
+		}
+		return tk
+	}
+	slots := 1000
+
+	for _, policy := range []SchedulePolicy{ScheduleRoundRobin, ScheduleWeighted} {
+		syncCl := &SyncClient{schedulePolicy: policy}
+		// the lagging shard has 990 blobs remaining and the nearly done one has 10
+		tasks := []*task{newTask(0, 960, 30), newTask(1, 8, 2)}
+		picks := make([]int, len(tasks))
+		for i := 0; i < slots; i++ {
+			picks[syncCl.pickTask(tasks)]++
+		}
+
+		switch policy {
+		case ScheduleRoundRobin:
+			if picks[0] != slots/2 || picks[1] != slots/2 {
+				t.Fatalf("%s picks are not shared equally: %v", policy, picks)
+			}
+		case ScheduleWeighted:
+			// the expected share of the lagging shard is 99%
+			if picks[0] < slots*9/10 {
+				t.Fatalf("%s picks of the lagging shard are too few: %v", policy, picks)
+			}
+		}
+	}
+
+	// the tasks without remaining work are served in round-robin
+	syncCl := &SyncClient{schedulePolicy: ScheduleWeighted}
+	tasks := []*task{newTask(0, 0, 0), newTask(1, 0, 0)}
+	if first, second := syncCl.pickTask(tasks), syncCl.pickTask(tasks); first == second {
+		t.Fatalf("tasks without remaining work should be served in turn, picked: %d, %d", first, second)
+	}
+}
+
+// TestMaxConcurrentPerPeer test a peer stays idle until the requests in flight to it reach the max concurrent
+// requests per peer, and becomes idle again once one of them is done.
+func TestMaxConcurrentPerPeer(t *testing.T) {
+	pr := &Peer{id: peer.ID("peer")}
+	syncCl := &SyncClient{
+		maxConcurrentPerPeer: 2,
+		peers:                map[peer.ID]*Peer{pr.id: pr},
+		idlerPeers:           map[peer.ID]struct{}{pr.id: {}},
+		peerRequests:         make(map[peer.ID]int),
+		update:               make(chan struct{}, 1),
+	}
+	isIdle := func() bool {
+		_, ok := syncCl.idlerPeers[pr.id]
+		return ok
+	}
+
+	syncCl.takePeer(pr.id)
+	if !isIdle() {
+		t.Fatalf("peer with 1 request in flight should be idle")
+	}
+	syncCl.takePeer(pr.id)
+	if isIdle() {
+		t.Fatalf("peer with 2 requests in flight should not be idle")
+	}
+	syncCl.releasePeer(pr)
+	if !isIdle() || syncCl.peerRequests[pr.id] != 1 {
+		t.Fatalf("peer should be idle with 1 request in flight, requests: %d", syncCl.peerRequests[pr.id])
+	}
+
+	// the requests to a removed peer do not return it to the idle peers
+	delete(syncCl.peers, pr.id)
+	delete(syncCl.idlerPeers, pr.id)
+	syncCl.releasePeer(pr)
+	if isIdle() {
+		t.Fatalf("removed peer should not be idle")
+	}
+}
+
+// TestDispatchJitter test the requests dispatched in a burst are spread over the jitter window, while a request
+// dispatched after a quiet period is not delayed.
+func TestDispatchJitter(t *testing.T) {
+	var (
+		kvSize      = defaultChunkSize
+		kvEntries   = uint64(256)
+		lastKvIndex = uint64(256)
+		peerCount   = 8
+		jitter      = 400 * time.Millisecond
+		db          = rawdb.NewMemoryDatabase()
+		shards      = map[common.Address][]uint64{contract: {0}}
+		rollupCfg   = &rollup.EsConfig{
+			L2ChainID: new(big.Int).SetUint64(3333),
+		}
+		syncParams = params
+		lock       sync.Mutex
+		dispatched = make([]time.Time, 0)
+	)
+	syncParams.MaxDispatchJitter = jitter
+
+	metafile, err := CreateMetaFile(metafileName, int64(kvEntries))
+	if err != nil {
+		t.Error("Create metafileName fail", err.Error())
+	}
+	defer metafile.Close()
+
+	shardManager, files := createEthStorage(contract, []uint64{0}, defaultChunkSize, kvSize, kvEntries, common.Address{}, defaultEncodeType)
+	if shardManager == nil {
+		t.Fatalf("createEthStorage failed")
+	}
+	defer func(files []string) {
+		for _, file := range files {
+			os.Remove(file)
+		}
+	}(files)
+
+	// record the time the range requests are sent, and fail them so the peers are idle again
+	rangeID := GetProtocolID(RequestBlobsByRangeProtocolID, rollupCfg.L2ChainID)
+	newStream := func(ctx context.Context, id peer.ID, pids ...protocol.ID) (network.Stream, error) {
+		if slices.Contains(pids, rangeID) {
+			lock.Lock()
+			dispatched = append(dispatched, time.Now())
+			lock.Unlock()
+		}
+		return nil, errors.New("no stream in test")
+	}
+	sm := ethstorage.NewStorageManager(shardManager, NewMockL1Source(lastKvIndex, metafileName))
+	sm.Reset(0)
+	syncCl := NewSyncClient(testLog, rollupCfg, newStream, sm, &syncParams, db, nil, nil)
+	defer syncCl.resCancel()
+	syncCl.loadSyncStatus()
+	for i := 0; i < peerCount; i++ {
+		syncCl.AddPeer(peer.ID(fmt.Sprintf("jitter-peer-%d", i)), shards, network.DirOutbound)
+	}
+	waitIdle := func() {
+		for i := 0; i < 100; i++ {
+			syncCl.lock.Lock()
+			idle := len(syncCl.idlerPeers)
+			syncCl.lock.Unlock()
+			if idle == peerCount {
+				return
+			}
+			time.Sleep(20 * time.Millisecond)
+		}
+		t.Fatalf("peers are not idle")
+	}
+	waitIdle()
+
+	start := time.Now()
+	syncCl.assignBlobRangeTasks()
+	for i := 0; i < 100; i++ {
+		lock.Lock()
+		count := len(dispatched)
+		lock.Unlock()
+		if count == peerCount {
+			break
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+	lock.Lock()
+	if len(dispatched) != peerCount {
+		t.Fatalf("dispatched request count is not match, expected: %d, actual: %d", peerCount, len(dispatched))
+	}
+	first, last := dispatched[0], dispatched[0]
+	for _, tm := range dispatched {
+		if tm.Before(first) {
+			first = tm
+		}
+		if tm.After(last) {
+			last = tm
+		}
+	}
+	lock.Unlock()
+	if spread := last.Sub(first); spread < jitter/4 {
+		t.Fatalf("requests of the burst are not spread over the jitter window, spread %s", spread)
+	}
+	if elapsed := last.Sub(start); elapsed > jitter+200*time.Millisecond {
+		t.Fatalf("requests of the burst are delayed beyond the jitter window, elapsed %s", elapsed)
+	}
+
+	// a request after a quiet period is dispatched at once
+	waitIdle()
+	time.Sleep(jitter)
+	syncCl.lock.Lock()
+	delay := syncCl.dispatchDelay()
+	syncCl.lock.Unlock()
+	if delay != 0 {
+		t.Fatalf("sparse request should not be delayed, delay %s", delay)
+	}
+}
+
+// TestSyncMetrics test the sync client and server metrics advance after a sync run.
+func TestSyncMetrics(t *testing.T) {
+	var (
+		kvSize      = defaultChunkSize
+		kvEntries   = uint64(16)
+		lastKvIndex = uint64(16)
+		encodeType  = uint64(defaultEncodeType)
+		db          = rawdb.NewMemoryDatabase()
+		ctx, cancel = context.WithCancel(context.Background())
+		mux         = new(event.Feed)
+		shards      = []uint64{0}
+		shardMap    = map[common.Address][]uint64{contract: shards}
+		clientM     = metrics.NewMetrics("sync_client_test")
+		serverM     = metrics.NewMetrics("sync_server_test")
+		rollupCfg   = &rollup.EsConfig{
+			L2ChainID: new(big.Int).SetUint64(3333),
+		}
+	)
+	defer cancel()
+
+	metafile, err := CreateMetaFile(metafileName, int64(kvEntries))
+	if err != nil {
+		t.Error("Create metafileName fail", err.Error())
+	}
+	defer metafile.Close()
+
+	shardManager, files := createEthStorage(contract, shards, defaultChunkSize, kvSize, kvEntries, common.Address{}, defaultEncodeType)
+	if shardManager == nil {
+		t.Fatalf("createEthStorage failed")
+	}
+	defer func(files []string) {
+		for _, file := range files {
+			os.Remove(file)
+		}
+	}(files)
+
+	data := makeKVStorage(contract, shards, defaultChunkSize, kvSize, kvEntries, lastKvIndex, common.Address{}, encodeType, metafile)
+	sm := ethstorage.NewStorageManager(shardManager, NewMockL1Source(lastKvIndex, metafileName))
+	sm.Reset(0)
+	localHost, syncCl := createLocalHostAndSyncClient(t, testLog, rollupCfg, db, sm, clientM, mux)
+	syncCl.Start()
+
+	smr := &mockStorageManagerReader{
+		kvEntries:       kvEntries,
+		maxKvSize:       kvSize,
+		encodeType:      encodeType,
+		shards:          shards,
+		contractAddress: contract,
+		shardMiner:      common.Address{},
+		blobPayloads:    data[contract],
+	}
+	remoteHost := createRemoteHost(t, ctx, rollupCfg, smr, db, serverM, testLog)
+	connect(t, localHost, remoteHost, shardMap, shardMap)
+	checkStall(t, 4, mux, cancel)
+	if !syncCl.syncDone {
+		t.Fatalf("sync state %v is not match with expected state %v", syncCl.syncDone, true)
+	}
+
+	if received := testutil.ToFloat64(clientM.SyncClientBlobsReceivedTotal); received < float64(lastKvIndex) {
+		t.Fatalf("blobs received should be at least %d, actual %v", lastKvIndex, received)
+	}
+	if bytesIn := testutil.ToFloat64(clientM.SyncClientBytesInTotal); bytesIn < float64(lastKvIndex*kvSize) {
+		t.Fatalf("bytes in should be at least %d, actual %v", lastKvIndex*kvSize, bytesIn)
+	}
+	if served := testutil.ToFloat64(serverM.SyncServerBlobsServedTotal); served < float64(lastKvIndex) {
+		t.Fatalf("blobs served should be at least %d, actual %v", lastKvIndex, served)
+	}
+	if bytesOut := testutil.ToFloat64(serverM.SyncServerBytesOutTotal); bytesOut < float64(lastKvIndex*kvSize) {
+		t.Fatalf("bytes out should be at least %d, actual %v", lastKvIndex*kvSize, bytesOut)
+	}
+	if count := testutil.CollectAndCount(clientM.SyncClientRequestDurationSeconds); count == 0 {
+		t.Fatalf("request latency of sync client should be recorded")
+	}
+	if count := testutil.CollectAndCount(serverM.SyncServerHandleReqDurationSeconds); count == 0 {
+		t.Fatalf("request latency of sync server should be recorded")
+	}
+	if peers := testutil.ToFloat64(clientM.PeerCount); peers != 1 {
+		t.Fatalf("active peer count should be 1, actual %v", peers)
+	}
+	if healSize := testutil.ToFloat64(clientM.SyncClientHealTaskSize.WithLabelValues(contract.Hex(), "0")); healSize != 0 {
+		t.Fatalf("heal task size should be 0 after sync done, actual %v", healSize)
+	}
+}
+
+// TestMaxConcurrentHandlers test the sync server serves at most MaxConcurrentHandlers requests at the same time,
+// and the excess requests are queued and then rejected with returnCodeServerBusy if no handler slot is freed in time.
+func TestMaxConcurrentHandlers(t *testing.T) {
+	var (
+		kvSize      = defaultChunkSize
+		kvEntries   = uint64(16)
+		lastKvIndex = uint64(16)
+		maxHandlers = 2
+		requests    = 6
+		ctx, cancel = context.WithCancel(context.Background())
+		db          = rawdb.NewMemoryDatabase()
+		shards      = map[common.Address][]uint64{contract: {0}}
+		m           = metrics.NewMetrics("sync_test")
+		rollupCfg   = &rollup.EsConfig{
+			L2ChainID:             new(big.Int).SetUint64(3333),
+			MaxConcurrentHandlers: maxHandlers,
+		}
+	)
+	defer cancel()
+
+	metafile, err := CreateMetaFile(metafileName, int64(kvEntries))
+	if err != nil {
+		t.Error("Create metafileName fail", err.Error())
+	}
+	defer metafile.Close()
+
+	shardManager, files := createEthStorage(contract, []uint64{0}, defaultChunkSize, kvSize, kvEntries, common.Address{}, defaultEncodeType)
+	if shardManager == nil {
+		t.Fatalf("createEthStorage failed")
+	}
+	defer func(files []string) {
+		for _, file := range files {
+			os.Remove(file)
+		}
+	}(files)
+
+	data := makeKVStorage(contract, []uint64{0}, defaultChunkSize, kvSize, kvEntries, lastKvIndex, common.Address{}, defaultEncodeType, metafile)
+	smr := &mockStorageManagerReader{
+		kvEntries:       kvEntries,
+		maxKvSize:       kvSize,
+		encodeType:      defaultEncodeType,
+		shards:          []uint64{0},
+		contractAddress: contract,
+		shardMiner:      common.Address{},
+		blobPayloads:    data[contract],
+		readDelay:       200 * time.Millisecond,
+	}
+
+	remoteHost := getNetHost(t)
+	syncSrv := NewSyncServer(rollupCfg, smr, db, m)
+	// the handlers take 800ms to read 4 blobs, so the queued requests time out before a slot is freed
+	syncSrv.queueTimeout = 100 * time.Millisecond
+	blobByRangeHandler := MakeStreamHandler(ctx, testLog, syncSrv.HandleGetBlobsByRangeRequest)
+	remoteHost.SetStreamHandler(GetProtocolID(RequestBlobsByRangeProtocolID, rollupCfg.L2ChainID), blobByRangeHandler)
+	localHost := getNetHost(t)
+	connect(t, localHost, remoteHost, shards, shards)
+	pr := NewPeer(0, rollupCfg.L2ChainID, remoteHost.ID(), localHost.NewStream, network.DirOutbound,
+		params.InitRequestSize, kvSize, shards)
+
+	var (
+		wg     sync.WaitGroup
+		served atomic.Int32
+		busy   atomic.Int32
+	)
+	for i := 0; i < requests; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			var packet BlobsByRangePacket
+			returnCode, err := pr.RequestBlobsByRange(uint64(i), contract, 0, uint64(i), uint64(i)+3, &packet)
+			if err == nil {
+				served.Add(1)
+			} else if returnCode == returnCodeServerBusy {
+				busy.Add(1)
+			} else {
+				t.Errorf("request %d failed: %s", i, err.Error())
+			}
+		}(i)
+	}
+	wg.Wait()
+
+	if int(served.Load()) != maxHandlers {
+		t.Fatalf("served request count is not match, expected: %d, actual: %d", maxHandlers, served.Load())
+	}
+	if int(busy.Load()) != requests-maxHandlers {
+		t.Fatalf("rejected request count is not match, expected: %d, actual: %d", requests-maxHandlers, busy.Load())
+	}
+
+	// the slots are freed once the handlers finish
+	var packet BlobsByRangePacket
+	if _, err := pr.RequestBlobsByRange(uint64(requests), contract, 0, 0, 0, &packet); err != nil {
+		t.Fatalf("request should be served after the handlers finish: %s", err.Error())
+	}
+}
+
+// TestMaxQueuedHandlers test the sync server queues at most MaxQueuedHandlers requests waiting for a handler slot,
+// the excess requests are rejected with returnCodeServerBusy at once, and the streams gauge tracks the handlers.
+func TestMaxQueuedHandlers(t *testing.T) {
+	var (
+		kvSize      = defaultChunkSize
+		kvEntries   = uint64(16)
+		lastKvIndex = uint64(16)
+		maxHandlers = 1
+		maxQueued   = 2
+		requests    = 6
+		ctx, cancel = context.WithCancel(context.Background())
+		db          = rawdb.NewMemoryDatabase()
+		shards      = map[common.Address][]uint64{contract: {0}}
+		m           = metrics.NewMetrics("sync_test")
+		rollupCfg   = &rollup.EsConfig{
+			L2ChainID:             new(big.Int).SetUint64(3333),
+			MaxConcurrentHandlers: maxHandlers,
+			MaxQueuedHandlers:     maxQueued,
+		}
+	)
+	defer cancel()
+
+	metafile, err := CreateMetaFile(metafileName, int64(kvEntries))
+	if err != nil {
+		t.Error("Create metafileName fail", err.Error())
+	}
+	defer metafile.Close()
+
+	shardManager, files := createEthStorage(contract, []uint64{0}, defaultChunkSize, kvSize, kvEntries, common.Address{}, defaultEncodeType)
+	if shardManager == nil {
+		t.Fatalf("createEthStorage failed")
+	}
+	defer func(files []string) {
+		for _, file := range files {
+			os.Remove(file)
+		}
+	}(files)
+
+	data := makeKVStorage(contract, []uint64{0}, defaultChunkSize, kvSize, kvEntries, lastKvIndex, common.Address{}, defaultEncodeType, metafile)
+	smr := &mockStorageManagerReader{
+		kvEntries:       kvEntries,
+		maxKvSize:       kvSize,
+		encodeType:      defaultEncodeType,
+		shards:          []uint64{0},
+		contractAddress: contract,
+		shardMiner:      common.Address{},
+		blobPayloads:    data[contract],
+		readDelay:       100 * time.Millisecond,
+	}
+
+	remoteHost := getNetHost(t)
+	// the handlers take 400ms to read 4 blobs, so the queued requests are served before the queue timeout
+	syncSrv := NewSyncServer(rollupCfg, smr, db, m)
+	blobByRangeHandler := MakeStreamHandler(ctx, testLog, syncSrv.HandleGetBlobsByRangeRequest)
+	remoteHost.SetStreamHandler(GetProtocolID(RequestBlobsByRangeProtocolID, rollupCfg.L2ChainID), blobByRangeHandler)
+	localHost := getNetHost(t)
+	connect(t, localHost, remoteHost, shards, shards)
+	pr := NewPeer(0, rollupCfg.L2ChainID, remoteHost.ID(), localHost.NewStream, network.DirOutbound,
+		params.InitRequestSize, kvSize, shards)
+
+	var (
+		wg        sync.WaitGroup
+		served    atomic.Int32
+		busy      atomic.Int32
+		done      = make(chan struct{})
+		maxActive float64
+		maxQueue  float64
+	)
+	go func() {
+		ticker := time.NewTicker(10 * time.Millisecond)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				maxActive = max(maxActive, testutil.ToFloat64(m.SyncServerStreams.WithLabelValues("active")))
+				maxQueue = max(maxQueue, testutil.ToFloat64(m.SyncServerStreams.WithLabelValues("queued")))
+			case <-done:
+				return
+			}
+		}
+	}()
+	for i := 0; i < requests; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			var packet BlobsByRangePacket
+			returnCode, err := pr.RequestBlobsByRange(uint64(i), contract, 0, uint64(i), uint64(i)+3, &packet)
+			if err == nil {
+				served.Add(1)
+			} else if returnCode == returnCodeServerBusy {
+				busy.Add(1)
+			} else {
+				t.Errorf("request %d failed: %s", i, err.Error())
+			}
+		}(i)
+	}
+	wg.Wait()
+	done <- struct{}{}
+
+	if int(served.Load()) != maxHandlers+maxQueued {
+		t.Fatalf("served request count is not match, expected: %d, actual: %d", maxHandlers+maxQueued, served.Load())
+	}
+	if int(busy.Load()) != requests-maxHandlers-maxQueued {
+		t.Fatalf("rejected request count is not match, expected: %d, actual: %d", requests-maxHandlers-maxQueued, busy.Load())
+	}
+	if maxActive != float64(maxHandlers) || maxQueue > float64(maxQueued) {
+		t.Fatalf("streams gauge exceeds the limits, active: %v, queued: %v", maxActive, maxQueue)
+	}
+	active := testutil.ToFloat64(m.SyncServerStreams.WithLabelValues("active"))
+	queued := testutil.ToFloat64(m.SyncServerStreams.WithLabelValues("queued"))
+	if active != 0 || queued != 0 {
+		t.Fatalf("streams gauge should be 0 after the handlers finish, active: %v, queued: %v", active, queued)
+	}
+}
+
+// TestServeBlobsFromCache test the encoded blobs served to peers are cached, so the repeated requests for the same
+// blobs do not read the disk again until the blobs are invalidated.
+func TestServeBlobsFromCache(t *testing.T) {
+	var (
+		kvSize      = defaultChunkSize
+		kvEntries   = uint64(16)
+		lastKvIndex = uint64(16)
+		blobList    = []uint64{1, 3, 5, 7}
+		ctx, cancel = context.WithCancel(context.Background())
+		db          = rawdb.NewMemoryDatabase()
+		shards      = map[common.Address][]uint64{contract: {0}}
+		m           = metrics.NewMetrics("sync_test")
+		rollupCfg   = &rollup.EsConfig{
+			L2ChainID: new(big.Int).SetUint64(3333),
+		}
+	)
+	defer cancel()
+
+	metafile, err := CreateMetaFile(metafileName, int64(kvEntries))
+	if err != nil {
+		t.Error("Create metafileName fail", err.Error())
+	}
+	defer metafile.Close()
+
+	shardManager, files := createEthStorage(contract, []uint64{0}, defaultChunkSize, kvSize, kvEntries, common.Address{}, defaultEncodeType)
+	if shardManager == nil {
+		t.Fatalf("createEthStorage failed")
+	}
+	defer func(files []string) {
+		for _, file := range files {
+			os.Remove(file)
+		}
+	}(files)
+
+	data := makeKVStorage(contract, []uint64{0}, defaultChunkSize, kvSize, kvEntries, lastKvIndex, common.Address{}, defaultEncodeType, metafile)
+	smr := &mockStorageManagerReader{
+		kvEntries:       kvEntries,
+		maxKvSize:       kvSize,
+		encodeType:      defaultEncodeType,
+		shards:          []uint64{0},
+		contractAddress: contract,
+		shardMiner:      common.Address{},
+		blobPayloads:    data[contract],
+	}
+
+	remoteHost := getNetHost(t)
+	syncSrv := NewSyncServer(rollupCfg, smr, db, m)
+	blobByListHandler := MakeStreamHandler(ctx, testLog, syncSrv.HandleGetBlobsByListRequest)
+	remoteHost.SetStreamHandler(GetProtocolID(RequestBlobsByListProtocolID, rollupCfg.L2ChainID), blobByListHandler)
+	localHost := getNetHost(t)
+	connect(t, localHost, remoteHost, shards, shards)
+	pr := NewPeer(0, rollupCfg.L2ChainID, remoteHost.ID(), localHost.NewStream, network.DirOutbound,
+		params.InitRequestSize, kvSize, shards)
+
+	requestBlobs := func(id uint64) {
+		var packet BlobsByListPacket
+		if _, err := pr.RequestBlobsByList(id, contract, 0, blobList, &packet); err != nil {
+			t.Fatalf("request blobs by list failed: %s", err.Error())
+		}
+		if len(packet.Blobs) != len(blobList) {
+			t.Fatalf("blob count is not match, expected: %d, actual: %d", len(blobList), len(packet.Blobs))
+		}
+		for _, blob := range packet.Blobs {
+			if !bytes.Equal(blob.EncodedBlob, data[contract][blob.BlobIndex].EncodedBlob) {
+				t.Fatalf("encoded blob %d is not match", blob.BlobIndex)
+			}
+		}
+	}
+
+	requestBlobs(0)
+	requestBlobs(1)
+	if reads := smr.reads.Load(); reads != uint64(len(blobList)) {
+		t.Fatalf("disk read count is not match, expected: %d, actual: %d", len(blobList), reads)
+	}
+	if hits := testutil.ToFloat64(m.SyncServerBlobCacheTotal.WithLabelValues("hit")); hits != float64(len(blobList)) {
+		t.Fatalf("cache hit count is not match, expected: %d, actual: %v", len(blobList), hits)
+	}
+
+	// the invalidated blobs are read from disk again
+	syncSrv.InvalidateBlobs(blobList[:2])
+	requestBlobs(2)
+	if reads := smr.reads.Load(); reads != uint64(len(blobList)+2) {
+		t.Fatalf("disk read count is not match after invalidation, expected: %d, actual: %d", len(blobList)+2, reads)
+	}
+}
+
+// TestBlobsChecksumFooter test a blobs response corrupted in transit is rejected by its checksum footer before the
+// blobs are decoded, and the retried request succeeds.
+func TestBlobsChecksumFooter(t *testing.T) {
+	var (
+		kvSize      = defaultChunkSize
+		kvEntries   = uint64(16)
+		lastKvIndex = uint64(16)
+		blobList    = []uint64{1, 3, 5, 7}
+		ctx, cancel = context.WithCancel(context.Background())
+		db          = rawdb.NewMemoryDatabase()
+		shards      = map[common.Address][]uint64{contract: {0}}
+		m           = metrics.NewMetrics("sync_test")
+		corrupted   atomic.Bool
+		rollupCfg   = &rollup.EsConfig{
+			L2ChainID: new(big.Int).SetUint64(3333),
+		}
+	)
+	defer cancel()
+
+	metafile, err := CreateMetaFile(metafileName, int64(kvEntries))
+	if err != nil {
+		t.Error("Create metafileName fail", err.Error())
+	}
+	defer metafile.Close()
+
+	shardManager, files := createEthStorage(contract, []uint64{0}, defaultChunkSize, kvSize, kvEntries, common.Address{}, defaultEncodeType)
+	if shardManager == nil {
+		t.Fatalf("createEthStorage failed")
+	}
+	defer func(files []string) {
+		for _, file := range files {
+			os.Remove(file)
+		}
+	}(files)
+
+	data := makeKVStorage(contract, []uint64{0}, defaultChunkSize, kvSize, kvEntries, lastKvIndex, common.Address{}, defaultEncodeType, metafile)
+	smr := &mockStorageManagerReader{
+		kvEntries:       kvEntries,
+		maxKvSize:       kvSize,
+		encodeType:      defaultEncodeType,
+		shards:          []uint64{0},
+		contractAddress: contract,
+		shardMiner:      common.Address{},
+		blobPayloads:    data[contract],
+	}
+
+	// flip a byte of the last blob in the first response after it is encoded, the footer is the last 5 bytes
+	remoteHost := getNetHost(t)
+	syncSrv := NewSyncServer(rollupCfg, smr, db, m)
+	remoteHost.SetStreamHandler(GetProtocolID(RequestBlobsByListProtocolID, rollupCfg.L2ChainID), MakeStreamHandler(ctx, testLog,
+		func(ctx context.Context, log log.Logger, stream network.Stream) {
+			returnCode, data, err := syncSrv.handleGetBlobsByListRequest(ctx, log, stream)
+			if err != nil {
+				t.Errorf("serve blobs by list request failed: %s", err.Error())
+			}
+			if corrupted.CompareAndSwap(false, true) {
+				data[len(data)-16] ^= 0xff
+			}
+			if err := writeMsg(stream, &Msg{returnCode, data}, p2pReadWriteTimeout); err != nil {
+				t.Errorf("write response failed: %s", err.Error())
+			}
+		}))
+	remoteHost.SetStreamHandler(RequestCapabilities, MakeStreamHandler(ctx, testLog, syncSrv.HandleRequestCapabilities))
+	localHost := getNetHost(t)
+	connect(t, localHost, remoteHost, shards, shards)
+	pr := NewPeer(0, rollupCfg.L2ChainID, remoteHost.ID(), localHost.NewStream, network.DirOutbound,
+		params.InitRequestSize, kvSize, shards)
+
+	var caps Capabilities
+	if _, err := pr.RequestCapabilities(&caps); err != nil || !caps.Checksum {
+		t.Fatalf("server should advertise the checksum footer, err: %v", err)
+	}
+	pr.checksum.Store(caps.Checksum)
+
+	var packet BlobsByListPacket
+	_, err = pr.RequestBlobsByList(0, contract, 0, blobList, &packet)
+	if !errors.Is(err, errMalformedResponse) || classifyResponseError(err) != responseMalformed {
+		t.Fatalf("corrupted response should be rejected as malformed, err: %v", err)
+	}
+
+	packet = BlobsByListPacket{}
+	if _, err := pr.RequestBlobsByList(1, contract, 0, blobList, &packet); err != nil {
+		t.Fatalf("retried request failed: %s", err.Error())
+	}
+	if len(packet.Blobs) != len(blobList) {
+		t.Fatalf("blob count is not match, expected: %d, actual: %d", len(blobList), len(packet.Blobs))
+	}
+	for _, blob := range packet.Blobs {
+		if !bytes.Equal(blob.EncodedBlob, data[contract][blob.BlobIndex].EncodedBlob) {
+			t.Fatalf("encoded blob %d is not match", blob.BlobIndex)
+		}
+	}
+}
+
+// TestRangeRequestsBoundedByPeerLastKvIndex test the range requests to a peer are bounded by the last kv index the
+// peer reports once it is fetched, even if the local last kv index is larger, and the last kv index of the peer is
+// fetched again once the blobs to request are beyond it, so the blobs the peer syncs later are requested from it.
+func TestRangeRequestsBoundedByPeerLastKvIndex(t *testing.T) {
+	var (
+		kvSize          = defaultChunkSize
+		kvEntries       = uint64(16)
+		lastKvIndex     = uint64(16)
+		peerLastKvIndex = uint64(6)
+		ctx, cancel     = context.WithCancel(context.Background())
+		db              = rawdb.NewMemoryDatabase()
+		mux             = new(event.Feed)
+		shards          = map[common.Address][]uint64{contract: {0}}
+		m               = metrics.NewMetrics("sync_test")
+		rollupCfg       = &rollup.EsConfig{
+			L2ChainID: new(big.Int).SetUint64(3333),
+		}
+	)
+	defer cancel()
+
+	metafile, err := CreateMetaFile(metafileName, int64(kvEntries))
+	if err != nil {
+		t.Error("Create metafileName fail", err.Error())
+	}
+	defer metafile.Close()
+
+	shardManager, files := createEthStorage(contract, []uint64{0}, defaultChunkSize, kvSize, kvEntries, common.Address{}, defaultEncodeType)
+	if shardManager == nil {
+		t.Fatalf("createEthStorage failed")
+	}
+	defer func(files []string) {
+		for _, file := range files {
+			os.Remove(file)
+		}
+	}(files)
+
+	data := makeKVStorage(contract, []uint64{0}, defaultChunkSize, kvSize, kvEntries, lastKvIndex, common.Address{}, defaultEncodeType, metafile)
+	sm := ethstorage.NewStorageManager(shardManager, NewMockL1Source(lastKvIndex, metafileName))
+	sm.Reset(0)
+	localHost, syncCl := createLocalHostAndSyncClient(t, testLog, rollupCfg, db, sm, m, mux)
+	syncCl.lastKvIndexRefresh = 100 * time.Millisecond
+	syncCl.Start()
+	defer syncCl.Close()
+
+	// the remote only has the blobs below its last kv index
+	held := make(map[uint64]*BlobPayloadWithRowData)
+	for idx := uint64(0); idx < peerLastKvIndex; idx++ {
+		held[idx] = data[contract][idx]
+	}
+	smr := &mockStorageManagerReader{
+		kvEntries:       kvEntries,
+		maxKvSize:       kvSize,
+		encodeType:      defaultEncodeType,
+		shards:          []uint64{0},
+		contractAddress: contract,
+		shardMiner:      common.Address{},
+		blobPayloads:    held,
+		lastKvIndex:     peerLastKvIndex,
+	}
+	remoteHost := createRemoteHost(t, ctx, rollupCfg, smr, db, m, testLog)
+	syncSrv := NewSyncServer(rollupCfg, smr, db, m)
+	lastKvIndexHandler := MakeStreamHandler(ctx, testLog, syncSrv.HandleRequestLastKvIndex)
+	remoteHost.SetStreamHandler(RequestLastKvIndex, lastKvIndexHandler)
+	connect(t, localHost, remoteHost, shards, shards)
+
+	peerLast := func() uint64 {
+		syncCl.lock.Lock()
+		defer syncCl.lock.Unlock()
+		if pr, ok := syncCl.peers[remoteHost.ID()]; ok {
+			return pr.lastKvIndex[contract]
+		}
+		return 0
+	}
+	// the peer is requested before its last kv index is fetched, the blobs it misses are requested again later
+	for i := 0; i < 50 && peerLast() != peerLastKvIndex; i++ {
+		time.Sleep(100 * time.Millisecond)
+	}
+	if known := peerLast(); known != peerLastKvIndex {
+		t.Fatalf("peer last kv index is not match, expected: %d, actual: %d", peerLastKvIndex, known)
+	}
+	if syncCl.syncDone {
+		t.Fatalf("sync should not be done as the peer does not have the blobs beyond %d", peerLastKvIndex)
+	}
+
+	// the peer syncs the rest of the blobs, and its last kv index is fetched again as the range is beyond it
+	smr.blobPayloads, smr.lastKvIndex = data[contract], lastKvIndex
+	checkStall(t, 10, mux, cancel)
+	if !syncCl.syncDone {
+		t.Fatalf("sync state %v is not match with expected state %v", syncCl.syncDone, true)
+	}
+	if known := peerLast(); known != lastKvIndex {
+		t.Fatalf("peer last kv index is not refreshed, expected: %d, actual: %d", lastKvIndex, known)
+	}
+	verifyKVs(data, make(map[uint64]struct{}), t)
+}
+
+// TestShardDoneWithheldUntilVerified test the shard done event consumed by the miner is withheld when the sync tasks
+// of the shard are done but the local blobs are not verified, until the gap is healed from the peer.
+func TestShardDoneWithheldUntilVerified(t *testing.T) {
+	var (
+		kvSize      = defaultChunkSize
+		kvEntries   = uint64(16)
+		lastKvIndex = uint64(16)
+		ctx, cancel = context.WithCancel(context.Background())
+		db          = rawdb.NewMemoryDatabase()
+		mux         = new(event.Feed)
+		shards      = map[common.Address][]uint64{contract: {0}}
+		m           = metrics.NewMetrics("sync_test")
+		rollupCfg   = &rollup.EsConfig{
+			L2ChainID: new(big.Int).SetUint64(3333),
+		}
+	)
+	defer cancel()
+
+	metafile, err := CreateMetaFile(metafileName, int64(kvEntries))
+	if err != nil {
+		t.Error("Create metafileName fail", err.Error())
+	}
+	defer metafile.Close()
+
+	shardManager, files := createEthStorage(contract, []uint64{0}, defaultChunkSize, kvSize, kvEntries, common.Address{}, defaultEncodeType)
+	if shardManager == nil {
+		t.Fatalf("createEthStorage failed")
+	}
+	defer func(files []string) {
+		for _, file := range files {
+			os.Remove(file)
+		}
+	}(files)
+
+	data := makeKVStorage(contract, []uint64{0}, defaultChunkSize, kvSize, kvEntries, lastKvIndex, common.Address{}, defaultEncodeType, metafile)
+	sm := ethstorage.NewStorageManager(shardManager, NewMockL1Source(lastKvIndex, metafileName))
+	sm.Reset(0)
+
+	// the sync tasks of shard 0 report done, but none of the blobs exist locally
+	progress, _ := json.Marshal(&SyncProgress{Tasks: []*task{{Contract: contract, ShardId: 0,
+		SubTasks: make([]*subTask, 0), SubEmptyTasks: make([]*subEmptyTask, 0)}}})
+	if err := db.Put(SyncTasksKey, progress); err != nil {
+		t.Fatalf("save sync tasks failed: %s", err.Error())
+	}
+
+	doneCh := make(chan EthStorageSyncDone, 16)
+	sub := mux.Subscribe(doneCh)
+	defer sub.Unsubscribe()
+
+	localHost, syncCl := createLocalHostAndSyncClient(t, testLog, rollupCfg, db, sm, m, mux)
+	syncCl.Start()
+	defer syncCl.Close()
+
+	select {
+	case ev := <-doneCh:
+		t.Fatalf("sync done event %v should be withheld as the blobs are not verified", ev)
+	case <-time.After(time.Second):
+	}
+	syncCl.lock.Lock()
+	gap := syncCl.tasks[0].healTask.count()
+	syncCl.lock.Unlock()
+	if gap != int(lastKvIndex) {
+		t.Fatalf("unverified blobs should be healed, expected: %d, actual: %d", lastKvIndex, gap)
+	}
+
+	smr := &mockStorageManagerReader{
+		kvEntries:       kvEntries,
+		maxKvSize:       kvSize,
+		encodeType:      defaultEncodeType,
+		shards:          []uint64{0},
+		contractAddress: contract,
+		shardMiner:      common.Address{},
+		blobPayloads:    data[contract],
+	}
+	remoteHost := createRemoteHost(t, ctx, rollupCfg, smr, db, m, testLog)
+	connect(t, localHost, remoteHost, shards, shards)
+
+	select {
+	case ev := <-doneCh:
+		if ev.DoneType != SingleShardDone || ev.ShardId != 0 {
+			t.Fatalf("shard done event of shard 0 is expected, actual %v", ev)
+		}
+	case <-time.After(10 * time.Second):
+		t.Fatalf("shard done event is not sent after the gap is healed")
+	}
+	verifyKVs(data, make(map[uint64]struct{}), t)
+}
+
+// TestSyncSummaryLog test the sync client periodically logs a summary of the sync health with sane values.
+func TestSyncSummaryLog(t *testing.T) {
+	var (
+		kvSize      = defaultChunkSize
+		kvEntries   = uint64(16)
+		lastKvIndex = uint64(16)
+		encodeType  = uint64(defaultEncodeType)
+		db          = rawdb.NewMemoryDatabase()
+		ctx, cancel = context.WithCancel(context.Background())
+		mux         = new(event.Feed)
+		shards      = []uint64{0}
+		shardMap    = map[common.Address][]uint64{contract: shards}
+		m           = metrics.NewMetrics("sync_test")
+		summaryCh   = make(chan map[string]interface{}, 16)
+		rollupCfg   = &rollup.EsConfig{
+			L2ChainID: new(big.Int).SetUint64(3333),
+		}
+	)
+	defer cancel()
+
+	summaryLog := log.New("TestSync")
+	summaryLog.SetHandler(log.FuncHandler(func(r *log.Record) error {
+		if r.Msg != "Storage sync summary" {
+			return nil
+		}
+		fields := make(map[string]interface{})
+		for i := 0; i+1 < len(r.Ctx); i += 2 {
+			fields[r.Ctx[i].(string)] = r.Ctx[i+1]
+		}
+		select {
+		case summaryCh <- fields:
+		default:
+		}
+		return nil
+	}))
+
+	metafile, err := CreateMetaFile(metafileName, int64(kvEntries))
+	if err != nil {
+		t.Error("Create metafileName fail", err.Error())
+	}
+	defer metafile.Close()
+
+	shardManager, files := createEthStorage(contract, shards, defaultChunkSize, kvSize, kvEntries, common.Address{}, defaultEncodeType)
+	if shardManager == nil {
+		t.Fatalf("createEthStorage failed")
+	}
+	defer func(files []string) {
+		for _, file := range files {
+			os.Remove(file)
+		}
+	}(files)
+
+	data := makeKVStorage(contract, shards, defaultChunkSize, kvSize, kvEntries, lastKvIndex, common.Address{}, encodeType, metafile)
+	sm := ethstorage.NewStorageManager(shardManager, NewMockL1Source(lastKvIndex, metafileName))
+	sm.Reset(0)
+	localHost, syncCl := createLocalHostAndSyncClient(t, summaryLog, rollupCfg, db, sm, m, mux)
+	syncCl.summaryInterval = 200 * time.Millisecond
+	syncCl.Start()
+	defer syncCl.Close()
+
+	smr := &mockStorageManagerReader{
+		kvEntries:       kvEntries,
+		maxKvSize:       kvSize,
+		encodeType:      encodeType,
+		shards:          shards,
+		contractAddress: contract,
+		shardMiner:      common.Address{},
+		blobPayloads:    data[contract],
+	}
+	remoteHost := createRemoteHost(t, ctx, rollupCfg, smr, db, m, testLog)
+	connect(t, localHost, remoteHost, shardMap, shardMap)
+	checkStall(t, 4, mux, cancel)
+	if !syncCl.syncDone {
+		t.Fatalf("sync state %v is not match with expected state %v", syncCl.syncDone, true)
+	}
+
+	// drop the summaries logged during sync, and take the first one after sync done
+	for len(summaryCh) > 0 {
+		<-summaryCh
+	}
+	var summary map[string]interface{}
+	select {
+	case summary = <-summaryCh:
+	case <-time.After(2 * time.Second):
+		t.Fatalf("sync summary is not logged")
+	}
+
+	expected := map[string]interface{}{
+		"peers":       1,
+		"shardsDone":  1,
+		"shardsTotal": 1,
+		"blobsToSync": uint64(0),
+		"healBacklog": 0,
+		"emptyToFill": uint64(0),
+		"etaTimeLeft": common.PrettyDuration(0).String(),
+	}
+	for key, value := range expected {
+		if summary[key] != value {
+			t.Fatalf("summary field %s is not match, expected: %v, actual: %v", key, value, summary[key])
+		}
+	}
+	if rate, ok := summary["downloadRate"].(string); !ok || rate == fmt.Sprintf("%s/s", common.StorageSize(0)) {
+		t.Fatalf("download rate should be positive after sync, actual: %v", summary["downloadRate"])
+	}
+}
+
+// TestSyncLogContext test the log lines of the sync client and server carry the context of the peer, contract,
+// shard and subTask range, so the lines of a peer or shard can be found together.
+func TestSyncLogContext(t *testing.T) {
+	var (
+		kvSize      = defaultChunkSize
+		kvEntries   = uint64(16)
+		lastKvIndex = uint64(16)
+		encodeType  = uint64(defaultEncodeType)
+		db          = rawdb.NewMemoryDatabase()
+		ctx, cancel = context.WithCancel(context.Background())
+		mux         = new(event.Feed)
+		shards      = []uint64{0}
+		shardMap    = map[common.Address][]uint64{contract: shards}
+		m           = metrics.NewMetrics("sync_test")
+		rollupCfg   = &rollup.EsConfig{
+			L2ChainID: new(big.Int).SetUint64(3333),
+		}
+		recordsLock sync.Mutex
+		records     = make(map[string][]map[string]interface{})
+	)
+	defer cancel()
+
+	captureLog := log.New("TestSync")
+	captureLog.SetHandler(log.FuncHandler(func(r *log.Record) error {
+		fields := make(map[string]interface{})
+		for i := 0; i+1 < len(r.Ctx); i += 2 {
+			fields[r.Ctx[i].(string)] = r.Ctx[i+1]
+		}
+		recordsLock.Lock()
+		records[r.Msg] = append(records[r.Msg], fields)
+		recordsLock.Unlock()
+		return nil
+	}))
+
+	metafile, err := CreateMetaFile(metafileName, int64(kvEntries))
+	if err != nil {
+		t.Error("Create metafileName fail", err.Error())
+	}
+	defer metafile.Close()
+
+	shardManager, files := createEthStorage(contract, shards, defaultChunkSize, kvSize, kvEntries, common.Address{}, defaultEncodeType)
+	if shardManager == nil {
+		t.Fatalf("createEthStorage failed")
+	}
+	defer func(files []string) {
+		for _, file := range files {
+			os.Remove(file)
+		}
+	}(files)
+
+	data := makeKVStorage(contract, shards, defaultChunkSize, kvSize, kvEntries, lastKvIndex, common.Address{}, encodeType, metafile)
+	sm := ethstorage.NewStorageManager(shardManager, NewMockL1Source(lastKvIndex, metafileName))
+	sm.Reset(0)
+	localHost, syncCl := createLocalHostAndSyncClient(t, captureLog, rollupCfg, db, sm, m, mux)
+	syncCl.Start()
+	defer syncCl.Close()
+
+	smr := &mockStorageManagerReader{
+		kvEntries:       kvEntries,
+		maxKvSize:       kvSize,
+		encodeType:      encodeType,
+		shards:          shards,
+		contractAddress: contract,
+		shardMiner:      common.Address{},
+		blobPayloads:    data[contract],
+	}
+	remoteHost := createRemoteHost(t, ctx, rollupCfg, smr, db, m, captureLog)
+	connect(t, localHost, remoteHost, shardMap, shardMap)
+	checkStall(t, 4, mux, cancel)
+	if !syncCl.syncDone {
+		t.Fatalf("sync state %v is not match with expected state %v", syncCl.syncDone, true)
+	}
+
+	expected := map[string]map[string]interface{}{
+		// the client side of the range request
+		"Persisted set of kvs": {"peer": shortPeerID(remoteHost.ID()), "contract": contract.Hex(), "shard": uint64(0)},
+		// the server side of the range request
+		"Read blobs for range request": {"peer": shortPeerID(localHost.ID()), "contract": contract.Hex(), "shard": uint64(0)},
+	}
+	recordsLock.Lock()
+	defer recordsLock.Unlock()
+	for msg, fields := range expected {
+		if len(records[msg]) == 0 {
+			t.Fatalf("log line %q is not found", msg)
+		}
+		// the range requests carry the subTask range in addition
+		fields["subTask"] = nil
+		found := false
+		for _, record := range records[msg] {
+			matched := true
+			for key, value := range fields {
+				if v, ok := record[key]; !ok || (value != nil && v != value) {
+					matched = false
+					break
+				}
+			}
+			if matched {
+				found = true
+				break
+			}
+		}
+		if !found {
+			t.Fatalf("log line %q with fields %v is not found, actual: %v", msg, fields, records[msg])
+		}
+	}
+}
+
+// TestSyncStalled test the SyncStalled event is emitted when the connected peer serves nothing for the stall timeout.
+func TestSyncStalled(t *testing.T) {
+	var (
+		kvSize      = defaultChunkSize
+		kvEntries   = uint64(16)
+		lastKvIndex = uint64(16)
+		encodeType  = uint64(defaultEncodeType)
+		db          = rawdb.NewMemoryDatabase()
+		ctx, cancel = context.WithCancel(context.Background())
+		mux         = new(event.Feed)
+		shards      = []uint64{0}
+		shardMap    = map[common.Address][]uint64{contract: shards}
+		m           = metrics.NewMetrics("sync_test")
+		rollupCfg   = &rollup.EsConfig{
+			L2ChainID: new(big.Int).SetUint64(3333),
+		}
+	)
+	defer cancel()
+
+	metafile, err := CreateMetaFile(metafileName, int64(kvEntries))
+	if err != nil {
+		t.Error("Create metafileName fail", err.Error())
+	}
+	defer metafile.Close()
+
+	shardManager, files := createEthStorage(contract, shards, defaultChunkSize, kvSize, kvEntries, common.Address{}, defaultEncodeType)
+	if shardManager == nil {
+		t.Fatalf("createEthStorage failed")
+	}
+	defer func(files []string) {
+		for _, file := range files {
+			os.Remove(file)
+		}
+	}(files)
+
+	makeKVStorage(contract, shards, defaultChunkSize, kvSize, kvEntries, lastKvIndex, common.Address{}, encodeType, metafile)
+	sm := ethstorage.NewStorageManager(shardManager, NewMockL1Source(lastKvIndex, metafileName))
+	sm.Reset(0)
+	localHost, syncCl := createLocalHostAndSyncClient(t, testLog, rollupCfg, db, sm, m, mux)
+	syncCl.stallTimeout = 500 * time.Millisecond
+
+	dlEventCh := make(chan EthStorageSyncDone, 16)
+	events := mux.Subscribe(dlEventCh)
+	defer events.Unsubscribe()
+	stalledCh := make(chan SyncStalled, 16)
+	stalled := syncCl.SubscribeSyncStalled(stalledCh)
+	defer stalled.Unsubscribe()
+	syncCl.Start()
+	defer syncCl.Close()
+
+	// the remote peer has none of the blobs, so nothing is committed
+	smr := &mockStorageManagerReader{
+		kvEntries:       kvEntries,
+		maxKvSize:       kvSize,
+		encodeType:      encodeType,
+		shards:          shards,
+		contractAddress: contract,
+		shardMiner:      common.Address{},
+		blobPayloads:    make(map[uint64]*BlobPayloadWithRowData),
+	}
+	remoteHost := createRemoteHost(t, ctx, rollupCfg, smr, db, m, testLog)
+	connect(t, localHost, remoteHost, shardMap, shardMap)
+
+	timeout := time.After(4 * time.Second)
+	for {
+		select {
+		case ev := <-dlEventCh:
+			if ev.DoneType == AllShardDone {
+				t.Fatalf("sync should not be done without any blob served")
+			}
+		case ev := <-stalledCh:
+			if ev.BlobsToSync == 0 {
+				t.Fatalf("stalled sync should have blobs to sync")
+			}
+			return
+		case <-timeout:
+			t.Fatalf("SyncStalled event is not emitted")
+		}
+	}
+}
+
+// TestDrainSyncServer test the in-flight request completes during the sync server drain rather than being reset,
+// and new requests are rejected after the drain.
+func TestDrainSyncServer(t *testing.T) {
+	var (
+		kvSize      = defaultChunkSize
+		kvEntries   = uint64(16)
+		lastKvIndex = uint64(16)
+		ctx, cancel = context.WithCancel(context.Background())
+		db          = rawdb.NewMemoryDatabase()
+		mux         = new(event.Feed)
+		shards      = map[common.Address][]uint64{contract: {0}}
+		m           = metrics.NewMetrics("sync_test")
+		rollupCfg   = &rollup.EsConfig{
+			L2ChainID: new(big.Int).SetUint64(3333),
+		}
+	)
+	defer cancel()
+
+	metafile, err := CreateMetaFile(metafileName, int64(kvEntries))
+	if err != nil {
+		t.Error("Create metafileName fail", err.Error())
+	}
+	defer metafile.Close()
+
+	shardManager, files := createEthStorage(contract, []uint64{0}, defaultChunkSize, kvSize, kvEntries, common.Address{}, defaultEncodeType)
+	if shardManager == nil {
+		t.Fatalf("createEthStorage failed")
+	}
+	defer func(files []string) {
+		for _, file := range files {
+			os.Remove(file)
+		}
+	}(files)
+
+	data := makeKVStorage(contract, []uint64{0}, defaultChunkSize, kvSize, kvEntries, lastKvIndex, common.Address{}, defaultEncodeType, metafile)
+	sm := ethstorage.NewStorageManager(shardManager, NewMockL1Source(lastKvIndex, metafileName))
+	smr := &mockStorageManagerReader{
+		kvEntries:       kvEntries,
+		maxKvSize:       kvSize,
+		encodeType:      defaultEncodeType,
+		shards:          []uint64{0},
+		contractAddress: contract,
+		shardMiner:      common.Address{},
+		blobPayloads:    data[contract],
+		readDelay:       100 * time.Millisecond,
+	}
+
+	localHost, syncCl := createLocalHostAndSyncClient(t, testLog, rollupCfg, db, sm, m, mux)
+	syncCl.loadSyncStatus()
+	sm.Reset(0)
+	err = sm.DownloadAllMetas(context.Background(), 16)
+	if err != nil {
+		t.Fatal("Download blob metadata failed", "error", err)
+	}
+
+	remoteHost := getNetHost(t)
+	syncSrv := NewSyncServer(rollupCfg, smr, db, m)
+	blobByRangeHandler := MakeStreamHandler(ctx, testLog, syncSrv.HandleGetBlobsByRangeRequest)
+	remoteHost.SetStreamHandler(GetProtocolID(RequestBlobsByRangeProtocolID, rollupCfg.L2ChainID), blobByRangeHandler)
+	connect(t, localHost, remoteHost, shards, shards)
+	time.Sleep(time.Second)
+
+	type result struct {
+		results []*BlobSyncResult
+		err     error
+	}
+	resCh := make(chan result, 1)
+	go func() {
+		_, results, err := syncCl.RequestL2RangeWithResults(0, 7)
+		resCh <- result{results, err}
+	}()
+	// wait for the request to be in-flight, it takes 800ms to read the 8 blobs
+	time.Sleep(200 * time.Millisecond)
+
+	drainCtx, drainCancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer drainCancel()
+	if err := syncSrv.Drain(drainCtx); err != nil {
+		t.Fatalf("drain sync server failed: %s", err.Error())
+	}
+
+	select {
+	case res := <-resCh:
+		if res.err != nil {
+			t.Fatalf("in-flight request should complete during drain: %s", res.err.Error())
+		}
+		if len(res.results) != 8 {
+			t.Fatalf("result count is not match, expected: %d, actual: %d", 8, len(res.results))
+		}
+		for _, r := range res.results {
+			if r.Outcome != BlobCommitted {
+				t.Fatalf("blob %d should be committed, outcome %d", r.Index, r.Outcome)
+			}
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("in-flight request does not complete during drain")
+	}
+
+	if _, _, err := syncCl.RequestL2RangeWithResults(8, 15); err == nil {
+		t.Fatalf("new request should be rejected after drain")
+	}
+}
+
+// TestHealWithRangePreference test the sync client sends contiguous heal indexes as a range request
+// to the peer which advertises a range preference, instead of a list request.
+func TestHealWithRangePreference(t *testing.T) {
+	var (
+		kvSize      = defaultChunkSize
+		kvEntries   = uint64(16)
+		lastKvIndex = uint64(16)
+		ctx, cancel = context.WithCancel(context.Background())
+		db          = rawdb.NewMemoryDatabase()
+		mux         = new(event.Feed)
+		shards      = make(map[common.Address][]uint64)
+		m           = metrics.NewMetrics("sync_test")
+		indexes     = []uint64{3, 4, 5, 6, 7, 8}
+		rangeCount  = int32(0)
+		listCount   = int32(0)
+		rollupCfg   = &rollup.EsConfig{
+			L2ChainID: new(big.Int).SetUint64(3333),
+		}
+	)
+	defer cancel()
+
+	metafile, err := CreateMetaFile(metafileName, int64(kvEntries))
+	if err != nil {
+		t.Error("Create metafileName fail", err.Error())
+	}
+	defer metafile.Close()
+
+	shardManager, files := createEthStorage(contract, []uint64{0}, defaultChunkSize, kvSize, kvEntries, common.Address{}, defaultEncodeType)
+	if shardManager == nil {
+		t.Fatalf("createEthStorage failed")
+	}
+	shards[shardManager.ContractAddress()] = shardManager.ShardIds()
+
+	defer func(files []string) {
+		for _, file := range files {
+			os.Remove(file)
+		}
+	}(files)
+
+	data := makeKVStorage(contract, []uint64{0}, defaultChunkSize, kvSize, kvEntries, lastKvIndex, common.Address{}, defaultEncodeType, metafile)
+
+	l1 := NewMockL1Source(lastKvIndex, metafileName)
+	sm := ethstorage.NewStorageManager(shardManager, l1)
+	smr := &mockStorageManagerReader{
+		kvEntries:       kvEntries,
+		maxKvSize:       kvSize,
+		encodeType:      defaultEncodeType,
+		shards:          []uint64{0},
+		contractAddress: contract,
+		shardMiner:      common.Address{},
+		blobPayloads:    data[contract],
+		lastKvIndex:     lastKvIndex,
+	}
+
+	localHost, syncCl := createLocalHostAndSyncClient(t, testLog, rollupCfg, db, sm, m, mux)
+	syncCl.loadSyncStatus()
+	sm.Reset(0)
+	err = sm.DownloadAllMetas(context.Background(), 16)
+	if err != nil {
+		t.Fatal("Download blob metadata failed", "error", err)
+		return
+	}
+
+	// create remote host which advertises range preference, and count the requests it received
+	remoteHost := getNetHost(t)
+	syncSrv := NewSyncServer(rollupCfg, smr, db, m)
+	syncSrv.SetPreferRange(true)
+	blobByRangeHandler := MakeStreamHandler(ctx, testLog, syncSrv.HandleGetBlobsByRangeRequest)
+	remoteHost.SetStreamHandler(GetProtocolID(RequestBlobsByRangeProtocolID, rollupCfg.L2ChainID), func(stream network.Stream) {
+		atomic.AddInt32(&rangeCount, 1)
+		blobByRangeHandler(stream)
+	})
+	blobByListHandler := MakeStreamHandler(ctx, testLog, syncSrv.HandleGetBlobsByListRequest)
+	remoteHost.SetStreamHandler(GetProtocolID(RequestBlobsByListProtocolID, rollupCfg.L2ChainID), func(stream network.Stream) {
+		atomic.AddInt32(&listCount, 1)
+		blobByListHandler(stream)
+	})
+	remoteHost.SetStreamHandler(RequestCapabilities, MakeStreamHandler(ctx, testLog, syncSrv.HandleRequestCapabilities))
+	connect(t, localHost, remoteHost, shards, shards)
+
+	time.Sleep(2 * time.Second)
+	syncCl.lock.Lock()
+	pr, ok := syncCl.peers[remoteHost.ID()]
+	if !ok || !pr.preferRange {
+		syncCl.lock.Unlock()
+		t.Fatalf("peer should be added with range preference")
+	}
+	// the preference, checksum and last kv index of the peer are all carried by the capabilities handshake, as the
+	// remote host serves no other handshake
+	if last, known := pr.lastKvIndex[contract]; !known || last != lastKvIndex || !pr.checksum.Load() {
+		syncCl.lock.Unlock()
+		t.Fatalf("peer should be added with the capabilities, last kv index %d known %v, checksum %v",
+			last, known, pr.checksum.Load())
+	}
+	syncCl.tasks[0].healTask.insert(indexes)
+	syncCl.lock.Unlock()
+
+	syncCl.assignBlobHealTasks()
+	syncCl.wg.Wait()
+
+	if atomic.LoadInt32(&rangeCount) != 1 || atomic.LoadInt32(&listCount) != 0 {
+		t.Fatalf("contiguous indexes should be requested by range, range requests %d, list requests %d",
+			atomic.LoadInt32(&rangeCount), atomic.LoadInt32(&listCount))
+	}
+	if syncCl.tasks[0].healTask.count() != 0 {
+		t.Fatalf("heal task should be done, remaining %d", syncCl.tasks[0].healTask.count())
+	}
+	healed := make(map[uint64]*BlobPayloadWithRowData)
+	for _, idx := range indexes {
+		healed[idx] = data[contract][idx]
+	}
+	verifyKVs(map[common.Address]map[uint64]*BlobPayloadWithRowData{contract: healed}, make(map[uint64]struct{}), t)
+}
+
+// TestHealCoalescesContiguousIndexes test the sync client sends the contiguous heal indexes as range requests to
+// the peer without a range preference, instead of list requests.
+func TestHealCoalescesContiguousIndexes(t *testing.T) {
+	var (
+		kvSize      = defaultChunkSize
+		kvEntries   = uint64(128)
+		lastKvIndex = uint64(128)
+		ctx, cancel = context.WithCancel(context.Background())
+		db          = rawdb.NewMemoryDatabase()
+		mux         = new(event.Feed)
+		shards      = make(map[common.Address][]uint64)
+		m           = metrics.NewMetrics("sync_test")
+		indexes     = make([]uint64, 0)
+		rangeCount  = int32(0)
+		listCount   = int32(0)
+		rollupCfg   = &rollup.EsConfig{
+			L2ChainID:       new(big.Int).SetUint64(3333),
+			MaxResponseSize: 32 * kvSize,
+		}
+	)
+	defer cancel()
+	// the indexes are served in full responses, so no run shorter than minRangeRun is left to request by list
+	for idx := uint64(10); idx < 106; idx++ {
+		indexes = append(indexes, idx)
+	}
+
+	metafile, err := CreateMetaFile(metafileName, int64(kvEntries))
+	if err != nil {
+		t.Error("Create metafileName fail", err.Error())
+	}
+	defer metafile.Close()
+
+	shardManager, files := createEthStorage(contract, []uint64{0}, defaultChunkSize, kvSize, kvEntries, common.Address{}, defaultEncodeType)
+	if shardManager == nil {
+		t.Fatalf("createEthStorage failed")
+	}
+	shards[shardManager.ContractAddress()] = shardManager.ShardIds()
+
+	defer func(files []string) {
+		for _, file := range files {
+			os.Remove(file)
+		}
+	}(files)
+
+	data := makeKVStorage(contract, []uint64{0}, defaultChunkSize, kvSize, kvEntries, lastKvIndex, common.Address{}, defaultEncodeType, metafile)
+
+	l1 := NewMockL1Source(lastKvIndex, metafileName)
+	sm := ethstorage.NewStorageManager(shardManager, l1)
+	smr := &mockStorageManagerReader{
+		kvEntries:       kvEntries,
+		maxKvSize:       kvSize,
+		encodeType:      defaultEncodeType,
+		shards:          []uint64{0},
+		contractAddress: contract,
+		shardMiner:      common.Address{},
+		blobPayloads:    data[contract],
+		lastKvIndex:     lastKvIndex,
+	}
+
+	localHost, syncCl := createLocalHostAndSyncClient(t, testLog, rollupCfg, db, sm, m, mux)
+	syncCl.loadSyncStatus()
+	sm.Reset(0)
+	err = sm.DownloadAllMetas(context.Background(), 16)
+	if err != nil {
+		t.Fatal("Download blob metadata failed", "error", err)
+		return
+	}
+
+	// create remote host without range preference, and count the requests it received
+	remoteHost := getNetHost(t)
+	syncSrv := NewSyncServer(rollupCfg, smr, db, m)
+	blobByRangeHandler := MakeStreamHandler(ctx, testLog, syncSrv.HandleGetBlobsByRangeRequest)
+	remoteHost.SetStreamHandler(GetProtocolID(RequestBlobsByRangeProtocolID, rollupCfg.L2ChainID), func(stream network.Stream) {
+		atomic.AddInt32(&rangeCount, 1)
+		blobByRangeHandler(stream)
+	})
+	blobByListHandler := MakeStreamHandler(ctx, testLog, syncSrv.HandleGetBlobsByListRequest)
+	remoteHost.SetStreamHandler(GetProtocolID(RequestBlobsByListProtocolID, rollupCfg.L2ChainID), func(stream network.Stream) {
+		atomic.AddInt32(&listCount, 1)
+		blobByListHandler(stream)
+	})
+	remoteHost.SetStreamHandler(RequestCapabilities, MakeStreamHandler(ctx, testLog, syncSrv.HandleRequestCapabilities))
+	connect(t, localHost, remoteHost, shards, shards)
+
+	time.Sleep(2 * time.Second)
+	syncCl.lock.Lock()
+	pr, ok := syncCl.peers[remoteHost.ID()]
+	if !ok || pr.preferRange {
+		syncCl.lock.Unlock()
+		t.Fatalf("peer should be added without range preference")
+	}
+	syncCl.tasks[0].healTask.insert(indexes)
+	syncCl.lock.Unlock()
+
+	// the range response is capped by the max response size, so the indexes left are retried after the request timeout
+	for i := 0; i < 5 && syncCl.tasks[0].healTask.count() != 0; i++ {
+		syncCl.assignBlobHealTasks()
+		syncCl.wg.Wait()
+		time.Sleep(requestTimeoutInMillisecond + 100*time.Millisecond)
+	}
+
+	if atomic.LoadInt32(&rangeCount) == 0 || atomic.LoadInt32(&listCount) != 0 {
+		t.Fatalf("contiguous indexes should be requested by range, range requests %d, list requests %d",
+			atomic.LoadInt32(&rangeCount), atomic.LoadInt32(&listCount))
+	}
+	if syncCl.tasks[0].healTask.count() != 0 {
+		t.Fatalf("heal task should be done, remaining %d", syncCl.tasks[0].healTask.count())
+	}
+	healed := make(map[uint64]*BlobPayloadWithRowData)
+	for _, idx := range indexes {
+		healed[idx] = data[contract][idx]
+	}
+	verifyKVs(map[common.Address]map[uint64]*BlobPayloadWithRowData{contract: healed}, make(map[uint64]struct{}), t)
+}
+
+// TestRetryAvoidsFailedPeer tests that a blob failed by a peer is retried from the other capable peer first, and it is
+// not retried from the failing peer while the other peer is busy.
+func TestRetryAvoidsFailedPeer(t *testing.T) {
+	var (
+		kvSize      = defaultChunkSize
+		kvEntries   = uint64(16)
+		lastKvIndex = uint64(16)
+		failedIdx   = uint64(5)
+		ctx, cancel = context.WithCancel(context.Background())
+		db          = rawdb.NewMemoryDatabase()
+		mux         = new(event.Feed)
+		shards      = make(map[common.Address][]uint64)
+		m           = metrics.NewMetrics("sync_test")
+		rollupCfg   = &rollup.EsConfig{
+			L2ChainID: new(big.Int).SetUint64(3333),
+		}
+	)
+	defer cancel()
+
+	metafile, err := CreateMetaFile(metafileName, int64(kvEntries))
+	if err != nil {
+		t.Error("Create metafileName fail", err.Error())
+	}
+	defer metafile.Close()
+
+	shardManager, files := createEthStorage(contract, []uint64{0}, defaultChunkSize, kvSize, kvEntries, common.Address{}, defaultEncodeType)
+	if shardManager == nil {
+		t.Fatalf("createEthStorage failed")
+	}
+	shards[shardManager.ContractAddress()] = shardManager.ShardIds()
+
+	defer func(files []string) {
+		for _, file := range files {
+			os.Remove(file)
+		}
+	}(files)
+
+	data := makeKVStorage(contract, []uint64{0}, defaultChunkSize, kvSize, kvEntries, lastKvIndex, common.Address{}, defaultEncodeType, metafile)
+
+	l1 := NewMockL1Source(lastKvIndex, metafileName)
+	sm := ethstorage.NewStorageManager(shardManager, l1)
+	localHost, syncCl := createLocalHostAndSyncClient(t, testLog, rollupCfg, db, sm, m, mux)
+	syncCl.loadSyncStatus()
+	sm.Reset(0)
+	if err := sm.DownloadAllMetas(context.Background(), 16); err != nil {
+		t.Fatal("Download blob metadata failed", "error", err)
+	}
+
+	// peer a misses the failed blob, while peer b has all the blobs
+	smrs := make([]*mockStorageManagerReader, 2)
+	hosts := make([]host.Host, 2)
+	for i := range smrs {
+		excluded := make(map[uint64]struct{})
+		if i == 0 {
+			excluded[failedIdx] = struct{}{}
+		}
+		smrs[i] = &mockStorageManagerReader{
+			kvEntries:       kvEntries,
+			maxKvSize:       kvSize,
+			encodeType:      defaultEncodeType,
+			shards:          []uint64{0},
+			contractAddress: contract,
+			shardMiner:      common.Address{},
+			blobPayloads:    copyShardData(data[contract], []uint64{0}, kvEntries, excluded),
+		}
+		hosts[i] = createRemoteHost(t, ctx, rollupCfg, smrs[i], db, m, testLog)
+		connect(t, localHost, hosts[i], shards, shards)
+	}
+	a, b := hosts[0].ID(), hosts[1].ID()
+	for start := time.Now(); ; time.Sleep(100 * time.Millisecond) {
+		syncCl.lock.Lock()
+		_, aIdle := syncCl.idlerPeers[a]
+		_, bIdle := syncCl.idlerPeers[b]
+		syncCl.lock.Unlock()
+		if aIdle && bIdle {
+			break
+		}
+		if time.Since(start) > 5*time.Second {
+			t.Fatalf("peers should be idle")
+		}
+	}
+
+	// only peer a is idle, it fails the blob and delivers the other one
+	syncCl.lock.Lock()
+	delete(syncCl.idlerPeers, b)
+	syncCl.tasks[0].healTask.insert([]uint64{failedIdx, failedIdx + 1})
+	syncCl.lock.Unlock()
+	syncCl.assignBlobHealTasks()
+	syncCl.wg.Wait()
+	if _, ok := smrs[0].readIdxs.Load(failedIdx); !ok {
+		t.Fatalf("blob %d should be requested from peer a", failedIdx)
+	}
+	if id, ok := syncCl.tasks[0].healTask.lastFailed(failedIdx); !ok || id != a {
+		t.Fatalf("blob %d should be last failed by peer a, real %s", failedIdx, id)
+	}
+	reads := smrs[0].reads.Load()
+
+	// peer b is busy, so the failed blob is not retried from peer a
+	time.Sleep(requestTimeoutInMillisecond + 100*time.Millisecond)
+	syncCl.assignBlobHealTasks()
+	syncCl.wg.Wait()
+	if smrs[0].reads.Load() != reads {
+		t.Fatalf("blob %d should not be retried from peer a before peer b", failedIdx)
+	}
+
+	// peer b becomes idle, and the failed blob is retried from it
+	syncCl.lock.Lock()
+	syncCl.idlerPeers[b] = struct{}{}
+	syncCl.lock.Unlock()
+	syncCl.assignBlobHealTasks()
+	syncCl.wg.Wait()
+	if _, ok := smrs[1].readIdxs.Load(failedIdx); !ok {
+		t.Fatalf("blob %d should be retried from peer b", failedIdx)
+	}
+	if smrs[0].reads.Load() != reads {
+		t.Fatalf("blob %d should be retried from peer b before peer a", failedIdx)
+	}
+	if syncCl.tasks[0].healTask.count() != 0 {
+		t.Fatalf("heal task should be done, remaining %d", syncCl.tasks[0].healTask.count())
+	}
+	verifyKVs(map[common.Address]map[uint64]*BlobPayloadWithRowData{contract: {failedIdx: data[contract][failedIdx]}},
+		make(map[uint64]struct{}), t)
+}
+
+// TestHealCommitMismatch tests that a blob mismatching its commit from a peer is added to the heal task and counted
+// as a commit mismatch of the peer, and that it is healed from the other peer delivering the correct blob.
+func TestHealCommitMismatch(t *testing.T) {
+	var (
+		kvSize      = defaultChunkSize
+		kvEntries   = uint64(16)
+		lastKvIndex = uint64(16)
+		badIdx      = uint64(5)
+		ctx, cancel = context.WithCancel(context.Background())
+		db          = rawdb.NewMemoryDatabase()
+		mux         = new(event.Feed)
+		shards      = make(map[common.Address][]uint64)
+		m           = metrics.NewMetrics("sync_test")
+		rollupCfg   = &rollup.EsConfig{
+			L2ChainID: new(big.Int).SetUint64(3333),
+		}
+	)
+	defer cancel()
+
+	metafile, err := CreateMetaFile(metafileName, int64(kvEntries))
+	if err != nil {
+		t.Error("Create metafileName fail", err.Error())
+	}
+	defer metafile.Close()
+
+	shardManager, files := createEthStorage(contract, []uint64{0}, defaultChunkSize, kvSize, kvEntries, common.Address{}, defaultEncodeType)
+	if shardManager == nil {
+		t.Fatalf("createEthStorage failed")
+	}
+	shards[shardManager.ContractAddress()] = shardManager.ShardIds()
+
+	defer func(files []string) {
+		for _, file := range files {
+			os.Remove(file)
+		}
+	}(files)
+
+	data := makeKVStorage(contract, []uint64{0}, defaultChunkSize, kvSize, kvEntries, lastKvIndex, common.Address{}, defaultEncodeType, metafile)
+
+	l1 := NewMockL1Source(lastKvIndex, metafileName)
+	sm := ethstorage.NewStorageManager(shardManager, l1)
+	localHost, syncCl := createLocalHostAndSyncClient(t, testLog, rollupCfg, db, sm, m, mux)
+	syncCl.loadSyncStatus()
+	sm.Reset(0)
+	if err := sm.DownloadAllMetas(context.Background(), 16); err != nil {
+		t.Fatal("Download blob metadata failed", "error", err)
+	}
+
+	// peer a delivers a corrupted blob of badIdx, while peer b delivers the correct one
+	smrs := make([]*mockStorageManagerReader, 2)
+	hosts := make([]host.Host, 2)
+	for i := range smrs {
+		payloads := copyShardData(data[contract], []uint64{0}, kvEntries, make(map[uint64]struct{}))
+		if i == 0 {
+			corrupted := *payloads[badIdx]
+			corrupted.EncodedBlob = bytes.Clone(corrupted.EncodedBlob)
+			corrupted.EncodedBlob[0] ^= 0xff
+			payloads[badIdx] = &corrupted
+		}
+		smrs[i] = &mockStorageManagerReader{
+			kvEntries:       kvEntries,
+			maxKvSize:       kvSize,
+			encodeType:      defaultEncodeType,
+			shards:          []uint64{0},
+			contractAddress: contract,
+			shardMiner:      common.Address{},
+			blobPayloads:    payloads,
+		}
+		hosts[i] = createRemoteHost(t, ctx, rollupCfg, smrs[i], db, m, testLog)
+		connect(t, localHost, hosts[i], shards, shards)
+	}
+	a, b := hosts[0].ID(), hosts[1].ID()
+	for start := time.Now(); ; time.Sleep(100 * time.Millisecond) {
+		syncCl.lock.Lock()
+		_, aIdle := syncCl.idlerPeers[a]
+		_, bIdle := syncCl.idlerPeers[b]
+		syncCl.lock.Unlock()
+		if aIdle && bIdle {
+			break
+		}
+		if time.Since(start) > 5*time.Second {
+			t.Fatalf("peers should be idle")
+		}
+	}
+
+	// only peer a is idle, so the blob is requested from it and mismatches its commit
+	syncCl.lock.Lock()
+	delete(syncCl.idlerPeers, b)
+	syncCl.tasks[0].healTask.insert([]uint64{badIdx})
+	syncCl.lock.Unlock()
+	syncCl.assignBlobHealTasks()
+	syncCl.wg.Wait()
+	if _, ok := smrs[0].readIdxs.Load(badIdx); !ok {
+		t.Fatalf("blob %d should be requested from peer a", badIdx)
+	}
+	syncCl.lock.Lock()
+	_, queued := syncCl.tasks[0].healTask.Indexes[badIdx]
+	failedBy, _ := syncCl.tasks[0].healTask.lastFailed(badIdx)
+	syncCl.lock.Unlock()
+	if !queued || failedBy != a {
+		t.Fatalf("mismatched blob %d should be healed avoiding peer a, queued %v, last failed by %s", badIdx, queued, failedBy)
+	}
+	if mismatches := testutil.ToFloat64(m.SyncClientCommitMismatchesTotal.WithLabelValues(a.String())); mismatches != 1 {
+		t.Fatalf("commit mismatches of peer a should be 1, real %v", mismatches)
+	}
+	reads := smrs[0].reads.Load()
+
+	// both peers are idle, and the blob is healed from peer b
+	syncCl.lock.Lock()
+	syncCl.idlerPeers[b] = struct{}{}
+	syncCl.lock.Unlock()
+	syncCl.assignBlobHealTasks()
+	syncCl.wg.Wait()
+	if _, ok := smrs[1].readIdxs.Load(badIdx); !ok {
+		t.Fatalf("blob %d should be healed from peer b", badIdx)
+	}
+	if smrs[0].reads.Load() != reads {
+		t.Fatalf("blob %d should not be retried from peer a", badIdx)
+	}
+	if syncCl.tasks[0].healTask.count() != 0 {
+		t.Fatalf("heal task should be done, remaining %d", syncCl.tasks[0].healTask.count())
+	}
+	if mismatches := testutil.ToFloat64(m.SyncClientCommitMismatchesTotal.WithLabelValues(b.String())); mismatches != 0 {
+		t.Fatalf("commit mismatches of peer b should be 0, real %v", mismatches)
+	}
+	verifyKVs(map[common.Address]map[uint64]*BlobPayloadWithRowData{contract: {badIdx: data[contract][badIdx]}},
+		make(map[uint64]struct{}), t)
+}
+
+// TestSyncRange test SyncRange only syncs the blobs in the requested range of the shard
+// and sends RangeSynced event when it is done.
+func TestSyncRange(t *testing.T) {
+	var (
+		kvSize      = defaultChunkSize
+		kvEntries   = uint64(32)
+		lastKvIndex = uint64(32)
+		first       = uint64(10)
+		last        = uint64(20)
+		ctx, cancel = context.WithCancel(context.Background())
+		db          = rawdb.NewMemoryDatabase()
+		mux         = new(event.Feed)
+		shards      = make(map[common.Address][]uint64)
+		m           = metrics.NewMetrics("sync_test")
+		rollupCfg   = &rollup.EsConfig{
+			L2ChainID: new(big.Int).SetUint64(3333),
+		}
+	)
+	defer cancel()
+
+	metafile, err := CreateMetaFile(metafileName, int64(kvEntries))
+	if err != nil {
+		t.Error("Create metafileName fail", err.Error())
+	}
+	defer metafile.Close()
+
+	shardManager, files := createEthStorage(contract, []uint64{0}, defaultChunkSize, kvSize, kvEntries, common.Address{}, defaultEncodeType)
+	if shardManager == nil {
+		t.Fatalf("createEthStorage failed")
+	}
+	shards[shardManager.ContractAddress()] = shardManager.ShardIds()
+
+	defer func(files []string) {
+		for _, file := range files {
+			os.Remove(file)
+		}
+	}(files)
+
+	data := makeKVStorage(contract, []uint64{0}, defaultChunkSize, kvSize, kvEntries, lastKvIndex, common.Address{}, defaultEncodeType, metafile)
+
+	l1 := NewMockL1Source(lastKvIndex, metafileName)
+	sm := ethstorage.NewStorageManager(shardManager, l1)
+	smr := &mockStorageManagerReader{
+		kvEntries:       kvEntries,
+		maxKvSize:       kvSize,
+		encodeType:      defaultEncodeType,
+		shards:          []uint64{0},
+		contractAddress: contract,
+		shardMiner:      common.Address{},
+		blobPayloads:    data[contract],
+	}
+
+	localHost, syncCl := createLocalHostAndSyncClient(t, testLog, rollupCfg, db, sm, m, mux)
+	sm.Reset(0)
+	err = sm.DownloadAllMetas(context.Background(), 16)
+	if err != nil {
+		t.Fatal("Download blob metadata failed", "error", err)
+		return
+	}
+	remoteHost := createRemoteHost(t, ctx, rollupCfg, smr, db, m, testLog)
+
+	if err := syncCl.SyncRange(contract, 1, first, last); err == nil {
+		t.Fatalf("sync range of unsupported shard should fail")
+	}
+	if err := syncCl.SyncRange(contract, 0, last, first); err == nil {
+		t.Fatalf("sync invalid range should fail")
+	}
+
+	rangeCh := make(chan RangeSynced, 16)
+	events := syncCl.SubscribeRangeSynced(rangeCh)
+	defer events.Unsubscribe()
+	if err := syncCl.SyncRange(contract, 0, first, last); err != nil {
+		t.Fatalf("sync range failed: %s", err.Error())
+	}
+	// the client is not started, so the peer is needed by the range task only
+	connect(t, localHost, remoteHost, shards, shards)
+	select {
+	case <-time.After(30 * time.Second):
+		t.Fatalf("sync range timeout")
+	case ev := <-rangeCh:
+		if ev.Contract != contract || ev.ShardId != 0 || ev.First != first || ev.Last != last {
+			t.Fatalf("unexpected range synced event %v", ev)
+		}
+	}
+
+	synced := make(map[uint64]*BlobPayloadWithRowData)
+	for idx := first; idx <= last; idx++ {
+		synced[idx] = data[contract][idx]
+	}
+	verifyKVs(map[common.Address]map[uint64]*BlobPayloadWithRowData{contract: synced}, make(map[uint64]struct{}), t)
+	for idx := uint64(0); idx < kvEntries; idx++ {
+		if idx >= first && idx <= last {
+			continue
+		}
+		meta, success, err := sm.TryReadMeta(idx)
+		if !success || err != nil {
+			t.Fatalf("read meta of kv %d failed: %v", idx, err)
+		}
+		if common.BytesToHash(meta) != (common.Hash{}) {
+			t.Fatalf("kv %d out of the range should not be written", idx)
+		}
+	}
+}
+
+// TestForceResync test ForceResync overwrites a local blob which is corrupted while its metadata still matches,
+// which SyncRange skips as it is synced already.
+func TestForceResync(t *testing.T) {
+	var (
+		kvSize      = defaultChunkSize
+		kvEntries   = uint64(16)
+		lastKvIndex = uint64(16)
+		first       = uint64(2)
+		last        = uint64(6)
+		corrupt     = uint64(4)
+		ctx, cancel = context.WithCancel(context.Background())
+		db          = rawdb.NewMemoryDatabase()
+		mux         = new(event.Feed)
+		shards      = make(map[common.Address][]uint64)
+		m           = metrics.NewMetrics("sync_test")
+		rollupCfg   = &rollup.EsConfig{
+			L2ChainID: new(big.Int).SetUint64(3333),
+		}
+	)
+	defer cancel()
+
+	metafile, err := CreateMetaFile(metafileName, int64(kvEntries))
+	if err != nil {
+		t.Error("Create metafileName fail", err.Error())
+	}
+	defer metafile.Close()
+
+	shardManager, files := createEthStorage(contract, []uint64{0}, defaultChunkSize, kvSize, kvEntries, common.Address{}, defaultEncodeType)
+	if shardManager == nil {
+		t.Fatalf("createEthStorage failed")
+	}
+	shards[shardManager.ContractAddress()] = shardManager.ShardIds()
+
+	defer func(files []string) {
+		for _, file := range files {
+			os.Remove(file)
+		}
+	}(files)
+
+	data := makeKVStorage(contract, []uint64{0}, defaultChunkSize, kvSize, kvEntries, lastKvIndex, common.Address{}, defaultEncodeType, metafile)
+
+	l1 := NewMockL1Source(lastKvIndex, metafileName)
+	sm := ethstorage.NewStorageManager(shardManager, l1)
+	smr := &mockStorageManagerReader{
+		kvEntries:       kvEntries,
+		maxKvSize:       kvSize,
+		encodeType:      defaultEncodeType,
+		shards:          []uint64{0},
+		contractAddress: contract,
+		shardMiner:      common.Address{},
+		blobPayloads:    data[contract],
+	}
+
+	localHost, syncCl := createLocalHostAndSyncClient(t, testLog, rollupCfg, db, sm, m, mux)
+	sm.Reset(0)
+	err = sm.DownloadAllMetas(context.Background(), 16)
+	if err != nil {
+		t.Fatal("Download blob metadata failed", "error", err)
+		return
+	}
+	remoteHost := createRemoteHost(t, ctx, rollupCfg, smr, db, m, testLog)
+
+	rangeCh := make(chan RangeSynced, 16)
+	events := syncCl.SubscribeRangeSynced(rangeCh)
+	defer events.Unsubscribe()
+	waitRangeSynced := func(sync func(common.Address, uint64, uint64, uint64) error, first, last uint64) {
+		if err := sync(contract, 0, first, last); err != nil {
+			t.Fatalf("sync range failed: %s", err.Error())
+		}
+		// the client is not started, so the peer is needed by the range task only
+		connect(t, localHost, remoteHost, shards, shards)
+		select {
+		case <-time.After(30 * time.Second):
+			t.Fatalf("sync range timeout")
+		case ev := <-rangeCh:
+			if ev.First != first || ev.Last != last {
+				t.Fatalf("unexpected range synced event %v", ev)
+			}
+		}
+	}
+	waitRangeSynced(syncCl.SyncRange, first, last)
+
+	// corrupt the local blob and keep its metadata, so it still passes the metadata checks
+	meta, success, err := sm.TryReadMeta(corrupt)
+	if !success || err != nil {
+		t.Fatalf("read meta of kv %d failed: %v", corrupt, err)
+	}
+	garbage := bytes.Repeat([]byte{0xab}, int(kvSize))
+	if _, err := shardManager.TryWriteEncoded(corrupt, garbage, common.BytesToHash(meta)); err != nil {
+		t.Fatalf("corrupt kv %d failed: %s", corrupt, err.Error())
+	}
+	isCorrupted := func() bool {
+		encoded, _, err := shardManager.TryReadEncoded(corrupt, int(kvSize))
+		if err != nil {
+			t.Fatalf("read encoded kv %d failed: %s", corrupt, err.Error())
+		}
+		return bytes.Equal(encoded, garbage)
+	}
+
+	waitRangeSynced(syncCl.SyncRange, corrupt, corrupt)
+	if !isCorrupted() {
+		t.Fatalf("sync range should skip kv %d synced already", corrupt)
+	}
+
+	waitRangeSynced(syncCl.ForceResync, corrupt, corrupt)
+	if isCorrupted() {
+		t.Fatalf("force resync should overwrite the corrupted kv %d", corrupt)
+	}
+	synced := make(map[uint64]*BlobPayloadWithRowData)
+	for idx := first; idx <= last; idx++ {
+		synced[idx] = data[contract][idx]
+	}
+	verifyKVs(map[common.Address]map[uint64]*BlobPayloadWithRowData{contract: synced}, make(map[uint64]struct{}), t)
+}
+
+// TestPeerReconnect tests that a peer rapidly removed and added again, as by the racing notifications of a reconnect,
+// is registered once with the tasks counting it once, and that the requests in flight to the removed peers do not
+// leak the in-flight counter.
+func TestPeerReconnect(t *testing.T) {
+	var (
+		kvSize      = defaultChunkSize
+		kvEntries   = uint64(64)
+		lastKvIndex = uint64(64)
+		reconnects  = 20
+		ctx, cancel = context.WithCancel(context.Background())
+		db          = rawdb.NewMemoryDatabase()
+		mux         = new(event.Feed)
+		shards      = make(map[common.Address][]uint64)
+		m           = metrics.NewMetrics("sync_test")
+		rollupCfg   = &rollup.EsConfig{
+			L2ChainID: new(big.Int).SetUint64(3333),
+		}
+	)
+	defer cancel()
+
+	metafile, err := CreateMetaFile(metafileName, int64(kvEntries))
+	if err != nil {
+		t.Error("Create metafileName fail", err.Error())
+	}
+	defer metafile.Close()
+
+	shardManager, files := createEthStorage(contract, []uint64{0}, defaultChunkSize, kvSize, kvEntries, common.Address{}, defaultEncodeType)
+	if shardManager == nil {
+		t.Fatalf("createEthStorage failed")
+	}
+	shards[shardManager.ContractAddress()] = shardManager.ShardIds()
+
+	defer func(files []string) {
+		for _, file := range files {
+			os.Remove(file)
+		}
+	}(files)
+
+	data := makeKVStorage(contract, []uint64{0}, defaultChunkSize, kvSize, kvEntries, lastKvIndex, common.Address{}, defaultEncodeType, metafile)
+
+	l1 := NewMockL1Source(lastKvIndex, metafileName)
+	sm := ethstorage.NewStorageManager(shardManager, l1)
+	sm.Reset(0)
+	smr := &mockStorageManagerReader{
+		kvEntries:       kvEntries,
+		maxKvSize:       kvSize,
+		encodeType:      defaultEncodeType,
+		shards:          []uint64{0},
+		contractAddress: contract,
+		shardMiner:      common.Address{},
+		blobPayloads:    data[contract],
+	}
+
+	localHost, syncCl := createLocalHostAndSyncClient(t, testLog, rollupCfg, db, sm, m, mux)
+	syncCl.Start()
+	remoteHost := createRemoteHost(t, ctx, rollupCfg, smr, db, m, testLog)
+	connect(t, localHost, remoteHost, shards, shards)
+
+	id := remoteHost.ID()
+	for i := 0; i < reconnects; i++ {
+		var wg sync.WaitGroup
+		wg.Add(2)
+		go func() {
+			defer wg.Done()
+			syncCl.RemovePeer(id)
+		}()
+		go func() {
+			defer wg.Done()
+			syncCl.AddPeer(id, shards, network.DirOutbound)
+		}()
+		wg.Wait()
+		time.Sleep(5 * time.Millisecond)
+	}
+	if !syncCl.AddPeer(id, shards, network.DirOutbound) {
+		t.Fatalf("failed to add peer %s again", id)
+	}
+
+	checkStall(t, 30, mux, cancel)
+	for start := time.Now(); ; time.Sleep(10 * time.Millisecond) {
+		syncCl.lock.Lock()
+		inFlight := syncCl.inFlight
+		syncCl.lock.Unlock()
+		if inFlight == 0 {
+			break
+		}
+		if time.Since(start) > 5*time.Second {
+			t.Fatalf("in-flight counter leaked: %d", inFlight)
+		}
+	}
+
+	syncCl.lock.Lock()
+	peers, peerCount := len(syncCl.peers), syncCl.tasks[0].state.PeerCount
+	_, registered := syncCl.peers[id]
+	syncDone := syncCl.syncDone
+	syncCl.lock.Unlock()
+	if !syncDone {
+		t.Fatalf("sync should be done after the peer reconnects")
+	}
+	if peers != 1 || !registered {
+		t.Fatalf("peer %s should be registered once, peers %d", id, peers)
+	}
+	if peerCount != 1 {
+		t.Fatalf("task should count the peer once, peer count %d", peerCount)
+	}
+	verifyKVs(data, make(map[uint64]struct{}), t)
+}
+
+// diskFullStorageManager is a storage manager whose commits of the blobs fail with ethstorage.ErrDiskFull while the
+// disk is reported low on space.
+type diskFullStorageManager struct {
+	StorageManager
+	lowSpace atomic.Bool
+}
+
+func (sm *diskFullStorageManager) CommitBlobs(kvIndices []uint64, blobs [][]byte, commits []common.Hash) ([]uint64, error) {
+	if sm.lowSpace.Load() {
+		return nil, ethstorage.ErrDiskFull
+	}
+	return sm.StorageManager.CommitBlobs(kvIndices, blobs, commits)
+}
+
+// TestDiskFullPausesShard tests that the sync of a shard is paused with a DiskFull event once the storage reports low
+// disk space, so no more requests are dispatched for the shard, and that the shard is synced once it is resumed after
+// the disk space is freed.
+func TestDiskFullPausesShard(t *testing.T) {
+	var (
+		kvSize      = defaultChunkSize
+		kvEntries   = uint64(16)
+		lastKvIndex = uint64(16)
+		ctx, cancel = context.WithCancel(context.Background())
+		db          = rawdb.NewMemoryDatabase()
+		mux         = new(event.Feed)
+		shards      = make(map[common.Address][]uint64)
+		m           = metrics.NewMetrics("sync_test")
+		rollupCfg   = &rollup.EsConfig{
+			L2ChainID: new(big.Int).SetUint64(3333),
+		}
+	)
+	defer cancel()
+
+	metafile, err := CreateMetaFile(metafileName, int64(kvEntries))
+	if err != nil {
+		t.Error("Create metafileName fail", err.Error())
+	}
+	defer metafile.Close()
+
+	shardManager, files := createEthStorage(contract, []uint64{0}, defaultChunkSize, kvSize, kvEntries, common.Address{}, defaultEncodeType)
+	if shardManager == nil {
+		t.Fatalf("createEthStorage failed")
+	}
+	shards[shardManager.ContractAddress()] = shardManager.ShardIds()
+
+	defer func(files []string) {
+		for _, file := range files {
+			os.Remove(file)
+		}
+	}(files)
+
+	data := makeKVStorage(contract, []uint64{0}, defaultChunkSize, kvSize, kvEntries, lastKvIndex, common.Address{}, defaultEncodeType, metafile)
+
+	l1 := NewMockL1Source(lastKvIndex, metafileName)
+	esm := ethstorage.NewStorageManager(shardManager, l1)
+	esm.Reset(0)
+	sm := &diskFullStorageManager{StorageManager: esm}
+	sm.lowSpace.Store(true)
+	smr := &mockStorageManagerReader{
+		kvEntries:       kvEntries,
+		maxKvSize:       kvSize,
+		encodeType:      defaultEncodeType,
+		shards:          []uint64{0},
+		contractAddress: contract,
+		shardMiner:      common.Address{},
+		blobPayloads:    data[contract],
+	}
+
+	localHost, syncCl := createLocalHostAndSyncClient(t, testLog, rollupCfg, db, sm, m, mux)
+	diskFullCh := make(chan DiskFull, 4)
+	sub := syncCl.SubscribeDiskFull(diskFullCh)
+	defer sub.Unsubscribe()
+	syncCl.Start()
+	remoteHost := createRemoteHost(t, ctx, rollupCfg, smr, db, m, testLog)
+	connect(t, localHost, remoteHost, shards, shards)
+
+	select {
+	case ev := <-diskFullCh:
+		if ev.Contract != contract || ev.ShardId != 0 {
+			t.Fatalf("unexpected disk full event %v", ev)
+		}
+	case <-time.After(30 * time.Second):
+		t.Fatalf("shard should be paused with a disk full event")
+	}
+
+	// the requests in flight are drained, and no more request is dispatched for the paused shard
+	inFlight := func() int {
+		syncCl.lock.Lock()
+		defer syncCl.lock.Unlock()
+		return syncCl.inFlight
+	}
+	for start := time.Now(); inFlight() > 0; time.Sleep(10 * time.Millisecond) {
+		if time.Since(start) > 5*time.Second {
+			t.Fatalf("requests in flight are not drained: %d", inFlight())
+		}
+	}
+	time.Sleep(time.Second)
+	syncCl.lock.Lock()
+	paused, syncDone := syncCl.tasks[0].diskFull, syncCl.syncDone
+	syncCl.lock.Unlock()
+	if !paused || syncDone {
+		t.Fatalf("shard should be paused, paused %v, sync done %v", paused, syncDone)
+	}
+	if n := inFlight(); n != 0 {
+		t.Fatalf("requests are dispatched for the paused shard: %d", n)
+	}
+
+	sm.lowSpace.Store(false)
+	if err := syncCl.ResumeShard(contract, 0); err != nil {
+		t.Fatalf("failed to resume shard: %s", err.Error())
+	}
+	if err := syncCl.ResumeShard(contract, 0); err == nil {
+		t.Fatalf("resume should fail once the shard is not paused")
+	}
+	checkStall(t, 30, mux, cancel)
+	if !syncCl.syncDone {
+		t.Fatalf("sync should be done once the shard is resumed")
+	}
+	verifyKVs(data, make(map[uint64]struct{}), t)
+}
+
+// TestFillEmptyDiskFullPausesShard tests that filling the empty blobs of a shard pauses the shard with a DiskFull
+// event once the storage reports low disk space, and that the empty blobs are filled once it is resumed after the
+// disk space is freed.
+func TestFillEmptyDiskFullPausesShard(t *testing.T) {
+	var (
+		kvSize      = defaultChunkSize
+		kvEntries   = uint64(16)
+		lastKvIndex = uint64(0)
+		db          = rawdb.NewMemoryDatabase()
+		mux         = new(event.Feed)
+		shards      = []uint64{0}
+		rollupCfg   = &rollup.EsConfig{
+			L2ChainID: new(big.Int).SetUint64(3333),
+		}
+	)
+
+	metafile, err := CreateMetaFile(metafileName, int64(kvEntries))
+	if err != nil {
+		t.Error("Create metafileName fail", err.Error())
+	}
+	defer metafile.Close()
+
+	shardManager, files := createEthStorage(contract, shards, defaultChunkSize, kvSize, kvEntries, common.Address{}, defaultEncodeType)
+	if shardManager == nil {
+		t.Fatalf("createEthStorage failed")
+	}
+	defer func(files []string) {
+		for _, file := range files {
+			os.Remove(file)
+		}
+	}(files)
+
+	makeKVStorage(contract, shards, defaultChunkSize, kvSize, kvEntries, lastKvIndex, common.Address{}, defaultEncodeType, metafile)
+
+	// no disk has the free space required, so all the writes fail with ethstorage.ErrDiskFull
+	shardManager.SetMinFreeDisk(math.MaxUint64)
+	sm := ethstorage.NewStorageManager(shardManager, NewMockL1Source(lastKvIndex, metafileName))
+	sm.Reset(0)
+	syncCl := NewSyncClient(testLog, rollupCfg, nil, sm, &params, db, nil, mux)
+	diskFullCh := make(chan DiskFull, 4)
+	sub := syncCl.SubscribeDiskFull(diskFullCh)
+	defer sub.Unsubscribe()
+	dlEventCh := make(chan EthStorageSyncDone, 16)
+	events := mux.Subscribe(dlEventCh)
+	defer events.Unsubscribe()
+	syncCl.Start()
+	defer syncCl.Close()
+
+	select {
+	case ev := <-diskFullCh:
+		if ev.Contract != contract || ev.ShardId != 0 {
+			t.Fatalf("unexpected disk full event %v", ev)
+		}
+	case <-time.After(30 * time.Second):
+		t.Fatalf("shard should be paused with a disk full event")
+	}
+
+	// the running fill empty workers are drained, and no more empty blob is filled for the paused shard
+	running := func() int {
+		syncCl.lock.Lock()
+		defer syncCl.lock.Unlock()
+		return syncCl.runningFillEmptyTaskTreads
+	}
+	for start := time.Now(); running() > 0; time.Sleep(10 * time.Millisecond) {
+		if time.Since(start) > 5*time.Second {
+			t.Fatalf("fill empty workers are not drained: %d", running())
+		}
+	}
+	time.Sleep(time.Second)
+	syncCl.lock.Lock()
+	paused, filled, workers := syncCl.tasks[0].diskFull, syncCl.tasks[0].state.EmptyFilled, syncCl.runningFillEmptyTaskTreads
+	syncCl.lock.Unlock()
+	if !paused || filled != 0 || workers != 0 {
+		t.Fatalf("shard should be paused, paused %v, filled %d, running workers %d", paused, filled, workers)
+	}
+
+	shardManager.SetMinFreeDisk(0)
+	if err := syncCl.ResumeShard(contract, 0); err != nil {
+		t.Fatalf("failed to resume shard: %s", err.Error())
+	}
+	for done := false; !done; {
+		select {
+		case <-time.After(30 * time.Second):
+			t.Fatalf("fill empty timeout once the shard is resumed")
+		case ev := <-dlEventCh:
+			done = ev.DoneType == AllShardDone
+		}
+	}
+	syncCl.lock.Lock()
+	filled = syncCl.tasks[0].state.EmptyFilled
+	syncCl.lock.Unlock()
+	if filled != kvEntries {
+		t.Fatalf("emptyBlobsFilled is wrong, expect %d, value %d", kvEntries, filled)
+	}
+}
+
+// recordingTracer records the spans started, each with the span in the ctx it is started with as its parent.
+type recordingTracer struct {
+	lock  sync.Mutex
+	spans []*recordedSpan
+}
+
+type recordedSpan struct {
+	tracer *recordingTracer
+	name   string
+	parent *recordedSpan
+	attrs  map[string]any
+	err    error
+	ended  bool
+}
+
+type recordedSpanKey struct{}
+
+func (tr *recordingTracer) Start(ctx context.Context, name string, attrs ...SpanAttribute) (context.Context, Span) {
+	parent, _ := ctx.Value(recordedSpanKey{}).(*recordedSpan)
+	span := &recordedSpan{tracer: tr, name: name, parent: parent, attrs: make(map[string]any)}
+	span.SetAttributes(attrs...)
+	tr.lock.Lock()
+	tr.spans = append(tr.spans, span)
+	tr.lock.Unlock()
+	return context.WithValue(ctx, recordedSpanKey{}, span), span
+}
+
+func (sp *recordedSpan) SetAttributes(attrs ...SpanAttribute) {
+	sp.tracer.lock.Lock()
+	defer sp.tracer.lock.Unlock()
+	for _, attr := range attrs {
+		sp.attrs[attr.Key] = attr.Value
+	}
+}
+
+func (sp *recordedSpan) RecordError(err error) {
+	sp.tracer.lock.Lock()
+	defer sp.tracer.lock.Unlock()
+	sp.err = err
+}
+
+func (sp *recordedSpan) End() {
+	sp.tracer.lock.Lock()
+	defer sp.tracer.lock.Unlock()
+	sp.ended = true
+}
+
+// TestTracerSpans tests that the sync of a single blob is traced by a request span with the peer and the range
+// attributes, whose children are the round trip, the decode and the verify of the blob, and the commit spans.
+func TestTracerSpans(t *testing.T) {
+	var (
+		kvSize      = defaultChunkSize
+		kvEntries   = uint64(16)
+		lastKvIndex = uint64(16)
+		kvIdx       = uint64(3)
+		ctx, cancel = context.WithCancel(context.Background())
+		db          = rawdb.NewMemoryDatabase()
+		mux         = new(event.Feed)
+		shards      = make(map[common.Address][]uint64)
+		m           = metrics.NewMetrics("sync_test")
+		tracer      = new(recordingTracer)
+		rollupCfg   = &rollup.EsConfig{
+			L2ChainID: new(big.Int).SetUint64(3333),
+		}
+	)
+	defer cancel()
+
+	metafile, err := CreateMetaFile(metafileName, int64(kvEntries))
+	if err != nil {
+		t.Error("Create metafileName fail", err.Error())
+	}
+	defer metafile.Close()
+
+	shardManager, files := createEthStorage(contract, []uint64{0}, defaultChunkSize, kvSize, kvEntries, common.Address{}, defaultEncodeType)
+	if shardManager == nil {
+		t.Fatalf("createEthStorage failed")
+	}
+	shards[shardManager.ContractAddress()] = shardManager.ShardIds()
+
+	defer func(files []string) {
+		for _, file := range files {
+			os.Remove(file)
+		}
+	}(files)
+
+	data := makeKVStorage(contract, []uint64{0}, defaultChunkSize, kvSize, kvEntries, lastKvIndex, common.Address{}, defaultEncodeType, metafile)
+
+	l1 := NewMockL1Source(lastKvIndex, metafileName)
+	sm := ethstorage.NewStorageManager(shardManager, l1)
+	smr := &mockStorageManagerReader{
+		kvEntries:       kvEntries,
+		maxKvSize:       kvSize,
+		encodeType:      defaultEncodeType,
+		shards:          []uint64{0},
+		contractAddress: contract,
+		shardMiner:      common.Address{},
+		blobPayloads:    data[contract],
+	}
+
+	localHost, syncCl := createLocalHostAndSyncClient(t, testLog, rollupCfg, db, sm, m, mux)
+	syncCl.SetTracer(tracer)
+	sm.Reset(0)
+	if err := sm.DownloadAllMetas(context.Background(), 16); err != nil {
+		t.Fatal("Download blob metadata failed", "error", err)
+	}
+	remoteHost := createRemoteHost(t, ctx, rollupCfg, smr, db, m, testLog)
+
+	rangeCh := make(chan RangeSynced, 16)
+	events := syncCl.SubscribeRangeSynced(rangeCh)
+	defer events.Unsubscribe()
+	if err := syncCl.SyncRange(contract, 0, kvIdx, kvIdx); err != nil {
+		t.Fatalf("sync range failed: %s", err.Error())
+	}
+	// the client is not started, so the peer is needed by the range task only
+	connect(t, localHost, remoteHost, shards, shards)
+	select {
+	case <-time.After(30 * time.Second):
+		t.Fatalf("sync range timeout")
+	case <-rangeCh:
+	}
+
+	// the request span ends once its response is processed, which may be after the range is done
+	var root *recordedSpan
+	for start := time.Now(); ; time.Sleep(10 * time.Millisecond) {
+		tracer.lock.Lock()
+		for _, span := range tracer.spans {
+			if span.name == spanRequestRange && span.ended {
+				root = span
+			}
+		}
+		tracer.lock.Unlock()
+		if root != nil {
+			break
+		}
+		if time.Since(start) > 5*time.Second {
+			t.Fatalf("request span is not ended")
+		}
+	}
+
+	tracer.lock.Lock()
+	defer tracer.lock.Unlock()
+	if root.parent != nil {
+		t.Fatalf("request span should be a root span, parent %s", root.parent.name)
+	}
+	if root.attrs["peer"] != remoteHost.ID().String() || root.attrs["origin"] != kvIdx || root.attrs["limit"] != kvIdx {
+		t.Fatalf("unexpected request span attributes %v", root.attrs)
+	}
+	children := make(map[string]*recordedSpan)
+	for _, span := range tracer.spans {
+		if span == root {
+			continue
+		}
+		if span.parent != root {
+			t.Fatalf("span %s should be a child of the request span", span.name)
+		}
+		if _, ok := children[span.name]; ok {
+			t.Fatalf("span %s is started more than once", span.name)
+		}
+		if !span.ended || span.err != nil {
+			t.Fatalf("span %s should end without error, ended %v, err %v", span.name, span.ended, span.err)
+		}
+		children[span.name] = span
+	}
+	for _, name := range []string{spanRoundTrip, spanDecode, spanVerify, spanCommit} {
+		if _, ok := children[name]; !ok {
+			t.Fatalf("span %s is not started, spans %v", name, children)
+		}
+	}
+	if len(children) != 4 {
+		t.Fatalf("unexpected spans %v", children)
+	}
+	for _, name := range []string{spanDecode, spanVerify} {
+		if index := children[name].attrs["index"]; index != kvIdx {
+			t.Fatalf("span %s has index %v, expected %d", name, index, kvIdx)
+		}
+	}
+}
+
+// stallConn is a mock connection which only provides the remote peer.
+type stallConn struct {
+	network.Conn
+	remote peer.ID
+}
+
+func (c *stallConn) ID() string {
+	return "stall-conn"
+}
+
+func (c *stallConn) RemotePeer() peer.ID {
+	return c.remote
+}
+
+func (c *stallConn) RemoteMultiaddr() ma.Multiaddr {
+	return nil
+}
+
+// stallStream is a mock stream whose remote peer opens the stream and stalls without sending the request,
+// the read only returns when the read deadline is exceeded.
+type stallStream struct {
+	network.Stream
+	conn         network.Conn
+	lock         sync.Mutex
+	readDeadline time.Time
+}
+
+func (s *stallStream) Read(p []byte) (int, error) {
+	for {
+		s.lock.Lock()
+		deadline := s.readDeadline
+		s.lock.Unlock()
+		if !deadline.IsZero() && time.Now().After(deadline) {
+			return 0, os.ErrDeadlineExceeded
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func (s *stallStream) Write(p []byte) (int, error) {
+	return len(p), nil
+}
+
+func (s *stallStream) SetReadDeadline(t time.Time) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.readDeadline = t
+	return nil
+}
+
+func (s *stallStream) SetWriteDeadline(t time.Time) error {
+	return nil
+}
+
+func (s *stallStream) Close() error {
+	return nil
+}
+
+func (s *stallStream) CloseRead() error {
+	return nil
+}
+
+func (s *stallStream) Conn() network.Conn {
+	return s.conn
+}
+
+func (s *stallStream) Protocol() protocol.ID {
+	return GetProtocolID(RequestBlobsByRangeProtocolID, new(big.Int).SetUint64(3333))
+}
+
+// TestStreamHandlerDeadline test the stream handler returns after the read deadline configured by EsConfig
+// is exceeded, rather than hanging on the stream which stalls.
+func TestStreamHandlerDeadline(t *testing.T) {
+	var (
+		readTimeout = 500 * time.Millisecond
+		db          = rawdb.NewMemoryDatabase()
+		m           = metrics.NewMetrics("sync_test")
+		rollupCfg   = &rollup.EsConfig{
+			L2ChainID:          new(big.Int).SetUint64(3333),
+			StreamReadTimeout:  readTimeout,
+			StreamWriteTimeout: time.Second,
+		}
+		smr = &mockStorageManagerReader{
+			kvEntries:       16,
+			maxKvSize:       defaultChunkSize,
+			encodeType:      defaultEncodeType,
+			shards:          []uint64{0},
+			contractAddress: contract,
+			shardMiner:      common.Address{},
+			blobPayloads:    make(map[uint64]*BlobPayloadWithRowData),
+		}
+	)
+
+	syncSrv := NewSyncServer(rollupCfg, smr, db, m)
+	handler := MakeStreamHandler(context.Background(), testLog, syncSrv.HandleGetBlobsByRangeRequest)
+	stream := &stallStream{conn: &stallConn{remote: peer.ID("stall-peer")}}
+
+	start := time.Now()
+	done := make(chan struct{})
+	go func() {
+		handler(stream)
+		close(done)
+	}()
+	select {
+	case <-done:
+		if time.Since(start) < readTimeout {
+			t.Fatalf("handler returned before the read deadline, time used %s", time.Since(start))
+		}
+	case <-time.After(10 * readTimeout):
+		t.Fatalf("handler should return after the read deadline exceeded")
+	}
+}
+
+// TestDecodeWithAltEncodeType test the blobs whose encode type is misreported by the peer are recovered by decoding
+// with the alternative encode types, and the attempts are metered.
+func TestDecodeWithAltEncodeType(t *testing.T) {
+	var (
+		kvSize      = defaultChunkSize
+		kvEntries   = uint64(16)
+		lastKvIndex = uint64(16)
+		db          = rawdb.NewMemoryDatabase()
+		mux         = new(event.Feed)
+		m           = metrics.NewMetrics("sync_test")
+		pid         = peer.ID("misreport-peer")
+		misreported = map[uint64]struct{}{2: {}, 5: {}}
+		rollupCfg   = &rollup.EsConfig{
+			L2ChainID: new(big.Int).SetUint64(3333),
+		}
+	)
+
+	metafile, err := CreateMetaFile(metafileName, int64(kvEntries))
+	if err != nil {
+		t.Error("Create metafileName fail", err.Error())
+	}
+	defer metafile.Close()
+
+	shardManager, files := createEthStorage(contract, []uint64{0}, defaultChunkSize, kvSize, kvEntries, common.Address{}, defaultEncodeType)
+	if shardManager == nil {
+		t.Fatalf("createEthStorage failed")
+	}
+	defer func(files []string) {
+		for _, file := range files {
+			os.Remove(file)
+		}
+	}(files)
+
+	data := makeKVStorage(contract, []uint64{0}, defaultChunkSize, kvSize, kvEntries, lastKvIndex, common.Address{}, defaultEncodeType, metafile)
+
+	sm := ethstorage.NewStorageManager(shardManager, NewMockL1Source(lastKvIndex, metafileName))
+	_, syncCl := createLocalHostAndSyncClient(t, testLog, rollupCfg, db, sm, m, mux)
+	sm.Reset(0)
+	err = sm.DownloadAllMetas(context.Background(), 16)
+	if err != nil {
+		t.Fatal("Download blob metadata failed", "error", err)
+	}
+
+	blobs := make([]*BlobPayload, 0)
+	for idx := uint64(0); idx < 8; idx++ {
+		d := data[contract][idx]
+		encodeType := d.EncodeType
+		if _, ok := misreported[idx]; ok {
+			// the blob is encoded with blob poseidon, but the peer reports keccak256
+			encodeType = ethstorage.ENCODE_KECCAK_256
+		}
+		blobs = append(blobs, &BlobPayload{
+			MinerAddress: d.MinerAddress,
+			BlobIndex:    d.BlobIndex,
+			BlobCommit:   d.BlobCommit,
+			EncodeType:   encodeType,
+			EncodedBlob:  d.EncodedBlob,
+		})
+	}
+
+	_, _, inserted, failures, err := syncCl.processBlobs(context.Background(), pid, contract, blobs, false)
+	if err != nil {
+		t.Fatalf("process blobs failed: %s", err.Error())
+	}
+	if len(inserted) != len(blobs) || len(failures) != 0 {
+		t.Fatalf("all blobs should be inserted, inserted %v, failures %v", inserted, failures)
+	}
+	if _, ok := syncCl.suspiciousPeers[pid]; ok {
+		t.Fatalf("peer misreporting the encode type should not be marked as suspicious once recovered")
+	}
+	recovered := testutil.ToFloat64(m.SyncClientAltEncodeTotal.WithLabelValues(fmt.Sprintf("%d", ethstorage.ENCODE_BLOB_POSEIDON), "recovered"))
+	if recovered != float64(len(misreported)) {
+		t.Fatalf("recovered count is not match, expected: %d, actual: %f", len(misreported), recovered)
+	}
+	if failed := testutil.ToFloat64(m.SyncClientAltEncodeTotal.WithLabelValues(fmt.Sprintf("%d", ethstorage.NO_ENCODE), "failed")); failed != float64(len(misreported)) {
+		t.Fatalf("failed count is not match, expected: %d, actual: %f", len(misreported), failed)
+	}
+	for idx := range misreported {
+		d := data[contract][idx]
+		rowData, _, err := shardManager.TryRead(idx, len(d.RowData), d.BlobCommit)
+		if err != nil || !bytes.Equal(rowData, d.RowData) {
+			t.Fatalf("blob %d recovered with alternative encode type is not match, err %v", idx, err)
+		}
+	}
+}
+
+// TestBlobPrefixesByRange test the server only returns the requested prefix of each encoded blob when the range
+// request carries MaxBytesPerBlob, and the full blobs otherwise.
+func TestBlobPrefixesByRange(t *testing.T) {
+	var (
+		kvSize      = defaultChunkSize
+		kvEntries   = uint64(16)
+		lastKvIndex = uint64(16)
+		readLen     = uint64(1024)
+		ctx, cancel = context.WithCancel(context.Background())
+		db          = rawdb.NewMemoryDatabase()
+		shards      = map[common.Address][]uint64{contract: {0}}
+		m           = metrics.NewMetrics("sync_test")
+		rollupCfg   = &rollup.EsConfig{
+			L2ChainID: new(big.Int).SetUint64(3333),
+		}
+	)
+	defer cancel()
+
+	metafile, err := CreateMetaFile(metafileName, int64(kvEntries))
+	if err != nil {
+		t.Error("Create metafileName fail", err.Error())
+	}
+	defer metafile.Close()
+
+	shardManager, files := createEthStorage(contract, []uint64{0}, defaultChunkSize, kvSize, kvEntries, common.Address{}, defaultEncodeType)
+	if shardManager == nil {
+		t.Fatalf("createEthStorage failed")
+	}
+	defer func(files []string) {
+		for _, file := range files {
+			os.Remove(file)
+		}
+	}(files)
+
+	data := makeKVStorage(contract, []uint64{0}, defaultChunkSize, kvSize, kvEntries, lastKvIndex, common.Address{}, defaultEncodeType, metafile)
+	smr := &mockStorageManagerReader{
+		kvEntries:       kvEntries,
+		maxKvSize:       kvSize,
+		encodeType:      defaultEncodeType,
+		shards:          []uint64{0},
+		contractAddress: contract,
+		shardMiner:      common.Address{},
+		blobPayloads:    data[contract],
+	}
+	remoteHost := createRemoteHost(t, ctx, rollupCfg, smr, db, m, testLog)
+	localHost := getNetHost(t)
+	connect(t, localHost, remoteHost, shards, shards)
+	pr := NewPeer(0, rollupCfg.L2ChainID, remoteHost.ID(), localHost.NewStream, network.DirOutbound,
+		params.InitRequestSize, kvSize, shards)
+
+	var packet BlobsByRangePacket
+	if _, err := pr.RequestBlobPrefixesByRange(rand.Uint64(), contract, 0, 0, 7, readLen, &packet); err != nil {
+		t.Fatalf("request blob prefixes failed: %s", err.Error())
+	}
+	if len(packet.Blobs) != 8 {
+		t.Fatalf("blob count is not match, expected: %d, actual: %d", 8, len(packet.Blobs))
+	}
+	for _, blob := range packet.Blobs {
+		expected, _, _ := smr.TryReadEncoded(blob.BlobIndex, int(readLen))
+		if uint64(len(blob.EncodedBlob)) != readLen || !bytes.Equal(blob.EncodedBlob, expected) {
+			t.Fatalf("blob %d prefix is not match, expected len: %d, actual len: %d", blob.BlobIndex, readLen, len(blob.EncodedBlob))
+		}
+	}
+
+	packet = BlobsByRangePacket{}
+	if _, err := pr.RequestBlobsByRange(rand.Uint64(), contract, 0, 0, 7, &packet); err != nil {
+		t.Fatalf("request blobs failed: %s", err.Error())
+	}
+	for _, blob := range packet.Blobs {
+		if uint64(len(blob.EncodedBlob)) != kvSize {
+			t.Fatalf("full blob %d should be returned, expected len: %d, actual len: %d", blob.BlobIndex, kvSize, len(blob.EncodedBlob))
+		}
+	}
+}
+
+// TestCompressedBlobsByRange test the blobs requested from a peer serving the compressed responses are the same
+// as the uncompressed ones, and the request falls back to uncompressed if the peer does not support compression.
+func TestCompressedBlobsByRange(t *testing.T) {
+	var (
+		kvSize      = defaultChunkSize
+		kvEntries   = uint64(16)
+		lastKvIndex = uint64(16)
+		ctx, cancel = context.WithCancel(context.Background())
+		db          = rawdb.NewMemoryDatabase()
+		shards      = map[common.Address][]uint64{contract: {0}}
+		m           = metrics.NewMetrics("sync_test")
+		rollupCfg   = &rollup.EsConfig{
+			L2ChainID:          new(big.Int).SetUint64(3333),
+			CompressionEnabled: true,
+		}
+	)
+	defer cancel()
+
+	metafile, err := CreateMetaFile(metafileName, int64(kvEntries))
+	if err != nil {
+		t.Error("Create metafileName fail", err.Error())
+	}
+	defer metafile.Close()
+
+	shardManager, files := createEthStorage(contract, []uint64{0}, defaultChunkSize, kvSize, kvEntries, common.Address{}, defaultEncodeType)
+	if shardManager == nil {
+		t.Fatalf("createEthStorage failed")
+	}
+	defer func(files []string) {
+		for _, file := range files {
+			os.Remove(file)
+		}
+	}(files)
+
+	data := makeKVStorage(contract, []uint64{0}, defaultChunkSize, kvSize, kvEntries, lastKvIndex, common.Address{}, defaultEncodeType, metafile)
+	smr := &mockStorageManagerReader{
+		kvEntries:       kvEntries,
+		maxKvSize:       kvSize,
+		encodeType:      defaultEncodeType,
+		shards:          []uint64{0},
+		contractAddress: contract,
+		shardMiner:      common.Address{},
+		blobPayloads:    data[contract],
+	}
+	// only the compressed protocol is served, so the request fails if it is not compressed
+	compressedHost := getNetHost(t)
+	syncSrv := NewSyncServer(rollupCfg, smr, db, m)
+	compressedHandler := MakeStreamHandler(ctx, testLog, syncSrv.HandleGetCompressedBlobsByRangeRequest)
+	compressedHost.SetStreamHandler(GetProtocolID(RequestCompressedBlobsByRangeProtocolID, rollupCfg.L2ChainID), compressedHandler)
+	uncompressedHost := createRemoteHost(t, ctx, rollupCfg, smr, db, m, testLog)
+	localHost := getNetHost(t)
+	connect(t, localHost, compressedHost, shards, shards)
+	connect(t, localHost, uncompressedHost, shards, shards)
+
+	request := func(remote peer.ID) BlobsByRangePacket {
+		pr := NewPeer(0, rollupCfg.L2ChainID, remote, localHost.NewStream, network.DirOutbound,
+			params.InitRequestSize, kvSize, shards)
+		pr.compression = true
+		var packet BlobsByRangePacket
+		if _, err := pr.RequestBlobsByRange(1, contract, 0, 0, 7, &packet); err != nil {
+			t.Fatalf("request blobs from %s failed: %s", remote, err.Error())
+		}
+		return packet
+	}
+	compressed, uncompressed := request(compressedHost.ID()), request(uncompressedHost.ID())
+	if len(compressed.Blobs) != 8 {
+		t.Fatalf("blob count is not match, expected: %d, actual: %d", 8, len(compressed.Blobs))
+	}
+	if !reflect.DeepEqual(compressed, uncompressed) {
+		t.Fatalf("compressed blobs are not match with the uncompressed blobs")
+	}
+}
+
+// TestDecompressPayloadLimit test the payload decompressed to more than the max decoded size of the decoder is rejected.
+func TestDecompressPayloadLimit(t *testing.T) {
+	payload := bytes.Repeat([]byte{0x01}, 1<<20)
+	compressed, err := compressPayload(payload)
+	if err != nil {
+		t.Fatalf("compress payload failed: %s", err.Error())
+	}
+	decompressed, err := decompressPayload(newZstdDecoder(uint64(len(payload))), compressed)
+	if err != nil {
+		t.Fatalf("decompress payload failed: %s", err.Error())
+	}
+	if !bytes.Equal(payload, decompressed) {
+		t.Fatalf("decompressed payload is not match with the payload")
+	}
+	if _, err = decompressPayload(newZstdDecoder(uint64(len(payload))/2), compressed); err == nil {
+		t.Fatalf("payload larger than the max decoded size is decompressed")
+	}
+}
+
+// TestCapabilitiesHandshake test the compression of the range responses is only requested from the peer advertising
+// it in the capabilities handshake, and the request falls back to uncompressed with the peer lacking compression.
+func TestCapabilitiesHandshake(t *testing.T) {
+	var (
+		kvSize      = defaultChunkSize
+		kvEntries   = uint64(16)
+		lastKvIndex = uint64(16)
+		ctx, cancel = context.WithCancel(context.Background())
+		db          = rawdb.NewMemoryDatabase()
+		shards      = map[common.Address][]uint64{contract: {0}}
+		m           = metrics.NewMetrics("sync_test")
+		chainID     = new(big.Int).SetUint64(3333)
+	)
+	defer cancel()
+
+	metafile, err := CreateMetaFile(metafileName, int64(kvEntries))
+	if err != nil {
+		t.Error("Create metafileName fail", err.Error())
+	}
+	defer metafile.Close()
+
+	shardManager, files := createEthStorage(contract, []uint64{0}, defaultChunkSize, kvSize, kvEntries, common.Address{}, defaultEncodeType)
+	if shardManager == nil {
+		t.Fatalf("createEthStorage failed")
+	}
+	defer func(files []string) {
+		for _, file := range files {
+			os.Remove(file)
+		}
+	}(files)
+
+	data := makeKVStorage(contract, []uint64{0}, defaultChunkSize, kvSize, kvEntries, lastKvIndex, common.Address{}, defaultEncodeType, metafile)
+	smr := &mockStorageManagerReader{
+		kvEntries:       kvEntries,
+		maxKvSize:       kvSize,
+		encodeType:      defaultEncodeType,
+		shards:          []uint64{0},
+		contractAddress: contract,
+		shardMiner:      common.Address{},
+		blobPayloads:    data[contract],
+		lastKvIndex:     lastKvIndex,
+	}
+	// both the protocols are served by the hosts, so only the capabilities decide whether to request compression,
+	// and the requests of each protocol are counted
+	createHost := func(compression bool) (host.Host, *atomic.Int32, *atomic.Int32) {
+		var compressed, uncompressed atomic.Int32
+		cfg := &rollup.EsConfig{L2ChainID: chainID, CompressionEnabled: compression}
+		h := getNetHost(t)
+		syncSrv := NewSyncServer(cfg, smr, db, m)
+		compressedHandler := MakeStreamHandler(ctx, testLog, syncSrv.HandleGetCompressedBlobsByRangeRequest)
+		h.SetStreamHandler(GetProtocolID(RequestCompressedBlobsByRangeProtocolID, chainID), func(stream network.Stream) {
+			compressed.Add(1)
+			compressedHandler(stream)
+		})
+		blobByRangeHandler := MakeStreamHandler(ctx, testLog, syncSrv.HandleGetBlobsByRangeRequest)
+		h.SetStreamHandler(GetProtocolID(RequestBlobsByRangeProtocolID, chainID), func(stream network.Stream) {
+			uncompressed.Add(1)
+			blobByRangeHandler(stream)
+		})
+		h.SetStreamHandler(RequestCapabilities, MakeStreamHandler(ctx, testLog, syncSrv.HandleRequestCapabilities))
+		return h, &compressed, &uncompressed
+	}
+	localHost := getNetHost(t)
+	request := func(remote host.Host, compression bool) {
+		connect(t, localHost, remote, shards, shards)
+		pr := NewPeer(0, chainID, remote.ID(), localHost.NewStream, network.DirOutbound,
+			params.InitRequestSize, kvSize, shards)
+		pr.compression = true
+		var caps Capabilities
+		if _, err := pr.RequestCapabilities(&caps); err != nil {
+			t.Fatalf("request capabilities failed: %s", err.Error())
+		}
+		if caps.Version != syncProtocolVersion || slices.Contains(caps.Compression, compressionZstd) != compression ||
+			!reflect.DeepEqual(caps.EncodeTypes, []*ShardEncodeType{{Contract: contract, ShardId: 0, EncodeType: defaultEncodeType}}) {
+			t.Fatalf("unexpected capabilities %+v", caps)
+		}
+		pr.caps.Store(&caps)
+		var packet BlobsByRangePacket
+		if _, err := pr.RequestBlobsByRange(1, contract, 0, 0, 7, &packet); err != nil {
+			t.Fatalf("request blobs failed: %s", err.Error())
+		}
+		if len(packet.Blobs) != 8 {
+			t.Fatalf("blob count is not match, expected: %d, actual: %d", 8, len(packet.Blobs))
+		}
+	}
+
+	plainHost, compressed, uncompressed := createHost(false)
+	request(plainHost, false)
+	if compressed.Load() != 0 || uncompressed.Load() != 1 {
+		t.Fatalf("peer lacking compression should be requested uncompressed, compressed: %d, uncompressed: %d",
+			compressed.Load(), uncompressed.Load())
+	}
+	compressionHost, compressed, uncompressed := createHost(true)
+	request(compressionHost, true)
+	if compressed.Load() != 1 || uncompressed.Load() != 0 {
+		t.Fatalf("peer supporting compression should be requested compressed, compressed: %d, uncompressed: %d",
+			compressed.Load(), uncompressed.Load())
+	}
+}
+
+// TestStreamedBlobsByRange test a large range is served in frames over the streamed protocol once the requester opts
+// in, the requester reassembles all the blobs from the frames with or without the zstd compression and the checksum
+// footer, the frames are only compressed if the peer advertises zstd in its capabilities, and the requester rejects the
+// response if a frame exceeds its max frame size, while the server skips the blobs exceeding its own.
+func TestStreamedBlobsByRange(t *testing.T) {
+	var (
+		kvSize      = defaultChunkSize
+		kvEntries   = uint64(64)
+		lastKvIndex = uint64(64)
+		ctx, cancel = context.WithCancel(context.Background())
+		db          = rawdb.NewMemoryDatabase()
+		shards      = map[common.Address][]uint64{contract: {0}}
+		m           = metrics.NewMetrics("sync_test")
+		rollupCfg   = &rollup.EsConfig{
+			L2ChainID: new(big.Int).SetUint64(3333),
+		}
+	)
+	defer cancel()
+
+	metafile, err := CreateMetaFile(metafileName, int64(kvEntries))
+	if err != nil {
+		t.Error("Create metafileName fail", err.Error())
+	}
+	defer metafile.Close()
+
+	shardManager, files := createEthStorage(contract, []uint64{0}, defaultChunkSize, kvSize, kvEntries, common.Address{}, defaultEncodeType)
+	if shardManager == nil {
+		t.Fatalf("createEthStorage failed")
+	}
+	defer func(files []string) {
+		for _, file := range files {
+			os.Remove(file)
+		}
+	}(files)
+
+	data := makeKVStorage(contract, []uint64{0}, defaultChunkSize, kvSize, kvEntries, lastKvIndex, common.Address{}, defaultEncodeType, metafile)
+	smr := &mockStorageManagerReader{
+		kvEntries:       kvEntries,
+		maxKvSize:       kvSize,
+		encodeType:      defaultEncodeType,
+		shards:          []uint64{0},
+		contractAddress: contract,
+		shardMiner:      common.Address{},
+		blobPayloads:    data[contract],
+	}
+	// only the streamed protocols are served, so the request fails if it is not streamed, and the requests of each
+	// of them are counted
+	streamedHost := getNetHost(t)
+	syncSrv := NewSyncServer(rollupCfg, smr, db, m)
+	var streamed, compressedStreamed atomic.Int32
+	streamedHandler := MakeStreamHandler(ctx, testLog, syncSrv.HandleGetStreamedBlobsByRangeRequest)
+	streamedHost.SetStreamHandler(GetProtocolID(RequestStreamedBlobsByRangeProtocolID, rollupCfg.L2ChainID), func(stream network.Stream) {
+		streamed.Add(1)
+		streamedHandler(stream)
+	})
+	compressedStreamedHandler := MakeStreamHandler(ctx, testLog, syncSrv.HandleGetCompressedStreamedBlobsByRangeRequest)
+	streamedHost.SetStreamHandler(GetProtocolID(RequestCompressedStreamedBlobsByRangeProtocolID, rollupCfg.L2ChainID), func(stream network.Stream) {
+		compressedStreamed.Add(1)
+		compressedStreamedHandler(stream)
+	})
+	localHost := getNetHost(t)
+	connect(t, localHost, streamedHost, shards, shards)
+
+	pr := NewPeer(0, rollupCfg.L2ChainID, streamedHost.ID(), localHost.NewStream, network.DirOutbound,
+		maxRequestSize, kvSize, shards)
+	if _, err := pr.RequestBlobsByRange(1, contract, 0, 0, kvEntries-1, &BlobsByRangePacket{}); err == nil {
+		t.Fatalf("the streamed protocol should not be requested unless streaming is enabled")
+	}
+	pr.streaming = true
+	// the frames are compressed once the requester enables compression, and the checksum footer follows them once
+	// the requester asks for it
+	for _, compression := range []bool{false, true} {
+		pr.compression = compression
+		pr.checksum.Store(compression)
+		var packet BlobsByRangePacket
+		if _, err := pr.RequestBlobsByRange(1, contract, 0, 0, kvEntries-1, &packet); err != nil {
+			t.Fatalf("request blobs with compression %t failed: %s", compression, err.Error())
+		}
+		if compression && compressedStreamed.Load() != 1 || !compression && streamed.Load() != 1 {
+			t.Fatalf("request with compression %t is not served by the expected protocol, streamed %d, compressed streamed %d",
+				compression, streamed.Load(), compressedStreamed.Load())
+		}
+		if packet.ID != 1 || packet.Contract != contract || packet.ShardId != 0 {
+			t.Fatalf("response header is not match, id %d, contract %s, shard %d", packet.ID, packet.Contract.Hex(), packet.ShardId)
+		}
+		if uint64(len(packet.Blobs)) != kvEntries {
+			t.Fatalf("blob count is not match, expected: %d, actual: %d", kvEntries, len(packet.Blobs))
+		}
+		for i, blob := range packet.Blobs {
+			expected := data[contract][uint64(i)]
+			if blob.BlobIndex != uint64(i) || blob.BlobCommit != expected.BlobCommit ||
+				!bytes.Equal(blob.EncodedBlob, expected.EncodedBlob) {
+				t.Fatalf("blob %d is not match with the served blob", i)
+			}
+		}
+		if compression && packet.Checksum != blobsChecksum(packet.Blobs) {
+			t.Fatalf("checksum footer is not match with the blobs")
+		}
+	}
+	// the frames are not compressed if the capabilities of the peer do not advertise zstd
+	pr.caps.Store(&Capabilities{Version: syncProtocolVersion, Compression: []string{}})
+	if _, err := pr.RequestBlobsByRange(1, contract, 0, 0, kvEntries-1, &BlobsByRangePacket{}); err != nil {
+		t.Fatalf("request blobs failed: %s", err.Error())
+	}
+	if streamed.Load() != 2 || compressedStreamed.Load() != 1 {
+		t.Fatalf("compressed frames should not be requested from a peer without zstd, streamed %d, compressed streamed %d",
+			streamed.Load(), compressedStreamed.Load())
+	}
+	pr.caps.Store(nil)
+
+	// a frame holds a whole blob, so the response is rejected if the frame size is below the blob size
+	pr.maxFrameSize = kvSize / 2
+	if _, err := pr.RequestBlobsByRange(2, contract, 0, 0, kvEntries-1, &BlobsByRangePacket{}); err == nil {
+		t.Fatalf("request should fail as the frames exceed the max frame size")
+	}
+
+	// the blobs exceeding the max frame size of the server are skipped instead of truncating the response
+	pr.maxFrameSize = defaultMaxFrameSize
+	syncSrv.maxFrameSize = kvSize / 2
+	skipped := BlobsByRangePacket{}
+	if _, err := pr.RequestBlobsByRange(2, contract, 0, 0, kvEntries-1, &skipped); err != nil {
+		t.Fatalf("request blobs failed: %s", err.Error())
+	}
+	if len(skipped.Blobs) != 0 || skipped.Checksum != blobsChecksum(nil) {
+		t.Fatalf("the blobs exceeding the max frame size should be skipped, blobs: %d", len(skipped.Blobs))
+	}
+
+	// the whole response is requested from a peer which does not serve the streamed protocol
+	remoteHost := createRemoteHost(t, ctx, rollupCfg, smr, db, m, testLog)
+	connect(t, localHost, remoteHost, shards, shards)
+	pr = NewPeer(0, rollupCfg.L2ChainID, remoteHost.ID(), localHost.NewStream, network.DirOutbound,
+		maxRequestSize, kvSize, shards)
+	pr.streaming = true
+	packet := BlobsByRangePacket{}
+	if _, err := pr.RequestBlobsByRange(3, contract, 0, 0, kvEntries-1, &packet); err != nil {
+		t.Fatalf("request blobs failed: %s", err.Error())
+	}
+	if len(packet.Blobs) == 0 {
+		t.Fatalf("blobs should be served in the whole response")
+	}
+}
+
+// TestStreamedFramesReuseBuffers test the frames encoded and read with the reused buffers of the pools are decoded
+// to the blobs sent, so the stale content of a larger blob in a buffer does not leak into the smaller blobs of the
+// other indexes, and a buffer got from the pool is zeroed.
+func TestStreamedFramesReuseBuffers(t *testing.T) {
+	var (
+		kvSize     = defaultChunkSize
+		serverPool = newBlobBufferPool(kvSize)
+		bufPool    = newBlobBufferPool(kvSize)
+		stream     = new(bytes.Buffer)
+		sizes      = []uint64{kvSize, kvSize / 2, 1, 0, kvSize, kvSize / 4}
+	)
+	sent := make([]*BlobPayload, 0, len(sizes))
+	for i, size := range sizes {
+		payload := &BlobPayload{
+			BlobIndex:   uint64(i),
+			BlobCommit:  common.BytesToHash([]byte{byte(i + 1)}),
+			EncodedBlob: bytes.Repeat([]byte{byte(0xf0 + i)}, int(size)),
+		}
+		frame, err := encodeFrame(payload, serverPool)
+		if err != nil {
+			t.Fatalf("encode blob %d failed: %s", i, err.Error())
+		}
+		err = writeFrame(stream, frame)
+		serverPool.put(frame)
+		if err != nil {
+			t.Fatalf("write blob %d failed: %s", i, err.Error())
+		}
+		sent = append(sent, payload)
+	}
+	if err := writeFrame(stream, nil); err != nil {
+		t.Fatalf("write end frame failed: %s", err.Error())
+	}
+
+	// the blobs are checked once all the frames are read, as the decoded blobs must not share the reused buffers
+	received := make([]*BlobPayload, 0, len(sent))
+	for {
+		frame, err := readFrame(stream, defaultMaxFrameSize, bufPool)
+		if err != nil {
+			t.Fatalf("read frame %d failed: %s", len(received), err.Error())
+		}
+		if frame == nil {
+			break
+		}
+		var payload BlobPayload
+		err = rlp.DecodeBytes(frame, &payload)
+		bufPool.put(frame)
+		if err != nil {
+			t.Fatalf("decode frame %d failed: %s", len(received), err.Error())
+		}
+		received = append(received, &payload)
+	}
+	if len(received) != len(sent) {
+		t.Fatalf("blob count is not match, expected: %d, actual: %d", len(sent), len(received))
+	}
+	for i, payload := range received {
+		if payload.BlobIndex != sent[i].BlobIndex || payload.BlobCommit != sent[i].BlobCommit ||
+			!bytes.Equal(payload.EncodedBlob, sent[i].EncodedBlob) {
+			t.Fatalf("blob %d is not match with the blob sent", i)
+		}
+	}
+
+	// a buffer filled by a blob is zeroed once it is got from the pool again
+	buf := bufPool.get(int(kvSize))
+	for i := range buf {
+		buf[i] = 0xff
+	}
+	bufPool.put(buf)
+	for i := 0; i < 4; i++ {
+		reused := bufPool.get(int(kvSize) / 2)
+		if !bytes.Equal(reused, make([]byte, len(reused))) {
+			t.Fatalf("buffer got from the pool is not zeroed")
+		}
+		bufPool.put(reused)
+	}
+}
+
+// BenchmarkReadFrames compares reading and encoding the blob frames of the streamed range responses with the
+// allocated buffers and with the buffers of the pool.
+func BenchmarkReadFrames(b *testing.B) {
+	kvSize := defaultChunkSize
+	payload := &BlobPayload{EncodedBlob: make([]byte, kvSize)}
+	frame, err := rlp.EncodeToBytes(payload)
+	if err != nil {
+		b.Fatalf("encode blob failed: %s", err.Error())
+	}
+	framed := new(bytes.Buffer)
+	if err := writeFrame(framed, frame); err != nil {
+		b.Fatalf("write frame failed: %s", err.Error())
+	}
+
+	for _, pooled := range []bool{false, true} {
+		name := "allocated"
+		var bufPool *blobBufferPool
+		if pooled {
+			name = "pooled"
+			bufPool = newBlobBufferPool(kvSize)
+		}
+		b.Run("read-"+name, func(b *testing.B) {
+			b.ReportAllocs()
+			for i := 0; i < b.N; i++ {
+				frame, err := readFrame(bytes.NewReader(framed.Bytes()), defaultMaxFrameSize, bufPool)
+				if err != nil {
+					b.Fatalf("read frame failed: %s", err.Error())
+				}
+				bufPool.put(frame)
+			}
+		})
+		b.Run("encode-"+name, func(b *testing.B) {
+			b.ReportAllocs()
+			for i := 0; i < b.N; i++ {
+				frame, err := encodeFrame(payload, bufPool)
+				if err != nil {
+					b.Fatalf("encode frame failed: %s", err.Error())
+				}
+				bufPool.put(frame)
+			}
+		})
+	}
+}
+
+// TestInvalidBlobLength test the blobs with length different from MaxKvSize are rejected safely,
+// and the peer delivering them is marked as suspicious.
+func TestInvalidBlobLength(t *testing.T) {
+	var (
+		kvSize      = defaultChunkSize
+		kvEntries   = uint64(16)
+		lastKvIndex = uint64(16)
+		db          = rawdb.NewMemoryDatabase()
+		mux         = new(event.Feed)
+		m           = metrics.NewMetrics("sync_test")
+		pid         = peer.ID("invalid-length-peer")
+		oversized   = uint64(3)
+		undersized  = uint64(5)
+		rollupCfg   = &rollup.EsConfig{
+			L2ChainID: new(big.Int).SetUint64(3333),
+		}
+	)
+
+	metafile, err := CreateMetaFile(metafileName, int64(kvEntries))
+	if err != nil {
+		t.Error("Create metafileName fail", err.Error())
+	}
+	defer metafile.Close()
+
+	shardManager, files := createEthStorage(contract, []uint64{0}, defaultChunkSize, kvSize, kvEntries, common.Address{}, defaultEncodeType)
+	if shardManager == nil {
+		t.Fatalf("createEthStorage failed")
+	}
+	defer func(files []string) {
+		for _, file := range files {
+			os.Remove(file)
+		}
+	}(files)
+
+	data := makeKVStorage(contract, []uint64{0}, defaultChunkSize, kvSize, kvEntries, lastKvIndex, common.Address{}, defaultEncodeType, metafile)
+
+	l1 := NewMockL1Source(lastKvIndex, metafileName)
+	sm := ethstorage.NewStorageManager(shardManager, l1)
+	_, syncCl := createLocalHostAndSyncClient(t, testLog, rollupCfg, db, sm, m, mux)
+	sm.Reset(0)
+	err = sm.DownloadAllMetas(context.Background(), 16)
+	if err != nil {
+		t.Fatal("Download blob metadata failed", "error", err)
+	}
+
+	blobs := make([]*BlobPayload, 0)
+	for idx := uint64(0); idx < 8; idx++ {
+		d := data[contract][idx]
+		encodedBlob := d.EncodedBlob
+		if idx == oversized {
+			encodedBlob = append(append([]byte{}, encodedBlob...), make([]byte, defaultChunkSize)...)
+		} else if idx == undersized {
+			encodedBlob = encodedBlob[:len(encodedBlob)/2]
+		}
+		blobs = append(blobs, &BlobPayload{
+			MinerAddress: d.MinerAddress,
+			BlobIndex:    d.BlobIndex,
+			BlobCommit:   d.BlobCommit,
+			EncodeType:   d.EncodeType,
+			EncodedBlob:  encodedBlob,
+		})
+	}
+
+	_, _, inserted, failures, err := syncCl.processBlobs(context.Background(), pid, contract, blobs, false)
+	if err != nil {
+		t.Fatalf("process blobs failed: %s", err.Error())
+	}
+	if len(inserted) != len(blobs)-2 {
+		t.Fatalf("only blobs with valid length should be inserted, inserted %v", inserted)
+	}
+	for _, idx := range []uint64{oversized, undersized} {
+		if reason, ok := failures[idx]; !ok || reason != failureInvalidBlobLength {
+			t.Fatalf("blob %d with invalid length should be rejected, reason %s", idx, reason)
+		}
+		meta, _, _ := sm.TryReadMeta(idx)
+		if common.BytesToHash(meta) != (common.Hash{}) {
+			t.Fatalf("blob %d with invalid length should not be written", idx)
+		}
+	}
+	if _, ok := syncCl.suspiciousPeers[pid]; !ok {
+		t.Fatalf("peer delivering blobs with invalid length should be marked as suspicious")
+	}
+}
+
+// TestOversizedBlobFromPeer test an oversized blob returned by a peer in a range response is rejected before it is
+// decoded, so it is neither written nor counted as synced bytes, and the peer is marked as suspicious.
+func TestOversizedBlobFromPeer(t *testing.T) {
+	var (
+		kvSize       = defaultChunkSize
+		kvEntries    = uint64(16)
+		lastKvIndex  = uint64(16)
+		oversizedIdx = uint64(3)
+		ctx, cancel  = context.WithCancel(context.Background())
+		db           = rawdb.NewMemoryDatabase()
+		mux          = new(event.Feed)
+		shards       = make(map[common.Address][]uint64)
 		m            = metrics.NewMetrics("sync_test")
 		rollupCfg    = &rollup.EsConfig{
 			L2ChainID: new(big.Int).SetUint64(3333),
 		}
 	)
+	defer cancel()
+
+	metafile, err := CreateMetaFile(metafileName, int64(kvEntries))
+	if err != nil {
+		t.Error("Create metafileName fail", err.Error())
+	}
+	defer metafile.Close()
+
+	shardManager, files := createEthStorage(contract, []uint64{0}, defaultChunkSize, kvSize, kvEntries, common.Address{}, defaultEncodeType)
+	if shardManager == nil {
+		t.Fatalf("createEthStorage failed")
+	}
+	shards[shardManager.ContractAddress()] = shardManager.ShardIds()
+
+	defer func(files []string) {
+		for _, file := range files {
+			os.Remove(file)
+		}
+	}(files)
+
+	data := makeKVStorage(contract, []uint64{0}, defaultChunkSize, kvSize, kvEntries, lastKvIndex, common.Address{}, defaultEncodeType, metafile)
+	remoteData := copyShardData(data[contract], []uint64{0}, kvEntries, make(map[uint64]struct{}))
+	oversized := *remoteData[oversizedIdx]
+	oversized.EncodedBlob = append(append([]byte{}, oversized.EncodedBlob...), make([]byte, kvSize)...)
+	remoteData[oversizedIdx] = &oversized
+
+	l1 := NewMockL1Source(lastKvIndex, metafileName)
+	sm := ethstorage.NewStorageManager(shardManager, l1)
+	// the remote peer serves blobs up to twice the kv size, so the oversized blob is returned as it is
+	smr := &mockStorageManagerReader{
+		kvEntries:       kvEntries,
+		maxKvSize:       2 * kvSize,
+		encodeType:      defaultEncodeType,
+		shards:          []uint64{0},
+		contractAddress: contract,
+		shardMiner:      common.Address{},
+		blobPayloads:    remoteData,
+	}
+	localHost, syncCl := createLocalHostAndSyncClient(t, testLog, rollupCfg, db, sm, m, mux)
+	syncCl.loadSyncStatus()
+	sm.Reset(0)
+	if err := sm.DownloadAllMetas(context.Background(), 16); err != nil {
+		t.Fatal("Download blob metadata failed", "error", err)
+	}
+	remoteHost := createRemoteHost(t, ctx, rollupCfg, smr, db, m, testLog)
+	connect(t, localHost, remoteHost, shards, shards)
+	time.Sleep(2 * time.Second)
+
+	_, results, err := syncCl.RequestL2RangeFromPeer(ctx, remoteHost.ID(), 0, kvEntries-1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, result := range results {
+		if result.Index == oversizedIdx {
+			if result.Outcome != BlobFailed || result.Reason != failureInvalidBlobLength {
+				t.Fatalf("oversized blob should be rejected, outcome %s, reason %s", result.Outcome, result.Reason)
+			}
+		} else if result.Outcome != BlobCommitted {
+			t.Fatalf("outcome of blob %d mismatch, expected %s, real %s", result.Index, BlobCommitted, result.Outcome)
+		}
+	}
+	meta, _, _ := sm.TryReadMeta(oversizedIdx)
+	if common.BytesToHash(meta) != (common.Hash{}) {
+		t.Fatalf("oversized blob should not be written")
+	}
+	if synced, expected := syncCl.syncedBytes.Load(), (kvEntries-1)*kvSize; synced != expected {
+		t.Fatalf("synced bytes mismatch, expected %d, real %d", expected, synced)
+	}
+	syncCl.lock.Lock()
+	_, suspicious := syncCl.suspiciousPeers[remoteHost.ID()]
+	syncCl.lock.Unlock()
+	if !suspicious {
+		t.Fatalf("peer returning an oversized blob should be marked as suspicious")
+	}
+}
+
+// TestSyncStatus test the sync status endpoint serves the peers and the progress of the shards as JSON
+// before and after the sync is done.
+func TestSyncStatus(t *testing.T) {
+	var (
+		kvSize      = defaultChunkSize
+		kvEntries   = uint64(16)
+		lastKvIndex = uint64(16)
+		encodeType  = uint64(defaultEncodeType)
+		db          = rawdb.NewMemoryDatabase()
+		ctx, cancel = context.WithCancel(context.Background())
+		mux         = new(event.Feed)
+		shards      = []uint64{0}
+		shardMap    = map[common.Address][]uint64{contract: shards}
+		m           = metrics.NewMetrics("sync_test")
+		rollupCfg   = &rollup.EsConfig{
+			L2ChainID: new(big.Int).SetUint64(3333),
+		}
+	)
+	defer cancel()
+
+	metafile, err := CreateMetaFile(metafileName, int64(kvEntries))
+	if err != nil {
+		t.Error("Create metafileName fail", err.Error())
+	}
+	defer metafile.Close()
+
+	shardManager, files := createEthStorage(contract, shards, defaultChunkSize, kvSize, kvEntries, common.Address{}, defaultEncodeType)
+	if shardManager == nil {
+		t.Fatalf("createEthStorage failed")
+	}
+	defer func(files []string) {
+		for _, file := range files {
+			os.Remove(file)
+		}
+	}(files)
+
+	data := makeKVStorage(contract, shards, defaultChunkSize, kvSize, kvEntries, lastKvIndex, common.Address{}, encodeType, metafile)
+	sm := ethstorage.NewStorageManager(shardManager, NewMockL1Source(lastKvIndex, metafileName))
+	sm.Reset(0)
+	localHost, syncCl := createLocalHostAndSyncClient(t, testLog, rollupCfg, db, sm, m, mux)
+	syncCl.Start()
+	defer syncCl.Close()
+
+	server := httptest.NewServer(http.HandlerFunc(syncCl.HandleStatus))
+	defer server.Close()
+	getStatus := func() ([]byte, *SyncStatus) {
+		resp, err := http.Get(server.URL)
+		if err != nil {
+			t.Fatalf("get sync status failed: %v", err)
+		}
+		defer resp.Body.Close()
+		body, err := io.ReadAll(resp.Body)
+		if err != nil {
+			t.Fatalf("read sync status failed: %v", err)
+		}
+		status := new(SyncStatus)
+		if err := json.Unmarshal(body, status); err != nil {
+			t.Fatalf("decode sync status failed: %v", err)
+		}
+		return body, status
+	}
+
+	body, status := getStatus()
+	var raw struct {
+		Shards []map[string]interface{} `json:"shards"`
+	}
+	if err := json.Unmarshal(body, &raw); err != nil {
+		t.Fatalf("decode sync status failed: %v", err)
+	}
+	if len(raw.Shards) != 1 {
+		t.Fatalf("shards in sync status mismatch, expected: 1, actual: %d", len(raw.Shards))
+	}
+	for _, field := range []string{"contract", "shard_id", "done", "heal_task_size", "blobs_synced", "blobs_to_sync",
+		"sync_progress", "empty_to_fill", "fill_empty_progress"} {
+		if _, ok := raw.Shards[0][field]; !ok {
+			t.Fatalf("field %s is missing in the shard status", field)
+		}
+	}
+	if status.SyncDone || status.Shards[0].BlobsToSync != lastKvIndex || status.Shards[0].SyncProgress != 0 {
+		t.Fatalf("sync status before sync mismatch: %+v", status.Shards[0])
+	}
+
+	remoteHost := createRemoteHost(t, ctx, rollupCfg, &mockStorageManagerReader{
+		kvEntries:       kvEntries,
+		maxKvSize:       kvSize,
+		encodeType:      encodeType,
+		shards:          shards,
+		contractAddress: contract,
+		shardMiner:      common.Address{},
+		blobPayloads:    data[contract],
+	}, db, m, testLog)
+	connect(t, localHost, remoteHost, shardMap, shardMap)
+
+	checkStall(t, 3, mux, cancel)
+
+	_, status = getStatus()
+	if len(status.Peers) != 1 || status.Peers[0].ID != remoteHost.ID().String() {
+		t.Fatalf("peers in sync status mismatch: %+v", status.Peers)
+	}
+	if status.Shards[0].Contract != contract || status.Shards[0].ShardId != 0 {
+		t.Fatalf("shard in sync status mismatch: %+v", status.Shards[0])
+	}
+	if status.Shards[0].BlobsToSync != 0 || status.Shards[0].SyncProgress != 10000 || status.Shards[0].HealTaskSize != 0 {
+		t.Fatalf("sync status after sync mismatch: %+v", status.Shards[0])
+	}
+}
+
+// TestEstimateSync test the sync estimate reports the blobs which no connected peer can serve, including the blobs
+// of the shard the peer does not have, and the blobs beyond the last kv index of the peer.
+func TestEstimateSync(t *testing.T) {
+	var (
+		kvSize          = defaultChunkSize
+		kvEntries       = uint64(16)
+		lastKvIndex     = uint64(32)
+		peerLastKvIndex = uint64(10)
+		encodeType      = uint64(defaultEncodeType)
+		db              = rawdb.NewMemoryDatabase()
+		ctx, cancel     = context.WithCancel(context.Background())
+		mux             = new(event.Feed)
+		shards          = []uint64{0, 1}
+		m               = metrics.NewMetrics("sync_test")
+		rollupCfg       = &rollup.EsConfig{
+			L2ChainID: new(big.Int).SetUint64(3333),
+		}
+	)
+	defer cancel()
+
+	metafile, err := CreateMetaFile(metafileName, int64(lastKvIndex))
+	if err != nil {
+		t.Error("Create metafileName fail", err.Error())
+	}
+	defer metafile.Close()
+
+	shardManager, files := createEthStorage(contract, shards, defaultChunkSize, kvSize, kvEntries, common.Address{}, defaultEncodeType)
+	if shardManager == nil {
+		t.Fatalf("createEthStorage failed")
+	}
+	defer func(files []string) {
+		for _, file := range files {
+			os.Remove(file)
+		}
+	}(files)
+
+	data := makeKVStorage(contract, shards, defaultChunkSize, kvSize, kvEntries, lastKvIndex, common.Address{}, encodeType, metafile)
+	sm := ethstorage.NewStorageManager(shardManager, NewMockL1Source(lastKvIndex, metafileName))
+	sm.Reset(0)
+	localHost, syncCl := createLocalHostAndSyncClient(t, testLog, rollupCfg, db, sm, m, mux)
+	// load the tasks without starting the main loop, so no blob is requested
+	syncCl.loadSyncStatus()
+	defer syncCl.Close()
+
+	// the remote only has shard 0, and the blobs beyond peerLastKvIndex are excluded
+	excludedList := make(map[uint64]struct{})
+	for idx := peerLastKvIndex; idx < kvEntries; idx++ {
+		excludedList[idx] = struct{}{}
+	}
+	smr := &mockStorageManagerReader{
+		kvEntries:       kvEntries,
+		maxKvSize:       kvSize,
+		encodeType:      encodeType,
+		shards:          []uint64{0},
+		contractAddress: contract,
+		shardMiner:      common.Address{},
+		blobPayloads:    copyShardData(data[contract], []uint64{0}, kvEntries, excludedList),
+		lastKvIndex:     peerLastKvIndex,
+	}
+	remoteHost := createRemoteHost(t, ctx, rollupCfg, smr, db, m, testLog)
+	syncSrv := NewSyncServer(rollupCfg, smr, db, m)
+	lastKvIndexHandler := MakeStreamHandler(ctx, testLog, syncSrv.HandleRequestLastKvIndex)
+	remoteHost.SetStreamHandler(RequestLastKvIndex, lastKvIndexHandler)
+	connect(t, localHost, remoteHost, map[common.Address][]uint64{contract: shards}, map[common.Address][]uint64{contract: {0}})
+
+	// wait for the last kv index of the peer
+	deadline := time.Now().Add(2 * time.Second)
+	for {
+		syncCl.lock.Lock()
+		known := false
+		if pr, ok := syncCl.peers[remoteHost.ID()]; ok {
+			_, known = pr.lastKvIndex[contract]
+		}
+		syncCl.lock.Unlock()
+		if known {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("last kv index of the peer is not received")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	estimate := syncCl.EstimateSync()
+	if estimate.BlobsToFetch != lastKvIndex {
+		t.Fatalf("blobs to fetch mismatch, expected: %d, actual: %d", lastKvIndex, estimate.BlobsToFetch)
+	}
+	if estimate.BytesToFetch != lastKvIndex*kvSize {
+		t.Fatalf("bytes to fetch mismatch, expected: %d, actual: %d", lastKvIndex*kvSize, estimate.BytesToFetch)
+	}
+	expectedUnservable := kvEntries + uint64(len(excludedList))
+	if estimate.Unservable != expectedUnservable {
+		t.Fatalf("unservable blobs mismatch, expected: %d, actual: %d", expectedUnservable, estimate.Unservable)
+	}
+	if reads := smr.reads.Load(); reads != 0 {
+		t.Fatalf("no blob should be requested in the estimate, but %d blobs are read", reads)
+	}
+}
+
+// TestUpdatePeerShards test a connected peer pushes its updated shard list, and the blobs of the newly served
+// shard are requested from it without reconnecting.
+func TestUpdatePeerShards(t *testing.T) {
+	var (
+		kvSize      = defaultChunkSize
+		kvEntries   = uint64(16)
+		lastKvIndex = uint64(32)
+		encodeType  = uint64(defaultEncodeType)
+		db          = rawdb.NewMemoryDatabase()
+		ctx, cancel = context.WithCancel(context.Background())
+		mux         = new(event.Feed)
+		shards      = []uint64{0, 1}
+		localShards = map[common.Address][]uint64{contract: shards}
+		m           = metrics.NewMetrics("sync_test")
+		rollupCfg   = &rollup.EsConfig{
+			L2ChainID: new(big.Int).SetUint64(3333),
+		}
+	)
+	defer cancel()
+
+	metafile, err := CreateMetaFile(metafileName, int64(lastKvIndex))
+	if err != nil {
+		t.Error("Create metafileName fail", err.Error())
+	}
+	defer metafile.Close()
+
+	shardManager, files := createEthStorage(contract, shards, defaultChunkSize, kvSize, kvEntries, common.Address{}, defaultEncodeType)
+	if shardManager == nil {
+		t.Fatalf("createEthStorage failed")
+	}
+	defer func(files []string) {
+		for _, file := range files {
+			os.Remove(file)
+		}
+	}(files)
+
+	data := makeKVStorage(contract, shards, defaultChunkSize, kvSize, kvEntries, lastKvIndex, common.Address{}, encodeType, metafile)
+	sm := ethstorage.NewStorageManager(shardManager, NewMockL1Source(lastKvIndex, metafileName))
+	sm.Reset(0)
+	localHost, syncCl := createLocalHostAndSyncClient(t, testLog, rollupCfg, db, sm, m, mux)
+	localHost.SetStreamHandler(UpdateShardList, MakeStreamHandler(ctx, testLog, syncCl.HandleUpdateShardList))
+
+	dlEventCh := make(chan EthStorageSyncDone, 16)
+	events := mux.Subscribe(dlEventCh)
+	defer events.Unsubscribe()
+	syncCl.Start()
+	defer syncCl.Close()
+
+	// the remote has the blobs of both shards, but only advertises shard 0 when connected
+	smr := &mockStorageManagerReader{
+		kvEntries:       kvEntries,
+		maxKvSize:       kvSize,
+		encodeType:      encodeType,
+		shards:          shards,
+		contractAddress: contract,
+		shardMiner:      common.Address{},
+		blobPayloads:    data[contract],
+	}
+	remoteHost := createRemoteHost(t, ctx, rollupCfg, smr, db, m, testLog)
+	connect(t, localHost, remoteHost, localShards, map[common.Address][]uint64{contract: {0}})
+
+	readOfShard := func(shardId uint64) int {
+		read := 0
+		smr.readIdxs.Range(func(key, _ any) bool {
+			if key.(uint64)/kvEntries == shardId {
+				read++
+			}
+			return true
+		})
+		return read
+	}
+	deadline := time.Now().Add(30 * time.Second)
+	for readOfShard(0) < int(kvEntries) {
+		if time.Now().After(deadline) {
+			t.Fatalf("blobs of shard 0 are not requested, read %d", readOfShard(0))
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	time.Sleep(200 * time.Millisecond)
+	if read := readOfShard(1); read != 0 {
+		t.Fatalf("blobs of shard 1 should not be requested before the peer serves it, read %d", read)
+	}
+
+	// the remote starts to serve shard 1, and pushes the updated shard list
+	pr := NewPeer(0, rollupCfg.L2ChainID, localHost.ID(), remoteHost.NewStream, network.DirOutbound,
+		params.InitRequestSize, kvSize, localShards)
+	returnCode, err := pr.UpdateShardList(localShards)
+	if err != nil || returnCode != returnCodeSuccess {
+		t.Fatalf("update shard list failed, code %d, err %v", returnCode, err)
+	}
+
+	timeout := time.After(30 * time.Second)
+	for done := false; !done; {
+		select {
+		case ev := <-dlEventCh:
+			done = ev.DoneType == AllShardDone
+		case <-timeout:
+			t.Fatalf("sync is not done after the peer serves shard 1")
+		}
+	}
+	if read := readOfShard(1); read != int(kvEntries) {
+		t.Fatalf("blobs of shard 1 read count mismatch, expected: %d, actual: %d", kvEntries, read)
+	}
+	verifyKVs(data, make(map[uint64]struct{}), t)
+}
+
+// TestIndexHeaderMismatch test the blob matching its commit but embedding another kv index is rejected if the
+// index header is checked for the shard, and the peer is marked as suspicious.
+func TestIndexHeaderMismatch(t *testing.T) {
+	var (
+		kvSize      = defaultChunkSize
+		kvEntries   = uint64(16)
+		lastKvIndex = uint64(16)
+		wrongIdx    = uint64(3)
+		embeddedIdx = uint64(5)
+		db          = rawdb.NewMemoryDatabase()
+		mux         = new(event.Feed)
+		m           = metrics.NewMetrics("sync_test")
+		pid         = peer.ID("wrong-index-peer")
+		rollupCfg   = &rollup.EsConfig{
+			L2ChainID: new(big.Int).SetUint64(3333),
+		}
+	)
+
+	metafile, err := CreateMetaFile(metafileName, int64(kvEntries))
+	if err != nil {
+		t.Error("Create metafileName fail", err.Error())
+	}
+	defer metafile.Close()
+
+	shardManager, files := createEthStorage(contract, []uint64{0}, defaultChunkSize, kvSize, kvEntries, common.Address{}, defaultEncodeType)
+	if shardManager == nil {
+		t.Fatalf("createEthStorage failed")
+	}
+	defer func(files []string) {
+		for _, file := range files {
+			os.Remove(file)
+		}
+	}(files)
+
+	data := makeKVStorage(contract, []uint64{0}, defaultChunkSize, kvSize, kvEntries, lastKvIndex, common.Address{}, defaultEncodeType, metafile)
+
+	// the blob of wrongIdx embeds embeddedIdx, and the commit on L1 matches the blob
+	val := make([]byte, kvSize)
+	copy(val[:20], contract.Bytes())
+	binary.BigEndian.PutUint64(val[20:28], embeddedIdx)
+	root, _ := prover.GetRoot(val, kvSize/defaultChunkSize, defaultChunkSize)
+	commit := generateMetadata(root)
+	encoded, _, _ := shardManager.EncodeKV(wrongIdx, val, commit, common.Address{}, defaultEncodeType)
+	meta := GenerateMetadata(wrongIdx, kvSize, root[:])
+	metafile.WriteAt(meta.Bytes(), int64(wrongIdx*32))
+
+	sm := ethstorage.NewStorageManager(shardManager, NewMockL1Source(lastKvIndex, metafileName))
+	_, syncCl := createLocalHostAndSyncClient(t, testLog, rollupCfg, db, sm, m, mux)
+	sm.Reset(0)
+	err = sm.DownloadAllMetas(context.Background(), 16)
+	if err != nil {
+		t.Fatal("Download blob metadata failed", "error", err)
+	}
+	syncCl.indexHeaderShards = map[ShardKey]struct{}{{Contract: contract, ShardId: 0}: {}}
+
+	blobs := make([]*BlobPayload, 0)
+	for idx := uint64(0); idx < 8; idx++ {
+		d := data[contract][idx]
+		blob := &BlobPayload{
+			MinerAddress: d.MinerAddress,
+			BlobIndex:    d.BlobIndex,
+			BlobCommit:   d.BlobCommit,
+			EncodeType:   d.EncodeType,
+			EncodedBlob:  d.EncodedBlob,
+		}
+		if idx == wrongIdx {
+			blob.BlobCommit = commit
+			blob.EncodedBlob = encoded
+		}
+		blobs = append(blobs, blob)
+	}
+
+	_, _, inserted, failures, err := syncCl.processBlobs(context.Background(), pid, contract, blobs, false)
+	if err != nil {
+		t.Fatalf("process blobs failed: %s", err.Error())
+	}
+	if len(inserted) != len(blobs)-1 || slices.Contains(inserted, wrongIdx) {
+		t.Fatalf("all blobs except %d should be inserted, inserted %v", wrongIdx, inserted)
+	}
+	if reason := failures[wrongIdx]; reason != "index header mismatch" || len(failures) != 1 {
+		t.Fatalf("blob %d should be rejected for the index header, failures %v", wrongIdx, failures)
+	}
+	if _, ok := syncCl.suspiciousPeers[pid]; !ok {
+		t.Fatalf("peer delivering the blob of a wrong index should be marked as suspicious")
+	}
+
+	// the blob is accepted if the index header is not checked for the shard
+	syncCl.indexHeaderShards = nil
+	_, _, inserted, failures, err = syncCl.processBlobs(context.Background(), pid, contract, blobs[wrongIdx:wrongIdx+1], false)
+	if err != nil {
+		t.Fatalf("process blobs failed: %s", err.Error())
+	}
+	if len(inserted) != 1 || len(failures) != 0 {
+		t.Fatalf("blob %d should be inserted without the index header checked, inserted %v, failures %v",
+			wrongIdx, inserted, failures)
+	}
+}
+
+// TestBanPeerWithInvalidBlobs test the peer always delivering blobs mismatching their commits is removed from sync
+// duties and banned once it exceeds maxInvalidBlobsPerPeer, and a PeerBanned event is sent.
+func TestBanPeerWithInvalidBlobs(t *testing.T) {
+	var (
+		kvSize          = defaultChunkSize
+		kvEntries       = uint64(16)
+		lastKvIndex     = uint64(16)
+		maxInvalidBlobs = 3
+		ctx, cancel     = context.WithCancel(context.Background())
+		db              = rawdb.NewMemoryDatabase()
+		mux             = new(event.Feed)
+		shards          = make(map[common.Address][]uint64)
+		m               = metrics.NewMetrics("sync_test")
+		rollupCfg       = &rollup.EsConfig{
+			L2ChainID: new(big.Int).SetUint64(3333),
+		}
+	)
+	defer cancel()
+
+	metafile, err := CreateMetaFile(metafileName, int64(kvEntries))
+	if err != nil {
+		t.Error("Create metafileName fail", err.Error())
+	}
+	defer metafile.Close()
+
+	shardManager, files := createEthStorage(contract, []uint64{0}, defaultChunkSize, kvSize, kvEntries, common.Address{}, defaultEncodeType)
+	if shardManager == nil {
+		t.Fatalf("createEthStorage failed")
+	}
+	shards[shardManager.ContractAddress()] = shardManager.ShardIds()
+
+	defer func(files []string) {
+		for _, file := range files {
+			os.Remove(file)
+		}
+	}(files)
+
+	data := makeKVStorage(contract, []uint64{0}, defaultChunkSize, kvSize, kvEntries, lastKvIndex, common.Address{}, defaultEncodeType, metafile)
+	// the remote peer delivers all the blobs with their commits, but the blobs are corrupted
+	remoteData := copyShardData(data[contract], []uint64{0}, kvEntries, map[uint64]struct{}{})
+	for idx, payload := range remoteData {
+		corrupted := *payload
+		corrupted.EncodedBlob = make([]byte, len(payload.EncodedBlob))
+		copy(corrupted.EncodedBlob, payload.EncodedBlob)
+		corrupted.EncodedBlob[100] = ^corrupted.EncodedBlob[100]
+		remoteData[idx] = &corrupted
+	}
+
+	sm := ethstorage.NewStorageManager(shardManager, NewMockL1Source(lastKvIndex, metafileName))
+	smr := &mockStorageManagerReader{
+		kvEntries:       kvEntries,
+		maxKvSize:       kvSize,
+		encodeType:      defaultEncodeType,
+		shards:          []uint64{0},
+		contractAddress: contract,
+		shardMiner:      common.Address{},
+		blobPayloads:    remoteData,
+	}
+
+	localHost, syncCl := createLocalHostAndSyncClient(t, testLog, rollupCfg, db, sm, m, mux)
+	syncCl.loadSyncStatus()
+	syncCl.maxInvalidBlobsPerPeer = maxInvalidBlobs
+	banned := make(chan peer.ID, 1)
+	syncCl.SetPeerBanner(func(id peer.ID) error {
+		banned <- id
+		return nil
+	})
+	bannedCh := make(chan PeerBanned, 1)
+	sub := syncCl.SubscribePeerBanned(bannedCh)
+	defer sub.Unsubscribe()
+
+	sm.Reset(0)
+	err = sm.DownloadAllMetas(context.Background(), 16)
+	if err != nil {
+		t.Fatal("Download blob metadata failed", "error", err)
+	}
+	remoteHost := createRemoteHost(t, ctx, rollupCfg, smr, db, m, testLog)
+	connect(t, localHost, remoteHost, shards, shards)
+
+	time.Sleep(2 * time.Second)
+	if _, err = syncCl.RequestL2Range(0, kvEntries-1); err != nil {
+		t.Log("Request range returned", "err", err)
+	}
+
+	select {
+	case ev := <-bannedCh:
+		if ev.Peer != remoteHost.ID() || ev.InvalidBlobs != maxInvalidBlobs+1 {
+			t.Fatalf("unexpected ban event, peer %s, invalid blobs %d", ev.Peer, ev.InvalidBlobs)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("peer delivering invalid blobs should be banned")
+	}
+	if id := <-banned; id != remoteHost.ID() {
+		t.Fatalf("banned peer mismatch, expected %s, real %s", remoteHost.ID(), id)
+	}
+
+	syncCl.lock.Lock()
+	_, ok := syncCl.peers[remoteHost.ID()]
+	syncCl.lock.Unlock()
+	if ok {
+		t.Fatalf("banned peer should be removed from sync duties")
+	}
+}
+
+// TestSkipLocalBlobs test the blobs already synced locally but not reflected in the saved status are checked before
+// the sync starts, and they are not requested from peers.
+func TestSkipLocalBlobs(t *testing.T) {
+	var (
+		kvSize      = defaultChunkSize
+		kvEntries   = uint64(64)
+		lastKvIndex = uint64(64)
+		ctx, cancel = context.WithCancel(context.Background())
+		db          = rawdb.NewMemoryDatabase()
+		mux         = new(event.Feed)
+		shards      = map[common.Address][]uint64{contract: {0}}
+		m           = metrics.NewMetrics("sync_test")
+		rollupCfg   = &rollup.EsConfig{
+			L2ChainID: new(big.Int).SetUint64(3333),
+		}
+		presentList = make([]uint64, 0)
+	)
+	defer cancel()
+	// a run at the start of a subTask and a run covering a whole subTask
+	for idx := uint64(0); idx < 20; idx++ {
+		presentList = append(presentList, idx)
+	}
+	for idx := uint64(32); idx < 48; idx++ {
+		presentList = append(presentList, idx)
+	}
+
+	metafile, err := CreateMetaFile(metafileName, int64(kvEntries))
+	if err != nil {
+		t.Error("Create metafileName fail", err.Error())
+	}
+	defer metafile.Close()
+
+	shardManager, files := createEthStorage(contract, []uint64{0}, defaultChunkSize, kvSize, kvEntries, common.Address{}, defaultEncodeType)
+	if shardManager == nil {
+		t.Fatalf("createEthStorage failed")
+	}
+	defer func(files []string) {
+		for _, file := range files {
+			os.Remove(file)
+		}
+	}(files)
+
+	data := makeKVStorage(contract, []uint64{0}, defaultChunkSize, kvSize, kvEntries, lastKvIndex, common.Address{}, defaultEncodeType, metafile)
+	sm := ethstorage.NewStorageManager(shardManager, NewMockL1Source(lastKvIndex, metafileName))
+	sm.Reset(0)
+	err = sm.DownloadAllMetas(context.Background(), 16)
+	if err != nil {
+		t.Fatal("Download blob metadata failed", "error", err)
+	}
+	// commit some blobs to local storage, while no sync status is saved
+	blobs, commits := make([][]byte, 0), make([]common.Hash, 0)
+	for _, idx := range presentList {
+		blobs = append(blobs, data[contract][idx].RowData)
+		commits = append(commits, data[contract][idx].BlobCommit)
+	}
+	if inserted, err := sm.CommitBlobs(presentList, blobs, commits); err != nil || len(inserted) != len(presentList) {
+		t.Fatalf("commit present blobs failed, inserted %v, err %v", inserted, err)
+	}
+
+	localHost, syncCl := createLocalHostAndSyncClient(t, testLog, rollupCfg, db, sm, m, mux)
+	syncCl.Start()
+	defer syncCl.Close()
+
+	smr := &mockStorageManagerReader{
+		kvEntries:       kvEntries,
+		maxKvSize:       kvSize,
+		encodeType:      defaultEncodeType,
+		shards:          []uint64{0},
+		contractAddress: contract,
+		shardMiner:      common.Address{},
+		blobPayloads:    data[contract],
+	}
+	// the local blobs are checked in the background, so the peer is connected after the check to make the requests
+	// deterministic
+	<-syncCl.localChecked
+	remoteHost := createRemoteHost(t, ctx, rollupCfg, smr, db, m, testLog)
+	connect(t, localHost, remoteHost, shards, shards)
+
+	checkStall(t, 20, mux, cancel)
+	if !syncCl.syncDone {
+		t.Fatalf("sync state %v is not match with expected state %v, peer count %d", syncCl.syncDone, true, len(syncCl.peers))
+	}
+	verifyKVs(data, make(map[uint64]struct{}), t)
+	smr.readIdxs.Range(func(key, _ any) bool {
+		if idx := key.(uint64); slices.Contains(presentList, idx) {
+			t.Errorf("blob %d already synced locally is requested", idx)
+		}
+		return true
+	})
+}
+
+// TestRevertBlobsOnLastKvIndexShrink tests that the synced blobs beyond a shrunk last kv index, e.g. on an L1
+// reorg, are reverted to empty blobs, while the blobs below it are kept.
+func TestRevertBlobsOnLastKvIndexShrink(t *testing.T) {
+	var (
+		kvSize         = defaultChunkSize
+		kvEntries      = uint64(32)
+		lastKvIndex    = uint64(32)
+		newLastKvIndex = uint64(20)
+		ctx, cancel    = context.WithCancel(context.Background())
+		db             = rawdb.NewMemoryDatabase()
+		mux            = new(event.Feed)
+		shards         = map[common.Address][]uint64{contract: {0}}
+		m              = metrics.NewMetrics("sync_test")
+		rollupCfg      = &rollup.EsConfig{
+			L2ChainID: new(big.Int).SetUint64(3333),
+		}
+	)
+	defer cancel()
+
+	metafile, err := CreateMetaFile(metafileName, int64(kvEntries))
+	if err != nil {
+		t.Error("Create metafileName fail", err.Error())
+	}
+	defer metafile.Close()
+
+	shardManager, files := createEthStorage(contract, []uint64{0}, defaultChunkSize, kvSize, kvEntries, common.Address{}, defaultEncodeType)
+	if shardManager == nil {
+		t.Fatalf("createEthStorage failed")
+	}
+	defer func(files []string) {
+		for _, file := range files {
+			os.Remove(file)
+		}
+	}(files)
+
+	data := makeKVStorage(contract, []uint64{0}, defaultChunkSize, kvSize, kvEntries, lastKvIndex, common.Address{}, defaultEncodeType, metafile)
+	l1 := NewMockL1Source(lastKvIndex, metafileName)
+	sm := ethstorage.NewStorageManager(shardManager, l1)
+	sm.Reset(0)
+	err = sm.DownloadAllMetas(context.Background(), 16)
+	if err != nil {
+		t.Fatal("Download blob metadata failed", "error", err)
+	}
+	localHost, syncCl := createLocalHostAndSyncClient(t, testLog, rollupCfg, db, sm, m, mux)
+	sm.OnLastKvIndexChanged(func(lastKvIdx uint64) {
+		syncCl.OnLastKvIndexChanged(sm.ContractAddress(), lastKvIdx)
+	})
+	var synced atomic.Int32
+	syncCl.OnShardSynced(func(common.Address, uint64) {
+		synced.Add(1)
+	})
+	syncCl.Start()
+	defer syncCl.Close()
+
+	smr := &mockStorageManagerReader{
+		kvEntries:       kvEntries,
+		maxKvSize:       kvSize,
+		encodeType:      defaultEncodeType,
+		shards:          []uint64{0},
+		contractAddress: contract,
+		shardMiner:      common.Address{},
+		blobPayloads:    data[contract],
+	}
+	remoteHost := createRemoteHost(t, ctx, rollupCfg, smr, db, m, testLog)
+	connect(t, localHost, remoteHost, shards, shards)
+
+	checkStall(t, 20, mux, cancel)
+	if !syncCl.syncDone {
+		t.Fatalf("sync state %v is not match with expected state %v, peer count %d", syncCl.syncDone, true, len(syncCl.peers))
+	}
+	verifyKVs(data, make(map[uint64]struct{}), t)
+
+	// the L1 reorg drops the blobs from newLastKvIndex
+	l1.lastBlobIndex = newLastKvIndex
+	if err := sm.Reset(1); err != nil {
+		t.Fatalf("reset storage manager failed: %v", err)
+	}
+	reverted := func() bool {
+		syncCl.lock.Lock()
+		defer syncCl.lock.Unlock()
+		return syncCl.syncDone && len(syncCl.tasks[0].SubEmptyTasks) == 0
+	}
+	for i := 0; i < 50 && !reverted(); i++ {
+		time.Sleep(100 * time.Millisecond)
+	}
+	if !reverted() {
+		t.Fatalf("blobs beyond the new last kv index are not reverted")
+	}
+	if syncCl.tasks[0].state.EmptyFilled != kvEntries-newLastKvIndex {
+		t.Fatalf("emptyBlobsFilled is wrong, expect %d, value %d", kvEntries-newLastKvIndex, syncCl.tasks[0].state.EmptyFilled)
+	}
+	// the shard is synced again once the reverted blobs are filled, which is not announced again
+	if count := synced.Load(); count != 1 {
+		t.Fatalf("shard synced callback should be called once, called %d times", count)
+	}
+
+	for idx := uint64(0); idx < kvEntries; idx++ {
+		meta, success, err := sm.TryReadMeta(idx)
+		if !success || err != nil {
+			t.Fatalf("read meta of kv %d failed: %v", idx, err)
+		}
+		commit := common.BytesToHash(meta)
+		empty := bytes.Equal(commit[:ethstorage.HashSizeInContract], make([]byte, ethstorage.HashSizeInContract))
+		if idx < newLastKvIndex && empty {
+			t.Errorf("blob %d below the new last kv index is reverted", idx)
+		}
+		if idx >= newLastKvIndex && !empty {
+			t.Errorf("blob %d beyond the new last kv index is not reverted", idx)
+		}
+	}
+}
+
+// TestFollowLastKvIndex tests that the sync client in follow mode syncs the blobs appended to the contract after
+// the sync is done, without a restart, and leaves the blobs appended along with a download to the downloader.
+func TestFollowLastKvIndex(t *testing.T) {
+	var (
+		kvSize         = defaultChunkSize
+		kvEntries      = uint64(32)
+		lastKvIndex    = uint64(16)
+		resetKvIndex   = uint64(24)
+		newLastKvIndex = uint64(32)
+		ctx, cancel    = context.WithCancel(context.Background())
+		db             = rawdb.NewMemoryDatabase()
+		mux            = new(event.Feed)
+		shards         = map[common.Address][]uint64{contract: {0}}
+		m              = metrics.NewMetrics("sync_test")
+		rollupCfg      = &rollup.EsConfig{
+			L2ChainID: new(big.Int).SetUint64(3333),
+		}
+	)
+	defer cancel()
+
+	metafile, err := CreateMetaFile(metafileName, int64(kvEntries))
+	if err != nil {
+		t.Error("Create metafileName fail", err.Error())
+	}
+	defer metafile.Close()
+
+	shardManager, files := createEthStorage(contract, []uint64{0}, defaultChunkSize, kvSize, kvEntries, common.Address{}, defaultEncodeType)
+	if shardManager == nil {
+		t.Fatalf("createEthStorage failed")
+	}
+	defer func(files []string) {
+		for _, file := range files {
+			os.Remove(file)
+		}
+	}(files)
+
+	// the peer has the blobs appended beyond the local last kv index
+	data := makeKVStorage(contract, []uint64{0}, defaultChunkSize, kvSize, kvEntries, newLastKvIndex, common.Address{}, defaultEncodeType, metafile)
+	l1 := NewMockL1Source(lastKvIndex, metafileName)
+	sm := ethstorage.NewStorageManager(shardManager, l1)
+	sm.Reset(0)
+	err = sm.DownloadAllMetas(context.Background(), 16)
+	if err != nil {
+		t.Fatal("Download blob metadata failed", "error", err)
+	}
+	localHost, syncCl := createLocalHostAndSyncClient(t, testLog, rollupCfg, db, sm, m, mux)
+	syncCl.followMode = true
+	syncCl.followInterval = 100 * time.Millisecond
+	syncCl.Start()
+	defer syncCl.Close()
+
+	smr := &mockStorageManagerReader{
+		kvEntries:       kvEntries,
+		maxKvSize:       kvSize,
+		encodeType:      defaultEncodeType,
+		shards:          []uint64{0},
+		contractAddress: contract,
+		shardMiner:      common.Address{},
+		blobPayloads:    data[contract],
+	}
+	remoteHost := createRemoteHost(t, ctx, rollupCfg, smr, db, m, testLog)
+	connect(t, localHost, remoteHost, shards, shards)
+
+	checkStall(t, 20, mux, cancel)
+	if !syncCl.syncDone {
+		t.Fatalf("sync state %v is not match with expected state %v, peer count %d", syncCl.syncDone, true, len(syncCl.peers))
+	}
+	appended := make(map[uint64]struct{})
+	for idx := lastKvIndex; idx < newLastKvIndex; idx++ {
+		appended[idx] = struct{}{}
+	}
+	verifyKVs(data, appended, t)
+
+	// the blobs are appended to the contract
+	l1.lastBlobIndex = resetKvIndex
+	if err := sm.Reset(1); err != nil {
+		t.Fatalf("reset storage manager failed: %v", err)
+	}
+	followed := func(kvIndex uint64) bool {
+		syncCl.lock.Lock()
+		defer syncCl.lock.Unlock()
+		return syncCl.followedKvIndexes[contract] == kvIndex && syncCl.syncDone && len(syncCl.tasks[0].SubTasks) == 0
+	}
+	for i := 0; i < 50 && !followed(resetKvIndex); i++ {
+		time.Sleep(100 * time.Millisecond)
+	}
+	if !followed(resetKvIndex) {
+		t.Fatalf("blobs appended to the contract are not synced")
+	}
+	downloaded := make(map[uint64]struct{})
+	for idx := resetKvIndex; idx < newLastKvIndex; idx++ {
+		downloaded[idx] = struct{}{}
+	}
+	verifyKVs(data, downloaded, t)
+
+	// the blobs appended along with a download are written by the downloader, so they are not followed
+	l1.lastBlobIndex = newLastKvIndex
+	if err := sm.DownloadFinished(2, nil, nil, nil); err != nil {
+		t.Fatalf("finish download failed: %v", err)
+	}
+	time.Sleep(5 * syncCl.followInterval)
+	if !followed(resetKvIndex) {
+		t.Fatalf("blobs written by the downloader are followed")
+	}
+}
+
+func TestOnBlobWritten(t *testing.T) {
+	var (
+		kvSize      = defaultChunkSize
+		kvEntries   = uint64(16)
+		lastKvIndex = uint64(12)
+		ctx, cancel = context.WithCancel(context.Background())
+		db          = rawdb.NewMemoryDatabase()
+		mux         = new(event.Feed)
+		shards      = map[common.Address][]uint64{contract: {0}}
+		m           = metrics.NewMetrics("sync_test")
+		rollupCfg   = &rollup.EsConfig{
+			L2ChainID: new(big.Int).SetUint64(3333),
+		}
+	)
+	defer cancel()
+
+	metafile, err := CreateMetaFile(metafileName, int64(kvEntries))
+	if err != nil {
+		t.Error("Create metafileName fail", err.Error())
+	}
+	defer metafile.Close()
+
+	shardManager, files := createEthStorage(contract, []uint64{0}, defaultChunkSize, kvSize, kvEntries, common.Address{}, defaultEncodeType)
+	if shardManager == nil {
+		t.Fatalf("createEthStorage failed")
+	}
+	defer func(files []string) {
+		for _, file := range files {
+			os.Remove(file)
+		}
+	}(files)
+
+	data := makeKVStorage(contract, []uint64{0}, defaultChunkSize, kvSize, kvEntries, lastKvIndex, common.Address{}, defaultEncodeType, metafile)
+	sm := ethstorage.NewStorageManager(shardManager, NewMockL1Source(lastKvIndex, metafileName))
+	sm.Reset(0)
+	err = sm.DownloadAllMetas(context.Background(), 16)
+	if err != nil {
+		t.Fatal("Download blob metadata failed", "error", err)
+	}
+
+	var (
+		writtenLock sync.Mutex
+		written     = make(map[uint64]int)
+		emptyCount  = 0
+	)
+	sm.OnBlobWritten(func(kvIdx uint64, commit common.Hash, empty bool) {
+		writtenLock.Lock()
+		defer writtenLock.Unlock()
+		written[kvIdx]++
+		if empty {
+			emptyCount++
+		} else if commit != data[contract][kvIdx].BlobCommit {
+			t.Errorf("commit of blob %d is not match", kvIdx)
+		}
+	})
+
+	localHost, syncCl := createLocalHostAndSyncClient(t, testLog, rollupCfg, db, sm, m, mux)
+	syncCl.Start()
+	defer syncCl.Close()
+
+	smr := &mockStorageManagerReader{
+		kvEntries:       kvEntries,
+		maxKvSize:       kvSize,
+		encodeType:      defaultEncodeType,
+		shards:          []uint64{0},
+		contractAddress: contract,
+		shardMiner:      common.Address{},
+		blobPayloads:    data[contract],
+	}
+	remoteHost := createRemoteHost(t, ctx, rollupCfg, smr, db, m, testLog)
+	connect(t, localHost, remoteHost, shards, shards)
+
+	checkStall(t, 3, mux, cancel)
+	if !syncCl.syncDone {
+		t.Fatalf("sync state %v is not match with expected state %v, peer count %d", syncCl.syncDone, true, len(syncCl.peers))
+	}
+
+	// the callbacks are called asynchronously
+	count := func() int {
+		writtenLock.Lock()
+		defer writtenLock.Unlock()
+		return len(written)
+	}
+	for i := 0; i < 20 && count() < int(kvEntries); i++ {
+		time.Sleep(50 * time.Millisecond)
+	}
+	writtenLock.Lock()
+	defer writtenLock.Unlock()
+	for idx := uint64(0); idx < kvEntries; idx++ {
+		if written[idx] != 1 {
+			t.Errorf("callback count of blob %d is not match, expected: 1, actual: %d", idx, written[idx])
+		}
+	}
+	if emptyCount != int(kvEntries-lastKvIndex) {
+		t.Fatalf("empty blob count is not match, expected: %d, actual: %d", kvEntries-lastKvIndex, emptyCount)
+	}
+}
+
+// TestSplitSubTaskAmongPeers tests that the range of a subTask is split among the idle peers in parallel, so the
+// subTask served by two peers each reading half of it completes in about half the time of a single peer.
+func TestSplitSubTaskAmongPeers(t *testing.T) {
+	var (
+		kvSize      = defaultChunkSize
+		kvEntries   = uint64(8)
+		lastKvIndex = uint64(8)
+		readDelay   = time.Second
+		ctx, cancel = context.WithCancel(context.Background())
+		db          = rawdb.NewMemoryDatabase()
+		mux         = new(event.Feed)
+		shards      = map[common.Address][]uint64{contract: {0}}
+		m           = metrics.NewMetrics("sync_test")
+		rollupCfg   = &rollup.EsConfig{
+			L2ChainID: new(big.Int).SetUint64(3333),
+		}
+	)
+	defer cancel()
+
+	metafile, err := CreateMetaFile(metafileName, int64(kvEntries))
+	if err != nil {
+		t.Error("Create metafileName fail", err.Error())
+	}
+	defer metafile.Close()
+
+	shardManager, files := createEthStorage(contract, []uint64{0}, defaultChunkSize, kvSize, kvEntries, common.Address{}, defaultEncodeType)
+	if shardManager == nil {
+		t.Fatalf("createEthStorage failed")
+	}
+	defer func(files []string) {
+		for _, file := range files {
+			os.Remove(file)
+		}
+	}(files)
+
+	data := makeKVStorage(contract, []uint64{0}, defaultChunkSize, kvSize, kvEntries, lastKvIndex, common.Address{}, defaultEncodeType, metafile)
+	sm := ethstorage.NewStorageManager(shardManager, NewMockL1Source(lastKvIndex, metafileName))
+	sm.Reset(0)
+	err = sm.DownloadAllMetas(context.Background(), 16)
+	if err != nil {
+		t.Fatal("Download blob metadata failed", "error", err)
+	}
+	localHost, syncCl := createLocalHostAndSyncClient(t, testLog, rollupCfg, db, sm, m, mux)
+	syncCl.maxPeersPerSubTask = 2
+	// the sync is paused until both the peers join, so the subTask is split between them
+	syncCl.Pause()
+	syncCl.Start()
+	defer syncCl.Close()
+
+	smrs := make([]*mockStorageManagerReader, 2)
+	for i := range smrs {
+		smrs[i] = &mockStorageManagerReader{
+			kvEntries:       kvEntries,
+			maxKvSize:       kvSize,
+			encodeType:      defaultEncodeType,
+			shards:          []uint64{0},
+			contractAddress: contract,
+			shardMiner:      common.Address{},
+			blobPayloads:    data[contract],
+			readDelay:       readDelay,
+		}
+		remoteHost := createRemoteHost(t, ctx, rollupCfg, smrs[i], db, m, testLog)
+		connect(t, localHost, remoteHost, shards, shards)
+	}
+	// both the peers are idle before the subTask is assigned
+	idle := func() int {
+		syncCl.lock.Lock()
+		defer syncCl.lock.Unlock()
+		return len(syncCl.idlerPeers)
+	}
+	for i := 0; i < 50 && idle() < len(smrs); i++ {
+		time.Sleep(20 * time.Millisecond)
+	}
+	if idle() != len(smrs) {
+		t.Fatalf("idle peer count is not match, expected: %d, actual: %d", len(smrs), idle())
+	}
+
+	start := time.Now()
+	syncCl.Resume()
+	checkStall(t, 20, mux, cancel)
+	elapsed := time.Since(start)
+	if !syncCl.syncDone {
+		t.Fatalf("sync state %v is not match with expected state %v, peer count %d", syncCl.syncDone, true, len(syncCl.peers))
+	}
+	verifyKVs(data, make(map[uint64]struct{}), t)
+
+	for i, smr := range smrs {
+		if reads := smr.reads.Load(); reads != lastKvIndex/2 {
+			t.Errorf("peer %d read count is not match, expected: %d, actual: %d", i, lastKvIndex/2, reads)
+		}
+	}
+	// a single peer takes lastKvIndex * readDelay to read the whole subTask
+	if serial := time.Duration(lastKvIndex) * readDelay; elapsed > serial*3/4 {
+		t.Fatalf("subTask split among peers is not faster, elapsed: %v, single peer: %v", elapsed, serial)
+	}
+}
+
+// TestOnShardSynced tests that the callback registered by OnShardSynced is called once for each shard when the
+// shard is synced, before all the shards are synced.
+func TestOnShardSynced(t *testing.T) {
+	var (
+		kvSize      = defaultChunkSize
+		kvEntries   = uint64(16)
+		lastKvIndex = uint64(32)
+		db          = rawdb.NewMemoryDatabase()
+		ctx, cancel = context.WithCancel(context.Background())
+		mux         = new(event.Feed)
+		m           = metrics.NewMetrics("sync_test")
+		localShards = map[common.Address][]uint64{contract: {0, 1}}
+		rollupCfg   = &rollup.EsConfig{
+			L2ChainID: new(big.Int).SetUint64(3333),
+		}
+		synced = make(chan uint64, 4)
+	)
+	defer cancel()
+
+	metafile, err := CreateMetaFile(metafileName, int64(kvEntries*2))
+	if err != nil {
+		t.Error("Create metafileName fail", err.Error())
+	}
+	defer metafile.Close()
+
+	shardManager, files := createEthStorage(contract, []uint64{0, 1}, defaultChunkSize, kvSize, kvEntries, common.Address{}, defaultEncodeType)
+	if shardManager == nil {
+		t.Fatalf("createEthStorage failed")
+	}
+	defer func(files []string) {
+		for _, file := range files {
+			os.Remove(file)
+		}
+	}(files)
+
+	data := makeKVStorage(contract, []uint64{0, 1}, defaultChunkSize, kvSize, kvEntries, lastKvIndex, common.Address{}, defaultEncodeType, metafile)
+	sm := ethstorage.NewStorageManager(shardManager, NewMockL1Source(lastKvIndex, metafileName))
+	sm.Reset(0)
+	localHost, syncCl := createLocalHostAndSyncClient(t, testLog, rollupCfg, db, sm, m, mux)
+	syncCl.OnShardSynced(func(c common.Address, shardIdx uint64) {
+		if c != contract {
+			t.Errorf("unexpected contract %s", c.Hex())
+		}
+		synced <- shardIdx
+	})
+	syncCl.Start()
+	defer syncCl.Close()
+
+	waitSynced := func(expected uint64) {
+		select {
+		case shardIdx := <-synced:
+			if shardIdx != expected {
+				t.Fatalf("shard %d synced, expected shard %d", shardIdx, expected)
+			}
+		case <-time.After(6 * time.Second):
+			t.Fatalf("shard %d is not synced", expected)
+		}
+	}
+
+	// the first peer only serves shard 0, so shard 1 is synced later from the second peer
+	for _, shardIdx := range []uint64{0, 1} {
+		smr := &mockStorageManagerReader{
+			kvEntries:       kvEntries,
+			maxKvSize:       kvSize,
+			encodeType:      defaultEncodeType,
+			shards:          []uint64{shardIdx},
+			contractAddress: contract,
+			shardMiner:      common.Address{},
+			blobPayloads:    data[contract],
+		}
+		remoteHost := createRemoteHost(t, ctx, rollupCfg, smr, db, m, testLog)
+		connect(t, localHost, remoteHost, localShards, map[common.Address][]uint64{contract: {shardIdx}})
+		waitSynced(shardIdx)
+	}
+
+	time.Sleep(time.Second)
+	if !syncCl.syncDone {
+		t.Fatalf("sync state %v is not match with expected state %v", syncCl.syncDone, true)
+	}
+	if len(synced) != 0 {
+		t.Fatalf("the callback is called more than once for a shard, shard %d", <-synced)
+	}
+	verifyKVs(data, make(map[uint64]struct{}), t)
+}
+
+// TestSyncAllowlist tests that a peer out of the allowlist is not added for sync duties, while a peer in the
+// allowlist is added and synced with.
+func TestSyncAllowlist(t *testing.T) {
+	var (
+		kvSize      = defaultChunkSize
+		kvEntries   = uint64(16)
+		lastKvIndex = uint64(16)
+		db          = rawdb.NewMemoryDatabase()
+		ctx, cancel = context.WithCancel(context.Background())
+		mux         = new(event.Feed)
+		m           = metrics.NewMetrics("sync_test")
+		shards      = map[common.Address][]uint64{contract: {0}}
+		rollupCfg   = &rollup.EsConfig{
+			L2ChainID: new(big.Int).SetUint64(3333),
+		}
+	)
+	defer cancel()
+
+	metafile, err := CreateMetaFile(metafileName, int64(kvEntries))
+	if err != nil {
+		t.Error("Create metafileName fail", err.Error())
+	}
+	defer metafile.Close()
+
+	shardManager, files := createEthStorage(contract, []uint64{0}, defaultChunkSize, kvSize, kvEntries, common.Address{}, defaultEncodeType)
+	if shardManager == nil {
+		t.Fatalf("createEthStorage failed")
+	}
+	defer func(files []string) {
+		for _, file := range files {
+			os.Remove(file)
+		}
+	}(files)
+
+	data := makeKVStorage(contract, []uint64{0}, defaultChunkSize, kvSize, kvEntries, lastKvIndex, common.Address{}, defaultEncodeType, metafile)
+	sm := ethstorage.NewStorageManager(shardManager, NewMockL1Source(lastKvIndex, metafileName))
+	sm.Reset(0)
+	localHost, syncCl := createLocalHostAndSyncClient(t, testLog, rollupCfg, db, sm, m, mux)
+
+	smr := &mockStorageManagerReader{
+		kvEntries:       kvEntries,
+		maxKvSize:       kvSize,
+		encodeType:      defaultEncodeType,
+		shards:          []uint64{0},
+		contractAddress: contract,
+		shardMiner:      common.Address{},
+		blobPayloads:    data[contract],
+	}
+	allowedHost := createRemoteHost(t, ctx, rollupCfg, smr, db, m, testLog)
+	deniedHost := createRemoteHost(t, ctx, rollupCfg, smr, db, m, testLog)
+	syncCl.SetAllowlist([]peer.ID{allowedHost.ID()})
+	if !syncCl.IsAllowed(allowedHost.ID()) || syncCl.IsAllowed(deniedHost.ID()) {
+		t.Fatalf("allowlist is not applied")
+	}
+	syncCl.Start()
+	defer syncCl.Close()
+
+	connect(t, localHost, deniedHost, shards, shards)
+	connect(t, localHost, allowedHost, shards, shards)
+	checkStall(t, 3, mux, cancel)
+
+	syncCl.lock.Lock()
+	_, allowed := syncCl.peers[allowedHost.ID()]
+	_, denied := syncCl.peers[deniedHost.ID()]
+	syncCl.lock.Unlock()
+	if !allowed {
+		t.Fatalf("peer in the allowlist should be added")
+	}
+	if denied {
+		t.Fatalf("peer out of the allowlist should not be added")
+	}
+	if !syncCl.syncDone {
+		t.Fatalf("sync state %v is not match with expected state %v", syncCl.syncDone, true)
+	}
+	verifyKVs(data, make(map[uint64]struct{}), t)
+}
+
+// TestGiveUpHealIndexes tests that a blob no peer can serve is given up as permanently missing after it is
+// requested maxHealAttempts times, instead of being retried forever.
+func TestGiveUpHealIndexes(t *testing.T) {
+	var (
+		kvSize      = defaultChunkSize
+		kvEntries   = uint64(16)
+		lastKvIndex = uint64(16)
+		missingIdx  = uint64(5)
+		db          = rawdb.NewMemoryDatabase()
+		ctx, cancel = context.WithCancel(context.Background())
+		mux         = new(event.Feed)
+		m           = metrics.NewMetrics("sync_test")
+		shards      = map[common.Address][]uint64{contract: {0}}
+		rollupCfg   = &rollup.EsConfig{
+			L2ChainID: new(big.Int).SetUint64(3333),
+		}
+		missingCh = make(chan BlobsMissing, 4)
+	)
+	defer cancel()
+
+	metafile, err := CreateMetaFile(metafileName, int64(kvEntries))
+	if err != nil {
+		t.Error("Create metafileName fail", err.Error())
+	}
+	defer metafile.Close()
+
+	shardManager, files := createEthStorage(contract, []uint64{0}, defaultChunkSize, kvSize, kvEntries, common.Address{}, defaultEncodeType)
+	if shardManager == nil {
+		t.Fatalf("createEthStorage failed")
+	}
+	defer func(files []string) {
+		for _, file := range files {
+			os.Remove(file)
+		}
+	}(files)
+
+	data := makeKVStorage(contract, []uint64{0}, defaultChunkSize, kvSize, kvEntries, lastKvIndex, common.Address{}, defaultEncodeType, metafile)
+	sm := ethstorage.NewStorageManager(shardManager, NewMockL1Source(lastKvIndex, metafileName))
+	sm.Reset(0)
+	err = sm.DownloadAllMetas(context.Background(), 16)
+	if err != nil {
+		t.Fatal("Download blob metadata failed", "error", err)
+	}
+	localHost, syncCl := createLocalHostAndSyncClient(t, testLog, rollupCfg, db, sm, m, mux)
+	syncCl.maxHealAttempts = 2
+	sub := syncCl.SubscribeBlobsMissing(missingCh)
+	defer sub.Unsubscribe()
+	syncCl.Start()
+	defer syncCl.Close()
+
+	// neither peer has the blob of missingIdx, and a peer is not requested again once it does not return the blob,
+	// so the blob is requested once from each peer
+	for i := 0; i < syncCl.maxHealAttempts; i++ {
+		smr := &mockStorageManagerReader{
+			kvEntries:       kvEntries,
+			maxKvSize:       kvSize,
+			encodeType:      defaultEncodeType,
+			shards:          []uint64{0},
+			contractAddress: contract,
+			shardMiner:      common.Address{},
+			blobPayloads:    copyShardData(data[contract], []uint64{0}, kvEntries, map[uint64]struct{}{missingIdx: {}}),
+		}
+		remoteHost := createRemoteHost(t, ctx, rollupCfg, smr, db, m, testLog)
+		connect(t, localHost, remoteHost, shards, shards)
+	}
+
+	select {
+	case ev := <-missingCh:
+		if ev.Contract != contract || ev.ShardId != 0 || !slices.Equal(ev.Indexes, []uint64{missingIdx}) {
+			t.Fatalf("unexpected missing blobs event %v", ev)
+		}
+	case <-time.After(10 * time.Second):
+		t.Fatalf("blob %d is not given up", missingIdx)
+	}
+
+	status := syncCl.Status()
+	if !slices.Equal(status.Shards[0].PermanentlyMissing, []uint64{missingIdx}) {
+		t.Fatalf("permanently missing blobs %v, expected %v", status.Shards[0].PermanentlyMissing, []uint64{missingIdx})
+	}
+	if status.Shards[0].HealTaskSize != 0 {
+		t.Fatalf("the missing blob should be removed from the heal task, heal task size %d", status.Shards[0].HealTaskSize)
+	}
+}
+
+// TestWaitMinPeersBeforeSync tests that the sync client does not dispatch requests until minPeersBeforeSync
+// capable peers are connected.
+func TestWaitMinPeersBeforeSync(t *testing.T) {
+	var (
+		kvSize      = defaultChunkSize
+		kvEntries   = uint64(16)
+		lastKvIndex = uint64(16)
+		db          = rawdb.NewMemoryDatabase()
+		ctx, cancel = context.WithCancel(context.Background())
+		mux         = new(event.Feed)
+		m           = metrics.NewMetrics("sync_test")
+		shards      = map[common.Address][]uint64{contract: {0}}
+		rollupCfg   = &rollup.EsConfig{
+			L2ChainID: new(big.Int).SetUint64(3333),
+		}
+	)
+	defer cancel()
+
+	metafile, err := CreateMetaFile(metafileName, int64(kvEntries))
+	if err != nil {
+		t.Error("Create metafileName fail", err.Error())
+	}
+	defer metafile.Close()
+
+	shardManager, files := createEthStorage(contract, []uint64{0}, defaultChunkSize, kvSize, kvEntries, common.Address{}, defaultEncodeType)
+	if shardManager == nil {
+		t.Fatalf("createEthStorage failed")
+	}
+	defer func(files []string) {
+		for _, file := range files {
+			os.Remove(file)
+		}
+	}(files)
+
+	data := makeKVStorage(contract, []uint64{0}, defaultChunkSize, kvSize, kvEntries, lastKvIndex, common.Address{}, defaultEncodeType, metafile)
+	sm := ethstorage.NewStorageManager(shardManager, NewMockL1Source(lastKvIndex, metafileName))
+	sm.Reset(0)
+	localHost, syncCl := createLocalHostAndSyncClient(t, testLog, rollupCfg, db, sm, m, mux)
+	syncCl.minPeersBeforeSync, syncCl.minPeersTimeout = 2, time.Minute
+	syncCl.Start()
+	defer syncCl.Close()
+
+	smrs := make([]*mockStorageManagerReader, 2)
+	remoteHosts := make([]host.Host, 2)
+	for i := range smrs {
+		smrs[i] = &mockStorageManagerReader{
+			kvEntries:       kvEntries,
+			maxKvSize:       kvSize,
+			encodeType:      defaultEncodeType,
+			shards:          []uint64{0},
+			contractAddress: contract,
+			shardMiner:      common.Address{},
+			blobPayloads:    data[contract],
+		}
+		remoteHosts[i] = createRemoteHost(t, ctx, rollupCfg, smrs[i], db, m, testLog)
+	}
+
+	connect(t, localHost, remoteHosts[0], shards, shards)
+	time.Sleep(time.Second)
+	smrs[0].readIdxs.Range(func(key, _ any) bool {
+		t.Fatalf("blob %d is requested before enough peers are connected", key.(uint64))
+		return false
+	})
+
+	connect(t, localHost, remoteHosts[1], shards, shards)
+	checkStall(t, 3, mux, cancel)
+	if !syncCl.syncDone {
+		t.Fatalf("sync state %v is not match with expected state %v", syncCl.syncDone, true)
+	}
+	verifyKVs(data, make(map[uint64]struct{}), t)
+}
+
+// TestResumeSubTaskProgress tests that the progress in the middle of a subTask is saved shortly after the blobs are
+// committed, so after a restart only the blobs not committed yet are requested again.
+func TestResumeSubTaskProgress(t *testing.T) {
+	var (
+		kvSize      = defaultChunkSize
+		kvEntries   = uint64(64)
+		lastKvIndex = uint64(64)
+		db          = rawdb.NewMemoryDatabase()
+		ctx, cancel = context.WithCancel(context.Background())
+		mux         = new(event.Feed)
+		m           = metrics.NewMetrics("sync_test")
+		shards      = map[common.Address][]uint64{contract: {0}}
+		rollupCfg   = &rollup.EsConfig{
+			L2ChainID: new(big.Int).SetUint64(3333),
+		}
+		// the first peer fails to serve the tail of subTask [32, 48)
+		tail = map[uint64]struct{}{40: {}, 41: {}, 42: {}, 43: {}, 44: {}, 45: {}, 46: {}, 47: {}}
+	)
+	defer cancel()
+
+	metafile, err := CreateMetaFile(metafileName, int64(kvEntries))
+	if err != nil {
+		t.Error("Create metafileName fail", err.Error())
+	}
+	defer metafile.Close()
+
+	shardManager, files := createEthStorage(contract, []uint64{0}, defaultChunkSize, kvSize, kvEntries, common.Address{}, defaultEncodeType)
+	if shardManager == nil {
+		t.Fatalf("createEthStorage failed")
+	}
+	defer func(files []string) {
+		for _, file := range files {
+			os.Remove(file)
+		}
+	}(files)
+
+	data := makeKVStorage(contract, []uint64{0}, defaultChunkSize, kvSize, kvEntries, lastKvIndex, common.Address{}, defaultEncodeType, metafile)
+	sm := ethstorage.NewStorageManager(shardManager, NewMockL1Source(lastKvIndex, metafileName))
+	sm.Reset(0)
+	localHost, syncCl := createLocalHostAndSyncClient(t, testLog, rollupCfg, db, sm, m, mux)
+	syncCl.progressSaveInterval = 100 * time.Millisecond
+	syncCl.Start()
+
+	smr := &mockStorageManagerReader{
+		kvEntries:       kvEntries,
+		maxKvSize:       kvSize,
+		encodeType:      defaultEncodeType,
+		shards:          []uint64{0},
+		contractAddress: contract,
+		shardMiner:      common.Address{},
+		blobPayloads:    copyShardData(data[contract], []uint64{0}, kvEntries, tail),
+	}
+	remoteHost := createRemoteHost(t, ctx, rollupCfg, smr, db, m, testLog)
+	connect(t, localHost, remoteHost, shards, shards)
+
+	// take the saved status before Close once only the tail is left, as if the node crashed
+	var (
+		status   []byte
+		progress SyncProgress
+	)
+	for i := 0; i < 100; i++ {
+		status, _ = db.Get(SyncTasksKey)
+		if status != nil {
+			if err := json.Unmarshal(status, &progress); err != nil {
+				t.Fatalf("decode sync status failed: %s", err.Error())
+			}
+			if len(progress.Tasks) == 1 && len(progress.Tasks[0].SubTasks) == 1 {
+				break
+			}
+		}
+		time.Sleep(200 * time.Millisecond)
+	}
+	if status == nil {
+		t.Fatalf("the progress is not saved")
+	}
+	if len(progress.Tasks) != 1 || len(progress.Tasks[0].SubTasks) != 1 {
+		t.Fatalf("only the subTask with the tail should be saved, progress %v", progress.Tasks)
+	}
+	if st := progress.Tasks[0].SubTasks[0]; st.First != 40 || st.Last != 48 {
+		t.Fatalf("subTask should resume from 40 to 48, saved from %d to %d", st.First, st.Last)
+	}
+	syncCl.Close()
+
+	newDb := rawdb.NewMemoryDatabase()
+	if err := newDb.Put(SyncTasksKey, status); err != nil {
+		t.Fatalf("save sync status failed: %s", err.Error())
+	}
+	localHost, syncCl = createLocalHostAndSyncClient(t, testLog, rollupCfg, newDb, sm, m, mux)
+	syncCl.Start()
+	defer syncCl.Close()
+
+	smr = &mockStorageManagerReader{
+		kvEntries:       kvEntries,
+		maxKvSize:       kvSize,
+		encodeType:      defaultEncodeType,
+		shards:          []uint64{0},
+		contractAddress: contract,
+		shardMiner:      common.Address{},
+		blobPayloads:    data[contract],
+	}
+	remoteHost = createRemoteHost(t, ctx, rollupCfg, smr, db, m, testLog)
+	connect(t, localHost, remoteHost, shards, shards)
+	checkStall(t, 3, mux, cancel)
+	if !syncCl.syncDone {
+		t.Fatalf("sync state %v is not match with expected state %v", syncCl.syncDone, true)
+	}
+	verifyKVs(data, make(map[uint64]struct{}), t)
+	smr.readIdxs.Range(func(key, _ any) bool {
+		if _, ok := tail[key.(uint64)]; !ok {
+			t.Errorf("blob %d committed before the restart is requested again", key.(uint64))
+		}
+		return true
+	})
+}
+
+// makeShardsENR creates a node with an ENR advertising the shards, or without an ethstorage ENR entry if shards is nil.
+func makeShardsENR(t *testing.T, shards map[common.Address][]uint64) *enode.Node {
+	key, err := crypto.GenerateKey()
+	if err != nil {
+		t.Fatalf("generate key failed: %v", err)
+	}
+	var r enr.Record
+	if shards != nil {
+		r.Set(&EthStorageENRData{ChainID: 1, Version: 0, Shards: ConvertToContractShards(shards)})
+	}
+	if err := enode.SignV4(&r, key); err != nil {
+		t.Fatalf("sign ENR failed: %v", err)
+	}
+	node, err := enode.New(enode.ValidSchemes, &r)
+	if err != nil {
+		t.Fatalf("create node failed: %v", err)
+	}
+	return node
+}
+
+// TestRankNodesByShardOverlap tests the discovered nodes are ranked by the overlap between the shards advertised
+// in their ENRs and the local shards, and the nodes with the same overlap keep their order.
+func TestRankNodesByShardOverlap(t *testing.T) {
+	var (
+		contract  = common.HexToAddress("0x0000000000000000000000000000000003330001")
+		contract2 = common.HexToAddress("0x0000000000000000000000000000000003330002")
+		local     = map[common.Address][]uint64{contract: {0, 1, 2}, contract2: {0}}
+	)
+
+	none := makeShardsENR(t, nil)
+	other := makeShardsENR(t, map[common.Address][]uint64{contract: {3, 4}})
+	one := makeShardsENR(t, map[common.Address][]uint64{contract: {2, 3}})
+	one2 := makeShardsENR(t, map[common.Address][]uint64{contract2: {0, 1}})
+	two := makeShardsENR(t, map[common.Address][]uint64{contract: {0, 1, 5}})
+	all := makeShardsENR(t, map[common.Address][]uint64{contract: {0, 1, 2}, contract2: {0}})
+
+	nodes := []*enode.Node{none, other, one, two, one2, all}
+	RankNodesByShardOverlap(nodes, local)
+
+	expected := []*enode.Node{all, two, one, one2, other, none}
+	for i, node := range nodes {
+		if node.ID() != expected[i].ID() {
+			t.Errorf("node %d mismatch, expected %s, got %s", i, expected[i].ID(), node.ID())
+		}
+	}
+
+	if overlap := ShardOverlap(local, nil); overlap != 0 {
+		t.Errorf("overlap without remote shards should be 0, got %d", overlap)
+	}
+	// the shards of a contract listed more than once are merged
+	remote := []*ContractShards{{contract, []uint64{0, 1}}, {contract, []uint64{1, 2}}}
+	if overlap := ShardOverlap(local, remote); overlap != 3 {
+		t.Errorf("overlap mismatch, expected 3, got %d", overlap)
+	}
+}
+
+// TestPauseAndResumeSync tests no blob is committed or filled while the sync is paused, and the sync completes
+// after it is resumed.
+func TestPauseAndResumeSync(t *testing.T) {
+	var (
+		kvSize      = defaultChunkSize
+		kvEntries   = uint64(64)
+		lastKvIndex = uint64(48)
+		db          = rawdb.NewMemoryDatabase()
+		ctx, cancel = context.WithCancel(context.Background())
+		mux         = new(event.Feed)
+		m           = metrics.NewMetrics("sync_test")
+		shards      = map[common.Address][]uint64{contract: {0}}
+		rollupCfg   = &rollup.EsConfig{
+			L2ChainID: new(big.Int).SetUint64(3333),
+		}
+	)
+	defer cancel()
+
+	metafile, err := CreateMetaFile(metafileName, int64(kvEntries))
+	if err != nil {
+		t.Error("Create metafileName fail", err.Error())
+	}
+	defer metafile.Close()
+
+	shardManager, files := createEthStorage(contract, []uint64{0}, defaultChunkSize, kvSize, kvEntries, common.Address{}, defaultEncodeType)
+	if shardManager == nil {
+		t.Fatalf("createEthStorage failed")
+	}
+	defer func(files []string) {
+		for _, file := range files {
+			os.Remove(file)
+		}
+	}(files)
+
+	data := makeKVStorage(contract, []uint64{0}, defaultChunkSize, kvSize, kvEntries, lastKvIndex, common.Address{}, defaultEncodeType, metafile)
+	sm := ethstorage.NewStorageManager(shardManager, NewMockL1Source(lastKvIndex, metafileName))
+	sm.Reset(0)
+	localHost, syncCl := createLocalHostAndSyncClient(t, testLog, rollupCfg, db, sm, m, mux)
+	pausedCh := make(chan SyncPaused, 2)
+	sub := syncCl.SubscribeSyncPaused(pausedCh)
+	defer sub.Unsubscribe()
+	syncCl.Start()
+	defer syncCl.Close()
+
+	smr := &mockStorageManagerReader{
+		kvEntries:       kvEntries,
+		maxKvSize:       kvSize,
+		encodeType:      defaultEncodeType,
+		shards:          []uint64{0},
+		contractAddress: contract,
+		shardMiner:      common.Address{},
+		blobPayloads:    data[contract],
+		readDelay:       50 * time.Millisecond,
+	}
+	remoteHost := createRemoteHost(t, ctx, rollupCfg, smr, db, m, testLog)
+	connect(t, localHost, remoteHost, shards, shards)
+	time.Sleep(300 * time.Millisecond)
+
+	syncCl.Pause()
+	if ev := <-pausedCh; !ev.Paused {
+		t.Fatalf("SyncPaused event with Paused should be sent on pause")
+	}
+	// wait for the in-flight requests and fill empty workers to finish
+	settled := func() bool {
+		syncCl.lock.Lock()
+		defer syncCl.lock.Unlock()
+		return syncCl.inFlight == 0 && syncCl.runningFillEmptyTaskTreads == 0
+	}
+	deadline := time.Now().Add(30 * time.Second)
+	for !settled() {
+		if time.Now().After(deadline) {
+			t.Fatalf("in-flight requests are not finished while paused")
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+	before := syncCl.Status()
+	if !before.Paused {
+		t.Fatalf("status should be paused")
+	}
+	if before.SyncDone {
+		t.Fatalf("sync should not be done before resumed")
+	}
+	time.Sleep(time.Second)
+	after := syncCl.Status()
+	for i, shard := range after.Shards {
+		if shard.BlobsSynced != before.Shards[i].BlobsSynced || shard.EmptyFilled != before.Shards[i].EmptyFilled {
+			t.Fatalf("blobs committed while paused, synced %d -> %d, filled %d -> %d", before.Shards[i].BlobsSynced,
+				shard.BlobsSynced, before.Shards[i].EmptyFilled, shard.EmptyFilled)
+		}
+	}
+
+	syncCl.Resume()
+	if ev := <-pausedCh; ev.Paused {
+		t.Fatalf("SyncPaused event without Paused should be sent on resume")
+	}
+	// the pause is not counted in the stall timeout
+	if elapsed := time.Since(time.Unix(0, syncCl.lastCommitTime.Load())); elapsed > time.Second {
+		t.Fatalf("last commit time should be reset on resume, elapsed %v", elapsed)
+	}
+	checkStall(t, 10, mux, cancel)
+	if !syncCl.syncDone {
+		t.Fatalf("sync state %v is not match with expected state %v", syncCl.syncDone, true)
+	}
+	if syncCl.Status().Paused {
+		t.Fatalf("status should not be paused after resumed")
+	}
+	verifyKVs(data, make(map[uint64]struct{}), t)
+}
+
+// TestWriteQueueBackPressure tests the receivers block when the disk writes fall behind, so the number of the
+// batches queued to be written is bounded by the queue size.
+func TestWriteQueueBackPressure(t *testing.T) {
+	var (
+		queueSize   = 2
+		receivers   = 10
+		writeDelay  = 50 * time.Millisecond
+		maxDepth    atomic.Int64
+		written     atomic.Int64
+		ctx, cancel = context.WithCancel(context.Background())
+	)
+	defer cancel()
+
+	slowCommit := func(sm StorageManager, kvIndices []uint64, decodedBlobs [][]byte, commits []common.Hash, force bool) ([]uint64, error) {
+		time.Sleep(writeDelay)
+		written.Add(int64(len(kvIndices)))
+		return kvIndices, nil
+	}
+	setDepth := func(depth int) {
+		for {
+			cur := maxDepth.Load()
+			if int64(depth) <= cur || maxDepth.CompareAndSwap(cur, int64(depth)) {
+				return
+			}
+		}
+	}
+	q := newWriteQueue(queueSize, slowCommit, setDepth)
+	go q.loop(ctx)
+
+	start := time.Now()
+	var wg sync.WaitGroup
+	for i := 0; i < receivers; i++ {
+		wg.Add(1)
+		go func(kvIdx uint64) {
+			defer wg.Done()
+			inserted, err := q.submit(ctx, nil, []uint64{kvIdx}, [][]byte{make([]byte, 32)}, []common.Hash{{}}, false)
+			if err != nil || len(inserted) != 1 || inserted[0] != kvIdx {
+				t.Errorf("write kv %d failed, inserted %v, err %v", kvIdx, inserted, err)
+			}
+		}(uint64(i))
+	}
+	wg.Wait()
+
+	if depth := maxDepth.Load(); depth > int64(queueSize) {
+		t.Fatalf("write queue depth %d exceeds the queue size %d", depth, queueSize)
+	}
+	if n := written.Load(); n != int64(receivers) {
+		t.Fatalf("expected %d blobs written, got %d", receivers, n)
+	}
+	// the batches are written one by one, so the receivers wait for the slow writes
+	if elapsed := time.Since(start); elapsed < time.Duration(receivers)*writeDelay {
+		t.Fatalf("receivers returned in %v before the writes are done", elapsed)
+	}
+
+	// the receivers stop waiting once the sync client is closed
+	cancel()
+	if _, err := q.submit(ctx, nil, []uint64{0}, [][]byte{make([]byte, 32)}, []common.Hash{{}}, false); !errors.Is(err, errWriteQueueClosed) {
+		t.Fatalf("expected errWriteQueueClosed, got %v", err)
+	}
+}
+
+// TestRejectMismatchedEncodeType tests no request is sent to the peer with a different encode type of the shard
+// with EncodeTypeRejectMismatch, and the shard is synced from the peer with the same encode type.
+func TestRejectMismatchedEncodeType(t *testing.T) {
+	var (
+		kvSize      = defaultChunkSize
+		kvEntries   = uint64(16)
+		lastKvIndex = uint64(16)
+		db          = rawdb.NewMemoryDatabase()
+		ctx, cancel = context.WithCancel(context.Background())
+		mux         = new(event.Feed)
+		m           = metrics.NewMetrics("sync_test")
+		shards      = map[common.Address][]uint64{contract: {0}}
+		rollupCfg   = &rollup.EsConfig{
+			L2ChainID: new(big.Int).SetUint64(3333),
+		}
+	)
+	defer cancel()
+
+	metafile, err := CreateMetaFile(metafileName, int64(kvEntries))
+	if err != nil {
+		t.Error("Create metafileName fail", err.Error())
+	}
+	defer metafile.Close()
+
+	shardManager, files := createEthStorage(contract, []uint64{0}, defaultChunkSize, kvSize, kvEntries, common.Address{}, defaultEncodeType)
+	if shardManager == nil {
+		t.Fatalf("createEthStorage failed")
+	}
+	defer func(files []string) {
+		for _, file := range files {
+			os.Remove(file)
+		}
+	}(files)
+
+	data := makeKVStorage(contract, []uint64{0}, defaultChunkSize, kvSize, kvEntries, lastKvIndex, common.Address{}, defaultEncodeType, metafile)
+	sm := ethstorage.NewStorageManager(shardManager, NewMockL1Source(lastKvIndex, metafileName))
+	sm.Reset(0)
+	localHost, syncCl := createLocalHostAndSyncClient(t, testLog, rollupCfg, db, sm, m, mux)
+	syncCl.encodeTypePolicy = EncodeTypeRejectMismatch
+	syncCl.Start()
+	defer syncCl.Close()
+
+	createHost := func(encodeType uint64) (host.Host, *mockStorageManagerReader) {
+		smr := &mockStorageManagerReader{
+			kvEntries:       kvEntries,
+			maxKvSize:       kvSize,
+			encodeType:      encodeType,
+			shards:          []uint64{0},
+			contractAddress: contract,
+			shardMiner:      common.Address{},
+			blobPayloads:    data[contract],
+			lastKvIndex:     lastKvIndex,
+		}
+		remoteHost := createRemoteHost(t, ctx, rollupCfg, smr, db, m, testLog)
+		syncSrv := NewSyncServer(rollupCfg, smr, db, m)
+		remoteHost.SetStreamHandler(RequestCapabilities, MakeStreamHandler(ctx, testLog, syncSrv.HandleRequestCapabilities))
+		return remoteHost, smr
+	}
+	mismatchedHost, mismatched := createHost(ethstorage.ENCODE_KECCAK_256)
+	matchedHost, matched := createHost(defaultEncodeType)
+
+	connect(t, localHost, mismatchedHost, shards, shards)
+	time.Sleep(500 * time.Millisecond)
+	connect(t, localHost, matchedHost, shards, shards)
+	checkStall(t, 3, mux, cancel)
+
+	if !syncCl.syncDone {
+		t.Fatalf("sync state %v is not match with expected state %v", syncCl.syncDone, true)
+	}
+	if reads := mismatched.reads.Load(); reads != 0 {
+		t.Fatalf("%d blobs requested from the peer with a different encode type", reads)
+	}
+	if matched.reads.Load() == 0 {
+		t.Fatalf("no blob requested from the peer with the same encode type")
+	}
+	syncCl.lock.Lock()
+	pr, ok := syncCl.peers[mismatchedHost.ID()]
+	var (
+		encodeType uint64
+		known      bool
+	)
+	if ok {
+		encodeType, known = pr.EncodeType(contract, 0)
+	}
+	syncCl.lock.Unlock()
+	if !known || encodeType != ethstorage.ENCODE_KECCAK_256 {
+		t.Fatalf("encode type of the peer should be known from its capabilities, got %d, known %v", encodeType, known)
+	}
+	verifyKVs(data, make(map[uint64]struct{}), t)
+}
+
+// TestChunkProof tests a chunk of a blob with its KZG proof served by the remote peer can be verified against
+// the commit of the blob, and not against the commit of another blob.
+func TestChunkProof(t *testing.T) {
+	var (
+		kvSize      = defaultChunkSize
+		kvEntries   = uint64(16)
+		lastKvIndex = uint64(4)
+		db          = rawdb.NewMemoryDatabase()
+		ctx, cancel = context.WithCancel(context.Background())
+		mux         = new(event.Feed)
+		m           = metrics.NewMetrics("sync_test")
+		shards      = map[common.Address][]uint64{contract: {0}}
+		rollupCfg   = &rollup.EsConfig{
+			L2ChainID: new(big.Int).SetUint64(3333),
+		}
+	)
+	defer cancel()
+
+	metafile, err := CreateMetaFile(metafileName, int64(kvEntries))
+	if err != nil {
+		t.Error("Create metafileName fail", err.Error())
+	}
+	defer metafile.Close()
+
+	shardManager, files := createEthStorage(contract, []uint64{0}, defaultChunkSize, kvSize, kvEntries, common.Address{}, defaultEncodeType)
+	if shardManager == nil {
+		t.Fatalf("createEthStorage failed")
+	}
+	defer func(files []string) {
+		for _, file := range files {
+			os.Remove(file)
+		}
+	}(files)
+
+	data := makeKVStorage(contract, []uint64{0}, defaultChunkSize, kvSize, kvEntries, lastKvIndex, common.Address{}, defaultEncodeType, metafile)
+	sm := ethstorage.NewStorageManager(shardManager, NewMockL1Source(lastKvIndex, metafileName))
+	sm.Reset(0)
+	localHost, syncCl := createLocalHostAndSyncClient(t, testLog, rollupCfg, db, sm, m, mux)
+	syncCl.Start()
+	defer syncCl.Close()
+
+	smr := &mockStorageManagerReader{
+		kvEntries:       kvEntries,
+		maxKvSize:       kvSize,
+		encodeType:      defaultEncodeType,
+		shards:          []uint64{0},
+		contractAddress: contract,
+		shardMiner:      common.Address{},
+		blobPayloads:    data[contract],
+	}
+	remoteHost := createRemoteHost(t, ctx, rollupCfg, smr, db, m, testLog)
+	syncSrv := NewSyncServer(rollupCfg, smr, db, m)
+	remoteHost.SetStreamHandler(GetProtocolID(RequestChunkProofProtocolID, rollupCfg.L2ChainID),
+		MakeStreamHandler(ctx, testLog, syncSrv.HandleGetChunkProofRequest))
+	connect(t, localHost, remoteHost, shards, shards)
+	time.Sleep(500 * time.Millisecond)
+
+	for _, chunkIdx := range []uint64{0, 1, 4095} {
+		res, err := syncCl.RequestChunkProof(remoteHost.ID(), 1, chunkIdx)
+		if err != nil {
+			t.Fatalf("request chunk proof of chunk %d failed: %v", chunkIdx, err)
+		}
+		if !bytes.Equal(res.Chunk, data[contract][1].RowData[chunkIdx*32:(chunkIdx+1)*32]) {
+			t.Fatalf("chunk %d mismatches the blob", chunkIdx)
+		}
+		if err := VerifyChunkProof(prover, res, data[contract][1].BlobCommit); err != nil {
+			t.Fatalf("verify chunk proof of chunk %d failed: %v", chunkIdx, err)
+		}
+		if err := VerifyChunkProof(prover, res, data[contract][2].BlobCommit); err == nil {
+			t.Fatalf("chunk proof of chunk %d verified against the commit of another blob", chunkIdx)
+		}
+	}
+
+	if _, err := syncCl.RequestChunkProof(remoteHost.ID(), 1, kvSize/32); err == nil {
+		t.Fatalf("chunk out of the blob should be rejected")
+	}
+}
+
+// TestSyncRateAndETA tests the sync rate and the ETA of a shard in the status, the blobs are served one by one
+// with a fixed delay, so the ETA taken in the middle of the sync should be close to the time the sync takes to finish.
+func TestSyncRateAndETA(t *testing.T) {
+	var (
+		kvSize      = defaultChunkSize
+		kvEntries   = uint64(64)
+		lastKvIndex = uint64(40)
+		readDelay   = 100 * time.Millisecond
+		warmupBlobs = uint64(8)
+		db          = rawdb.NewMemoryDatabase()
+		ctx, cancel = context.WithCancel(context.Background())
+		mux         = new(event.Feed)
+		m           = metrics.NewMetrics("sync_test")
+		shards      = map[common.Address][]uint64{contract: {0}}
+		rollupCfg   = &rollup.EsConfig{
+			L2ChainID: new(big.Int).SetUint64(3333),
+		}
+	)
+	defer cancel()
+
+	metafile, err := CreateMetaFile(metafileName, int64(kvEntries))
+	if err != nil {
+		t.Error("Create metafileName fail", err.Error())
+	}
+	defer metafile.Close()
+
+	shardManager, files := createEthStorage(contract, []uint64{0}, defaultChunkSize, kvSize, kvEntries, common.Address{}, defaultEncodeType)
+	if shardManager == nil {
+		t.Fatalf("createEthStorage failed")
+	}
+	defer func(files []string) {
+		for _, file := range files {
+			os.Remove(file)
+		}
+	}(files)
+
+	data := makeKVStorage(contract, []uint64{0}, defaultChunkSize, kvSize, kvEntries, lastKvIndex, common.Address{}, defaultEncodeType, metafile)
+	sm := ethstorage.NewStorageManager(shardManager, NewMockL1Source(lastKvIndex, metafileName))
+	sm.Reset(0)
+	localHost, syncCl := createLocalHostAndSyncClient(t, testLog, rollupCfg, db, sm, m, mux)
+	// request a blob at a time, so the blobs are committed at a steady rate
+	syncCl.minRangeBatchSize, syncCl.maxRangeBatchSize = 1, 1
+	syncCl.Start()
+	defer syncCl.Close()
+
+	smr := &mockStorageManagerReader{
+		kvEntries:       kvEntries,
+		maxKvSize:       kvSize,
+		encodeType:      defaultEncodeType,
+		shards:          []uint64{0},
+		contractAddress: contract,
+		shardMiner:      common.Address{},
+		blobPayloads:    data[contract],
+		readDelay:       readDelay,
+	}
+	remoteHost := createRemoteHost(t, ctx, rollupCfg, smr, db, m, testLog)
+	connect(t, localHost, remoteHost, shards, shards)
+
+	// take the ETA once a few blobs are synced, as the first blobs are slowed down by the start of the sync
+	var shard ShardStatus
+	for deadline := time.Now().Add(30 * time.Second); ; time.Sleep(20 * time.Millisecond) {
+		shard = syncCl.Status().Shards[0]
+		if shard.BlobsToSync <= lastKvIndex-warmupBlobs {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("blobs are not synced in time")
+		}
+	}
+	start := time.Now()
+	if shard.BlobsToSync == 0 {
+		t.Fatalf("sync finished too early to estimate")
+	}
+	if shard.BlobsPerSec <= 0 || shard.BlobsPerSec > float64(time.Second/readDelay) {
+		t.Fatalf("blobs per second %.2f is out of (0, %d]", shard.BlobsPerSec, time.Second/readDelay)
+	}
+	if shard.ETASeconds <= 0 {
+		t.Fatalf("ETA %.2f should be positive while blobs remain", shard.ETASeconds)
+	}
+
+	for syncCl.Status().Shards[0].BlobsToSync != 0 {
+		if time.Since(start) > 30*time.Second {
+			t.Fatalf("blobs are not synced in time")
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+	actual := time.Since(start).Seconds()
+	if math.Abs(shard.ETASeconds-actual) > actual*0.5 {
+		t.Fatalf("ETA %.2fs is not close to the actual %.2fs", shard.ETASeconds, actual)
+	}
+	if eta := syncCl.Status().Shards[0].ETASeconds; eta != 0 {
+		t.Fatalf("ETA %.2f should be 0 once synced", eta)
+	}
+}
+
+// TestBlobsByCommit tests the blobs are served by their commits, a blob stored at several kv indexes is served
+// once, an unknown commit is omitted, the commit index follows the overwritten blobs, and the commits of each
+// contract served are indexed separately.
+func TestBlobsByCommit(t *testing.T) {
+	var (
+		kvSize      = defaultChunkSize
+		kvEntries   = uint64(16)
+		lastKvIndex = uint64(8)
+		db          = rawdb.NewMemoryDatabase()
+		ctx, cancel = context.WithCancel(context.Background())
+		mux         = new(event.Feed)
+		m           = metrics.NewMetrics("sync_test")
+		shards      = map[common.Address][]uint64{contract: {0}}
+		rollupCfg   = &rollup.EsConfig{
+			L2ChainID: new(big.Int).SetUint64(3333),
+		}
+	)
+	defer cancel()
+
+	metafile, err := CreateMetaFile(metafileName, int64(kvEntries))
+	if err != nil {
+		t.Error("Create metafileName fail", err.Error())
+	}
+	defer metafile.Close()
+
+	shardManager, files := createEthStorage(contract, []uint64{0}, defaultChunkSize, kvSize, kvEntries, common.Address{}, defaultEncodeType)
+	if shardManager == nil {
+		t.Fatalf("createEthStorage failed")
+	}
+	defer func(files []string) {
+		for _, file := range files {
+			os.Remove(file)
+		}
+	}(files)
+
+	data := makeKVStorage(contract, []uint64{0}, defaultChunkSize, kvSize, kvEntries, lastKvIndex, common.Address{}, defaultEncodeType, metafile)
+	sm := ethstorage.NewStorageManager(shardManager, NewMockL1Source(lastKvIndex, metafileName))
+	sm.Reset(0)
+	localHost, syncCl := createLocalHostAndSyncClient(t, testLog, rollupCfg, db, sm, m, mux)
+	syncCl.Start()
+	defer syncCl.Close()
+
+	// the remote stores the blob of kv 3 at kv 5 too
+	payloads := make(map[uint64]*BlobPayloadWithRowData, len(data[contract]))
+	for idx, payload := range data[contract] {
+		payloads[idx] = payload
+	}
+	duplicate := *payloads[3]
+	duplicate.BlobIndex = 5
+	payloads[5] = &duplicate
+	smr := &mockStorageManagerReader{
+		kvEntries:       kvEntries,
+		maxKvSize:       kvSize,
+		encodeType:      defaultEncodeType,
+		shards:          []uint64{0},
+		contractAddress: contract,
+		shardMiner:      common.Address{},
+		blobPayloads:    payloads,
+		lastKvIndex:     lastKvIndex,
+	}
+	remoteHost := createRemoteHost(t, ctx, rollupCfg, smr, db, m, testLog)
+	syncSrv := NewSyncServer(rollupCfg, smr, db, m)
+	// the remote stores the blob of kv 1 only of another contract
+	contract2 := common.HexToAddress("0x0000000000000000000000000000000003330002")
+	err = syncSrv.AddContract(&mockStorageManagerReader{
+		kvEntries:       kvEntries,
+		maxKvSize:       kvSize,
+		encodeType:      defaultEncodeType,
+		shards:          []uint64{0},
+		contractAddress: contract2,
+		shardMiner:      common.Address{},
+		blobPayloads:    map[uint64]*BlobPayloadWithRowData{1: payloads[1]},
+		lastKvIndex:     lastKvIndex,
+	})
+	if err != nil {
+		t.Fatalf("add contract to sync server failed: %s", err.Error())
+	}
+	remoteHost.SetStreamHandler(GetProtocolID(RequestBlobsByCommitProtocolID, rollupCfg.L2ChainID),
+		MakeStreamHandler(ctx, testLog, syncSrv.HandleGetBlobsByCommitRequest))
+	connect(t, localHost, remoteHost, shards, shards)
+	time.Sleep(500 * time.Millisecond)
+	<-syncSrv.commitIndexOf(contract).indexed
+	<-syncSrv.commitIndexOf(contract2).indexed
+
+	unknown := common.HexToHash("0x1234")
+	blobs, err := syncCl.RequestBlobsByCommit(remoteHost.ID(), contract, []common.Hash{payloads[1].BlobCommit, unknown, payloads[3].BlobCommit})
+	if err != nil {
+		t.Fatalf("request blobs by commit failed: %v", err)
+	}
+	if len(blobs) != 2 {
+		t.Fatalf("expected 2 blobs, got %d", len(blobs))
+	}
+	for i, idx := range []uint64{1, 3} {
+		if blobs[i].BlobIndex != idx || blobs[i].BlobCommit != payloads[idx].BlobCommit ||
+			!bytes.Equal(blobs[i].EncodedBlob, payloads[idx].EncodedBlob) {
+			t.Fatalf("blob %d mismatches kv %d", blobs[i].BlobIndex, idx)
+		}
+	}
+
+	blobs, err = syncCl.RequestBlobsByCommit(remoteHost.ID(), contract, []common.Hash{unknown})
+	if err != nil {
+		t.Fatalf("request blobs by unknown commit failed: %v", err)
+	}
+	if len(blobs) != 0 {
+		t.Fatalf("expected no blob of unknown commit, got %d", len(blobs))
+	}
+
+	blobs, err = syncCl.RequestBlobsByCommit(remoteHost.ID(), contract2, []common.Hash{payloads[1].BlobCommit, payloads[3].BlobCommit})
+	if err != nil {
+		t.Fatalf("request blobs of contract %s by commit failed: %v", contract2.Hex(), err)
+	}
+	if len(blobs) != 1 || blobs[0].BlobIndex != 1 {
+		t.Fatalf("expected the blob of kv 1 of contract %s only, got %v", contract2.Hex(), blobs)
+	}
+	if _, err = syncCl.RequestBlobsByCommit(remoteHost.ID(), common.HexToAddress("0x1"), []common.Hash{payloads[1].BlobCommit}); err == nil {
+		t.Fatalf("request blobs of a contract not served should fail")
+	}
+
+	// the duplicate is served once kv 3 is overwritten
+	payloads[3] = payloads[2]
+	syncSrv.InvalidateBlobs([]uint64{3})
+	syncSrv.IndexBlob(3, payloads[2].BlobCommit, false)
+	blobs, err = syncCl.RequestBlobsByCommit(remoteHost.ID(), contract, []common.Hash{duplicate.BlobCommit})
+	if err != nil {
+		t.Fatalf("request blobs by commit failed: %v", err)
+	}
+	if len(blobs) != 1 || blobs[0].BlobIndex != 5 {
+		t.Fatalf("expected the blob of kv 5 once kv 3 is overwritten, got %v", blobs)
+	}
+}
+
+// TestStreamResetRetried tests a stream reset by the peer in the middle of a response is counted in the stats of
+// the peer, and the subTask of the failed request is retried until the sync is done.
+func TestStreamResetRetried(t *testing.T) {
+	var (
+		kvSize      = defaultChunkSize
+		kvEntries   = uint64(16)
+		lastKvIndex = uint64(16)
+		db          = rawdb.NewMemoryDatabase()
+		ctx, cancel = context.WithCancel(context.Background())
+		mux         = new(event.Feed)
+		m           = metrics.NewMetrics("sync_test")
+		shards      = map[common.Address][]uint64{contract: {0}}
+		rollupCfg   = &rollup.EsConfig{
+			L2ChainID: new(big.Int).SetUint64(3333),
+		}
+		requests atomic.Int32
+	)
+	defer cancel()
+
+	metafile, err := CreateMetaFile(metafileName, int64(kvEntries))
+	if err != nil {
+		t.Error("Create metafileName fail", err.Error())
+	}
+	defer metafile.Close()
+
+	shardManager, files := createEthStorage(contract, []uint64{0}, defaultChunkSize, kvSize, kvEntries, common.Address{}, defaultEncodeType)
+	if shardManager == nil {
+		t.Fatalf("createEthStorage failed")
+	}
+	defer func(files []string) {
+		for _, file := range files {
+			os.Remove(file)
+		}
+	}(files)
+
+	data := makeKVStorage(contract, []uint64{0}, defaultChunkSize, kvSize, kvEntries, lastKvIndex, common.Address{}, defaultEncodeType, metafile)
+	sm := ethstorage.NewStorageManager(shardManager, NewMockL1Source(lastKvIndex, metafileName))
+	sm.Reset(0)
+	localHost, syncCl := createLocalHostAndSyncClient(t, testLog, rollupCfg, db, sm, m, mux)
+	syncCl.Start()
+	defer syncCl.Close()
+
+	smr := &mockStorageManagerReader{
+		kvEntries:       kvEntries,
+		maxKvSize:       kvSize,
+		encodeType:      defaultEncodeType,
+		shards:          []uint64{0},
+		contractAddress: contract,
+		shardMiner:      common.Address{},
+		blobPayloads:    data[contract],
+	}
+	remoteHost := createRemoteHost(t, ctx, rollupCfg, smr, db, m, testLog)
+	syncSrv := NewSyncServer(rollupCfg, smr, db, m)
+	rangeHandler := MakeStreamHandler(ctx, testLog, syncSrv.HandleGetBlobsByRangeRequest)
+	remoteHost.SetStreamHandler(GetProtocolID(RequestBlobsByRangeProtocolID, rollupCfg.L2ChainID), func(stream network.Stream) {
+		if requests.Add(1) > 1 {
+			rangeHandler(stream)
+			return
+		}
+		// reset the stream once the response is started
+		if _, _, err := readMsg(stream, time.Second); err != nil {
+			t.Errorf("read request failed: %v", err)
+		}
+		_, _ = stream.Write([]byte{returnCodeSuccess})
+		time.Sleep(100 * time.Millisecond)
+		stream.Reset()
+	})
+	connect(t, localHost, remoteHost, shards, shards)
+	checkStall(t, 5, mux, cancel)
+
+	if !syncCl.syncDone {
+		t.Fatalf("sync state %v is not match with expected state %v", syncCl.syncDone, true)
+	}
+	if requests.Load() < 2 {
+		t.Fatalf("the range request is not retried after the stream reset")
+	}
+	stats, ok := syncCl.PeerStats(remoteHost.ID())
+	if !ok {
+		t.Fatalf("peer is not registered")
+	}
+	if stats.StreamResets != 1 || stats.PartialResponses != 0 || stats.MalformedResponses != 0 {
+		t.Fatalf("unexpected peer stats %+v, expected a stream reset", stats)
+	}
+	verifyKVs(data, make(map[uint64]struct{}), t)
+}
+
+// TestImportSourceFallback tests that the blob no peer serves is imported from the shard export in the import source
+// before it is given up, so the sync is done without the peers.
+func TestImportSourceFallback(t *testing.T) {
+	var (
+		kvSize      = defaultChunkSize
+		kvEntries   = uint64(16)
+		lastKvIndex = uint64(16)
+		missingIdx  = uint64(5)
+		importDir   = t.TempDir()
+		db          = rawdb.NewMemoryDatabase()
+		ctx, cancel = context.WithCancel(context.Background())
+		mux         = new(event.Feed)
+		m           = metrics.NewMetrics("sync_test")
+		shards      = map[common.Address][]uint64{contract: {0}}
+		rollupCfg   = &rollup.EsConfig{
+			L2ChainID: new(big.Int).SetUint64(3333),
+		}
+		missingCh = make(chan BlobsMissing, 4)
+	)
+	defer cancel()
+
+	metafile, err := CreateMetaFile(metafileName, int64(kvEntries))
+	if err != nil {
+		t.Error("Create metafileName fail", err.Error())
+	}
+	defer metafile.Close()
+
+	shardManager, files := createEthStorage(contract, []uint64{0}, defaultChunkSize, kvSize, kvEntries, common.Address{}, defaultEncodeType)
+	if shardManager == nil {
+		t.Fatalf("createEthStorage failed")
+	}
+	defer func(files []string) {
+		for _, file := range files {
+			os.Remove(file)
+		}
+	}(files)
+
+	data := makeKVStorage(contract, []uint64{0}, defaultChunkSize, kvSize, kvEntries, lastKvIndex, common.Address{}, defaultEncodeType, metafile)
+
+	// only the export has the blob of missingIdx, a file not of an export is skipped
+	export, err := os.Create(filepath.Join(importDir, "shard-0.export"))
+	if err != nil {
+		t.Fatal("create export failed", err)
+	}
+	ew, err := ethstorage.NewShardExportWriter(export, contract, 0, kvSize, kvEntries)
+	if err != nil {
+		t.Fatal("write export header failed", err)
+	}
+	if err := ew.WriteBlob(missingIdx, data[contract][missingIdx].BlobCommit, data[contract][missingIdx].RowData); err != nil {
+		t.Fatal("write blob to export failed", err)
+	}
+	if err := ew.Close(); err != nil {
+		t.Fatal("close export failed", err)
+	}
+	export.Close()
+	if err := os.WriteFile(filepath.Join(importDir, "README"), []byte("not an export"), 0o600); err != nil {
+		t.Fatal("write file failed", err)
+	}
+
+	sm := ethstorage.NewStorageManager(shardManager, NewMockL1Source(lastKvIndex, metafileName))
+	sm.Reset(0)
+	err = sm.DownloadAllMetas(context.Background(), 16)
+	if err != nil {
+		t.Fatal("Download blob metadata failed", "error", err)
+	}
+	localHost, syncCl := createLocalHostAndSyncClient(t, testLog, rollupCfg, db, sm, m, mux)
+	syncCl.maxHealAttempts = 2
+	syncCl.SetImportSource(importDir)
+	sub := syncCl.SubscribeBlobsMissing(missingCh)
+	defer sub.Unsubscribe()
+	syncCl.Start()
+	defer syncCl.Close()
+
+	// the peer does not have the blob of missingIdx
+	smr := &mockStorageManagerReader{
+		kvEntries:       kvEntries,
+		maxKvSize:       kvSize,
+		encodeType:      defaultEncodeType,
+		shards:          []uint64{0},
+		contractAddress: contract,
+		shardMiner:      common.Address{},
+		blobPayloads:    copyShardData(data[contract], []uint64{0}, kvEntries, map[uint64]struct{}{missingIdx: {}}),
+	}
+	remoteHost := createRemoteHost(t, ctx, rollupCfg, smr, db, m, testLog)
+	connect(t, localHost, remoteHost, shards, shards)
+	checkStall(t, 10, mux, cancel)
+
+	if !syncCl.syncDone {
+		t.Fatalf("sync state %v is not match with expected state %v", syncCl.syncDone, true)
+	}
+	select {
+	case ev := <-missingCh:
+		t.Fatalf("unexpected missing blobs event %v", ev)
+	default:
+	}
+	if missing := syncCl.Status().Shards; len(missing) > 0 && len(missing[0].PermanentlyMissing) > 0 {
+		t.Fatalf("blobs %v are given up", missing[0].PermanentlyMissing)
+	}
+	verifyKVs(data, make(map[uint64]struct{}), t)
+}
+
+// TestRequestAvailability tests the client asks the peers which blobs they hold before requesting a list, so the
+// blobs excluded by a peer are never requested from it and are fetched from the other peer instead.
+func TestRequestAvailability(t *testing.T) {
+	var (
+		kvSize      = defaultChunkSize
+		kvEntries   = uint64(64)
+		lastKvIndex = uint64(64)
+		encodeType  = uint64(ethstorage.NO_ENCODE)
+		ctx, cancel = context.WithCancel(context.Background())
+		db          = rawdb.NewMemoryDatabase()
+		mux         = new(event.Feed)
+		shards      = []uint64{0}
+		shardMap    = map[common.Address][]uint64{contract: shards}
+		m           = metrics.NewMetrics("sync_test")
+		rollupCfg   = &rollup.EsConfig{
+			L2ChainID: new(big.Int).SetUint64(3333),
+		}
+		syncParams = params
+	)
+	defer cancel()
+	syncParams.ShardVerifyStrictness = map[ShardKey]VerifyStrictness{{ShardId: 0}: VerifyTrusted}
 
 	metafile, err := CreateMetaFile(metafileName, int64(kvEntries))
 	if err != nil {
@@ -1018,81 +9111,145 @@ func TestAddPeerDuringSyncing(t *testing.T) {
 	}
 	defer metafile.Close()
 
-	shardMap[contract] = shards
-	shardManager, files := createEthStorage(contract, shards, defaultChunkSize, kvSize, kvEntries, common.Address{}, defaultEncodeType)
+	shardManager, files := createEthStorage(contract, shards, defaultChunkSize, kvSize, kvEntries, common.Address{}, encodeType)
 	if shardManager == nil {
 		t.Fatalf("createEthStorage failed")
 	}
-
 	defer func(files []string) {
 		for _, file := range files {
 			os.Remove(file)
 		}
 	}(files)
 
-	l1 := NewMockL1Source(lastKvIndex, metafileName)
 	data := makeKVStorage(contract, shards, defaultChunkSize, kvSize, kvEntries, lastKvIndex, common.Address{}, encodeType, metafile)
-	sm := ethstorage.NewStorageManager(shardManager, l1)
+	sm := ethstorage.NewStorageManager(shardManager, NewMockL1Source(lastKvIndex, metafileName))
+	localHost := getNetHost(t)
+	syncCl := NewSyncClient(testLog, rollupCfg, localHost.NewStream, sm, &syncParams, db, m, mux)
+	syncCl.loadSyncStatus()
 	sm.Reset(0)
-	// fill empty to excludedList for verify KVs
-	fillEmpty(shardManager, excludedList)
-
-	localHost, syncCl := createLocalHostAndSyncClient(t, testLog, rollupCfg, db, sm, m, mux)
-	syncCl.Start()
+	if err := sm.DownloadAllMetas(context.Background(), 16); err != nil {
+		t.Fatal("Download blob metadata failed", "error", err)
+	}
 
-	pData := copyShardData(data[contract], shards, kvEntries, excludedList)
-	smr0 := &mockStorageManagerReader{
-		kvEntries:       kvEntries,
-		maxKvSize:       kvSize,
-		encodeType:      encodeType,
-		shards:          shards,
-		contractAddress: contract,
-		shardMiner:      common.Address{},
-		blobPayloads:    pData,
+	holes0 := getRandomU64InRange(make(map[uint64]struct{}), 0, lastKvIndex, 10)
+	holes1 := getRandomU64InRange(holes0, 0, lastKvIndex, 10)
+	remotes := make([]*mockStorageManagerReader, 0)
+	peers := make([]peer.ID, 0)
+	// the last peer does not serve the availability requests
+	for i, holes := range []map[uint64]struct{}{holes0, holes1, {}} {
+		smr := &mockStorageManagerReader{
+			kvEntries:       kvEntries,
+			maxKvSize:       kvSize,
+			encodeType:      encodeType,
+			shards:          shards,
+			contractAddress: contract,
+			shardMiner:      common.Address{},
+			blobPayloads:    copyShardData(data[contract], shards, kvEntries, holes),
+		}
+		remoteHost := createRemoteHost(t, ctx, rollupCfg, smr, db, m, testLog)
+		if i < 2 {
+			syncSrv := NewSyncServer(rollupCfg, smr, db, m)
+			remoteHost.SetStreamHandler(GetProtocolID(RequestAvailabilityProtocolID, rollupCfg.L2ChainID),
+				MakeStreamHandler(ctx, testLog, syncSrv.HandleGetAvailabilityRequest))
+		}
+		connect(t, localHost, remoteHost, shardMap, shardMap)
+		if !syncCl.AddPeer(remoteHost.ID(), shardMap, network.DirOutbound) {
+			t.Fatalf("add peer failed")
+		}
+		remotes = append(remotes, smr)
+		peers = append(peers, remoteHost.ID())
+	}
+	// a kv empty filled by the first peer is not held by it, so it is excluded as a hole of the peer
+	for idx := uint64(0); idx < lastKvIndex; idx++ {
+		_, hole0 := holes0[idx]
+		_, hole1 := holes1[idx]
+		if hole0 || hole1 {
+			continue
+		}
+		emptyFilled := *remotes[0].blobPayloads[idx]
+		emptyFilled.BlobCommit = common.Hash{}
+		emptyFilled.BlobCommit[ethstorage.HashSizeInContract] = 0x80
+		remotes[0].blobPayloads[idx] = &emptyFilled
+		holes0[idx] = struct{}{}
+		break
 	}
-	remoteHost0 := createRemoteHost(t, ctx, rollupCfg, smr0, db, m, testLog)
-	connect(t, localHost, remoteHost0, shardMap, shardMap)
-	time.Sleep(3 * time.Second)
 
-	if syncCl.syncDone {
-		t.Fatalf("sync state %v is not match with expected state %v, peer count %d", syncCl.syncDone, false, len(syncCl.peers))
+	indexes := make([]uint64, 0)
+	for i := uint64(0); i < lastKvIndex; i++ {
+		indexes = append(indexes, i)
+	}
+	syncCl.lock.Lock()
+	pr, unsupported := syncCl.peers[peers[0]], syncCl.peers[peers[2]]
+	syncCl.lock.Unlock()
+	held, missing := syncCl.availableIndexes(pr, contract, 0, indexes)
+	if len(held) != len(indexes)-len(holes0) || len(missing) != len(holes0) {
+		t.Fatalf("expected %d held and %d missing, got %d and %d", len(indexes)-len(holes0), len(holes0), len(held), len(missing))
+	}
+	for _, idx := range missing {
+		if _, ok := holes0[idx]; !ok {
+			t.Fatalf("kv %d is held by the peer but reported missing", idx)
+		}
 	}
-	verifyKVs(data, excludedList, t)
 
-	smr1 := &mockStorageManagerReader{
-		kvEntries:       kvEntries,
-		maxKvSize:       kvSize,
-		encodeType:      encodeType,
-		shards:          shards,
-		contractAddress: contract,
-		shardMiner:      common.Address{},
-		blobPayloads:    data[contract],
+	// the availability answered is reused for the indexes in its range
+	avail := pr.availability.Load()
+	if held, _ = syncCl.availableIndexes(pr, contract, 0, indexes[1:]); pr.availability.Load() != avail {
+		t.Fatalf("the availability of the peer is asked again")
+	}
+	if held, _ = syncCl.availableIndexes(unsupported, contract, 0, indexes); len(held) != len(indexes) {
+		t.Fatalf("all the indexes should be held by the peer not serving the availability, got %d", len(held))
+	}
+	if !unsupported.noAvailability.Load() {
+		t.Fatalf("the peer not serving the availability should not be asked again")
 	}
-	remoteHost1 := createRemoteHost(t, ctx, rollupCfg, smr1, db, m, testLog)
-	connect(t, localHost, remoteHost1, shardMap, shardMap)
-	checkStall(t, 4, mux, cancel)
 
-	if !syncCl.syncDone {
-		t.Fatalf("sync state %v is not match with expected state %v, peer count %d", syncCl.syncDone, true, len(syncCl.peers))
+	synced, err := syncCl.RequestL2List(indexes)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if synced != lastKvIndex {
+		t.Fatalf("synced blob count is not match, expected: %d, actual: %d", lastKvIndex, synced)
+	}
+	for i, holes := range []map[uint64]struct{}{holes0, holes1} {
+		for idx := range holes {
+			if _, ok := remotes[i].readIdxs.Load(idx); ok {
+				t.Errorf("kv %d excluded by peer %d is requested from it", idx, i)
+			}
+		}
 	}
 	verifyKVs(data, make(map[uint64]struct{}), t)
 }
 
-// TestCloseSyncWhileFillEmpty test the sync can be cancel while the fill empty is running.
-func TestCloseSyncWhileFillEmpty(t *testing.T) {
+type toggleLoadController struct {
+	throttle atomic.Bool
+}
+
+func (c *toggleLoadController) ShouldThrottle() bool {
+	return c.throttle.Load()
+}
+
+// TestLoadControllerThrottle tests the requests in flight are capped while the LoadController reports the system
+// is busy, so fewer requests are dispatched, and the sync speeds up again once the load drops.
+func TestLoadControllerThrottle(t *testing.T) {
 	var (
 		kvSize      = defaultChunkSize
-		kvEntries   = uint64(512)
-		lastKvIndex = uint64(0)
+		kvEntries   = uint64(256)
+		lastKvIndex = uint64(256)
+		peerCount   = 8
+		hold        = 100 * time.Millisecond
+		window      = 600 * time.Millisecond
 		db          = rawdb.NewMemoryDatabase()
-		mux         = new(event.Feed)
-		shards      = []uint64{0}
-		shardMap    = make(map[common.Address][]uint64)
-		m           = metrics.NewMetrics("sync_test")
+		shards      = map[common.Address][]uint64{contract: {0}}
 		rollupCfg   = &rollup.EsConfig{
 			L2ChainID: new(big.Int).SetUint64(3333),
 		}
+		syncParams  = params
+		lc          = &toggleLoadController{}
+		dispatched  atomic.Int64
+		active      atomic.Int64
+		maxInFlight atomic.Int64
 	)
+	syncParams.MaxDispatchJitter = 0
 
 	metafile, err := CreateMetaFile(metafileName, int64(kvEntries))
 	if err != nil {
@@ -1100,8 +9257,7 @@ func TestCloseSyncWhileFillEmpty(t *testing.T) {
 	}
 	defer metafile.Close()
 
-	shardMap[contract] = shards
-	shardManager, files := createEthStorage(contract, shards, defaultChunkSize, kvSize, kvEntries, common.Address{}, defaultEncodeType)
+	shardManager, files := createEthStorage(contract, []uint64{0}, defaultChunkSize, kvSize, kvEntries, common.Address{}, defaultEncodeType)
 	if shardManager == nil {
 		t.Fatalf("createEthStorage failed")
 	}
@@ -1111,42 +9267,90 @@ func TestCloseSyncWhileFillEmpty(t *testing.T) {
 		}
 	}(files)
 
-	makeKVStorage(contract, shards, defaultChunkSize, kvSize, kvEntries, lastKvIndex, common.Address{}, defaultEncodeType, metafile)
-
-	l1 := NewMockL1Source(lastKvIndex, metafileName)
-	sm := ethstorage.NewStorageManager(shardManager, l1)
+	// hold the range requests for a while to keep them in flight, and fail them so the peers are idle again
+	rangeID := GetProtocolID(RequestBlobsByRangeProtocolID, rollupCfg.L2ChainID)
+	newStream := func(ctx context.Context, id peer.ID, pids ...protocol.ID) (network.Stream, error) {
+		if slices.Contains(pids, rangeID) {
+			dispatched.Add(1)
+			cur := active.Add(1)
+			for {
+				prev := maxInFlight.Load()
+				if cur <= prev || maxInFlight.CompareAndSwap(prev, cur) {
+					break
+				}
+			}
+			time.Sleep(hold)
+			active.Add(-1)
+		}
+		return nil, errors.New("no stream in test")
+	}
+	sm := ethstorage.NewStorageManager(shardManager, NewMockL1Source(lastKvIndex, metafileName))
 	sm.Reset(0)
-	_, syncCl := createLocalHostAndSyncClient(t, testLog, rollupCfg, db, sm, m, mux)
-	syncCl.Start()
-	time.Sleep(10 * time.Millisecond)
-	syncCl.Close()
+	syncCl := NewSyncClient(testLog, rollupCfg, newStream, sm, &syncParams, db, nil, nil)
+	defer syncCl.resCancel()
+	syncCl.SetLoadController(lc)
+	syncCl.loadSyncStatus()
+	for i := 0; i < peerCount; i++ {
+		syncCl.AddPeer(peer.ID(fmt.Sprintf("load-peer-%d", i)), shards, network.DirOutbound)
+	}
 
-	t.Log("Fill empty status", "filled", syncCl.tasks[0].state.EmptyFilled, "toFill", syncCl.tasks[0].state.EmptyToFill)
-	if syncCl.syncDone {
-		t.Fatalf("fill empty should be cancel")
+	// run the dispatching for the window, and return the requests dispatched and the max requests in flight
+	run := func() (int64, int64) {
+		for i := 0; i < 100; i++ {
+			syncCl.lock.Lock()
+			inFlight := syncCl.inFlight
+			syncCl.lock.Unlock()
+			if inFlight == 0 {
+				break
+			}
+			time.Sleep(20 * time.Millisecond)
+		}
+		dispatched.Store(0)
+		maxInFlight.Store(0)
+		for start := time.Now(); time.Since(start) < window; {
+			syncCl.assignBlobRangeTasks()
+			time.Sleep(10 * time.Millisecond)
+		}
+		return dispatched.Load(), maxInFlight.Load()
+	}
+
+	fullCount, fullInFlight := run()
+	if fullInFlight <= throttledInFlight {
+		t.Fatalf("requests should be dispatched to the idle peers concurrently, max in flight %d", fullInFlight)
+	}
+
+	lc.throttle.Store(true)
+	throttledCount, throttledMax := run()
+	if throttledMax > throttledInFlight {
+		t.Fatalf("requests in flight should be capped while throttled, expected: %d, actual: %d", throttledInFlight, throttledMax)
+	}
+	if throttledCount >= fullCount {
+		t.Fatalf("dispatch rate should drop while throttled, throttled: %d, full: %d", throttledCount, fullCount)
+	}
+
+	lc.throttle.Store(false)
+	if count, inFlight := run(); inFlight <= throttledInFlight || count <= throttledCount {
+		t.Fatalf("dispatch rate should recover once unthrottled, count %d, max in flight %d", count, inFlight)
 	}
 }
 
-// TestAddPeerAfterSyncDone test add peer after sync done, the peer should add successfully (the connection is kept),
-// as the remote peer may need to sync data from this local peer, we also need to use the sync client to control
-// the peer count.
-func TestAddPeerAfterSyncDone(t *testing.T) {
+// TestDedupRequestingIndexes tests a blob queued in both a subTask and the heal task is requested only once while
+// a request of it is in flight, and both the subTask and the heal task observe it done once it is delivered.
+func TestDedupRequestingIndexes(t *testing.T) {
 	var (
-		kvSize       = defaultChunkSize
-		kvEntries    = uint64(16)
-		lastKvIndex  = uint64(16)
-		encodeType   = uint64(defaultEncodeType)
-		db           = rawdb.NewMemoryDatabase()
-		ctx, cancel  = context.WithCancel(context.Background())
-		mux          = new(event.Feed)
-		shards       = []uint64{0}
-		shardMap     = make(map[common.Address][]uint64)
-		excludedList = make(map[uint64]struct{})
-		m            = metrics.NewMetrics("sync_test")
-		rollupCfg    = &rollup.EsConfig{
+		kvSize      = defaultChunkSize
+		kvEntries   = uint64(16)
+		lastKvIndex = uint64(16)
+		ctx, cancel = context.WithCancel(context.Background())
+		db          = rawdb.NewMemoryDatabase()
+		mux         = new(event.Feed)
+		shards      = map[common.Address][]uint64{contract: {0}}
+		m           = metrics.NewMetrics("sync_test")
+		rollupCfg   = &rollup.EsConfig{
 			L2ChainID: new(big.Int).SetUint64(3333),
 		}
 	)
+	defer cancel()
 
 	metafile, err := CreateMetaFile(metafileName, int64(kvEntries))
 	if err != nil {
@@ -1154,79 +9358,123 @@ func TestAddPeerAfterSyncDone(t *testing.T) {
 	}
 	defer metafile.Close()
 
-	shardMap[contract] = shards
-	shardManager, files := createEthStorage(contract, shards, defaultChunkSize, kvSize, kvEntries, common.Address{}, defaultEncodeType)
+	shardManager, files := createEthStorage(contract, []uint64{0}, defaultChunkSize, kvSize, kvEntries, common.Address{}, defaultEncodeType)
 	if shardManager == nil {
 		t.Fatalf("createEthStorage failed")
 	}
-
 	defer func(files []string) {
-		for _, f := range files {
-			os.Remove(f)
+		for _, file := range files {
+			os.Remove(file)
 		}
 	}(files)
 
-	l1 := NewMockL1Source(lastKvIndex, metafileName)
-	data := makeKVStorage(contract, shards, defaultChunkSize, kvSize, kvEntries, lastKvIndex, common.Address{}, encodeType, metafile)
-
-	sm := ethstorage.NewStorageManager(shardManager, l1)
+	data := makeKVStorage(contract, []uint64{0}, defaultChunkSize, kvSize, kvEntries, lastKvIndex, common.Address{}, defaultEncodeType, metafile)
+	sm := ethstorage.NewStorageManager(shardManager, NewMockL1Source(lastKvIndex, metafileName))
+	// the sync client is not started, so the tasks are loaded with the last kv index reset already
 	sm.Reset(0)
-	// fill empty to excludedList for verify KVs
-	fillEmpty(shardManager, excludedList)
-
 	localHost, syncCl := createLocalHostAndSyncClient(t, testLog, rollupCfg, db, sm, m, mux)
-	syncCl.Start()
-
-	smr0 := &mockStorageManagerReader{
-		kvEntries:       kvEntries,
-		maxKvSize:       kvSize,
-		encodeType:      encodeType,
-		shards:          shards,
-		contractAddress: contract,
-		shardMiner:      common.Address{},
-		blobPayloads:    data[contract],
+	syncCl.loadSyncStatus()
+	err = sm.DownloadAllMetas(context.Background(), 16)
+	if err != nil {
+		t.Fatal("Download blob metadata failed", "error", err)
 	}
-	remoteHost0 := createRemoteHost(t, ctx, rollupCfg, smr0, db, m, testLog)
-	connect(t, localHost, remoteHost0, shardMap, shardMap)
-	checkStall(t, 4, mux, cancel)
 
-	if !syncCl.syncDone {
-		t.Fatalf("sync state %v is not match with expected state %v, peer count %d", syncCl.syncDone, true, len(syncCl.peers))
+	// two slow peers, so the heal request is still in flight when the range requests are assigned
+	smrs := make([]*mockStorageManagerReader, 2)
+	for i := range smrs {
+		smrs[i] = &mockStorageManagerReader{
+			kvEntries:       kvEntries,
+			maxKvSize:       kvSize,
+			encodeType:      defaultEncodeType,
+			shards:          []uint64{0},
+			contractAddress: contract,
+			shardMiner:      common.Address{},
+			blobPayloads:    data[contract],
+			readDelay:       200 * time.Millisecond,
+		}
+		remoteHost := createRemoteHost(t, ctx, rollupCfg, smrs[i], db, m, testLog)
+		connect(t, localHost, remoteHost, shards, shards)
+	}
+	for i := 0; i < 100; i++ {
+		syncCl.lock.Lock()
+		idle := len(syncCl.idlerPeers)
+		syncCl.lock.Unlock()
+		if idle == len(smrs) {
+			break
+		}
+		time.Sleep(20 * time.Millisecond)
 	}
-	verifyKVs(data, excludedList, t)
 
-	smr1 := &mockStorageManagerReader{
-		kvEntries:       kvEntries,
-		maxKvSize:       kvSize,
-		encodeType:      encodeType,
-		shards:          shards,
-		contractAddress: contract,
-		shardMiner:      common.Address{},
-		blobPayloads:    data[contract],
+	// queue the next blob of the first subTask to heal, which is the first to be requested by range as well
+	syncCl.lock.Lock()
+	tk := syncCl.tasks[0]
+	st := tk.SubTasks[0]
+	idx := st.next
+	tk.healTask.insert([]uint64{idx})
+	syncCl.lock.Unlock()
+
+	done := func() bool {
+		syncCl.lock.Lock()
+		defer syncCl.lock.Unlock()
+		for _, st := range tk.SubTasks {
+			if !st.done {
+				return false
+			}
+		}
+		return tk.healTask.count() == 0
+	}
+	for i := 0; i < 32 && !done(); i++ {
+		syncCl.assignBlobHealTasks()
+		syncCl.assignBlobRangeTasks()
+		syncCl.wg.Wait()
+	}
+	if !done() {
+		t.Fatalf("sync should be done")
+	}
+	if st.next <= idx {
+		t.Fatalf("subTask should move past the healed blob %d, next %d", idx, st.next)
 	}
-	remoteHost1 := createRemoteHost(t, ctx, rollupCfg, smr1, db, m, testLog)
-	connect(t, localHost, remoteHost1, shardMap, shardMap)
 
-	time.Sleep(10 * time.Millisecond)
-	if len(syncCl.peers) != 2 {
-		t.Fatalf("sync client peers count is not match, expected: %d, actual count %d;", 2, len(syncCl.peers))
+	count, total := 0, uint64(0)
+	for _, smr := range smrs {
+		if _, ok := smr.readIdxs.Load(idx); ok {
+			count++
+		}
+		total += smr.reads.Load()
+	}
+	if count != 1 {
+		t.Fatalf("blob %d in both the subTask and the heal task should be requested once, requested %d times", idx, count)
 	}
+	if total != lastKvIndex {
+		t.Fatalf("each blob should be requested once, expected: %d, actual: %d", lastKvIndex, total)
+	}
+	syncCl.lock.Lock()
+	requesting := len(syncCl.requesting)
+	syncCl.lock.Unlock()
+	if requesting != 0 {
+		t.Fatalf("no blob should be requesting once the requests complete, requesting contracts %d", requesting)
+	}
+	verifyKVs(data, make(map[uint64]struct{}), t)
 }
 
-func TestFillEmpty(t *testing.T) {
+// TestNetworkSecretAuth test the sync streams of a private network are served only if they are opened with the
+// same network secret, and the peers with a different or no secret cannot complete the requests.
+func TestNetworkSecretAuth(t *testing.T) {
 	var (
 		kvSize      = defaultChunkSize
-		kvEntries   = uint64(256)
-		lastKvIndex = uint64(12)
+		kvEntries   = uint64(16)
+		lastKvIndex = uint64(16)
+		secret      = "private-network-a"
+		ctx, cancel = context.WithCancel(context.Background())
 		db          = rawdb.NewMemoryDatabase()
-		mux         = new(event.Feed)
-		shards      = []uint64{0}
-		shardMap    = make(map[common.Address][]uint64)
+		shards      = map[common.Address][]uint64{contract: {0}}
 		m           = metrics.NewMetrics("sync_test")
 		rollupCfg   = &rollup.EsConfig{
-			L2ChainID: new(big.Int).SetUint64(3333),
+			L2ChainID:     new(big.Int).SetUint64(3333),
+			NetworkSecret: secret,
 		}
 	)
+	defer cancel()
 
 	metafile, err := CreateMetaFile(metafileName, int64(kvEntries))
 	if err != nil {
@@ -1234,8 +9482,7 @@ func TestFillEmpty(t *testing.T) {
 	}
 	defer metafile.Close()
 
-	shardMap[contract] = shards
-	shardManager, files := createEthStorage(contract, shards, defaultChunkSize, kvSize, kvEntries, common.Address{}, defaultEncodeType)
+	shardManager, files := createEthStorage(contract, []uint64{0}, defaultChunkSize, kvSize, kvEntries, common.Address{}, defaultEncodeType)
 	if shardManager == nil {
 		t.Fatalf("createEthStorage failed")
 	}
@@ -1245,27 +9492,43 @@ func TestFillEmpty(t *testing.T) {
 		}
 	}(files)
 
-	makeKVStorage(contract, shards, defaultChunkSize, kvSize, kvEntries, lastKvIndex, common.Address{}, defaultEncodeType, metafile)
+	data := makeKVStorage(contract, []uint64{0}, defaultChunkSize, kvSize, kvEntries, lastKvIndex, common.Address{}, defaultEncodeType, metafile)
+	smr := &mockStorageManagerReader{
+		kvEntries:       kvEntries,
+		maxKvSize:       kvSize,
+		encodeType:      defaultEncodeType,
+		shards:          []uint64{0},
+		contractAddress: contract,
+		shardMiner:      common.Address{},
+		blobPayloads:    data[contract],
+	}
+	remoteHost := createRemoteHost(t, ctx, rollupCfg, smr, db, m, testLog)
+	syncSrv := NewSyncServer(rollupCfg, smr, db, m)
+	remoteHost.SetStreamHandler(GetProtocolID(RequestBlobsByRangeProtocolID, rollupCfg.L2ChainID),
+		AuthStreamHandler(secret, MakeStreamHandler(ctx, testLog, syncSrv.HandleGetBlobsByRangeRequest)))
+	localHost := getNetHost(t)
+	connect(t, localHost, remoteHost, shards, shards)
 
-	l1 := NewMockL1Source(lastKvIndex, metafileName)
-	sm := ethstorage.NewStorageManager(shardManager, l1)
-	sm.Reset(0)
-	_, syncCl := createLocalHostAndSyncClient(t, testLog, rollupCfg, db, sm, m, mux)
-	syncCl.Start()
-	for i := 0; i < 4; i++ {
-		time.Sleep(500 * time.Millisecond)
-		l1.lastBlobIndex = l1.lastBlobIndex + rand.Uint64()%(kvEntries/4)
-		sm.Reset(1)
+	request := func(secret string) error {
+		pr := NewPeer(0, rollupCfg.L2ChainID, remoteHost.ID(), AuthNewStream(secret, localHost.NewStream),
+			network.DirOutbound, params.InitRequestSize, kvSize, shards)
+		var packet BlobsByRangePacket
+		if _, err := pr.RequestBlobsByRange(rand.Uint64(), contract, 0, 0, 7, &packet); err != nil {
+			return err
+		}
+		if len(packet.Blobs) != 8 {
+			return fmt.Errorf("blob count is not match, expected: %d, actual: %d", 8, len(packet.Blobs))
+		}
+		return nil
 	}
-	time.Sleep(8 * time.Second)
 
-	if len(syncCl.tasks[0].SubEmptyTasks) > 0 {
-		t.Fatalf("fill empty should be done")
+	if err := request(secret); err != nil {
+		t.Fatalf("request with the network secret failed: %s", err.Error())
 	}
-	if syncCl.tasks[0].state.EmptyToFill != 0 {
-		t.Fatalf("emptyBlobsToFill should be 0, value %d", syncCl.tasks[0].state.EmptyToFill)
+	if err := request("private-network-b"); err == nil {
+		t.Fatalf("request with a different network secret should fail")
 	}
-	if syncCl.tasks[0].state.EmptyFilled != (kvEntries - lastKvIndex) {
-		t.Fatalf("emptyBlobsFilled is wrong, expect %d, value %d", kvEntries-lastKvIndex, syncCl.tasks[0].state.EmptyFilled)
+	if err := request(""); err == nil {
+		t.Fatalf("request without the network secret should fail")
 	}
 }
@@ -6,24 +6,34 @@ package protocol
 import (
 	"bytes"
 	"context"
+	"encoding/binary"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"math"
 	"math/big"
 	"math/rand"
+	"net/http"
+	"os"
+	"path/filepath"
 	"runtime"
+	"slices"
 	"sort"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/ethereum/go-ethereum/common"
 	"github.com/ethereum/go-ethereum/ethdb"
 	"github.com/ethereum/go-ethereum/event"
 	"github.com/ethereum/go-ethereum/log"
+	"github.com/ethereum/go-ethereum/rlp"
 	"github.com/ethstorage/go-ethstorage/ethstorage"
 	"github.com/ethstorage/go-ethstorage/ethstorage/metrics"
 	prv "github.com/ethstorage/go-ethstorage/ethstorage/prover"
 	"github.com/ethstorage/go-ethstorage/ethstorage/rollup"
+	"github.com/klauspost/compress/zstd"
 	"github.com/libp2p/go-libp2p/core/network"
 	"github.com/libp2p/go-libp2p/core/peer"
 	"github.com/libp2p/go-libp2p/core/protocol"
@@ -46,22 +56,113 @@ const (
 	defaultMinPeersPerShard = 5
 
 	minSubTaskSize = 16
+
+	// the runs of at least minRangeRun contiguous heal indexes are requested as ranges instead of lists
+	minRangeRun = 8
+
+	// syncProtocolVersion is the version of the sync protocol advertised in the capabilities
+	syncProtocolVersion = 1
+
+	// compressionZstd is the compression of the responses of RequestCompressedBlobsByRangeProtocolID and
+	// RequestCompressedStreamedBlobsByRangeProtocolID
+	compressionZstd = "zstd"
+
+	defaultVerifySampleRate = 0.1
+
+	// trustedVerifySampleRate is the fraction of the blobs verified for the VerifyTrusted shards from the peers not
+	// suspicious, so a peer delivering corrupt blobs is caught and marked suspicious eventually
+	trustedVerifySampleRate = 0.01
+
+	defaultMinVerifiedRatio = 1.0
+
+	defaultSummaryLogInterval = time.Minute
+
+	defaultStallTimeout = 5 * time.Minute
+
+	defaultFollowInterval = 30 * time.Second
+
+	defaultMaxStatusSize = 16 * 1024 * 1024
+
+	// maxHealLogRecords is the max records in the heal log of a task, the heal log is compacted to a snapshot record
+	// once it is exceeded
+	maxHealLogRecords = 64
+
+	defaultRetryCooldown = 30 * time.Second
+
+	defaultProgressSaveInterval = 10 * time.Second
+
+	defaultWriteQueueSize = 16
+
+	// Size of the index header embedded in the blobs of the shards with the header checked, which is the contract
+	// address followed by the big endian kv index
+	indexHeaderSize = common.AddressLength + 8
+
+	// the range batch of a peer grows by rangeBatchIncrease blobs if the response arrives within
+	// rangeBatchTargetRTT, and halves if the request fails
+	rangeBatchIncrease  = 4
+	rangeBatchTargetRTT = time.Second
+
+	// the window of the recent synced blobs to estimate the sync rate and the remaining time of a shard
+	syncRateWindow = time.Minute
+
+	// the time a blob missing from a peer is not requested from the peer, as the peer may sync it meanwhile
+	availabilityTTL = 30 * time.Second
+
+	// min interval to fetch the last kv indexes of a peer again after a request to the peer fails, or the peer is
+	// skipped as the range to request is beyond its last kv index
+	lastKvIndexRefreshInterval = 30 * time.Second
+
+	// max contracts and max shards of a contract advertised by a peer, a peer advertising more is malformed
+	maxAdvertisedContracts = 256
+	maxAdvertisedShards    = 4096
 )
 
 const (
 	RequestBlobsByRangeProtocolID = "/ethstorage/dev/requestblobsbyrange/%d/1.0.0"
 	RequestBlobsByListProtocolID  = "/ethstorage/dev/requestblobsbylist/%d/1.0.0"
 	RequestShardList              = "/ethstorage/dev/shardlist/1.0.0"
+	RequestCapabilities           = "/ethstorage/dev/capabilities/1.0.0"
+	RequestLastKvIndex            = "/ethstorage/dev/lastkvindex/1.0.0"
+	// UpdateShardList is pushed by a peer to the connected peers when its shards change, e.g. new data files opened.
+	UpdateShardList = "/ethstorage/dev/updateshardlist/1.0.0"
+	// RequestPing is sent to the idle peers by the keep-alive, so their connections are not dropped by NATs and
+	// firewalls while there is nothing to sync.
+	RequestPing = "/ethstorage/dev/ping/1.0.0"
+
+	// RequestCompressedBlobsByRangeProtocolID is the same as RequestBlobsByRangeProtocolID, except the response
+	// payload is compressed by zstd. It is only served by the nodes with compression enabled.
+	RequestCompressedBlobsByRangeProtocolID = RequestBlobsByRangeProtocolID + "/zstd"
+	// RequestStreamedBlobsByRangeProtocolID is the same as RequestBlobsByRangeProtocolID, except the blobs of the
+	// response are written to the stream one by one in length prefixed frames, so the memory to serve a response is
+	// bounded by the frame size instead of the response size. The requester still holds all the blobs of the
+	// response, which is bounded by the bytes requested.
+	RequestStreamedBlobsByRangeProtocolID = RequestBlobsByRangeProtocolID + "/streamed"
+	// RequestCompressedStreamedBlobsByRangeProtocolID is the same as RequestStreamedBlobsByRangeProtocolID, except the
+	// frames are written in a zstd stream. It is only served by the nodes with compression enabled.
+	RequestCompressedStreamedBlobsByRangeProtocolID = RequestStreamedBlobsByRangeProtocolID + "/zstd"
+	// RequestChunkProofProtocolID requests a chunk of a blob with its KZG proof, so a light client can verify the
+	// chunk against the commit of the blob without downloading the full blob.
+	RequestChunkProofProtocolID = "/ethstorage/dev/requestchunkproof/%d/1.0.0"
+	// RequestBlobsByCommitProtocolID requests the blobs by their commits, for the clients knowing the commit of
+	// a blob but not its kv index.
+	RequestBlobsByCommitProtocolID = "/ethstorage/dev/requestblobsbycommit/%d/1.0.0"
+	// RequestAvailabilityProtocolID requests the bitmap of the blobs a peer holds in a range, so the blobs missing
+	// from the peer are requested from the other peers instead.
+	RequestAvailabilityProtocolID = "/ethstorage/dev/requestavailability/%d/1.0.0"
 )
 
 var (
 	maxKvCountPerReq            = uint64(16)
 	SyncStatusKey               = []byte("SyncStatusKey")
-	SyncTasksKey                = []byte("SyncStatus") // TODO this is the legacy value, change the value before next test net
-	maxFillEmptyTaskTreads      = 1
+	SyncTasksKey                = []byte("SyncStatus")    // TODO this is the legacy value, change the value before next test net
+	SyncHealLogKey              = []byte("SyncHealLog")   // prefix of the heal logs of the tasks
 	requestTimeoutInMillisecond = 1000 * time.Millisecond // Millisecond
 )
 
+// altEncodeTypes are the known encode types to retry decoding a blob which fails the verification with the encode
+// type reported by the peer. ENCODE_ETHASH is not in the list as it needs the expensive ethash dataset to decode.
+var altEncodeTypes = []uint64{ethstorage.NO_ENCODE, ethstorage.ENCODE_KECCAK_256, ethstorage.ENCODE_BLOB_POSEIDON}
+
 func GetProtocolID(format string, l2ChainID *big.Int) protocol.ID {
 	return protocol.ID(fmt.Sprintf(format, l2ChainID))
 }
@@ -70,7 +171,7 @@ type requestHandlerFn func(ctx context.Context, log log.Logger, stream network.S
 
 func MakeStreamHandler(resourcesCtx context.Context, log log.Logger, fn requestHandlerFn) network.StreamHandler {
 	return func(stream network.Stream) {
-		handleLog := log.New("peer", stream.Conn().ID(), "remote", stream.Conn().RemoteMultiaddr())
+		handleLog := log.New("peer", shortPeerID(stream.Conn().RemotePeer()), "remote", stream.Conn().RemoteMultiaddr())
 		defer func() {
 			if err := recover(); err != nil {
 				handleLog.Error("P2p server request handling panic", "err", err, "protocol", stream.Protocol())
@@ -108,6 +209,12 @@ type SyncClientMetrics interface {
 	ClientOnBlobsByRange(peerID string, reqCount, retBlobCount, insertedCount uint64, duration time.Duration)
 	ClientOnBlobsByList(peerID string, reqCount, retBlobCount, insertedCount uint64, duration time.Duration)
 	ClientRecordTimeUsed(method string) func()
+	ClientBlobsReceived(count, bytes uint64)
+	ClientSetHealTaskSize(contract common.Address, shardId uint64, size int)
+	ClientAltEncodeTypeDecode(encodeType uint64, recovered bool)
+	ClientSetWriteQueueDepth(depth int)
+	ClientResponseFailure(peerID string, failure string)
+	ClientCommitMismatch(peerID string)
 	IncDropPeerCount()
 	IncPeerCount()
 	DecPeerCount()
@@ -130,9 +237,13 @@ type ShardManagerInfo interface {
 type StorageManagerReader interface {
 	ShardManagerInfo
 
+	LastKvIndex() uint64
+
 	TryReadEncoded(kvIdx uint64, readLen int) ([]byte, bool, error)
 
 	TryReadMeta(kvIdx uint64) ([]byte, bool, error)
+
+	DecodeKV(kvIdx uint64, b []byte, hash common.Hash, providerAddr common.Address, encodeType uint64) ([]byte, bool, error)
 }
 
 type StorageManagerWriter interface {
@@ -141,6 +252,8 @@ type StorageManagerWriter interface {
 	CommitEmptyBlobs(start, limit uint64) (uint64, uint64, error)
 
 	CommitBlobs(kvIndices []uint64, blobs [][]byte, commits []common.Hash) ([]uint64, error)
+
+	OverwriteBlobs(kvIndices []uint64, blobs [][]byte, commits []common.Hash) ([]uint64, error)
 }
 
 type StorageManager interface {
@@ -148,11 +261,19 @@ type StorageManager interface {
 
 	StorageManagerWriter
 
-	LastKvIndex() uint64
+	DownloadAllMetas(ctx context.Context, batchSize uint64) error
 
-	DecodeKV(kvIdx uint64, b []byte, hash common.Hash, providerAddr common.Address, encodeType uint64) ([]byte, bool, error)
+	DownloadShardMetas(ctx context.Context, sid uint64, batchSize uint64) error
 
-	DownloadAllMetas(ctx context.Context, batchSize uint64) error
+	DownloadMetas(ctx context.Context, first, limit, batchSize uint64) error
+
+	DownloadKvIndex() uint64
+
+	ContractCommit(kvIdx uint64) (common.Hash, bool)
+
+	UnverifiedBlobs(shardIdx uint64) ([]uint64, error)
+
+	FilledBitmap(shardIdx uint64) ([]byte, error)
 }
 
 type SyncClient struct {
@@ -163,20 +284,48 @@ type SyncClient struct {
 	metrics     SyncClientMetrics
 	newStreamFn newStreamFn
 	tasks       []*task
+	rangeTasks  []*task    // One-off tasks created by SyncRange, protected by lock
+	rangeFeed   event.Feed // Announces the RangeSynced events
 
 	maxPeers         int
+	maxListBatchSize uint64 // Max number of blobs in a list request sent by RequestL2List
+	peersOvershoot   int    // Number of peers allowed beyond maxPeers before sync done
 	minPeersPerShard int
 	syncerParams     *SyncerParams
+	verifySampleRate float64
+	// Fraction of the blobs verified for the VerifyTrusted shards from the peers not suspicious
+	trustedVerifySampleRate float64
+	// Verify strictness and index header shards of the syncer params with the contract of each shard resolved
+	verifyStrictness  map[ShardKey]VerifyStrictness
+	indexHeaderShards map[ShardKey]struct{}
+	// Deadline of a list request sent by RequestL2List, after which the batch is requested from another peer
+	listRequestTimeout time.Duration
+	// Max number of requests in flight to a peer, the peer stays idle until the requests in flight reach it
+	maxConcurrentPerPeer int
+	// Fraction of in-range blobs of a shard to be verified before the shard is advertised as done
+	minVerifiedRatio float64
+	fillEmptyWorkers int // Number of workers to concurrently fill empty blobs to distinct kv indexes
+	// Number of fill empty workers while peers serving unfinished sync tasks are connected,
+	// so resources pivot to downloading real data; 0 means fill empty always uses fillEmptyWorkers.
+	fillEmptyWorkersWithPeers int
+	// Bounded pool of workers to decode and verify the received blobs, shared by all the responses
+	decodePool *decodePool
+	// Bounded queue of the decoded blobs to be written to disk by a single writer, shared by all the responses
+	writeQueue *writeQueue
 
 	// Don't allow anything to be added to the wait-group while, or after, we are shutting down.
 	// This is protected by lock.
 	closingPeers               bool
 	syncDone                   bool // Flag to signal that eth storage sync is done
 	peers                      map[peer.ID]*Peer
-	idlerPeers                 map[peer.ID]struct{} // Peers that aren't serving requests
+	idlerPeers                 map[peer.ID]struct{} // Peers that can serve more requests
+	peerRequests               map[peer.ID]int      // Number of the requests in flight to each peer
+	suspiciousPeers            map[peer.ID]struct{} // Peers that delivered blobs which failed the commit verification
+	invalidBlobs               map[peer.ID]int      // Number of the invalid blobs delivered by each peer
 	runningFillEmptyTaskTreads int                  // Number of working threads for processing empty task
 	peerJoin                   chan peer.ID
 	update                     chan struct{} // Notification channel for possible sync progression
+	localChecked               chan struct{} // Closed once the pending blobs are checked against the local storage
 
 	// resource context: all peers and mainLoop tasks inherit this, and origin shutting down once resCancel() is called.
 	resCtx    context.Context
@@ -184,28 +333,154 @@ type SyncClient struct {
 
 	// wait group: wait for the resources to close. Adding to this is only safe if the peersLock is held.
 	wg sync.WaitGroup
-	// lock Protects fields (peers, idlerPeers, runningFillEmptyTaskTreads, closingPeers, syncDone,
+	// lock Protects fields (peers, idlerPeers, peerRequests, suspiciousPeers, invalidBlobs, runningFillEmptyTaskTreads, closingPeers, syncDone,
 	// task.statelessPeers, healTask.Indexes, subTask.isRunning, subTask.done, subEmptyTask.isRunning, subEmptyTask.done)
 	lock sync.Mutex
 
 	prover         prv.IProver
 	logTime        time.Time // Time instance when status was last reported
 	storageManager StorageManager
+	// Storage managers of all the contracts to sync keyed by contract, including storageManager of the primary
+	// contract. It is only modified before Start, so it is read without the lock.
+	storageManagers map[common.Address]StorageManager
+
+	summaryInterval time.Duration // Interval to log the summary of the sync health
+	startTime       time.Time     // Time instance when the sync client started, used to compute the download rate
+	syncedBytes     atomic.Uint64 // Bytes of the encoded blobs received from peers since started
+
+	stallTimeout   time.Duration // Interval without any blob committed before the sync is treated as stalled
+	stalledFeed    event.Feed    // Announces the SyncStalled events
+	lastCommitTime atomic.Int64  // Unix time in nanoseconds when a blob from peers was last committed
+
+	progressSaveInterval time.Duration // Delay to save the sync status after the subTasks progressed
+	progressed           chan struct{} // Notification channel for the progress of the subTasks to save
+
+	minRangeBatchSize uint64 // Min number of blobs in a range request adapted to the peer
+	maxRangeBatchSize uint64 // Max number of blobs in a range request adapted to the peer
+
+	maxPeersPerSubTask int // Max number of peers the range of a subTask is split among in parallel
+
+	maxStatusSize int // Max size in bytes of the saved sync tasks, above which a warning is logged
+
+	retryCooldown time.Duration // Time the retries of a failed blob prefer the peers other than the one failing it
+
+	keepAliveInterval time.Duration // Interval to ping the idle peers, 0 means the keep-alive is disabled
+
+	schedulePolicy SchedulePolicy // How the request slots of the idle peers are shared among the tasks
+	taskCursor     int            // Next task to serve in round-robin, protected by the lock
+
+	maxInvalidBlobsPerPeer int                    // Invalid blobs allowed from a peer before it is banned, 0 means never
+	banPeer                func(id peer.ID) error // Bans the peer from reconnecting, set by SetPeerBanner before Start
+	bannedFeed             event.Feed             // Announces the PeerBanned events
+
+	// Last kv index of each contract the tasks are created or last updated with, protected by the lock
+	lastKvIndexes map[common.Address]uint64
+
+	followMode     bool          // Keep syncing the blobs appended to the contracts after the sync is done
+	followInterval time.Duration // Interval to check the growth of the last kv indexes in follow mode
+
+	lastKvIndexRefresh time.Duration // Min interval to fetch the last kv indexes of a peer again, see maybeRefreshLastKvIndex
+	// Last kv index of each contract the tasks are synced to in follow mode, protected by the lock
+	followedKvIndexes map[common.Address]uint64
+
+	shardSynced []func(contract common.Address, shardIdx uint64) // Callbacks of the shards synced, protected by the lock
+	allowlist   map[peer.ID]struct{}                             // Peers allowed to sync with, nil to allow all, protected by the lock
+
+	maxHealAttempts int        // Requests of a heal index before it is given up as missing, 0 means never
+	missingFeed     event.Feed // Announces the BlobsMissing events
+	importDir       string     // Directory of the shard exports to import the blobs no peer serves, protected by the lock
+	importing       bool       // Whether importHealIndexes is running in the background, protected by the lock
+
+	minPeersBeforeSync int           // Capable peers connected before the requests are dispatched, 0 means no wait
+	minPeersTimeout    time.Duration // Max time to wait for minPeersBeforeSync peers before the sync proceeds anyway
+
+	maxDispatchJitter time.Duration // Max random delay of a request dispatched in a burst, 0 means no delay
+	lastDispatch      time.Time     // Time instance when a request was last dispatched, protected by the lock
+
+	paused     bool       // Whether dispatching the requests and filling empty blobs is paused, protected by the lock
+	pausedFeed event.Feed // Announces the SyncPaused events
+
+	diskFullFeed event.Feed // Announces the DiskFull events
+
+	encodeTypePolicy EncodeTypePolicy // How the peers with a different encode type of a shard are requested
+
+	loadController LoadController // Tells whether to back off as the system is busy, nil to never throttle, protected by the lock
+	inFlight       int            // Number of the range and list requests in flight, protected by the lock
+	throttled      bool           // Whether the dispatching was last throttled by the loadController, protected by the lock
+
+	requesting map[common.Address]map[uint64]struct{} // Kv indexes of the range and list requests in flight, protected by the lock
+
+	bufPool     *blobBufferPool               // Buffers of the frames of the streamed range responses shared by the peers
+	zstdDecoder func() (*zstd.Decoder, error) // Decoder of the compressed range responses shared by the peers
+	tracer      Tracer                        // Starts the spans of the sync requests, noopTracer while the tracing is disabled
 }
 
 func NewSyncClient(log log.Logger, cfg *rollup.EsConfig, newStream newStreamFn, storageManager StorageManager, params *SyncerParams,
 	db ethdb.Database, m SyncClientMetrics, mux *event.Feed) *SyncClient {
 	ctx, cancel := context.WithCancel(context.Background())
+	fillEmptyWorkers := 1
 	if params.FillEmptyConcurrency > 0 {
-		maxFillEmptyTaskTreads = params.FillEmptyConcurrency
+		fillEmptyWorkers = params.FillEmptyConcurrency
 	} else if runtime.NumCPU() > 2 {
-		maxFillEmptyTaskTreads = runtime.NumCPU() - 2
+		fillEmptyWorkers = runtime.NumCPU() - 2
+	}
+	decodeWorkers := params.DecodeConcurrency
+	if decodeWorkers <= 0 {
+		decodeWorkers = runtime.NumCPU()
+	}
+	writeQueueSize := params.WriteQueueSize
+	if writeQueueSize <= 0 {
+		writeQueueSize = defaultWriteQueueSize
 	}
 	maxKvCountPerReq = params.InitRequestSize / storageManager.MaxKvSize()
+	maxListBatchSize := params.MaxListBatchSize
+	if maxListBatchSize == 0 {
+		maxListBatchSize = maxKvCountPerReq
+	}
+	// the init request size may be smaller than a blob, but a list request carries one blob at least
+	maxListBatchSize = max(maxListBatchSize, 1)
 	shardCount := len(storageManager.Shards())
+	syncCfg := syncConfigOf(log, cfg, params)
+	maxPeers := syncCfg.MaxPeers
 	if m == nil {
 		m = metrics.NoopMetrics
 	}
+	verifySampleRate := params.VerifySampleRate
+	if verifySampleRate <= 0 || verifySampleRate > 1 {
+		verifySampleRate = defaultVerifySampleRate
+	}
+	minVerifiedRatio := params.MinVerifiedRatio
+	if minVerifiedRatio <= 0 || minVerifiedRatio > 1 {
+		minVerifiedRatio = defaultMinVerifiedRatio
+	}
+	summaryInterval := params.SummaryLogInterval
+	if summaryInterval <= 0 {
+		summaryInterval = defaultSummaryLogInterval
+	}
+	stallTimeout := params.StallTimeout
+	if stallTimeout <= 0 {
+		stallTimeout = defaultStallTimeout
+	}
+	maxStatusSize := params.MaxStatusSize
+	if maxStatusSize <= 0 {
+		maxStatusSize = defaultMaxStatusSize
+	}
+	retryCooldown := params.RetryCooldown
+	if retryCooldown <= 0 {
+		retryCooldown = defaultRetryCooldown
+	}
+	followInterval := params.FollowInterval
+	if followInterval <= 0 {
+		followInterval = defaultFollowInterval
+	}
+	progressSaveInterval := params.ProgressSaveInterval
+	if progressSaveInterval <= 0 {
+		progressSaveInterval = defaultProgressSaveInterval
+	}
+	minRangeBatchSize, maxRangeBatchSize := syncCfg.MinBatchSize, syncCfg.MaxBatchSize
+	if maxRangeBatchSize == 0 {
+		maxRangeBatchSize = max(maxRequestSize/storageManager.MaxKvSize()*2, minRangeBatchSize)
+	}
 
 	c := &SyncClient{
 		log:                        log,
@@ -213,19 +488,93 @@ func NewSyncClient(log log.Logger, cfg *rollup.EsConfig, newStream newStreamFn,
 		cfg:                        cfg,
 		db:                         db,
 		metrics:                    m,
-		newStreamFn:                newStream,
+		newStreamFn:                AuthNewStream(cfg.NetworkSecret, newStream),
 		idlerPeers:                 make(map[peer.ID]struct{}),
+		requesting:                 make(map[common.Address]map[uint64]struct{}),
+		suspiciousPeers:            make(map[peer.ID]struct{}),
+		invalidBlobs:               make(map[peer.ID]int),
+		lastKvIndexes:              make(map[common.Address]uint64),
+		followedKvIndexes:          make(map[common.Address]uint64),
+		followMode:                 params.FollowMode,
+		followInterval:             followInterval,
+		lastKvIndexRefresh:         lastKvIndexRefreshInterval,
 		peers:                      make(map[peer.ID]*Peer),
 		peerJoin:                   make(chan peer.ID, 1),
 		update:                     make(chan struct{}, 1),
+		localChecked:               make(chan struct{}),
 		runningFillEmptyTaskTreads: 0,
 		resCtx:                     ctx,
 		resCancel:                  cancel,
+		tracer:                     noopTracer{},
 		storageManager:             storageManager,
+		storageManagers:            map[common.Address]StorageManager{storageManager.ContractAddress(): storageManager},
 		prover:                     prv.NewKZGProver(log),
-		maxPeers:                   params.MaxPeers,
-		minPeersPerShard:           getMinPeersPerShard(params.MaxPeers, shardCount),
+		maxPeers:                   maxPeers,
+		maxListBatchSize:           maxListBatchSize,
+		listRequestTimeout:         syncCfg.RequestTimeout,
+		maxConcurrentPerPeer:       syncCfg.MaxConcurrentPerPeer,
+		peerRequests:               make(map[peer.ID]int),
+		peersOvershoot:             params.PeersOvershoot,
+		minPeersPerShard:           getMinPeersPerShard(maxPeers, shardCount),
 		syncerParams:               params,
+		verifySampleRate:           verifySampleRate,
+		trustedVerifySampleRate:    trustedVerifySampleRate,
+		verifyStrictness:           primaryShardKeys(params.ShardVerifyStrictness, storageManager.ContractAddress()),
+		indexHeaderShards:          primaryShardKeys(params.IndexHeaderShards, storageManager.ContractAddress()),
+		minVerifiedRatio:           minVerifiedRatio,
+		fillEmptyWorkers:           fillEmptyWorkers,
+		fillEmptyWorkersWithPeers:  params.FillEmptyWithPeers,
+		decodePool:                 newDecodePool(decodeWorkers),
+		summaryInterval:            summaryInterval,
+		stallTimeout:               stallTimeout,
+		progressSaveInterval:       progressSaveInterval,
+		progressed:                 make(chan struct{}, 1),
+		minRangeBatchSize:          minRangeBatchSize,
+		maxRangeBatchSize:          maxRangeBatchSize,
+		maxPeersPerSubTask:         params.MaxPeersPerSubTask,
+		maxStatusSize:              maxStatusSize,
+		retryCooldown:              retryCooldown,
+		keepAliveInterval:          params.KeepAliveInterval,
+		schedulePolicy:             params.SchedulePolicy,
+		maxInvalidBlobsPerPeer:     params.MaxInvalidBlobsPerPeer,
+		maxDispatchJitter:          params.MaxDispatchJitter,
+		maxHealAttempts:            syncCfg.MaxRetries,
+		minPeersBeforeSync:         params.MinPeersBeforeSync,
+		minPeersTimeout:            params.MinPeersTimeout,
+		encodeTypePolicy:           params.EncodeTypePolicy,
+		bufPool:                    newBlobBufferPool(storageManager.MaxKvSize()),
+		zstdDecoder:                newZstdDecoder(maxDecodedSizeOf(cfg)),
+	}
+	if params.MaxLoad > 0 {
+		c.loadController = NewCPULoadController(params.MaxLoad)
+	}
+	c.writeQueue = newWriteQueue(writeQueueSize, c.commitBlobs, m.ClientSetWriteQueueDepth)
+	// the writer runs from the creation, so the blobs requested before Start are written as well
+	go c.writeQueue.loop(ctx)
+	return c
+}
+
+// syncConfigOf returns the sync config of cfg with the fields not set filled by the params, and the defaults applied.
+// The config loaded from the flags is already validated, so an invalid config is only set by the caller, and the
+// defaults are used instead.
+func syncConfigOf(log log.Logger, cfg *rollup.EsConfig, params *SyncerParams) rollup.SyncConfig {
+	c := cfg.Sync
+	if c.MaxPeers == 0 {
+		c.MaxPeers = params.MaxPeers
+	}
+	if c.MinBatchSize == 0 {
+		c.MinBatchSize = params.MinRangeBatchSize
+	}
+	if c.MaxBatchSize == 0 {
+		c.MaxBatchSize = params.MaxRangeBatchSize
+	}
+	if c.MaxRetries == 0 {
+		c.MaxRetries = params.MaxHealAttempts
+	}
+	if err := c.Validate(); err != nil {
+		log.Error("Invalid sync config, the defaults are used", "err", err)
+		c = rollup.SyncConfig{MaxPeers: max(params.MaxPeers, 0)}
+		c.Validate()
 	}
 	return c
 }
@@ -238,6 +587,54 @@ func getMinPeersPerShard(maxPeers, shardCount int) int {
 	return minPeersPerShard
 }
 
+// AddContract adds the storage manager of another contract to sync, so the shards of all the contracts are synced
+// from the peers serving them. It must be called before Start.
+func (s *SyncClient) AddContract(storageManager StorageManager) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if !s.startTime.IsZero() {
+		return fmt.Errorf("contract must be added before the sync client starts")
+	}
+	contract := storageManager.ContractAddress()
+	if _, ok := s.storageManagers[contract]; ok {
+		return fmt.Errorf("contract %s is already added", contract.Hex())
+	}
+	s.storageManagers[contract] = storageManager
+	shardCount := 0
+	for _, sm := range s.storageManagers {
+		shardCount += len(sm.Shards())
+	}
+	s.minPeersPerShard = getMinPeersPerShard(s.maxPeers, shardCount)
+	return nil
+}
+
+// storageManagerOf returns the storage manager of the contract, or nil if the contract is not synced.
+func (s *SyncClient) storageManagerOf(contract common.Address) StorageManager {
+	return s.storageManagers[contract]
+}
+
+// sortedStorageManagers returns the storage managers of all the contracts sorted by contract.
+func (s *SyncClient) sortedStorageManagers() []StorageManager {
+	sms := make([]StorageManager, 0, len(s.storageManagers))
+	for _, sm := range s.storageManagers {
+		sms = append(sms, sm)
+	}
+	sort.Slice(sms, func(i, j int) bool {
+		return bytes.Compare(sms[i].ContractAddress().Bytes(), sms[j].ContractAddress().Bytes()) < 0
+	})
+	return sms
+}
+
+// sortTasks sorts the tasks by contract and shard id.
+func sortTasks(tasks []*task) {
+	sort.Slice(tasks, func(i, j int) bool {
+		if tasks[i].Contract != tasks[j].Contract {
+			return bytes.Compare(tasks[i].Contract.Bytes(), tasks[j].Contract.Bytes()) < 0
+		}
+		return tasks[i].ShardId < tasks[j].ShardId
+	})
+}
+
 func (s *SyncClient) setSyncDone() {
 	s.syncDone = true
 	if s.mux != nil {
@@ -254,8 +651,7 @@ func (s *SyncClient) loadSyncStatus() {
 			log.Error("Failed to decode storage sync status", "err", err)
 		} else {
 			for _, t := range progress.Tasks {
-				log.Debug("Load sync subTask", "contract", t.Contract.Hex(),
-					"shard", t.ShardId, "count", len(t.SubTasks))
+				s.shardLogger(t.Contract, t.ShardId).Debug("Load sync subTask", "count", len(t.SubTasks))
 				t.healTask = &healTask{
 					Indexes: make(map[uint64]int64),
 					task:    t,
@@ -265,69 +661,207 @@ func (s *SyncClient) loadSyncStatus() {
 					sTask.task = t
 					sTask.next = sTask.First
 				}
+				// the subTasks may overlap if the node crashed in the middle of saving the status, merge them and
+				// split the merged ranges again to avoid requesting the same blobs repeatedly
+				if normalized := normalizeSubTasks(t.SubTasks); coveredBlobs(normalized) < coveredBlobs(t.SubTasks) {
+					s.shardLogger(t.Contract, t.ShardId).Warn("Overlapping sync subTasks loaded", "count", len(t.SubTasks))
+					subTasks := make([]*subTask, 0)
+					for _, sTask := range normalized {
+						subTasks = append(subTasks, s.createSubTasks(t, sTask.First, sTask.Last)...)
+					}
+					t.SubTasks = subTasks
+				}
 				for _, sEmptyTask := range t.SubEmptyTasks {
 					sEmptyTask.task = t
 				}
+				sortSubTasks(t.SubTasks)
+				sortSubEmptyTasks(t.SubEmptyTasks)
 			}
 		}
 	}
 
-	var states map[uint64]*SyncState
-	if status, _ := s.db.Get(SyncStatusKey); status != nil {
-		if err := json.Unmarshal(status, &states); err != nil {
-			log.Error("Failed to decode storage sync status", "err", err)
-		}
-	}
-
 	// create tasks
-	lastKvIndex := s.storageManager.LastKvIndex()
-	for _, sid := range s.storageManager.Shards() {
-		exist := false
-		for _, t := range progress.Tasks {
-			if t.Contract == s.storageManager.ContractAddress() && t.ShardId == sid {
-				if states != nil {
-					if state, ok := states[t.ShardId]; ok {
-						state.PeerCount = 0
-						t.state = state
+	for _, sm := range s.sortedStorageManagers() {
+		var states map[uint64]*SyncState
+		if status, _ := s.db.Get(s.syncStatusKey(sm.ContractAddress())); status != nil {
+			if err := json.Unmarshal(status, &states); err != nil {
+				log.Error("Failed to decode storage sync status", "contract", sm.ContractAddress().Hex(), "err", err)
+			}
+		}
+		lastKvIndex := sm.LastKvIndex()
+		s.lock.Lock()
+		s.lastKvIndexes[sm.ContractAddress()] = lastKvIndex
+		s.followedKvIndexes[sm.ContractAddress()] = lastKvIndex
+		s.lock.Unlock()
+		for _, sid := range sm.Shards() {
+			exist := false
+			for _, t := range progress.Tasks {
+				if t.Contract == sm.ContractAddress() && t.ShardId == sid {
+					if states != nil {
+						if state, ok := states[t.ShardId]; ok {
+							state.PeerCount = 0
+							t.state = state
+						}
 					}
-				}
-				if t.state == nil {
-					// TODO if t.state is nil, that mean the status is marshal by old state,
-					// set process value to SyncState to make it compatible.
-					// it can be removed after public test done.
-					t.state = &SyncState{
-						PeerCount:         0,
-						BlobsToSync:       0,
-						BlobsSynced:       progress.BlobsSynced,
-						SyncProgress:      0,
-						SyncedSeconds:     progress.TotalSecondsUsed,
-						EmptyFilled:       progress.EmptyBlobsFilled,
-						EmptyToFill:       0,
-						FillEmptySeconds:  progress.TotalSecondsUsed,
-						FillEmptyProgress: 0,
+					if t.state == nil {
+						// TODO if t.state is nil, that mean the status is marshal by old state,
+						// set process value to SyncState to make it compatible.
+						// it can be removed after public test done.
+						t.state = &SyncState{
+							PeerCount:         0,
+							BlobsToSync:       0,
+							BlobsSynced:       progress.BlobsSynced,
+							SyncProgress:      0,
+							SyncedSeconds:     progress.TotalSecondsUsed,
+							EmptyFilled:       progress.EmptyBlobsFilled,
+							EmptyToFill:       0,
+							FillEmptySeconds:  progress.TotalSecondsUsed,
+							FillEmptyProgress: 0,
+						}
 					}
+					s.tasks = append(s.tasks, t)
+					exist = true
+					continue
 				}
-				s.tasks = append(s.tasks, t)
-				exist = true
+			}
+			if exist {
 				continue
 			}
+
+			t := s.createTask(sm, sid, lastKvIndex)
+			s.tasks = append(s.tasks, t)
 		}
-		if exist {
-			continue
+	}
+
+	for _, t := range s.tasks {
+		s.loadHealLog(t)
+		s.skipFilledEmptyBlobs(t)
+	}
+	sortTasks(s.tasks)
+}
+
+// healLogPrefix returns the prefix of the keys of the records of the heal log of the shard.
+func healLogPrefix(contract common.Address, shardId uint64) []byte {
+	prefix := append(append([]byte{}, SyncHealLogKey...), contract.Bytes()...)
+	return binary.BigEndian.AppendUint64(prefix, shardId)
+}
+
+// healLogKey returns the key of the record of the heal log of the shard, the records are ordered by the keys.
+func healLogKey(contract common.Address, shardId uint64, seq uint64) []byte {
+	return binary.BigEndian.AppendUint64(healLogPrefix(contract, shardId), seq)
+}
+
+// loadHealLog replays the records of the heal log of the task to restore its heal indexes, which are only saved in
+// the heal log.
+func (s *SyncClient) loadHealLog(t *task) {
+	prefix := healLogPrefix(t.Contract, t.ShardId)
+	kvEntries := s.storageManagerOf(t.Contract).KvEntries()
+	it := s.db.NewIterator(prefix, nil)
+	defer it.Release()
+	for it.Next() {
+		if err := t.healTask.apply(it.Value(), t.ShardId*kvEntries, (t.ShardId+1)*kvEntries); err != nil {
+			s.shardLogger(t.Contract, t.ShardId).Warn("Failed to load heal log", "err", err)
+			break
 		}
+		t.healTask.logSeq = binary.BigEndian.Uint64(it.Key()[len(prefix):]) + 1
+		t.healTask.logLen++
+	}
+	t.healTask.journal = nil
+}
+
+// checkpointHealLog appends the changes of the heal indexes of the task since the last checkpoint to its heal log as
+// a delta record, so a healed blob is saved without rewriting the sync status. Once the heal log exceeds
+// maxHealLogRecords, it is compacted to a snapshot record of all the heal indexes instead. The caller must hold
+// the lock.
+func (s *SyncClient) checkpointHealLog(batch ethdb.Batch, t *task) {
+	h := t.healTask
+	queued, dequeued := h.takeJournal()
+	if len(queued) == 0 && len(dequeued) == 0 {
+		return
+	}
+	if h.logLen < maxHealLogRecords {
+		batch.Put(healLogKey(t.Contract, t.ShardId, h.logSeq), encodeHealDelta(queued, dequeued))
+		h.logSeq++
+		h.logLen++
+		return
+	}
+	for seq := uint64(1); seq < h.logSeq; seq++ {
+		batch.Delete(healLogKey(t.Contract, t.ShardId, seq))
+	}
+	batch.Put(healLogKey(t.Contract, t.ShardId, 0), encodeHealSnapshot(h.sortedIndexes()))
+	h.logSeq, h.logLen = 1, 1
+}
+
+// skipFilledEmptyBlobs removes the blobs already filled with empty blobs from the subEmptyTasks of the task by the
+// filled bitmap of the shard, e.g. filled by a prior run but not reflected in the saved status, so a restart does not
+// fill them again. The bitmap is kept along with the writes, so the metas of the shard are not read.
+func (s *SyncClient) skipFilledEmptyBlobs(t *task) {
+	if len(t.SubEmptyTasks) == 0 {
+		return
+	}
+	sm := s.storageManagerOf(t.Contract)
+	bitmap, err := sm.FilledBitmap(t.ShardId)
+	if err != nil {
+		s.shardLogger(t.Contract, t.ShardId).Warn("Failed to load filled bitmap", "err", err)
+		return
+	}
+	first := t.ShardId * sm.KvEntries()
+	filled := func(kvIdx uint64) bool {
+		i := kvIdx - first
+		return i/8 < uint64(len(bitmap)) && bitmap[i/8]&(1<<(i%8)) != 0
+	}
 
-		t := s.createTask(sid, lastKvIndex)
-		s.tasks = append(s.tasks, t)
+	subEmptyTasks, skipped := make([]*subEmptyTask, 0, len(t.SubEmptyTasks)), uint64(0)
+	for _, st := range t.SubEmptyTasks {
+		if st.done || st.isRunning {
+			subEmptyTasks = append(subEmptyTasks, st)
+			continue
+		}
+		split, n := splitSubEmptyTask(st, filled)
+		subEmptyTasks, skipped = append(subEmptyTasks, split...), skipped+n
 	}
+	if skipped == 0 {
+		return
+	}
+	t.SubEmptyTasks = subEmptyTasks
+	t.state.EmptyFilled += skipped
+	s.shardLogger(t.Contract, t.ShardId).Info("Skip blobs already filled", "filled", skipped,
+		"subEmptyTasks", len(subEmptyTasks))
+}
 
-	sort.Slice(s.tasks, func(i, j int) bool {
-		return s.tasks[i].ShardId < s.tasks[j].ShardId
-	})
+// splitSubEmptyTask splits the range of the subEmptyTask at the runs of the filled blobs as splitSubTask does, and
+// returns the subEmptyTasks of the ranges left to fill and the number of the filled blobs skipped. The short runs in
+// the middle of the range are filled again, which is harmless.
+func splitSubEmptyTask(st *subEmptyTask, filled func(uint64) bool) ([]*subEmptyTask, uint64) {
+	subEmptyTasks, skipped := make([]*subEmptyTask, 0), uint64(0)
+	start := st.First // first blob of the range left to fill
+	for idx := st.First; idx < st.Last; {
+		if !filled(idx) {
+			idx++
+			continue
+		}
+		end := idx
+		for end < st.Last && filled(end) {
+			end++
+		}
+		if end-idx >= minSubTaskSize || idx == start || end == st.Last {
+			if idx > start {
+				subEmptyTasks = append(subEmptyTasks, &subEmptyTask{task: st.task, First: start, Last: idx})
+			}
+			start = end
+			skipped += end - idx
+		}
+		idx = end
+	}
+	if start < st.Last {
+		subEmptyTasks = append(subEmptyTasks, &subEmptyTask{task: st.task, First: start, Last: st.Last})
+	}
+	return subEmptyTasks, skipped
 }
 
-func (s *SyncClient) createTask(sid uint64, lastKvIndex uint64) *task {
+func (s *SyncClient) createTask(sm StorageManager, sid uint64, lastKvIndex uint64) *task {
 	task := task{
-		Contract:       s.storageManager.ContractAddress(),
+		Contract:       sm.ContractAddress(),
 		ShardId:        sid,
 		nextIdx:        0,
 		statelessPeers: make(map[peer.ID]struct{}),
@@ -349,7 +883,7 @@ func (s *SyncClient) createTask(sid uint64, lastKvIndex uint64) *task {
 		Indexes: make(map[uint64]int64),
 	}
 
-	first, limit := s.storageManager.KvEntries()*sid, s.storageManager.KvEntries()*(sid+1)
+	first, limit := sm.KvEntries()*sid, sm.KvEntries()*(sid+1)
 	firstEmpty, limitForEmpty := uint64(0), uint64(0)
 	if first >= lastKvIndex {
 		firstEmpty, limitForEmpty = first, limit
@@ -359,6 +893,39 @@ func (s *SyncClient) createTask(sid uint64, lastKvIndex uint64) *task {
 		limit = lastKvIndex
 	}
 
+	subTasks := s.createSubTasks(&task, first, limit)
+
+	subEmptyTasks := make([]*subEmptyTask, 0)
+	if limitForEmpty > 0 {
+		task.state.EmptyToFill = limitForEmpty - firstEmpty
+		maxEmptyTaskSize := (limitForEmpty - firstEmpty + uint64(s.fillEmptyWorkers) - 1) / uint64(s.fillEmptyWorkers)
+		if maxEmptyTaskSize < minSubTaskSize {
+			maxEmptyTaskSize = minSubTaskSize
+		}
+
+		for firstEmpty < limitForEmpty {
+			last := firstEmpty + maxEmptyTaskSize
+			if last > limitForEmpty {
+				last = limitForEmpty
+			}
+			subTask := subEmptyTask{
+				task:  &task,
+				First: firstEmpty,
+				Last:  last,
+				done:  false,
+			}
+
+			subEmptyTasks = append(subEmptyTasks, &subTask)
+			firstEmpty = last
+		}
+	}
+
+	task.healTask, task.SubTasks, task.SubEmptyTasks = &healTask, subTasks, subEmptyTasks
+	return &task
+}
+
+// createSubTasks splits the blob range [first, limit) of the task into subTasks.
+func (s *SyncClient) createSubTasks(t *task, first, limit uint64) []*subTask {
 	subTasks := make([]*subTask, 0)
 	// split subTask for a shard to 16 subtasks and if one batch is too small
 	// set to minSubTaskSize
@@ -373,7 +940,7 @@ func (s *SyncClient) createTask(sid uint64, lastKvIndex uint64) *task {
 			last = limit
 		}
 		subTask := subTask{
-			task:  &task,
+			task:  t,
 			next:  first,
 			First: first,
 			Last:  last,
@@ -383,40 +950,155 @@ func (s *SyncClient) createTask(sid uint64, lastKvIndex uint64) *task {
 		subTasks = append(subTasks, &subTask)
 		first = last
 	}
+	return subTasks
+}
 
-	subEmptyTasks := make([]*subEmptyTask, 0)
-	if limitForEmpty > 0 {
-		task.state.EmptyToFill = limitForEmpty - firstEmpty
-		maxEmptyTaskSize := (limitForEmpty - firstEmpty + uint64(maxFillEmptyTaskTreads) - 1) / uint64(maxFillEmptyTaskTreads)
-		if maxEmptyTaskSize < minSubTaskSize {
-			maxEmptyTaskSize = minSubTaskSize
+// skipLocalBlobs checks the blobs pending in the subTasks against the local storage and the commits downloaded from
+// the contracts. The blobs already synced locally and matching their commits, e.g. synced by a prior run but not
+// reflected in the saved status, are removed from the subTasks not started yet, so a restart does not fetch them
+// again. It runs in the background along with the sync, so the blobs requested before they are checked are fetched.
+func (s *SyncClient) skipLocalBlobs() {
+	defer s.wg.Done()
+	defer close(s.localChecked)
+
+	s.lock.Lock()
+	tasks := slices.Clone(s.tasks)
+	s.lock.Unlock()
+	for _, t := range tasks {
+		valid := s.localValidBlobs(t)
+		if len(valid) == 0 {
+			continue
+		}
+		s.lock.Lock()
+		subTasks := make([]*subTask, 0, len(t.SubTasks))
+		for _, st := range t.SubTasks {
+			// only the subTasks not started yet are split, so no heal index is left out of the subTasks
+			if st.done || st.isRunning || st.First != st.next {
+				subTasks = append(subTasks, st)
+				continue
+			}
+			subTasks = append(subTasks, splitSubTask(st, valid)...)
 		}
+		t.SubTasks, t.nextIdx = subTasks, 0
+		s.lock.Unlock()
+		s.shardLogger(t.Contract, t.ShardId).Info("Skip blobs already synced locally", "valid", len(valid),
+			"subTasks", len(subTasks))
+	}
+}
 
-		for firstEmpty < limitForEmpty {
-			last := firstEmpty + maxEmptyTaskSize
-			if last > limitForEmpty {
-				last = limitForEmpty
+// localValidBlobs returns the kv indexes pending in the subTasks of the task whose blobs exist in the local storage,
+// match the commits downloaded from the contract and pass the commit verification. It returns nil once the sync
+// client is closed.
+func (s *SyncClient) localValidBlobs(t *task) map[uint64]struct{} {
+	sm := s.storageManagerOf(t.Contract)
+	unverified, err := sm.UnverifiedBlobs(t.ShardId)
+	if err != nil {
+		s.shardLogger(t.Contract, t.ShardId).Warn("Failed to check local blobs", "err", err)
+		return nil
+	}
+	skip := make(map[uint64]struct{}, len(unverified))
+	for _, idx := range unverified {
+		skip[idx] = struct{}{}
+	}
+
+	s.lock.Lock()
+	ranges := make([][2]uint64, 0, len(t.SubTasks))
+	for _, st := range t.SubTasks {
+		if !st.done && !st.isRunning {
+			ranges = append(ranges, [2]uint64{st.next, st.Last})
+		}
+	}
+	s.lock.Unlock()
+
+	var (
+		miner, _      = sm.GetShardMiner(t.ShardId)
+		encodeType, _ = sm.GetShardEncodeType(t.ShardId)
+		lastKvIndex   = sm.LastKvIndex()
+		valid         = make(map[uint64]struct{})
+	)
+	for _, r := range ranges {
+		for idx := r[0]; idx < r[1] && idx < lastKvIndex; idx++ {
+			if s.resCtx.Err() != nil {
+				return nil
 			}
-			subTask := subEmptyTask{
-				task:  &task,
-				First: firstEmpty,
-				Last:  last,
-				done:  false,
+			if _, ok := skip[idx]; ok {
+				continue
+			}
+			if s.localBlobValid(sm, idx, miner, encodeType) {
+				valid[idx] = struct{}{}
 			}
-
-			subEmptyTasks = append(subEmptyTasks, &subTask)
-			firstEmpty = last
 		}
 	}
+	return valid
+}
 
-	task.healTask, task.SubTasks, task.SubEmptyTasks = &healTask, subTasks, subEmptyTasks
-	return &task
+// localBlobValid reads the blob of the kv index from the local storage, and verifies it against the commit downloaded
+// from the contract. The blobs whose commits are not downloaded are not valid.
+func (s *SyncClient) localBlobValid(sm StorageManager, kvIdx uint64, miner common.Address, encodeType uint64) bool {
+	commit, ok := sm.ContractCommit(kvIdx)
+	if !ok {
+		return false
+	}
+	meta, success, err := sm.TryReadMeta(kvIdx)
+	if !success || err != nil {
+		return false
+	}
+	encodedBlob, success, err := sm.TryReadEncoded(kvIdx, int(sm.MaxKvSize()))
+	if !success || err != nil {
+		return false
+	}
+	blob, success, err := sm.DecodeKV(kvIdx, encodedBlob, common.BytesToHash(meta), miner, encodeType)
+	if !success || err != nil {
+		return false
+	}
+	root, err := s.prover.GetRoot(blob, 0, 0)
+	return err == nil && bytes.Equal(root[:ethstorage.HashSizeInContract], commit[:ethstorage.HashSizeInContract])
+}
+
+// splitSubTask splits the range of the subTask at the runs of the valid blobs, and returns the subTasks of the ranges
+// left to request. The runs shorter than minSubTaskSize in the middle of the range are kept in the range to avoid
+// fragmenting the subTask, the blobs of them are skipped when the response is committed as they are present.
+func splitSubTask(st *subTask, valid map[uint64]struct{}) []*subTask {
+	subTasks := make([]*subTask, 0)
+	start := st.next // first blob of the pending range
+	for idx := st.next; idx < st.Last; {
+		if _, ok := valid[idx]; !ok {
+			idx++
+			continue
+		}
+		end := idx
+		for end < st.Last {
+			if _, ok := valid[end]; !ok {
+				break
+			}
+			end++
+		}
+		if end-idx >= minSubTaskSize || idx == start || end == st.Last {
+			if idx > start {
+				subTasks = append(subTasks, &subTask{task: st.task, next: start, First: start, Last: idx})
+			}
+			start = end
+		}
+		idx = end
+	}
+	if start < st.Last {
+		subTasks = append(subTasks, &subTask{task: st.task, next: start, First: start, Last: st.Last})
+	}
+	return subTasks
 }
 
 // saveSyncStatus marshals the remaining sync tasks into leveldb.
 func (s *SyncClient) saveSyncStatus() {
 	s.lock.Lock()
 	defer s.lock.Unlock()
+	// save the tasks in a stable order, so the saved status is diffable across runs
+	sortTasks(s.tasks)
+	for _, t := range s.tasks {
+		// advance the First of the subTasks to the first blob not committed yet
+		cleanSubTasks(t)
+		sortSubTasks(t.SubTasks)
+		sortSubEmptyTasks(t.SubEmptyTasks)
+	}
 	// Store the actual progress markers
 	progress := &SyncProgress{
 		Tasks: s.tasks,
@@ -431,23 +1113,48 @@ func (s *SyncClient) saveSyncStatus() {
 	if err != nil {
 		panic(err) // This can only fail during implementation
 	}
-	if err := s.db.Put(SyncTasksKey, status); err != nil {
+	if len(status) > s.maxStatusSize {
+		log.Warn("Sync status is oversized", "size", len(status), "maxSize", s.maxStatusSize)
+	}
+	// the heal indexes are only saved in the heal logs, which are checkpointed along with the status
+	batch := s.db.NewBatch()
+	if err := batch.Put(SyncTasksKey, status); err != nil {
+		log.Error("Failed to store sync tasks", "err", err)
+	}
+	for _, t := range s.tasks {
+		s.checkpointHealLog(batch, t)
+	}
+	if err := batch.Write(); err != nil {
 		log.Error("Failed to store sync tasks", "err", err)
 	}
 	log.Debug("Save sync state to DB")
 
-	// save sync states to DB for status reporting
-	states := make(map[uint64]*SyncState)
+	// save sync states of each contract to DB for status reporting
+	states := make(map[common.Address]map[uint64]*SyncState)
 	for _, t := range s.tasks {
-		states[t.ShardId] = t.state
+		if states[t.Contract] == nil {
+			states[t.Contract] = make(map[uint64]*SyncState)
+		}
+		states[t.Contract][t.ShardId] = t.state
 	}
-	status, err = json.Marshal(states)
-	if err != nil {
-		panic(err) // This can only fail during implementation
+	for contract, contractStates := range states {
+		status, err = json.Marshal(contractStates)
+		if err != nil {
+			panic(err) // This can only fail during implementation
+		}
+		if err := s.db.Put(s.syncStatusKey(contract), status); err != nil {
+			log.Error("Failed to store sync states", "contract", contract.Hex(), "err", err)
+		}
 	}
-	if err := s.db.Put(SyncStatusKey, status); err != nil {
-		log.Error("Failed to store sync states", "err", err)
+}
+
+// syncStatusKey returns the key of the sync states of the contract, the states of the primary contract are kept
+// under SyncStatusKey for compatibility and the states of the other contracts are keyed by the contract too.
+func (s *SyncClient) syncStatusKey(contract common.Address) []byte {
+	if contract == s.storageManager.ContractAddress() {
+		return SyncStatusKey
 	}
+	return append(append([]byte{}, SyncStatusKey...), contract.Bytes()...)
 }
 
 // saveSyncStatus marshals the remaining sync tasks into leveldb.
@@ -456,10 +1163,20 @@ func (s *SyncClient) saveStatusLoop() {
 
 	ticker := time.NewTicker(5 * time.Minute)
 	defer ticker.Stop()
+	// the progress is saved progressSaveInterval after it is made, so a failure in the middle of a large subTask
+	// resumes from the last committed blob instead of the first blob of the subTask
+	var progressSave <-chan time.Time
 	for {
 		select {
 		case <-ticker.C:
 			s.saveSyncStatus()
+		case <-s.progressed:
+			if progressSave == nil {
+				progressSave = time.After(s.progressSaveInterval)
+			}
+		case <-progressSave:
+			progressSave = nil
+			s.saveSyncStatus()
 		case <-s.resCtx.Done():
 			s.log.Info("Stopped P2P sync client save status")
 			return
@@ -467,46 +1184,356 @@ func (s *SyncClient) saveStatusLoop() {
 	}
 }
 
-// cleanTasks removes kv range retrieval tasks that have already been completed.
-func (s *SyncClient) cleanTasks() {
-	// Sync wasn't finished previously, check for any subTask that can be finalized
+func (s *SyncClient) summaryLoop() {
+	defer s.wg.Done()
+
+	ticker := time.NewTicker(s.summaryInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			s.logSummary()
+		case <-s.resCtx.Done():
+			return
+		}
+	}
+}
+
+// stallWatchdog checks whether the sync is stalled, that is no blob has been committed for stallTimeout while
+// blobs remain to sync from peers. A stalled sync is reported once per stallTimeout until it makes progress again.
+func (s *SyncClient) stallWatchdog() {
+	defer s.wg.Done()
+
+	ticker := time.NewTicker(s.stallTimeout / 4)
+	defer ticker.Stop()
+	lastReport := time.Time{}
+	for {
+		select {
+		case <-ticker.C:
+			since := time.Unix(0, s.lastCommitTime.Load())
+			if lastReport.After(since) {
+				since = lastReport
+			}
+			if time.Since(since) < s.stallTimeout {
+				continue
+			}
+			if s.checkStalled() {
+				lastReport = time.Now()
+			}
+		case <-s.resCtx.Done():
+			return
+		}
+	}
+}
+
+// checkStalled reports a stalled sync if there are blobs remaining to sync from peers, and returns whether
+// it is reported. The SyncStalled event lets the p2p node discover new peers to re-seed the sync.
+func (s *SyncClient) checkStalled() bool {
+	s.lock.Lock()
+	// no blob is committed while paused, which is not a stall
+	if s.syncDone || s.paused {
+		s.lock.Unlock()
+		return false
+	}
+	peers, blobsToSync := len(s.peers), uint64(0)
+	for _, t := range s.tasks {
+		// no blob of the shard paused as the disk is full is committed, which is not a stall
+		if t.diskFull {
+			continue
+		}
+		blobsToSync += uint64(t.healTask.count())
+		for _, st := range t.SubTasks {
+			blobsToSync += st.Last - st.next
+		}
+	}
+	s.lock.Unlock()
+	if blobsToSync == 0 {
+		return false
+	}
+
+	lastCommit := time.Unix(0, s.lastCommitTime.Load())
+	s.log.Warn("Storage sync stalled, looking for new peers", "lastCommit", lastCommit,
+		"elapsed", common.PrettyDuration(time.Since(lastCommit)), "peers", peers, "blobsToSync", blobsToSync)
+	s.stalledFeed.Send(SyncStalled{LastCommit: lastCommit, BlobsToSync: blobsToSync})
+	return true
+}
+
+// SubscribeSyncStalled subscribes to the SyncStalled events, which are sent once no blob has been committed for the
+// stall timeout while blobs remain to sync.
+func (s *SyncClient) SubscribeSyncStalled(ch chan<- SyncStalled) event.Subscription {
+	return s.stalledFeed.Subscribe(ch)
+}
+
+// logSummary logs a single summary of the sync health over all the shards, including the connected peers,
+// the shards done, the overall download rate, the heal backlog, the empty blobs remaining to fill and the ETA.
+func (s *SyncClient) logSummary() {
+	s.lock.Lock()
+	peers, shardsDone := len(s.peers), 0
+	blobsToSync, healBacklog, emptyToFill, bytesToSync := uint64(0), 0, uint64(0), uint64(0)
+	for _, t := range s.tasks {
+		if t.done {
+			shardsDone++
+		}
+		taskBlobs := uint64(t.healTask.count())
+		for _, st := range t.SubTasks {
+			taskBlobs += st.Last - st.next
+		}
+		blobsToSync += taskBlobs
+		bytesToSync += taskBlobs * s.storageManagerOf(t.Contract).MaxKvSize()
+		healBacklog += t.healTask.count()
+		for _, st := range t.SubEmptyTasks {
+			emptyToFill += st.Last - st.First
+		}
+	}
+	shardsTotal, startTime := len(s.tasks), s.startTime
+	s.lock.Unlock()
+
+	rate := float64(0)
+	if elapsed := time.Since(startTime).Seconds(); elapsed > 0 {
+		rate = float64(s.syncedBytes.Load()) / elapsed
+	}
+	estTime := "No estimated time"
+	if blobsToSync == 0 {
+		estTime = common.PrettyDuration(0).String()
+	} else if rate > 0 {
+		etaSecondsLeft := float64(bytesToSync) / rate
+		estTime = common.PrettyDuration(time.Duration(etaSecondsLeft) * time.Second).String()
+	}
+
+	s.log.Info("Storage sync summary", "peers", peers, "shardsDone", shardsDone, "shardsTotal", shardsTotal,
+		"downloadRate", fmt.Sprintf("%s/s", common.StorageSize(rate)), "blobsToSync", blobsToSync,
+		"healBacklog", healBacklog, "emptyToFill", emptyToFill, "etaTimeLeft", estTime)
+}
+
+// Status returns the snapshot of the peers and the sync progress of the shards. Unlike the states reported in logs
+// which are refreshed occasionally, the remaining blobs and progresses are computed at the time of the call.
+func (s *SyncClient) Status() *SyncStatus {
 	s.lock.Lock()
 	defer s.lock.Unlock()
+
+	status := &SyncStatus{
+		SyncDone: s.syncDone,
+		Paused:   s.paused,
+		Peers:    make([]PeerStatus, 0, len(s.peers)),
+		Shards:   make([]ShardStatus, 0, len(s.tasks)),
+	}
+	for id, pr := range s.peers {
+		shards := make(map[common.Address][]uint64, len(pr.shards))
+		for contract, ids := range pr.shards {
+			shards[contract] = slices.Clone(ids)
+		}
+		status.Peers = append(status.Peers, PeerStatus{
+			ID:         id.String(),
+			Direction:  pr.direction.String(),
+			Shards:     shards,
+			RangeBatch: pr.rangeBatch,
+			RTT:        pr.rtt.Milliseconds(),
+			PeerStats:  pr.stats,
+		})
+	}
+	sort.Slice(status.Peers, func(i, j int) bool {
+		return status.Peers[i].ID < status.Peers[j].ID
+	})
+
+	now := time.Now()
+	for _, t := range s.tasks {
+		state := *t.state
+		state.BlobsToSync = uint64(t.healTask.count())
+		for _, st := range t.SubTasks {
+			state.BlobsToSync += st.Last - st.next
+		}
+		state.SyncProgress = 10000
+		if state.BlobsSynced+state.BlobsToSync != 0 {
+			state.SyncProgress = state.BlobsSynced * 10000 / (state.BlobsSynced + state.BlobsToSync)
+		}
+		state.EmptyToFill = 0
+		for _, st := range t.SubEmptyTasks {
+			state.EmptyToFill += st.Last - st.First
+		}
+		state.FillEmptyProgress = 10000
+		if state.EmptyFilled+state.EmptyToFill != 0 {
+			state.FillEmptyProgress = state.EmptyFilled * 10000 / (state.EmptyFilled + state.EmptyToFill)
+		}
+		status.Shards = append(status.Shards, ShardStatus{
+			Contract:           t.Contract,
+			ShardId:            t.ShardId,
+			Done:               t.done,
+			SubTaskRemain:      len(t.SubTasks),
+			HealTaskSize:       t.healTask.count(),
+			SubEmptyTaskRemain: len(t.SubEmptyTasks),
+			PermanentlyMissing: t.healTask.missingIndexes(),
+			BlobsPerSec:        t.rate.blobsPerSec(now),
+			ETASeconds:         t.rate.eta(now, state.BlobsToSync),
+			SyncState:          state,
+		})
+	}
+	return status
+}
+
+// HandleStatus serves the snapshot returned by Status as JSON.
+func (s *SyncClient) HandleStatus(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(s.Status()); err != nil {
+		s.log.Warn("Failed to write sync status", "err", err)
+	}
+}
+
+// cleanTasks removes kv range retrieval tasks that have already been completed, and returns whether all
+// the tasks are done.
+func (s *SyncClient) cleanTasks() bool {
+	// the metas of the shards done are scanned without the lock held, so the peer handlers are not blocked
+	verified := make(map[*task]bool)
+	for _, t := range s.finalizeTasks() {
+		verified[t] = s.shardVerified(t)
+	}
+
+	synced := make([]*task, 0)
+	s.lock.Lock()
 	allDone := true
 	for _, t := range s.tasks {
-		for i := 0; i < len(t.SubTasks); i++ {
-			exist, first := t.healTask.hasIndexInRange(t.SubTasks[i].First, t.SubTasks[i].next)
-			// if existed, min will be the smallest index in range [subTask.First, subTask.next)
-			// if no exist, min will be next, so subTask.First can directly set to subTask.next
-			t.SubTasks[i].First = first
-			if t.SubTasks[i].done && !exist {
-				t.SubTasks = append(t.SubTasks[:i], t.SubTasks[i+1:]...)
-				if t.nextIdx > i {
-					t.nextIdx--
-				}
-				i--
+		if t.done && !t.verified && verified[t] {
+			t.verified = true
+			synced = append(synced, t)
+			if s.mux != nil {
+				s.mux.Send(EthStorageSyncDone{DoneType: SingleShardDone, ShardId: t.ShardId})
 			}
 		}
+		if !t.done || !t.verified {
+			allDone = false
+		}
+	}
+	// If everything was just finalized, generate the account trie and origin heal
+	if allDone {
+		s.setSyncDone()
+		log.Info("Storage sync done", "subTaskCount", len(s.tasks))
+	}
+	s.lock.Unlock()
+	// the callbacks of the shards synced are called after the lock is released
+	s.notifyShardsSynced(synced)
+	return allDone
+}
+
+// finalizeTasks removes the subTasks that have already been completed, marks the tasks without subTasks done, and
+// returns the tasks done whose blobs are not verified yet.
+func (s *SyncClient) finalizeTasks() []*task {
+	// Sync wasn't finished previously, check for any subTask that can be finalized
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	batch := s.db.NewBatch()
+	defer func() {
+		if batch.ValueSize() == 0 {
+			return
+		}
+		if err := batch.Write(); err != nil {
+			log.Error("Failed to store heal logs", "err", err)
+		}
+	}()
+	unverified := make([]*task, 0)
+	for _, t := range s.tasks {
+		s.checkpointHealLog(batch, t)
+		cleanSubTasks(t)
 		for i := 0; i < len(t.SubEmptyTasks); i++ {
 			if t.SubEmptyTasks[i].done {
 				t.SubEmptyTasks = append(t.SubEmptyTasks[:i], t.SubEmptyTasks[i+1:]...)
 				i--
 			}
 		}
-		if len(t.SubTasks) > 0 || len(t.SubEmptyTasks) > 0 {
-			allDone = false
-		} else if !t.done {
+		sortSubTasks(t.SubTasks)
+		sortSubEmptyTasks(t.SubEmptyTasks)
+		if len(t.SubTasks) == 0 && len(t.SubEmptyTasks) == 0 {
 			t.done = true
-			if s.mux != nil {
-				s.mux.Send(EthStorageSyncDone{DoneType: SingleShardDone, ShardId: t.ShardId})
-			}
+		}
+		if t.done && !t.verified {
+			unverified = append(unverified, t)
 		}
 	}
+	return unverified
+}
 
-	// If everything was just finalized, generate the account trie and origin heal
-	if allDone {
-		s.setSyncDone()
-		log.Info("Storage sync done", "subTaskCount", len(s.tasks))
+// OnShardSynced registers fn to be called once for each shard when all its subTasks and heal indexes are done and
+// enough of its blobs are verified, so the miner can start mining the shard without waiting for all the shards
+// synced. fn is called without the lock held. It should be called before Start.
+func (s *SyncClient) OnShardSynced(fn func(contract common.Address, shardIdx uint64)) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.shardSynced = append(s.shardSynced, fn)
+}
+
+func (s *SyncClient) notifyShardsSynced(tasks []*task) {
+	if len(tasks) == 0 {
+		return
+	}
+	s.lock.Lock()
+	callbacks := s.shardSynced
+	s.lock.Unlock()
+	for _, t := range tasks {
+		for _, fn := range callbacks {
+			fn(t.Contract, t.ShardId)
+		}
+	}
+}
+
+// shardVerified checks whether enough in-range blobs of the task's shard are present and verified locally, so the
+// shard can be advertised as done to the miner. The unverified blobs are added to the heal task to fetch them again,
+// and the shard is not scanned again until the gap is healed. The metas of the shard are scanned without the lock held,
+// so the caller must not hold the lock.
+func (s *SyncClient) shardVerified(t *task) bool {
+	sm := s.storageManagerOf(t.Contract)
+	kvEntries := sm.KvEntries()
+	first, limit := t.ShardId*kvEntries, (t.ShardId+1)*kvEntries
+	if lastKvIdx := sm.LastKvIndex(); limit > lastKvIdx {
+		limit = lastKvIdx
+	}
+	if limit <= first {
+		return true
+	}
+	inRange := limit - first
+	maxGap := inRange - uint64(math.Ceil(s.minVerifiedRatio*float64(inRange)))
+	s.lock.Lock()
+	healing, missing := uint64(t.healTask.count()), uint64(len(t.healTask.missing))
+	s.lock.Unlock()
+	if healing > 0 {
+		return healing+missing <= maxGap
+	}
+
+	unverified, err := sm.UnverifiedBlobs(t.ShardId)
+	if err != nil {
+		s.shardLogger(t.Contract, t.ShardId).Warn("Failed to check unverified blobs", "err", err)
+		return false
+	}
+	if uint64(len(unverified)) <= maxGap {
+		return true
+	}
+	// the blobs given up as missing are not fetched again, so the shard stays undone if they are too many
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	toHeal := slices.DeleteFunc(unverified, func(idx uint64) bool {
+		_, ok := t.healTask.missing[idx]
+		return ok
+	})
+	if len(toHeal) == 0 {
+		return false
+	}
+	s.shardLogger(t.Contract, t.ShardId).Warn("Shard tasks are done but verified blobs are not enough",
+		"inRange", inRange, "unverified", len(unverified), "minVerifiedRatio", s.minVerifiedRatio)
+	t.healTask.insert(toHeal)
+	return false
+}
+
+// cleanSubTasks removes the subTasks which are done and have no blob to heal, the caller must hold the lock.
+func cleanSubTasks(t *task) {
+	for i := 0; i < len(t.SubTasks); i++ {
+		exist, first := t.healTask.hasIndexInRange(t.SubTasks[i].First, t.SubTasks[i].next)
+		// if existed, min will be the smallest index in range [subTask.First, subTask.next)
+		// if no exist, min will be next, so subTask.First can directly set to subTask.next
+		t.SubTasks[i].First = first
+		if t.SubTasks[i].done && !exist {
+			t.SubTasks = append(t.SubTasks[:i], t.SubTasks[i+1:]...)
+			if t.nextIdx > i {
+				t.nextIdx--
+			}
+			i--
+		}
 	}
 }
 
@@ -515,11 +1542,23 @@ func (s *SyncClient) Start() error {
 	s.loadSyncStatus()
 	s.lock.Lock()
 	s.closingPeers = false
+	s.startTime = time.Now()
 	s.lock.Unlock()
+	s.lastCommitTime.Store(time.Now().UnixNano())
 
-	s.wg.Add(2)
+	s.wg.Add(4)
 	go s.mainLoop()
 	go s.saveStatusLoop()
+	go s.summaryLoop()
+	go s.stallWatchdog()
+	if s.followMode {
+		s.wg.Add(1)
+		go s.followLoop()
+	}
+	if s.keepAliveInterval > 0 {
+		s.wg.Add(1)
+		go s.keepAliveLoop()
+	}
 
 	return nil
 }
@@ -535,6 +1574,17 @@ func (s *SyncClient) AddPeer(id peer.ID, shards map[common.Address][]uint64, dir
 		s.lock.Unlock()
 		return false
 	}
+	if !s.isAllowed(id) {
+		s.log.Debug("Cannot register peer for sync duties, peer is not in the allowlist", "peer", id)
+		s.lock.Unlock()
+		return false
+	}
+	if err := s.validateShards(shards); err != nil {
+		s.log.Warn("Cannot register peer for sync duties, peer advertises malformed shards", "peer", id, "err", err)
+		s.metrics.IncDropPeerCount()
+		s.lock.Unlock()
+		return false
+	}
 	if !s.needThisPeer(shards) {
 		s.log.Info("No need this peer, the connection would be closed later", "maxPeers", s.maxPeers,
 			"Peer count", len(s.peers), "peer", id.String(), "shards", shards)
@@ -544,127 +1594,1542 @@ func (s *SyncClient) AddPeer(id peer.ID, shards map[common.Address][]uint64, dir
 	}
 	// add new peer routine
 	pr := NewPeer(0, s.cfg.L2ChainID, id, s.newStreamFn, direction, s.syncerParams.InitRequestSize, s.storageManager.MaxKvSize(), shards)
+	pr.compression = s.cfg.CompressionEnabled
+	pr.streaming = s.cfg.StreamingEnabled
+	pr.maxFrameSize = frameSizeOf(s.cfg)
+	pr.bufPool = s.bufPool
+	pr.zstdDecoder = s.zstdDecoder
+	pr.maxDecodedSize = maxDecodedSizeOf(s.cfg)
+	pr.rangeBatch = s.clampRangeBatch(pr.rangeBatch)
 	s.peers[id] = pr
 
-	s.idlerPeers[id] = struct{}{}
 	s.addPeerToTask(shards)
 	s.metrics.IncPeerCount()
+	// the range requests are bounded by the last kv indexes of the peer once they are fetched
+	pr.lastKvIndexTime = time.Now()
+	s.wg.Add(1)
+	if s.encodeTypePolicy == EncodeTypeReEncode {
+		s.idlerPeers[id] = struct{}{}
+		go s.requestCapabilities(pr)
+	} else {
+		// the peer becomes idle once the encode types of the peer in the capabilities are fetched, so the
+		// peers are chosen by the encode types from their first requests
+		s.wg.Add(1)
+		go func() {
+			defer s.wg.Done()
+			s.requestCapabilities(pr)
+			s.lock.Lock()
+			if s.isRegistered(pr) {
+				s.idlerPeers[pr.id] = struct{}{}
+				s.notifyUpdate()
+			}
+			s.lock.Unlock()
+		}()
+	}
 	s.lock.Unlock()
 
 	s.notifyPeerJoin(id)
 	return true
 }
 
-func (s *SyncClient) RemovePeer(id peer.ID) {
-	s.lock.Lock()
-	defer s.lock.Unlock()
-	pr, ok := s.peers[id]
-	if !ok {
-		s.log.Debug("Cannot remove peer from sync duties, peer was not registered", "peer", id)
+// requestCapabilities fetches the capabilities from the peer when it joins, which also carry how the peer prefers to
+// be requested and its last kv indexes. The features of a peer which does not support the handshake are negotiated
+// per request as before, and its last kv indexes are fetched by a separate request.
+func (s *SyncClient) requestCapabilities(pr *Peer) {
+	defer s.wg.Done()
+
+	var caps Capabilities
+	returnCode, err := pr.RequestCapabilities(&caps)
+	if err != nil || returnCode != returnCodeSuccess {
+		s.log.Debug("Request capabilities failed", "peer", pr.id, "code", returnCode, "err", err)
+		s.updateLastKvIndex(pr)
 		return
 	}
-	pr.resCancel() // once loop exits
-	delete(s.peers, id)
-	s.removePeerFromTask(pr.shards)
-	s.metrics.DecPeerCount()
-	delete(s.idlerPeers, id)
-	for _, t := range s.tasks {
-		delete(t.statelessPeers, id)
+	pr.caps.Store(&caps)
+	pr.checksum.Store(caps.Checksum)
+	s.lock.Lock()
+	pr.preferRange = caps.PreferRange
+	for _, et := range caps.EncodeTypes {
+		if et != nil {
+			pr.setEncodeType(et.Contract, et.ShardId, et.EncodeType)
+		}
+	}
+	if caps.LastKvIndexes != nil && s.isRegistered(pr) {
+		for _, index := range caps.LastKvIndexes {
+			if index != nil {
+				pr.lastKvIndex[index.Contract] = index.LastKvIndex
+			}
+		}
+		s.notifyUpdate()
+	}
+	s.lock.Unlock()
+	s.log.Debug("Peer capabilities", "peer", pr.id, "version", caps.Version, "compression", caps.Compression,
+		"encodeTypes", len(caps.EncodeTypes), "preferRange", caps.PreferRange, "checksum", caps.Checksum)
+	if caps.LastKvIndexes == nil {
+		s.updateLastKvIndex(pr)
 	}
 }
 
-// Close will shut down the sync client and all attached work, and block until shutdown is complete.
-// This will block if the Start() has not created the main background loop.
-func (s *SyncClient) Close() error {
+// announceShards pushes the shards of all the contracts to sync to the connected peers, so the peers start to request
+// the blobs of the new shards without reconnecting.
+func (s *SyncClient) announceShards() {
+	defer s.wg.Done()
+
+	shards := make(map[common.Address][]uint64)
+	for contract, sm := range s.storageManagers {
+		shards[contract] = sm.Shards()
+	}
 	s.lock.Lock()
-	s.closingPeers = true
+	peers := make([]*Peer, 0, len(s.peers))
+	for _, pr := range s.peers {
+		peers = append(peers, pr)
+	}
 	s.lock.Unlock()
-	s.resCancel()
-	s.wg.Wait()
-	s.cleanTasks()
-	s.report(true)
-	s.saveSyncStatus()
-	return nil
-}
 
-func (s *SyncClient) RequestL2Range(start, end uint64) (uint64, error) {
-	for _, pr := range s.peers {
-		id := rand.Uint64()
-		var packet BlobsByRangePacket
-		_, err := pr.RequestBlobsByRange(id, s.storageManager.ContractAddress(), start/s.storageManager.KvEntries(), start, end, &packet)
-		if err != nil {
-			return 0, err
+	for _, pr := range peers {
+		returnCode, err := pr.UpdateShardList(shards)
+		if err != nil || returnCode != returnCodeSuccess {
+			s.log.Debug("Update shard list failed", "peer", pr.id, "code", returnCode, "err", err)
 		}
-		_, _, _, err = s.onResult(packet.Blobs)
-		if err != nil {
-			return 0, err
+	}
+}
+
+// HandleUpdateShardList handles the shard list pushed by a connected peer, and updates the shards served by the peer.
+func (s *SyncClient) HandleUpdateShardList(ctx context.Context, log log.Logger, stream network.Stream) {
+	rCode := byte(returnCodeSuccess)
+	msg, _, err := ReadMsg(stream)
+	if err != nil {
+		log.Warn("Read update shard list failed", "err", err)
+		return
+	}
+	var css []*ContractShards
+	if err := rlp.DecodeBytes(msg, &css); err != nil {
+		log.Warn("Decode update shard list failed", "err", err)
+		rCode = returnCodeInvalidRequest
+	} else {
+		shards := ConvertToShardList(css)
+		if err := s.validateShards(shards); err != nil {
+			log.Warn("Update shard list is malformed", "err", err)
+			rCode = returnCodeInvalidRequest
+		} else if !s.updatePeerShards(stream.Conn().RemotePeer(), shards) {
+			rCode = returnCodeServerError
 		}
-		return id, nil
 	}
-	return 0, fmt.Errorf("no peer can be used to send requests")
+
+	if err := writeMsg(stream, &Msg{rCode, []byte{}}, p2pReadWriteTimeout); err != nil {
+		log.Warn("Write response failed for HandleUpdateShardList", "err", err.Error())
+	}
+	log.Debug("Write response done for HandleUpdateShardList", "returnCode", rCode)
 }
 
-func (s *SyncClient) RequestL2List(indexes []uint64) (uint64, error) {
-	if len(indexes) == 0 {
-		return 0, nil
+// validateShards checks the shards advertised by a peer are within sane limits: the contracts and the shards of each
+// contract are bounded, and the shards of the contracts synced locally are within the range of the kv indexes.
+func (s *SyncClient) validateShards(shards map[common.Address][]uint64) error {
+	if len(shards) > maxAdvertisedContracts {
+		return fmt.Errorf("%d contracts exceed the max %d", len(shards), maxAdvertisedContracts)
 	}
-	for _, pr := range s.peers {
-		id := rand.Uint64()
-		var packet BlobsByListPacket
-		_, err := pr.RequestBlobsByList(id, s.storageManager.ContractAddress(), indexes[0]/s.storageManager.KvEntries(), indexes, &packet)
-		if err != nil {
-			return 0, err
+	for contract, shardIds := range shards {
+		if len(shardIds) > maxAdvertisedShards {
+			return fmt.Errorf("%d shards of contract %s exceed the max %d", len(shardIds), contract.Hex(), maxAdvertisedShards)
 		}
-		_, _, _, err = s.onResult(packet.Blobs)
-		if err != nil {
-			return 0, err
+		sm := s.storageManagerOf(contract)
+		if sm == nil {
+			continue
+		}
+		// the kv indexes of the last shard must not overflow
+		maxShardId := math.MaxUint64/sm.KvEntries() - 1
+		for _, shardId := range shardIds {
+			if shardId > maxShardId {
+				return fmt.Errorf("shard %d of contract %s is out of the kv index range", shardId, contract.Hex())
+			}
 		}
-		return id, nil
 	}
-	return 0, fmt.Errorf("no peer can be used to send requests")
+	return nil
 }
 
-func (s *SyncClient) mainLoop() {
+// updatePeerShards replaces the shards served by the peer, the tasks of the shards newly served by the peer are
+// assigned to it from the next round. It returns false if the peer is not registered.
+func (s *SyncClient) updatePeerShards(id peer.ID, shards map[common.Address][]uint64) bool {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	pr, ok := s.peers[id]
+	if !ok {
+		return false
+	}
+	s.removePeerFromTask(pr.shards)
+	pr.shards = shards
+	s.addPeerToTask(shards)
+	s.log.Info("Peer shards updated", "peer", shortPeerID(id), "shards", shards)
+	s.notifyUpdate()
+	return true
+}
+
+// refreshLastKvIndex fetches the last kv indexes of the contracts from the peer, so the range requests assigned to
+// the peer are bounded by the blobs it has. They are carried by the capabilities when the peer joins, and fetched
+// again after the contracts grow in follow mode or a request to the peer fails, see maybeRefreshLastKvIndex. The
+// known last kv indexes are kept if the request fails, and a peer which does not support the protocol is not bounded.
+func (s *SyncClient) refreshLastKvIndex(pr *Peer) {
 	defer s.wg.Done()
+	s.updateLastKvIndex(pr)
+}
 
-	s.cleanTasks()
-	if !s.syncDone {
-		err := s.storageManager.DownloadAllMetas(s.resCtx, s.syncerParams.MetaDownloadBatchSize)
+// updateLastKvIndex fetches the last kv indexes of the peer, and updates them unless the peer is removed.
+func (s *SyncClient) updateLastKvIndex(pr *Peer) {
+	indexes := s.fetchLastKvIndex(pr)
+	if len(indexes) == 0 {
+		return
+	}
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if !s.isRegistered(pr) {
+		return
+	}
+	for _, index := range indexes {
+		pr.lastKvIndex[index.Contract] = index.LastKvIndex
+	}
+	s.notifyUpdate()
+}
+
+// maybeRefreshLastKvIndex fetches the last kv indexes of the peer again in the background, if they are not fetched
+// within lastKvIndexRefresh, as the peer may have synced or reverted blobs since. The caller must hold the lock.
+func (s *SyncClient) maybeRefreshLastKvIndex(pr *Peer) {
+	if s.closingPeers || time.Since(pr.lastKvIndexTime) < s.lastKvIndexRefresh {
+		return
+	}
+	pr.lastKvIndexTime = time.Now()
+	s.wg.Add(1)
+	go s.refreshLastKvIndex(pr)
+}
+
+// fetchLastKvIndex requests the last kv indexes of the contracts from the peer, it returns nil if the request fails.
+func (s *SyncClient) fetchLastKvIndex(pr *Peer) []*ContractLastKvIndex {
+	var indexes []*ContractLastKvIndex
+	returnCode, err := pr.RequestLastKvIndex(&indexes)
+	if err != nil || returnCode != returnCodeSuccess {
+		s.log.Debug("Request last kv index failed", "peer", pr.id, "code", returnCode, "err", err)
+		return nil
+	}
+	return indexes
+}
+
+func (s *SyncClient) RemovePeer(id peer.ID) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.removePeer(id)
+}
+
+// SetAllowlist restricts the sync to the peers in ids, an empty ids allows all the peers. The registered peers
+// out of the allowlist are removed from sync duties, while their connections are kept for gossip.
+func (s *SyncClient) SetAllowlist(ids []peer.ID) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	if len(ids) == 0 {
+		s.allowlist = nil
+		return
+	}
+	s.allowlist = make(map[peer.ID]struct{}, len(ids))
+	for _, id := range ids {
+		s.allowlist[id] = struct{}{}
+	}
+	for id := range s.peers {
+		if !s.isAllowed(id) {
+			s.log.Info("Remove peer out of the allowlist from sync duties", "peer", id)
+			s.removePeer(id)
+		}
+	}
+}
+
+// IsAllowed returns whether the peer is allowed to sync with by the allowlist.
+func (s *SyncClient) IsAllowed(id peer.ID) bool {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return s.isAllowed(id)
+}
+
+// isAllowed works as IsAllowed, the caller should hold the lock.
+func (s *SyncClient) isAllowed(id peer.ID) bool {
+	if s.allowlist == nil {
+		return true
+	}
+	_, ok := s.allowlist[id]
+	return ok
+}
+
+// removePeer removes the peer from sync duties, the caller should hold the lock.
+func (s *SyncClient) removePeer(id peer.ID) {
+	pr, ok := s.peers[id]
+	if !ok {
+		s.log.Debug("Cannot remove peer from sync duties, peer was not registered", "peer", id)
+		return
+	}
+	pr.resCancel() // once loop exits, and abort the requests in flight to the peer
+	delete(s.peers, id)
+	s.removePeerFromTask(pr.shards)
+	s.metrics.DecPeerCount()
+	delete(s.idlerPeers, id)
+	delete(s.peerRequests, id)
+	delete(s.invalidBlobs, id)
+	for _, t := range s.tasks {
+		delete(t.statelessPeers, id)
+	}
+}
+
+// isRegistered returns whether pr is the registered peer of its id, so the requests to a peer removed or replaced
+// by a reconnect do not update the state of the peer registered later. The caller must hold the lock.
+func (s *SyncClient) isRegistered(pr *Peer) bool {
+	return s.peers[pr.id] == pr
+}
+
+// SetPeerBanner sets the function to ban the peers which delivered too many invalid blobs, e.g. by the connection
+// gater, so they cannot reconnect after being removed. It should be called before Start.
+func (s *SyncClient) SetPeerBanner(ban func(id peer.ID) error) {
+	s.banPeer = ban
+}
+
+// SubscribePeerBanned subscribes to the PeerBanned events, which are sent once a peer is removed from sync duties
+// because it delivered too many invalid blobs.
+func (s *SyncClient) SubscribePeerBanned(ch chan<- PeerBanned) event.Subscription {
+	return s.bannedFeed.Subscribe(ch)
+}
+
+// Pause stops dispatching new requests to the peers and filling empty blobs, e.g. to free CPU and IO for mining,
+// until Resume is called. The in-flight requests and fill empty workers finish as usual, and the peers and the
+// tasks are kept.
+func (s *SyncClient) Pause() {
+	s.setPaused(true)
+}
+
+// Resume continues the sync paused by Pause.
+func (s *SyncClient) Resume() {
+	// no blob is committed while paused, so the stall timeout restarts from the resume
+	s.lastCommitTime.Store(time.Now().UnixNano())
+	s.setPaused(false)
+	s.notifyUpdate()
+}
+
+// IsPaused returns whether the sync is paused by Pause.
+func (s *SyncClient) IsPaused() bool {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return s.paused
+}
+
+func (s *SyncClient) setPaused(paused bool) {
+	s.lock.Lock()
+	if s.paused == paused {
+		s.lock.Unlock()
+		return
+	}
+	s.paused = paused
+	s.lock.Unlock()
+
+	if paused {
+		s.log.Info("Storage sync paused")
+	} else {
+		s.log.Info("Storage sync resumed")
+	}
+	s.pausedFeed.Send(SyncPaused{Paused: paused})
+}
+
+// SubscribeSyncPaused subscribes to the SyncPaused events, which are sent once the sync is paused or resumed.
+func (s *SyncClient) SubscribeSyncPaused(ch chan<- SyncPaused) event.Subscription {
+	return s.pausedFeed.Subscribe(ch)
+}
+
+// Close will shut down the sync client and all attached work, and block until shutdown is complete.
+// This will block if the Start() has not created the main background loop.
+func (s *SyncClient) Close() error {
+	s.lock.Lock()
+	s.closingPeers = true
+	s.lock.Unlock()
+	s.resCancel()
+	s.wg.Wait()
+	s.decodePool.wait()
+	s.cleanTasks()
+	s.report(true)
+	s.saveSyncStatus()
+	return nil
+}
+
+func (s *SyncClient) RequestL2Range(start, end uint64) (uint64, error) {
+	id, _, err := s.RequestL2RangeWithResults(start, end)
+	return id, err
+}
+
+// RequestL2RangeWithResults works as RequestL2Range, and also returns the outcome of each blob index
+// in the range (both start and end are included) for diagnostics. Blobs not returned by the peer are
+// reported as BlobNotReturned, and the caller may queue them by HealIndexes to retrieve them later. Blobs
+// out of the shard of start or not less than the last kv index are reported as BlobNotServed.
+func (s *SyncClient) RequestL2RangeWithResults(start, end uint64) (uint64, []*BlobSyncResult, error) {
+	var pr *Peer
+	s.lock.Lock()
+	for _, p := range s.peers {
+		pr = p
+		break
+	}
+	s.lock.Unlock()
+	if pr == nil {
+		return 0, nil, fmt.Errorf("no peer can be used to send requests")
+	}
+	return s.requestL2RangeFrom(context.Background(), pr, start, end)
+}
+
+// RequestL2RangeFromPeer works as RequestL2RangeWithResults, but forces the request to the peer of the id instead
+// of the peer picked by the client, e.g. to debug the blobs served by a specific peer. It fails if the peer is not
+// connected or does not serve the shard of start, and the request is aborted once ctx is done.
+func (s *SyncClient) RequestL2RangeFromPeer(ctx context.Context, id peer.ID, start, end uint64) (uint64, []*BlobSyncResult, error) {
+	pr, err := s.shardPeer(id, start/s.storageManager.KvEntries())
+	if err != nil {
+		return 0, nil, err
+	}
+	return s.requestL2RangeFrom(ctx, pr, start, end)
+}
+
+// RequestBlobPrefixesFromPeer requests the first maxBytesPerBlob bytes of each encoded blob in the range (both start
+// and end are included) from the peer of the id, e.g. to check the headers of the blobs served by the peer with less
+// bandwidth. The returned blobs are partial, so they are neither verified nor committed to the local storage.
+func (s *SyncClient) RequestBlobPrefixesFromPeer(ctx context.Context, id peer.ID, start, end, maxBytesPerBlob uint64) ([]*BlobPayload, error) {
+	if maxBytesPerBlob == 0 {
+		return nil, fmt.Errorf("max bytes per blob should be positive")
+	}
+	shardId := start / s.storageManager.KvEntries()
+	pr, err := s.shardPeer(id, shardId)
+	if err != nil {
+		return nil, err
+	}
+	var packet BlobsByRangePacket
+	_, err = pr.RequestBlobPrefixesByRangeWithContext(ctx, rand.Uint64(), s.storageManager.ContractAddress(), shardId,
+		start, end, maxBytesPerBlob, &packet)
+	if err != nil {
+		return nil, err
+	}
+	return packet.Blobs, nil
+}
+
+// shardPeer returns the connected peer of the id, which fails if the peer does not serve the shard.
+func (s *SyncClient) shardPeer(id peer.ID, shardId uint64) (*Peer, error) {
+	s.lock.Lock()
+	pr, ok := s.peers[id]
+	s.lock.Unlock()
+	if !ok {
+		return nil, fmt.Errorf("peer %s is not connected", id.String())
+	}
+	if !pr.IsShardExist(s.storageManager.ContractAddress(), shardId) {
+		return nil, fmt.Errorf("peer %s does not serve shard %d", id.String(), shardId)
+	}
+	return pr, nil
+}
+
+// requestL2RangeFrom requests the range of blobs from the peer and returns the outcome of each blob index in the
+// range, see RequestL2RangeWithResults. The request is aborted once ctx is done, and the blobs received are not
+// committed then.
+func (s *SyncClient) requestL2RangeFrom(ctx context.Context, pr *Peer, start, end uint64) (uint64, []*BlobSyncResult, error) {
+	if err := ctx.Err(); err != nil {
+		return 0, nil, err
+	}
+	id := rand.Uint64()
+	shardId := start / s.storageManager.KvEntries()
+	ctx, span := s.tracer.Start(ctx, spanRequestL2Range, SpanAttribute{"peer", pr.id.String()},
+		SpanAttribute{"shard", shardId}, SpanAttribute{"origin", start}, SpanAttribute{"limit", end})
+	var packet BlobsByRangePacket
+	_, rtSpan := s.tracer.Start(ctx, spanRoundTrip)
+	_, err := pr.RequestBlobsByRangeWithContext(ctx, id, s.storageManager.ContractAddress(), shardId, start, end, &packet)
+	endSpan(rtSpan, err)
+	if err == nil {
+		err = ctx.Err()
+	}
+	if err != nil {
+		endSpan(span, err)
+		return 0, nil, err
+	}
+	present := s.presentBlobs(packet.Blobs)
+	_, _, inserted, failures, err := s.processBlobs(ctx, pr.id, s.storageManager.ContractAddress(), packet.Blobs, false)
+	endSpan(span, err)
+	if err != nil {
+		return 0, nil, err
+	}
+
+	returned := make(map[uint64]struct{})
+	for _, payload := range packet.Blobs {
+		returned[payload.BlobIndex] = struct{}{}
+	}
+	committed := make(map[uint64]struct{})
+	for _, idx := range inserted {
+		committed[idx] = struct{}{}
+	}
+
+	// blobs out of the shard or not less than the last kv index will not be served by peers
+	limit := s.storageManager.KvEntries() * (shardId + 1)
+	if lastKvIndex := s.storageManager.LastKvIndex(); lastKvIndex < limit {
+		limit = lastKvIndex
+	}
+	results := make([]*BlobSyncResult, 0)
+	for idx := start; idx <= end; idx++ {
+		result := &BlobSyncResult{Index: idx}
+		if idx >= limit {
+			result.Outcome = BlobNotServed
+		} else if _, ok := returned[idx]; !ok {
+			result.Outcome = BlobNotReturned
+		} else if _, ok := present[idx]; ok {
+			result.Outcome = BlobAlreadyPresent
+		} else if _, ok := committed[idx]; ok {
+			result.Outcome = BlobCommitted
+		} else {
+			result.Outcome = BlobFailed
+			result.Reason = failures[idx]
+		}
+		results = append(results, result)
+	}
+	return id, results, nil
+}
+
+// HealIndexes queues the blobs of the contract to the heal tasks of their shards, e.g. the blobs reported as
+// BlobNotReturned by RequestL2RangeWithResults, so they are retrieved from the peers later. The indexes of the shards
+// not synced by the client are ignored.
+func (s *SyncClient) HealIndexes(contract common.Address, indexes []uint64) {
+	sm := s.storageManagerOf(contract)
+	if sm == nil {
+		return
+	}
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	for _, t := range s.tasks {
+		if t.Contract != contract {
+			continue
+		}
+		shardIndexes := make([]uint64, 0, len(indexes))
+		for _, idx := range indexes {
+			if idx/sm.KvEntries() == t.ShardId {
+				shardIndexes = append(shardIndexes, idx)
+			}
+		}
+		if len(shardIndexes) > 0 {
+			t.healTask.insert(shardIndexes)
+		}
+	}
+}
+
+// RequestL2List requests the blobs of the indexes from the peers. The indexes are split into batches of at most
+// maxListBatchSize blobs, and the batches are pipelined across the peers serving the shard concurrently, the blobs
+// a peer does not return are requested from the other peers. It returns the count of the blobs synced.
+func (s *SyncClient) RequestL2List(indexes []uint64) (uint64, error) {
+	return s.RequestL2ListWithContext(context.Background(), indexes)
+}
+
+// RequestL2ListWithContext works as RequestL2List, and stops dispatching the batches and aborts the in-flight
+// requests once ctx is done, in which case it returns the count of the blobs synced so far with the error of ctx.
+func (s *SyncClient) RequestL2ListWithContext(ctx context.Context, indexes []uint64) (uint64, error) {
+	if len(indexes) == 0 {
+		return 0, nil
+	}
+	shardIndexes := make(map[uint64][]uint64)
+	for _, idx := range indexes {
+		shardId := idx / s.storageManager.KvEntries()
+		shardIndexes[shardId] = append(shardIndexes[shardId], idx)
+	}
+	shardPeers := make(map[uint64][]*Peer)
+	s.lock.Lock()
+	for shardId := range shardIndexes {
+		for _, pr := range s.peers {
+			if pr.IsShardExist(s.storageManager.ContractAddress(), shardId) {
+				shardPeers[shardId] = append(shardPeers[shardId], pr)
+			}
+		}
+	}
+	s.lock.Unlock()
+	for shardId := range shardIndexes {
+		if len(shardPeers[shardId]) == 0 {
+			return 0, fmt.Errorf("no peer can be used to send requests for shard %d", shardId)
+		}
+	}
+
+	var (
+		wg       sync.WaitGroup
+		mu       sync.Mutex
+		synced   uint64
+		missing  int
+		firstErr error
+	)
+	for shardId, list := range shardIndexes {
+		batches := make(chan []uint64, (uint64(len(list))+s.maxListBatchSize-1)/s.maxListBatchSize)
+		for start := uint64(0); start < uint64(len(list)); start += s.maxListBatchSize {
+			end := start + s.maxListBatchSize
+			if end > uint64(len(list)) {
+				end = uint64(len(list))
+			}
+			batches <- list[start:end]
+		}
+		close(batches)
+
+		// one worker for each peer, and each worker requests the batches from its peer first
+		peers := shardPeers[shardId]
+		for i := range peers {
+			wg.Add(1)
+			go func(shardId uint64, first int) {
+				defer wg.Done()
+				for batch := range batches {
+					if ctx.Err() != nil {
+						return
+					}
+					count, remaining, err := s.requestListFromPeers(ctx, shardId, batch, peers, first)
+					mu.Lock()
+					synced += count
+					missing += len(remaining)
+					if err != nil && firstErr == nil {
+						firstErr = err
+					}
+					mu.Unlock()
+				}
+			}(shardId, i)
+		}
+	}
+	wg.Wait()
+
+	if err := ctx.Err(); err != nil {
+		return synced, err
+	}
+	if firstErr != nil {
+		return synced, firstErr
+	}
+	if missing > 0 {
+		return synced, fmt.Errorf("%d blobs can not be fetched from the peers", missing)
+	}
+	return synced, nil
+}
+
+// requestListFromPeers requests the blobs of the indexes from the peers in turn starting from peers[first],
+// until all the blobs are returned, all the peers are tried or ctx is done. It returns the count of the blobs synced
+// and the indexes which no peer returns.
+func (s *SyncClient) requestListFromPeers(ctx context.Context, shardId uint64, indexes []uint64, peers []*Peer, first int) (uint64, []uint64, error) {
+	synced := uint64(0)
+	for i := 0; i < len(peers) && len(indexes) > 0 && ctx.Err() == nil; i++ {
+		pr := peers[(first+i)%len(peers)]
+		// the blobs missing from the peer are left to the next peer
+		held, missing := s.availableIndexes(pr, s.storageManager.ContractAddress(), shardId, indexes)
+		if len(held) == 0 {
+			continue
+		}
+		var packet BlobsByListPacket
+		// a slow peer is abandoned after the timeout, and the batch is requested from the next peer
+		reqCtx, cancel := context.WithTimeout(ctx, s.listRequestTimeout)
+		_, err := pr.RequestBlobsByListWithContext(reqCtx, rand.Uint64(), s.storageManager.ContractAddress(), shardId, held, &packet)
+		cancel()
 		if err != nil {
-			log.Error("Download blob metadata failed", "error", err)
+			s.log.Debug("Request blobs by list failed", "peer", pr.id, "count", len(held), "err", err)
+			continue
+		}
+		_, _, inserted, err := s.onResult(ctx, pr.id, s.storageManager.ContractAddress(), packet.Blobs, false)
+		if err != nil {
+			return synced, indexes, err
+		}
+		synced += uint64(len(inserted))
+
+		returned := make(map[uint64]struct{})
+		for _, payload := range packet.Blobs {
+			returned[payload.BlobIndex] = struct{}{}
+		}
+		remaining := missing
+		for _, idx := range held {
+			if _, ok := returned[idx]; !ok {
+				remaining = append(remaining, idx)
+			}
+		}
+		slices.Sort(remaining)
+		indexes = remaining
+	}
+	return synced, indexes, nil
+}
+
+// availableIndexes asks the peer which of the indexes of the shard it holds, and returns the indexes held and
+// missing from the peer. The peer is asked the range from the first index to the end of the shard, so the answer is
+// reused for the following requests of the range until availabilityTTL passes. If the peer fails to answer, all the
+// indexes are returned as held, so they are requested from the peer as before, and the peer not serving
+// RequestAvailabilityProtocolID is not asked again.
+func (s *SyncClient) availableIndexes(pr *Peer, contract common.Address, shardId uint64, indexes []uint64) ([]uint64, []uint64) {
+	if len(indexes) == 0 || pr.noAvailability.Load() {
+		return indexes, nil
+	}
+	origin, last := slices.Min(indexes), slices.Max(indexes)
+	avail := pr.availability.Load()
+	if !avail.covers(contract, shardId, origin, last) {
+		sm := s.storageManagerOf(contract)
+		if sm == nil {
+			return indexes, nil
+		}
+		var res AvailabilityPacket
+		reqId := rand.Uint64()
+		returnCode, err := pr.RequestAvailability(reqId, contract, shardId, origin, (shardId+1)*sm.KvEntries()-1, &res)
+		if err != nil || returnCode != returnCodeSuccess {
+			s.log.Debug("Request availability failed", "peer", pr.id, "shard", shardId, "returnCode", returnCode, "err", err)
+			// the stream of the protocol is not opened if the peer does not serve it
+			if returnCode == streamError {
+				pr.noAvailability.Store(true)
+			}
+			return indexes, nil
+		}
+		if res.ID != reqId || res.Contract != contract || res.ShardId != shardId || res.Origin != origin {
+			s.log.Debug("Availability mismatches the request", "peer", pr.id, "reqId", reqId, "resId", res.ID)
+			return indexes, nil
+		}
+		avail = &peerAvailability{
+			contract: contract,
+			shardId:  shardId,
+			origin:   res.Origin,
+			limit:    res.Limit,
+			bitmap:   res.Bitmap,
+			time:     time.Now(),
+		}
+		pr.availability.Store(avail)
+	}
+	held, missing := make([]uint64, 0, len(indexes)), make([]uint64, 0)
+	for _, idx := range indexes {
+		// the indexes beyond the range answered by the peer are unknown, so they are requested anyway
+		if idx > avail.limit || avail.bitmap.Has(idx-avail.origin) {
+			held = append(held, idx)
+		} else {
+			missing = append(missing, idx)
+		}
+	}
+	return held, missing
+}
+
+// RequestChunkProof requests the chunk of chunkIdx of the blob of kvIdx with its KZG proof from the peer, the chunk
+// is the 32 bytes field element of the blob. The proof should be verified by VerifyChunkProof against the commit of
+// the blob, e.g. read from L1.
+func (s *SyncClient) RequestChunkProof(id peer.ID, kvIdx, chunkIdx uint64) (*ChunkProofPacket, error) {
+	s.lock.Lock()
+	pr, ok := s.peers[id]
+	s.lock.Unlock()
+	if !ok {
+		return nil, fmt.Errorf("peer %s is not registered", id)
+	}
+
+	var res ChunkProofPacket
+	returnCode, err := pr.RequestChunkProof(s.storageManager.ContractAddress(), kvIdx, chunkIdx, &res)
+	if err != nil {
+		return nil, err
+	}
+	if returnCode != returnCodeSuccess {
+		return nil, requestResultErr(returnCode)
+	}
+	if res.KvIdx != kvIdx || res.ChunkIdx != chunkIdx {
+		return nil, fmt.Errorf("chunk proof of kv %d chunk %d mismatches the request", res.KvIdx, res.ChunkIdx)
+	}
+	return &res, nil
+}
+
+// RequestBlobsByCommit requests the blobs of the commits of the contract from the peer, for a client knowing the
+// commit of a blob but not its kv index. The commits not found by the peer are omitted, and the response may be
+// truncated by the response size limit of the peer. If the same blob is stored at several kv indexes, only one of
+// them is returned.
+func (s *SyncClient) RequestBlobsByCommit(id peer.ID, contract common.Address, commits []common.Hash) ([]*BlobPayload, error) {
+	s.lock.Lock()
+	pr, ok := s.peers[id]
+	s.lock.Unlock()
+	if !ok {
+		return nil, fmt.Errorf("peer %s is not registered", id)
+	}
+
+	var res BlobsByCommitPacket
+	reqId := rand.Uint64()
+	returnCode, err := pr.RequestBlobsByCommit(reqId, contract, commits, &res)
+	if err != nil {
+		return nil, err
+	}
+	if returnCode != returnCodeSuccess {
+		return nil, requestResultErr(returnCode)
+	}
+	if res.ID != reqId {
+		return nil, fmt.Errorf("response id %d mismatches request id %d", res.ID, reqId)
+	}
+	if res.Contract != contract {
+		return nil, fmt.Errorf("response contract %s mismatches request contract %s", res.Contract.Hex(), contract.Hex())
+	}
+	requested := make(map[common.Hash]struct{}, len(commits))
+	for _, commit := range commits {
+		if key, ok := commitKey(commit); ok {
+			requested[key] = struct{}{}
+		}
+	}
+	for _, blob := range res.Blobs {
+		key, _ := commitKey(blob.BlobCommit)
+		if _, ok := requested[key]; !ok {
+			return nil, fmt.Errorf("blob %d of commit %s is not requested", blob.BlobIndex, blob.BlobCommit.Hex())
+		}
+	}
+	return res.Blobs, nil
+}
+
+// SyncRange syncs the blobs in range [first, last] of the shard with a one-off task, which is independent of
+// the full shard tasks, and sends a RangeSynced event to the subscribers of SubscribeRangeSynced when all the blobs in
+// the range are synced.
+// It coexists with an in-progress full sync, as a blob synced by either of them will not be written again.
+// Blobs not less than the last kv index are empty blobs and will be filled by the full shard task.
+func (s *SyncClient) SyncRange(contract common.Address, shardIdx, first, last uint64) error {
+	return s.syncRange(contract, shardIdx, first, last, false)
+}
+
+// ForceResync works as SyncRange, except the blobs in the range are fetched from the peers and overwrite the local
+// blobs even if they are synced already, e.g. to repair the blobs suspected to be corrupted while their metadata
+// still matches. The fetched blobs are verified against their commitments before they are written.
+func (s *SyncClient) ForceResync(contract common.Address, shardIdx, first, last uint64) error {
+	return s.syncRange(contract, shardIdx, first, last, true)
+}
+
+func (s *SyncClient) syncRange(contract common.Address, shardIdx, first, last uint64, force bool) error {
+	sm := s.storageManagerOf(contract)
+	if sm == nil {
+		return fmt.Errorf("contract %s is not supported", contract.Hex())
+	}
+	if _, ok := sm.GetShardMiner(shardIdx); !ok {
+		return fmt.Errorf("shard %d is not supported", shardIdx)
+	}
+	kvEntries := sm.KvEntries()
+	if first > last || first < kvEntries*shardIdx || last >= kvEntries*(shardIdx+1) {
+		return fmt.Errorf("invalid range [%d, %d] for shard %d", first, last, shardIdx)
+	}
+	limit := last + 1
+	if lastKvIndex := sm.LastKvIndex(); limit > lastKvIndex {
+		limit = lastKvIndex
+	}
+	if first >= limit {
+		return fmt.Errorf("range [%d, %d] is not less than the last kv index", first, last)
+	}
+
+	t := &task{
+		Contract:       contract,
+		ShardId:        shardIdx,
+		statelessPeers: make(map[peer.ID]struct{}),
+		state:          &SyncState{},
+		force:          force,
+	}
+	t.healTask = &healTask{
+		task:    t,
+		Indexes: make(map[uint64]int64),
+	}
+	t.SubTasks = s.createSubTasks(t, first, limit)
+
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if s.closingPeers {
+		return fmt.Errorf("sync client is closing")
+	}
+	s.rangeTasks = append(s.rangeTasks, t)
+	s.wg.Add(1)
+	go s.rangeSyncLoop(t, first, last)
+	return nil
+}
+
+// SubscribeRangeSynced subscribes to the RangeSynced events, which are sent once the range of SyncRange or
+// ForceResync is synced.
+func (s *SyncClient) SubscribeRangeSynced(ch chan<- RangeSynced) event.Subscription {
+	return s.rangeFeed.Subscribe(ch)
+}
+
+// AddShard starts to sync a shard which is added to the storage manager at runtime. The task of the shard is
+// created like the tasks created on start, and the connected peers serving the shard are counted to the task.
+// If the sync is already done, the sync loop restarts to sync the new shard, and the shard is announced done by a
+// SingleShardDone event once it is synced, which the miner handles to mine the shard. It should be called after Start.
+func (s *SyncClient) AddShard(contract common.Address, shardIdx uint64) error {
+	sm := s.storageManagerOf(contract)
+	if sm == nil {
+		return fmt.Errorf("contract %s is not supported", contract.Hex())
+	}
+	if _, ok := sm.GetShardMiner(shardIdx); !ok {
+		return fmt.Errorf("shard %d is not supported by the storage manager", shardIdx)
+	}
+	// the metas are downloaded again if the shard is already syncing, which does not change them
+	err := sm.DownloadShardMetas(s.resCtx, shardIdx, s.syncerParams.MetaDownloadBatchSize)
+	if err != nil {
+		return fmt.Errorf("download blob metadata of shard %d failed: %w", shardIdx, err)
+	}
+
+	t := s.createTask(sm, shardIdx, sm.LastKvIndex())
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if s.closingPeers {
+		return fmt.Errorf("sync client is closing")
+	}
+	for _, syncing := range s.tasks {
+		if syncing.Contract == contract && syncing.ShardId == shardIdx {
+			return fmt.Errorf("shard %d is already syncing", shardIdx)
+		}
+	}
+	for _, p := range s.peers {
+		if p.IsShardExist(contract, shardIdx) {
+			t.state.PeerCount++
+		}
+	}
+	s.tasks = append(s.tasks, t)
+	sortTasks(s.tasks)
+	s.log.Info("Add shard to sync", "contract", contract.Hex(), "shardId", shardIdx, "peerCount", t.state.PeerCount)
+	s.wg.Add(1)
+	go s.announceShards()
+
+	if s.syncDone {
+		s.syncDone = false
+		s.wg.Add(1)
+		go func() {
+			defer s.wg.Done()
+			s.syncLoop()
+		}()
+	} else {
+		s.notifyUpdate()
+	}
+	return nil
+}
+
+// OnLastKvIndexChanged updates the tasks of the contract when its last kv index is changed. If the last kv index
+// shrinks, e.g. on an L1 reorg, the blobs beyond the new last kv index are no longer synced from peers, their heal
+// indexes are dropped, and they are filled with empty blobs again to revert the blobs already synced there. A grown
+// last kv index is only recorded, as the new blobs are written by the L1 downloader.
+func (s *SyncClient) OnLastKvIndexChanged(contract common.Address, lastKvIndex uint64) {
+	sm := s.storageManagerOf(contract)
+	if sm == nil {
+		return
+	}
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	old, ok := s.lastKvIndexes[contract]
+	s.lastKvIndexes[contract] = lastKvIndex
+	if !ok || lastKvIndex >= old {
+		return
+	}
+	kvEntries, reverted := sm.KvEntries(), false
+	for _, t := range s.tasks {
+		if t.Contract != contract {
+			continue
+		}
+		first, limit := t.ShardId*kvEntries, (t.ShardId+1)*kvEntries
+		start, end := min(max(lastKvIndex, first), limit), min(old, limit)
+		if start >= end {
+			continue
+		}
+		for _, st := range t.SubTasks {
+			if st.Last <= start {
+				continue
+			}
+			st.Last = max(st.First, start)
+			if st.next >= st.Last {
+				st.next, st.done = st.Last, true
+			}
+		}
+		healReverted := make([]uint64, 0)
+		for idx := range t.healTask.Indexes {
+			if idx >= start {
+				healReverted = append(healReverted, idx)
+			}
+		}
+		t.healTask.remove(healReverted)
+		t.SubEmptyTasks = append(t.SubEmptyTasks, &subEmptyTask{task: t, First: start, Last: end})
+		sortSubEmptyTasks(t.SubEmptyTasks)
+		t.state.EmptyToFill += end - start
+		// the shard done is not announced again once the reverted blobs are filled, as t.verified is kept
+		t.done = false
+		reverted = true
+		s.shardLogger(contract, t.ShardId).Warn("Last kv index shrinks, revert blobs to empty",
+			"oldLastKvIndex", old, "lastKvIndex", lastKvIndex, "first", start, "limit", end)
+	}
+	if !reverted || s.closingPeers {
+		return
+	}
+	if s.syncDone {
+		s.syncDone = false
+		s.wg.Add(1)
+		go func() {
+			defer s.wg.Done()
+			s.syncLoop()
+		}()
+	} else {
+		s.notifyUpdate()
+	}
+}
+
+// followLoop checks the growth of the last kv indexes every followInterval in follow mode, see followLastKvIndex.
+func (s *SyncClient) followLoop() {
+	defer s.wg.Done()
+
+	ticker := time.NewTicker(s.followInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			s.followLastKvIndex()
+		case <-s.resCtx.Done():
+			return
+		}
+	}
+}
+
+// keepAliveLoop pings the idle peers every keepAliveInterval, e.g. the peers kept connected after the sync is done
+// to sync from us, so their connections are not dropped by NATs and firewalls for being idle.
+func (s *SyncClient) keepAliveLoop() {
+	defer s.wg.Done()
+
+	ticker := time.NewTicker(s.keepAliveInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			s.pingIdlePeers()
+		case <-s.resCtx.Done():
+			return
+		}
+	}
+}
+
+// pingIdlePeers pings the peers without requests in flight concurrently. A failed ping is only logged, as the peer
+// is removed once its connection is closed.
+func (s *SyncClient) pingIdlePeers() {
+	s.lock.Lock()
+	peers := make([]*Peer, 0, len(s.idlerPeers))
+	for id := range s.idlerPeers {
+		if pr, ok := s.peers[id]; ok && s.peerRequests[id] == 0 {
+			peers = append(peers, pr)
+		}
+	}
+	s.lock.Unlock()
+
+	var wg sync.WaitGroup
+	for _, pr := range peers {
+		wg.Add(1)
+		go func(pr *Peer) {
+			defer wg.Done()
+			if returnCode, err := pr.Ping(); err != nil {
+				pr.Log().Debug("Ping peer failed", "returnCode", returnCode, "err", err)
+			}
+		}(pr)
+	}
+	wg.Wait()
+}
+
+// followLastKvIndex extends the tasks to the blobs appended to the contracts since they are last synced, once the
+// sync is done, and restarts the sync loop to sync them from peers. The last kv indexes of the peers are fetched
+// again, as the range requests are bounded by them.
+func (s *SyncClient) followLastKvIndex() {
+	s.lock.Lock()
+	done := s.syncDone
+	s.lock.Unlock()
+	if !done {
+		return
+	}
+
+	extended := false
+	for _, sm := range s.sortedStorageManagers() {
+		if s.followContract(sm) {
+			extended = true
+		}
+	}
+	if !extended {
+		return
+	}
+
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if s.closingPeers {
+		return
+	}
+	for _, pr := range s.peers {
+		pr.lastKvIndexTime = time.Now()
+		s.wg.Add(1)
+		go s.refreshLastKvIndex(pr)
+	}
+	// the stall is counted from the growth, as no blob is committed while the sync is done
+	s.lastCommitTime.Store(time.Now().UnixNano())
+	if s.syncDone {
+		s.syncDone = false
+		s.wg.Add(1)
+		go func() {
+			defer s.wg.Done()
+			s.syncLoop()
+		}()
+	} else {
+		s.notifyUpdate()
+	}
+}
+
+// followContract extends the tasks of the contract to the blobs appended since the contract is last followed, and
+// returns whether any task is extended. The metas of the appended blobs are downloaded first to verify the blobs.
+// The blobs written by the L1 downloader are not followed, so only the growth by a reset of the storage manager is
+// synced from peers. A shrunk last kv index is only recorded, as the blobs beyond it are reverted by
+// OnLastKvIndexChanged.
+func (s *SyncClient) followContract(sm StorageManager) bool {
+	contract, lastKvIndex := sm.ContractAddress(), min(sm.LastKvIndex(), sm.DownloadKvIndex())
+	s.lock.Lock()
+	old := s.followedKvIndexes[contract]
+	if lastKvIndex <= old {
+		s.followedKvIndexes[contract] = lastKvIndex
+		s.lock.Unlock()
+		return false
+	}
+	s.lock.Unlock()
+
+	if err := sm.DownloadMetas(s.resCtx, old, lastKvIndex, s.syncerParams.MetaDownloadBatchSize); err != nil {
+		s.log.Warn("Download blob metadata to follow failed", "contract", contract.Hex(), "error", err)
+		return false
+	}
+
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.followedKvIndexes[contract] = lastKvIndex
+	kvEntries, extended := sm.KvEntries(), false
+	for _, t := range s.tasks {
+		if t.Contract != contract {
+			continue
+		}
+		first, limit := t.ShardId*kvEntries, (t.ShardId+1)*kvEntries
+		start, end := min(max(old, first), limit), min(lastKvIndex, limit)
+		if start >= end {
+			continue
+		}
+		t.SubTasks = append(t.SubTasks, s.createSubTasks(t, start, end)...)
+		sortSubTasks(t.SubTasks)
+		t.done = false
+		extended = true
+		s.shardLogger(contract, t.ShardId).Info("Last kv index grows, follow the new blobs",
+			"oldLastKvIndex", old, "lastKvIndex", lastKvIndex, "first", start, "limit", end)
+	}
+	return extended
+}
+
+// RemoveShard stops syncing a shard removed from the storage manager at runtime, and the peers only serving the
+// shard are no longer needed. The task of the shard is torn down by CancelShard, so the responses of its requests
+// in flight are not committed, and the task and its heal log are removed from the saved status.
+func (s *SyncClient) RemoveShard(contract common.Address, shardIdx uint64) error {
+	if err := s.CancelShard(contract, shardIdx); err != nil {
+		return err
+	}
+	s.log.Info("Remove shard from sync", "contract", contract.Hex(), "shardId", shardIdx)
+	return nil
+}
+
+// CancelShard cancels the sync of a shard mid-sync without affecting the other shards. The task of the shard is
+// marked done and removed, so no more requests are dispatched for it, the responses of its requests in flight are
+// dropped, and once they are drained the task and its heal log are removed from the saved status.
+func (s *SyncClient) CancelShard(contract common.Address, shardIdx uint64) error {
+	s.lock.Lock()
+	i := slices.IndexFunc(s.tasks, func(t *task) bool {
+		return t.Contract == contract && t.ShardId == shardIdx
+	})
+	if i < 0 {
+		s.lock.Unlock()
+		return fmt.Errorf("shard %d is not syncing", shardIdx)
+	}
+	t := s.tasks[i]
+	s.tasks = slices.Delete(s.tasks, i, i+1)
+	t.done, t.cancelled = true, true
+	logSeq, synced := t.healTask.logSeq, t.state.BlobsSynced
+	s.notifyUpdate()
+	s.lock.Unlock()
+	s.log.Info("Cancel shard sync", "contract", contract.Hex(), "shardId", shardIdx, "blobsSynced", synced)
+
+	kvEntries := s.storageManagerOf(contract).KvEntries()
+	for s.shardRequesting(contract, kvEntries*shardIdx, kvEntries*(shardIdx+1)) {
+		select {
+		case <-time.After(requestTimeoutInMillisecond):
+		case <-s.resCtx.Done():
+			return fmt.Errorf("sync client is closing")
+		}
+	}
+
+	batch := s.db.NewBatch()
+	for seq := uint64(0); seq < logSeq; seq++ {
+		batch.Delete(healLogKey(contract, shardIdx, seq))
+	}
+	if err := batch.Write(); err != nil {
+		log.Error("Failed to delete heal logs", "err", err)
+	}
+	s.saveSyncStatus()
+	return nil
+}
+
+// ResumeShard continues the sync of the shard paused as the disk is full, once the disk space is freed. The shard is
+// paused again with another DiskFull event if the disk space is still below the min free disk space.
+func (s *SyncClient) ResumeShard(contract common.Address, shardIdx uint64) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	resumed := false
+	for _, t := range append(slices.Clone(s.tasks), s.rangeTasks...) {
+		if t.Contract == contract && t.ShardId == shardIdx && t.diskFull {
+			t.diskFull, resumed = false, true
+		}
+	}
+	if !resumed {
+		return fmt.Errorf("shard %d is not paused", shardIdx)
+	}
+	s.log.Info("Resume shard sync", "contract", contract.Hex(), "shardId", shardIdx)
+	s.notifyUpdate()
+	return nil
+}
+
+// pauseDiskFull pauses the sync of the shard as the disk of its data file is full, so the blobs of the shard are
+// no longer requested or filled until ResumeShard, and sends a DiskFull event once the shard is paused.
+func (s *SyncClient) pauseDiskFull(contract common.Address, shardIdx uint64, err error) {
+	s.lock.Lock()
+	paused := false
+	for _, t := range append(slices.Clone(s.tasks), s.rangeTasks...) {
+		if t.Contract == contract && t.ShardId == shardIdx && !t.diskFull {
+			t.diskFull, paused = true, true
+		}
+	}
+	s.lock.Unlock()
+	if !paused {
+		return
+	}
+	s.log.Error("Shard sync paused as the disk is full", "contract", contract.Hex(), "shardId", shardIdx, "err", err)
+	s.diskFullFeed.Send(DiskFull{Contract: contract, ShardId: shardIdx})
+}
+
+// SubscribeDiskFull subscribes to the DiskFull events, which are sent once the sync of a shard is paused as the disk
+// is full.
+func (s *SyncClient) SubscribeDiskFull(ch chan<- DiskFull) event.Subscription {
+	return s.diskFullFeed.Subscribe(ch)
+}
+
+// shardRequesting returns whether any kv index in [first, limit) of the contract is requested in flight.
+func (s *SyncClient) shardRequesting(contract common.Address, first, limit uint64) bool {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	for idx := range s.requesting[contract] {
+		if idx >= first && idx < limit {
+			return true
+		}
+	}
+	return false
+}
+
+// taskCancelled returns whether the task is cancelled by CancelShard, so the responses for it are dropped.
+func (s *SyncClient) taskCancelled(t *task) bool {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return t.cancelled
+}
+
+// rangeSyncLoop assigns the requests of the one-off task created by SyncRange until all the blobs are synced.
+func (s *SyncClient) rangeSyncLoop(t *task, first, last uint64) {
+	defer s.wg.Done()
+
+	for {
+		s.lock.Lock()
+		cleanSubTasks(t)
+		if len(t.SubTasks) == 0 {
+			t.done = true
+			for i, rt := range s.rangeTasks {
+				if rt == t {
+					s.rangeTasks = append(s.rangeTasks[:i], s.rangeTasks[i+1:]...)
+					break
+				}
+			}
+			s.lock.Unlock()
+			s.rangeFeed.Send(RangeSynced{Contract: t.Contract, ShardId: t.ShardId, First: first, Last: last})
+			s.log.Info("Range sync done", "shardId", t.ShardId, "first", first, "last", last,
+				"blobsSynced", t.state.BlobsSynced)
+			return
+		}
+		if !s.paused {
+			s.assignBlobRangeRequests([]*task{t})
+			s.assignBlobHealRequests([]*task{t})
+		}
+		s.lock.Unlock()
+
+		select {
+		case <-time.After(requestTimeoutInMillisecond):
+		case <-s.resCtx.Done():
+			s.log.Info("Stopped range sync", "shardId", t.ShardId, "first", first, "last", last)
+			return
+		}
+	}
+}
+
+func (s *SyncClient) mainLoop() {
+	defer s.wg.Done()
+
+	s.cleanTasks()
+	if !s.syncDone {
+		for _, sm := range s.sortedStorageManagers() {
+			err := sm.DownloadAllMetas(s.resCtx, s.syncerParams.MetaDownloadBatchSize)
+			if err != nil {
+				s.log.Error("Download blob metadata failed", "contract", sm.ContractAddress().Hex(), "error", err)
+				return
+			}
+		}
+		s.lock.Lock()
+		if !s.closingPeers {
+			s.wg.Add(1)
+			go s.skipLocalBlobs()
+		}
+		s.lock.Unlock()
+	}
+	if !s.waitMinPeers() {
+		return
+	}
+
+	s.syncLoop()
+}
+
+// waitMinPeers waits until minPeersBeforeSync capable peers are connected, or minPeersTimeout passes, so the
+// sync does not start with a single flaky peer. It returns false if the sync client is closed while waiting.
+func (s *SyncClient) waitMinPeers() bool {
+	if s.minPeersBeforeSync <= 0 || s.syncDone {
+		return true
+	}
+	timeout := time.NewTimer(s.minPeersTimeout)
+	defer timeout.Stop()
+	for {
+		peers := s.capablePeerCount()
+		if peers >= s.minPeersBeforeSync {
+			s.log.Info("Enough peers connected to start sync", "peers", peers)
+			return true
+		}
+		select {
+		case <-s.peerJoin:
+		case <-timeout.C:
+			s.log.Warn("Start sync without enough peers", "peers", peers, "minPeers", s.minPeersBeforeSync,
+				"timeout", s.minPeersTimeout)
+			return true
+		case <-s.resCtx.Done():
+			return false
+		}
+	}
+}
+
+// capablePeerCount returns the number of the connected peers serving any shard of the unfinished tasks.
+func (s *SyncClient) capablePeerCount() int {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	count := 0
+	for _, pr := range s.peers {
+		for _, t := range s.tasks {
+			if !t.done && pr.IsShardExist(t.Contract, t.ShardId) {
+				count++
+				break
+			}
+		}
+	}
+	return count
+}
+
+// syncLoop assigns the tasks to peers until all the tasks are done.
+func (s *SyncClient) syncLoop() {
+	s.logTime = time.Now()
+	for {
+		// the exhausted heal indexes are given up only after the import looking them up is done
+		if !s.startImportHealIndexes() {
+			s.giveUpHealIndexes()
+		}
+		// Remove all completed tasks and terminate sync if everything's done
+		if s.cleanTasks() {
+			s.report(true)
+			s.saveSyncStatus()
+			return
+		}
+		s.assignBlobRangeTasks()
+		// Assign all the Data retrieval tasks to any free peers
+		s.assignBlobHealTasks()
+
+		s.assignFillEmptyBlobTasks()
+
+		select {
+		case <-time.After(requestTimeoutInMillisecond):
+
+		case <-s.update:
+			// Something happened (new peer, delivery, timeout), recheck tasks
+		case <-s.peerJoin:
+			// A new peer joined, try to schedule it new tasks
+		case <-s.resCtx.Done():
+			s.log.Info("Stopped P2P req-resp L2 block sync client")
 			return
 		}
+		// Report stats if something meaningful happened
+		s.report(false)
+	}
+}
+
+// giveUpHealIndexes moves the heal indexes requested maxHealAttempts times without being delivered to the missing
+// set of the heal task, so the blobs unavailable from the peers are not retried forever.
+func (s *SyncClient) giveUpHealIndexes() {
+	events := make([]BlobsMissing, 0)
+	s.lock.Lock()
+	for _, t := range s.tasks {
+		if given := t.healTask.giveUp(s.maxHealAttempts); len(given) > 0 {
+			s.shardLogger(t.Contract, t.ShardId).Warn("Give up blobs no peer can serve", "count", len(given),
+				"attempts", s.maxHealAttempts, "missing", len(t.healTask.missing))
+			events = append(events, BlobsMissing{Contract: t.Contract, ShardId: t.ShardId, Indexes: given})
+		}
+	}
+	s.lock.Unlock()
+
+	for _, ev := range events {
+		s.missingFeed.Send(ev)
+	}
+}
+
+// SetImportSource sets the directory of the shard exports written by ExportShard, e.g. for an air-gapped node, so the
+// blobs no capable peer serves are imported from the exports before their heal indexes are given up. An empty dir
+// disables the import.
+func (s *SyncClient) SetImportSource(dir string) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.importDir = dir
+	// the blobs not found in the previous source are looked up again
+	for _, t := range s.tasks {
+		t.healTask.importTried = nil
+	}
+}
+
+// startImportHealIndexes starts importing the heal indexes looked up by importLookups in the background, so the scans
+// of the shard exports do not block the sync loop, and returns whether an import is running. Only one import runs at
+// a time, and the sync loop is notified once it is done.
+func (s *SyncClient) startImportHealIndexes() bool {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if s.importing {
+		return true
+	}
+	if s.importDir == "" || s.closingPeers {
+		return false
+	}
+	lookups := s.importLookups()
+	if len(lookups) == 0 {
+		return false
+	}
+	s.importing = true
+	s.wg.Add(1)
+	go func(dir string) {
+		defer s.wg.Done()
+		s.importHealIndexes(dir, lookups)
+		s.lock.Lock()
+		s.importing = false
+		s.lock.Unlock()
+		s.notifyUpdate()
+	}(s.importDir)
+	return true
+}
+
+// importLookups returns the heal indexes about to be given up, and the heal indexes of the shards no connected peer
+// serves, to import from the shard exports in the import source. Each index is looked up once per import source.
+// It must be called with the lock held.
+func (s *SyncClient) importLookups() map[*task][]uint64 {
+	lookups := make(map[*task][]uint64)
+	for _, t := range s.tasks {
+		if t.done || t.healTask.count() == 0 {
+			continue
+		}
+		candidates := t.healTask.exhausted(s.maxHealAttempts)
+		// the peers which did not return the blobs of the shard are not asked again, see statelessPeers
+		if !s.hasOtherCapablePeer(t, "") {
+			candidates = t.healTask.getBlobIndexesForRequest(uint64(t.healTask.count()))
+		}
+		if t.healTask.importTried == nil {
+			t.healTask.importTried = make(map[uint64]struct{})
+		}
+		indexes := make([]uint64, 0, len(candidates))
+		for _, idx := range candidates {
+			if _, ok := t.healTask.importTried[idx]; !ok {
+				t.healTask.importTried[idx] = struct{}{}
+				indexes = append(indexes, idx)
+			}
+		}
+		if len(indexes) > 0 {
+			lookups[t] = indexes
+		}
 	}
+	return lookups
+}
 
-	s.logTime = time.Now()
-	for {
-		// Remove all completed tasks and terminate sync if everything's done
-		s.cleanTasks()
-		if s.syncDone {
-			s.report(true)
-			s.saveSyncStatus()
+// importHealIndexes imports the looked up heal indexes from the shard exports in dir. The imported blobs are verified
+// against their commits before committed.
+func (s *SyncClient) importHealIndexes(dir string, lookups map[*task][]uint64) {
+	for t, indexes := range lookups {
+		if s.resCtx.Err() != nil {
 			return
 		}
-		s.assignBlobRangeTasks()
-		// Assign all the Data retrieval tasks to any free peers
-		s.assignBlobHealTasks()
+		inserted, err := s.importFromSource(dir, t.Contract, indexes)
+		if err != nil {
+			s.shardLogger(t.Contract, t.ShardId).Warn("Import blobs from source failed", "dir", dir, "err", err)
+		}
+		if len(inserted) == 0 {
+			continue
+		}
+		s.shardLogger(t.Contract, t.ShardId).Info("Imported blobs from source", "dir", dir,
+			"count", len(inserted), "lookups", len(indexes))
+		s.lock.Lock()
+		t.state.BlobsSynced += uint64(len(inserted))
+		t.healTask.remove(inserted)
+		advanceSubTasks(t, inserted)
+		s.lock.Unlock()
+		s.notifyProgress()
+	}
+}
 
-		s.assignFillEmptyBlobTasks()
+// importFromSource reads the blobs of the indexes of the contract from the shard exports in dir, verifies them
+// against the commits in their metas, and commits them to the local storage, which rejects the blobs whose commits
+// do not match the local metas. It returns the committed indexes.
+func (s *SyncClient) importFromSource(dir string, contract common.Address, indexes []uint64) ([]uint64, error) {
+	sm := s.storageManagerOf(contract)
+	if sm == nil {
+		return nil, fmt.Errorf("contract %s is not synced", contract.Hex())
+	}
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
 
-		select {
-		case <-time.After(requestTimeoutInMillisecond):
+	found := make(map[uint64]*ethstorage.ExportedBlob)
+	for _, entry := range entries {
+		if entry.IsDir() || len(found) == len(indexes) {
+			continue
+		}
+		f, err := os.Open(filepath.Join(dir, entry.Name()))
+		if err != nil {
+			s.log.Debug("Open import source failed", "file", entry.Name(), "err", err)
+			continue
+		}
+		exportContract, blobs, err := ethstorage.ReadExportedBlobs(f, sm.MaxKvSize(), indexes)
+		f.Close()
+		if err != nil {
+			s.log.Debug("Read import source failed", "file", entry.Name(), "err", err)
+			continue
+		}
+		if exportContract != contract {
+			continue
+		}
+		for idx, blob := range blobs {
+			if _, ok := found[idx]; !ok {
+				found[idx] = blob
+			}
+		}
+	}
 
-		case <-s.update:
-			// Something happened (new peer, delivery, timeout), recheck tasks
-		case <-s.peerJoin:
-			// A new peer joined, try to schedule it new tasks
-		case <-s.resCtx.Done():
-			s.log.Info("Stopped P2P req-resp L2 block sync client")
-			return
+	kvIndices := make([]uint64, 0, len(found))
+	decodedBlobs := make([][]byte, 0, len(found))
+	commits := make([]common.Hash, 0, len(found))
+	for _, idx := range indexes {
+		blob, ok := found[idx]
+		if !ok {
+			continue
 		}
-		// Report stats if something meaningful happened
-		s.report(false)
+		if !s.checkBlobCommit(blob.Blob, &BlobPayload{BlobIndex: idx, BlobCommit: blob.Meta}) {
+			s.log.Warn("Imported blob does not match its commit", "kvIndex", idx, "commit", blob.Meta.Hex())
+			continue
+		}
+		kvIndices = append(kvIndices, idx)
+		decodedBlobs = append(decodedBlobs, blob.Blob)
+		commits = append(commits, blob.Meta)
+	}
+	if len(kvIndices) == 0 {
+		return nil, nil
 	}
+	return sm.CommitBlobs(kvIndices, decodedBlobs, commits)
+}
+
+// SubscribeBlobsMissing subscribes to the BlobsMissing events, which are sent once the heal indexes are given up
+// after maxHealAttempts requests.
+func (s *SyncClient) SubscribeBlobsMissing(ch chan<- BlobsMissing) event.Subscription {
+	return s.missingFeed.Subscribe(ch)
 }
 
 func (s *SyncClient) notifyPeerJoin(id peer.ID) {
@@ -674,6 +3139,14 @@ func (s *SyncClient) notifyPeerJoin(id peer.ID) {
 	}
 }
 
+// notifyProgress notifies saveStatusLoop that the subTasks progressed.
+func (s *SyncClient) notifyProgress() {
+	select {
+	case s.progressed <- struct{}{}:
+	default:
+	}
+}
+
 func (s *SyncClient) notifyUpdate() {
 	select {
 	case s.update <- struct{}{}:
@@ -686,96 +3159,341 @@ func (s *SyncClient) assignBlobRangeTasks() {
 	s.lock.Lock()
 	defer s.lock.Unlock()
 
-	if len(s.idlerPeers) == 0 {
+	if s.paused {
 		return
 	}
+	s.assignBlobRangeRequests(s.tasks)
+}
 
-	// Iterate over all the tasks and try to find a pending one
-	for _, t := range s.tasks {
-		maxRange := maxRequestSize / ethstorage.ContractToShardManager[t.Contract].MaxKvSize() * 2
-		subTaskCount := len(t.SubTasks)
-		for idx := 0; idx < subTaskCount; idx++ {
-			pr := s.getIdlePeerForTask(t)
-			if pr == nil {
-				break
-			}
-			t.nextIdx = t.nextIdx % subTaskCount
-			st := t.SubTasks[t.nextIdx]
-			t.nextIdx++
-			if st.done {
-				continue
-			}
-			// Skip any tasks already running
-			if st.isRunning {
-				continue
+// assignBlobRangeRequests attempts to match idle peers to pending blob range retrievals of the tasks,
+// the caller must hold the lock.
+func (s *SyncClient) assignBlobRangeRequests(tasks []*task) {
+	// Share the idle peers among the tasks one request at a time, a task is not picked again once no more
+	// request of it can be assigned
+	pending := slices.Clone(tasks)
+	for len(s.idlerPeers) > 0 && len(pending) > 0 && s.canDispatch() {
+		i := s.pickTask(pending)
+		if !s.assignBlobRangeRequest(pending[i]) {
+			pending = slices.Delete(pending, i, i+1)
+		}
+	}
+}
+
+// pickTask picks the task among the tasks to serve the next request slot according to the schedule policy,
+// and returns its index. The caller must hold the lock.
+func (s *SyncClient) pickTask(tasks []*task) int {
+	if s.schedulePolicy == ScheduleWeighted {
+		total := uint64(0)
+		for _, t := range tasks {
+			total += remainingWork(t)
+		}
+		// fall back to round-robin if no work remains to weigh the tasks
+		if total > 0 {
+			r := uint64(rand.Int63n(int64(total)))
+			for i, t := range tasks {
+				w := remainingWork(t)
+				if r < w {
+					return i
+				}
+				r -= w
 			}
+		}
+	}
+	i := s.taskCursor % len(tasks)
+	s.taskCursor++
+	return i
+}
+
+// remainingWork returns the number of blobs remaining to sync from peers for the task, including the blobs
+// in the subTasks and the heal indexes. The caller must hold the lock.
+func remainingWork(t *task) uint64 {
+	remaining := uint64(t.healTask.count())
+	for _, st := range t.SubTasks {
+		if !st.done {
+			remaining += st.Last - st.next
+		}
+	}
+	return remaining
+}
 
-			last := st.next + maxRange
-			if last > st.Last {
-				last = st.Last
+// assignBlobRangeRequest assigns a range request of a pending subTask of the task to an idle peer, and returns
+// false if no request can be assigned. The caller must hold the lock.
+func (s *SyncClient) assignBlobRangeRequest(t *task) bool {
+	if t.diskFull {
+		return false
+	}
+	maxRange := maxRequestSize / ethstorage.ContractToShardManager[t.Contract].MaxKvSize() * 2
+	subTaskCount := len(t.SubTasks)
+	for idx := 0; idx < subTaskCount; idx++ {
+		t.nextIdx = t.nextIdx % subTaskCount
+		st := t.SubTasks[t.nextIdx]
+		t.nextIdx++
+		if st.done {
+			continue
+		}
+		// Skip any tasks already running
+		if st.isRunning {
+			continue
+		}
+		// Skip the subTask whose next blob is requested by a heal request, it moves on once the blob is delivered
+		if s.isRequesting(t.Contract, st.next) {
+			continue
+		}
+		peers := s.getIdlePeersForRange(t, st.next)
+		if len(peers) == 0 {
+			continue
+		}
+		// split the rest of the subTask evenly among the peers, each bounded by its own batch
+		share := (st.Last - st.next + uint64(len(peers)) - 1) / uint64(len(peers))
+		var fan *rangeFan
+		if len(peers) > 1 {
+			fan = &rangeFan{}
+		}
+		origin, dispatched := st.next, 0
+		for i, pr := range peers {
+			last, stopped := s.rangeLimit(t, st, pr, origin, min(share, maxRange))
+			if last <= origin || (i > 0 && !s.canDispatch()) {
+				// return the peers left to the idle peers
+				for _, p := range peers[i:] {
+					s.idlerPeers[p.id] = struct{}{}
+				}
+				break
 			}
-			req := &blobsByRangeRequest{
-				peer:     pr.ID(),
-				id:       rand.Uint64(),
-				contract: t.Contract,
-				shardId:  t.ShardId,
-				origin:   st.next,
-				limit:    last - 1,
-				time:     time.Now(),
-				subTask:  st,
+			s.dispatchRangeRequest(t, st, pr, origin, last, fan)
+			origin, dispatched = last, dispatched+1
+			if stopped || origin >= st.Last {
+				for _, p := range peers[i+1:] {
+					s.idlerPeers[p.id] = struct{}{}
+				}
+				break
 			}
-			delete(s.idlerPeers, pr.ID())
-			st.isRunning = true
+		}
+		if dispatched == 0 {
+			continue
+		}
+		st.isRunning = true
+		return true
+	}
+	return false
+}
 
-			s.wg.Add(1)
-			go func(id peer.ID) {
-				defer func() {
-					s.lock.Lock()
-					st.isRunning = false
-					s.lock.Unlock()
-					s.wg.Done()
-				}()
-				start := time.Now()
-				var packet BlobsByRangePacket
-				// Attempt to send the remote request and revert if it fails
-				returnCode, err := pr.RequestBlobsByRange(req.id, req.contract, req.shardId, req.origin, req.limit, &packet)
-				s.metrics.ClientGetBlobsByRangeEvent(req.peer.String(), returnCode, time.Since(start))
+// takePeer records a request dispatched to the peer, which is removed from the idle peers once the requests in
+// flight to it reach maxConcurrentPerPeer, or kept idle to serve more requests. The caller must hold the lock.
+func (s *SyncClient) takePeer(id peer.ID) {
+	s.peerRequests[id]++
+	if s.peerRequests[id] >= s.maxConcurrentPerPeer {
+		delete(s.idlerPeers, id)
+	} else {
+		s.idlerPeers[id] = struct{}{}
+	}
+}
 
-				s.lock.Lock()
-				if _, ok := s.peers[id]; ok {
-					s.idlerPeers[id] = struct{}{}
-					s.notifyUpdate()
-				}
-				s.lock.Unlock()
+// releasePeer records a request to the peer is done, and returns the peer to the idle peers unless it is removed.
+// The caller must hold the lock.
+func (s *SyncClient) releasePeer(pr *Peer) {
+	if !s.isRegistered(pr) {
+		return
+	}
+	if s.peerRequests[pr.id] > 0 {
+		s.peerRequests[pr.id]--
+	}
+	s.idlerPeers[pr.id] = struct{}{}
+	s.notifyUpdate()
+}
 
-				if err != nil {
-					if e, ok := err.(*yamux.Error); ok && e.Timeout() {
-						log.Debug("Request blobs timeout", "peer", pr.id.String(), "err", err)
-						pr.tracker.Update(0, 0)
-					} else if returnCode == streamError && strings.Contains(err.Error(), "no addresses") {
-						log.Debug("Failed to request blobs as newStream failed", "peer", pr.id.String(), "err", err)
-					} else {
-						log.Info("Failed to request blobs", "peer", pr.id.String(), "err", err)
-					}
-					return
-				}
+// getIdlePeersForRange picks up to maxPeersPerSubTask idle peers to request the range of the task from origin, and
+// removes them from the idle peers. The caller must hold the lock.
+func (s *SyncClient) getIdlePeersForRange(t *task, origin uint64) []*Peer {
+	peers := make([]*Peer, 0, 1)
+	for len(peers) < max(s.maxPeersPerSubTask, 1) {
+		pr := s.getIdlePeerForRange(t, origin)
+		if pr == nil {
+			break
+		}
+		delete(s.idlerPeers, pr.id)
+		peers = append(peers, pr)
+	}
+	return peers
+}
 
-				if req.id != packet.ID || req.contract != packet.Contract || req.shardId != packet.ShardId {
-					log.Info("Req mismatch with res", "reqId", req.id, "packetId", packet.ID,
-						"reqContract", req.contract.Hex(), "packetContract", packet.Contract.Hex(),
-						"reqShardId", req.shardId, "packetShardId", packet.ShardId)
-					return
-				}
-				res := &blobsByRangeResponse{
-					req:   req,
-					Blobs: packet.Blobs,
-					time:  time.Now(),
+// rangeLimit returns the exclusive end of the range request of the subTask from origin to the peer, which is
+// bounded by the batch of the peer, the last kv index of the peer, and the blobs being requested. It returns true
+// if the range stops before a blob being requested, so no more range of the subTask can be requested for now.
+// The caller must hold the lock.
+func (s *SyncClient) rangeLimit(t *task, st *subTask, pr *Peer, origin, maxBatch uint64) (uint64, bool) {
+	batch := pr.rangeBatch
+	if batch > maxBatch {
+		batch = maxBatch
+	}
+	last := origin + batch
+	if last > st.Last {
+		last = st.Last
+	}
+	// do not request the blobs beyond the last kv index of the peer, as the peer does not have them
+	if peerLast, ok := pr.lastKvIndex[t.Contract]; ok && last > peerLast {
+		last = max(peerLast, origin)
+	}
+	// stop before the blobs requested by the heal requests, so a blob is not requested twice at a time
+	for kvIdx := origin; kvIdx < last; kvIdx++ {
+		if kvIdx > st.next && s.isRequesting(t.Contract, kvIdx) {
+			return kvIdx, true
+		}
+	}
+	return last, false
+}
+
+// dispatchRangeRequest requests the blobs [origin, last) of the subTask from the peer, which is picked from the
+// idle peers by the caller and returned to them if it can serve more requests. The requests of a subTask fanned out to multiple peers share the fan, and the subTask
+// moves on once all of them are done, see mergeRangeFan. The caller must hold the lock.
+func (s *SyncClient) dispatchRangeRequest(t *task, st *subTask, pr *Peer, origin, last uint64, fan *rangeFan) {
+	rangeIndexes := make([]uint64, 0, last-origin)
+	for kvIdx := origin; kvIdx < last; kvIdx++ {
+		rangeIndexes = append(rangeIndexes, kvIdx)
+	}
+	req := &blobsByRangeRequest{
+		peer:     pr.ID(),
+		id:       rand.Uint64(),
+		contract: t.Contract,
+		shardId:  t.ShardId,
+		origin:   origin,
+		limit:    last - 1,
+		time:     time.Now(),
+		subTask:  st,
+		fan:      fan,
+	}
+	req.log = s.requestLogger(pr.id, t.Contract, t.ShardId).New("subTask", fmt.Sprintf("%d-%d", st.First, st.Last))
+	ctx, span := s.tracer.Start(context.Background(), spanRequestRange, SpanAttribute{"peer", pr.id.String()},
+		SpanAttribute{"contract", t.Contract.Hex()}, SpanAttribute{"shard", t.ShardId}, SpanAttribute{"origin", origin},
+		SpanAttribute{"limit", last - 1})
+	req.ctx = ctx
+	s.takePeer(pr.ID())
+	s.inFlight++
+	s.markRequesting(t.Contract, rangeIndexes)
+	if fan != nil {
+		fan.pending++
+	}
+	delay := s.dispatchDelay()
+
+	s.wg.Add(1)
+	go func(id peer.ID) {
+		defer func() {
+			s.lock.Lock()
+			if fan == nil {
+				st.isRunning = false
+			} else {
+				fan.pending--
+				if fan.pending == 0 {
+					s.mergeRangeFan(st, fan)
 				}
-				pr.tracker.Update(time.Since(req.time), len(packet.Blobs)*int(s.storageManager.MaxKvSize()))
-				s.OnBlobsByRange(res)
-			}(pr.id)
+			}
+			s.unmarkRequesting(req.contract, rangeIndexes)
+			s.lock.Unlock()
+			span.End()
+			s.wg.Done()
+		}()
+		if !s.waitDispatch(delay) {
+			return
+		}
+		req.time = time.Now()
+		start := time.Now()
+		var packet BlobsByRangePacket
+		// Attempt to send the remote request and revert if it fails
+		_, rtSpan := s.tracer.Start(ctx, spanRoundTrip)
+		returnCode, err := pr.RequestBlobsByRange(req.id, req.contract, req.shardId, req.origin, req.limit, &packet)
+		endSpan(rtSpan, err)
+		s.metrics.ClientGetBlobsByRangeEvent(req.peer.String(), returnCode, time.Since(start))
+
+		s.lock.Lock()
+		s.inFlight--
+		s.adaptRangeBatch(pr, time.Since(req.time), err)
+		s.releasePeer(pr)
+		if err != nil {
+			st.task.healTask.markFailed(id, []uint64{req.origin}, s.retryCooldown)
+		}
+		s.lock.Unlock()
+
+		if err != nil {
+			s.recordResponseFailure(pr, err)
+			if e, ok := err.(*yamux.Error); ok && e.Timeout() {
+				req.log.Debug("Request blobs timeout", "err", err)
+				pr.tracker.Update(0, 0)
+			} else if returnCode == returnCodeServerBusy {
+				req.log.Debug("Peer is busy serving requests", "err", err)
+				pr.tracker.Update(0, 0)
+			} else if returnCode == streamError && strings.Contains(err.Error(), "no addresses") {
+				req.log.Debug("Failed to request blobs as newStream failed", "err", err)
+			} else {
+				req.log.Info("Failed to request blobs", "err", err)
+			}
+			return
+		}
+
+		if req.id != packet.ID || req.contract != packet.Contract || req.shardId != packet.ShardId {
+			req.log.Info("Req mismatch with res", "reqId", req.id, "packetId", packet.ID,
+				"reqContract", req.contract.Hex(), "packetContract", packet.Contract.Hex(),
+				"reqShardId", req.shardId, "packetShardId", packet.ShardId)
+			return
 		}
+		res := &blobsByRangeResponse{
+			req:   req,
+			Blobs: packet.Blobs,
+			time:  time.Now(),
+		}
+		pr.tracker.Update(time.Since(req.time), len(packet.Blobs)*int(s.storageManagerOf(req.contract).MaxKvSize()))
+		s.OnBlobsByRange(res)
+	}(pr.id)
+}
+
+// mergeRangeFan moves the subTask on by the blobs inserted by all the requests of the fan, as a single range
+// request does. The blobs a peer misses in its part of the range are healed by the other peers. The caller must
+// hold the lock.
+func (s *SyncClient) mergeRangeFan(st *subTask, fan *rangeFan) {
+	st.isRunning = false
+	if len(fan.inserted) == 0 {
+		return
+	}
+	slices.Sort(fan.inserted)
+	moveSubTaskNext(st, fan.inserted)
+}
+
+// shardLogger returns a child logger with the context of the shard of the contract.
+func (s *SyncClient) shardLogger(contract common.Address, shardId uint64) log.Logger {
+	return s.log.New("contract", contract.Hex(), "shard", shardId)
+}
+
+// requestLogger returns a child logger with the context of a request to the peer for the shard of the contract,
+// so the log lines of the same peer or shard can be found together.
+func (s *SyncClient) requestLogger(id peer.ID, contract common.Address, shardId uint64) log.Logger {
+	return s.log.New("peer", shortPeerID(id), "contract", contract.Hex(), "shard", shardId)
+}
+
+// adaptRangeBatch adjusts the number of blobs in the range requests to the peer in an AIMD way based on the
+// smoothed round trip time of the requests, so the batches grow on a fast link and shrink on a failing one, and a
+// single slow or fast response does not flip the decision. The caller should hold the lock.
+func (s *SyncClient) adaptRangeBatch(pr *Peer, rtt time.Duration, err error) {
+	if err != nil {
+		pr.rangeBatch = s.clampRangeBatch(pr.rangeBatch / 2)
+		return
+	}
+	if pr.rtt == 0 {
+		pr.rtt = rtt
+	} else {
+		pr.rtt = time.Duration((1-measurementImpact)*float64(pr.rtt) + measurementImpact*float64(rtt))
+	}
+	if pr.rtt < rangeBatchTargetRTT {
+		pr.rangeBatch = s.clampRangeBatch(pr.rangeBatch + rangeBatchIncrease)
+	}
+}
+
+// clampRangeBatch bounds the range batch of a peer by the configured min and max range batch size.
+func (s *SyncClient) clampRangeBatch(batch uint64) uint64 {
+	if batch < s.minRangeBatchSize {
+		return s.minRangeBatchSize
 	}
+	if batch > s.maxRangeBatchSize {
+		return s.maxRangeBatchSize
+	}
+	return batch
 }
 
 // assignBlobHealTasks attempts to match idle peers to heal blob requests to retrieval missing blob from the blob list request.
@@ -783,100 +3501,327 @@ func (s *SyncClient) assignBlobHealTasks() {
 	s.lock.Lock()
 	defer s.lock.Unlock()
 
-	if len(s.idlerPeers) == 0 {
+	if s.paused {
 		return
 	}
+	s.assignBlobHealRequests(s.tasks)
+}
 
-	// Iterate over all the tasks and try to find a pending one
-	for _, t := range s.tasks {
-		// All the kvs are downloading, wait for request time or success
-		batch := maxRequestSize / ethstorage.ContractToShardManager[t.Contract].MaxKvSize() * 2
+// dispatchDelay returns the random delay before dispatching a request, the caller must hold the lock. A request
+// dispatched within maxDispatchJitter after the previous one is part of a burst, e.g. many subTasks become ready at
+// once after the sync status is loaded, and it is delayed up to maxDispatchJitter to spread the load on the peers and
+// the local network. A request of a sparse workload is dispatched at once.
+func (s *SyncClient) dispatchDelay() time.Duration {
+	if s.maxDispatchJitter <= 0 {
+		return 0
+	}
+	now := time.Now()
+	burst := now.Sub(s.lastDispatch) < s.maxDispatchJitter
+	s.lastDispatch = now
+	if !burst {
+		return 0
+	}
+	return time.Duration(rand.Int63n(int64(s.maxDispatchJitter)))
+}
 
-		// kvHealTask pending retrieval, try to find an idle peer. If no such peer
-		// exists, we probably assigned tasks for all (or they are stateless).
-		// Abort the entire assignment mechanism.
-		if len(s.idlerPeers) == 0 {
-			return
-		}
-		indexes := t.healTask.getBlobIndexesForRequest(batch)
-		if len(indexes) == 0 {
+// isRequesting returns whether the kv index is requested by a range or list request in flight, the caller must
+// hold the lock.
+func (s *SyncClient) isRequesting(contract common.Address, kvIdx uint64) bool {
+	_, ok := s.requesting[contract][kvIdx]
+	return ok
+}
+
+// markRequesting adds the kv indexes to the set of the indexes in flight, so they are not requested by another
+// range or list request until unmarkRequesting. The caller must hold the lock.
+func (s *SyncClient) markRequesting(contract common.Address, indexes []uint64) {
+	requesting, ok := s.requesting[contract]
+	if !ok {
+		requesting = make(map[uint64]struct{})
+		s.requesting[contract] = requesting
+	}
+	for _, idx := range indexes {
+		requesting[idx] = struct{}{}
+	}
+}
+
+// unmarkRequesting removes the kv indexes from the set of the indexes in flight once the request completes, the
+// caller must hold the lock.
+func (s *SyncClient) unmarkRequesting(contract common.Address, indexes []uint64) {
+	requesting := s.requesting[contract]
+	for _, idx := range indexes {
+		delete(requesting, idx)
+	}
+	if len(requesting) == 0 {
+		delete(s.requesting, contract)
+	}
+}
+
+// advanceSubTasks moves the subTasks past the blobs delivered out of the range requests, e.g. by the heal requests,
+// so the blobs are not requested again by the subTasks. The caller must hold the lock.
+func advanceSubTasks(t *task, inserted []uint64) {
+	delivered := make(map[uint64]struct{}, len(inserted))
+	for _, idx := range inserted {
+		delivered[idx] = struct{}{}
+	}
+	for _, st := range t.SubTasks {
+		if st.done || st.isRunning {
 			continue
 		}
-		pr := s.getIdlePeerForTask(t)
-		if pr == nil {
-			log.Info("Peer for request no found", "contract", t.Contract.Hex(), "shardId",
-				t.ShardId, "indexCount", t.healTask.count(), "peers", len(s.peers), "idlers", len(s.idlerPeers))
-			continue
+		for st.next < st.Last {
+			if _, ok := delivered[st.next]; !ok {
+				break
+			}
+			st.next++
 		}
+		if st.next >= st.Last {
+			st.done = true
+		}
+	}
+}
 
-		req := &blobsByListRequest{
-			peer:     pr.ID(),
-			id:       rand.Uint64(),
-			contract: t.Contract,
-			shardId:  t.ShardId,
-			indexes:  indexes,
-			time:     time.Now(),
-			healTask: t.healTask,
+// canDispatch returns whether another request can be dispatched, the caller must hold the lock. While the
+// loadController reports the system is busy, the requests in flight are capped to throttledInFlight, so the sync
+// backs off without stalling. The loadController is only consulted once the cap is reached.
+func (s *SyncClient) canDispatch() bool {
+	if s.loadController == nil || s.inFlight < throttledInFlight {
+		return true
+	}
+	throttled := s.loadController.ShouldThrottle()
+	if throttled != s.throttled {
+		s.throttled = throttled
+		if throttled {
+			s.log.Info("Sync throttled by the system load", "inFlight", s.inFlight)
+		} else {
+			s.log.Info("Sync unthrottled by the system load")
 		}
-		delete(s.idlerPeers, pr.ID())
-		req.healTask.refresh(indexes)
+	}
+	return !throttled
+}
 
-		s.wg.Add(1)
-		go func(id peer.ID) {
-			defer func() {
-				s.wg.Done()
-			}()
-			start := time.Now()
-			var packet BlobsByListPacket
-			// Attempt to send the remote request and revert if it fails
-			returnCode, err := pr.RequestBlobsByList(req.id, req.contract, req.shardId, req.indexes, &packet)
-			s.metrics.ClientGetBlobsByListEvent(req.peer.String(), returnCode, time.Since(start))
+// SetLoadController sets the LoadController to throttle the sync by the system load, nil to never throttle.
+func (s *SyncClient) SetLoadController(lc LoadController) {
+	s.lock.Lock()
+	s.loadController = lc
+	s.lock.Unlock()
+	s.notifyUpdate()
+}
+
+// waitDispatch waits for the delay before dispatching a request, and returns false if the sync client is closed.
+func (s *SyncClient) waitDispatch(delay time.Duration) bool {
+	if delay <= 0 {
+		return true
+	}
+	select {
+	case <-time.After(delay):
+		return true
+	case <-s.resCtx.Done():
+		return false
+	}
+}
+
+// assignBlobHealRequests attempts to match idle peers to heal blob requests of the tasks, the caller must hold the lock.
+func (s *SyncClient) assignBlobHealRequests(tasks []*task) {
+	// Each task is served one heal request at a time in the order picked by the schedule policy
+	pending := slices.Clone(tasks)
+	for len(s.idlerPeers) > 0 && len(pending) > 0 && s.canDispatch() {
+		i := s.pickTask(pending)
+		s.assignBlobHealRequest(pending[i])
+		pending = slices.Delete(pending, i, i+1)
+	}
+}
+
+// assignBlobHealRequest assigns a list request of the heal indexes of the task to an idle peer.
+// The caller must hold the lock.
+func (s *SyncClient) assignBlobHealRequest(t *task) {
+	if t.diskFull {
+		return
+	}
+	// All the kvs are downloading, wait for request time or success
+	batch := maxRequestSize / ethstorage.ContractToShardManager[t.Contract].MaxKvSize() * 2
+	indexes := t.healTask.getBlobIndexesForRequest(batch)
+	if len(indexes) == 0 {
+		return
+	}
+	pr := s.getIdlePeerAvoiding(t, 0, s.retryAvoidedPeer(t, indexes))
+	if pr == nil {
+		s.log.Info("Peer for request no found", "contract", t.Contract.Hex(), "shard",
+			t.ShardId, "indexCount", t.healTask.count(), "peers", len(s.peers), "idlers", len(s.idlerPeers))
+		return
+	}
+	// skip the blobs known to be missing from the peer, they are requested from the other peers, the blobs
+	// requested by the other requests, and the blobs last failed by the peer if they can be retried elsewhere
+	avoidFailed := s.hasOtherCapablePeer(t, pr.ID())
+	if indexes = t.healTask.getBlobIndexesForPeer(batch, pr.ID(), s.requesting[t.Contract], avoidFailed); len(indexes) == 0 {
+		return
+	}
 
+	req := &blobsByListRequest{
+		peer:     pr.ID(),
+		id:       rand.Uint64(),
+		contract: t.Contract,
+		shardId:  t.ShardId,
+		indexes:  indexes,
+		time:     time.Now(),
+		healTask: t.healTask,
+	}
+	req.log = s.requestLogger(pr.id, t.Contract, t.ShardId)
+	ctx, span := s.tracer.Start(context.Background(), spanRequestList, SpanAttribute{"peer", pr.id.String()},
+		SpanAttribute{"contract", t.Contract.Hex()}, SpanAttribute{"shard", t.ShardId}, SpanAttribute{"indexes", indexes})
+	req.ctx = ctx
+	s.takePeer(pr.ID())
+	s.inFlight++
+	s.markRequesting(t.Contract, indexes)
+	req.healTask.refresh(indexes)
+	preferRange := pr.preferRange
+	delay := s.dispatchDelay()
+
+	s.wg.Add(1)
+	go func(id peer.ID) {
+		defer func() {
 			s.lock.Lock()
-			if _, ok := s.peers[id]; ok {
-				s.idlerPeers[id] = struct{}{}
-				s.notifyUpdate()
+			s.unmarkRequesting(req.contract, indexes)
+			s.lock.Unlock()
+			span.End()
+			s.wg.Done()
+		}()
+		if !s.waitDispatch(delay) {
+			return
+		}
+		held, missing := s.availableIndexes(pr, req.contract, req.shardId, req.indexes)
+		if len(missing) > 0 {
+			s.lock.Lock()
+			req.healTask.markUnavailable(id, missing)
+			if len(held) == 0 {
+				s.inFlight--
+				s.releasePeer(pr)
 			}
 			s.lock.Unlock()
-
-			if err != nil {
-				if e, ok := err.(*yamux.Error); ok && e.Timeout() {
-					log.Debug("Request blobs timeout", "peer", pr.id.String(), "err", err)
-					pr.tracker.Update(0, 0)
-				} else if returnCode == streamError && strings.Contains(err.Error(), "no addresses") {
-					log.Debug("Failed to request blobs as newStream failed", "peer", pr.id.String(), "err", err)
-				} else {
-					log.Info("Failed to request blobs", "peer", pr.id.String(), "err", err)
-				}
+			if len(held) == 0 {
 				return
 			}
-			if req.id != packet.ID || req.contract != packet.Contract || req.shardId != packet.ShardId {
-				log.Info("Req mismatch with res", "reqId", req.id, "packetId", packet.ID,
-					"reqContract", req.contract.Hex(), "packetContract", packet.Contract.Hex(),
-					"reqShardId", req.shardId, "packetShardId", packet.ShardId)
+			req.indexes = held
+		}
+		req.time = time.Now()
+		// Attempt to send the remote requests and revert the failed ones
+		_, rtSpan := s.tracer.Start(ctx, spanRoundTrip)
+		blobs, failed, returnCode, err := s.requestHealIndexes(pr, req, preferRange)
+		endSpan(rtSpan, err)
+
+		s.lock.Lock()
+		s.inFlight--
+		s.releasePeer(pr)
+		if len(failed) > 0 {
+			req.healTask.markFailed(id, failed, s.retryCooldown)
+		}
+		s.lock.Unlock()
+
+		if err != nil {
+			s.recordResponseFailure(pr, err)
+			if e, ok := err.(*yamux.Error); ok && e.Timeout() {
+				req.log.Debug("Request blobs timeout", "err", err)
+				pr.tracker.Update(0, 0)
+			} else if returnCode == returnCodeServerBusy {
+				req.log.Debug("Peer is busy serving requests", "err", err)
+				pr.tracker.Update(0, 0)
+			} else if returnCode == streamError && strings.Contains(err.Error(), "no addresses") {
+				req.log.Debug("Failed to request blobs as newStream failed", "err", err)
+			} else {
+				req.log.Info("Failed to request blobs", "err", err)
+			}
+			// the blobs of the other requests of the indexes are still committed
+			if len(blobs) == 0 {
 				return
 			}
-			res := &blobsByListResponse{
-				req:   req,
-				Blobs: packet.Blobs,
-				time:  time.Now(),
+		}
+		// all the responses mismatch the request
+		if blobs == nil {
+			return
+		}
+		res := &blobsByListResponse{
+			req:   req,
+			Blobs: blobs,
+			time:  time.Now(),
+		}
+		pr.tracker.Update(time.Since(req.time), len(blobs)*int(s.storageManagerOf(req.contract).MaxKvSize()))
+		s.OnBlobsByList(res)
+	}(pr.ID())
+}
+
+// requestHealIndexes requests the blobs of the heal request from the peer. The runs of at least minRangeRun contiguous
+// indexes are requested as ranges, which are cheaper on the wire, and the sparse indexes left as a list; all the
+// indexes are requested as a single range if they are contiguous and the peer prefers range requests, which are
+// cheaper to serve. It returns the blobs of the requests succeeded, nil if no response matches the request, and the
+// indexes of the requests failed with the error of the last failed one.
+func (s *SyncClient) requestHealIndexes(pr *Peer, req *blobsByListRequest, preferRange bool) ([]*BlobPayload, []uint64, byte, error) {
+	ranges, sparse := coalesceIndexes(req.indexes, minRangeRun)
+	if first, last, contiguous := contiguousRange(req.indexes); preferRange && contiguous {
+		ranges, sparse = [][2]uint64{{first, last}}, nil
+	}
+	var (
+		blobs      []*BlobPayload
+		failed     []uint64
+		returnCode byte
+		err        error
+	)
+	// the response is dropped if it mismatches the request, the same as a response without the blobs
+	matched := func(id uint64, contract common.Address, shardId uint64, packetBlobs []*BlobPayload) {
+		if req.id != id || req.contract != contract || req.shardId != shardId {
+			req.log.Info("Req mismatch with res", "reqId", req.id, "packetId", id,
+				"reqContract", req.contract.Hex(), "packetContract", contract.Hex(),
+				"reqShardId", req.shardId, "packetShardId", shardId)
+			return
+		}
+		if blobs == nil {
+			blobs = make([]*BlobPayload, 0, len(req.indexes))
+		}
+		blobs = append(blobs, packetBlobs...)
+	}
+	for _, r := range ranges {
+		start := time.Now()
+		var packet BlobsByRangePacket
+		code, e := pr.RequestBlobsByRange(req.id, req.contract, req.shardId, r[0], r[1], &packet)
+		s.metrics.ClientGetBlobsByRangeEvent(req.peer.String(), code, time.Since(start))
+		if e != nil {
+			returnCode, err = code, e
+			for idx := r[0]; idx <= r[1]; idx++ {
+				failed = append(failed, idx)
 			}
-			pr.tracker.Update(time.Since(req.time), len(packet.Blobs)*int(s.storageManager.MaxKvSize()))
-			s.OnBlobsByList(res)
-		}(pr.ID())
+			continue
+		}
+		matched(packet.ID, packet.Contract, packet.ShardId, packet.Blobs)
 	}
+	if len(sparse) > 0 {
+		start := time.Now()
+		var packet BlobsByListPacket
+		code, e := pr.RequestBlobsByList(req.id, req.contract, req.shardId, sparse, &packet)
+		s.metrics.ClientGetBlobsByListEvent(req.peer.String(), code, time.Since(start))
+		if e != nil {
+			returnCode, err = code, e
+			failed = append(failed, sparse...)
+		} else {
+			matched(packet.ID, packet.Contract, packet.ShardId, packet.Blobs)
+		}
+	}
+	return blobs, failed, returnCode, err
 }
 
 // assignFillEmptyBlobTasks attempts to match idle peers to heal kv requests to retrieval missing kv from the kv range request.
 func (s *SyncClient) assignFillEmptyBlobTasks() {
 	s.lock.Lock()
 	defer s.lock.Unlock()
+	if s.paused {
+		return
+	}
+	workers := s.fillEmptyWorkerLimit()
 	for _, task := range s.tasks {
+		if task.diskFull {
+			continue
+		}
 		for _, emptyTask := range task.SubEmptyTasks {
 			if s.closingPeers {
 				return
 			}
-			if s.runningFillEmptyTaskTreads >= maxFillEmptyTaskTreads {
+			if s.runningFillEmptyTaskTreads >= workers {
 				return
 			}
 			if emptyTask.isRunning || emptyTask.done {
@@ -896,11 +3841,12 @@ func (s *SyncClient) assignFillEmptyBlobTasks() {
 					s.wg.Done()
 				}()
 				t := time.Now()
-				next, err := s.FillFileWithEmptyBlob(start, limit)
+				emptyLog := s.shardLogger(contract, eTask.task.ShardId).New("subTask", fmt.Sprintf("%d-%d", start, limit))
+				next, err := s.fillEmptyBlobs(s.storageManagerOf(contract), start, limit)
 				if err != nil {
-					log.Warn("Fill in empty fail", "err", err.Error())
+					emptyLog.Warn("Fill in empty fail", "err", err.Error())
 				} else {
-					log.Debug("Fill in empty done", "time", time.Now().Sub(t).Seconds())
+					emptyLog.Debug("Fill in empty done", "time", time.Now().Sub(t).Seconds())
 				}
 				filled := next - start
 
@@ -919,20 +3865,122 @@ func (s *SyncClient) assignFillEmptyBlobTasks() {
 	}
 }
 
+// fillEmptyWorkerLimit returns the number of workers allowed to fill empty blobs. When no peer can serve the
+// unfinished sync tasks, fill empty is the only useful work, so it uses all the fill empty workers; otherwise it
+// yields to sync and uses fillEmptyWorkersWithPeers workers. The caller should hold the lock.
+func (s *SyncClient) fillEmptyWorkerLimit() int {
+	if s.fillEmptyWorkersWithPeers <= 0 || s.fillEmptyWorkersWithPeers >= s.fillEmptyWorkers {
+		return s.fillEmptyWorkers
+	}
+	for _, t := range s.tasks {
+		if len(t.SubTasks) == 0 && t.healTask.count() == 0 {
+			continue
+		}
+		for _, p := range s.peers {
+			if p.IsShardExist(t.Contract, t.ShardId) {
+				return s.fillEmptyWorkersWithPeers
+			}
+		}
+	}
+	return s.fillEmptyWorkers
+}
+
+// encodeTypeMismatch returns whether the encode type of the shard of the task stored by the peer is known to be
+// different from the local one, the caller should hold the lock.
+func (s *SyncClient) encodeTypeMismatch(p *Peer, t *task) bool {
+	encodeType, known := p.EncodeType(t.Contract, t.ShardId)
+	if !known {
+		return false
+	}
+	localEncodeType, _ := s.storageManagerOf(t.Contract).GetShardEncodeType(t.ShardId)
+	return encodeType != localEncodeType
+}
+
 func (s *SyncClient) getIdlePeerForTask(t *task) *Peer {
+	return s.getIdlePeerForRange(t, 0)
+}
+
+// getIdlePeerForRange returns the idle peer with the highest capacity serving the shard of the task, whose last kv
+// index is larger than origin if it is known, and whose encode type of the shard is allowed by the encode type
+// policy, the caller must hold the lock. The peer whose request from origin failed last is not returned during its
+// cooldown if there is another capable peer, see retryAvoidedPeer.
+func (s *SyncClient) getIdlePeerForRange(t *task, origin uint64) *Peer {
+	return s.getIdlePeerAvoiding(t, origin, s.retryAvoidedPeer(t, []uint64{origin}))
+}
+
+// retryAvoidedPeer returns the peer whose requests of all the blobs failed last during its cooldown, so the retries
+// of the blobs are routed to the other peers. It returns empty if there is no such peer, or if it is the only capable
+// peer of the task, as the blobs are retried from it anyway. The caller must hold the lock.
+func (s *SyncClient) retryAvoidedPeer(t *task, indexes []uint64) peer.ID {
+	var avoided peer.ID
+	for _, idx := range indexes {
+		id, ok := t.healTask.lastFailed(idx)
+		if !ok || (avoided != "" && id != avoided) {
+			return ""
+		}
+		avoided = id
+	}
+	if avoided == "" || !s.hasOtherCapablePeer(t, avoided) {
+		return ""
+	}
+	return avoided
+}
+
+// hasOtherCapablePeer returns whether a peer other than id, idle or not, serves the shard of the task. The caller
+// must hold the lock.
+func (s *SyncClient) hasOtherCapablePeer(t *task, id peer.ID) bool {
+	for pid, p := range s.peers {
+		if pid == id {
+			continue
+		}
+		if _, ok := t.statelessPeers[pid]; ok {
+			continue
+		}
+		if p.IsShardExist(t.Contract, t.ShardId) {
+			return true
+		}
+	}
+	return false
+}
+
+// getIdlePeerAvoiding is the same as getIdlePeerForRange, except the avoided peer is never returned.
+func (s *SyncClient) getIdlePeerAvoiding(t *task, origin uint64, avoided peer.ID) *Peer {
 	idlers := &capacitySort{
 		ids:  make([]peer.ID, 0, len(s.idlerPeers)),
 		caps: make([]float64, 0, len(s.idlerPeers)),
 	}
+	fallbacks := &capacitySort{}
 	for id := range s.idlerPeers {
+		if id == avoided {
+			continue
+		}
 		if _, ok := t.statelessPeers[id]; ok {
 			continue
 		}
 		p, ok := s.peers[id]
-		if ok && p.IsShardExist(t.Contract, t.ShardId) {
-			idlers.ids = append(idlers.ids, id)
-			idlers.caps = append(idlers.caps, p.tracker.capacity)
+		if !ok {
+			continue
+		}
+		if last, known := p.lastKvIndex[t.Contract]; known && origin >= last {
+			s.maybeRefreshLastKvIndex(p)
+			continue
+		}
+		if !p.IsShardExist(t.Contract, t.ShardId) {
+			continue
+		}
+		if s.encodeTypePolicy != EncodeTypeReEncode && s.encodeTypeMismatch(p, t) {
+			if s.encodeTypePolicy == EncodeTypePreferMatch {
+				fallbacks.ids = append(fallbacks.ids, id)
+				fallbacks.caps = append(fallbacks.caps, p.tracker.capacity)
+			}
+			continue
 		}
+		idlers.ids = append(idlers.ids, id)
+		idlers.caps = append(idlers.caps, p.tracker.capacity)
+	}
+	if len(idlers.ids) == 0 {
+		// fall back to the peers with a different encode type, whose blobs are re-encoded
+		idlers = fallbacks
 	}
 	if len(idlers.ids) == 0 {
 		return nil
@@ -960,7 +4008,11 @@ func (s *SyncClient) OnBlobsByRange(res *blobsByRangeResponse) {
 			size += common.StorageSize(len(blob.EncodedBlob))
 		}
 	}
-	s.log.Debug("OnBlobsByRange: static", "reqId", req.id, "blobCount", len(res.Blobs), "bytes", size)
+	req.log.Debug("OnBlobsByRange: static", "reqId", req.id, "blobCount", len(res.Blobs), "bytes", size)
+	if s.taskCancelled(req.subTask.task) {
+		req.log.Debug("Drop response of cancelled shard", "reqId", req.id)
+		return
+	}
 
 	blobsInRange := make([]*BlobPayload, 0)
 	for _, blob := range res.Blobs {
@@ -969,31 +4021,32 @@ func (s *SyncClient) OnBlobsByRange(res *blobsByRangeResponse) {
 		}
 	}
 	if len(res.Blobs) > len(blobsInRange) {
-		s.log.Trace("Drop unexpected kvs", "count", len(res.Blobs)-len(blobsInRange))
+		req.log.Trace("Drop unexpected kvs", "count", len(res.Blobs)-len(blobsInRange))
 	}
 
 	// Response is valid, but check if peer is signalling that it does not have
 	// the requested Data. For blob range queries that means the peer is not
 	// yet synced.
 	if len(blobsInRange) == 0 {
-		s.log.Info("Peer rejected get blob by range request")
+		req.log.Info("Peer rejected get blob by range request", "origin", req.origin, "limit", req.limit)
 		s.lock.Lock()
 		if _, ok := s.peers[req.peer]; ok {
 			req.subTask.task.statelessPeers[req.peer] = struct{}{}
 		}
+		req.subTask.task.healTask.markFailed(req.peer, []uint64{req.origin}, s.retryCooldown)
 		s.lock.Unlock()
 		s.metrics.ClientOnBlobsByRange(req.peer.String(), reqCount, uint64(len(res.Blobs)), 0, time.Since(start))
 		return
 	}
 
-	synced, syncedBytes, inserted, err := s.onResult(blobsInRange)
+	synced, syncedBytes, inserted, err := s.onResult(req.ctx, req.peer, req.contract, blobsInRange, req.subTask.task.force)
 	if err != nil {
-		log.Error("OnBlobsByRange fail", "err", err.Error())
+		req.log.Error("OnBlobsByRange fail", "err", err.Error())
 		return
 	}
 
 	s.metrics.ClientOnBlobsByRange(req.peer.String(), reqCount, uint64(len(res.Blobs)), synced, time.Since(start))
-	log.Debug("Persisted set of kvs", "count", synced, "bytes", syncedBytes)
+	req.log.Debug("Persisted set of kvs", "count", synced, "bytes", syncedBytes)
 
 	// set peer to stateless peer if fail too much
 	if len(inserted) == 0 {
@@ -1001,6 +4054,7 @@ func (s *SyncClient) OnBlobsByRange(res *blobsByRangeResponse) {
 		if _, ok := s.peers[req.peer]; ok {
 			req.subTask.task.statelessPeers[req.peer] = struct{}{}
 		}
+		req.subTask.task.healTask.markFailed(req.peer, []uint64{req.origin}, s.retryCooldown)
 		s.lock.Unlock()
 		return
 	}
@@ -1008,24 +4062,38 @@ func (s *SyncClient) OnBlobsByRange(res *blobsByRangeResponse) {
 	sort.Slice(inserted, func(i, j int) bool {
 		return inserted[i] < inserted[j]
 	})
+	s.lock.Lock()
+	state := req.subTask.task.state
+	state.BlobsSynced += uint64(len(inserted))
+	req.subTask.task.rate.add(time.Now(), uint64(len(inserted)))
+	req.subTask.task.healTask.remove(inserted)
+	if req.fan != nil {
+		// the subTask moves on once all the requests of the fan are done
+		req.fan.inserted = append(req.fan.inserted, inserted...)
+	} else {
+		moveSubTaskNext(req.subTask, inserted)
+	}
+	s.lock.Unlock()
+	s.notifyProgress()
+}
+
+// moveSubTaskNext moves the next of the subTask after the last blob of the sorted inserted blobs, and the blobs
+// missing before it are added to the heal task. The caller must hold the lock.
+func moveSubTaskNext(st *subTask, inserted []uint64) {
 	last := inserted[len(inserted)-1]
 	missing := make([]uint64, 0)
-	for i, n := 0, res.req.subTask.next; n <= last; n++ {
+	for i, n := 0, st.next; n <= last; n++ {
 		if inserted[i] == n {
 			i++
 		} else if inserted[i] > n {
 			missing = append(missing, n)
 		}
 	}
-	s.lock.Lock()
-	state := req.subTask.task.state
-	state.BlobsSynced += uint64(len(inserted))
-	res.req.subTask.task.healTask.insert(missing)
-	if last == res.req.subTask.Last-1 {
-		res.req.subTask.done = true
+	st.task.healTask.insert(missing)
+	if last == st.Last-1 {
+		st.done = true
 	}
-	res.req.subTask.next = last + 1
-	s.lock.Unlock()
+	st.next = last + 1
 }
 
 // OnBlobsByList is a callback method to invoke when a batch of Contract
@@ -1041,9 +4109,14 @@ func (s *SyncClient) OnBlobsByList(res *blobsByListResponse) {
 			size += common.StorageSize(len(blob.EncodedBlob))
 		}
 	}
-	s.log.Debug("OnBlobsByList: static", "reqId", req.id, "blobCount", len(res.Blobs), "bytes", size)
+	req.log.Debug("OnBlobsByList: static", "reqId", req.id, "blobCount", len(res.Blobs), "bytes", size)
+	if s.taskCancelled(req.healTask.task) {
+		req.log.Debug("Drop response of cancelled shard", "reqId", req.id)
+		return
+	}
 
-	startIdx, endIdx := s.storageManager.KvEntries()*req.shardId, s.storageManager.KvEntries()*(req.shardId+1)-1
+	kvEntries := s.storageManagerOf(req.contract).KvEntries()
+	startIdx, endIdx := kvEntries*req.shardId, kvEntries*(req.shardId+1)-1
 	blobsInRange := make([]*BlobPayload, 0)
 	for _, blob := range res.Blobs {
 		if startIdx <= blob.BlobIndex && endIdx >= blob.BlobIndex {
@@ -1051,37 +4124,41 @@ func (s *SyncClient) OnBlobsByList(res *blobsByListResponse) {
 		}
 	}
 	if len(res.Blobs) > len(blobsInRange) {
-		s.log.Trace("Drop unexpected kvs", "count", len(res.Blobs)-len(blobsInRange))
+		req.log.Trace("Drop unexpected kvs", "count", len(res.Blobs)-len(blobsInRange))
 	}
 
 	// Response is valid, but check if peer is signalling that it does not have
 	// the requested Data. For kv range queries that means the peer is not
 	// yet synced.
 	if len(blobsInRange) == 0 {
-		s.log.Info("Peer rejected get blobs by list request")
+		req.log.Info("Peer rejected get blobs by list request", "count", len(req.indexes))
 		s.lock.Lock()
 		if _, ok := s.peers[req.peer]; ok {
 			req.healTask.task.statelessPeers[req.peer] = struct{}{}
 		}
+		req.healTask.markFailed(req.peer, req.indexes, s.retryCooldown)
 		s.lock.Unlock()
 		s.metrics.ClientOnBlobsByList(req.peer.String(), uint64(len(req.indexes)), uint64(len(res.Blobs)),
 			0, time.Since(start))
 		return
 	}
 
-	synced, syncedBytes, inserted, err := s.onResult(blobsInRange)
+	synced, syncedBytes, inserted, err := s.onResult(req.ctx, req.peer, req.contract, blobsInRange, req.healTask.task.force)
 	if err != nil {
-		log.Error("OnBlobsByList fail", "err", err.Error())
+		req.log.Error("OnBlobsByList fail", "err", err.Error())
 		return
 	}
 
 	s.metrics.ClientOnBlobsByList(req.peer.String(), uint64(len(req.indexes)), uint64(len(res.Blobs)),
 		synced, time.Since(start))
-	log.Debug("Persisted set of kvs", "count", synced, "bytes", syncedBytes)
+	req.log.Debug("Persisted set of kvs", "count", synced, "bytes", syncedBytes)
 
 	s.lock.Lock()
 	state := req.healTask.task.state
 	state.BlobsSynced += uint64(len(inserted))
+	if len(inserted) > 0 {
+		req.healTask.task.rate.add(time.Now(), uint64(len(inserted)))
+	}
 	// set peer to stateless peer if fail too much
 	if len(inserted) == 0 {
 		if _, ok := s.peers[req.peer]; ok {
@@ -1089,18 +4166,39 @@ func (s *SyncClient) OnBlobsByList(res *blobsByListResponse) {
 		}
 	}
 	res.req.healTask.remove(inserted)
+	// the blobs not delivered are retried from the other peers first
+	delivered := make(map[uint64]struct{}, len(inserted))
+	for _, idx := range inserted {
+		delivered[idx] = struct{}{}
+	}
+	failed := make([]uint64, 0)
+	for _, idx := range req.indexes {
+		if _, ok := delivered[idx]; !ok {
+			failed = append(failed, idx)
+		}
+	}
+	res.req.healTask.markFailed(req.peer, failed, s.retryCooldown)
+	advanceSubTasks(res.req.healTask.task, inserted)
 	s.lock.Unlock()
+	if len(inserted) > 0 {
+		s.notifyProgress()
+	}
 }
 
 // FillFileWithEmptyBlob this func is used to fill empty blobs to storage file to make the whole file data encoded.
 // file in the blobs between origin and limit (include limit). if the lastKvIdx larger than kv idx to fill, ignore it.
 func (s *SyncClient) FillFileWithEmptyBlob(start, limit uint64) (uint64, error) {
+	return s.fillEmptyBlobs(s.storageManager, start, limit)
+}
+
+// fillEmptyBlobs works as FillFileWithEmptyBlob for the storage file of the storage manager.
+func (s *SyncClient) fillEmptyBlobs(sm StorageManager, start, limit uint64) (uint64, error) {
 	var (
 		st       = time.Now()
 		inserted = uint64(0)
 		next     = start
 	)
-	lastBlobIdx := s.storageManager.LastKvIndex()
+	lastBlobIdx := sm.LastKvIndex()
 	if lastBlobIdx > limit {
 		return limit + 1, nil
 	}
@@ -1108,14 +4206,45 @@ func (s *SyncClient) FillFileWithEmptyBlob(start, limit uint64) (uint64, error)
 	if start < lastBlobIdx {
 		start = lastBlobIdx
 	}
-	inserted, next, err := s.storageManager.CommitEmptyBlobs(start, limit)
+	inserted, next, err := sm.CommitEmptyBlobs(start, limit)
 	if inserted > 0 {
 		s.metrics.ClientFillEmptyBlobsEvent(inserted, time.Since(st))
 	}
+	if errors.Is(err, ethstorage.ErrDiskFull) {
+		s.pauseDiskFull(sm.ContractAddress(), next/sm.KvEntries(), err)
+	}
 
 	return next, err
 }
 
+// TrimPeers removes the peers beyond maxPeers, which are allowed by the overshoot during the sync, from
+// sync duties once the sync is done, and returns them so that the caller can close the connections.
+// Peers with lower capacity are removed first.
+func (s *SyncClient) TrimPeers() []peer.ID {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	trimmed := make([]peer.ID, 0)
+	if !s.syncDone || len(s.peers) <= s.maxPeers {
+		return trimmed
+	}
+	peers := &capacitySort{
+		ids:  make([]peer.ID, 0, len(s.peers)),
+		caps: make([]float64, 0, len(s.peers)),
+	}
+	for id, p := range s.peers {
+		peers.ids = append(peers.ids, id)
+		peers.caps = append(peers.caps, p.tracker.capacity)
+	}
+	sort.Sort(peers)
+	for _, id := range peers.ids[:len(s.peers)-s.maxPeers] {
+		s.removePeer(id)
+		trimmed = append(trimmed, id)
+	}
+	s.log.Info("Trim peers after sync done", "maxPeers", s.maxPeers, "trimmed", len(trimmed))
+	return trimmed
+}
+
 func (s *SyncClient) Peers() []peer.ID {
 	s.lock.Lock()
 	defer s.lock.Unlock()
@@ -1128,9 +4257,89 @@ func (s *SyncClient) Peers() []peer.ID {
 	return peers
 }
 
+// PeersForIndex returns the connected peers which advertise the shard of kvIndex of the contract, to diagnose
+// whether a blob is not synced because no capable peer is connected, or the blob is missing in the peers.
+// The kvIndex is mapped to the shard by the local storage, so no peer is returned for a contract not synced.
+func (s *SyncClient) PeersForIndex(contract common.Address, kvIndex uint64) []peer.ID {
+	peers := make([]peer.ID, 0)
+	sm := s.storageManagerOf(contract)
+	if sm == nil {
+		return peers
+	}
+	shardId := kvIndex / sm.KvEntries()
+
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	for id, pr := range s.peers {
+		if pr.IsShardExist(contract, shardId) {
+			peers = append(peers, id)
+		}
+	}
+	sort.Slice(peers, func(i, j int) bool {
+		return peers[i] < peers[j]
+	})
+	return peers
+}
+
+// EstimateSync walks the tasks and the connected peers to estimate the blobs and bytes remaining to sync, and how many
+// of them no connected peer can serve, either as no peer has the shard or the peers are behind the kv index. It is a
+// dry run which neither requests blobs from peers nor writes to the storage.
+func (s *SyncClient) EstimateSync() *SyncEstimate {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	estimate := new(SyncEstimate)
+	for _, t := range s.tasks {
+		// the blobs from servable are beyond all the connected peers serving the shard
+		servable := uint64(0)
+		for id, pr := range s.peers {
+			if _, ok := t.statelessPeers[id]; ok || !pr.IsShardExist(t.Contract, t.ShardId) {
+				continue
+			}
+			last, known := pr.lastKvIndex[t.Contract]
+			if !known {
+				servable = math.MaxUint64
+				break
+			}
+			servable = max(servable, last)
+		}
+
+		blobs, unservable := uint64(0), uint64(0)
+		for _, st := range t.SubTasks {
+			blobs += st.Last - st.next
+			if st.Last > servable {
+				unservable += st.Last - max(st.next, servable)
+			}
+		}
+		for idx := range t.healTask.Indexes {
+			blobs++
+			if idx >= servable {
+				unservable++
+			}
+		}
+		estimate.BlobsToFetch += blobs
+		estimate.BytesToFetch += blobs * s.storageManagerOf(t.Contract).MaxKvSize()
+		estimate.Unservable += unservable
+	}
+	return estimate
+}
+
 // onResult is exclusively called by the main loop, and has thus direct access to the request bookkeeping state.
 // This function verifies if the result is canonical, and either promotes the result or moves the result into quarantine.
-func (s *SyncClient) onResult(blobs []*BlobPayload) (uint64, uint64, []uint64, error) {
+func (s *SyncClient) onResult(ctx context.Context, id peer.ID, contract common.Address, blobs []*BlobPayload, force bool) (uint64, uint64, []uint64, error) {
+	synced, syncedBytes, inserted, _, err := s.processBlobs(ctx, id, contract, blobs, force)
+	return synced, syncedBytes, inserted, err
+}
+
+// processBlobs decodes, verifies and commits the blobs of the contract, and returns the reasons of the blobs failed
+// to decode, verify or commit in addition to the result of onResult.
+// The blobs are decoded and verified concurrently in the decode pool, and then committed in a batch, overwriting
+// the local blobs if force. The spans of the blobs are the children of the span in ctx.
+func (s *SyncClient) processBlobs(ctx context.Context, id peer.ID, contract common.Address, blobs []*BlobPayload, force bool) (uint64, uint64, []uint64, map[uint64]string, error) {
+	sm := s.storageManagerOf(contract)
+	if sm == nil {
+		return 0, 0, nil, nil, fmt.Errorf("contract %s is not supported", contract.Hex())
+	}
 	var (
 		synced       uint64
 		syncedBytes  uint64
@@ -1138,35 +4347,206 @@ func (s *SyncClient) onResult(blobs []*BlobPayload) (uint64, uint64, []uint64, e
 		indices      = make([]uint64, 0)
 		decodedBlobs = make([][]byte, 0)
 		commits      = make([]common.Hash, 0)
+		failures     = make(map[uint64]string)
+		mismatched   = make([]uint64, 0)
+		results      = make([]decodeResult, len(blobs))
+		wg           sync.WaitGroup
 	)
-	for _, payload := range blobs {
+	for i, payload := range blobs {
 		synced++
+		// a blob of invalid length is rejected as it is parsed, so an oversized blob from a malicious or buggy peer
+		// is never decoded, committed or counted as synced bytes
+		if !s.checkBlobLength(sm, payload) {
+			s.markPeerSuspicious(id)
+			results[i] = decodeResult{failure: failureInvalidBlobLength}
+			continue
+		}
 		syncedBytes += uint64(len(payload.EncodedBlob))
 
-		decodedBlob, success := s.decodeKV(payload)
-		if !success {
+		i, payload := i, payload
+		wg.Add(1)
+		if !s.decodePool.submit(s.resCtx, func() {
+			defer wg.Done()
+			results[i] = s.decodeAndVerify(ctx, sm, id, payload)
+		}) {
+			wg.Done()
+			results[i] = decodeResult{failure: "sync client closed"}
+		}
+	}
+	wg.Wait()
+
+	for i, payload := range blobs {
+		if results[i].failure == failureEncodeTypeMismatch {
+			s.rejectEncodeType(id, contract, payload.BlobIndex/sm.KvEntries(), payload.EncodeType)
+		}
+		if results[i].failure == failureCommitMismatch {
+			mismatched = append(mismatched, payload.BlobIndex)
+		}
+		if results[i].failure != "" {
+			failures[payload.BlobIndex] = results[i].failure
+			continue
+		}
+		indices = append(indices, payload.BlobIndex)
+		decodedBlobs = append(decodedBlobs, results[i].decodedBlob)
+		commits = append(commits, payload.BlobCommit)
+	}
+	s.metrics.ClientBlobsReceived(synced, syncedBytes)
+	s.syncedBytes.Add(syncedBytes)
+	if len(mismatched) > 0 {
+		s.healMismatches(id, sm, mismatched)
+	}
+
+	// block while the disk writes fall behind, so the decoded blobs are not buffered without a bound
+	_, commitSpan := s.tracer.Start(ctx, spanCommit, SpanAttribute{"indexes", indices})
+	inserted, err := s.writeQueue.submit(s.resCtx, sm, indices, decodedBlobs, commits, force)
+	endSpan(commitSpan, err)
+	if len(inserted) > 0 {
+		s.lastCommitTime.Store(time.Now().UnixNano())
+	}
+	if errors.Is(err, ethstorage.ErrDiskFull) && len(indices) > 0 {
+		s.pauseDiskFull(contract, indices[0]/sm.KvEntries(), err)
+	}
+	if err != nil {
+		return synced, syncedBytes, inserted, failures, err
+	}
+	committed := make(map[uint64]struct{})
+	for _, idx := range inserted {
+		committed[idx] = struct{}{}
+	}
+	for _, idx := range indices {
+		if _, ok := committed[idx]; !ok {
+			failures[idx] = "commit blob to storage failed"
+		}
+	}
+	return synced, syncedBytes, inserted, failures, nil
+}
+
+const (
+	// failureEncodeTypeMismatch is the failure of a blob dropped for its encode type by EncodeTypeRejectMismatch.
+	failureEncodeTypeMismatch = "encode type mismatch"
+	// failureInvalidBlobLength is the failure of a blob whose length is not the kv size of the shard.
+	failureInvalidBlobLength = "invalid blob length"
+	// failureCommitMismatch is the failure of a blob whose decoded data mismatches its commit, unlike a blob not
+	// found, the peer has the blob but delivered the wrong data.
+	failureCommitMismatch = "commit mismatch"
+)
+
+// healMismatches adds the blobs of the storage manager mismatching their commits to the heal tasks of their shards, and
+// records the peer delivering them as their last failed peer, so the blobs are retried from the other peers first.
+func (s *SyncClient) healMismatches(id peer.ID, sm StorageManager, indexes []uint64) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	for _, t := range s.tasks {
+		if t.Contract != sm.ContractAddress() {
+			continue
+		}
+		shardIndexes := make([]uint64, 0, len(indexes))
+		for _, idx := range indexes {
+			if idx/sm.KvEntries() == t.ShardId {
+				shardIndexes = append(shardIndexes, idx)
+			}
+		}
+		if len(shardIndexes) == 0 {
 			continue
 		}
+		s.log.Info("Heal blobs mismatching their commits", "peer", id, "shardId", t.ShardId, "indexes", shardIndexes)
+		t.healTask.insert(shardIndexes)
+		t.healTask.markFailed(id, shardIndexes, s.retryCooldown)
+	}
+}
+
+// rejectEncodeType records the encode type of the shard stored by the peer learned from the blobs it delivered, so
+// the peer is not requested for the shard again by EncodeTypeRejectMismatch.
+func (s *SyncClient) rejectEncodeType(id peer.ID, contract common.Address, shardId uint64, encodeType uint64) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	pr, ok := s.peers[id]
+	if !ok {
+		return
+	}
+	if known, ok := pr.EncodeType(contract, shardId); !ok || known != encodeType {
+		pr.Log().Info("Reject blobs of a different encode type", "contract", contract.Hex(), "shardId", shardId,
+			"encodeType", encodeType)
+		pr.setEncodeType(contract, shardId, encodeType)
+	}
+}
+
+type decodeResult struct {
+	decodedBlob []byte
+	failure     string // the reason the blob failed to decode or verify, empty on success
+}
+
+// decodeAndVerify decodes the blob received from the peer and verifies it against its commit if needed. It runs in
+// the decode pool, so it is called concurrently for the blobs of a response.
+func (s *SyncClient) decodeAndVerify(ctx context.Context, sm StorageManager, id peer.ID, payload *BlobPayload) decodeResult {
+	if s.encodeTypePolicy == EncodeTypeRejectMismatch {
+		if encodeType, _ := sm.GetShardEncodeType(payload.BlobIndex / sm.KvEntries()); payload.EncodeType != encodeType {
+			return decodeResult{failure: failureEncodeTypeMismatch}
+		}
+	}
+
+	_, decodeSpan := s.tracer.Start(ctx, spanDecode, SpanAttribute{"index", payload.BlobIndex})
+	decodedBlob, success := s.decodeKV(sm, payload)
+	decodeSpan.End()
+	if !success {
+		return decodeResult{failure: "decode blob failed"}
+	}
 
+	shard := ShardKey{Contract: sm.ContractAddress(), ShardId: payload.BlobIndex / sm.KvEntries()}
+	if s.shouldVerify(shard, id) {
+		_, verifySpan := s.tracer.Start(ctx, spanVerify, SpanAttribute{"index", payload.BlobIndex})
 		success = s.checkBlobCommit(decodedBlob, payload)
 		if !success {
-			continue
+			// the peer may misreport the encode type during an encode type migration
+			decodedBlob, success = s.decodeWithAltEncodeTypes(sm, payload)
+		}
+		verifySpan.End()
+		if !success {
+			s.metrics.ClientCommitMismatch(id.String())
+			s.markPeerSuspicious(id)
+			return decodeResult{failure: failureCommitMismatch}
 		}
+	}
 
-		indices = append(indices, payload.BlobIndex)
-		decodedBlobs = append(decodedBlobs, decodedBlob)
-		commits = append(commits, payload.BlobCommit)
+	if _, ok := s.indexHeaderShards[shard]; ok &&
+		!s.checkIndexHeader(sm.ContractAddress(), decodedBlob, payload) {
+		s.markPeerSuspicious(id)
+		return decodeResult{failure: "index header mismatch"}
 	}
+	return decodeResult{decodedBlob: decodedBlob}
+}
 
-	inserted, err := s.commitBlobs(indices, decodedBlobs, commits)
-	return synced, syncedBytes, inserted, err
+// presentBlobs returns the indexes of the blobs which already exist in the local storage with the same commit.
+func (s *SyncClient) presentBlobs(blobs []*BlobPayload) map[uint64]struct{} {
+	present := make(map[uint64]struct{})
+	for _, payload := range blobs {
+		meta, success, err := s.storageManager.TryReadMeta(payload.BlobIndex)
+		if !success || err != nil {
+			continue
+		}
+		if bytes.Equal(meta, payload.BlobCommit[:]) {
+			present[payload.BlobIndex] = struct{}{}
+		}
+	}
+	return present
+}
+
+// checkBlobLength checks the length of the encoded blob, as the encoded blob of all encode types
+// is chunk aligned, it should be exactly MaxKvSize.
+func (s *SyncClient) checkBlobLength(sm StorageManager, payload *BlobPayload) bool {
+	if uint64(len(payload.EncodedBlob)) != sm.MaxKvSize() {
+		s.log.Info("Invalid blob length", "kvIdx", payload.BlobIndex, "encodeType", payload.EncodeType,
+			"length", len(payload.EncodedBlob), "expected", sm.MaxKvSize())
+		return false
+	}
+	return true
 }
 
-func (s *SyncClient) decodeKV(payload *BlobPayload) ([]byte, bool) {
+func (s *SyncClient) decodeKV(sm StorageManager, payload *BlobPayload) ([]byte, bool) {
 	recordDur := s.metrics.ClientRecordTimeUsed("decodeKv")
 	defer recordDur()
 
-	decodedBlob, found, err := s.storageManager.DecodeKV(payload.BlobIndex, payload.EncodedBlob, payload.BlobCommit,
+	decodedBlob, found, err := sm.DecodeKV(payload.BlobIndex, payload.EncodedBlob, payload.BlobCommit,
 		payload.MinerAddress, payload.EncodeType)
 	if err != nil || !found {
 		if err != nil {
@@ -1179,6 +4559,127 @@ func (s *SyncClient) decodeKV(payload *BlobPayload) ([]byte, bool) {
 	return decodedBlob, true
 }
 
+// decodeWithAltEncodeTypes decodes the blob with the known encode types other than the one reported by the peer,
+// and returns the first decoded blob matching the commit.
+func (s *SyncClient) decodeWithAltEncodeTypes(sm StorageManager, payload *BlobPayload) ([]byte, bool) {
+	for _, encodeType := range altEncodeTypes {
+		if encodeType == payload.EncodeType {
+			continue
+		}
+		decodedBlob, found, err := sm.DecodeKV(payload.BlobIndex, payload.EncodedBlob, payload.BlobCommit,
+			payload.MinerAddress, encodeType)
+		recovered := err == nil && found && s.checkBlobCommit(decodedBlob, payload)
+		s.metrics.ClientAltEncodeTypeDecode(encodeType, recovered)
+		if recovered {
+			s.log.Info("Blob decoded with alternative encode type", "kvIdx", payload.BlobIndex,
+				"reported", payload.EncodeType, "actual", encodeType)
+			return decodedBlob, true
+		}
+	}
+	return []byte{}, false
+}
+
+// shouldVerify reports whether a blob of the given shard received from the peer needs to be
+// verified against its commit, according to the verify strictness configured for the shard.
+func (s *SyncClient) shouldVerify(shard ShardKey, id peer.ID) bool {
+	strictness := VerifyFull
+	if level, ok := s.verifyStrictness[shard]; ok {
+		strictness = level
+	}
+	if strictness == VerifyFull {
+		return true
+	}
+
+	s.lock.Lock()
+	_, suspicious := s.suspiciousPeers[id]
+	s.lock.Unlock()
+	if suspicious {
+		return true
+	}
+
+	switch strictness {
+	case VerifySampled:
+		return rand.Float64() < s.verifySampleRate
+	case VerifyTrusted:
+		return rand.Float64() < s.trustedVerifySampleRate
+	default:
+		return true
+	}
+}
+
+// recordResponseFailure counts the failed response of the peer in its PeerStats, and feeds the peer scoring: a reset
+// or partial response lowers the request capacity of the peer, and a malformed response marks the peer suspicious
+// and counts towards its ban as an invalid blob.
+func (s *SyncClient) recordResponseFailure(pr *Peer, err error) {
+	failure := classifyResponseError(err)
+	if failure == responseOK {
+		return
+	}
+	s.lock.Lock()
+	switch failure {
+	case responseReset:
+		pr.stats.StreamResets++
+	case responsePartial:
+		pr.stats.PartialResponses++
+	case responseMalformed:
+		pr.stats.MalformedResponses++
+	}
+	if failure != responseMalformed && s.isRegistered(pr) {
+		s.maybeRefreshLastKvIndex(pr)
+	}
+	s.lock.Unlock()
+	s.metrics.ClientResponseFailure(pr.id.String(), string(failure))
+
+	if failure == responseMalformed {
+		s.markPeerSuspicious(pr.id)
+	} else {
+		pr.tracker.Update(0, 0)
+	}
+}
+
+// PeerStats returns the counts of the failed responses of the peer, and false if the peer is not registered.
+func (s *SyncClient) PeerStats(id peer.ID) (PeerStats, bool) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	pr, ok := s.peers[id]
+	if !ok {
+		return PeerStats{}, false
+	}
+	return pr.stats, true
+}
+
+// markPeerSuspicious records that the peer delivered a blob which failed verification, so that all blobs
+// from it get verified from now on, regardless of the strictness of the shard.
+// Once the peer delivered more than maxInvalidBlobsPerPeer invalid blobs, it is removed and banned.
+func (s *SyncClient) markPeerSuspicious(id peer.ID) {
+	s.lock.Lock()
+	if _, ok := s.suspiciousPeers[id]; !ok {
+		s.log.Warn("Mark peer as suspicious", "peer", id)
+		s.suspiciousPeers[id] = struct{}{}
+	}
+	_, connected := s.peers[id]
+	if !connected || s.maxInvalidBlobsPerPeer <= 0 {
+		s.lock.Unlock()
+		return
+	}
+	s.invalidBlobs[id]++
+	invalidBlobs := s.invalidBlobs[id]
+	if invalidBlobs <= s.maxInvalidBlobsPerPeer {
+		s.lock.Unlock()
+		return
+	}
+	s.removePeer(id)
+	s.lock.Unlock()
+
+	s.log.Warn("Ban peer for delivering too many invalid blobs", "peer", id, "invalidBlobs", invalidBlobs)
+	if s.banPeer != nil {
+		if err := s.banPeer(id); err != nil {
+			s.log.Warn("Failed to ban peer", "peer", id, "err", err)
+		}
+	}
+	s.bannedFeed.Send(PeerBanned{Peer: id, InvalidBlobs: invalidBlobs})
+}
+
 func (s *SyncClient) checkBlobCommit(decodedBlob []byte, payload *BlobPayload) bool {
 	recordDur := s.metrics.ClientRecordTimeUsed("getRoot")
 	root, err := s.prover.GetRoot(decodedBlob, 0, 0)
@@ -1199,10 +4700,32 @@ func (s *SyncClient) checkBlobCommit(decodedBlob []byte, payload *BlobPayload) b
 	return true
 }
 
-func (s *SyncClient) commitBlobs(kvIndices []uint64, decodedBlobs [][]byte, commits []common.Hash) ([]uint64, error) {
+// checkIndexHeader checks the header embedded at the start of the decoded blob, which is the contract address followed
+// by the big endian kv index, against the contract and the kv index of the blob, so a blob of another index is not
+// accepted even if it matches the commit.
+func (s *SyncClient) checkIndexHeader(contract common.Address, decodedBlob []byte, payload *BlobPayload) bool {
+	if len(decodedBlob) < indexHeaderSize {
+		s.log.Info("Blob is too short for index header", "kvIdx", payload.BlobIndex, "length", len(decodedBlob))
+		return false
+	}
+	embeddedContract := common.BytesToAddress(decodedBlob[:common.AddressLength])
+	embeddedIdx := binary.BigEndian.Uint64(decodedBlob[common.AddressLength:indexHeaderSize])
+	if embeddedContract != contract || embeddedIdx != payload.BlobIndex {
+		s.log.Info("Blob index header mismatch", "kvIdx", payload.BlobIndex, "embeddedIdx", embeddedIdx,
+			"contract", contract.Hex(), "embeddedContract", embeddedContract.Hex())
+		return false
+	}
+	return true
+}
+
+func (s *SyncClient) commitBlobs(sm StorageManager, kvIndices []uint64, decodedBlobs [][]byte, commits []common.Hash,
+	force bool) ([]uint64, error) {
 	recordDur := s.metrics.ClientRecordTimeUsed("commitBlobs")
 	defer recordDur()
-	return s.storageManager.CommitBlobs(kvIndices, decodedBlobs, commits)
+	if force {
+		return sm.OverwriteBlobs(kvIndices, decodedBlobs, commits)
+	}
+	return sm.CommitBlobs(kvIndices, decodedBlobs, commits)
 }
 
 // report calculates various status reports and provides it to the user.
@@ -1228,6 +4751,7 @@ func (s *SyncClient) reportSyncState(duration uint64) {
 			blobsToSync = blobsToSync + (st.Last - st.next)
 		}
 		t.state.BlobsToSync = blobsToSync + uint64(t.healTask.count())
+		s.metrics.ClientSetHealTaskSize(t.Contract, t.ShardId, t.healTask.count())
 		if t.state.BlobsSynced+t.state.BlobsToSync != 0 {
 			t.state.SyncProgress = t.state.BlobsSynced * 10000 / (t.state.BlobsSynced + t.state.BlobsToSync)
 		} else {
@@ -1246,7 +4770,7 @@ func (s *SyncClient) reportSyncState(duration uint64) {
 			estTime = common.PrettyDuration(time.Duration(etaSecondsLeft) * time.Second).String()
 		}
 
-		log.Info("Storage sync in progress", "shardId", t.ShardId, "subTaskRemain", len(t.SubTasks), "peerCount",
+		s.shardLogger(t.Contract, t.ShardId).Info("Storage sync in progress", "subTaskRemain", len(t.SubTasks), "peerCount",
 			t.state.PeerCount, "progress", progress, "blobsSynced", t.state.BlobsSynced, "blobsToSync", t.state.BlobsToSync,
 			"timeUsed", common.PrettyDuration(time.Duration(t.state.SyncedSeconds)*time.Second), "etaTimeLeft", estTime)
 	}
@@ -1279,7 +4803,7 @@ func (s *SyncClient) reportFillEmptyState(duration uint64) {
 			estTime = common.PrettyDuration(time.Duration(etaSecondsLeft) * time.Second).String()
 		}
 
-		log.Info("Storage fill empty in progress", "shardId", t.ShardId, "subTaskRemain", len(t.SubEmptyTasks),
+		s.shardLogger(t.Contract, t.ShardId).Info("Storage fill empty in progress", "subTaskRemain", len(t.SubEmptyTasks),
 			"progress", progress, "emptyFilled", t.state.EmptyFilled, "emptyToFill", t.state.EmptyToFill, "timeUsed",
 			common.PrettyDuration(time.Duration(t.state.FillEmptySeconds)*time.Second), "etaTimeLeft", estTime)
 	}
@@ -1315,16 +4839,16 @@ func (s *SyncClient) needThisPeer(contractShards map[common.Address][]uint64) bo
 	}
 	for contract, shards := range contractShards {
 		for _, shard := range shards {
-			for _, t := range s.tasks {
+			for _, t := range append(slices.Clone(s.tasks), s.rangeTasks...) {
 				if t.Contract != contract || shard != t.ShardId {
 					continue
 				}
 
 				// when the peer and local node has overlap, the peer will be added to the sync client when
-				// - SyncClient peer count smaller than maxPeers; or
+				// - SyncClient peer count smaller than maxPeers (plus peersOvershoot before sync done); or
 				// - task peer count smaller than minPeersPerShard
 				// otherwise, the peer will be disconnected.
-				if len(s.peers) < s.maxPeers || t.state.PeerCount < s.minPeersPerShard {
+				if len(s.peers) < s.peerLimit() || t.state.PeerCount < s.minPeersPerShard {
 					return true
 				}
 			}
@@ -1334,10 +4858,19 @@ func (s *SyncClient) needThisPeer(contractShards map[common.Address][]uint64) bo
 	return false
 }
 
+// peerLimit returns the max number of peers, which allows peersOvershoot extra peers to grab more seeders
+// before sync done. The caller should hold the lock.
+func (s *SyncClient) peerLimit() int {
+	if s.syncDone || s.peersOvershoot <= 0 {
+		return s.maxPeers
+	}
+	return s.maxPeers + s.peersOvershoot
+}
+
 func (s *SyncClient) addPeerToTask(contractShards map[common.Address][]uint64) {
 	for contract, shards := range contractShards {
 		for _, shard := range shards {
-			for _, t := range s.tasks {
+			for _, t := range append(slices.Clone(s.tasks), s.rangeTasks...) {
 				if t.Contract == contract && shard == t.ShardId {
 					t.state.PeerCount++
 				}
@@ -1349,7 +4882,7 @@ func (s *SyncClient) addPeerToTask(contractShards map[common.Address][]uint64) {
 func (s *SyncClient) removePeerFromTask(contractShards map[common.Address][]uint64) {
 	for contract, shards := range contractShards {
 		for _, shard := range shards {
-			for _, t := range s.tasks {
+			for _, t := range append(slices.Clone(s.tasks), s.rangeTasks...) {
 				if t.Contract == contract && shard == t.ShardId {
 					t.state.PeerCount--
 				}
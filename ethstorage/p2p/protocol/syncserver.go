@@ -4,10 +4,13 @@
 package protocol
 
 import (
+	"bytes"
 	"context"
+	"encoding/binary"
 	"encoding/json"
 	"fmt"
-	"math"
+	"hash/crc32"
+	"slices"
 	"sync"
 	"time"
 
@@ -18,6 +21,7 @@ import (
 	"github.com/ethereum/go-ethereum/rlp"
 	"github.com/ethstorage/go-ethstorage/ethstorage"
 	"github.com/ethstorage/go-ethstorage/ethstorage/metrics"
+	prv "github.com/ethstorage/go-ethstorage/ethstorage/prover"
 	"github.com/ethstorage/go-ethstorage/ethstorage/rollup"
 	"github.com/hashicorp/golang-lru/v2/simplelru"
 	"github.com/libp2p/go-libp2p/core/network"
@@ -30,6 +34,7 @@ const (
 	returnCodeReadError
 	returnCodeInvalidRequest
 	returnCodeServerError
+	returnCodeServerBusy // too many requests are being served, the requester should back off
 )
 
 const (
@@ -44,6 +49,40 @@ const (
 
 	// maxRequestSize is the target maximum size of replies to data retrievals.
 	maxRequestSize = 8 * 1024 * 1024
+
+	// default deadlines to read the request from and write the response to a stream,
+	// so a peer stalls in the middle of the stream can not tie up a handler indefinitely.
+	defaultStreamReadTimeout  = 10 * time.Second
+	defaultStreamWriteTimeout = 30 * time.Second
+
+	// default max number of request handlers served concurrently, the excess ones wait in the queue
+	// and are rejected with returnCodeServerBusy after handlerQueueTimeout.
+	defaultMaxConcurrentHandlers = 64
+	handlerQueueTimeout          = 5 * time.Second
+
+	// default max number of request handlers waiting in the queue, so the streams of many requesters at the same
+	// time do not pile up goroutines and file descriptors; the excess ones are rejected at once.
+	defaultMaxQueuedHandlers = 128
+
+	// default max total size of the encoded blobs cached for serving hot blobs without reading the disk.
+	defaultBlobCacheSize = 32 * 1024 * 1024
+
+	// default max size of a frame of the streamed range responses, which holds an encoded blob and its metadata.
+	defaultMaxFrameSize = 1024 * 1024
+
+	// streamedWindowSize is the zstd window of the compressed streamed range responses, which bounds the memory of
+	// decompressing a response regardless of its size.
+	streamedWindowSize = 1024 * 1024
+
+	// default max decompressed size of a compressed range response, which is the default max response size plus
+	// the last blob crossing it and the metadata of the blobs.
+	defaultMaxDecodedSize = maxRequestSize + maxGossipSize
+
+	// chunkProofSize is the size of a chunk served with its KZG proof, which is a field element of the blob.
+	chunkProofSize = 32
+
+	// maxAvailabilityRange is the max number of blobs covered by an availability response, i.e. an 8KB bitmap.
+	maxAvailabilityRange = 64 * 1024
 )
 
 var (
@@ -61,22 +100,47 @@ type SyncServerMetrics interface {
 	ServerGetBlobsByListEvent(peerID string, resultCode byte, duration time.Duration)
 	ServerReadBlobs(peerID string, read, sucRead uint64, timeUse time.Duration)
 	ServerRecordTimeUsed(method string) func()
+	ServerBlobsServed(count, bytes uint64)
+	ServerBlobCacheLookup(hit bool)
+	ServerSetStreams(active, queued int)
 }
 
 type SyncServer struct {
-	cfg *rollup.EsConfig
+	cfg          *rollup.EsConfig
+	readTimeout  time.Duration
+	writeTimeout time.Duration
 
-	providedBlobs  map[uint64]uint64
-	storageManager StorageManagerReader
-	db             ethdb.Database
-	metrics        SyncServerMetrics
-	exitCh         chan struct{}
+	providedBlobs   map[uint64]uint64                       // blobs provided to peers by shard id of the primary contract
+	storageManager  StorageManagerReader                    // storage manager of the primary contract
+	storageManagers map[common.Address]StorageManagerReader // storage managers of all the served contracts, protected by lock
+	blobCache       *blobCache
+	maxResponseSize uint64          // max total size of the blobs in a response
+	maxFrameSize    uint64          // max size of a frame of the streamed range responses
+	bufPool         *blobBufferPool // buffers to encode the frames of the streamed range responses
+	db              ethdb.Database
+	metrics         SyncServerMetrics
+	exitCh          chan struct{}
 
 	peerRateLimits *simplelru.LRU[peer.ID, *peerStat]
 	peerStatsLock  sync.Mutex
 
 	globalRequestsRL *rate.Limiter
 
+	preferRange bool // advertise to peers that range requests are preferred to list requests
+
+	draining     bool           // reject new requests while draining, protected by lock
+	handlers     sync.WaitGroup // in-flight request handlers, only added to when not draining
+	handlerSlots chan struct{}  // semaphore limiting the request handlers served concurrently
+	queueTimeout time.Duration  // max time a request handler waits for a slot before being rejected
+	maxQueued    int            // max number of request handlers waiting for a slot, the excess ones are rejected
+	active       int            // request handlers holding a slot, protected by lock
+	queued       int            // request handlers waiting for a slot, protected by lock
+
+	prover     *prv.KZGProver // prover of the chunk proofs, created on the first chunk proof request
+	proverOnce sync.Once
+
+	commitIndexes map[common.Address]*commitIndex // kv indexes of the local blobs by commit of all the served contracts, protected by lock
+
 	lock sync.Mutex
 }
 
@@ -98,15 +162,50 @@ func NewSyncServer(cfg *rollup.EsConfig, storageManager StorageManagerReader, db
 		}
 	}
 
+	readTimeout, writeTimeout := defaultStreamReadTimeout, defaultStreamWriteTimeout
+	if cfg.StreamReadTimeout > 0 {
+		readTimeout = cfg.StreamReadTimeout
+	}
+	if cfg.StreamWriteTimeout > 0 {
+		writeTimeout = cfg.StreamWriteTimeout
+	}
+	maxHandlers := defaultMaxConcurrentHandlers
+	if cfg.MaxConcurrentHandlers > 0 {
+		maxHandlers = cfg.MaxConcurrentHandlers
+	}
+	maxQueued := defaultMaxQueuedHandlers
+	if cfg.MaxQueuedHandlers > 0 {
+		maxQueued = cfg.MaxQueuedHandlers
+	}
+	blobCacheSize := uint64(defaultBlobCacheSize)
+	if cfg.BlobCacheSize > 0 {
+		blobCacheSize = cfg.BlobCacheSize
+	}
+	maxResponseSize := uint64(maxRequestSize)
+	if cfg.MaxResponseSize > 0 {
+		maxResponseSize = cfg.MaxResponseSize
+	}
+
 	server := SyncServer{
 		cfg:              cfg,
+		readTimeout:      readTimeout,
+		writeTimeout:     writeTimeout,
 		storageManager:   storageManager,
+		storageManagers:  map[common.Address]StorageManagerReader{storageManager.ContractAddress(): storageManager},
+		blobCache:        newBlobCache(blobCacheSize),
+		commitIndexes:    map[common.Address]*commitIndex{storageManager.ContractAddress(): newCommitIndex()},
+		maxResponseSize:  maxResponseSize,
+		maxFrameSize:     frameSizeOf(cfg),
+		bufPool:          newBlobBufferPool(storageManager.MaxKvSize()),
 		db:               db,
 		providedBlobs:    make(map[uint64]uint64),
 		exitCh:           make(chan struct{}),
 		metrics:          m,
 		peerRateLimits:   peerRateLimits,
 		globalRequestsRL: globalRequestsRL,
+		handlerSlots:     make(chan struct{}, maxHandlers),
+		queueTimeout:     handlerQueueTimeout,
+		maxQueued:        maxQueued,
 	}
 
 	for _, shardId := range storageManager.Shards() {
@@ -118,10 +217,66 @@ func NewSyncServer(cfg *rollup.EsConfig, storageManager StorageManagerReader, db
 		}
 		server.providedBlobs[shardId] = 0
 	}
+	go server.indexLocalCommits(storageManager, server.commitIndexes[storageManager.ContractAddress()])
 	go server.SaveProvidedBlobs()
 	return &server
 }
 
+// AddContract adds the storage manager of another contract to serve, so the peers can sync the shards of all the
+// contracts from this node. The commits of the blobs of the added contract are indexed in the background to serve
+// them by commit, and the blobs provided are only counted for the primary contract.
+func (srv *SyncServer) AddContract(storageManager StorageManagerReader) error {
+	srv.lock.Lock()
+	defer srv.lock.Unlock()
+	contract := storageManager.ContractAddress()
+	if _, ok := srv.storageManagers[contract]; ok {
+		return fmt.Errorf("contract %s is already added", contract.Hex())
+	}
+	srv.storageManagers[contract] = storageManager
+	index := newCommitIndex()
+	srv.commitIndexes[contract] = index
+	go srv.indexLocalCommits(storageManager, index)
+	return nil
+}
+
+// storageManagerOf returns the storage manager of the contract, or nil if the contract is not served.
+func (srv *SyncServer) storageManagerOf(contract common.Address) StorageManagerReader {
+	srv.lock.Lock()
+	defer srv.lock.Unlock()
+	return srv.storageManagers[contract]
+}
+
+// commitIndexOf returns the commit index of the contract, or nil if the contract is not served.
+func (srv *SyncServer) commitIndexOf(contract common.Address) *commitIndex {
+	srv.lock.Lock()
+	defer srv.lock.Unlock()
+	return srv.commitIndexes[contract]
+}
+
+// sortedStorageManagers returns the storage managers of all the served contracts sorted by contract.
+func (srv *SyncServer) sortedStorageManagers() []StorageManagerReader {
+	srv.lock.Lock()
+	sms := make([]StorageManagerReader, 0, len(srv.storageManagers))
+	for _, sm := range srv.storageManagers {
+		sms = append(sms, sm)
+	}
+	srv.lock.Unlock()
+	slices.SortFunc(sms, func(a, b StorageManagerReader) int {
+		return bytes.Compare(a.ContractAddress().Bytes(), b.ContractAddress().Bytes())
+	})
+	return sms
+}
+
+// addProvidedBlobs counts the blobs of the shard provided to peers, only the blobs of the primary contract are counted.
+func (srv *SyncServer) addProvidedBlobs(contract common.Address, shardId uint64, count uint64) {
+	if contract != srv.storageManager.ContractAddress() {
+		return
+	}
+	srv.lock.Lock()
+	srv.providedBlobs[shardId] += count
+	srv.lock.Unlock()
+}
+
 // HandleGetBlobsByRangeRequest is a stream handler function to register the L2 unsafe payloads alt-sync protocol.
 // See MakeStreamHandler to transform this into a LibP2P handler function.
 //
@@ -129,38 +284,71 @@ func NewSyncServer(cfg *rollup.EsConfig, storageManager StorageManagerReader, db
 //
 // The caller must Close the stream.
 func (srv *SyncServer) HandleGetBlobsByRangeRequest(ctx context.Context, log log.Logger, stream network.Stream) {
+	srv.serveGetBlobsByRange(ctx, log, stream, false)
+}
+
+// HandleGetCompressedBlobsByRangeRequest is the same as HandleGetBlobsByRangeRequest, except the response payload
+// is compressed to save the bandwidth of the compressible blobs.
+func (srv *SyncServer) HandleGetCompressedBlobsByRangeRequest(ctx context.Context, log log.Logger, stream network.Stream) {
+	srv.serveGetBlobsByRange(ctx, log, stream, true)
+}
+
+func (srv *SyncServer) serveGetBlobsByRange(ctx context.Context, log log.Logger, stream network.Stream, compress bool) {
+	if !srv.beginHandle(log, stream) {
+		return
+	}
+	defer srv.endHandle()
+
 	// We wait as long as necessary; we throttle the peer instead of disconnecting,
 	// unless the delay reaches a threshold that is unreasonable to wait for.
 	ctx, cancel := context.WithTimeout(ctx, maxThrottleDelay)
 	start := time.Now()
-	returnCode, data, err := srv.handleGetBlobsByRangeRequest(ctx, stream)
+	returnCode, data, err := srv.handleGetBlobsByRangeRequest(ctx, log, stream)
 	srv.metrics.ServerGetBlobsByRangeEvent(stream.Conn().RemotePeer().String(), returnCode, time.Since(start))
 	cancel()
 
 	if err != nil {
 		log.Warn("Failed to serve p2p sync request", "err", err)
 	}
-	err = WriteMsg(stream, &Msg{returnCode, data})
+	// the payload is only read by the requester on success
+	if compress && returnCode == returnCodeSuccess {
+		if data, err = compressPayload(data); err != nil {
+			log.Warn("Failed to compress p2p sync response", "err", err)
+			returnCode, data = returnCodeServerError, []byte{}
+		}
+	}
+	// the compressed payload is written as is, as compressing it by snappy again only costs CPU
+	if compress && returnCode == returnCodeSuccess {
+		err = writeRawMsg(stream, &Msg{returnCode, data}, srv.writeTimeout)
+	} else {
+		err = writeMsg(stream, &Msg{returnCode, data}, srv.writeTimeout)
+	}
 	if err != nil {
 		log.Debug("write message fail", "err", err.Error())
 	} else {
-		log.Debug("Sent response for func HandleGetBlobsByRangeRequest", "returnCode", returnCode, "len(Bytes)", len(data), "peer", stream.Conn().RemotePeer().String())
+		log.Debug("Sent response for func HandleGetBlobsByRangeRequest", "returnCode", returnCode, "len(Bytes)", len(data),
+			"compressed", compress, "peer", stream.Conn().RemotePeer().String())
 	}
 }
 
 func (srv *SyncServer) HandleGetBlobsByListRequest(ctx context.Context, log log.Logger, stream network.Stream) {
+	if !srv.beginHandle(log, stream) {
+		return
+	}
+	defer srv.endHandle()
+
 	// We wait as long as necessary; we throttle the peer instead of disconnecting,
 	// unless the delay reaches a threshold that is unreasonable to wait for.
 	ctx, cancel := context.WithTimeout(ctx, maxThrottleDelay)
 	start := time.Now()
-	returnCode, data, err := srv.handleGetBlobsByListRequest(ctx, stream)
+	returnCode, data, err := srv.handleGetBlobsByListRequest(ctx, log, stream)
 	srv.metrics.ServerGetBlobsByListEvent(stream.Conn().RemotePeer().String(), returnCode, time.Since(start))
 	cancel()
 
 	if err != nil {
 		log.Warn("Failed to serve p2p sync request", "err", err)
 	}
-	err = WriteMsg(stream, &Msg{returnCode, data})
+	err = writeMsg(stream, &Msg{returnCode, data}, srv.writeTimeout)
 	if err != nil {
 		log.Debug("write message fail", "err", err.Error())
 	} else {
@@ -168,23 +356,89 @@ func (srv *SyncServer) HandleGetBlobsByListRequest(ctx context.Context, log log.
 	}
 }
 
-func (srv *SyncServer) handleGetBlobsByRangeRequest(ctx context.Context, stream network.Stream) (byte, []byte, error) {
-	peerID := stream.Conn().RemotePeer()
+// HandleGetChunkProofRequest serves a chunk of a blob with its KZG proof, so a light client can verify the chunk
+// against the commit of the blob without downloading the full blob.
+func (srv *SyncServer) HandleGetChunkProofRequest(ctx context.Context, log log.Logger, stream network.Stream) {
+	if !srv.beginHandle(log, stream) {
+		return
+	}
+	defer srv.endHandle()
+
+	ctx, cancel := context.WithTimeout(ctx, maxThrottleDelay)
+	returnCode, data, err := srv.handleGetChunkProofRequest(ctx, stream)
+	cancel()
 
-	err := srv.limitPeer(ctx, peerID)
 	if err != nil {
-		return returnCodeServerError, []byte{}, err
+		log.Warn("Failed to serve chunk proof request", "err", err)
+	}
+	err = writeMsg(stream, &Msg{returnCode, data}, srv.writeTimeout)
+	if err != nil {
+		log.Debug("write message fail", "err", err.Error())
+	} else {
+		log.Debug("Sent response for func HandleGetChunkProofRequest", "returnCode", returnCode, "peer", stream.Conn().RemotePeer().String())
 	}
+}
 
-	msg, _, err := ReadMsg(stream)
+func (srv *SyncServer) handleGetChunkProofRequest(ctx context.Context, stream network.Stream) (byte, []byte, error) {
+	err := srv.limitPeer(ctx, stream.Conn().RemotePeer())
+	if err != nil {
+		return returnCodeServerError, []byte{}, err
+	}
+	msg, _, err := readMsg(stream, srv.readTimeout)
 	if err != nil {
 		return returnCodeReadError, []byte{}, fmt.Errorf("read msg from stream fail: %w", err)
 	}
-
-	var req GetBlobsByRangePacket
+	var req GetChunkProofPacket
 	if err := rlp.DecodeBytes(msg, &req); err != nil {
 		return returnCodeInvalidRequest, []byte{}, fmt.Errorf("decode message fail, msg: %v, error: %v", common.Bytes2Hex(msg), err)
 	}
+	sm := srv.storageManagerOf(req.Contract)
+	if sm == nil {
+		return returnCodeInvalidRequest, []byte{}, fmt.Errorf("contract %s is not served", req.Contract.Hex())
+	}
+	if req.ChunkIdx >= sm.MaxKvSize()/chunkProofSize {
+		return returnCodeInvalidRequest, []byte{}, fmt.Errorf("chunk %d is out of blob", req.ChunkIdx)
+	}
+
+	payload, err := srv.blobByIndex(sm, req.KvIdx, int(sm.MaxKvSize()))
+	if err != nil {
+		return returnCodeServerError, []byte{}, fmt.Errorf("read blob %d fail: %w", req.KvIdx, err)
+	}
+	blob, success, err := sm.DecodeKV(req.KvIdx, payload.EncodedBlob, payload.BlobCommit,
+		payload.MinerAddress, payload.EncodeType)
+	if !success || err != nil {
+		return returnCodeServerError, []byte{}, fmt.Errorf("decode blob %d fail: %v", req.KvIdx, err)
+	}
+	srv.proverOnce.Do(func() {
+		srv.prover = prv.NewKZGProver(log.Root())
+	})
+	proof, err := srv.prover.GenerateKZGProof(blob, req.ChunkIdx)
+	if err != nil {
+		return returnCodeServerError, []byte{}, fmt.Errorf("generate proof of blob %d chunk %d fail: %w", req.KvIdx, req.ChunkIdx, err)
+	}
+
+	res := ChunkProofPacket{
+		KvIdx:    req.KvIdx,
+		ChunkIdx: req.ChunkIdx,
+		Commit:   payload.BlobCommit,
+		Chunk:    blob[req.ChunkIdx*chunkProofSize : (req.ChunkIdx+1)*chunkProofSize],
+		Proof:    proof,
+	}
+	data, err := rlp.EncodeToBytes(&res)
+	if err != nil {
+		return returnCodeServerError, []byte{}, fmt.Errorf("encode chunk proof fail: %w", err)
+	}
+	return returnCodeSuccess, data, nil
+}
+
+func (srv *SyncServer) handleGetBlobsByRangeRequest(ctx context.Context, log log.Logger, stream network.Stream) (byte, []byte, error) {
+	peerID := stream.Conn().RemotePeer()
+	req, sm, returnCode, err := srv.readBlobsByRangeRequest(ctx, stream)
+	if err != nil {
+		return returnCode, []byte{}, err
+	}
+
+	log = log.New("contract", req.Contract.Hex(), "shard", req.ShardId, "subTask", fmt.Sprintf("%d-%d", req.Origin, req.Limit))
 
 	res := BlobsByRangePacket{
 		ID:       req.ID,
@@ -192,11 +446,12 @@ func (srv *SyncServer) handleGetBlobsByRangeRequest(ctx context.Context, stream
 		ShardId:  req.ShardId,
 		Blobs:    make([]*BlobPayload, 0),
 	}
-	maxbytes := uint64(math.Min(maxRequestSize, float64(req.Bytes)))
+	maxbytes := srv.responseSize(req.Bytes)
+	readLen := rangeReadLen(sm, req)
 	read, sucRead, readBytes := uint64(0), uint64(0), uint64(0)
 	start := time.Now()
 	for id := req.Origin; id <= req.Limit; id++ {
-		payload, err := srv.BlobByIndex(id)
+		payload, err := srv.blobByIndex(sm, id, readLen)
 		read++
 		if err != nil {
 			log.Debug("Get blob fail", "id", id, "error", err.Error())
@@ -209,10 +464,13 @@ func (srv *SyncServer) handleGetBlobsByRangeRequest(ctx context.Context, stream
 			break
 		}
 	}
+	log.Trace("Read blobs for range request", "read", read, "found", sucRead, "bytes", readBytes)
 	srv.metrics.ServerReadBlobs(peerID.String(), read, sucRead, time.Since(start))
-	srv.lock.Lock()
-	srv.providedBlobs[req.ShardId] += uint64(len(res.Blobs))
-	srv.lock.Unlock()
+	srv.metrics.ServerBlobsServed(uint64(len(res.Blobs)), readBytes)
+	srv.addProvidedBlobs(req.Contract, req.ShardId, uint64(len(res.Blobs)))
+	if req.Checksum {
+		res.Checksum = blobsChecksum(res.Blobs)
+	}
 
 	recordDur := srv.metrics.ServerRecordTimeUsed("encodeResult")
 	data, err := rlp.EncodeToBytes(&res)
@@ -224,7 +482,189 @@ func (srv *SyncServer) handleGetBlobsByRangeRequest(ctx context.Context, stream
 	return returnCodeSuccess, data, nil
 }
 
-func (srv *SyncServer) handleGetBlobsByListRequest(ctx context.Context, stream network.Stream) (byte, []byte, error) {
+// HandleGetStreamedBlobsByRangeRequest is the same as HandleGetBlobsByRangeRequest, except the blobs are written to
+// the stream one by one in length prefixed frames once they are read, instead of being buffered for the whole response.
+func (srv *SyncServer) HandleGetStreamedBlobsByRangeRequest(ctx context.Context, log log.Logger, stream network.Stream) {
+	srv.serveStreamedBlobsByRange(ctx, log, stream, false)
+}
+
+// HandleGetCompressedStreamedBlobsByRangeRequest is the same as HandleGetStreamedBlobsByRangeRequest, except the
+// frames are compressed in a zstd stream to save the bandwidth of the compressible blobs.
+func (srv *SyncServer) HandleGetCompressedStreamedBlobsByRangeRequest(ctx context.Context, log log.Logger, stream network.Stream) {
+	srv.serveStreamedBlobsByRange(ctx, log, stream, true)
+}
+
+func (srv *SyncServer) serveStreamedBlobsByRange(ctx context.Context, log log.Logger, stream network.Stream, compress bool) {
+	if !srv.beginHandle(log, stream) {
+		return
+	}
+	defer srv.endHandle()
+
+	// We wait as long as necessary; we throttle the peer instead of disconnecting,
+	// unless the delay reaches a threshold that is unreasonable to wait for.
+	ctx, cancel := context.WithTimeout(ctx, maxThrottleDelay)
+	start := time.Now()
+	returnCode, sent, err := srv.streamBlobsByRange(ctx, log, stream, compress)
+	srv.metrics.ServerGetBlobsByRangeEvent(stream.Conn().RemotePeer().String(), returnCode, time.Since(start))
+	cancel()
+
+	if err != nil {
+		log.Warn("Failed to serve p2p sync request", "err", err)
+	} else {
+		log.Debug("Sent response for func HandleGetStreamedBlobsByRangeRequest", "returnCode", returnCode, "blobs", sent,
+			"peer", stream.Conn().RemotePeer().String())
+	}
+}
+
+// streamBlobsByRange serves the range request by writing each blob read to the stream in a frame, and returns the
+// number of the blobs sent. The return code is written before the blobs are read, so a failure afterward resets the
+// stream to signal the requester that the response is incomplete. The frames are compressed by zstd if compress is set.
+func (srv *SyncServer) streamBlobsByRange(ctx context.Context, log log.Logger, stream network.Stream, compress bool) (byte, uint64, error) {
+	peerID := stream.Conn().RemotePeer()
+	req, sm, returnCode, err := srv.readBlobsByRangeRequest(ctx, stream)
+	if err != nil {
+		if err := writeMsg(stream, &Msg{returnCode, []byte{}}, srv.writeTimeout); err != nil {
+			log.Debug("write message fail", "err", err.Error())
+		}
+		return returnCode, 0, err
+	}
+
+	log = log.New("contract", req.Contract.Hex(), "shard", req.ShardId, "subTask", fmt.Sprintf("%d-%d", req.Origin, req.Limit))
+
+	w, err := newFrameWriter(stream, compress)
+	if err != nil {
+		if err := writeMsg(stream, &Msg{returnCodeServerError, []byte{}}, srv.writeTimeout); err != nil {
+			log.Debug("write message fail", "err", err.Error())
+		}
+		return returnCodeServerError, 0, err
+	}
+	_ = stream.SetWriteDeadline(time.Now().Add(srv.writeTimeout))
+	if _, err := stream.Write([]byte{returnCodeSuccess}); err != nil {
+		return returnCodeSuccess, 0, fmt.Errorf("write return code fail: %w", err)
+	}
+	checksum := crc32.New(crc32cTable)
+	maxbytes := srv.responseSize(req.Bytes)
+	readLen := rangeReadLen(sm, req)
+	read, sucRead, readBytes := uint64(0), uint64(0), uint64(0)
+	start := time.Now()
+	for id := req.Origin; id <= req.Limit; id++ {
+		payload, err := srv.blobByIndex(sm, id, readLen)
+		read++
+		if err != nil {
+			log.Debug("Get blob fail", "id", id, "error", err.Error())
+			continue
+		}
+		frame, err := encodeFrame(payload, srv.bufPool)
+		if err != nil {
+			stream.Reset()
+			return returnCodeSuccess, sucRead, fmt.Errorf("failed to encode blob %d: %w", id, err)
+		}
+		if uint64(len(frame)) > srv.maxFrameSize {
+			// the blob is skipped as the requester rejects the frame, and it is requested again as the blobs missing
+			// in the response, e.g. from another peer
+			log.Warn("Skip the blob exceeding the max frame size", "id", id, "size", len(frame), "maxFrameSize", srv.maxFrameSize)
+			srv.bufPool.put(frame)
+			continue
+		}
+		// the deadline is extended for each frame, as the response is written while the blobs are read
+		_ = stream.SetWriteDeadline(time.Now().Add(srv.writeTimeout))
+		err = writeFrame(w, frame)
+		// the buffered writer copies the frame, so the buffer is returned once the frame is written
+		srv.bufPool.put(frame)
+		if err != nil {
+			stream.Reset()
+			return returnCodeSuccess, sucRead, fmt.Errorf("write blob %d fail: %w", id, err)
+		}
+		if err := w.Flush(); err != nil {
+			stream.Reset()
+			return returnCodeSuccess, sucRead, fmt.Errorf("write blob %d fail: %w", id, err)
+		}
+		writeBlobChecksum(checksum, payload)
+		sucRead++
+		readBytes += uint64(len(payload.EncodedBlob))
+		if readBytes >= maxbytes {
+			break
+		}
+	}
+	log.Trace("Streamed blobs for range request", "read", read, "found", sucRead, "bytes", readBytes)
+	srv.metrics.ServerReadBlobs(peerID.String(), read, sucRead, time.Since(start))
+	srv.metrics.ServerBlobsServed(sucRead, readBytes)
+	srv.addProvidedBlobs(req.Contract, req.ShardId, sucRead)
+
+	if err := writeFrame(w, nil); err != nil {
+		stream.Reset()
+		return returnCodeSuccess, sucRead, fmt.Errorf("write end frame fail: %w", err)
+	}
+	if req.Checksum {
+		var footer [4]byte
+		binary.BigEndian.PutUint32(footer[:], checksum.Sum32())
+		if _, err := w.Write(footer[:]); err != nil {
+			stream.Reset()
+			return returnCodeSuccess, sucRead, fmt.Errorf("write checksum footer fail: %w", err)
+		}
+	}
+	if err := closeFrameWriter(w); err != nil {
+		return returnCodeSuccess, sucRead, fmt.Errorf("failed to finishing writing payload to sync response: %w", err)
+	}
+	return returnCodeSuccess, sucRead, nil
+}
+
+// readBlobsByRangeRequest throttles the peer and reads the range request from the stream, and returns it with the
+// storage manager of the requested contract. The return code is only meaningful if an error is returned.
+func (srv *SyncServer) readBlobsByRangeRequest(ctx context.Context, stream network.Stream) (*GetBlobsByRangePacket, StorageManagerReader, byte, error) {
+	err := srv.limitPeer(ctx, stream.Conn().RemotePeer())
+	if err != nil {
+		return nil, nil, returnCodeServerError, err
+	}
+
+	msg, _, err := readMsg(stream, srv.readTimeout)
+	if err != nil {
+		return nil, nil, returnCodeReadError, fmt.Errorf("read msg from stream fail: %w", err)
+	}
+
+	var req GetBlobsByRangePacket
+	if err := rlp.DecodeBytes(msg, &req); err != nil {
+		return nil, nil, returnCodeInvalidRequest, fmt.Errorf("decode message fail, msg: %v, error: %v", common.Bytes2Hex(msg), err)
+	}
+	sm := srv.storageManagerOf(req.Contract)
+	if sm == nil {
+		return nil, nil, returnCodeInvalidRequest, fmt.Errorf("contract %s is not served", req.Contract.Hex())
+	}
+	return &req, sm, returnCodeSuccess, nil
+}
+
+// rangeReadLen returns the bytes to read of each encoded blob of sm for the range request.
+func rangeReadLen(sm StorageManagerReader, req *GetBlobsByRangePacket) int {
+	readLen := sm.MaxKvSize()
+	if req.MaxBytesPerBlob > 0 && req.MaxBytesPerBlob < readLen {
+		readLen = req.MaxBytesPerBlob
+	}
+	return int(readLen)
+}
+
+// responseSize returns the size at which to stop adding blobs to a response, capped by maxResponseSize.
+func (srv *SyncServer) responseSize(requested uint64) uint64 {
+	return min(srv.maxResponseSize, requested)
+}
+
+// frameSizeOf returns the max frame size of the streamed range responses of the config.
+func frameSizeOf(cfg *rollup.EsConfig) uint64 {
+	if cfg.MaxFrameSize > 0 {
+		return cfg.MaxFrameSize
+	}
+	return defaultMaxFrameSize
+}
+
+// maxDecodedSizeOf returns the max decompressed size of the compressed range responses of the config, which is the
+// max response size plus maxGossipSize for the last blob crossing it and the metadata of the blobs.
+func maxDecodedSizeOf(cfg *rollup.EsConfig) uint64 {
+	if cfg.MaxResponseSize > 0 {
+		return cfg.MaxResponseSize + maxGossipSize
+	}
+	return defaultMaxDecodedSize
+}
+
+func (srv *SyncServer) handleGetBlobsByListRequest(ctx context.Context, log log.Logger, stream network.Stream) (byte, []byte, error) {
 	peerID := stream.Conn().RemotePeer()
 
 	err := srv.limitPeer(ctx, peerID)
@@ -232,7 +672,7 @@ func (srv *SyncServer) handleGetBlobsByListRequest(ctx context.Context, stream n
 		return returnCodeServerError, []byte{}, err
 	}
 
-	msg, _, err := ReadMsg(stream)
+	msg, _, err := readMsg(stream, srv.readTimeout)
 	if err != nil {
 		return returnCodeReadError, []byte{}, fmt.Errorf("read msg from stream fail: %w", err)
 	}
@@ -241,6 +681,12 @@ func (srv *SyncServer) handleGetBlobsByListRequest(ctx context.Context, stream n
 	if err := rlp.DecodeBytes(msg, &req); err != nil {
 		return returnCodeInvalidRequest, []byte{}, fmt.Errorf("decode message fail, msg: %v, error: %v", common.Bytes2Hex(msg), err)
 	}
+	sm := srv.storageManagerOf(req.Contract)
+	if sm == nil {
+		return returnCodeInvalidRequest, []byte{}, fmt.Errorf("contract %s is not served", req.Contract.Hex())
+	}
+
+	log = log.New("contract", req.Contract.Hex(), "shard", req.ShardId)
 
 	res := BlobsByListPacket{
 		ID:       req.ID,
@@ -248,11 +694,11 @@ func (srv *SyncServer) handleGetBlobsByListRequest(ctx context.Context, stream n
 		ShardId:  req.ShardId,
 		Blobs:    make([]*BlobPayload, 0),
 	}
-	maxbytes := uint64(math.Min(maxRequestSize, float64(req.Bytes)))
+	maxbytes := srv.responseSize(req.Bytes)
 	read, sucRead, readBytes := uint64(0), uint64(0), uint64(0)
 	start := time.Now()
 	for _, idx := range req.BlobList {
-		payload, err := srv.BlobByIndex(idx)
+		payload, err := srv.blobByIndex(sm, idx, int(sm.MaxKvSize()))
 		read++
 		if err != nil {
 			log.Debug("Get blob fail", "idx", idx, "error", err.Error())
@@ -265,10 +711,13 @@ func (srv *SyncServer) handleGetBlobsByListRequest(ctx context.Context, stream n
 			break
 		}
 	}
+	log.Trace("Read blobs for list request", "read", read, "found", sucRead, "bytes", readBytes)
 	srv.metrics.ServerReadBlobs(peerID.String(), read, sucRead, time.Since(start))
-	srv.lock.Lock()
-	srv.providedBlobs[req.ShardId] += uint64(len(res.Blobs))
-	srv.lock.Unlock()
+	srv.metrics.ServerBlobsServed(uint64(len(res.Blobs)), readBytes)
+	srv.addProvidedBlobs(req.Contract, req.ShardId, uint64(len(res.Blobs)))
+	if req.Checksum {
+		res.Checksum = blobsChecksum(res.Blobs)
+	}
 
 	recordDur := srv.metrics.ServerRecordTimeUsed("encodeResult")
 	data, err := rlp.EncodeToBytes(&res)
@@ -280,6 +729,161 @@ func (srv *SyncServer) handleGetBlobsByListRequest(ctx context.Context, stream n
 	return returnCodeSuccess, data, nil
 }
 
+// HandleGetBlobsByCommitRequest serves the blobs of the requested commits, so a client can fetch a blob by its
+// commit without the kv index. The commits not found locally are omitted from the response.
+func (srv *SyncServer) HandleGetBlobsByCommitRequest(ctx context.Context, log log.Logger, stream network.Stream) {
+	if !srv.beginHandle(log, stream) {
+		return
+	}
+	defer srv.endHandle()
+
+	ctx, cancel := context.WithTimeout(ctx, maxThrottleDelay)
+	returnCode, data, err := srv.handleGetBlobsByCommitRequest(ctx, log, stream)
+	cancel()
+
+	if err != nil {
+		log.Warn("Failed to serve blobs by commit request", "err", err)
+	}
+	err = writeMsg(stream, &Msg{returnCode, data}, srv.writeTimeout)
+	if err != nil {
+		log.Debug("write message fail", "err", err.Error())
+	} else {
+		log.Debug("Sent response for func HandleGetBlobsByCommitRequest", "returnCode", returnCode, "peer", stream.Conn().RemotePeer().String())
+	}
+}
+
+func (srv *SyncServer) handleGetBlobsByCommitRequest(ctx context.Context, log log.Logger, stream network.Stream) (byte, []byte, error) {
+	peerID := stream.Conn().RemotePeer()
+	err := srv.limitPeer(ctx, peerID)
+	if err != nil {
+		return returnCodeServerError, []byte{}, err
+	}
+	msg, _, err := readMsg(stream, srv.readTimeout)
+	if err != nil {
+		return returnCodeReadError, []byte{}, fmt.Errorf("read msg from stream fail: %w", err)
+	}
+	var req GetBlobsByCommitPacket
+	if err := rlp.DecodeBytes(msg, &req); err != nil {
+		return returnCodeInvalidRequest, []byte{}, fmt.Errorf("decode message fail, msg: %v, error: %v", common.Bytes2Hex(msg), err)
+	}
+	sm, index := srv.storageManagerOf(req.Contract), srv.commitIndexOf(req.Contract)
+	if sm == nil || index == nil {
+		return returnCodeInvalidRequest, []byte{}, fmt.Errorf("contract %s is not served", req.Contract.Hex())
+	}
+
+	res := BlobsByCommitPacket{
+		ID:       req.ID,
+		Contract: req.Contract,
+		Blobs:    make([]*BlobPayload, 0),
+	}
+	maxbytes := srv.responseSize(req.Bytes)
+	read, sucRead, readBytes := uint64(0), uint64(0), uint64(0)
+	start := time.Now()
+	for _, commit := range req.Commits {
+		// a blob stored at several kv indexes is served from the first readable one
+		for _, idx := range index.lookup(commit) {
+			payload, err := srv.blobByIndex(sm, idx, int(sm.MaxKvSize()))
+			read++
+			if err != nil {
+				log.Debug("Get blob fail", "idx", idx, "error", err.Error())
+				continue
+			}
+			if !bytes.Equal(payload.BlobCommit[:ethstorage.HashSizeInContract], commit[:ethstorage.HashSizeInContract]) {
+				// overwritten after looked up
+				continue
+			}
+			sucRead++
+			res.Blobs = append(res.Blobs, payload)
+			readBytes += uint64(len(payload.EncodedBlob))
+			break
+		}
+		if readBytes >= maxbytes {
+			break
+		}
+	}
+	log.Trace("Read blobs for commit request", "commits", len(req.Commits), "found", sucRead, "bytes", readBytes)
+	srv.metrics.ServerReadBlobs(peerID.String(), read, sucRead, time.Since(start))
+	srv.metrics.ServerBlobsServed(uint64(len(res.Blobs)), readBytes)
+
+	data, err := rlp.EncodeToBytes(&res)
+	if err != nil {
+		return returnCodeServerError, []byte{}, fmt.Errorf("failed to write payload to sync response: %w", err)
+	}
+	return returnCodeSuccess, data, nil
+}
+
+// HandleGetAvailabilityRequest serves the bitmap of the blobs held locally in the requested range of a shard, so a
+// client can request the blobs only from the peers holding them. The range is clamped to the shard and
+// maxAvailabilityRange, and the blobs not synced yet are not held.
+func (srv *SyncServer) HandleGetAvailabilityRequest(ctx context.Context, log log.Logger, stream network.Stream) {
+	if !srv.beginHandle(log, stream) {
+		return
+	}
+	defer srv.endHandle()
+
+	ctx, cancel := context.WithTimeout(ctx, maxThrottleDelay)
+	returnCode, data, err := srv.handleGetAvailabilityRequest(ctx, stream)
+	cancel()
+
+	if err != nil {
+		log.Warn("Failed to serve availability request", "err", err)
+	}
+	err = writeMsg(stream, &Msg{returnCode, data}, srv.writeTimeout)
+	if err != nil {
+		log.Debug("write message fail", "err", err.Error())
+	} else {
+		log.Debug("Sent response for func HandleGetAvailabilityRequest", "returnCode", returnCode, "peer", stream.Conn().RemotePeer().String())
+	}
+}
+
+func (srv *SyncServer) handleGetAvailabilityRequest(ctx context.Context, stream network.Stream) (byte, []byte, error) {
+	err := srv.limitPeer(ctx, stream.Conn().RemotePeer())
+	if err != nil {
+		return returnCodeServerError, []byte{}, err
+	}
+	msg, _, err := readMsg(stream, srv.readTimeout)
+	if err != nil {
+		return returnCodeReadError, []byte{}, fmt.Errorf("read msg from stream fail: %w", err)
+	}
+	var req GetAvailabilityPacket
+	if err := rlp.DecodeBytes(msg, &req); err != nil {
+		return returnCodeInvalidRequest, []byte{}, fmt.Errorf("decode message fail, msg: %v, error: %v", common.Bytes2Hex(msg), err)
+	}
+	sm := srv.storageManagerOf(req.Contract)
+	if sm == nil {
+		return returnCodeInvalidRequest, []byte{}, fmt.Errorf("contract %s is not served", req.Contract.Hex())
+	}
+	kvEntries := sm.KvEntries()
+	if req.Origin > req.Limit || req.Origin/kvEntries != req.ShardId {
+		return returnCodeInvalidRequest, []byte{}, fmt.Errorf("invalid range %d-%d of shard %d", req.Origin, req.Limit, req.ShardId)
+	}
+
+	limit := min(req.Limit, (req.ShardId+1)*kvEntries-1, req.Origin+maxAvailabilityRange-1)
+	res := AvailabilityPacket{
+		ID:       req.ID,
+		Contract: req.Contract,
+		ShardId:  req.ShardId,
+		Origin:   req.Origin,
+		Limit:    limit,
+		Bitmap:   newAvailabilityBitmap(limit - req.Origin + 1),
+	}
+	if slices.Contains(sm.Shards(), req.ShardId) {
+		for idx := req.Origin; idx <= limit; idx++ {
+			// the same check as serving the blobs, so the empty filled kvs are not counted as held
+			meta, ok, err := sm.TryReadMeta(idx)
+			if ok && err == nil && ethstorage.IsBlobSynced(common.BytesToHash(meta)) {
+				res.Bitmap.set(idx - req.Origin)
+			}
+		}
+	}
+
+	data, err := rlp.EncodeToBytes(&res)
+	if err != nil {
+		return returnCodeServerError, []byte{}, fmt.Errorf("failed to write payload to sync response: %w", err)
+	}
+	return returnCodeSuccess, data, nil
+}
+
 func (srv *SyncServer) limitPeer(ctx context.Context, peerId peer.ID) error {
 	// take a token from the global rate-limiter,
 	// to make sure there's not too much concurrent server work between different peers.
@@ -311,25 +915,28 @@ func (srv *SyncServer) limitPeer(ctx context.Context, peerId peer.ID) error {
 	return nil
 }
 
+// BlobByIndex reads the blob at idx of the primary contract.
 func (srv *SyncServer) BlobByIndex(idx uint64) (*BlobPayload, error) {
+	return srv.blobByIndex(srv.storageManager, idx, int(srv.storageManager.MaxKvSize()))
+}
+
+// blobByIndex reads the first readLen bytes of the encoded blob at idx of sm.
+func (srv *SyncServer) blobByIndex(sm StorageManagerReader, idx uint64, readLen int) (*BlobPayload, error) {
 	recordDur := srv.metrics.ServerRecordTimeUsed("readBlobByIndex")
 	defer recordDur()
 
-	shardIdx := idx / srv.storageManager.KvEntries()
-	blob, found, err := srv.storageManager.TryReadEncoded(idx, int(srv.storageManager.MaxKvSize()))
+	shardIdx := idx / sm.KvEntries()
+	blob, err := srv.readEncoded(sm, idx, readLen)
 	if err != nil {
 		return nil, err
 	}
-	if !found {
-		return nil, ethereum.NotFound
-	}
-	commit, _, err := srv.storageManager.TryReadMeta(idx)
+	commit, _, err := sm.TryReadMeta(idx)
 	if err != nil {
 		return nil, err
 	}
 
-	miner, _ := srv.storageManager.GetShardMiner(shardIdx)
-	encodeType, _ := srv.storageManager.GetShardEncodeType(shardIdx)
+	miner, _ := sm.GetShardMiner(shardIdx)
+	encodeType, _ := sm.GetShardEncodeType(shardIdx)
 	return &BlobPayload{
 		MinerAddress: miner,
 		BlobIndex:    idx,
@@ -339,7 +946,97 @@ func (srv *SyncServer) BlobByIndex(idx uint64) (*BlobPayload, error) {
 	}, nil
 }
 
+// readEncoded reads the first readLen bytes of the encoded blob at idx of sm through the blob cache. Only the full
+// blobs are cached, so a prefix read is served from the cache if the full blob is cached, or from disk otherwise.
+func (srv *SyncServer) readEncoded(sm StorageManagerReader, idx uint64, readLen int) ([]byte, error) {
+	key := blobCacheKey{contract: sm.ContractAddress(), kvIdx: idx}
+	blob, gen, hit := srv.blobCache.get(key)
+	srv.metrics.ServerBlobCacheLookup(hit)
+	if hit && readLen <= len(blob) {
+		return blob[:readLen], nil
+	}
+
+	blob, found, err := sm.TryReadEncoded(idx, readLen)
+	if err != nil {
+		return nil, err
+	}
+	if !found {
+		return nil, ethereum.NotFound
+	}
+	if uint64(readLen) == sm.MaxKvSize() {
+		srv.blobCache.add(key, blob, gen)
+	}
+	return blob, nil
+}
+
+// InvalidateBlobs removes the blobs at kvIndices of the primary contract from the blob cache, it must be called
+// after the blobs are overwritten in the local storage so the stale blobs are not served to peers.
+func (srv *SyncServer) InvalidateBlobs(kvIndices []uint64) {
+	srv.InvalidateContractBlobs(srv.storageManager.ContractAddress(), kvIndices)
+}
+
+// InvalidateContractBlobs is the same as InvalidateBlobs for the blobs of the contract.
+func (srv *SyncServer) InvalidateContractBlobs(contract common.Address, kvIndices []uint64) {
+	srv.blobCache.invalidate(contract, kvIndices)
+}
+
+// BlobWritten removes the stale blob written at kvIdx of the primary contract from the blob cache and indexes its
+// commit, it should be registered to ethstorage.StorageManager.OnBlobWritten so the blobs written after the server
+// is created are served fresh and by commit.
+func (srv *SyncServer) BlobWritten(kvIdx uint64, commit common.Hash, empty bool) {
+	srv.ContractBlobWritten(srv.storageManager.ContractAddress(), kvIdx, commit, empty)
+}
+
+// ContractBlobWritten is the same as BlobWritten for the blob written at kvIdx of the contract.
+func (srv *SyncServer) ContractBlobWritten(contract common.Address, kvIdx uint64, commit common.Hash, empty bool) {
+	srv.InvalidateContractBlobs(contract, []uint64{kvIdx})
+	srv.IndexContractBlob(contract, kvIdx, commit, empty)
+}
+
+// IndexBlob updates the commit of the blob written at kvIdx of the primary contract in the commit index.
+func (srv *SyncServer) IndexBlob(kvIdx uint64, commit common.Hash, empty bool) {
+	srv.IndexContractBlob(srv.storageManager.ContractAddress(), kvIdx, commit, empty)
+}
+
+// IndexContractBlob is the same as IndexBlob for the blob written at kvIdx of the contract, the blobs of the
+// contracts not served are ignored.
+func (srv *SyncServer) IndexContractBlob(contract common.Address, kvIdx uint64, commit common.Hash, empty bool) {
+	if index := srv.commitIndexOf(contract); index != nil {
+		index.update(kvIdx, commit)
+	}
+}
+
+// indexLocalCommits indexes the commits of the blobs of sm below the last kv index in the local shards, it runs in
+// the background once the contract is served, and the blobs not indexed yet are omitted from the responses by commit.
+func (srv *SyncServer) indexLocalCommits(sm StorageManagerReader, index *commitIndex) {
+	defer close(index.indexed)
+	readCommit := func(kvIdx uint64) (common.Hash, bool) {
+		meta, found, err := sm.TryReadMeta(kvIdx)
+		if err != nil || !found {
+			return common.Hash{}, false
+		}
+		return common.BytesToHash(meta), true
+	}
+	kvEntries, lastKvIndex := sm.KvEntries(), sm.LastKvIndex()
+	for _, shardId := range sm.Shards() {
+		first, limit := shardId*kvEntries, min((shardId+1)*kvEntries, lastKvIndex)
+		for kvIdx := first; kvIdx < limit; kvIdx++ {
+			select {
+			case <-srv.exitCh:
+				return
+			default:
+			}
+			index.fill(kvIdx, readCommit)
+		}
+	}
+}
+
 func (srv *SyncServer) HandleRequestShardList(ctx context.Context, log log.Logger, stream network.Stream) {
+	if !srv.beginHandle(log, stream) {
+		return
+	}
+	defer srv.endHandle()
+
 	rCode := byte(0)
 	bs, err := rlp.EncodeToBytes(ConvertToContractShards(ethstorage.Shards()))
 	if err != nil {
@@ -347,13 +1044,117 @@ func (srv *SyncServer) HandleRequestShardList(ctx context.Context, log log.Logge
 		rCode = returnCodeServerError
 	}
 
-	err = WriteMsg(stream, &Msg{rCode, bs})
+	err = writeMsg(stream, &Msg{rCode, bs}, srv.writeTimeout)
 	if err != nil {
 		log.Warn("Write response failed for HandleRequestShardList", "err", err.Error())
 	}
 	log.Debug("Write response done for HandleRequestShardList")
 }
 
+func (srv *SyncServer) HandleRequestLastKvIndex(ctx context.Context, log log.Logger, stream network.Stream) {
+	if !srv.beginHandle(log, stream) {
+		return
+	}
+	defer srv.endHandle()
+
+	rCode := byte(0)
+	bs, err := rlp.EncodeToBytes(srv.lastKvIndexes())
+	if err != nil {
+		log.Warn("Encode last kv index fail", "err", err.Error())
+		rCode = returnCodeServerError
+	}
+
+	err = writeMsg(stream, &Msg{rCode, bs}, srv.writeTimeout)
+	if err != nil {
+		log.Warn("Write response failed for HandleRequestLastKvIndex", "err", err.Error())
+	}
+	log.Debug("Write response done for HandleRequestLastKvIndex")
+}
+
+// lastKvIndexes returns the last kv indexes of all the served contracts.
+func (srv *SyncServer) lastKvIndexes() []*ContractLastKvIndex {
+	indexes := make([]*ContractLastKvIndex, 0)
+	for _, sm := range srv.sortedStorageManagers() {
+		indexes = append(indexes, &ContractLastKvIndex{Contract: sm.ContractAddress(), LastKvIndex: sm.LastKvIndex()})
+	}
+	return indexes
+}
+
+// HandlePing replies to the ping of the keep-alive of a peer. It is not limited by the max concurrent handlers, as
+// it is cheap to serve and should not be delayed by the sync requests.
+func (srv *SyncServer) HandlePing(ctx context.Context, log log.Logger, stream network.Stream) {
+	if err := writeMsg(stream, &Msg{returnCodeSuccess, []byte{}}, srv.writeTimeout); err != nil {
+		log.Warn("Write response failed for HandlePing", "err", err.Error())
+	}
+	log.Trace("Write response done for HandlePing")
+}
+
+// SetPreferRange sets whether to advertise to peers that range requests are preferred, as the sequential
+// IO of range requests is cheaper to serve than the scattered IO of list requests.
+func (srv *SyncServer) SetPreferRange(prefer bool) {
+	srv.lock.Lock()
+	defer srv.lock.Unlock()
+	srv.preferRange = prefer
+}
+
+// shardEncodeTypes returns the encode types of the local shards of all the served contracts advertised in the
+// capabilities.
+func (srv *SyncServer) shardEncodeTypes() []*ShardEncodeType {
+	encodeTypes := make([]*ShardEncodeType, 0)
+	for _, sm := range srv.sortedStorageManagers() {
+		for _, shardId := range sm.Shards() {
+			if encodeType, ok := sm.GetShardEncodeType(shardId); ok {
+				encodeTypes = append(encodeTypes, &ShardEncodeType{
+					Contract:   sm.ContractAddress(),
+					ShardId:    shardId,
+					EncodeType: encodeType,
+				})
+			}
+		}
+	}
+	return encodeTypes
+}
+
+// HandleRequestCapabilities replies the features of the sync protocol served by this node to the capabilities
+// handshake of a peer.
+func (srv *SyncServer) HandleRequestCapabilities(ctx context.Context, log log.Logger, stream network.Stream) {
+	if !srv.beginHandle(log, stream) {
+		return
+	}
+	defer srv.endHandle()
+
+	rCode := byte(0)
+	bs, err := rlp.EncodeToBytes(srv.capabilities())
+	if err != nil {
+		log.Warn("Encode capabilities fail", "err", err.Error())
+		rCode = returnCodeServerError
+	}
+
+	err = writeMsg(stream, &Msg{rCode, bs}, srv.writeTimeout)
+	if err != nil {
+		log.Warn("Write response failed for HandleRequestCapabilities", "err", err.Error())
+	}
+	log.Debug("Write response done for HandleRequestCapabilities")
+}
+
+// capabilities returns the features of the sync protocol served by this node.
+func (srv *SyncServer) capabilities() *Capabilities {
+	caps := &Capabilities{
+		Version:       syncProtocolVersion,
+		Compression:   make([]string, 0),
+		EncodeTypes:   srv.shardEncodeTypes(),
+		Checksum:      true,
+		LastKvIndexes: srv.lastKvIndexes(),
+	}
+	if srv.cfg.CompressionEnabled {
+		caps.Compression = append(caps.Compression, compressionZstd)
+	}
+	srv.lock.Lock()
+	caps.PreferRange = srv.preferRange
+	srv.lock.Unlock()
+	return caps
+}
+
 func (srv *SyncServer) saveProvidedBlobs() {
 	srv.lock.Lock()
 	states, err := json.Marshal(srv.providedBlobs)
@@ -384,6 +1185,87 @@ func (srv *SyncServer) SaveProvidedBlobs() {
 	}
 }
 
+// beginHandle registers an in-flight request handler and waits for a free handler slot, the caller must call
+// srv.endHandle() when the handler finishes. It returns false and resets the stream if the server is draining,
+// or responds returnCodeServerBusy if the queue is full or no slot is freed in time, so the requester backs off.
+func (srv *SyncServer) beginHandle(log log.Logger, stream network.Stream) bool {
+	srv.lock.Lock()
+	if srv.draining {
+		srv.lock.Unlock()
+		log.Debug("Reject request as sync server is draining", "protocol", stream.Protocol())
+		stream.Reset()
+		return false
+	}
+	if srv.queued >= srv.maxQueued {
+		srv.lock.Unlock()
+		log.Debug("Reject request as too many requests are queued", "protocol", stream.Protocol())
+		srv.respondBusy(log, stream)
+		return false
+	}
+	srv.handlers.Add(1)
+	srv.queued++
+	srv.metrics.ServerSetStreams(srv.active, srv.queued)
+	srv.lock.Unlock()
+
+	timer := time.NewTimer(srv.queueTimeout)
+	defer timer.Stop()
+	select {
+	case srv.handlerSlots <- struct{}{}:
+		srv.lock.Lock()
+		srv.queued--
+		srv.active++
+		srv.metrics.ServerSetStreams(srv.active, srv.queued)
+		srv.lock.Unlock()
+		return true
+	case <-timer.C:
+		srv.lock.Lock()
+		srv.queued--
+		srv.metrics.ServerSetStreams(srv.active, srv.queued)
+		srv.lock.Unlock()
+		srv.handlers.Done()
+		log.Debug("Reject request as too many requests are being served", "protocol", stream.Protocol())
+		srv.respondBusy(log, stream)
+		return false
+	}
+}
+
+// endHandle releases the handler slot and unregisters the request handler.
+func (srv *SyncServer) endHandle() {
+	srv.lock.Lock()
+	srv.active--
+	srv.metrics.ServerSetStreams(srv.active, srv.queued)
+	srv.lock.Unlock()
+	<-srv.handlerSlots
+	srv.handlers.Done()
+}
+
+// respondBusy responds returnCodeServerBusy to a request rejected for the handler slots.
+func (srv *SyncServer) respondBusy(log log.Logger, stream network.Stream) {
+	if err := writeMsg(stream, &Msg{returnCodeServerBusy, []byte{}}, srv.writeTimeout); err != nil {
+		log.Debug("write message fail", "err", err.Error())
+	}
+}
+
+// Drain stops accepting new requests and waits for the in-flight request handlers to finish, so that the
+// responses are not truncated when the host closes. It returns the context error if the context is done first.
+func (srv *SyncServer) Drain(ctx context.Context) error {
+	srv.lock.Lock()
+	srv.draining = true
+	srv.lock.Unlock()
+
+	done := make(chan struct{})
+	go func() {
+		srv.handlers.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
 func (srv *SyncServer) Close() {
 	close(srv.exitCh)
 	srv.saveProvidedBlobs()
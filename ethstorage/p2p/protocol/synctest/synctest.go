@@ -0,0 +1,336 @@
+// Copyright 2022-2023, EthStorage.
+// For license information, see https://github.com/ethstorage/es-node/blob/main/LICENSE
+
+// Package synctest provides an in-process cluster of a sync client and the sync servers of its peers on the loopback
+// network, serving the synthetic blobs of a synthetic contract, for the integration tests of the packages built on
+// the sync protocol.
+package synctest
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math/big"
+	"os"
+	"path/filepath"
+	"slices"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/core/rawdb"
+	"github.com/ethereum/go-ethereum/event"
+	"github.com/ethereum/go-ethereum/log"
+	"github.com/ethstorage/go-ethstorage/ethstorage"
+	"github.com/ethstorage/go-ethstorage/ethstorage/p2p/protocol"
+	prv "github.com/ethstorage/go-ethstorage/ethstorage/prover"
+	"github.com/ethstorage/go-ethstorage/ethstorage/rollup"
+	"github.com/libp2p/go-libp2p"
+	"github.com/libp2p/go-libp2p/core/host"
+	"github.com/libp2p/go-libp2p/core/network"
+	"github.com/libp2p/go-libp2p/core/peer"
+)
+
+const (
+	// KvSize is the size of the synthetic blobs, which is the size of an EIP-4844 blob to get the KZG roots.
+	KvSize = 4096 * 32
+	// KvEntries is the number of the synthetic blobs of a shard.
+	KvEntries = 16
+)
+
+// Contract is the synthetic contract of the cluster, which is registered to ethstorage.ContractToShardManager until
+// the cluster is closed.
+var Contract = common.HexToAddress("0x000000000000000000000000000000005e1c7e57")
+
+// l1Source serves the metas of the synthetic blobs to the storage managers of the cluster.
+type l1Source struct {
+	metas [][32]byte
+}
+
+func (l1 *l1Source) GetKvMetas(kvIndices []uint64, blockNumber int64) ([][32]byte, error) {
+	metas := make([][32]byte, 0, len(kvIndices))
+	for _, idx := range kvIndices {
+		if idx >= uint64(len(l1.metas)) {
+			return nil, fmt.Errorf("kv index %d out of range", idx)
+		}
+		metas = append(metas, l1.metas[idx])
+	}
+	return metas, nil
+}
+
+func (l1 *l1Source) GetStorageLastBlobIdx(blockNumber int64) (uint64, error) {
+	return uint64(len(l1.metas)), nil
+}
+
+// Peer is a remote peer of the cluster, which serves the synthetic blobs of its shards by a sync server.
+type Peer struct {
+	Host    host.Host
+	Server  *protocol.SyncServer
+	Storage *ethstorage.StorageManager
+	Shards  []uint64
+}
+
+// Cluster is a sync client with an empty storage of its shards and the remote peers serving the synthetic blobs,
+// all connected by the loopback network in process.
+type Cluster struct {
+	Config  *rollup.EsConfig
+	Params  *protocol.SyncerParams
+	Host    host.Host
+	Client  *protocol.SyncClient
+	Storage *ethstorage.StorageManager
+	Shards  []uint64
+	Peers   []*Peer
+
+	// Blobs are the synthetic blobs of all the shards indexed by the kv index, and Roots are their KZG roots.
+	Blobs [][]byte
+	Roots []common.Hash
+
+	feed   *event.Feed
+	ctx    context.Context
+	cancel context.CancelFunc
+	dir    string
+}
+
+// NewInMemoryCluster creates a cluster of a sync client syncing the shards to an empty storage and a remote peer
+// serving the synthetic blobs of each of the peer shards. The blobs are generated for the shards up to the max shard
+// of the client and the peers, and the remote peers listen on the loopback network but are not connected to the
+// client until Start is called.
+// The cluster must be closed once it is done.
+func NewInMemoryCluster(shards []uint64, peers ...[]uint64) (*Cluster, error) {
+	if len(shards) == 0 {
+		return nil, errors.New("no shard to sync")
+	}
+	maxShard := slices.Max(shards)
+	for _, ss := range peers {
+		if len(ss) > 0 {
+			maxShard = max(maxShard, slices.Max(ss))
+		}
+	}
+	dir, err := os.MkdirTemp("", "es-node-synctest")
+	if err != nil {
+		return nil, err
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	c := &Cluster{
+		Config: &rollup.EsConfig{
+			L2ChainID: new(big.Int).SetUint64(3333),
+		},
+		Params: &protocol.SyncerParams{
+			MaxPeers:              30,
+			InitRequestSize:       uint64(4 * 1024 * 1024),
+			SyncConcurrency:       4,
+			FillEmptyConcurrency:  4,
+			MetaDownloadBatchSize: 16,
+		},
+		Shards: shards,
+		feed:   new(event.Feed),
+		ctx:    ctx,
+		cancel: cancel,
+		dir:    dir,
+	}
+	if err := c.init(maxShard, peers); err != nil {
+		c.Close()
+		return nil, err
+	}
+	return c, nil
+}
+
+func (c *Cluster) init(maxShard uint64, peers [][]uint64) error {
+	blobs, roots, l1, err := syntheticBlobs((maxShard + 1) * KvEntries)
+	if err != nil {
+		return err
+	}
+	c.Blobs, c.Roots = blobs, roots
+
+	lg := log.New("p2p", "synctest")
+	for i, shards := range peers {
+		sm, err := newStorage(c.ctx, filepath.Join(c.dir, fmt.Sprintf("peer%d", i)), shards, l1)
+		if err != nil {
+			return err
+		}
+		pr := &Peer{Storage: sm, Shards: shards}
+		c.Peers = append(c.Peers, pr)
+		for _, shard := range shards {
+			for idx := shard * KvEntries; idx < (shard+1)*KvEntries; idx++ {
+				if err := sm.CommitBlob(idx, blobs[idx], roots[idx]); err != nil {
+					return fmt.Errorf("commit blob %d of peer %d failed: %w", idx, i, err)
+				}
+			}
+		}
+		if pr.Host, err = libp2p.New(libp2p.ListenAddrStrings("/ip4/127.0.0.1/tcp/0"), libp2p.DisableRelay()); err != nil {
+			return err
+		}
+		pr.Server = protocol.NewSyncServer(c.Config, sm, rawdb.NewMemoryDatabase(), nil)
+		c.serve(pr.Host, pr.Server, lg)
+	}
+
+	// the client storage is created last, so the synthetic contract is registered with its shard manager
+	if c.Storage, err = newStorage(c.ctx, filepath.Join(c.dir, "client"), c.Shards, l1); err != nil {
+		return err
+	}
+	if c.Host, err = libp2p.New(libp2p.NoListenAddrs, libp2p.DisableRelay()); err != nil {
+		return err
+	}
+	c.Client = protocol.NewSyncClient(lg, c.Config, c.Host.NewStream, c.Storage, c.Params, rawdb.NewMemoryDatabase(), nil, c.feed)
+	return nil
+}
+
+// serve registers the handlers of the sync protocols requested by the sync client to the peer host.
+func (c *Cluster) serve(h host.Host, srv *protocol.SyncServer, lg log.Logger) {
+	h.SetStreamHandler(protocol.GetProtocolID(protocol.RequestBlobsByRangeProtocolID, c.Config.L2ChainID),
+		protocol.MakeStreamHandler(c.ctx, lg, srv.HandleGetBlobsByRangeRequest))
+	h.SetStreamHandler(protocol.GetProtocolID(protocol.RequestBlobsByListProtocolID, c.Config.L2ChainID),
+		protocol.MakeStreamHandler(c.ctx, lg, srv.HandleGetBlobsByListRequest))
+	h.SetStreamHandler(protocol.RequestCapabilities, protocol.MakeStreamHandler(c.ctx, lg, srv.HandleRequestCapabilities))
+	h.SetStreamHandler(protocol.RequestLastKvIndex, protocol.MakeStreamHandler(c.ctx, lg, srv.HandleRequestLastKvIndex))
+}
+
+// Start starts the sync client, and connects the remote peers and adds them to the client.
+func (c *Cluster) Start() error {
+	if err := c.Client.Start(); err != nil {
+		return err
+	}
+	for i, pr := range c.Peers {
+		if err := c.ConnectPeer(pr); err != nil {
+			return fmt.Errorf("failed to connect peer %d: %w", i, err)
+		}
+	}
+	return nil
+}
+
+// ConnectPeer connects the remote peer to the client host and adds it to the sync client with its shards.
+func (c *Cluster) ConnectPeer(pr *Peer) error {
+	if err := c.Host.Connect(c.ctx, peer.AddrInfo{ID: pr.Host.ID(), Addrs: pr.Host.Addrs()}); err != nil {
+		return err
+	}
+	shards := map[common.Address][]uint64{Contract: pr.Shards}
+	if !c.Client.AddPeer(pr.Host.ID(), shards, network.DirOutbound) {
+		return errors.New("peer is not added")
+	}
+	return nil
+}
+
+// DisconnectPeer removes the remote peer from the sync client and disconnects it from the client host.
+func (c *Cluster) DisconnectPeer(pr *Peer) error {
+	c.Client.RemovePeer(pr.Host.ID())
+	return c.Host.Network().ClosePeer(pr.Host.ID())
+}
+
+// WaitSynced waits until the sync client has synced all of its shards, or returns the error of the context.
+func (c *Cluster) WaitSynced(ctx context.Context) error {
+	doneCh := make(chan protocol.EthStorageSyncDone, 16)
+	sub := c.feed.Subscribe(doneCh)
+	defer sub.Unsubscribe()
+	if c.Client.Status().SyncDone {
+		return nil
+	}
+	for {
+		select {
+		case ev := <-doneCh:
+			if ev.DoneType == protocol.AllShardDone {
+				return nil
+			}
+		case <-ctx.Done():
+			return fmt.Errorf("sync is not done: %w", ctx.Err())
+		}
+	}
+}
+
+// Verify checks that the client storage holds the synthetic blobs of all of its shards.
+func (c *Cluster) Verify() error {
+	for _, shard := range c.Shards {
+		for idx := shard * KvEntries; idx < (shard+1)*KvEntries; idx++ {
+			blob, ok, err := c.Storage.TryRead(idx, len(c.Blobs[idx]), c.Roots[idx])
+			if !ok || err != nil {
+				return fmt.Errorf("read synced blob %d failed: %v", idx, err)
+			}
+			if !bytes.Equal(blob, c.Blobs[idx]) {
+				return fmt.Errorf("synced blob %d mismatches", idx)
+			}
+		}
+	}
+	return nil
+}
+
+// Close stops the sync client and the servers, closes the storages and the hosts, removes the data files and
+// unregisters the synthetic contract.
+func (c *Cluster) Close() {
+	if c.Client != nil {
+		c.Client.Close()
+	}
+	for _, pr := range c.Peers {
+		if pr.Server != nil {
+			pr.Server.Close()
+		}
+		if pr.Storage != nil {
+			pr.Storage.Close()
+		}
+		if pr.Host != nil {
+			pr.Host.Close()
+		}
+	}
+	if c.Storage != nil {
+		c.Storage.Close()
+	}
+	if c.Host != nil {
+		c.Host.Close()
+	}
+	c.cancel()
+	os.RemoveAll(c.dir)
+	delete(ethstorage.ContractToShardManager, Contract)
+}
+
+// syntheticBlobs generates the synthetic blobs, each embeds the contract and the kv index as the index header, the
+// KZG roots of the blobs and the metas of the blobs as stored in the contract.
+func syntheticBlobs(n uint64) ([][]byte, []common.Hash, *l1Source, error) {
+	var (
+		prover = prv.NewKZGProver(log.Root())
+		blobs  = make([][]byte, n)
+		roots  = make([]common.Hash, n)
+		l1     = &l1Source{metas: make([][32]byte, n)}
+	)
+	for i := range blobs {
+		blob := make([]byte, KvSize)
+		copy(blob[:common.AddressLength], Contract.Bytes())
+		binary.BigEndian.PutUint64(blob[common.AddressLength:], uint64(i))
+		root, err := prover.GetRoot(blob, 1, KvSize)
+		if err != nil {
+			return nil, nil, nil, err
+		}
+		// the meta is the kv index of 5 bytes, the kv size of 3 bytes and the hash of the blob
+		binary.BigEndian.PutUint64(l1.metas[i][:8], uint64(i)<<24|KvSize)
+		copy(l1.metas[i][8:], root[:ethstorage.HashSizeInContract])
+		blobs[i], roots[i] = blob, root
+	}
+	return blobs, roots, l1, nil
+}
+
+// newStorage creates a storage manager of the shards of the synthetic contract, each in a data file with the prefix,
+// with the metas of the synthetic blobs of the shards downloaded from l1.
+func newStorage(ctx context.Context, prefix string, shards []uint64, l1 *l1Source) (*ethstorage.StorageManager, error) {
+	shardManager := ethstorage.NewShardManager(Contract, KvSize, KvEntries, KvSize)
+	for _, shard := range shards {
+		filename := fmt.Sprintf("%s.shard%d.dat", prefix, shard)
+		if _, err := ethstorage.Create(filename, shard*KvEntries, KvEntries, 0, KvSize, ethstorage.ENCODE_KECCAK_256,
+			common.Address{}, KvSize); err != nil {
+			return nil, err
+		}
+		df, err := ethstorage.OpenDataFile(filename)
+		if err != nil {
+			return nil, err
+		}
+		if err := shardManager.AddDataFileAndShard(df); err != nil {
+			return nil, err
+		}
+	}
+	sm := ethstorage.NewStorageManager(shardManager, l1)
+	if err := sm.Reset(0); err != nil {
+		sm.Close()
+		return nil, err
+	}
+	if err := sm.DownloadAllMetas(ctx, KvEntries); err != nil {
+		sm.Close()
+		return nil, err
+	}
+	return sm, nil
+}
@@ -0,0 +1,36 @@
+package synctest
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/ethstorage/go-ethstorage/ethstorage"
+)
+
+// TestInMemoryCluster tests that the sync client of the cluster syncs its shards from the remote peers serving them
+// separately, and that the synthetic contract is unregistered once the cluster is closed.
+func TestInMemoryCluster(t *testing.T) {
+	c, err := NewInMemoryCluster([]uint64{0, 1}, []uint64{0}, []uint64{1})
+	if err != nil {
+		t.Fatalf("failed to create cluster: %s", err.Error())
+	}
+	if err := c.Start(); err != nil {
+		c.Close()
+		t.Fatalf("failed to start cluster: %s", err.Error())
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+	defer cancel()
+	if err := c.WaitSynced(ctx); err != nil {
+		c.Close()
+		t.Fatalf(err.Error())
+	}
+	if err := c.Verify(); err != nil {
+		c.Close()
+		t.Fatalf(err.Error())
+	}
+	c.Close()
+	if _, ok := ethstorage.ContractToShardManager[Contract]; ok {
+		t.Fatalf("synthetic contract should be unregistered once the cluster is closed")
+	}
+}
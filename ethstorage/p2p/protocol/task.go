@@ -4,6 +4,11 @@
 package protocol
 
 import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"slices"
+	"sort"
 	"time"
 
 	"github.com/ethereum/go-ethereum/common"
@@ -23,8 +28,69 @@ type task struct {
 	// TODO: consider whether we need to retry those stateless peers or disconnect the peer
 	statelessPeers map[peer.ID]struct{} // Peers that failed to deliver kv Data
 	state          *SyncState
+	rate           syncRate // Recent synced blobs to estimate the sync rate
 
-	done bool // Flag whether the task has done
+	done      bool // Flag whether the task has done
+	verified  bool // Flag whether enough blobs of the done task are verified and the shard done is announced
+	cancelled bool // Flag whether the sync of the task is cancelled by CancelShard, protected by the lock
+	force     bool // Flag whether the blobs of the task overwrite the local ones, set by ForceResync
+	diskFull  bool // Flag whether the sync of the task is paused as the disk is full until ResumeShard, protected by the lock
+}
+
+// syncRate keeps the commit times of the blobs synced in the recent window of a task, so the sync rate and
+// the remaining time of the task can be estimated from a moving average. The zero value is ready to use.
+type syncRate struct {
+	samples []rateSample
+}
+
+type rateSample struct {
+	time  time.Time
+	count uint64
+}
+
+// add records count blobs committed at now, and drops the samples out of the window.
+func (r *syncRate) add(now time.Time, count uint64) {
+	r.samples = append(r.samples, rateSample{time: now, count: count})
+	r.prune(now)
+}
+
+func (r *syncRate) prune(now time.Time) {
+	i := 0
+	for i < len(r.samples) && now.Sub(r.samples[i].time) > syncRateWindow {
+		i++
+	}
+	r.samples = r.samples[i:]
+}
+
+// blobsPerSec returns the blobs committed per second since the first sample in the window, the blobs of the first
+// sample are committed at the start of the measure so they are not counted. It is 0 if less than two samples are
+// in the window, so a stalled sync converges to 0 once the window passes.
+func (r *syncRate) blobsPerSec(now time.Time) float64 {
+	r.prune(now)
+	if len(r.samples) < 2 {
+		return 0
+	}
+	elapsed := now.Sub(r.samples[0].time).Seconds()
+	if elapsed <= 0 {
+		return 0
+	}
+	count := uint64(0)
+	for _, s := range r.samples[1:] {
+		count += s.count
+	}
+	return float64(count) / elapsed
+}
+
+// eta returns the estimated seconds to sync the remaining blobs at the current rate, or -1 if the rate is unknown.
+func (r *syncRate) eta(now time.Time, remaining uint64) float64 {
+	if remaining == 0 {
+		return 0
+	}
+	rate := r.blobsPerSec(now)
+	if rate == 0 {
+		return -1
+	}
+	return float64(remaining) / rate
 }
 
 // task which is used to write empty to storage file, so the files will fill up with encode data
@@ -62,17 +128,97 @@ type subTask struct {
 	done      bool // Flag whether the subTask can be removed
 }
 
+// normalizeSubTasks sorts the subTasks by First, drops the done ones whose next has reached Last, and merges
+// the overlapping or adjacent ones, so that no blob is covered by more than one subTask. The next of a merged
+// subTask is reset to its First.
+func normalizeSubTasks(subTasks []*subTask) []*subTask {
+	sorted := make([]*subTask, 0, len(subTasks))
+	for _, st := range subTasks {
+		if st.done || st.First >= st.Last || st.next >= st.Last {
+			continue
+		}
+		sorted = append(sorted, st)
+	}
+	sort.Slice(sorted, func(i, j int) bool {
+		return sorted[i].First < sorted[j].First
+	})
+
+	normalized := make([]*subTask, 0, len(sorted))
+	for _, st := range sorted {
+		if n := len(normalized); n > 0 && st.First <= normalized[n-1].Last {
+			prev := normalized[n-1]
+			if st.Last > prev.Last {
+				prev.Last = st.Last
+			}
+			prev.next = prev.First
+			continue
+		}
+		normalized = append(normalized, &subTask{task: st.task, next: st.next, First: st.First, Last: st.Last})
+	}
+	return normalized
+}
+
+// sortSubTasks sorts the subTasks by First, so they are iterated and saved in a stable order.
+func sortSubTasks(subTasks []*subTask) {
+	sort.SliceStable(subTasks, func(i, j int) bool {
+		return subTasks[i].First < subTasks[j].First
+	})
+}
+
+// sortSubEmptyTasks sorts the subEmptyTasks by First, so they are iterated and saved in a stable order.
+func sortSubEmptyTasks(subEmptyTasks []*subEmptyTask) {
+	sort.SliceStable(subEmptyTasks, func(i, j int) bool {
+		return subEmptyTasks[i].First < subEmptyTasks[j].First
+	})
+}
+
+// coveredBlobs returns the total number of blobs covered by the ranges of the subTasks.
+func coveredBlobs(subTasks []*subTask) uint64 {
+	count := uint64(0)
+	for _, st := range subTasks {
+		if st.Last > st.First {
+			count += st.Last - st.First
+		}
+	}
+	return count
+}
+
 // healTask represents the sync task for healing blobs fail to fetch from remote  .
 type healTask struct {
 	task    *task
 	Indexes map[uint64]int64 // Set of blobs currently queued for retrieval
+
+	attempts map[uint64]int      // Number of the requests sent for each queued blob
+	missing  map[uint64]struct{} // Blobs given up after too many requests, they are not queued again
+
+	importTried map[uint64]struct{} // Blobs looked up in the import source, they are not looked up again
+
+	unavailable map[uint64]map[peer.ID]int64 // Peers known to miss each queued blob, until the expiry time in millis
+
+	failed map[uint64]failedPeer // Peer whose request of each blob failed last, avoided by the retries until the expiry
+
+	journal map[uint64]bool // Blobs queued (true) or dequeued (false) since the last checkpoint to the heal log
+	logSeq  uint64          // Sequence of the next record of the heal log
+	logLen  int             // Records in the heal log since it is compacted
+}
+
+// failedPeer is the peer whose request of a blob failed last, and the time in millis until which the retries of the
+// blob prefer the other peers.
+type failedPeer struct {
+	id     peer.ID
+	expiry int64
 }
 
 func (h *healTask) remove(list []uint64) {
 	for _, idx := range list {
 		if _, ok := h.Indexes[idx]; ok {
 			delete(h.Indexes, idx)
+			h.record(idx, false)
 		}
+		delete(h.attempts, idx)
+		delete(h.missing, idx)
+		delete(h.unavailable, idx)
+		delete(h.failed, idx)
 	}
 }
 
@@ -82,15 +228,121 @@ func (h *healTask) count() int {
 
 func (h *healTask) insert(list []uint64) {
 	for _, idx := range list {
+		if _, ok := h.missing[idx]; ok {
+			continue
+		}
 		h.Indexes[idx] = 0
+		h.record(idx, true)
+	}
+}
+
+// record journals the blob queued or dequeued, so the change is appended to the heal log by the next checkpoint.
+func (h *healTask) record(idx uint64, queued bool) {
+	if h.journal == nil {
+		h.journal = make(map[uint64]bool)
+	}
+	h.journal[idx] = queued
+}
+
+// takeJournal returns the blobs queued and dequeued since the last call in order, and resets the journal.
+func (h *healTask) takeJournal() ([]uint64, []uint64) {
+	queued, dequeued := make([]uint64, 0), make([]uint64, 0)
+	for idx, q := range h.journal {
+		if q {
+			queued = append(queued, idx)
+		} else {
+			dequeued = append(dequeued, idx)
+		}
 	}
+	h.journal = nil
+	slices.Sort(queued)
+	slices.Sort(dequeued)
+	return queued, dequeued
+}
+
+// sortedIndexes returns the queued blobs in order.
+func (h *healTask) sortedIndexes() []uint64 {
+	indexes := make([]uint64, 0, len(h.Indexes))
+	for idx := range h.Indexes {
+		indexes = append(indexes, idx)
+	}
+	slices.Sort(indexes)
+	return indexes
 }
 
 func (h *healTask) refresh(list []uint64) {
+	if h.attempts == nil {
+		h.attempts = make(map[uint64]int)
+	}
 	t := time.Now().UnixMilli()
 	for _, idx := range list {
 		h.Indexes[idx] = t
+		h.attempts[idx]++
+	}
+}
+
+// giveUp moves the blobs whose last of maxAttempts requests has timed out without the blob delivered from the
+// queue to the missing set, and returns them in order. maxAttempts 0 means the blobs are never given up.
+func (h *healTask) giveUp(maxAttempts int) []uint64 {
+	given := make([]uint64, 0)
+	if maxAttempts <= 0 {
+		return given
+	}
+	now := time.Now().UnixMilli()
+	for idx, tm := range h.Indexes {
+		if !h.isExhausted(idx, tm, maxAttempts, now) {
+			continue
+		}
+		if h.missing == nil {
+			h.missing = make(map[uint64]struct{})
+		}
+		h.missing[idx] = struct{}{}
+		delete(h.Indexes, idx)
+		h.record(idx, false)
+		delete(h.attempts, idx)
+		delete(h.unavailable, idx)
+		delete(h.failed, idx)
+		given = append(given, idx)
 	}
+	sort.Slice(given, func(i, j int) bool {
+		return given[i] < given[j]
+	})
+	return given
+}
+
+// exhausted returns the blobs to be given up by giveUp in order, without moving them to the missing set.
+func (h *healTask) exhausted(maxAttempts int) []uint64 {
+	indexes := make([]uint64, 0)
+	if maxAttempts <= 0 {
+		return indexes
+	}
+	now := time.Now().UnixMilli()
+	for idx, tm := range h.Indexes {
+		if h.isExhausted(idx, tm, maxAttempts, now) {
+			indexes = append(indexes, idx)
+		}
+	}
+	sort.Slice(indexes, func(i, j int) bool {
+		return indexes[i] < indexes[j]
+	})
+	return indexes
+}
+
+// isExhausted returns whether the last of maxAttempts requests of the blob requested at tm has timed out.
+func (h *healTask) isExhausted(idx uint64, tm int64, maxAttempts int, now int64) bool {
+	return h.attempts[idx] >= maxAttempts && now-tm > requestTimeoutInMillisecond.Milliseconds()
+}
+
+// missingIndexes returns the blobs given up in order.
+func (h *healTask) missingIndexes() []uint64 {
+	indexes := make([]uint64, 0, len(h.missing))
+	for idx := range h.missing {
+		indexes = append(indexes, idx)
+	}
+	sort.Slice(indexes, func(i, j int) bool {
+		return indexes[i] < indexes[j]
+	})
+	return indexes
 }
 
 func (h *healTask) hasIndexInRange(first, next uint64) (bool, uint64) {
@@ -106,10 +358,65 @@ func (h *healTask) hasIndexInRange(first, next uint64) (bool, uint64) {
 	return exist, min
 }
 
+// markUnavailable records the blobs are missing from the peer for availabilityTTL, and makes them ready to be
+// requested from the other peers at once instead of waiting for the request to time out.
+func (h *healTask) markUnavailable(id peer.ID, list []uint64) {
+	if h.unavailable == nil {
+		h.unavailable = make(map[uint64]map[peer.ID]int64)
+	}
+	expiry := time.Now().Add(availabilityTTL).UnixMilli()
+	for _, idx := range list {
+		if _, ok := h.Indexes[idx]; !ok {
+			continue
+		}
+		if h.unavailable[idx] == nil {
+			h.unavailable[idx] = make(map[peer.ID]int64)
+		}
+		h.unavailable[idx][id] = expiry
+		h.Indexes[idx] = 0
+	}
+}
+
+// markFailed records the peer as the last one failing the request of the blobs for cooldown, so the retries of the
+// blobs prefer the other peers.
+func (h *healTask) markFailed(id peer.ID, list []uint64, cooldown time.Duration) {
+	if h.failed == nil {
+		h.failed = make(map[uint64]failedPeer)
+	}
+	expiry := time.Now().Add(cooldown).UnixMilli()
+	for _, idx := range list {
+		h.failed[idx] = failedPeer{id: id, expiry: expiry}
+	}
+}
+
+// lastFailed returns the peer whose request of the blob failed last, if its cooldown has not passed.
+func (h *healTask) lastFailed(idx uint64) (peer.ID, bool) {
+	f, ok := h.failed[idx]
+	if !ok || time.Now().UnixMilli() >= f.expiry {
+		return "", false
+	}
+	return f.id, true
+}
+
 func (h *healTask) getBlobIndexesForRequest(batch uint64) []uint64 {
+	return h.getBlobIndexesForPeer(batch, "", nil, false)
+}
+
+// getBlobIndexesForPeer is the same as getBlobIndexesForRequest, except the blobs known to be missing from the
+// peer and the blobs in the requesting set are skipped, and so are the blobs last failed by the peer if avoidFailed.
+func (h *healTask) getBlobIndexesForPeer(batch uint64, id peer.ID, requesting map[uint64]struct{}, avoidFailed bool) []uint64 {
 	indexes := make([]uint64, 0)
 	l := uint64(0)
 	for idx, tm := range h.Indexes {
+		if _, ok := requesting[idx]; ok {
+			continue
+		}
+		if expiry, ok := h.unavailable[idx][id]; ok && time.Now().UnixMilli() < expiry {
+			continue
+		}
+		if failed, ok := h.lastFailed(idx); avoidFailed && ok && failed == id {
+			continue
+		}
 		if time.Now().UnixMilli()-tm > requestTimeoutInMillisecond.Milliseconds() {
 			indexes = append(indexes, idx)
 			l++
@@ -122,6 +429,115 @@ func (h *healTask) getBlobIndexesForRequest(batch uint64) []uint64 {
 	return indexes
 }
 
+// encodeIndexRanges encodes the sorted indexes compactly as the runs of contiguous indexes, each run is the gap from
+// the end of the previous run and the length of the run as uvarints, so the large contiguous ranges of heal indexes
+// take a few bytes.
+func encodeIndexRanges(indexes []uint64) []byte {
+	buf := make([]byte, 0)
+	end := uint64(0) // end of the previous run
+	for i := 0; i < len(indexes); {
+		j := i + 1
+		for j < len(indexes) && indexes[j] == indexes[j-1]+1 {
+			j++
+		}
+		buf = binary.AppendUvarint(buf, indexes[i]-end)
+		buf = binary.AppendUvarint(buf, uint64(j-i))
+		end = indexes[j-1] + 1
+		i = j
+	}
+	return buf
+}
+
+// decodeIndexRanges decodes the indexes encoded by encodeIndexRanges, each run must be within [first, limit), e.g.
+// the kv indexes of a shard, so a malformed encoding cannot allocate more indexes than the shard has.
+func decodeIndexRanges(b []byte, first, limit uint64) ([]uint64, error) {
+	indexes := make([]uint64, 0)
+	end := uint64(0)
+	for len(b) > 0 {
+		gap, n := binary.Uvarint(b)
+		if n <= 0 {
+			return nil, errors.New("malformed index ranges")
+		}
+		b = b[n:]
+		length, n := binary.Uvarint(b)
+		if n <= 0 || length == 0 {
+			return nil, errors.New("malformed index ranges")
+		}
+		b = b[n:]
+		// end never exceeds limit, so the checks do not overflow
+		if gap >= limit-end || length > limit-end-gap || end+gap < first {
+			return nil, fmt.Errorf("index range out of [%d, %d)", first, limit)
+		}
+		for idx := end + gap; idx < end+gap+length; idx++ {
+			indexes = append(indexes, idx)
+		}
+		end += gap + length
+	}
+	return indexes, nil
+}
+
+// The kinds of the records of the heal log: a delta record queues and dequeues blobs on top of the records before
+// it, while a snapshot record replaces them all.
+const (
+	healRecordDelta byte = iota
+	healRecordSnapshot
+)
+
+// encodeHealDelta encodes a delta record of the heal log, the queued and the dequeued blobs are encoded by
+// encodeIndexRanges, prefixed by the kind and the length of the queued ones.
+func encodeHealDelta(queued, dequeued []uint64) []byte {
+	q := encodeIndexRanges(queued)
+	buf := binary.AppendUvarint([]byte{healRecordDelta}, uint64(len(q)))
+	buf = append(buf, q...)
+	return append(buf, encodeIndexRanges(dequeued)...)
+}
+
+// encodeHealSnapshot encodes a snapshot record of the heal log with all the queued blobs.
+func encodeHealSnapshot(indexes []uint64) []byte {
+	return append([]byte{healRecordSnapshot}, encodeIndexRanges(indexes)...)
+}
+
+// apply applies a record of the heal log encoded by encodeHealDelta or encodeHealSnapshot to the heal indexes
+// without journaling it, as it is loaded from the heal log. The indexes of the record must be within [first, limit).
+func (h *healTask) apply(record []byte, first, limit uint64) error {
+	if len(record) == 0 {
+		return errors.New("empty heal record")
+	}
+	switch record[0] {
+	case healRecordSnapshot:
+		indexes, err := decodeIndexRanges(record[1:], first, limit)
+		if err != nil {
+			return err
+		}
+		h.Indexes = make(map[uint64]int64, len(indexes))
+		for _, idx := range indexes {
+			h.Indexes[idx] = 0
+		}
+	case healRecordDelta:
+		size, n := binary.Uvarint(record[1:])
+		if n <= 0 || uint64(len(record)-1-n) < size {
+			return errors.New("malformed heal record")
+		}
+		queued, err := decodeIndexRanges(record[1+n:1+n+int(size)], first, limit)
+		if err != nil {
+			return err
+		}
+		dequeued, err := decodeIndexRanges(record[1+n+int(size):], first, limit)
+		if err != nil {
+			return err
+		}
+		for _, idx := range queued {
+			h.Indexes[idx] = 0
+		}
+		for _, idx := range dequeued {
+			delete(h.Indexes, idx)
+		}
+	default:
+		return fmt.Errorf("unknown heal record kind %d", record[0])
+	}
+	return nil
+}
+
 type SyncProgress struct {
 	Tasks []*task // The suspended kv tasks
 
@@ -0,0 +1,77 @@
+// Copyright 2022-2023, EthStorage.
+// For license information, see https://github.com/ethstorage/es-node/blob/main/LICENSE
+
+package protocol
+
+import (
+	"context"
+)
+
+// The names of the spans of the sync requests. A request span is the parent of the round trip and the commit spans
+// of the request, and of the decode and the verify spans of each blob delivered.
+const (
+	spanRequestRange   = "sync.RequestBlobsByRange"
+	spanRequestList    = "sync.RequestBlobsByList"
+	spanRequestL2Range = "sync.RequestL2Range"
+	spanRoundTrip      = "sync.RoundTrip"
+	spanDecode         = "sync.Decode"
+	spanVerify         = "sync.Verify"
+	spanCommit         = "sync.Commit"
+)
+
+// SpanAttribute is a key value attribute of a span, e.g. the peer or the blob index of a request.
+type SpanAttribute struct {
+	Key   string
+	Value any
+}
+
+// Span is a span of the sync request lifecycle started by a Tracer, which mirrors the subset of the OpenTelemetry
+// span used by the sync client.
+type Span interface {
+	// SetAttributes sets the attributes of the span.
+	SetAttributes(attrs ...SpanAttribute)
+	// RecordError records the error the span failed with.
+	RecordError(err error)
+	// End ends the span.
+	End()
+}
+
+// Tracer starts the spans around the dispatch, the stream round trip, the decode, the verify and the commit of the
+// sync requests. It mirrors the OpenTelemetry tracer, so a thin adapter of trace.Tracer plugs the spans into the
+// distributed tracing: the span started is the child of the span in ctx, and the ctx returned carries the new span.
+// Start is called on the hot path of the sync, so it should return quickly.
+type Tracer interface {
+	Start(ctx context.Context, name string, attrs ...SpanAttribute) (context.Context, Span)
+}
+
+// noopTracer is the default Tracer, which starts no span so the tracing adds no overhead while disabled.
+type noopTracer struct{}
+
+type noopSpan struct{}
+
+func (noopTracer) Start(ctx context.Context, name string, attrs ...SpanAttribute) (context.Context, Span) {
+	return ctx, noopSpan{}
+}
+
+func (noopSpan) SetAttributes(attrs ...SpanAttribute) {}
+
+func (noopSpan) RecordError(err error) {}
+
+func (noopSpan) End() {}
+
+// SetTracer sets the Tracer to start the spans of the sync requests, nil to disable the tracing. It should be called
+// before Start.
+func (s *SyncClient) SetTracer(tracer Tracer) {
+	if tracer == nil {
+		tracer = noopTracer{}
+	}
+	s.tracer = tracer
+}
+
+// endSpan records the error of the span if any and ends it.
+func endSpan(span Span, err error) {
+	if err != nil {
+		span.RecordError(err)
+	}
+	span.End()
+}
@@ -4,10 +4,12 @@
 package protocol
 
 import (
+	"context"
 	"fmt"
 	"time"
 
 	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/log"
 	"github.com/libp2p/go-libp2p/core/peer"
 )
 
@@ -40,7 +42,17 @@ type blobsByRangeRequest struct {
 	limit    uint64
 
 	subTask *subTask
-	time    time.Time // Timestamp when the request was sent
+	fan     *rangeFan       // Requests of the subTask fanned out to multiple peers, nil for a single request
+	time    time.Time       // Timestamp when the request was sent
+	log     log.Logger      // Logger with the context of the peer, contract, shard and subTask range
+	ctx     context.Context // Context carrying the span of the request to the spans of its blobs
+}
+
+// rangeFan tracks the range requests of a subTask split among multiple peers in parallel, the subTask moves on
+// once all of them are done.
+type rangeFan struct {
+	pending  int      // Number of the requests not done yet, protected by the lock
+	inserted []uint64 // Blobs inserted by the responses, protected by the lock
 }
 
 type blobsByListRequest struct {
@@ -51,7 +63,9 @@ type blobsByListRequest struct {
 	indexes  []uint64
 
 	healTask *healTask
-	time     time.Time // Timestamp when the request was sent
+	time     time.Time       // Timestamp when the request was sent
+	log      log.Logger      // Logger with the context of the peer, contract and shard
+	ctx      context.Context // Context carrying the span of the request to the spans of its blobs
 }
 
 type blobsByRangeResponse struct {
@@ -75,6 +89,9 @@ type GetBlobsByRangePacket struct {
 	Origin   uint64         // Index of the first Blob to retrieve
 	Limit    uint64         // Index of the last Blob to retrieve
 	Bytes    uint64         // Soft limit at which to stop returning data
+
+	MaxBytesPerBlob uint64 `rlp:"optional"` // Max bytes of the encoded blob prefix to return per blob, 0 means the full blob
+	Checksum        bool   `rlp:"optional"` // Request the checksum footer of the blobs in the response
 }
 
 // BlobsByRangePacket represents a Blobs query response.
@@ -83,6 +100,8 @@ type BlobsByRangePacket struct {
 	Contract common.Address // Contract of the sharded storage
 	ShardId  uint64
 	Blobs    []*BlobPayload // List of the returning Blobs data
+
+	Checksum uint32 `rlp:"optional"` // Checksum of the blobs by blobsChecksum if requested
 }
 
 // GetBlobsByListPacket represents a Blobs query.
@@ -92,6 +111,8 @@ type GetBlobsByListPacket struct {
 	ShardId  uint64         // ShardId
 	BlobList []uint64       // BlobList index list to retrieve
 	Bytes    uint64         // Soft limit at which to stop returning data
+
+	Checksum bool `rlp:"optional"` // Request the checksum footer of the blobs in the response
 }
 
 // BlobsByListPacket represents a Blobs query response.
@@ -100,6 +121,134 @@ type BlobsByListPacket struct {
 	Contract common.Address // Contract of the sharded storage
 	ShardId  uint64
 	Blobs    []*BlobPayload // List of the returning Blobs data
+
+	Checksum uint32 `rlp:"optional"` // Checksum of the blobs by blobsChecksum if requested
+}
+
+// GetBlobsByCommitPacket represents a Blobs query by the commits of the blobs.
+type GetBlobsByCommitPacket struct {
+	ID       uint64         // Request ID to match up responses with
+	Contract common.Address // Contract of the sharded storage
+	Commits  []common.Hash  // Commits of the blobs to retrieve
+	Bytes    uint64         // Soft limit at which to stop returning data
+}
+
+// BlobsByCommitPacket represents a Blobs query by commits response.
+type BlobsByCommitPacket struct {
+	ID       uint64         // ID of the request this is a response for
+	Contract common.Address // Contract of the sharded storage
+	Blobs    []*BlobPayload // List of the returning Blobs data, the commits not found are omitted
+}
+
+// GetAvailabilityPacket represents a query of which blobs of a range the server holds.
+type GetAvailabilityPacket struct {
+	ID       uint64         // Request ID to match up responses with
+	Contract common.Address // Contract of the sharded storage
+	ShardId  uint64         // ShardId
+	Origin   uint64         // Index of the first Blob to query
+	Limit    uint64         // Index of the last Blob to query
+}
+
+// AvailabilityPacket represents an availability query response.
+type AvailabilityPacket struct {
+	ID       uint64         // ID of the request this is a response for
+	Contract common.Address // Contract of the sharded storage
+	ShardId  uint64
+	Origin   uint64
+	Limit    uint64             // Index of the last Blob covered by Bitmap, which may be below the requested one
+	Bitmap   AvailabilityBitmap // Bit i of the bitmap is set if the server holds the blob of index Origin+i
+}
+
+// AvailabilityBitmap is a bitmap of the blobs held, bit i is bit i%8 (least significant bit first) of byte i/8,
+// the same format as StorageManager.ShardOccupancy.
+type AvailabilityBitmap []byte
+
+func newAvailabilityBitmap(n uint64) AvailabilityBitmap {
+	return make(AvailabilityBitmap, (n+7)/8)
+}
+
+// Has returns whether bit i is set.
+func (b AvailabilityBitmap) Has(i uint64) bool {
+	return i/8 < uint64(len(b)) && b[i/8]&(1<<(i%8)) != 0
+}
+
+func (b AvailabilityBitmap) set(i uint64) {
+	b[i/8] |= 1 << (i % 8)
+}
+
+// BlobSyncOutcome is the outcome of a blob requested by RequestL2RangeWithResults.
+type BlobSyncOutcome int
+
+const (
+	BlobCommitted      BlobSyncOutcome = iota // the blob is fetched and committed to the local storage
+	BlobAlreadyPresent                        // the blob already exists in the local storage
+	BlobNotReturned                           // the blob is not returned by the peer, and is left to the caller to heal
+	BlobFailed                                // the blob fails to decode, verify or commit, see Reason for detail
+	BlobNotServed                             // the blob is out of the shard or not less than the last kv index, so it is not requested
+)
+
+func (o BlobSyncOutcome) String() string {
+	switch o {
+	case BlobCommitted:
+		return "committed"
+	case BlobAlreadyPresent:
+		return "already-present"
+	case BlobNotReturned:
+		return "not-returned"
+	case BlobFailed:
+		return "failed"
+	case BlobNotServed:
+		return "not-served"
+	default:
+		return fmt.Sprintf("unknown(%d)", int(o))
+	}
+}
+
+// BlobSyncResult is the detailed result of a blob requested by RequestL2RangeWithResults.
+type BlobSyncResult struct {
+	Index   uint64
+	Outcome BlobSyncOutcome
+	Reason  string // Reason of the failure, only set when Outcome is BlobFailed
+}
+
+// Capabilities are the features of the sync protocol supported by a peer, which are exchanged by the capabilities
+// handshake when the peer joins, so only the features supported by the peer are requested from it. The encode types
+// of the shards of the peer are stored per peer, so the peers with a different encode type can be skipped. The
+// handshake is the only round-trip to set up a new peer, as it also carries how the peer prefers to be requested and
+// its last kv indexes.
+type Capabilities struct {
+	Version     uint64             // version of the sync protocol
+	Compression []string           // compression algorithms of the range responses, e.g. "zstd"
+	EncodeTypes []*ShardEncodeType // encode types of the shards stored by the peer
+	// the peer prefers BlobsByRange requests to BlobsByList requests for contiguous indexes
+	PreferRange bool `rlp:"optional"`
+	// the peer appends the checksum footer to the blobs responses if requested
+	Checksum bool `rlp:"optional"`
+	// last kv indexes of the contracts served by the peer, nil if not advertised
+	LastKvIndexes []*ContractLastKvIndex `rlp:"optional"`
+}
+
+// GetChunkProofPacket represents a chunk proof query.
+type GetChunkProofPacket struct {
+	Contract common.Address // Contract of the sharded storage
+	KvIdx    uint64         // Index of the blob
+	ChunkIdx uint64         // Index of the 32 bytes chunk, i.e. the field element, in the blob
+}
+
+// ChunkProofPacket represents a chunk proof query response.
+type ChunkProofPacket struct {
+	KvIdx    uint64
+	ChunkIdx uint64
+	Commit   common.Hash // Commit of the blob in the local meta of the server
+	Chunk    []byte      // The 32 bytes chunk of the decoded blob
+	Proof    []byte      // Point evaluation input of the chunk generated by KZGProver.GenerateKZGProof
+}
+
+// ShardEncodeType is the encode type of a shard stored by a node.
+type ShardEncodeType struct {
+	Contract   common.Address
+	ShardId    uint64
+	EncodeType uint64
 }
 
 type requestResultErr byte
@@ -112,11 +261,24 @@ func (r requestResultErr) ResultCode() byte {
 	return byte(r)
 }
 
+// ShardKey identifies a shard of a contract, a zero contract stands for the contract the node is started with.
+type ShardKey struct {
+	Contract common.Address
+	ShardId  uint64
+}
+
 type ContractShards struct {
 	Contract common.Address
 	ShardIds []uint64
 }
 
+// ContractLastKvIndex is the last kv index of a contract in the local view of a node, it is exchanged when the
+// peers connect, so the range requests to a peer are bounded by the blobs the peer has.
+type ContractLastKvIndex struct {
+	Contract    common.Address
+	LastKvIndex uint64
+}
+
 // EthStorageENRData The discovery ENRs are just key-value lists, and we filter them by records tagged with the "ethstorage" key,
 // and then check the chain ID and Version.
 type EthStorageENRData struct {
@@ -134,12 +296,161 @@ type EthStorageSyncDone struct {
 	ShardId  uint64
 }
 
+// RangeSynced is sent when all the blobs in the range [First, Last] of the shard requested by SyncClient.SyncRange or
+// SyncClient.ForceResync are synced.
+type RangeSynced struct {
+	Contract common.Address
+	ShardId  uint64
+	First    uint64
+	Last     uint64
+}
+
+// PeerBanned is sent when a peer is removed from sync duties and banned because it delivered too many invalid blobs.
+type PeerBanned struct {
+	Peer         peer.ID
+	InvalidBlobs int // number of the invalid blobs delivered by the peer
+}
+
+// BlobsMissing is sent when the heal indexes of a shard are given up after maxHealAttempts requests to the peers,
+// so the blobs are likely unavailable from the network.
+type BlobsMissing struct {
+	Contract common.Address
+	ShardId  uint64
+	Indexes  []uint64
+}
+
+// DiskFull is sent when the sync of a shard is paused as the free disk space of its data file is below the min free
+// disk space, the sync of the shard continues once SyncClient.ResumeShard is called after the disk space is freed.
+type DiskFull struct {
+	Contract common.Address
+	ShardId  uint64
+}
+
+// SyncStalled is sent when no blob has been committed for the stall timeout while blobs remain to sync.
+type SyncStalled struct {
+	LastCommit  time.Time // Time instance when a blob was last committed
+	BlobsToSync uint64
+}
+
+// SyncPaused is sent when the sync is paused by SyncClient.Pause or resumed by SyncClient.Resume.
+type SyncPaused struct {
+	Paused bool
+}
+
+// VerifyStrictness controls how blobs received for a shard are verified against their commits.
+type VerifyStrictness int
+
+const (
+	// VerifyFull verifies every blob received for the shard.
+	VerifyFull VerifyStrictness = iota
+	// VerifySampled verifies a random fraction of the blobs received for the shard,
+	// blobs from suspicious peers are always verified.
+	VerifySampled
+	// VerifyTrusted verifies blobs from suspicious peers, that is peers which delivered
+	// blobs that failed verification before, and a small fixed fraction of the blobs from
+	// the other peers, so a peer delivering corrupt blobs becomes suspicious eventually.
+	VerifyTrusted
+)
+
+func (v VerifyStrictness) String() string {
+	switch v {
+	case VerifyFull:
+		return "full"
+	case VerifySampled:
+		return "sampled"
+	case VerifyTrusted:
+		return "trusted"
+	default:
+		return fmt.Sprintf("unknown(%d)", int(v))
+	}
+}
+
+// SchedulePolicy controls how the request slots of the idle peers are shared among the sync tasks.
+type SchedulePolicy int
+
+const (
+	// ScheduleRoundRobin serves the tasks in turn, one request of a task at a time.
+	ScheduleRoundRobin SchedulePolicy = iota
+	// ScheduleWeighted serves the tasks with the chance proportional to their remaining work, that is the blobs
+	// remaining in the subTasks and heal indexes, so a lagging shard gets more requests than a nearly done one.
+	ScheduleWeighted
+)
+
+func (p SchedulePolicy) String() string {
+	switch p {
+	case ScheduleRoundRobin:
+		return "round-robin"
+	case ScheduleWeighted:
+		return "weighted"
+	default:
+		return fmt.Sprintf("unknown(%d)", int(p))
+	}
+}
+
+// EncodeTypePolicy controls how the peers storing a shard with an encode type different from the local one are
+// requested. The blobs from such a peer are decoded with its encode type, then encoded with the local one.
+type EncodeTypePolicy int
+
+const (
+	// EncodeTypeReEncode requests the blobs from any peer regardless of its encode type.
+	EncodeTypeReEncode EncodeTypePolicy = iota
+	// EncodeTypeRejectMismatch never requests the blobs from the peers with a different encode type, and drops the
+	// blobs of a different encode type, so the CPU is not spent on the decode of the mismatched blobs.
+	EncodeTypeRejectMismatch
+	// EncodeTypePreferMatch requests the blobs from the peers with the same encode type first, and falls back to
+	// the peers with a different encode type if none of them is idle.
+	EncodeTypePreferMatch
+)
+
+func (p EncodeTypePolicy) String() string {
+	switch p {
+	case EncodeTypeReEncode:
+		return "re-encode"
+	case EncodeTypeRejectMismatch:
+		return "reject-mismatch"
+	case EncodeTypePreferMatch:
+		return "prefer-match"
+	default:
+		return fmt.Sprintf("unknown(%d)", int(p))
+	}
+}
+
 type SyncerParams struct {
-	MaxPeers              int
-	InitRequestSize       uint64
-	SyncConcurrency       uint64
-	FillEmptyConcurrency  int
-	MetaDownloadBatchSize uint64
+	MaxPeers               int
+	PeersOvershoot         int // extra peers allowed beyond MaxPeers while syncing, trimmed after sync done
+	InitRequestSize        uint64
+	SyncConcurrency        uint64
+	FillEmptyConcurrency   int
+	FillEmptyWithPeers     int // fill empty workers while peers serving unfinished tasks are connected
+	DecodeConcurrency      int // workers to decode and verify the received blobs, 0 means NumCPU
+	WriteQueueSize         int // batches of the decoded blobs queued to be written to disk, 0 means 16
+	MetaDownloadBatchSize  uint64
+	ShardVerifyStrictness  map[ShardKey]VerifyStrictness // shards not in the map use VerifyFull
+	IndexHeaderShards      map[ShardKey]struct{}         // shards whose blobs embed the contract and kv index to be checked
+	VerifySampleRate       float64                       // fraction of blobs to verify for VerifySampled shards
+	PreferRange            bool                          // advertise to peers that range requests are preferred
+	MaxListBatchSize       uint64                        // max blobs in a list request of RequestL2List, 0 means maxKvCountPerReq
+	MinVerifiedRatio       float64                       // fraction of in-range blobs verified before a shard is done, 0 means 1
+	SummaryLogInterval     time.Duration                 // interval to log the summary of the sync health
+	StallTimeout           time.Duration                 // interval without any blob committed to treat the sync as stalled
+	ProgressSaveInterval   time.Duration                 // delay to save the sync status after the subTasks progressed
+	MinRangeBatchSize      uint64                        // min blobs in a range request adapted to the peer, 0 means 1
+	MaxRangeBatchSize      uint64                        // max blobs in a range request adapted to the peer, 0 means twice of a max response
+	SchedulePolicy         SchedulePolicy                // how the request slots of the idle peers are shared among the tasks
+	MaxInvalidBlobsPerPeer int                           // invalid blobs allowed from a peer before it is removed and banned, 0 means never
+	MaxDispatchJitter      time.Duration                 // max random delay of a request dispatched in a burst, 0 means no delay
+	Allowlist              []peer.ID                     // peers allowed to sync with, empty means all the peers
+	MaxHealAttempts        int                           // requests of a heal index before it is given up as missing, 0 means never
+	MinPeersBeforeSync     int                           // capable peers connected before the sync starts, 0 means no wait
+	MinPeersTimeout        time.Duration                 // max time to wait for MinPeersBeforeSync peers before the sync starts anyway
+	EncodeTypePolicy       EncodeTypePolicy              // how the peers with a different encode type of a shard are requested
+	MaxLoad                float64                       // load average per CPU above which the sync is throttled, 0 means never
+	FollowMode             bool                          // keep syncing the blobs appended to the contracts after the sync is done
+	FollowInterval         time.Duration                 // interval to check the growth of the last kv indexes in follow mode
+	MaxPeersPerSubTask     int                           // max number of peers the range of a subTask is split among, 0 or 1 means one peer
+	MaxStatusSize          int                           // max size in bytes of the saved sync tasks, above which a warning is logged
+	RetryCooldown          time.Duration                 // time the retries of a failed blob prefer the peers other than the one failing it
+	KeepAliveInterval      time.Duration                 // interval to ping the idle peers to keep the connections, 0 means never
 }
 
 type SyncState struct {
@@ -153,3 +464,49 @@ type SyncState struct {
 	FillEmptyProgress uint64 `json:"fill_empty_progress"`
 	FillEmptySeconds  uint64 `json:"fill_empty_seconds"`
 }
+
+// PeerStats is the count of the failed responses of a peer in the stream read path.
+type PeerStats struct {
+	StreamResets       uint64 `json:"stream_resets"`       // streams reset by the peer in the middle of a response
+	PartialResponses   uint64 `json:"partial_responses"`   // streams closed before the response is complete
+	MalformedResponses uint64 `json:"malformed_responses"` // responses failed to decompress or decode
+}
+
+// PeerStatus is the snapshot of a connected sync peer exposed by the sync status endpoint.
+type PeerStatus struct {
+	ID         string                      `json:"id"`
+	Direction  string                      `json:"direction"`
+	Shards     map[common.Address][]uint64 `json:"shards"`
+	RangeBatch uint64                      `json:"range_batch"`
+	RTT        int64                       `json:"rtt_ms"`
+	PeerStats
+}
+
+// ShardStatus is the snapshot of the sync and fill empty progress of a shard exposed by the sync status endpoint.
+type ShardStatus struct {
+	Contract           common.Address `json:"contract"`
+	ShardId            uint64         `json:"shard_id"`
+	Done               bool           `json:"done"`
+	SubTaskRemain      int            `json:"sub_task_remain"`
+	HealTaskSize       int            `json:"heal_task_size"`
+	SubEmptyTaskRemain int            `json:"sub_empty_task_remain"`
+	PermanentlyMissing []uint64       `json:"permanently_missing"` // blobs given up as no peer can serve them
+	BlobsPerSec        float64        `json:"blobs_per_sec"`       // moving average of the blobs synced per second
+	ETASeconds         float64        `json:"eta_seconds"`         // estimated seconds to sync the remaining blobs, -1 if unknown
+	SyncState
+}
+
+// SyncEstimate is the estimate of the remaining sync returned by SyncClient.EstimateSync.
+type SyncEstimate struct {
+	BlobsToFetch uint64 `json:"blobs_to_fetch"` // blobs remaining in the sync and heal tasks
+	BytesToFetch uint64 `json:"bytes_to_fetch"` // encoded size of the blobs to fetch
+	Unservable   uint64 `json:"unservable"`     // blobs to fetch which no connected peer can serve
+}
+
+// SyncStatus is the snapshot of the sync client served as JSON by the sync status endpoint.
+type SyncStatus struct {
+	SyncDone bool          `json:"sync_done"`
+	Paused   bool          `json:"paused"`
+	Peers    []PeerStatus  `json:"peers"`
+	Shards   []ShardStatus `json:"shards"`
+}
@@ -4,15 +4,31 @@
 package protocol
 
 import (
+	"bufio"
+	"bytes"
+	"context"
 	"encoding/binary"
+	"errors"
 	"fmt"
+	"hash"
+	"hash/crc32"
 	"io"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
 	"time"
 
 	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/p2p/enode"
 	"github.com/ethereum/go-ethereum/rlp"
+	"github.com/ethstorage/go-ethstorage/ethstorage"
+	prv "github.com/ethstorage/go-ethstorage/ethstorage/prover"
 	"github.com/golang/snappy"
+	"github.com/klauspost/compress/zstd"
 	"github.com/libp2p/go-libp2p/core/network"
+	"github.com/libp2p/go-libp2p/core/peer"
 )
 
 const (
@@ -26,15 +42,118 @@ const (
 	rttEstimateFactor = 0.8
 )
 
+// crc32cTable is the table of the checksums of the blobs responses.
+var crc32cTable = crc32.MakeTable(crc32.Castagnoli)
+
+// errMalformedResponse wraps the errors of the responses read completely but failed to decode.
+var errMalformedResponse = errors.New("malformed response")
+
+// responseFailure is the kind of a response failed in the stream read path, which is counted in PeerStats.
+type responseFailure string
+
+const (
+	responseOK        responseFailure = ""
+	responseReset     responseFailure = "stream_reset" // the stream is reset by the peer in the middle of the response
+	responsePartial   responseFailure = "partial"      // the stream is closed before the response is complete
+	responseMalformed responseFailure = "malformed"    // the response can not be decompressed or decoded
+)
+
+// classifyResponseError returns the kind of the response failure of err returned by a request, the other errors,
+// e.g. failing to open the stream, timeouts and error return codes, are not response failures.
+func classifyResponseError(err error) responseFailure {
+	switch {
+	case err == nil:
+		return responseOK
+	case errors.Is(err, network.ErrReset):
+		return responseReset
+	case errors.Is(err, io.ErrUnexpectedEOF), errors.Is(err, io.EOF):
+		return responsePartial
+	case errors.Is(err, errMalformedResponse), errors.Is(err, snappy.ErrCorrupt), errors.Is(err, snappy.ErrTooLarge):
+		return responseMalformed
+	default:
+		return responseOK
+	}
+}
+
+// zstdEncoder returns the zstd encoder shared by all the streams, as EncodeAll is safe for concurrent use. It is
+// created once it is first used, and the error of creating it is returned each time.
+var zstdEncoder = sync.OnceValues(func() (*zstd.Encoder, error) {
+	return zstd.NewWriter(nil)
+})
+
+// compressPayload compresses the payload of a sync response, it only applies to the transport and the encode
+// type of the blobs in the payload is unchanged.
+func compressPayload(payload []byte) ([]byte, error) {
+	encoder, err := zstdEncoder()
+	if err != nil {
+		return nil, fmt.Errorf("failed to create zstd encoder: %w", err)
+	}
+	return encoder.EncodeAll(payload, nil), nil
+}
+
+// newZstdDecoder returns a function creating the zstd decoder of the compressed responses once it is first used,
+// the decompressed size of a response is limited by maxDecodedSize. DecodeAll of the decoder is safe for
+// concurrent use, so it is shared by all the peers.
+func newZstdDecoder(maxDecodedSize uint64) func() (*zstd.Decoder, error) {
+	return sync.OnceValues(func() (*zstd.Decoder, error) {
+		return zstd.NewReader(nil, zstd.WithDecoderMaxMemory(maxDecodedSize))
+	})
+}
+
+// defaultZstdDecoder is the decoder of the compressed responses of the peers not created by a SyncClient, sized for
+// the default max response size.
+var defaultZstdDecoder = newZstdDecoder(defaultMaxDecodedSize)
+
+// decompressPayload decompresses the payload of a sync response, whose decompressed size is limited by the max
+// memory of the decoder.
+func decompressPayload(decoder func() (*zstd.Decoder, error), payload []byte) ([]byte, error) {
+	d, err := decoder()
+	if err != nil {
+		return nil, fmt.Errorf("failed to create zstd decoder: %w", err)
+	}
+	return d.DecodeAll(payload, nil)
+}
+
+// shortPeerID returns the last 8 characters of the peer id, which is short enough for the log context while
+// still unique among the connected peers.
+func shortPeerID(id peer.ID) string {
+	pid := id.String()
+	if len(pid) <= 8 {
+		return pid
+	}
+	return pid[len(pid)-8:]
+}
+
 func WriteMsg(stream network.Stream, msg *Msg) error {
-	_ = stream.SetWriteDeadline(time.Now().Add(p2pReadWriteTimeout))
+	return writeMsg(stream, msg, p2pReadWriteTimeout)
+}
+
+func writeMsg(stream network.Stream, msg *Msg, timeout time.Duration) error {
+	return writeFramedMsg(stream, msg, timeout, true)
+}
+
+// writeRawMsg is the same as writeMsg, except the payload is written as is instead of being compressed by snappy,
+// e.g. the payload already compressed by zstd.
+func writeRawMsg(stream network.Stream, msg *Msg, timeout time.Duration) error {
+	return writeFramedMsg(stream, msg, timeout, false)
+}
+
+func writeFramedMsg(stream network.Stream, msg *Msg, timeout time.Duration, compress bool) error {
+	_ = stream.SetWriteDeadline(time.Now().Add(timeout))
 	// write return code
 	n, err := stream.Write([]byte{msg.ReturnCode})
 	if err != nil {
 		return err
 	}
 
-	w := snappy.NewBufferedWriter(stream)
+	var (
+		w  io.Writer = stream
+		sw *snappy.Writer
+	)
+	if compress {
+		sw = snappy.NewBufferedWriter(stream)
+		w = sw
+	}
 	// write msg size
 	sizeBytes := make([]byte, 4)
 	binary.BigEndian.PutUint32(sizeBytes, uint32(len(msg.Payload)))
@@ -51,14 +170,30 @@ func WriteMsg(stream network.Stream, msg *Msg) error {
 	if err != nil {
 		return err
 	}
-	if err := w.Close(); err != nil {
-		return fmt.Errorf("failed to finishing writing payload to sync response: %w", err)
+	if sw != nil {
+		if err := sw.Close(); err != nil {
+			return fmt.Errorf("failed to finishing writing payload to sync response: %w", err)
+		}
 	}
 	return nil
 }
 
 func ReadMsg(stream network.Stream) ([]byte, byte, error) {
-	_ = stream.SetReadDeadline(time.Now().Add(p2pReadWriteTimeout))
+	return readMsg(stream, p2pReadWriteTimeout)
+}
+
+func readMsg(stream network.Stream, timeout time.Duration) ([]byte, byte, error) {
+	return readFramedMsg(stream, timeout, true, maxGossipSize)
+}
+
+// readRawMsg is the same as readMsg for the messages written by writeRawMsg, the payload larger than maxSize is
+// rejected before it is read.
+func readRawMsg(stream network.Stream, timeout time.Duration, maxSize uint64) ([]byte, byte, error) {
+	return readFramedMsg(stream, timeout, false, maxSize)
+}
+
+func readFramedMsg(stream network.Stream, timeout time.Duration, compressed bool, maxSize uint64) ([]byte, byte, error) {
+	_ = stream.SetReadDeadline(time.Now().Add(timeout))
 	var returnCode [1]byte
 	if _, err := io.ReadFull(stream, returnCode[:]); err != nil {
 		return nil, clientError, fmt.Errorf("failed to read result part of response: %w", err)
@@ -68,8 +203,11 @@ func ReadMsg(stream network.Stream) ([]byte, byte, error) {
 		return nil, code, requestResultErr(code)
 	}
 
-	var r io.Reader = snappy.NewReader(stream)
-	r = io.LimitReader(r, maxGossipSize)
+	var r io.Reader = stream
+	if compressed {
+		r = snappy.NewReader(stream)
+	}
+	r = io.LimitReader(r, int64(maxSize))
 	sizeBytes := make([]byte, 4)
 	_, err := io.ReadFull(r, sizeBytes)
 	if err != nil {
@@ -77,6 +215,9 @@ func ReadMsg(stream network.Stream) ([]byte, byte, error) {
 	}
 
 	size := binary.BigEndian.Uint32(sizeBytes)
+	if !compressed && uint64(size) > maxSize {
+		return nil, code, fmt.Errorf("%w: payload size %d exceeds the max size %d", errMalformedResponse, size, maxSize)
+	}
 
 	payload := make([]byte, size)
 	_, err = io.ReadFull(r, payload)
@@ -116,14 +257,279 @@ func SendRPC(stream network.Stream, req interface{}, resp interface{}) (byte, er
 		return returnCode, err
 	}
 
-	return returnCode, rlp.DecodeBytes(msg, resp)
+	if err := rlp.DecodeBytes(msg, resp); err != nil {
+		return returnCode, fmt.Errorf("%w: %v", errMalformedResponse, err)
+	}
+	return returnCode, nil
+}
+
+// SendCompressedRPC is the same as SendRPC, except the response payload is compressed by zstd only instead of snappy,
+// and it is decompressed by the decoder before decoded.
+func SendCompressedRPC(stream network.Stream, decoder func() (*zstd.Decoder, error), maxDecodedSize uint64,
+	req interface{}, resp interface{}) (byte, error) {
+	s, err := Send(stream, req)
+	if err != nil {
+		return clientError, err
+	}
+
+	// the compressed payload is not larger than the decompressed one
+	msg, returnCode, err := readRawMsg(s, p2pReadWriteTimeout, maxDecodedSize)
+	if err != nil {
+		return returnCode, err
+	}
+	msg, err = decompressPayload(decoder, msg)
+	if err != nil {
+		return clientError, fmt.Errorf("%w: failed to decompress response: %v", errMalformedResponse, err)
+	}
+
+	if err := rlp.DecodeBytes(msg, resp); err != nil {
+		return returnCode, fmt.Errorf("%w: %v", errMalformedResponse, err)
+	}
+	return returnCode, nil
+}
+
+// SendStreamedRPC is the same as SendRPC for the range requests served by RequestStreamedBlobsByRangeProtocolID, the
+// blobs of the response are read from the stream frame by frame, and a frame larger than maxFrameSize fails the request.
+// The read deadline of each frame is not later than the deadline of ctx, and the reading stops once ctx is done.
+// The frames are followed by the checksum footer if req.Checksum is set, which is returned in resp.Checksum.
+func SendStreamedRPC(ctx context.Context, stream network.Stream, req *GetBlobsByRangePacket, maxFrameSize uint64,
+	resp *BlobsByRangePacket) (byte, error) {
+	return sendStreamedRPC(ctx, stream, req, false, maxFrameSize, nil, resp)
+}
+
+// SendCompressedStreamedRPC is the same as SendStreamedRPC for the range requests served by
+// RequestCompressedStreamedBlobsByRangeProtocolID, whose frames and checksum footer are read from a zstd stream.
+func SendCompressedStreamedRPC(ctx context.Context, stream network.Stream, req *GetBlobsByRangePacket,
+	maxFrameSize uint64, resp *BlobsByRangePacket) (byte, error) {
+	return sendStreamedRPC(ctx, stream, req, true, maxFrameSize, nil, resp)
+}
+
+// sendStreamedRPC is SendStreamedRPC reading the frames into the buffers of the pool, nil to allocate them, and
+// decompressing them by zstd if compressed is set.
+func sendStreamedRPC(ctx context.Context, stream network.Stream, req *GetBlobsByRangePacket, compressed bool,
+	maxFrameSize uint64, bufPool *blobBufferPool, resp *BlobsByRangePacket) (byte, error) {
+	s, err := Send(stream, req)
+	if err != nil {
+		return clientError, err
+	}
+
+	_ = s.SetReadDeadline(readDeadline(ctx))
+	var returnCode [1]byte
+	if _, err := io.ReadFull(s, returnCode[:]); err != nil {
+		return clientError, fmt.Errorf("failed to read result part of response: %w", err)
+	}
+	if code := returnCode[0]; code != 0 {
+		return code, requestResultErr(code)
+	}
+
+	resp.ID, resp.Contract, resp.ShardId = req.ID, req.Contract, req.ShardId
+	resp.Blobs = make([]*BlobPayload, 0)
+	sr := &streamReader{r: s}
+	var r io.Reader = bufio.NewReader(sr)
+	if compressed {
+		d, err := newFrameDecoder(sr)
+		if err != nil {
+			return clientError, err
+		}
+		defer d.Close()
+		r = d
+	}
+	for {
+		if err := ctx.Err(); err != nil {
+			return clientError, err
+		}
+		// the deadline is extended for each frame, so a long response is not cut off while the peer keeps sending
+		_ = s.SetReadDeadline(readDeadline(ctx))
+		frame, err := readFrame(r, maxFrameSize, bufPool)
+		if err != nil {
+			return clientError, sr.malformed(err)
+		}
+		if frame == nil {
+			break
+		}
+		// the decoded payload copies the blob, so the frame is returned to the pool right after decoding
+		var payload BlobPayload
+		err = rlp.DecodeBytes(frame, &payload)
+		bufPool.put(frame)
+		if err != nil {
+			return clientError, fmt.Errorf("%w: failed to decode blob frame: %v", errMalformedResponse, err)
+		}
+		resp.Blobs = append(resp.Blobs, &payload)
+	}
+	// the checksum footer follows the end frame, and is verified against the blobs by the requester
+	if req.Checksum {
+		var footer [4]byte
+		if _, err := io.ReadFull(r, footer[:]); err != nil {
+			return clientError, fmt.Errorf("%w: failed to read checksum footer: %v", errMalformedResponse, err)
+		}
+		resp.Checksum = binary.BigEndian.Uint32(footer[:])
+	}
+	if err := s.CloseRead(); err != nil {
+		return clientError, fmt.Errorf("failed to close reading side")
+	}
+	return returnCodeSuccess, nil
+}
+
+// readDeadline returns the deadline to read the next part of a response, which is p2pReadWriteTimeout from now but not
+// later than the deadline of ctx.
+func readDeadline(ctx context.Context) time.Time {
+	deadline := time.Now().Add(p2pReadWriteTimeout)
+	if d, ok := ctx.Deadline(); ok && d.Before(deadline) {
+		return d
+	}
+	return deadline
+}
+
+// frameWriter buffers the frames of a streamed response written to the stream, which are sent once flushed.
+type frameWriter interface {
+	io.Writer
+	Flush() error
+}
+
+// newFrameWriter returns the writer of the frames of a streamed response to w, which compresses them in a zstd
+// stream if compressed is set. The writer is closed by closeFrameWriter once all the frames are written.
+func newFrameWriter(w io.Writer, compressed bool) (frameWriter, error) {
+	if !compressed {
+		return bufio.NewWriter(w), nil
+	}
+	// the window is bounded, so the memory of the decoder of the requester does not grow with the response
+	encoder, err := zstd.NewWriter(w, zstd.WithEncoderConcurrency(1), zstd.WithWindowSize(streamedWindowSize))
+	if err != nil {
+		return nil, fmt.Errorf("failed to create zstd encoder: %w", err)
+	}
+	return encoder, nil
+}
+
+// newFrameDecoder returns the zstd decoder of the frames of a compressed streamed response read from r, which is
+// closed once the response is read.
+func newFrameDecoder(r io.Reader) (*zstd.Decoder, error) {
+	d, err := zstd.NewReader(r, zstd.WithDecoderConcurrency(1), zstd.WithDecoderMaxWindow(streamedWindowSize))
+	if err != nil {
+		return nil, fmt.Errorf("failed to create zstd decoder: %w", err)
+	}
+	return d, nil
+}
+
+// streamReader records the error of reading the stream of a streamed response, so the errors of decompressing the
+// frames are told apart from the errors of the stream.
+type streamReader struct {
+	r   io.Reader
+	err error
+}
+
+func (r *streamReader) Read(p []byte) (int, error) {
+	n, err := r.r.Read(p)
+	if err != nil {
+		r.err = err
+	}
+	return n, err
+}
+
+// malformed marks err of reading the frames as a malformed response if the stream was read without an error, e.g.
+// the frames can not be decompressed.
+func (r *streamReader) malformed(err error) error {
+	if r.err != nil || errors.Is(err, errMalformedResponse) {
+		return err
+	}
+	return fmt.Errorf("%w: %v", errMalformedResponse, err)
+}
+
+// closeFrameWriter flushes the frames buffered by w, and finishes the zstd stream if they are compressed.
+func closeFrameWriter(w frameWriter) error {
+	if c, ok := w.(io.Closer); ok {
+		return c.Close()
+	}
+	return w.Flush()
+}
+
+// writeFrame writes the frame prefixed with its length to w, an empty frame marks the end of the frames.
+func writeFrame(w io.Writer, frame []byte) error {
+	sizeBytes := make([]byte, 4)
+	binary.BigEndian.PutUint32(sizeBytes, uint32(len(frame)))
+	if _, err := w.Write(sizeBytes); err != nil {
+		return err
+	}
+	_, err := w.Write(frame)
+	return err
+}
+
+// encodeFrame encodes the blob with its metadata into a buffer of bufPool, which is returned to the pool once the
+// frame is written.
+func encodeFrame(payload *BlobPayload, bufPool *blobBufferPool) ([]byte, error) {
+	buf := bytes.NewBuffer(bufPool.get(0))
+	if err := rlp.Encode(buf, payload); err != nil {
+		bufPool.put(buf.Bytes())
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// readFrame reads a length prefixed frame from r into a buffer of bufPool, and returns nil once the end of the frames
+// is read. The buffer is fully overwritten by the frame, or not returned if the frame is not read completely.
+func readFrame(r io.Reader, maxFrameSize uint64, bufPool *blobBufferPool) ([]byte, error) {
+	sizeBytes := make([]byte, 4)
+	if _, err := io.ReadFull(r, sizeBytes); err != nil {
+		return nil, fmt.Errorf("failed to read frame size: %w", err)
+	}
+	size := binary.BigEndian.Uint32(sizeBytes)
+	if size == 0 {
+		return nil, nil
+	}
+	if uint64(size) > maxFrameSize {
+		return nil, fmt.Errorf("%w: frame size %d exceeds the max frame size %d", errMalformedResponse, size, maxFrameSize)
+	}
+	frame := bufPool.get(int(size))
+	if _, err := io.ReadFull(r, frame); err != nil {
+		bufPool.put(frame)
+		return nil, fmt.Errorf("failed to read frame: %w", err)
+	}
+	return frame, nil
+}
+
+// blobsChecksum returns the CRC-32C of the blobs with their metadata, which is appended to the blobs responses as
+// a footer if requested, so the corrupted blobs are rejected before they are decoded and verified by their commits.
+func blobsChecksum(blobs []*BlobPayload) uint32 {
+	h := crc32.New(crc32cTable)
+	for _, blob := range blobs {
+		writeBlobChecksum(h, blob)
+	}
+	return h.Sum32()
+}
+
+// writeBlobChecksum adds the blob with its metadata to the checksum h, so the checksum of the streamed blobs is
+// computed as they are written.
+func writeBlobChecksum(h hash.Hash32, blob *BlobPayload) {
+	if blob == nil {
+		return
+	}
+	var buf [8]byte
+	binary.BigEndian.PutUint64(buf[:], blob.BlobIndex)
+	h.Write(buf[:])
+	h.Write(blob.MinerAddress.Bytes())
+	h.Write(blob.BlobCommit.Bytes())
+	binary.BigEndian.PutUint64(buf[:], blob.EncodeType)
+	h.Write(buf[:])
+	h.Write(blob.EncodedBlob)
+}
+
+// verifyBlobsChecksum checks the blobs of a response against the checksum footer of the response.
+func verifyBlobsChecksum(blobs []*BlobPayload, checksum uint32) error {
+	if actual := blobsChecksum(blobs); actual != checksum {
+		return fmt.Errorf("%w: blobs checksum %08x mismatches the footer %08x", errMalformedResponse, actual, checksum)
+	}
+	return nil
 }
 
+// ConvertToContractShards converts the shards of the contracts to a list sorted by contract, so the encoding
+// of the same shards is deterministic.
 func ConvertToContractShards(shards map[common.Address][]uint64) []*ContractShards {
 	cs := make([]*ContractShards, 0)
 	for contract, shardIds := range shards {
 		cs = append(cs, &ContractShards{contract, shardIds})
 	}
+	sort.Slice(cs, func(i, j int) bool {
+		return bytes.Compare(cs[i].Contract.Bytes(), cs[j].Contract.Bytes()) < 0
+	})
 	return cs
 }
 
@@ -131,8 +537,221 @@ func ConvertToShardList(css []*ContractShards) map[common.Address][]uint64 {
 	shards := make(map[common.Address][]uint64)
 	if css != nil {
 		for _, cs := range css {
-			shards[cs.Contract] = cs.ShardIds
+			if cs == nil {
+				continue
+			}
+			if _, ok := shards[cs.Contract]; !ok {
+				shards[cs.Contract] = make([]uint64, 0, len(cs.ShardIds))
+			}
+			// merge the shards of a contract listed more than once
+			for _, shardId := range cs.ShardIds {
+				if !slices.Contains(shards[cs.Contract], shardId) {
+					shards[cs.Contract] = append(shards[cs.Contract], shardId)
+				}
+			}
 		}
 	}
 	return shards
 }
+
+// ShardOverlap returns the number of the local shards which are also in the remote contract shards, e.g. the
+// shards advertised in the ENR of a discovered node, so the peers which can serve more local shards rank higher.
+func ShardOverlap(local map[common.Address][]uint64, remote []*ContractShards) int {
+	overlap := 0
+	for contract, shardIds := range ConvertToShardList(remote) {
+		for _, shardId := range local[contract] {
+			if slices.Contains(shardIds, shardId) {
+				overlap++
+			}
+		}
+	}
+	return overlap
+}
+
+// RankNodesByShardOverlap sorts the nodes in place in the descending order of the overlap between the shards
+// advertised in their ENRs and the local shards, the nodes without an ethstorage ENR entry rank last. The sort
+// is stable, so the random order of the discovery is kept for the nodes with the same overlap.
+func RankNodesByShardOverlap(nodes []*enode.Node, local map[common.Address][]uint64) {
+	overlaps := make(map[enode.ID]int, len(nodes))
+	for _, node := range nodes {
+		var dat EthStorageENRData
+		if err := node.Load(&dat); err != nil {
+			overlaps[node.ID()] = -1
+			continue
+		}
+		overlaps[node.ID()] = ShardOverlap(local, dat.Shards)
+	}
+	sort.SliceStable(nodes, func(i, j int) bool {
+		return overlaps[nodes[i].ID()] > overlaps[nodes[j].ID()]
+	})
+}
+
+// ParseShardVerifyStrictness parses the per-shard verify strictness in the format of
+// [<contract>:]<shardId>:<level>;[<contract>:]<shardId>:<level>;... where level is one of full, sampled or trusted,
+// and the shards without a contract are the shards of the contract the node is started with.
+// For example: 0:full;1:sampled;0x804C520d3c084C805E37A35E90057Ac32831F96f:2:trusted
+func ParseShardVerifyStrictness(str string) (map[ShardKey]VerifyStrictness, error) {
+	levels := make(map[ShardKey]VerifyStrictness)
+	for _, item := range strings.Split(str, ";") {
+		item := strings.TrimSpace(item)
+		if item == "" {
+			continue
+		}
+		sep := strings.LastIndex(item, ":")
+		if sep < 0 {
+			return nil, fmt.Errorf("invalid shard verify strictness: %s", item)
+		}
+		key, err := parseShardKey(item[:sep])
+		if err != nil {
+			return nil, fmt.Errorf("invalid shard in verify strictness %s: %w", item, err)
+		}
+		switch strings.ToLower(strings.TrimSpace(item[sep+1:])) {
+		case VerifyFull.String():
+			levels[key] = VerifyFull
+		case VerifySampled.String():
+			levels[key] = VerifySampled
+		case VerifyTrusted.String():
+			levels[key] = VerifyTrusted
+		default:
+			return nil, fmt.Errorf("unknown verify strictness level: %s", item[sep+1:])
+		}
+	}
+	return levels, nil
+}
+
+// ParseShardIds parses a comma separated list of shards in the format of [<contract>:]<shardId>, and the shards
+// without a contract are the shards of the contract the node is started with. For example: 0,1,0x804C...F96f:2
+func ParseShardIds(str string) (map[ShardKey]struct{}, error) {
+	shardIds := make(map[ShardKey]struct{})
+	for _, item := range strings.Split(str, ",") {
+		item := strings.TrimSpace(item)
+		if item == "" {
+			continue
+		}
+		key, err := parseShardKey(item)
+		if err != nil {
+			return nil, err
+		}
+		shardIds[key] = struct{}{}
+	}
+	return shardIds, nil
+}
+
+// parseShardKey parses a shard in the format of [<contract>:]<shardId>.
+func parseShardKey(str string) (ShardKey, error) {
+	var key ShardKey
+	shardId := str
+	if contract, id, ok := strings.Cut(str, ":"); ok {
+		contract = strings.TrimSpace(contract)
+		if !common.IsHexAddress(contract) {
+			return key, fmt.Errorf("invalid contract %s", contract)
+		}
+		key.Contract, shardId = common.HexToAddress(contract), id
+	}
+	id, err := strconv.ParseUint(strings.TrimSpace(shardId), 10, 64)
+	if err != nil {
+		return key, fmt.Errorf("invalid shard id %s: %w", shardId, err)
+	}
+	key.ShardId = id
+	return key, nil
+}
+
+// primaryShardKeys returns a copy of m with the shards without a contract assigned to the primary contract.
+func primaryShardKeys[V any](m map[ShardKey]V, primary common.Address) map[ShardKey]V {
+	keys := make(map[ShardKey]V, len(m))
+	for key, v := range m {
+		if key.Contract == (common.Address{}) {
+			key.Contract = primary
+		}
+		keys[key] = v
+	}
+	return keys
+}
+
+// ParseSchedulePolicy parses the schedule policy of the sync tasks, which is one of round-robin or weighted,
+// an empty string means round-robin.
+func ParseSchedulePolicy(str string) (SchedulePolicy, error) {
+	switch strings.ToLower(strings.TrimSpace(str)) {
+	case "", ScheduleRoundRobin.String():
+		return ScheduleRoundRobin, nil
+	case ScheduleWeighted.String():
+		return ScheduleWeighted, nil
+	default:
+		return ScheduleRoundRobin, fmt.Errorf("unknown schedule policy: %s", str)
+	}
+}
+
+// VerifyChunkProof verifies the chunk proof returned by RequestChunkProof against the commit of the blob, e.g. read
+// from L1, so the chunk is proved to be the chunk of the blob without the full blob.
+func VerifyChunkProof(prover *prv.KZGProver, res *ChunkProofPacket, commit common.Hash) error {
+	versionedHash, value, err := prover.VerifyKZGProof(res.Proof, res.ChunkIdx)
+	if err != nil {
+		return err
+	}
+	if !bytes.Equal(versionedHash[:ethstorage.HashSizeInContract], commit[:ethstorage.HashSizeInContract]) {
+		return fmt.Errorf("proof of blob %s does not match commit %s", versionedHash.Hex(), commit.Hex())
+	}
+	if !bytes.Equal(value, res.Chunk) {
+		return fmt.Errorf("chunk %d does not match the proved value", res.ChunkIdx)
+	}
+	return nil
+}
+
+// ParseEncodeTypePolicy parses the encode type policy from its name, an empty string means EncodeTypeReEncode.
+func ParseEncodeTypePolicy(str string) (EncodeTypePolicy, error) {
+	switch strings.ToLower(strings.TrimSpace(str)) {
+	case "", EncodeTypeReEncode.String():
+		return EncodeTypeReEncode, nil
+	case EncodeTypeRejectMismatch.String():
+		return EncodeTypeRejectMismatch, nil
+	case EncodeTypePreferMatch.String():
+		return EncodeTypePreferMatch, nil
+	default:
+		return EncodeTypeReEncode, fmt.Errorf("unknown encode type policy: %s", str)
+	}
+}
+
+// contiguousRange returns the first and last index of the indexes, and whether the indexes
+// are contiguous without duplication, the order of the indexes does not matter.
+func contiguousRange(indexes []uint64) (uint64, uint64, bool) {
+	if len(indexes) == 0 {
+		return 0, 0, false
+	}
+	first, last := indexes[0], indexes[0]
+	seen := make(map[uint64]struct{}, len(indexes))
+	for _, idx := range indexes {
+		if _, ok := seen[idx]; ok {
+			return first, last, false
+		}
+		seen[idx] = struct{}{}
+		if idx < first {
+			first = idx
+		}
+		if idx > last {
+			last = idx
+		}
+	}
+	return first, last, last-first+1 == uint64(len(indexes))
+}
+
+// coalesceIndexes splits the indexes into the runs of at least minRun contiguous indexes, each as its first and
+// last index, and the sparse indexes left, both in ascending order. The duplicated indexes are coalesced.
+func coalesceIndexes(indexes []uint64, minRun int) ([][2]uint64, []uint64) {
+	sorted := slices.Clone(indexes)
+	slices.Sort(sorted)
+	sorted = slices.Compact(sorted)
+	ranges, sparse := make([][2]uint64, 0), make([]uint64, 0)
+	for i := 0; i < len(sorted); {
+		j := i + 1
+		for j < len(sorted) && sorted[j] == sorted[j-1]+1 {
+			j++
+		}
+		if j-i >= minRun {
+			ranges = append(ranges, [2]uint64{sorted[i], sorted[j-1]})
+		} else {
+			sparse = append(sparse, sorted[i:j]...)
+		}
+		i = j
+	}
+	return ranges, sparse
+}
@@ -0,0 +1,82 @@
+// Copyright 2022-2023, EthStorage.
+// For license information, see https://github.com/ethstorage/es-node/blob/main/LICENSE
+
+package protocol
+
+import (
+	"context"
+	"errors"
+
+	"github.com/ethereum/go-ethereum/common"
+)
+
+var errWriteQueueClosed = errors.New("write queue closed")
+
+// writeJob is a batch of the decoded blobs of a response to be committed to the storage manager.
+type writeJob struct {
+	sm           StorageManager
+	kvIndices    []uint64
+	decodedBlobs [][]byte
+	commits      []common.Hash
+	force        bool // overwrite the local blobs
+	done         chan writeResult
+}
+
+type writeResult struct {
+	inserted []uint64
+	err      error
+}
+
+// writeQueue is a bounded queue between the receive path and a single disk writer, so when the disk writes fall
+// behind the network receive, the receivers block on submit instead of buffering the decoded blobs in memory
+// without a bound.
+type writeQueue struct {
+	jobs     chan *writeJob
+	commit   func(sm StorageManager, kvIndices []uint64, decodedBlobs [][]byte, commits []common.Hash, force bool) ([]uint64, error)
+	setDepth func(depth int) // reports the number of the queued batches, e.g. to the metrics
+}
+
+func newWriteQueue(size int, commit func(sm StorageManager, kvIndices []uint64, decodedBlobs [][]byte,
+	commits []common.Hash, force bool) ([]uint64, error), setDepth func(depth int)) *writeQueue {
+	return &writeQueue{jobs: make(chan *writeJob, size), commit: commit, setDepth: setDepth}
+}
+
+// loop writes the queued batches one by one until ctx is done.
+func (q *writeQueue) loop(ctx context.Context) {
+	for {
+		select {
+		case job := <-q.jobs:
+			q.setDepth(len(q.jobs))
+			inserted, err := q.commit(job.sm, job.kvIndices, job.decodedBlobs, job.commits, job.force)
+			job.done <- writeResult{inserted: inserted, err: err}
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// submit queues the batch and waits until it is written, it blocks while the queue is full. The local blobs are
+// overwritten if force. It returns errWriteQueueClosed if ctx is done before the batch is written.
+func (q *writeQueue) submit(ctx context.Context, sm StorageManager, kvIndices []uint64, decodedBlobs [][]byte,
+	commits []common.Hash, force bool) ([]uint64, error) {
+	job := &writeJob{
+		sm:           sm,
+		kvIndices:    kvIndices,
+		decodedBlobs: decodedBlobs,
+		commits:      commits,
+		force:        force,
+		done:         make(chan writeResult, 1),
+	}
+	select {
+	case q.jobs <- job:
+		q.setDepth(len(q.jobs))
+	case <-ctx.Done():
+		return nil, errWriteQueueClosed
+	}
+	select {
+	case res := <-job.done:
+		return res.inserted, res.err
+	case <-ctx.Done():
+		return nil, errWriteQueueClosed
+	}
+}
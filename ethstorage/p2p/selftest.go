@@ -0,0 +1,214 @@
+package p2p
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/core/rawdb"
+	"github.com/ethereum/go-ethereum/event"
+	"github.com/ethereum/go-ethereum/log"
+	"github.com/ethstorage/go-ethstorage/ethstorage"
+	"github.com/ethstorage/go-ethstorage/ethstorage/p2p/protocol"
+	prv "github.com/ethstorage/go-ethstorage/ethstorage/prover"
+	"github.com/libp2p/go-libp2p"
+	"github.com/libp2p/go-libp2p/core/host"
+	"github.com/libp2p/go-libp2p/core/network"
+	"github.com/libp2p/go-libp2p/core/peer"
+)
+
+const (
+	// selfTestKvSize is the size of the synthetic blobs, which is the size of an EIP-4844 blob to get the KZG roots.
+	selfTestKvSize = 4096 * 32
+	// selfTestKvEntries is the number of the synthetic blobs synced by the self-test.
+	selfTestKvEntries = 16
+	// selfTestTimeout is the max time for the self-test to sync the synthetic blobs.
+	selfTestTimeout = time.Minute
+)
+
+// selfTestContract is the synthetic contract of the self-test, which must not be a contract stored by the node.
+var selfTestContract = common.HexToAddress("0x000000000000000000000000000000005e1f7e57")
+
+// selfTestL1Source serves the metas of the synthetic blobs to the storage managers of the self-test.
+type selfTestL1Source struct {
+	metas [][32]byte
+}
+
+func (l1 *selfTestL1Source) GetKvMetas(kvIndices []uint64, blockNumber int64) ([][32]byte, error) {
+	metas := make([][32]byte, 0, len(kvIndices))
+	for _, idx := range kvIndices {
+		if idx >= uint64(len(l1.metas)) {
+			return nil, fmt.Errorf("kv index %d out of range", idx)
+		}
+		metas = append(metas, l1.metas[idx])
+	}
+	return metas, nil
+}
+
+func (l1 *selfTestL1Source) GetStorageLastBlobIdx(blockNumber int64) (uint64, error) {
+	return uint64(len(l1.metas)), nil
+}
+
+// SelfTest validates the sync stack end to end: it serves a shard of synthetic blobs by a sync server on an in-process
+// host, syncs the shard to an empty storage by a sync client on another host with the syncer params of the node, and
+// verifies the synced blobs. It returns nil if the self-test passes. It should be called before the node starts, as
+// the synthetic contract is registered to ethstorage.ContractToShardManager during the self-test.
+func (n *NodeP2P) SelfTest(ctx context.Context) error {
+	ctx, cancel := context.WithTimeout(ctx, selfTestTimeout)
+	defer cancel()
+	dir, err := os.MkdirTemp("", "es-node-selftest")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(dir)
+	defer delete(ethstorage.ContractToShardManager, selfTestContract)
+
+	blobs, roots, l1, err := selfTestBlobs()
+	if err != nil {
+		return err
+	}
+	srvSm, err := selfTestStorage(filepath.Join(dir, "server.dat"), l1)
+	if err != nil {
+		return err
+	}
+	defer srvSm.Close()
+	// the blobs are verified against the metas when they are committed or synced
+	if err := srvSm.DownloadAllMetas(ctx, selfTestKvEntries); err != nil {
+		return err
+	}
+	for idx, blob := range blobs {
+		if err := srvSm.CommitBlob(uint64(idx), blob, roots[idx]); err != nil {
+			return fmt.Errorf("commit blob %d failed: %w", idx, err)
+		}
+	}
+	clSm, err := selfTestStorage(filepath.Join(dir, "client.dat"), l1)
+	if err != nil {
+		return err
+	}
+	defer clSm.Close()
+	if err := clSm.DownloadAllMetas(ctx, selfTestKvEntries); err != nil {
+		return err
+	}
+
+	srvHost, err := libp2p.New(libp2p.ListenAddrStrings("/ip4/127.0.0.1/tcp/0"), libp2p.DisableRelay())
+	if err != nil {
+		return fmt.Errorf("failed to start self-test server host: %w", err)
+	}
+	defer srvHost.Close()
+	clHost, err := libp2p.New(libp2p.NoListenAddrs, libp2p.DisableRelay())
+	if err != nil {
+		return fmt.Errorf("failed to start self-test client host: %w", err)
+	}
+	defer clHost.Close()
+
+	lg := log.New("p2p", "selftest")
+	syncSrv := protocol.NewSyncServer(n.rollupCfg, srvSm, rawdb.NewMemoryDatabase(), nil)
+	defer syncSrv.Close()
+	n.serveSelfTest(ctx, srvHost, syncSrv, lg)
+
+	// the blobs appended after the self-test is done are not followed
+	params := *n.syncParams
+	params.FollowMode = false
+	feed := new(event.Feed)
+	syncCl := protocol.NewSyncClient(lg, n.rollupCfg, clHost.NewStream, clSm, &params, rawdb.NewMemoryDatabase(), nil, feed)
+	doneCh := make(chan protocol.EthStorageSyncDone, 16)
+	sub := feed.Subscribe(doneCh)
+	defer sub.Unsubscribe()
+	if err := syncCl.Start(); err != nil {
+		return err
+	}
+	defer syncCl.Close()
+
+	if err := clHost.Connect(ctx, peer.AddrInfo{ID: srvHost.ID(), Addrs: srvHost.Addrs()}); err != nil {
+		return fmt.Errorf("failed to connect self-test hosts: %w", err)
+	}
+	shards := map[common.Address][]uint64{selfTestContract: {0}}
+	if !syncCl.AddPeer(srvHost.ID(), shards, network.DirOutbound) {
+		return errors.New("failed to add self-test server peer")
+	}
+	for done := false; !done; {
+		select {
+		case ev := <-doneCh:
+			done = ev.DoneType == protocol.AllShardDone
+		case <-ctx.Done():
+			return fmt.Errorf("self-test sync is not done: %w", ctx.Err())
+		}
+	}
+
+	for idx, blob := range blobs {
+		synced, ok, err := clSm.TryRead(uint64(idx), len(blob), roots[idx])
+		if !ok || err != nil {
+			return fmt.Errorf("read synced blob %d failed: %v", idx, err)
+		}
+		if !bytes.Equal(synced, blob) {
+			return fmt.Errorf("synced blob %d mismatches", idx)
+		}
+	}
+	lg.Info("Sync self-test passed", "blobs", len(blobs))
+	return nil
+}
+
+// serveSelfTest registers the handlers of the sync protocols requested by the sync client to the server host.
+func (n *NodeP2P) serveSelfTest(ctx context.Context, h host.Host, syncSrv *protocol.SyncServer, lg log.Logger) {
+	blobByRangeHandler := protocol.MakeStreamHandler(ctx, lg, syncSrv.HandleGetBlobsByRangeRequest)
+	h.SetStreamHandler(protocol.GetProtocolID(protocol.RequestBlobsByRangeProtocolID, n.rollupCfg.L2ChainID), n.authSync(blobByRangeHandler))
+	blobByListHandler := protocol.MakeStreamHandler(ctx, lg, syncSrv.HandleGetBlobsByListRequest)
+	h.SetStreamHandler(protocol.GetProtocolID(protocol.RequestBlobsByListProtocolID, n.rollupCfg.L2ChainID), n.authSync(blobByListHandler))
+	requestCapabilitiesHandler := protocol.MakeStreamHandler(ctx, lg, syncSrv.HandleRequestCapabilities)
+	h.SetStreamHandler(protocol.RequestCapabilities, n.authSync(requestCapabilitiesHandler))
+	requestLastKvIndexHandler := protocol.MakeStreamHandler(ctx, lg, syncSrv.HandleRequestLastKvIndex)
+	h.SetStreamHandler(protocol.RequestLastKvIndex, n.authSync(requestLastKvIndexHandler))
+}
+
+// selfTestBlobs generates the synthetic blobs, each embeds the contract and the kv index as the index header, the
+// KZG roots of the blobs and the metas of the blobs as stored in the contract.
+func selfTestBlobs() ([][]byte, []common.Hash, *selfTestL1Source, error) {
+	var (
+		prover = prv.NewKZGProver(log.Root())
+		blobs  = make([][]byte, selfTestKvEntries)
+		roots  = make([]common.Hash, selfTestKvEntries)
+		l1     = &selfTestL1Source{metas: make([][32]byte, selfTestKvEntries)}
+	)
+	for i := range blobs {
+		blob := make([]byte, selfTestKvSize)
+		copy(blob[:common.AddressLength], selfTestContract.Bytes())
+		binary.BigEndian.PutUint64(blob[common.AddressLength:], uint64(i))
+		root, err := prover.GetRoot(blob, 1, selfTestKvSize)
+		if err != nil {
+			return nil, nil, nil, err
+		}
+		// the meta is the kv index of 5 bytes, the kv size of 3 bytes and the hash of the blob
+		binary.BigEndian.PutUint64(l1.metas[i][:8], uint64(i)<<24|selfTestKvSize)
+		copy(l1.metas[i][8:], root[:ethstorage.HashSizeInContract])
+		blobs[i], roots[i] = blob, root
+	}
+	return blobs, roots, l1, nil
+}
+
+// selfTestStorage creates a storage manager of shard 0 of the synthetic contract in the data file.
+func selfTestStorage(filename string, l1 *selfTestL1Source) (*ethstorage.StorageManager, error) {
+	shardManager := ethstorage.NewShardManager(selfTestContract, selfTestKvSize, selfTestKvEntries, selfTestKvSize)
+	if _, err := ethstorage.Create(filename, 0, selfTestKvEntries, 0, selfTestKvSize, ethstorage.ENCODE_KECCAK_256,
+		common.Address{}, selfTestKvSize); err != nil {
+		return nil, err
+	}
+	df, err := ethstorage.OpenDataFile(filename)
+	if err != nil {
+		return nil, err
+	}
+	if err := shardManager.AddDataFileAndShard(df); err != nil {
+		return nil, err
+	}
+	sm := ethstorage.NewStorageManager(shardManager, l1)
+	if err := sm.Reset(0); err != nil {
+		sm.Close()
+		return nil, err
+	}
+	return sm, nil
+}
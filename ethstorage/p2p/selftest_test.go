@@ -0,0 +1,34 @@
+package p2p
+
+import (
+	"context"
+	"math/big"
+	"testing"
+
+	"github.com/ethstorage/go-ethstorage/ethstorage"
+	"github.com/ethstorage/go-ethstorage/ethstorage/p2p/protocol"
+	"github.com/ethstorage/go-ethstorage/ethstorage/rollup"
+)
+
+// TestSelfTest tests that the self-test syncs the synthetic blobs between the in-process peers and passes, and that
+// the synthetic contract is unregistered once it is done.
+func TestSelfTest(t *testing.T) {
+	n := &NodeP2P{
+		rollupCfg: &rollup.EsConfig{
+			L2ChainID: new(big.Int).SetUint64(3333),
+		},
+		syncParams: &protocol.SyncerParams{
+			MaxPeers:              30,
+			InitRequestSize:       uint64(4 * 1024 * 1024),
+			SyncConcurrency:       4,
+			FillEmptyConcurrency:  4,
+			MetaDownloadBatchSize: 16,
+		},
+	}
+	if err := n.SelfTest(context.Background()); err != nil {
+		t.Fatalf("self-test failed: %s", err.Error())
+	}
+	if _, ok := ethstorage.ContractToShardManager[selfTestContract]; ok {
+		t.Fatalf("synthetic contract should be unregistered after the self-test")
+	}
+}
@@ -0,0 +1,69 @@
+package p2p
+
+import (
+	"compress/gzip"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+
+	"github.com/ethereum/go-ethereum/log"
+	"github.com/ethstorage/go-ethstorage/ethstorage"
+)
+
+// ServeShardSnapshot writes the snapshot of the local shard to w, which is the shard export of
+// ethstorage.StorageManager.ExportShard compressed by gzip, and returns the number of the blobs in the snapshot.
+// A new node can bootstrap the shard by ImportShardSnapshot in one stream instead of syncing it from the peers.
+func (n *NodeP2P) ServeShardSnapshot(shardIdx uint64, w io.Writer) (uint64, error) {
+	if n.storageManager == nil {
+		return 0, errors.New("storage manager is not initialized")
+	}
+	zw := gzip.NewWriter(w)
+	count, err := n.storageManager.ExportShard(shardIdx, zw)
+	if err != nil {
+		zw.Close()
+		return count, err
+	}
+	return count, zw.Close()
+}
+
+// HandleShardSnapshot serves the snapshot of the local shard given by the shard query parameter over http, e.g.
+// /sync/snapshot?shard=0.
+func (n *NodeP2P) HandleShardSnapshot(w http.ResponseWriter, r *http.Request) {
+	shardIdx, err := strconv.ParseUint(r.URL.Query().Get("shard"), 10, 64)
+	if err != nil {
+		http.Error(w, "invalid shard index", http.StatusBadRequest)
+		return
+	}
+	if n.storageManager == nil {
+		http.Error(w, "storage manager is not initialized", http.StatusServiceUnavailable)
+		return
+	}
+	if _, ok := n.storageManager.GetShardMiner(shardIdx); !ok {
+		http.Error(w, fmt.Sprintf("shard %d not found", shardIdx), http.StatusNotFound)
+		return
+	}
+	w.Header().Set("Content-Type", "application/gzip")
+	w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=\"shard-%d.gz\"", shardIdx))
+	// the status is sent with the first bytes, so a failure in the middle is only detected by the importer, as the
+	// end frame of the export is missing
+	count, err := n.ServeShardSnapshot(shardIdx, w)
+	if err != nil {
+		log.Warn("Failed to serve shard snapshot", "shard", shardIdx, "blobs", count, "err", err)
+		return
+	}
+	log.Info("Served shard snapshot", "shard", shardIdx, "blobs", count, "remote", r.RemoteAddr)
+}
+
+// ImportShardSnapshot reads a snapshot written by NodeP2P.ServeShardSnapshot from r and imports its blobs to the
+// local shard of sm, and returns the number of the imported blobs. Each blob is verified against the commit in its
+// meta by ethstorage.StorageManager.ImportShard.
+func ImportShardSnapshot(sm *ethstorage.StorageManager, r io.Reader) (uint64, error) {
+	zr, err := gzip.NewReader(r)
+	if err != nil {
+		return 0, fmt.Errorf("read snapshot failed: %w", err)
+	}
+	defer zr.Close()
+	return sm.ImportShard(zr)
+}
@@ -0,0 +1,108 @@
+package p2p
+
+import (
+	"bytes"
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/ethstorage/go-ethstorage/ethstorage"
+)
+
+// TestShardSnapshot tests that the snapshot of a shard served over http is imported into a fresh storage, with the
+// same blobs and the same manifest as the served shard.
+func TestShardSnapshot(t *testing.T) {
+	dir, err := os.MkdirTemp("", "es-node-snapshot")
+	if err != nil {
+		t.Fatalf("failed to create temp dir: %s", err.Error())
+	}
+	defer os.RemoveAll(dir)
+	defer delete(ethstorage.ContractToShardManager, selfTestContract)
+
+	blobs, roots, l1, err := selfTestBlobs()
+	if err != nil {
+		t.Fatalf("failed to generate blobs: %s", err.Error())
+	}
+	srvSm, err := selfTestStorage(filepath.Join(dir, "server.dat"), l1)
+	if err != nil {
+		t.Fatalf("failed to create server storage: %s", err.Error())
+	}
+	defer srvSm.Close()
+	if err := srvSm.DownloadAllMetas(context.Background(), selfTestKvEntries); err != nil {
+		t.Fatalf("failed to download server metas: %s", err.Error())
+	}
+	// leave the last blob unsynced, which is not in the snapshot
+	for idx, blob := range blobs[:len(blobs)-1] {
+		if err := srvSm.CommitBlob(uint64(idx), blob, roots[idx]); err != nil {
+			t.Fatalf("failed to commit blob %d: %s", idx, err.Error())
+		}
+	}
+	n := &NodeP2P{storageManager: srvSm}
+	srv := httptest.NewServer(http.HandlerFunc(n.HandleShardSnapshot))
+	defer srv.Close()
+
+	res, err := http.Get(srv.URL + "?shard=1")
+	if err != nil {
+		t.Fatalf("failed to get snapshot: %s", err.Error())
+	}
+	res.Body.Close()
+	if res.StatusCode != http.StatusNotFound {
+		t.Fatalf("snapshot of a shard not found should be rejected, status %d", res.StatusCode)
+	}
+	res, err = http.Get(srv.URL + "?shard=0")
+	if err != nil {
+		t.Fatalf("failed to get snapshot: %s", err.Error())
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		t.Fatalf("unexpected status %d", res.StatusCode)
+	}
+
+	clSm, err := selfTestStorage(filepath.Join(dir, "client.dat"), l1)
+	if err != nil {
+		t.Fatalf("failed to create client storage: %s", err.Error())
+	}
+	defer clSm.Close()
+	if err := clSm.DownloadAllMetas(context.Background(), selfTestKvEntries); err != nil {
+		t.Fatalf("failed to download client metas: %s", err.Error())
+	}
+	count, err := ImportShardSnapshot(clSm, res.Body)
+	if err != nil {
+		t.Fatalf("failed to import snapshot: %s", err.Error())
+	}
+	if count != uint64(len(blobs)-1) {
+		t.Fatalf("imported %d blobs, expected %d", count, len(blobs)-1)
+	}
+	for idx, blob := range blobs[:len(blobs)-1] {
+		imported, ok, err := clSm.TryRead(uint64(idx), len(blob), roots[idx])
+		if !ok || err != nil {
+			t.Fatalf("failed to read imported blob %d: %v", idx, err)
+		}
+		if !bytes.Equal(imported, blob) {
+			t.Fatalf("imported blob %d mismatches", idx)
+		}
+	}
+	srvManifest, err := srvSm.ShardManifest(0)
+	if err != nil {
+		t.Fatalf("failed to build server manifest: %s", err.Error())
+	}
+	clManifest, err := clSm.ShardManifest(0)
+	if err != nil {
+		t.Fatalf("failed to build client manifest: %s", err.Error())
+	}
+	if srvManifest.Hash != clManifest.Hash {
+		t.Fatalf("manifest of the imported shard %s mismatches %s", clManifest.Hash.Hex(), srvManifest.Hash.Hex())
+	}
+
+	// a truncated snapshot is rejected as its end frame is missing
+	var buf bytes.Buffer
+	if _, err := n.ServeShardSnapshot(0, &buf); err != nil {
+		t.Fatalf("failed to serve snapshot: %s", err.Error())
+	}
+	if _, err := ImportShardSnapshot(clSm, bytes.NewReader(buf.Bytes()[:buf.Len()/2])); err == nil {
+		t.Fatalf("truncated snapshot should be rejected")
+	}
+}
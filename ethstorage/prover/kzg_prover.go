@@ -105,6 +105,42 @@ func (p *KZGProver) GenerateKZGProof(data []byte, sampleIdx uint64) ([]byte, err
 	return pointEvalInput, nil
 }
 
+// VerifyKZGProof verifies the point evaluation input generated by GenerateKZGProof for the sample of sampleIdx,
+// and returns the versioned hash of the blob and the claimed value, which is the sample of the blob.
+func (p *KZGProver) VerifyKZGProof(pointEvalInput []byte, sampleIdx uint64) (common.Hash, []byte, error) {
+	if len(pointEvalInput) != 32+32+32+48+48 {
+		return common.Hash{}, nil, fmt.Errorf("invalid point evaluation input size: %v", len(pointEvalInput))
+	}
+	if sampleIdx >= gokzg4844.ScalarsPerBlob {
+		return common.Hash{}, nil, fmt.Errorf("sample index out of scope")
+	}
+	var (
+		versionedHash = common.BytesToHash(pointEvalInput[:32])
+		inputPoint    gokzg4844.Scalar
+		claimedValue  gokzg4844.Scalar
+		commitment    gokzg4844.KZGCommitment
+		proof         gokzg4844.KZGProof
+	)
+	copy(inputPoint[:], pointEvalInput[32:64])
+	copy(claimedValue[:], pointEvalInput[64:96])
+	copy(commitment[:], pointEvalInput[96:144])
+	copy(proof[:], pointEvalInput[144:192])
+
+	// the input point must be the one of the sample, otherwise the proof is of another sample
+	var xe fr.Element
+	expected := gokzg4844.SerializeScalar(*xe.Exp(p.ru, new(big.Int).SetUint64(reverseBits(sampleIdx))))
+	if inputPoint != expected {
+		return common.Hash{}, nil, fmt.Errorf("input point does not match sample %d", sampleIdx)
+	}
+	if hash := eth.KZGToVersionedHash(eth.KZGCommitment(commitment)); !bytes.Equal(hash[:], versionedHash[:]) {
+		return common.Hash{}, nil, fmt.Errorf("versioned hash does not match the commitment")
+	}
+	if err := p.ctx.VerifyKZGProof(commitment, inputPoint, claimedValue, proof); err != nil {
+		return common.Hash{}, nil, fmt.Errorf("failed to verify proof: %v", err)
+	}
+	return versionedHash, claimedValue[:], nil
+}
+
 func reverseBits(x uint64) uint64 {
 	// The standard library's bits.Reverse64 inverts its input as a 64-bit unsigned integer.
 	// However, we need to invert it as a log2(len(list))-bit integer, so we need to correct this by
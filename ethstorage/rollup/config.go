@@ -1,9 +1,99 @@
 package rollup
 
-import "math/big"
+import (
+	"fmt"
+	"math/big"
+	"time"
+)
+
+const (
+	// DefaultSyncMaxConcurrentPerPeer is the default max number of requests in flight to a peer.
+	DefaultSyncMaxConcurrentPerPeer = 1
+	// DefaultSyncMinBatchSize is the default min number of blobs in a range request.
+	DefaultSyncMinBatchSize = 1
+	// DefaultSyncRequestTimeout is the default deadline of a blob by list request.
+	DefaultSyncRequestTimeout = 30 * time.Second
+)
+
+// SyncConfig is the tuning of the sync client. The zero fields fall back to the p2p sync flags, and then the
+// defaults applied by Validate.
+type SyncConfig struct {
+	// Max number of peers to sync with.
+	MaxPeers int `json:"max_peers,omitempty"`
+	// Max number of requests in flight to a peer, which requires MaxPeers to bound the requests in flight.
+	MaxConcurrentPerPeer int `json:"max_concurrent_per_peer,omitempty"`
+	// Min and max number of blobs in a range request adapted to the peer. The max batch size is left to the sync
+	// client if not set, which defaults it to twice of a max response of the blob size.
+	MinBatchSize uint64 `json:"min_batch_size,omitempty"`
+	MaxBatchSize uint64 `json:"max_batch_size,omitempty"`
+	// Deadline of a blob by list request sent to a peer by RequestL2List, after which the batch is abandoned and
+	// requested from another peer.
+	RequestTimeout time.Duration `json:"request_timeout,omitempty"`
+	// Max number of requests of a blob before it is given up as missing, 0 means never.
+	MaxRetries int `json:"max_retries,omitempty"`
+}
+
+// Validate rejects the nonsensical settings, and applies the defaults to the fields not set.
+func (c *SyncConfig) Validate() error {
+	if c.MaxPeers < 0 {
+		return fmt.Errorf("max_peers should not be negative: %d", c.MaxPeers)
+	}
+	if c.MaxConcurrentPerPeer < 0 {
+		return fmt.Errorf("max_concurrent_per_peer should not be negative: %d", c.MaxConcurrentPerPeer)
+	}
+	if c.MaxConcurrentPerPeer > 0 && c.MaxPeers == 0 {
+		return fmt.Errorf("max_concurrent_per_peer %d is set without max_peers", c.MaxConcurrentPerPeer)
+	}
+	if c.MaxBatchSize > 0 && c.MinBatchSize > c.MaxBatchSize {
+		return fmt.Errorf("min_batch_size %d exceeds max_batch_size %d", c.MinBatchSize, c.MaxBatchSize)
+	}
+	if c.RequestTimeout < 0 {
+		return fmt.Errorf("request_timeout should not be negative: %s", c.RequestTimeout)
+	}
+	if c.MaxRetries < 0 {
+		return fmt.Errorf("max_retries should not be negative: %d", c.MaxRetries)
+	}
+	if c.MaxConcurrentPerPeer == 0 {
+		c.MaxConcurrentPerPeer = DefaultSyncMaxConcurrentPerPeer
+	}
+	if c.MinBatchSize == 0 {
+		c.MinBatchSize = DefaultSyncMinBatchSize
+	}
+	if c.RequestTimeout == 0 {
+		c.RequestTimeout = DefaultSyncRequestTimeout
+	}
+	return nil
+}
 
 type EsConfig struct {
 	L2ChainID *big.Int `json:"l2_chain_id"`
+	// Deadlines to read the request from and write the response to the p2p sync streams served by this node,
+	// default values are used if they are not set.
+	StreamReadTimeout  time.Duration `json:"stream_read_timeout,omitempty"`
+	StreamWriteTimeout time.Duration `json:"stream_write_timeout,omitempty"`
+	// Max number of sync requests served concurrently, the excess ones are queued and rejected if not served in time.
+	MaxConcurrentHandlers int `json:"max_concurrent_handlers,omitempty"`
+	// Max number of sync requests queued for serving, the excess ones are rejected at once.
+	MaxQueuedHandlers int `json:"max_queued_handlers,omitempty"`
+	// Max total size in bytes of the encoded blobs cached for serving the sync requests.
+	BlobCacheSize uint64 `json:"blob_cache_size,omitempty"`
+	// Serve and request the blobs by range compressed on the wire, the uncompressed protocol is used with the peers
+	// which do not support it.
+	CompressionEnabled bool `json:"compression_enabled,omitempty"`
+	// Max total size in bytes of the blobs in a sync response served by this node, default value is used if not set.
+	MaxResponseSize uint64 `json:"max_response_size,omitempty"`
+	// Request the blobs by range streamed in length prefixed frames, so a peer writes each blob once it is read
+	// instead of buffering the whole response. The compressed protocol is preferred if compression is enabled too,
+	// and the whole uncompressed response is requested from the peers which do not serve either.
+	StreamingEnabled bool `json:"streaming_enabled,omitempty"`
+	// Max size in bytes of a frame of the streamed range responses, i.e. a blob and its metadata, which bounds the
+	// memory to serve a blob of the responses and the size of a frame accepted. Default value is used if not set.
+	MaxFrameSize uint64 `json:"max_frame_size,omitempty"`
+	// Shared secret of a private network, the sync streams are authenticated by it so only the nodes with the same
+	// secret can sync with each other. Empty for a public network.
+	NetworkSecret string `json:"network_secret,omitempty"`
+	// Tuning of the sync client, which overrides the p2p sync flags.
+	Sync SyncConfig `json:"sync"`
 	// Required to identify the L2 network and create p2p signatures unique for this chain.
 	// L2ChainID *big.Int `json:"l2_chain_id"`
 }
@@ -0,0 +1,47 @@
+package rollup
+
+import (
+	"testing"
+	"time"
+)
+
+// TestSyncConfigValidate tests that the defaults are applied to the sync config fields not set, the fields set
+// are kept, and the nonsensical settings are rejected.
+func TestSyncConfigValidate(t *testing.T) {
+	var empty SyncConfig
+	if err := empty.Validate(); err != nil {
+		t.Fatalf("empty sync config should be valid: %s", err.Error())
+	}
+	defaults := SyncConfig{
+		MaxConcurrentPerPeer: DefaultSyncMaxConcurrentPerPeer,
+		MinBatchSize:         DefaultSyncMinBatchSize,
+		RequestTimeout:       DefaultSyncRequestTimeout,
+	}
+	if empty != defaults {
+		t.Fatalf("defaults should be applied, expected: %+v, actual: %+v", defaults, empty)
+	}
+
+	set := SyncConfig{MaxPeers: 10, MaxConcurrentPerPeer: 4, MinBatchSize: 2, MaxBatchSize: 8,
+		RequestTimeout: time.Second, MaxRetries: 3}
+	expected := set
+	if err := set.Validate(); err != nil {
+		t.Fatalf("sync config should be valid: %s", err.Error())
+	}
+	if set != expected {
+		t.Fatalf("fields set should be kept, expected: %+v, actual: %+v", expected, set)
+	}
+
+	invalid := map[string]SyncConfig{
+		"negative max peers":                     {MaxPeers: -1},
+		"negative concurrency per peer":          {MaxPeers: 10, MaxConcurrentPerPeer: -1},
+		"concurrency per peer without max peers": {MaxConcurrentPerPeer: 2},
+		"min batch exceeds max batch":            {MinBatchSize: 16, MaxBatchSize: 8},
+		"negative request timeout":               {RequestTimeout: -time.Second},
+		"negative retries":                       {MaxRetries: -1},
+	}
+	for name, c := range invalid {
+		if err := c.Validate(); err == nil {
+			t.Fatalf("%s should be rejected", name)
+		}
+	}
+}
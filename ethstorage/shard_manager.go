@@ -4,12 +4,22 @@
 package ethstorage
 
 import (
+	"errors"
 	"fmt"
 	"math/bits"
 
 	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/log"
 )
 
+// ErrDiskFull is returned by the writes of the blobs while the free disk space of the data file is below the min free
+// disk space set by SetMinFreeDisk, so the writes fail before the file system runs out of space mid-write.
+var ErrDiskFull = errors.New("not enough free disk space")
+
+// ErrShardReEncoding is returned by the writes of the blobs and the mining reads of the samples of a shard being
+// re-encoded, as its kvs are of different encode types until the re-encoding is finished.
+var ErrShardReEncoding = errors.New("shard is being re-encoded")
+
 type ShardManager struct {
 	shardMap        map[uint64]*DataShard
 	contractAddress common.Address
@@ -21,6 +31,10 @@ type ShardManager struct {
 	kvEntries       uint64
 	chunkSize       uint64
 	chunkSizeBits   uint64
+
+	fsync       FsyncPolicy                       // fsync policy of the data files
+	minFreeDisk uint64                            // min free disk space in bytes to write the blobs, 0 means no check
+	freeDisk    func(path string) (uint64, error) // free disk space of the file system of the path
 }
 
 // if v is not 2^n, panic; otherwise return n
@@ -58,6 +72,7 @@ func NewShardManager(contractAddress common.Address, kvSize uint64, kvEntries ui
 		chunksPerKv:     kvSize / chunkSize,
 		chunkSize:       chunkSize,
 		chunkSizeBits:   chunkSizeBits,
+		freeDisk:        freeDiskSpace,
 	}
 
 	ContractToShardManager[contractAddress] = sm
@@ -126,7 +141,7 @@ func (sm *ShardManager) AddDataFile(df *DataFile) error {
 		return fmt.Errorf("data shard not found")
 	}
 
-	return ds.AddDataFile(df)
+	return sm.addDataFile(ds, df)
 }
 
 func (sm *ShardManager) AddDataFileAndShard(df *DataFile) error {
@@ -138,7 +153,89 @@ func (sm *ShardManager) AddDataFileAndShard(df *DataFile) error {
 		sm.shardMap[shardIdx] = ds
 	}
 
-	return ds.AddDataFile(df)
+	return sm.addDataFile(ds, df)
+}
+
+func (sm *ShardManager) addDataFile(ds *DataShard, df *DataFile) error {
+	if err := ds.AddDataFile(df); err != nil {
+		return err
+	}
+	if sm.fsync.Mode != FsyncNever {
+		df.SetFsyncPolicy(sm.fsync)
+	}
+	return nil
+}
+
+// SetFsyncPolicy sets the policy to flush the blobs written to the data files added and to be added.
+func (sm *ShardManager) SetFsyncPolicy(policy FsyncPolicy) {
+	sm.fsync = policy
+	for _, ds := range sm.shardMap {
+		for _, df := range ds.dataFiles {
+			df.SetFsyncPolicy(policy)
+		}
+	}
+}
+
+// SetMinFreeDisk sets the min free disk space in bytes of the data files to write the blobs, below which the writes
+// fail with ErrDiskFull. 0 disables the check.
+func (sm *ShardManager) SetMinFreeDisk(minFreeDisk uint64) {
+	sm.minFreeDisk = minFreeDisk
+}
+
+// checkFreeDisk returns ErrDiskFull if the free disk space of the data file of the kv is below the min free disk
+// space. The check is skipped if the free disk space is unknown, e.g. on an unsupported platform.
+func (sm *ShardManager) checkFreeDisk(ds *DataShard, kvIdx uint64) error {
+	if sm.minFreeDisk == 0 {
+		return nil
+	}
+	df := ds.GetStorageFile(kvIdx * sm.chunksPerKv)
+	if df == nil {
+		return nil
+	}
+	free, err := sm.freeDisk(df.file.Name())
+	if err != nil {
+		log.Debug("Failed to get free disk space", "file", df.file.Name(), "err", err)
+		return nil
+	}
+	if free < sm.minFreeDisk {
+		return fmt.Errorf("%w: %d bytes free for data file %s, min %d", ErrDiskFull, free, df.file.Name(), sm.minFreeDisk)
+	}
+	return nil
+}
+
+// SyncShard flushes the blobs written to the data files of the shard to disk regardless of the fsync policy,
+// e.g. once the shard is synced in FsyncBatched mode.
+func (sm *ShardManager) SyncShard(shardIdx uint64) error {
+	if ds, ok := sm.shardMap[shardIdx]; ok {
+		return ds.Sync()
+	}
+	return fmt.Errorf("shard %d not found", shardIdx)
+}
+
+// Warmup validates the data files of all the shards and reads their metas into the page cache, see DataFile.Warmup.
+// It is called once the data files are added, e.g. on startup, and returns the errors of all the data files failed
+// instead of the first one, so the broken data files are reported at once.
+func (sm *ShardManager) Warmup() error {
+	var errs []error
+	for _, ds := range sm.shardMap {
+		for _, df := range ds.dataFiles {
+			if err := df.Warmup(); err != nil {
+				errs = append(errs, fmt.Errorf("warm up data file %s of shard %d error: %w", df.file.Name(), ds.shardIdx, err))
+			}
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// FilledBitmap returns the bitmap of the kvs of the shard filled with an empty blob, which is kept on disk along with
+// the writes, so it is available without reading the metas of the shard. A kv synced with a blob is unset. The bitmap
+// of a data file created before the bitmap is kept is derived from its metas, see
+// DataFile.MigrateFilledBitmap.
+func (sm *ShardManager) FilledBitmap(shardIdx uint64) ([]byte, error) {
+	if ds, ok := sm.shardMap[shardIdx]; ok {
+		return ds.FilledBitmap()
+	}
+	return nil, fmt.Errorf("shard %d not found", shardIdx)
 }
 
 // TryWrite Encode a raw KV data, and write it to the underly storage file.
@@ -147,6 +244,12 @@ func (sm *ShardManager) AddDataFileAndShard(df *DataFile) error {
 func (sm *ShardManager) TryWrite(kvIdx uint64, b []byte, commit common.Hash) (bool, error) {
 	shardIdx := kvIdx / sm.kvEntries
 	if ds, ok := sm.shardMap[shardIdx]; ok {
+		if ds.IsReEncoding() {
+			return true, fmt.Errorf("%w: shard %d", ErrShardReEncoding, shardIdx)
+		}
+		if err := sm.checkFreeDisk(ds, kvIdx); err != nil {
+			return true, err
+		}
 		return true, ds.Write(kvIdx, b, commit)
 	} else {
 		return false, nil
@@ -159,6 +262,12 @@ func (sm *ShardManager) TryWrite(kvIdx uint64, b []byte, commit common.Hash) (bo
 func (sm *ShardManager) TryWriteEncoded(kvIdx uint64, b []byte, commit common.Hash) (bool, error) {
 	shardIdx := kvIdx / sm.kvEntries
 	if ds, ok := sm.shardMap[shardIdx]; ok {
+		if ds.IsReEncoding() {
+			return true, fmt.Errorf("%w: shard %d", ErrShardReEncoding, shardIdx)
+		}
+		if err := sm.checkFreeDisk(ds, kvIdx); err != nil {
+			return true, err
+		}
 		err := ds.WriteWith(kvIdx, b, commit, func(cdata []byte, chunkIdx uint64) []byte {
 			return cdata
 		})
@@ -188,7 +297,7 @@ func (sm *ShardManager) TryEncodeKV(kvIdx uint64, b []byte, hash common.Hash) ([
 	if ds, ok := sm.shardMap[shardIdx]; ok {
 		cb := make([]byte, ds.kvSize)
 		copy(cb, b)
-		return sm.EncodeKV(kvIdx, cb, hash, ds.Miner(), ds.EncodeType())
+		return sm.EncodeKV(kvIdx, cb, hash, ds.Miner(), ds.EncodeTypeOf(kvIdx))
 	} else {
 		return nil, false, nil
 	}
@@ -221,6 +330,15 @@ func (sm *ShardManager) GetShardEncodeType(shardIdx uint64) (uint64, bool) {
 	return NO_ENCODE, false
 }
 
+// GetKvEncodeType returns the encode type of the kv, which differs from that of its shard if the shard is being
+// re-encoded and the kv is re-encoded already.
+func (sm *ShardManager) GetKvEncodeType(kvIdx uint64) (uint64, bool) {
+	if ds, ok := sm.shardMap[kvIdx/sm.kvEntries]; ok {
+		return ds.EncodeTypeOf(kvIdx), true
+	}
+	return NO_ENCODE, false
+}
+
 // DecodeKV Decode the encoded KV data.
 func (sm *ShardManager) DecodeKV(kvIdx uint64, b []byte, hash common.Hash, providerAddr common.Address, encodeType uint64) ([]byte, bool, error) {
 	return sm.DecodeOrEncodeKV(kvIdx, b, hash, providerAddr, false, encodeType)
@@ -235,6 +353,14 @@ func (sm *ShardManager) DecodeOrEncodeKV(kvIdx uint64, b []byte, hash common.Has
 	shardIdx := kvIdx / sm.kvEntries
 	var data []byte
 	if ds, ok := sm.shardMap[shardIdx]; ok {
+		// the encode types beyond the built-in ones are dispatched to the registered codecs
+		if encodeType > ENCODE_END {
+			fn, ok := customCodec(encodeType, encode)
+			if !ok {
+				return nil, true, fmt.Errorf("unsupported encode type %d", encodeType)
+			}
+			return fn(kvIdx, b, hash, providerAddr, encodeType)
+		}
 		datalen := len(b)
 		for i := uint64(0); i < ds.chunksPerKv; i++ {
 			if datalen == 0 {
@@ -275,6 +401,20 @@ func (sm *ShardManager) TryReadEncoded(kvIdx uint64, readLen int) ([]byte, bool,
 	}
 }
 
+// TryReadEncodedAt Read the encoded KV data of readLen bytes from storage file starting at the chunk aligned
+// offset and return it.
+// Return error if the read IO fails or the range is invalid.
+// Return false if the data is not managed by the ShardManager.
+func (sm *ShardManager) TryReadEncodedAt(kvIdx uint64, offset uint64, readLen int) ([]byte, bool, error) {
+	shardIdx := kvIdx / sm.kvEntries
+	if ds, ok := sm.shardMap[shardIdx]; ok {
+		b, err := ds.ReadEncodedAt(kvIdx, offset, readLen)
+		return b, true, err
+	} else {
+		return nil, false, nil
+	}
+}
+
 // TryReadMeta Read the KV meta data from storage file and return it.
 // Return error if the read IO fails.
 // Return false if the data is not managed by the ShardManager.
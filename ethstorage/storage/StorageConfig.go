@@ -3,7 +3,10 @@
 
 package storage
 
-import "github.com/ethereum/go-ethereum/common"
+import (
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethstorage/go-ethstorage/ethstorage"
+)
 
 type StorageConfig struct {
 	Filenames         []string
@@ -12,4 +15,7 @@ type StorageConfig struct {
 	KvEntriesPerShard uint64
 	L1Contract        common.Address
 	Miner             common.Address
+	Fsync             ethstorage.FsyncPolicy // policy to flush the blobs written to the data files
+	Warmup            bool                   // validate the data files and warm up their metas on startup
+	MinFreeDisk       uint64                 // min free disk space in bytes to write the blobs, 0 means no check
 }
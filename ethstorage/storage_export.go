@@ -0,0 +1,295 @@
+// Copyright 2022-2023, EthStorage.
+// For license information, see https://github.com/ethstorage/es-node/blob/main/LICENSE
+
+package ethstorage
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/log"
+	prv "github.com/ethstorage/go-ethstorage/ethstorage/prover"
+)
+
+// The shard export format is self-describing, so a shard can be imported into a node with a different miner
+// or encode type. It starts with a header:
+//
+//	magic (8 bytes) | version (1 byte) | contract (20 bytes) | shardIdx (8 bytes) | kvSize (8 bytes) | kvEntries (8 bytes)
+//
+// followed by a frame of each synced blob, and an end frame with the number of the blob frames:
+//
+//	frameBlob (1 byte) | kvIdx (8 bytes) | meta (32 bytes) | blob length (4 bytes) | decoded blob
+//	frameEnd (1 byte) | count (8 bytes)
+//
+// All the integers are big endian.
+const (
+	exportVersion = byte(1)
+
+	frameBlob = byte(1)
+	frameEnd  = byte(2)
+)
+
+var exportMagic = [8]byte{'E', 'S', 'S', 'H', 'A', 'R', 'D', 0}
+
+type exportHeader struct {
+	Magic     [8]byte
+	Version   byte
+	Contract  common.Address
+	ShardIdx  uint64
+	KvSize    uint64
+	KvEntries uint64
+}
+
+type blobFrameHeader struct {
+	KvIdx  uint64
+	Meta   common.Hash
+	Length uint32
+}
+
+// ExportShard writes the synced blobs of the local shard and their metas to w, and returns the number of the
+// exported blobs. The blobs are decoded, so they can be imported regardless of the miner and the encode type.
+func (s *StorageManager) ExportShard(shardIdx uint64, w io.Writer) (uint64, error) {
+	miner, ok := s.GetShardMiner(shardIdx)
+	if !ok {
+		return 0, fmt.Errorf("shard %d not found", shardIdx)
+	}
+	encodeType, _ := s.GetShardEncodeType(shardIdx)
+
+	ew, err := NewShardExportWriter(w, s.ContractAddress(), shardIdx, s.MaxKvSize(), s.KvEntries())
+	if err != nil {
+		return 0, err
+	}
+	kvEntries := s.KvEntries()
+	for kvIdx := shardIdx * kvEntries; kvIdx < (shardIdx+1)*kvEntries; kvIdx++ {
+		meta, success, err := s.TryReadMeta(kvIdx)
+		if !success || err != nil {
+			return ew.Count(), fmt.Errorf("read meta of kv %d failed: %v", kvIdx, err)
+		}
+		commit := common.BytesToHash(meta)
+		if !IsBlobSynced(commit) {
+			continue
+		}
+		encodedBlob, success, err := s.TryReadEncoded(kvIdx, int(s.MaxKvSize()))
+		if !success || err != nil {
+			return ew.Count(), fmt.Errorf("read encoded blob of kv %d failed: %v", kvIdx, err)
+		}
+		blob, success, err := s.DecodeKV(kvIdx, encodedBlob, commit, miner, encodeType)
+		if !success || err != nil {
+			return ew.Count(), fmt.Errorf("decode blob of kv %d failed: %v", kvIdx, err)
+		}
+		if err := ew.WriteBlob(kvIdx, commit, blob); err != nil {
+			return ew.Count(), err
+		}
+	}
+	return ew.Count(), ew.Close()
+}
+
+// ShardExportWriter writes a shard export in the format of ExportShard, e.g. to export the blobs of a shard from
+// a source other than the local storage.
+type ShardExportWriter struct {
+	bw    *bufio.Writer
+	count uint64
+}
+
+// NewShardExportWriter writes the header of the export of the shard to w.
+func NewShardExportWriter(w io.Writer, contract common.Address, shardIdx, kvSize, kvEntries uint64) (*ShardExportWriter, error) {
+	bw := bufio.NewWriter(w)
+	header := exportHeader{
+		Magic:     exportMagic,
+		Version:   exportVersion,
+		Contract:  contract,
+		ShardIdx:  shardIdx,
+		KvSize:    kvSize,
+		KvEntries: kvEntries,
+	}
+	if err := binary.Write(bw, binary.BigEndian, &header); err != nil {
+		return nil, fmt.Errorf("write export header failed: %w", err)
+	}
+	return &ShardExportWriter{bw: bw}, nil
+}
+
+// WriteBlob writes the frame of the decoded blob of the kv index with its meta.
+func (e *ShardExportWriter) WriteBlob(kvIdx uint64, meta common.Hash, blob []byte) error {
+	if err := e.bw.WriteByte(frameBlob); err != nil {
+		return err
+	}
+	frame := blobFrameHeader{KvIdx: kvIdx, Meta: meta, Length: uint32(len(blob))}
+	if err := binary.Write(e.bw, binary.BigEndian, &frame); err != nil {
+		return err
+	}
+	if _, err := e.bw.Write(blob); err != nil {
+		return err
+	}
+	e.count++
+	return nil
+}
+
+// Count returns the number of the blobs written.
+func (e *ShardExportWriter) Count() uint64 {
+	return e.count
+}
+
+// Close writes the end frame and flushes the export, the underlying writer is not closed.
+func (e *ShardExportWriter) Close() error {
+	if err := e.bw.WriteByte(frameEnd); err != nil {
+		return err
+	}
+	if err := binary.Write(e.bw, binary.BigEndian, e.count); err != nil {
+		return err
+	}
+	return e.bw.Flush()
+}
+
+// ImportShard reads the blobs exported by ExportShard from r and writes them to the local shard, and returns the
+// number of the imported blobs. The export must be of the same contract and storage layout, the shard must exist
+// locally, and each blob must match the commit in its meta, otherwise the import stops with an error.
+func (s *StorageManager) ImportShard(r io.Reader) (uint64, error) {
+	var (
+		prover = prv.NewKZGProver(log.Root())
+		count  = uint64(0)
+	)
+	checkHeader := func(header *exportHeader) error {
+		if header.Contract != s.ContractAddress() {
+			return fmt.Errorf("export of contract %s does not match %s", header.Contract.Hex(), s.ContractAddress().Hex())
+		}
+		if header.KvSize != s.MaxKvSize() || header.KvEntries != s.KvEntries() {
+			return fmt.Errorf("export layout (kvSize %d, kvEntries %d) does not match (kvSize %d, kvEntries %d)",
+				header.KvSize, header.KvEntries, s.MaxKvSize(), s.KvEntries())
+		}
+		if _, ok := s.GetShardMiner(header.ShardIdx); !ok {
+			return fmt.Errorf("shard %d not found", header.ShardIdx)
+		}
+		return nil
+	}
+	err := scanExport(r, checkHeader, func(frame *blobFrameHeader, data []byte) error {
+		root, err := prover.GetRoot(data, 0, 0)
+		if err != nil || !bytes.Equal(root[:HashSizeInContract], frame.Meta[:HashSizeInContract]) {
+			return fmt.Errorf("blob of kv %d does not match its commit: %v", frame.KvIdx, err)
+		}
+		if err := s.writeImportedBlob(frame.KvIdx, data, frame.Meta); err != nil {
+			return fmt.Errorf("write blob of kv %d failed: %w", frame.KvIdx, err)
+		}
+		count++
+		return nil
+	})
+	return count, err
+}
+
+// ExportedBlob is a decoded blob read from a shard export with its meta.
+type ExportedBlob struct {
+	Meta common.Hash
+	Blob []byte
+}
+
+// ReadExportedBlobs reads the blobs of the kv indexes from a shard export written by ExportShard with the blobs of
+// kvSize, and returns the contract of the export and the blobs found by kv index. The blobs are not verified against
+// their metas, which is up to the caller.
+func ReadExportedBlobs(r io.Reader, kvSize uint64, kvIndexes []uint64) (common.Address, map[uint64]*ExportedBlob, error) {
+	var (
+		contract common.Address
+		wanted   = make(map[uint64]struct{}, len(kvIndexes))
+		blobs    = make(map[uint64]*ExportedBlob)
+	)
+	for _, kvIdx := range kvIndexes {
+		wanted[kvIdx] = struct{}{}
+	}
+	checkHeader := func(header *exportHeader) error {
+		if header.KvSize != kvSize {
+			return fmt.Errorf("export kvSize %d does not match %d", header.KvSize, kvSize)
+		}
+		contract = header.Contract
+		return nil
+	}
+	err := scanExport(r, checkHeader, func(frame *blobFrameHeader, data []byte) error {
+		if _, ok := wanted[frame.KvIdx]; ok {
+			blobs[frame.KvIdx] = &ExportedBlob{Meta: frame.Meta, Blob: bytes.Clone(data)}
+		}
+		return nil
+	})
+	return contract, blobs, err
+}
+
+// scanExport reads a shard export written by ExportShard from r, checks its header by checkHeader, and calls onBlob
+// with each blob frame in order. The blob passed to onBlob is reused after the call returns.
+func scanExport(r io.Reader, checkHeader func(*exportHeader) error, onBlob func(*blobFrameHeader, []byte) error) error {
+	br := bufio.NewReader(r)
+	var header exportHeader
+	if err := binary.Read(br, binary.BigEndian, &header); err != nil {
+		return fmt.Errorf("read export header failed: %w", err)
+	}
+	if header.Magic != exportMagic {
+		return errors.New("not a shard export")
+	}
+	if header.Version != exportVersion {
+		return fmt.Errorf("unsupported export version %d", header.Version)
+	}
+	if err := checkHeader(&header); err != nil {
+		return err
+	}
+
+	var (
+		first      = header.ShardIdx * header.KvEntries
+		limit      = first + header.KvEntries
+		count      = uint64(0)
+		blob       = make([]byte, header.KvSize)
+		frameType  byte
+		err        error
+		blobHeader blobFrameHeader
+	)
+	for {
+		if frameType, err = br.ReadByte(); err != nil {
+			return fmt.Errorf("read frame failed: %w", err)
+		}
+		if frameType == frameEnd {
+			var expected uint64
+			if err := binary.Read(br, binary.BigEndian, &expected); err != nil {
+				return fmt.Errorf("read end frame failed: %w", err)
+			}
+			if expected != count {
+				return fmt.Errorf("blob count mismatch, expected %d, imported %d", expected, count)
+			}
+			return nil
+		}
+		if frameType != frameBlob {
+			return fmt.Errorf("unknown frame type %d", frameType)
+		}
+
+		if err := binary.Read(br, binary.BigEndian, &blobHeader); err != nil {
+			return fmt.Errorf("read blob frame failed: %w", err)
+		}
+		if blobHeader.KvIdx < first || blobHeader.KvIdx >= limit {
+			return fmt.Errorf("kv %d is out of shard %d", blobHeader.KvIdx, header.ShardIdx)
+		}
+		if uint64(blobHeader.Length) > header.KvSize {
+			return fmt.Errorf("blob of kv %d is too large: %d", blobHeader.KvIdx, blobHeader.Length)
+		}
+		if !IsBlobSynced(blobHeader.Meta) {
+			return fmt.Errorf("meta of kv %d is not of a synced blob", blobHeader.KvIdx)
+		}
+		data := blob[:blobHeader.Length]
+		if _, err := io.ReadFull(br, data); err != nil {
+			return fmt.Errorf("read blob of kv %d failed: %w", blobHeader.KvIdx, err)
+		}
+		if err := onBlob(&blobHeader, data); err != nil {
+			return err
+		}
+		count++
+	}
+}
+
+func (s *StorageManager) writeImportedBlob(kvIdx uint64, blob []byte, meta common.Hash) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	success, err := s.shardManager.TryWrite(kvIdx, blob, meta)
+	if !success || err != nil {
+		return fmt.Errorf("blob write failed: %v", err)
+	}
+	s.notifyBlobWritten(kvIdx, meta, false)
+	return nil
+}
@@ -6,20 +6,27 @@ package ethstorage
 import (
 	"bytes"
 	"context"
+	"encoding/binary"
 	"errors"
 	"fmt"
 	"math/big"
+	"slices"
 	"sync"
 	"time"
 
 	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/crypto"
 	"github.com/ethereum/go-ethereum/log"
+	prv "github.com/ethstorage/go-ethstorage/ethstorage/prover"
 )
 
 const (
 	blobFillingMask    = byte(0b10000000)
 	HashSizeInContract = 24
 	MetaDownloadThread = 32
+
+	// defaultWrittenQueueSize is the max number of the written blobs queued for the OnBlobWritten listeners
+	defaultWrittenQueueSize = 4096
 )
 
 var (
@@ -40,15 +47,105 @@ type StorageManager struct {
 	localL1           int64      // local view of most-recent-finalized L1 block
 	mu                sync.Mutex // protect lastKvIdx, shardManager and blobMeta read/write state
 	lastKvIdx         uint64     // lastKvIndex in the most-recent-finalized L1 block
+	resetKvIdx        uint64     // lastKvIndex at the latest reset, the blobs beyond it are written by the downloader
 	l1Source          Il1Source
 	blobMetas         map[uint64][32]byte
+	lastKvIdxChanged  []func(lastKvIdx uint64) // listeners of lastKvIdx changes, protected by mu
+
+	writtenMu        sync.Mutex                                           // protect the blob written listeners and events
+	blobWritten      []func(kvIdx uint64, commit common.Hash, empty bool) // listeners of each blob written, protected by writtenMu
+	writtenQueue     []blobWrittenEvent                                   // events to dispatch to blobWritten, protected by writtenMu
+	writtenQueueSize int                                                  // max number of the events queued, the writes block once reached
+	writtenTaken     *sync.Cond                                           // signalled once the queued events are taken by the dispatcher or it is stopped
+	writtenNotify    chan struct{}                                        // wakes up the dispatcher of the events, nil if not started
+	writtenStop      chan struct{}                                        // stops the dispatcher of the events on Close
+}
+
+// blobWrittenEvent is a blob written into the local storage files to dispatch to the OnBlobWritten listeners.
+type blobWrittenEvent struct {
+	kvIdx  uint64
+	commit common.Hash
+	empty  bool
 }
 
 func NewStorageManager(sm *ShardManager, l1Source Il1Source) *StorageManager {
 	return &StorageManager{
-		shardManager: sm,
-		l1Source:     l1Source,
-		blobMetas:    map[uint64][32]byte{},
+		shardManager:     sm,
+		l1Source:         l1Source,
+		blobMetas:        map[uint64][32]byte{},
+		writtenQueueSize: defaultWrittenQueueSize,
+	}
+}
+
+// OnBlobWritten registers fn to be called with the kv index and the commit of each blob written into the local
+// storage files, by the L1 downloader, the p2p sync, the empty blobs filling, the import or the re-encoding, and empty
+// is true for the empty blobs. fn is only called once the write succeeds, and only for the blobs actually written.
+// fn is called asynchronously by a single goroutine in the order of the writes, so a slow fn does not block the
+// writes until writtenQueueSize events are queued, and then the writes wait for fn instead of queuing the events
+// without a bound. So fn may call back into the storage manager, but must not write blobs or wait for its lock.
+func (s *StorageManager) OnBlobWritten(fn func(kvIdx uint64, commit common.Hash, empty bool)) {
+	s.writtenMu.Lock()
+	defer s.writtenMu.Unlock()
+	s.blobWritten = append(s.blobWritten, fn)
+	if s.writtenNotify == nil {
+		s.writtenNotify, s.writtenStop = make(chan struct{}, 1), make(chan struct{})
+		s.writtenTaken = sync.NewCond(&s.writtenMu)
+		go s.dispatchBlobWritten(s.writtenNotify, s.writtenStop)
+	}
+}
+
+// notifyBlobWritten queues the blob written for the OnBlobWritten listeners without waiting for them, unless the
+// queue is full, in which case it blocks until the queued events are taken by the dispatcher.
+func (s *StorageManager) notifyBlobWritten(kvIdx uint64, commit common.Hash, empty bool) {
+	s.writtenMu.Lock()
+	defer s.writtenMu.Unlock()
+	for s.writtenStop != nil && len(s.writtenQueue) >= s.writtenQueueSize {
+		s.writtenTaken.Wait()
+	}
+	if len(s.blobWritten) == 0 || s.writtenStop == nil {
+		return
+	}
+	s.writtenQueue = append(s.writtenQueue, blobWrittenEvent{kvIdx: kvIdx, commit: commit, empty: empty})
+	select {
+	case s.writtenNotify <- struct{}{}:
+	default:
+	}
+}
+
+func (s *StorageManager) dispatchBlobWritten(notify, stop chan struct{}) {
+	for {
+		select {
+		case <-notify:
+		case <-stop:
+			return
+		}
+		s.writtenMu.Lock()
+		events, listeners := s.writtenQueue, s.blobWritten
+		s.writtenQueue = nil
+		s.writtenTaken.Broadcast()
+		s.writtenMu.Unlock()
+		for _, ev := range events {
+			for _, fn := range listeners {
+				fn(ev.kvIdx, ev.commit, ev.empty)
+			}
+		}
+	}
+}
+
+// OnLastKvIndexChanged registers fn to be called with the new lastKvIdx when it is changed by a new L1 view,
+// e.g. it shrinks on an L1 reorg. fn is called with the storage manager unlocked.
+func (s *StorageManager) OnLastKvIndexChanged(fn func(lastKvIdx uint64)) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.lastKvIdxChanged = append(s.lastKvIdxChanged, fn)
+}
+
+func (s *StorageManager) notifyLastKvIdxChanged(lastKvIdx uint64) {
+	s.mu.Lock()
+	listeners := s.lastKvIdxChanged
+	s.mu.Unlock()
+	for _, fn := range listeners {
+		fn(lastKvIdx)
 	}
 }
 
@@ -64,7 +161,7 @@ func (s *StorageManager) DecodeBlob(blob []byte, blobHash common.Hash, kvIdx, si
 
 func (s *StorageManager) getEncodingParams(kvIdx uint64, blobHash common.Hash) (uint64, common.Hash) {
 	shardIdx := kvIdx >> s.KvEntriesBits()
-	encodeType, _ := s.GetShardEncodeType(shardIdx)
+	encodeType, _ := s.shardManager.GetKvEncodeType(kvIdx)
 	miner, _ := s.GetShardMiner(shardIdx)
 	encodeKey := CalcEncodeKey(blobHash, kvIdx, miner)
 	return encodeType, encodeKey
@@ -77,6 +174,16 @@ func (s *StorageManager) DownloadFinished(newL1 int64, kvIndices []uint64, blobs
 		return errors.New("invalid params lens")
 	}
 
+	// the listeners are notified after s.mu is unlocked
+	var (
+		lastKvIdx uint64
+		changed   bool
+	)
+	defer func() {
+		if changed {
+			s.notifyLastKvIdxChanged(lastKvIdx)
+		}
+	}()
 	s.mu.Lock()
 	defer s.mu.Unlock()
 
@@ -112,10 +219,14 @@ func (s *StorageManager) DownloadFinished(newL1 int64, kvIndices []uint64, blobs
 			for _, idx := range insertIdx {
 				c := prepareCommit(commits[idx])
 				// if return false, just ignore because we are not interested in it
-				_, err = s.shardManager.TryWriteEncoded(kvIndices[idx], blobs[idx], c)
+				var written bool
+				written, err = s.shardManager.TryWriteEncoded(kvIndices[idx], blobs[idx], c)
 				if err != nil {
 					break
 				}
+				if written {
+					s.notifyBlobWritten(kvIndices[idx], commits[idx], false)
+				}
 			}
 
 			chanRes <- err
@@ -137,6 +248,7 @@ func (s *StorageManager) DownloadFinished(newL1 int64, kvIndices []uint64, blobs
 	if err != nil {
 		return err
 	}
+	changed = lastKvIdx != s.lastKvIdx
 	s.lastKvIdx = lastKvIdx
 	s.localL1 = newL1
 
@@ -157,24 +269,56 @@ func prepareCommit(commit common.Hash) common.Hash {
 }
 
 // Reset This function must be called before calling any other funcs, it will setup a local L1 view for the node.
+// If the lastKvIdx shrinks, e.g. on an L1 reorg, the local metas beyond the new lastKvIdx are removed, so the
+// blobs there are treated as empty blobs.
 func (s *StorageManager) Reset(newL1 int64) error {
+	lastKvIdx, changed, err := s.reset(newL1)
+	if err != nil {
+		return err
+	}
+	if changed {
+		s.notifyLastKvIdxChanged(lastKvIdx)
+	}
+	return nil
+}
+
+func (s *StorageManager) reset(newL1 int64) (uint64, bool, error) {
 	s.mu.Lock()
 	defer s.mu.Unlock()
 
 	lastKvIdx, err := s.l1Source.GetStorageLastBlobIdx(newL1)
 	if err != nil {
-		return err
+		return 0, false, err
+	}
+	changed := lastKvIdx != s.lastKvIdx
+	if lastKvIdx < s.lastKvIdx {
+		for idx := range s.blobMetas {
+			if idx >= lastKvIdx {
+				delete(s.blobMetas, idx)
+			}
+		}
 	}
 	s.lastKvIdx = lastKvIdx
+	s.resetKvIdx = lastKvIdx
 	s.localL1 = newL1
 
-	return nil
+	return lastKvIdx, changed, nil
 }
 
 // CommitBlobs This function will be called when p2p sync received blobs. It will commit the blobs
 // that match local L1 view and return the unmatched ones.
 // Note that the caller must make sure the blobs data and the corresponding commit are matched.
 func (s *StorageManager) CommitBlobs(kvIndices []uint64, blobs [][]byte, commits []common.Hash) ([]uint64, error) {
+	return s.commitBlobs(kvIndices, blobs, commits, false)
+}
+
+// OverwriteBlobs works as CommitBlobs, except the blobs are written even if the local blobs have the same commits,
+// so the local blobs corrupted while their metadata still matches are repaired.
+func (s *StorageManager) OverwriteBlobs(kvIndices []uint64, blobs [][]byte, commits []common.Hash) ([]uint64, error) {
+	return s.commitBlobs(kvIndices, blobs, commits, true)
+}
+
+func (s *StorageManager) commitBlobs(kvIndices []uint64, blobs [][]byte, commits []common.Hash, overwrite bool) ([]uint64, error) {
 	if len(kvIndices) != len(blobs) || len(blobs) != len(commits) {
 		return nil, errors.New("invalid params lens")
 	}
@@ -206,9 +350,13 @@ func (s *StorageManager) CommitBlobs(kvIndices []uint64, blobs [][]byte, commits
 		if !encoded[i] {
 			continue
 		}
-		err := s.commitEncodedBlob(kvIndices[i], encodedBlobs[i], commits[i], contractMeta)
+		err := s.commitEncodedBlob(kvIndices[i], encodedBlobs[i], commits[i], contractMeta, overwrite)
 		if err != nil {
 			log.Warn("Commit blobs fail", "kvIndex", kvIndices[i], "err", err.Error())
+			// the rest of the blobs cannot be written either until the disk space is freed
+			if errors.Is(err, ErrDiskFull) {
+				return inserted, err
+			}
 			continue
 		}
 		inserted = append(inserted, kvIndices[i])
@@ -217,7 +365,7 @@ func (s *StorageManager) CommitBlobs(kvIndices []uint64, blobs [][]byte, commits
 }
 
 // CommitEmptyBlobs use to commit batch empty blobs, return inserted blobs count, next index to fill
-// and error GetKvMetas got. Any error (like encode or commit) happen to a blob, cancel to rest.
+// and error GetKvMetas got or ErrDiskFull. Any error (like encode or commit) happen to a blob, cancel to rest.
 func (s *StorageManager) CommitEmptyBlobs(start, limit uint64) (uint64, uint64, error) {
 	var (
 		encodedBlobs = make([][]byte, 0)
@@ -246,11 +394,15 @@ func (s *StorageManager) CommitEmptyBlobs(start, limit uint64) (uint64, uint64,
 	}
 
 	for i, index := range kvIndices {
-		err := s.commitEncodedBlob(index, encodedBlobs[i], hash, metas[i])
+		err := s.commitEncodedBlob(index, encodedBlobs[i], hash, metas[i], false)
 		if err == nil {
 			inserted++
 		} else if err != errCommitMismatch {
 			log.Info("Commit blobs fail", "kvIndex", kvIndices[i], "err", err.Error())
+			// the rest of the blobs cannot be filled either until the disk space is freed
+			if errors.Is(err, ErrDiskFull) {
+				return inserted, next, err
+			}
 			break
 		}
 		// if meta is not equal to empty hash, that mean the blob is not empty,
@@ -281,10 +433,11 @@ func (s *StorageManager) CommitBlob(kvIndex uint64, blob []byte, commit common.H
 	}
 
 	contractMeta := metas[0]
-	return s.commitEncodedBlob(kvIndex, encodedBlob, commit, contractMeta)
+	return s.commitEncodedBlob(kvIndex, encodedBlob, commit, contractMeta, false)
 }
 
-func (s *StorageManager) commitEncodedBlob(kvIndex uint64, encodedBlob []byte, commit common.Hash, contractMeta [32]byte) error {
+func (s *StorageManager) commitEncodedBlob(kvIndex uint64, encodedBlob []byte, commit common.Hash, contractMeta [32]byte,
+	overwrite bool) error {
 	// the commit is different with what we got from the contract, so should not commit
 	if !bytes.Equal(contractMeta[32-HashSizeInContract:32], commit[0:HashSizeInContract]) {
 		return errCommitMismatch
@@ -305,16 +458,21 @@ func (s *StorageManager) commitEncodedBlob(kvIndex uint64, encodedBlob []byte, c
 
 	// the local already have the data and we do not need to commit
 	// empty filled case: if both of the hash is 0, but local meta shows this encodedBlob hasn't been filled yet, we should also commit
-	if bytes.Equal(localMeta[0:HashSizeInContract], commit[0:HashSizeInContract]) && (localMeta[HashSizeInContract]&blobFillingMask) != 0 {
+	if !overwrite && bytes.Equal(localMeta[0:HashSizeInContract], commit[0:HashSizeInContract]) && (localMeta[HashSizeInContract]&blobFillingMask) != 0 {
 		return nil
 	}
 
 	c := prepareCommit(commit)
 
 	success, err = s.shardManager.TryWriteEncoded(kvIndex, encodedBlob, c)
+	if errors.Is(err, ErrDiskFull) {
+		return err
+	}
 	if !success || err != nil {
 		return errors.New("encodedBlob write failed")
 	}
+	// the empty blobs are committed with the empty hash
+	s.notifyBlobWritten(kvIndex, commit, commit == common.Hash{})
 	return nil
 }
 
@@ -324,56 +482,405 @@ func (s *StorageManager) syncCheck(kvIdx uint64) error {
 		return errors.New("meta reading failed")
 	}
 
+	hash := common.Hash{}
+	copy(hash[:], meta)
+	if !IsBlobSynced(hash) {
+		return errors.New("syncing or just empty blob")
+	}
+
+	return nil
+}
+
+// IsBlobSynced checks whether the local meta stands for a blob with data, so the blob is served to the peers.
+func IsBlobSynced(meta common.Hash) bool {
 	// There are two cases that we do NOT want to return data: not synced and empty filled
 	h0 := common.Hash{} // means not filled, e.g. haven't been synced yet
 
 	h1 := common.Hash{}
 	h1[HashSizeInContract] = h1[HashSizeInContract] | blobFillingMask // means empty filled
 
-	hash := common.Hash{}
-	copy(hash[:], meta)
-	if hash == h0 || hash == h1 {
-		return errors.New("syncing or just empty blob")
+	return meta != h0 && meta != h1
+}
+
+// VerifyShard iterates all the kv indexes of the shard and verifies the integrity of the blobs stored locally:
+// the encoded data is read and decoded, then its root is recomputed and compared with the commit stored in the meta.
+// The blobs which are not synced yet or just empty filled are skipped. It returns the kv indexes of the corrupt blobs.
+func (s *StorageManager) VerifyShard(shardIdx uint64) ([]uint64, error) {
+	miner, ok := s.GetShardMiner(shardIdx)
+	if !ok {
+		return nil, fmt.Errorf("shard %d not found", shardIdx)
 	}
 
-	return nil
+	var (
+		prover    = prv.NewKZGProver(log.Root())
+		kvEntries = s.KvEntries()
+		corrupt   = make([]uint64, 0)
+	)
+	for kvIdx := shardIdx * kvEntries; kvIdx < (shardIdx+1)*kvEntries; kvIdx++ {
+		isCorrupt, err := s.verifyKV(prover, kvIdx, miner)
+		if err != nil {
+			return corrupt, err
+		}
+		if isCorrupt {
+			corrupt = append(corrupt, kvIdx)
+		}
+	}
+	return corrupt, nil
 }
 
-// DownloadAllMetas This function download the blob hashes of all the local storage shards from the smart contract
-func (s *StorageManager) DownloadAllMetas(ctx context.Context, batchSize uint64) error {
+// VerifyShardParallel is the same as VerifyShard, except the blobs are decoded and verified by a pool of workers
+// concurrently. The corrupt kv indexes are returned in ascending order regardless of the concurrency, and if a blob
+// fails to read, the error of the lowest such kv index is returned with the corrupt kv indexes below it, the same
+// as VerifyShard.
+func (s *StorageManager) VerifyShardParallel(shardIdx uint64, workers int) ([]uint64, error) {
+	miner, ok := s.GetShardMiner(shardIdx)
+	if !ok {
+		return nil, fmt.Errorf("shard %d not found", shardIdx)
+	}
+	if workers <= 0 {
+		return nil, errors.New("workers should be positive")
+	}
+
+	var (
+		prover    = prv.NewKZGProver(log.Root())
+		kvEntries = s.KvEntries()
+		first     = shardIdx * kvEntries
+		next      = first
+		errIdx    = (shardIdx + 1) * kvEntries // lowest kv index failed to read, the limit if none
+		firstErr  error
+		corrupt   = make([]uint64, 0)
+		mu        sync.Mutex
+		wg        sync.WaitGroup
+	)
+	// take returns the next kv index to verify, and false once all are taken or a lower kv index failed to read
+	take := func() (uint64, bool) {
+		mu.Lock()
+		defer mu.Unlock()
+		if next >= errIdx {
+			return 0, false
+		}
+		next++
+		return next - 1, true
+	}
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for kvIdx, ok := take(); ok; kvIdx, ok = take() {
+				isCorrupt, err := s.verifyKV(prover, kvIdx, miner)
+				mu.Lock()
+				if err != nil && kvIdx < errIdx {
+					errIdx, firstErr = kvIdx, err
+				} else if isCorrupt {
+					corrupt = append(corrupt, kvIdx)
+				}
+				mu.Unlock()
+			}
+		}()
+	}
+	wg.Wait()
+
+	slices.Sort(corrupt)
+	// drop the corrupt kv indexes above the failed one, which VerifyShard does not reach
+	corrupt = slices.DeleteFunc(corrupt, func(kvIdx uint64) bool { return kvIdx > errIdx })
+	return corrupt, firstErr
+}
+
+// verifyKV verifies the blob of the kv index stored locally against the commit in its meta, and returns whether
+// the blob is corrupt. The blobs not synced are not corrupt. An error is returned if the blob fails to read.
+func (s *StorageManager) verifyKV(prover *prv.KZGProver, kvIdx uint64, miner common.Address) (bool, error) {
+	meta, success, err := s.TryReadMeta(kvIdx)
+	if !success || err != nil {
+		return false, fmt.Errorf("read meta of kv %d failed: %v", kvIdx, err)
+	}
+	commit := common.BytesToHash(meta)
+	if !IsBlobSynced(commit) {
+		return false, nil
+	}
+
+	encodedBlob, encodeType, err := s.readEncodedWithType(kvIdx)
+	if err != nil {
+		return false, err
+	}
+	blob, success, err := s.DecodeKV(kvIdx, encodedBlob, commit, miner, encodeType)
+	if !success || err != nil {
+		log.Warn("Decode blob failed", "kvIndex", kvIdx, "err", err)
+		return true, nil
+	}
+	root, err := prover.GetRoot(blob, 0, 0)
+	if err != nil || !bytes.Equal(root[:HashSizeInContract], commit[:HashSizeInContract]) {
+		log.Warn("Blob is corrupt", "kvIndex", kvIdx, "root", root.Hex(), "commit", commit.Hex(), "err", err)
+		return true, nil
+	}
+	return false, nil
+}
+
+// readEncodedWithType reads the encoded blob of the kv index with the encode type it is encoded with, which differs
+// from that of its shard if the kv is already re-encoded by ReEncodeShard. Both are read with the storage manager
+// locked, so the kv is not re-encoded in between.
+func (s *StorageManager) readEncodedWithType(kvIdx uint64) ([]byte, uint64, error) {
 	s.mu.Lock()
-	lastKvIdx := s.lastKvIdx
+	defer s.mu.Unlock()
+	if err := s.syncCheck(kvIdx); err != nil {
+		return nil, 0, fmt.Errorf("read encoded blob of kv %d failed: %v", kvIdx, err)
+	}
+	encodedBlob, success, err := s.shardManager.TryReadEncoded(kvIdx, int(s.shardManager.MaxKvSize()))
+	if !success || err != nil {
+		return nil, 0, fmt.Errorf("read encoded blob of kv %d failed: %v", kvIdx, err)
+	}
+	encodeType, _ := s.shardManager.GetKvEncodeType(kvIdx)
+	return encodedBlob, encodeType, nil
+}
+
+// VerifyBlobAgainstCommit verifies the blob of the kv index stored locally against the commit, e.g. fetched from
+// L1 by an external tool: the encoded data is read and decoded with the commit stored in the meta, then its root is
+// recomputed and compared with the commit. It returns an error if the blob is not synced locally.
+func (s *StorageManager) VerifyBlobAgainstCommit(kvIdx uint64, commit common.Hash) (bool, error) {
+	shardIdx := kvIdx / s.KvEntries()
+	miner, ok := s.GetShardMiner(shardIdx)
+	if !ok {
+		return false, fmt.Errorf("shard %d not found", shardIdx)
+	}
+
+	meta, success, err := s.TryReadMeta(kvIdx)
+	if !success || err != nil {
+		return false, fmt.Errorf("read meta of kv %d failed: %v", kvIdx, err)
+	}
+	localCommit := common.BytesToHash(meta)
+	if !IsBlobSynced(localCommit) {
+		return false, fmt.Errorf("kv %d is not synced", kvIdx)
+	}
+	encodedBlob, encodeType, err := s.readEncodedWithType(kvIdx)
+	if err != nil {
+		return false, err
+	}
+	blob, success, err := s.DecodeKV(kvIdx, encodedBlob, localCommit, miner, encodeType)
+	if !success || err != nil {
+		return false, fmt.Errorf("decode blob of kv %d failed: %v", kvIdx, err)
+	}
+	root, err := prv.NewKZGProver(log.Root()).GetRoot(blob, 0, 0)
+	if err != nil {
+		return false, fmt.Errorf("compute root of kv %d failed: %w", kvIdx, err)
+	}
+	return bytes.Equal(root[:HashSizeInContract], commit[:HashSizeInContract]), nil
+}
+
+// ReEncodeShard re-encodes the blobs of the shard to newEncodeType in place after the encode type of the shard is
+// changed. The blobs are re-encoded one by one in order, each is decoded with the encode type before re-encoding,
+// encoded with newEncodeType and rewritten, then marked re-encoded in the header of its data file with the storage
+// manager locked, so every blob is read with its own encode type meanwhile. If interrupted, e.g. the node is
+// stopped, calling it again resumes from the last checkpoint of the progress. The shard reports its encode type
+// before re-encoding until all the blobs are re-encoded, and the writes of the blobs and the mining of the shard fail
+// with ErrShardReEncoding until ReEncodeShard returns.
+func (s *StorageManager) ReEncodeShard(shardIdx uint64, newEncodeType uint64) error {
+	s.mu.Lock()
+	ds, ok := s.shardManager.shardMap[shardIdx]
+	if !ok {
+		s.mu.Unlock()
+		return fmt.Errorf("shard %d not found", shardIdx)
+	}
+	oldEncodeType := ds.EncodeType()
+	started, err := ds.StartReEncode(newEncodeType)
 	s.mu.Unlock()
+	if err != nil || !started {
+		return err
+	}
+	log.Info("Re-encoding shard", "shard", shardIdx, "from", oldEncodeType, "to", newEncodeType)
 
-	for _, sid := range s.Shards() {
-		first, limit := s.KvEntries()*sid, s.KvEntries()*(sid+1)
+	kvEntries := s.KvEntries()
+	rewritten := 0
+	for kvIdx := shardIdx * kvEntries; kvIdx < (shardIdx+1)*kvEntries; kvIdx++ {
+		ok, err := s.reEncodeKV(ds, kvIdx)
+		if err != nil {
+			s.mu.Lock()
+			if cerr := ds.CheckpointReEncode(); cerr != nil {
+				log.Warn("Failed to checkpoint re-encoding", "shard", shardIdx, "err", cerr)
+			}
+			s.mu.Unlock()
+			return fmt.Errorf("re-encode kv %d failed: %w", kvIdx, err)
+		}
+		if ok {
+			rewritten++
+		}
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if err := ds.FinishReEncode(); err != nil {
+		return err
+	}
+	log.Info("Re-encoded shard", "shard", shardIdx, "encodeType", newEncodeType, "rewritten", rewritten)
+	return nil
+}
 
-		// batch request metas until the lastKvIdx
-		end := limit
-		if end > lastKvIdx {
-			end = lastKvIdx
+func (s *StorageManager) reEncodeKV(ds *DataShard, kvIdx uint64) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	rewritten, err := ds.ReEncodeKV(kvIdx)
+	if rewritten && err == nil {
+		// only the synced blobs are rewritten, whose commits are kept in the metas
+		if meta, ok, _ := s.shardManager.TryReadMeta(kvIdx); ok {
+			s.notifyBlobWritten(kvIdx, common.BytesToHash(meta), false)
 		}
+	}
+	return rewritten, err
+}
 
-		// Additional check to ensure end is not less than first
-		// E.g. There are more than one shard, and lastKvIdx is even less than the first of the current shard
-		if end < first {
-			continue
+// ShardOccupancy returns the occupancy bitmap of the local shard. The bitmap has KvEntries bits, the bit of
+// the i-th kv of the shard is bit i%8 (least significant bit first) of byte i/8, which is set if the blob is
+// synced locally; the bits of the blobs not synced yet or just empty filled are unset.
+func (s *StorageManager) ShardOccupancy(shardIdx uint64) ([]byte, error) {
+	if _, ok := s.GetShardMiner(shardIdx); !ok {
+		return nil, fmt.Errorf("shard %d not found", shardIdx)
+	}
+
+	kvEntries := s.KvEntries()
+	bitmap := make([]byte, (kvEntries+7)/8)
+	for i := uint64(0); i < kvEntries; i++ {
+		kvIdx := shardIdx*kvEntries + i
+		meta, success, err := s.TryReadMeta(kvIdx)
+		if !success || err != nil {
+			return nil, fmt.Errorf("read meta of kv %d failed: %v", kvIdx, err)
+		}
+		if IsBlobSynced(common.BytesToHash(meta)) {
+			bitmap[i/8] |= 1 << (i % 8)
 		}
+	}
+	return bitmap, nil
+}
 
-		log.Info("Begin to download metas", "shard", sid, "first", first, "end", end, "limit", limit, "lastKvIdx", lastKvIdx)
-		ts := time.Now()
+// ShardManifestEntry is the commit of a kv listed in a ShardManifest, as read from the local meta of the kv.
+type ShardManifestEntry struct {
+	KvIdx  uint64
+	Commit common.Hash
+}
 
-		err := s.downloadMetaInParallel(ctx, first, end, batchSize)
-		if err != nil {
+// ShardManifest lists the commits of all the kvs of a shard in the order of the kv indexes, with a hash over them,
+// so the peers can compare the hashes to detect a divergence of the shard before syncing it.
+type ShardManifest struct {
+	ShardIdx uint64
+	Entries  []ShardManifestEntry
+	Hash     common.Hash // keccak256 of the big endian kv index and the commit of each entry in order
+}
+
+// ShardManifest builds the manifest of the local shard from the metas of its kvs.
+func (s *StorageManager) ShardManifest(shardIdx uint64) (*ShardManifest, error) {
+	if _, ok := s.GetShardMiner(shardIdx); !ok {
+		return nil, fmt.Errorf("shard %d not found", shardIdx)
+	}
+
+	kvEntries := s.KvEntries()
+	manifest := &ShardManifest{
+		ShardIdx: shardIdx,
+		Entries:  make([]ShardManifestEntry, 0, kvEntries),
+	}
+	hasher := crypto.NewKeccakState()
+	for kvIdx := shardIdx * kvEntries; kvIdx < (shardIdx+1)*kvEntries; kvIdx++ {
+		meta, success, err := s.TryReadMeta(kvIdx)
+		if !success || err != nil {
+			return nil, fmt.Errorf("read meta of kv %d failed: %v", kvIdx, err)
+		}
+		entry := ShardManifestEntry{KvIdx: kvIdx, Commit: common.BytesToHash(meta)}
+		manifest.Entries = append(manifest.Entries, entry)
+		hasher.Write(binary.BigEndian.AppendUint64(nil, kvIdx))
+		hasher.Write(entry.Commit[:])
+	}
+	hasher.Read(manifest.Hash[:])
+	return manifest, nil
+}
+
+// UnverifiedBlobs returns the kv indexes of the shard below the last kv index whose blob is missing locally or does
+// not match the commit downloaded from the contract. If the commit of a kv is not downloaded yet, e.g. just restarted,
+// only the local presence is checked as the blob was verified when it was committed.
+func (s *StorageManager) UnverifiedBlobs(shardIdx uint64) ([]uint64, error) {
+	if _, ok := s.GetShardMiner(shardIdx); !ok {
+		return nil, fmt.Errorf("shard %d not found", shardIdx)
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	first, limit := shardIdx*s.KvEntries(), (shardIdx+1)*s.KvEntries()
+	if limit > s.lastKvIdx {
+		limit = s.lastKvIdx
+	}
+	unverified := make([]uint64, 0)
+	for kvIdx := first; kvIdx < limit; kvIdx++ {
+		m, success, err := s.shardManager.TryReadMeta(kvIdx)
+		if !success || err != nil {
+			return nil, fmt.Errorf("read meta of kv %d failed: %v", kvIdx, err)
+		}
+		localMeta := common.BytesToHash(m)
+		if !IsBlobSynced(localMeta) {
+			unverified = append(unverified, kvIdx)
+			continue
+		}
+		contractMeta, ok := s.blobMetas[kvIdx]
+		if ok && !bytes.Equal(contractMeta[32-HashSizeInContract:32], localMeta[0:HashSizeInContract]) {
+			unverified = append(unverified, kvIdx)
+		}
+	}
+	return unverified, nil
+}
+
+// DownloadAllMetas This function download the blob hashes of all the local storage shards from the smart contract
+func (s *StorageManager) DownloadAllMetas(ctx context.Context, batchSize uint64) error {
+	for _, sid := range s.Shards() {
+		if err := s.DownloadShardMetas(ctx, sid, batchSize); err != nil {
 			return err
 		}
+	}
+
+	return nil
+}
+
+// DownloadShardMetas This function download the blob hashes of a local storage shard from the smart contract
+func (s *StorageManager) DownloadShardMetas(ctx context.Context, sid uint64, batchSize uint64) error {
+	s.mu.Lock()
+	lastKvIdx := s.lastKvIdx
+	s.mu.Unlock()
+
+	first, limit := s.KvEntries()*sid, s.KvEntries()*(sid+1)
+
+	// batch request metas until the lastKvIdx
+	end := limit
+	if end > lastKvIdx {
+		end = lastKvIdx
+	}
+
+	// Additional check to ensure end is not less than first
+	// E.g. There are more than one shard, and lastKvIdx is even less than the first of the current shard
+	if end < first {
+		return nil
+	}
 
-		log.Info("All the metas has been downloaded", "first", first, "end", end, "time", time.Since(ts).Seconds())
+	log.Info("Begin to download metas", "shard", sid, "first", first, "end", end, "limit", limit, "lastKvIdx", lastKvIdx)
+	ts := time.Now()
+
+	err := s.downloadMetaInParallel(ctx, first, end, batchSize)
+	if err != nil {
+		return err
 	}
 
+	log.Info("All the metas has been downloaded", "first", first, "end", end, "time", time.Since(ts).Seconds())
 	return nil
 }
 
+// DownloadMetas downloads the blob hashes of the kvs in [first, limit) until the lastKvIdx from the smart contract,
+// e.g. the blobs appended to the contract after the metas of the shard are downloaded.
+func (s *StorageManager) DownloadMetas(ctx context.Context, first, limit, batchSize uint64) error {
+	s.mu.Lock()
+	lastKvIdx := s.lastKvIdx
+	s.mu.Unlock()
+
+	if limit > lastKvIdx {
+		limit = lastKvIdx
+	}
+	if limit <= first {
+		return nil
+	}
+	return s.downloadMetaInParallel(ctx, first, limit, batchSize)
+}
+
 func (s *StorageManager) downloadMetaInParallel(ctx context.Context, from, to, batchSize uint64) error {
 	var wg sync.WaitGroup
 	taskNum := uint64(MetaDownloadThread)
@@ -526,6 +1033,28 @@ func (s *StorageManager) TryReadEncoded(kvIdx uint64, readLen int) ([]byte, bool
 	return s.shardManager.TryReadEncoded(kvIdx, readLen)
 }
 
+// TryReadEncodedAt reads the encoded data of readLen bytes from the local storage file starting at the offset of
+// the blob, e.g. to serve only the missing tail of a partially transferred blob. The offset must be aligned to the
+// chunk size and the range must be within MaxKvSize. Like TryReadEncoded, it returns err for an empty or not synced blob.
+func (s *StorageManager) TryReadEncodedAt(kvIdx uint64, offset uint64, readLen int) ([]byte, bool, error) {
+	if offset%s.shardManager.ChunkSize() != 0 {
+		return nil, false, fmt.Errorf("offset %d is not aligned to chunk size %d", offset, s.shardManager.ChunkSize())
+	}
+	if readLen < 0 || offset+uint64(readLen) > s.MaxKvSize() {
+		return nil, false, fmt.Errorf("read range out of kv size, offset %d, readLen %d, kvSize %d", offset, readLen, s.MaxKvSize())
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	err := s.syncCheck(kvIdx)
+	if err != nil {
+		return nil, false, err
+	}
+
+	return s.shardManager.TryReadEncodedAt(kvIdx, offset, readLen)
+}
+
 func (s *StorageManager) TryRead(kvIdx uint64, readLen int, commit common.Hash) ([]byte, bool, error) {
 	s.mu.Lock()
 	defer s.mu.Unlock()
@@ -545,6 +1074,28 @@ func (s *StorageManager) LastKvIndex() uint64 {
 	return s.lastKvIdx
 }
 
+// ContractCommit returns the commit of the kv in the meta downloaded from the contract, and false if the meta is not
+// downloaded.
+func (s *StorageManager) ContractCommit(kvIdx uint64) (common.Hash, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	meta, ok := s.blobMetas[kvIdx]
+	if !ok {
+		return common.Hash{}, false
+	}
+	commit := common.Hash{}
+	copy(commit[:HashSizeInContract], meta[32-HashSizeInContract:32])
+	return commit, true
+}
+
+// DownloadKvIndex returns the kv index from which the blobs are written by the downloader, i.e. the lastKvIndex at
+// the latest reset, as DownloadFinished writes the blobs appended since then along with the growth of lastKvIndex.
+func (s *StorageManager) DownloadKvIndex() uint64 {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.resetKvIdx
+}
+
 func (s *StorageManager) DecodeKV(kvIdx uint64, b []byte, hash common.Hash, providerAddr common.Address, encodeType uint64) ([]byte, bool, error) {
 	return s.shardManager.DecodeKV(kvIdx, b, hash, providerAddr, encodeType)
 }
@@ -567,11 +1118,21 @@ func (s *StorageManager) Shards() []uint64 {
 
 func (s *StorageManager) ReadSampleUnlocked(shardIdx, sampleIdx uint64) (common.Hash, error) {
 	if ds, ok := s.shardManager.shardMap[shardIdx]; ok {
+		// the samples of a shard being re-encoded are of different encode types, so they can not be mined
+		if ds.IsReEncoding() {
+			return common.Hash{}, fmt.Errorf("%w: shard %d", ErrShardReEncoding, shardIdx)
+		}
 		return ds.ReadSample(sampleIdx)
 	}
 	return common.Hash{}, errors.New("shard not found")
 }
 
+// IsShardReEncoding returns whether the shard is being re-encoded by ReEncodeShard, so it is not written or mined.
+func (s *StorageManager) IsShardReEncoding(shardIdx uint64) bool {
+	ds, ok := s.shardManager.shardMap[shardIdx]
+	return ok && ds.IsReEncoding()
+}
+
 func (s *StorageManager) GetShardMiner(shardIdx uint64) (common.Address, bool) {
 	return s.shardManager.GetShardMiner(shardIdx)
 }
@@ -596,6 +1157,25 @@ func (s *StorageManager) KvEntriesBits() uint64 {
 	return s.shardManager.kvEntriesBits
 }
 
+// FilledBitmap returns the bitmap of the kvs of the shard filled with an empty blob, see
+// ShardManager.FilledBitmap.
+func (s *StorageManager) FilledBitmap(shardIdx uint64) ([]byte, error) {
+	return s.shardManager.FilledBitmap(shardIdx)
+}
+
+// SyncShard flushes the blobs written to the shard to disk, see ShardManager.SyncShard.
+func (s *StorageManager) SyncShard(shardIdx uint64) error {
+	return s.shardManager.SyncShard(shardIdx)
+}
+
 func (s *StorageManager) Close() error {
+	s.writtenMu.Lock()
+	if s.writtenStop != nil {
+		close(s.writtenStop)
+		s.writtenStop = nil
+		// the writes waiting for the full queue drop their events, as they are not dispatched any more
+		s.writtenTaken.Broadcast()
+	}
+	s.writtenMu.Unlock()
 	return s.shardManager.Close()
 }
@@ -4,12 +4,17 @@
 package ethstorage
 
 import (
+	"bytes"
 	"context"
 	"encoding/binary"
 	"errors"
 	"fmt"
+	"io"
 	"os"
+	"slices"
+	"strings"
 	"testing"
+	"time"
 
 	"github.com/detailyang/go-fallocate"
 	"github.com/ethereum/go-ethereum/common"
@@ -138,7 +143,7 @@ func generateMetadata(idx, size uint64, hash []byte) common.Hash {
 	return common.BytesToHash(meta)
 }
 
-func setup(t *testing.T) {
+func setup(t testing.TB) {
 	// create l1
 	metafile, err := createMetaFile(metafileName, int64(kvEntries))
 	if err != nil {
@@ -234,6 +239,93 @@ func TestStorageManager_CommitBlobs(t *testing.T) {
 	}
 }
 
+// TestStorageManager_OnBlobWritten tests the listeners are notified once a blob is written, and not for the blob
+// failing to be written or already stored.
+func TestStorageManager_OnBlobWritten(t *testing.T) {
+	setup(t)
+	defer storageManager.Close()
+
+	writtenCh := make(chan uint64, 4)
+	storageManager.OnBlobWritten(func(kvIdx uint64, commit common.Hash, empty bool) {
+		writtenCh <- kvIdx
+	})
+	kvIndex := uint64(2)
+	b, h := createBlob(kvIndex)
+	if err := storageManager.CommitBlob(kvIndex, b, common.Hash{0xff}); err == nil {
+		t.Fatal("blob with a mismatched commit should not be committed")
+	}
+	// the blob is already stored by setup, so it is not written again
+	if _, err := storageManager.CommitBlobs([]uint64{kvIndex}, [][]byte{b}, []common.Hash{h}); err != nil {
+		t.Fatal("failed to commit blob", err)
+	}
+	if _, err := storageManager.OverwriteBlobs([]uint64{kvIndex}, [][]byte{b}, []common.Hash{h}); err != nil {
+		t.Fatal("failed to overwrite blob", err)
+	}
+	select {
+	case idx := <-writtenCh:
+		if idx != kvIndex {
+			t.Fatalf("listener is notified of blob %d, expected %d", idx, kvIndex)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("listener is not notified of the blob written")
+	}
+	select {
+	case idx := <-writtenCh:
+		t.Fatalf("listener is notified of blob %d not written", idx)
+	case <-time.After(100 * time.Millisecond):
+	}
+}
+
+// TestStorageManager_OnBlobWrittenBounded tests the writes wait for a slow listener once the queue of the blobs
+// written is full, instead of queuing them without a bound, and all the blobs are notified in order once it catches up.
+func TestStorageManager_OnBlobWrittenBounded(t *testing.T) {
+	setup(t)
+	defer storageManager.Close()
+
+	storageManager.writtenQueueSize = 1
+	release := make(chan struct{})
+	writtenCh := make(chan uint64, 4)
+	storageManager.OnBlobWritten(func(kvIdx uint64, commit common.Hash, empty bool) {
+		<-release
+		writtenCh <- kvIdx
+	})
+	kvIndexes := []uint64{1, 2, 3}
+	blobs, hashes := make([][]byte, len(kvIndexes)), make([]common.Hash, len(kvIndexes))
+	for i, idx := range kvIndexes {
+		blobs[i], hashes[i] = createBlob(idx)
+	}
+	done := make(chan error, 1)
+	go func() {
+		_, err := storageManager.OverwriteBlobs(kvIndexes, blobs, hashes)
+		done <- err
+	}()
+	select {
+	case <-done:
+		t.Fatal("writes should wait for the listener once the queue is full")
+	case <-time.After(200 * time.Millisecond):
+	}
+
+	close(release)
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Fatal("failed to overwrite blobs", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("writes should resume once the listener catches up")
+	}
+	for _, expected := range kvIndexes {
+		select {
+		case idx := <-writtenCh:
+			if idx != expected {
+				t.Fatalf("listener is notified of blob %d, expected %d", idx, expected)
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("listener is not notified of blob %d", expected)
+		}
+	}
+}
+
 func TestStorageManager_DownloadAllMeta(t *testing.T) {
 	setup(t)
 	err := storageManager.DownloadAllMetas(context.Background(), 4)
@@ -254,3 +346,929 @@ func TestStorageManager_DownloadAllMeta(t *testing.T) {
 		t.Fatal("failed to compare meta", err)
 	}
 }
+
+func TestStorageManager_VerifyShard(t *testing.T) {
+	setup(t)
+
+	kvIndexes := []uint64{1, 2, 3}
+	encodedBlobs := make([][]byte, len(kvIndexes))
+	hashes := make([]common.Hash, len(kvIndexes))
+	for i, idx := range kvIndexes {
+		blob, hash := createBlob(idx)
+		encodedBlob, success, err := storageManager.shardManager.TryEncodeKV(idx, blob, hash)
+		if !success || err != nil {
+			t.Fatal("failed to encode blob", err)
+		}
+		encodedBlobs[i] = encodedBlob
+		hashes[i] = hash
+	}
+	err := storageManager.DownloadFinished(97529, kvIndexes, encodedBlobs, hashes)
+	if err != nil {
+		t.Fatal("failed to Download Finished", err)
+	}
+
+	corrupt, err := storageManager.VerifyShard(0)
+	if err != nil {
+		t.Fatal("failed to verify shard", err)
+	}
+	if len(corrupt) != 0 {
+		t.Fatalf("expected no corrupt blob, got %v", corrupt)
+	}
+
+	// flip a byte of kv 2 in the data file
+	kvIndex := uint64(2)
+	df := storageManager.shardManager.shardMap[0].GetStorageFile(kvIndex)
+	chunk, err := df.Read(kvIndex, 1)
+	if err != nil {
+		t.Fatal("failed to read data file", err)
+	}
+	chunk[0] = ^chunk[0]
+	if err := df.Write(kvIndex, chunk); err != nil {
+		t.Fatal("failed to write data file", err)
+	}
+
+	corrupt, err = storageManager.VerifyShard(0)
+	if err != nil {
+		t.Fatal("failed to verify shard", err)
+	}
+	if len(corrupt) != 1 || corrupt[0] != kvIndex {
+		t.Fatalf("expected corrupt blob %d, got %v", kvIndex, corrupt)
+	}
+}
+
+// downloadVerifyBlobs writes the blobs of all the kv indexes of the shard, and corrupts the blobs of kv 2, 5 and 11
+// in the data file, it returns the corrupt kv indexes.
+func downloadVerifyBlobs(t testing.TB) []uint64 {
+	kvIndexes := make([]uint64, 0, kvEntries)
+	for idx := uint64(0); idx < kvEntries; idx++ {
+		kvIndexes = append(kvIndexes, idx)
+	}
+	encodedBlobs := make([][]byte, len(kvIndexes))
+	hashes := make([]common.Hash, len(kvIndexes))
+	for i, idx := range kvIndexes {
+		blob, hash := createBlob(idx)
+		encodedBlob, success, err := storageManager.shardManager.TryEncodeKV(idx, blob, hash)
+		if !success || err != nil {
+			t.Fatal("failed to encode blob", err)
+		}
+		encodedBlobs[i] = encodedBlob
+		hashes[i] = hash
+	}
+	if err := storageManager.DownloadFinished(97529, kvIndexes, encodedBlobs, hashes); err != nil {
+		t.Fatal("failed to Download Finished", err)
+	}
+
+	corrupt := []uint64{2, 5, 11}
+	for _, kvIndex := range corrupt {
+		df := storageManager.shardManager.shardMap[0].GetStorageFile(kvIndex)
+		chunk, err := df.Read(kvIndex, 1)
+		if err != nil {
+			t.Fatal("failed to read data file", err)
+		}
+		chunk[0] = ^chunk[0]
+		if err := df.Write(kvIndex, chunk); err != nil {
+			t.Fatal("failed to write data file", err)
+		}
+	}
+	return corrupt
+}
+
+func TestStorageManager_VerifyShardParallel(t *testing.T) {
+	setup(t)
+	expected := downloadVerifyBlobs(t)
+
+	sequential, err := storageManager.VerifyShard(0)
+	if err != nil {
+		t.Fatal("failed to verify shard", err)
+	}
+	if !slices.Equal(sequential, expected) {
+		t.Fatalf("expected corrupt blobs %v, got %v", expected, sequential)
+	}
+	for _, workers := range []int{1, 2, 4, 16, 32} {
+		parallel, err := storageManager.VerifyShardParallel(0, workers)
+		if err != nil {
+			t.Fatal("failed to verify shard in parallel", err)
+		}
+		if !slices.Equal(parallel, sequential) {
+			t.Fatalf("workers %d: parallel verification reports %v, sequential reports %v", workers, parallel, sequential)
+		}
+	}
+
+	if _, err := storageManager.VerifyShardParallel(0, 0); err == nil {
+		t.Fatal("expected error for non-positive workers")
+	}
+	if _, err := storageManager.VerifyShardParallel(1, 4); err == nil {
+		t.Fatal("expected error for unknown shard")
+	}
+}
+
+func BenchmarkStorageManager_VerifyShardParallel(b *testing.B) {
+	setup(b)
+	downloadVerifyBlobs(b)
+
+	for _, workers := range []int{1, 4, 16} {
+		b.Run(fmt.Sprintf("workers-%d", workers), func(b *testing.B) {
+			for i := 0; i < b.N; i++ {
+				if _, err := storageManager.VerifyShardParallel(0, workers); err != nil {
+					b.Fatal("failed to verify shard in parallel", err)
+				}
+			}
+		})
+	}
+}
+
+func TestStorageManager_VerifyBlobAgainstCommit(t *testing.T) {
+	setup(t)
+
+	kvIndex := uint64(1)
+	blob, hash := createBlob(kvIndex)
+	encodedBlob, success, err := storageManager.shardManager.TryEncodeKV(kvIndex, blob, hash)
+	if !success || err != nil {
+		t.Fatal("failed to encode blob", err)
+	}
+	err = storageManager.DownloadFinished(97529, []uint64{kvIndex}, [][]byte{encodedBlob}, []common.Hash{hash})
+	if err != nil {
+		t.Fatal("failed to Download Finished", err)
+	}
+
+	ok, err := storageManager.VerifyBlobAgainstCommit(kvIndex, hash)
+	if err != nil {
+		t.Fatal("failed to verify blob", err)
+	}
+	if !ok {
+		t.Fatalf("expected blob %d to match its commit", kvIndex)
+	}
+
+	_, otherHash := createBlob(kvIndex + 1)
+	ok, err = storageManager.VerifyBlobAgainstCommit(kvIndex, otherHash)
+	if err != nil {
+		t.Fatal("failed to verify blob", err)
+	}
+	if ok {
+		t.Fatalf("expected blob %d not to match another commit", kvIndex)
+	}
+}
+
+func TestStorageManager_TryReadEncodedAt(t *testing.T) {
+	chunkSize, kvSize := uint64(4096), uint64(131072)
+	sm, files := createEthStorage(contractAddress, []uint64{0}, chunkSize, kvSize, kvEntries, common.Address{}, ENCODE_KECCAK_256)
+	if sm == nil {
+		t.Fatalf("createEthStorage failed")
+	}
+	defer func(files []string) {
+		for _, file := range files {
+			os.Remove(file)
+		}
+	}(files)
+	s := NewStorageManager(sm, nil)
+
+	kvIndex := uint64(3)
+	blob, hash := createBlob(kvIndex)
+	if success, err := sm.TryWrite(kvIndex, blob, hash); !success || err != nil {
+		t.Fatal("failed to write blob", err)
+	}
+	full, success, err := s.TryReadEncoded(kvIndex, int(kvSize))
+	if !success || err != nil {
+		t.Fatal("failed to read encoded blob", err)
+	}
+
+	// a middle chunk
+	offset := 2 * chunkSize
+	chunk, success, err := s.TryReadEncodedAt(kvIndex, offset, int(chunkSize))
+	if !success || err != nil {
+		t.Fatal("failed to read encoded chunk", err)
+	}
+	if !bytes.Equal(chunk, full[offset:offset+chunkSize]) {
+		t.Fatalf("encoded chunk at offset %d does not match the full blob", offset)
+	}
+	// the tail across chunks
+	offset = kvSize - 3*chunkSize
+	tail, success, err := s.TryReadEncodedAt(kvIndex, offset, int(kvSize-offset))
+	if !success || err != nil {
+		t.Fatal("failed to read encoded tail", err)
+	}
+	if !bytes.Equal(tail, full[offset:]) {
+		t.Fatalf("encoded tail at offset %d does not match the full blob", offset)
+	}
+
+	if _, _, err := s.TryReadEncodedAt(kvIndex, chunkSize+1, int(chunkSize)); err == nil {
+		t.Fatal("expected error reading at an unaligned offset")
+	}
+	if _, _, err := s.TryReadEncodedAt(kvIndex, kvSize-chunkSize, int(2*chunkSize)); err == nil {
+		t.Fatal("expected error reading beyond the kv size")
+	}
+}
+
+func TestStorageManager_ShardOccupancy(t *testing.T) {
+	setup(t)
+
+	// kv 1, 2 and 3 are synced in setup, sync kv 9 and 14 to make the shard sparse
+	kvIndexes := []uint64{9, 14}
+	encodedBlobs := make([][]byte, len(kvIndexes))
+	hashes := make([]common.Hash, len(kvIndexes))
+	for i, idx := range kvIndexes {
+		blob, hash := createBlob(idx)
+		encodedBlob, success, err := storageManager.shardManager.TryEncodeKV(idx, blob, hash)
+		if !success || err != nil {
+			t.Fatal("failed to encode blob", err)
+		}
+		encodedBlobs[i] = encodedBlob
+		hashes[i] = hash
+	}
+	err := storageManager.DownloadFinished(97529, kvIndexes, encodedBlobs, hashes)
+	if err != nil {
+		t.Fatal("failed to Download Finished", err)
+	}
+
+	bitmap, err := storageManager.ShardOccupancy(0)
+	if err != nil {
+		t.Fatal("failed to get shard occupancy", err)
+	}
+	expected := []byte{0b00001110, 0b01000010}
+	if !bytes.Equal(bitmap, expected) {
+		t.Fatalf("expected occupancy bitmap %08b, got %08b", expected, bitmap)
+	}
+	for i := uint64(0); i < kvEntries; i++ {
+		occupied := bitmap[i/8]&(1<<(i%8)) != 0
+		synced := storageManager.syncCheck(i) == nil
+		if occupied != synced {
+			t.Fatalf("occupancy of kv %d is %v, but synced is %v", i, occupied, synced)
+		}
+	}
+
+	if _, err := storageManager.ShardOccupancy(1); err == nil {
+		t.Fatal("expected error for the shard not found")
+	}
+}
+
+func TestStorageManager_ShardManifest(t *testing.T) {
+	dir := t.TempDir()
+	newStorage := func(name string) *StorageManager {
+		sm := NewShardManager(contractAddress, 131072, kvEntries, 131072)
+		fileName := fmt.Sprintf("%s/%s.dat", dir, name)
+		if _, err := Create(fileName, 0, kvEntries, 0, 131072, defaultEncodeType, common.Address{}, 131072); err != nil {
+			t.Fatal("failed to create data file", err)
+		}
+		df, err := OpenDataFile(fileName)
+		if err != nil {
+			t.Fatal("failed to open data file", err)
+		}
+		if err := sm.AddDataFileAndShard(df); err != nil {
+			t.Fatal("failed to add data file", err)
+		}
+		t.Cleanup(func() { sm.Close() })
+		return NewStorageManager(sm, &mockL1Source{lastBlobIndex: lastKvIndex})
+	}
+	// both shards have the same commits of kv 1, 2 and 3
+	storages := []*StorageManager{newStorage("manifest-a"), newStorage("manifest-b")}
+	for _, s := range storages {
+		for _, idx := range []uint64{1, 2, 3} {
+			_, hash := createBlob(idx)
+			if err := s.shardManager.ShardMap()[0].WriteMeta(idx, hash[:]); err != nil {
+				t.Fatal("failed to write meta", err)
+			}
+		}
+	}
+
+	manifestA, err := storages[0].ShardManifest(0)
+	if err != nil {
+		t.Fatal("failed to build shard manifest", err)
+	}
+	manifestB, err := storages[1].ShardManifest(0)
+	if err != nil {
+		t.Fatal("failed to build shard manifest", err)
+	}
+	if uint64(len(manifestA.Entries)) != kvEntries {
+		t.Fatalf("expected %d manifest entries, got %d", kvEntries, len(manifestA.Entries))
+	}
+	for i, entry := range manifestA.Entries {
+		if entry.KvIdx != uint64(i) {
+			t.Fatalf("manifest entry %d has kv index %d", i, entry.KvIdx)
+		}
+	}
+	if manifestA.Hash != manifestB.Hash {
+		t.Fatalf("identical shards should have the same manifest hash, %s != %s", manifestA.Hash.Hex(), manifestB.Hash.Hex())
+	}
+
+	// a single byte different in the commit of a kv changes the manifest hash
+	_, hash := createBlob(2)
+	hash[0] ^= 1
+	if err := storages[1].shardManager.ShardMap()[0].WriteMeta(2, hash[:]); err != nil {
+		t.Fatal("failed to write meta", err)
+	}
+	if manifestB, err = storages[1].ShardManifest(0); err != nil {
+		t.Fatal("failed to build shard manifest", err)
+	}
+	if manifestA.Hash == manifestB.Hash {
+		t.Fatal("shards differing in a byte should have different manifest hashes")
+	}
+
+	if _, err := storages[0].ShardManifest(1); err == nil {
+		t.Fatal("expected error for the shard not found")
+	}
+}
+
+func TestStorageManager_ExportImportShard(t *testing.T) {
+	setup(t)
+
+	kvIndexes := []uint64{1, 2, 3}
+	encodedBlobs := make([][]byte, len(kvIndexes))
+	hashes := make([]common.Hash, len(kvIndexes))
+	for i, idx := range kvIndexes {
+		blob, hash := createBlob(idx)
+		encodedBlob, success, err := storageManager.shardManager.TryEncodeKV(idx, blob, hash)
+		if !success || err != nil {
+			t.Fatal("failed to encode blob", err)
+		}
+		encodedBlobs[i] = encodedBlob
+		hashes[i] = hash
+	}
+	err := storageManager.DownloadFinished(97529, kvIndexes, encodedBlobs, hashes)
+	if err != nil {
+		t.Fatal("failed to Download Finished", err)
+	}
+
+	var buf bytes.Buffer
+	exported, err := storageManager.ExportShard(0, &buf)
+	if err != nil {
+		t.Fatal("failed to export shard", err)
+	}
+	if exported != uint64(len(kvIndexes)) {
+		t.Fatalf("expected %d exported blobs, got %d", len(kvIndexes), exported)
+	}
+
+	// import into a fresh shard of another miner, so the blobs are encoded differently
+	sm := NewShardManager(contractAddress, 131072, kvEntries, 131072)
+	sm.AddDataShard(0)
+	fileName := t.TempDir() + "/import-0.dat"
+	if _, err := Create(fileName, 0, kvEntries, 0, 131072, defaultEncodeType, common.HexToAddress("0x1"), sm.ChunkSize()); err != nil {
+		t.Fatal("failed to create data file", err)
+	}
+	df, err := OpenDataFile(fileName)
+	if err != nil {
+		t.Fatal("failed to open data file", err)
+	}
+	sm.AddDataFile(df)
+	imported := NewStorageManager(sm, storageManager.l1Source)
+	defer imported.Close()
+
+	count, err := imported.ImportShard(bytes.NewReader(buf.Bytes()))
+	if err != nil {
+		t.Fatal("failed to import shard", err)
+	}
+	if count != exported {
+		t.Fatalf("expected %d imported blobs, got %d", exported, count)
+	}
+	for i := uint64(0); i < kvEntries; i++ {
+		meta, success, err := imported.TryReadMeta(i)
+		if err != nil || !success {
+			t.Fatal("failed to read meta", err)
+		}
+		expectedMeta, _, _ := storageManager.TryReadMeta(i)
+		if !bytes.Equal(meta, expectedMeta) {
+			t.Fatalf("meta of kv %d mismatch, expected %x, got %x", i, expectedMeta, meta)
+		}
+		if !IsBlobSynced(common.BytesToHash(meta)) {
+			continue
+		}
+		blob, success, err := imported.TryRead(i, 131072, common.BytesToHash(meta))
+		if err != nil || !success {
+			t.Fatal("failed to read blob", err)
+		}
+		expected, _ := createBlob(i)
+		if !bytes.Equal(blob, expected) {
+			t.Fatalf("blob of kv %d mismatch", i)
+		}
+	}
+
+	// a corrupt export is rejected
+	corrupt := bytes.Clone(buf.Bytes())
+	corrupt[len(corrupt)-100] ^= 0xff
+	if _, err := imported.ImportShard(bytes.NewReader(corrupt)); err == nil {
+		t.Fatal("expected error for the corrupt export")
+	}
+}
+
+func TestStorageManager_ReEncodeShard(t *testing.T) {
+	miner := common.HexToAddress("0x1")
+	fileName := t.TempDir() + "/reencode-0.dat"
+	if _, err := Create(fileName, 0, kvEntries, 0, 131072, ENCODE_KECCAK_256, miner, 131072); err != nil {
+		t.Fatal("failed to create data file", err)
+	}
+	open := func() (*ShardManager, *DataShard) {
+		sm := NewShardManager(contractAddress, 131072, kvEntries, 131072)
+		sm.AddDataShard(0)
+		df, err := OpenDataFile(fileName)
+		if err != nil {
+			t.Fatal("failed to open data file", err)
+		}
+		if err := sm.AddDataFile(df); err != nil {
+			t.Fatal("failed to add data file", err)
+		}
+		return sm, sm.ShardMap()[0]
+	}
+	checkBlobs := func(s *StorageManager, kvIndexes []uint64) {
+		for _, idx := range kvIndexes {
+			expected, hash := createBlob(idx)
+			blob, success, err := s.TryRead(idx, 131072, hash)
+			if !success || err != nil {
+				t.Fatalf("failed to read blob %d: %v", idx, err)
+			}
+			if !bytes.Equal(blob, expected) {
+				t.Fatalf("blob of kv %d mismatch", idx)
+			}
+		}
+	}
+
+	sm, ds := open()
+	kvIndexes := []uint64{1, 2, 3}
+	for _, idx := range kvIndexes {
+		blob, hash := createBlob(idx)
+		if success, err := sm.TryWrite(idx, blob, hash); !success || err != nil {
+			t.Fatal("failed to write blob", err)
+		}
+	}
+
+	// interrupt the re-encoding after kv 2 is rewritten but before it is marked re-encoded
+	if started, err := ds.StartReEncode(ENCODE_BLOB_POSEIDON); !started || err != nil {
+		t.Fatal("failed to start re-encoding", err)
+	}
+	for _, idx := range []uint64{0, 1} {
+		if _, err := ds.ReEncodeKV(idx); err != nil {
+			t.Fatal("failed to re-encode kv", err)
+		}
+	}
+	// the progress is written to the header in checkpoints instead of for each kv, and once the data file is closed
+	if df := ds.dataFiles[0]; df.reEncodeNext != 2 || df.reEncodeSaved != 0 {
+		t.Fatalf("re-encoding progress should be checkpointed every %d kvs, next %d, saved %d", reEncodeCheckpointKvs,
+			df.reEncodeNext, df.reEncodeSaved)
+	}
+	// the blobs of the shard being re-encoded are not written
+	if _, err := sm.TryWrite(4, []byte{}, common.Hash{}); !errors.Is(err, ErrShardReEncoding) {
+		t.Fatalf("write should be rejected while re-encoding, err: %v", err)
+	}
+	blob, hash := createBlob(2)
+	err := ds.WriteWith(2, blob, hash, func(cdata []byte, chunkIdx uint64) []byte {
+		return encodeChunk(ds.chunkSize, cdata, ENCODE_BLOB_POSEIDON, calcEncodeKey(hash, chunkIdx, miner))
+	})
+	if err != nil {
+		t.Fatal("failed to write blob", err)
+	}
+	sm.Close()
+
+	sm, ds = open()
+	s := NewStorageManager(sm, nil)
+	defer s.Close()
+	if !ds.IsReEncoding() {
+		t.Fatal("expected the re-encoding to be resumable")
+	}
+	if next := ds.dataFiles[0].reEncodeNext; next != 2 {
+		t.Fatalf("re-encoding should be resumed from the progress kept on close, next %d", next)
+	}
+	// the shard being re-encoded is not mined
+	if _, err := s.ReadSampleUnlocked(0, 0); !errors.Is(err, ErrShardReEncoding) || !s.IsShardReEncoding(0) {
+		t.Fatalf("mining should be rejected while re-encoding, err: %v", err)
+	}
+	if encodeType, _ := s.GetShardEncodeType(0); encodeType != ENCODE_KECCAK_256 {
+		t.Fatalf("expected encode type %d during re-encoding, got %d", ENCODE_KECCAK_256, encodeType)
+	}
+	checkBlobs(s, []uint64{1, 3})
+	// kv 1 is already re-encoded while kv 3 is not, both are verified with the encode type of their own
+	for _, idx := range []uint64{1, 3} {
+		_, hash := createBlob(idx)
+		if ok, err := s.VerifyBlobAgainstCommit(idx, hash); !ok || err != nil {
+			t.Fatalf("failed to verify blob %d during re-encoding: %v", idx, err)
+		}
+	}
+
+	if err := s.ReEncodeShard(0, ENCODE_BLOB_POSEIDON); err != nil {
+		t.Fatal("failed to re-encode shard", err)
+	}
+	if ds.IsReEncoding() {
+		t.Fatal("expected the re-encoding to be finished")
+	}
+	if _, err := s.ReadSampleUnlocked(0, 0); err != nil {
+		t.Fatal("failed to read sample once re-encoded", err)
+	}
+	if encodeType, _ := s.GetShardEncodeType(0); encodeType != ENCODE_BLOB_POSEIDON {
+		t.Fatalf("expected encode type %d, got %d", ENCODE_BLOB_POSEIDON, encodeType)
+	}
+	checkBlobs(s, kvIndexes)
+	for _, idx := range kvIndexes {
+		expected, hash := createBlob(idx)
+		encoded, success, err := s.TryReadEncoded(idx, 131072)
+		if !success || err != nil {
+			t.Fatal("failed to read encoded blob", err)
+		}
+		blob, success, err := s.DecodeKV(idx, encoded, hash, miner, ENCODE_BLOB_POSEIDON)
+		if !success || err != nil {
+			t.Fatal("failed to decode blob", err)
+		}
+		if !bytes.Equal(blob, expected) {
+			t.Fatalf("decoded blob of kv %d mismatch", idx)
+		}
+	}
+
+	// re-encoding to the same encode type is a no-op
+	if err := s.ReEncodeShard(0, ENCODE_BLOB_POSEIDON); err != nil {
+		t.Fatal("failed to re-encode shard again", err)
+	}
+	checkBlobs(s, kvIndexes)
+}
+
+func TestShardManager_FsyncBatched(t *testing.T) {
+	fileName := t.TempDir() + "/fsync-0.dat"
+	if _, err := Create(fileName, 0, kvEntries, 0, 131072, ENCODE_KECCAK_256, common.Address{}, 131072); err != nil {
+		t.Fatal("failed to create data file", err)
+	}
+	open := func() (*ShardManager, *DataFile) {
+		sm := NewShardManager(contractAddress, 131072, kvEntries, 131072)
+		sm.SetFsyncPolicy(FsyncPolicy{Mode: FsyncBatched, BatchWrites: 2, BatchInterval: time.Hour})
+		df, err := OpenDataFile(fileName)
+		if err != nil {
+			t.Fatal("failed to open data file", err)
+		}
+		if err := sm.AddDataFileAndShard(df); err != nil {
+			t.Fatal("failed to add data file", err)
+		}
+		return sm, df
+	}
+
+	sm, df := open()
+	kvIndexes := []uint64{1, 2, 3}
+	for _, idx := range kvIndexes {
+		blob, hash := createBlob(idx)
+		if success, err := sm.TryWrite(idx, blob, hash); !success || err != nil {
+			t.Fatal("failed to write blob", err)
+		}
+	}
+	// the first batch of 2 blobs is flushed, and the last blob is left to Close
+	if df.unsynced != 1 {
+		t.Fatalf("expected 1 blob not flushed, got %d", df.unsynced)
+	}
+	if err := sm.Close(); err != nil {
+		t.Fatal("failed to close shard manager", err)
+	}
+	if df.unsynced != 0 {
+		t.Fatalf("expected all blobs flushed on close, got %d not flushed", df.unsynced)
+	}
+
+	sm, _ = open()
+	defer sm.Close()
+	for _, idx := range kvIndexes {
+		expected, hash := createBlob(idx)
+		blob, success, err := sm.TryRead(idx, 131072, hash)
+		if !success || err != nil {
+			t.Fatalf("failed to read blob %d: %v", idx, err)
+		}
+		if !bytes.Equal(blob, expected) {
+			t.Fatalf("blob of kv %d mismatch after reopen", idx)
+		}
+	}
+}
+
+func TestShardManager_FilledBitmap(t *testing.T) {
+	fileName := t.TempDir() + "/filled-0.dat"
+	if _, err := Create(fileName, 0, kvEntries, 0, 131072, ENCODE_KECCAK_256, common.Address{}, 131072); err != nil {
+		t.Fatal("failed to create data file", err)
+	}
+	open := func() (*ShardManager, *DataFile) {
+		sm := NewShardManager(contractAddress, 131072, kvEntries, 131072)
+		df, err := OpenDataFile(fileName)
+		if err != nil {
+			t.Fatal("failed to open data file", err)
+		}
+		if err := sm.AddDataFileAndShard(df); err != nil {
+			t.Fatal("failed to add data file", err)
+		}
+		return sm, df
+	}
+	checkBitmap := func(sm *ShardManager, expected []uint64) {
+		bitmap, err := sm.FilledBitmap(0)
+		if err != nil {
+			t.Fatal("failed to get filled bitmap", err)
+		}
+		for i := uint64(0); i < kvEntries; i++ {
+			filled := bitmap[i/8]&(1<<(i%8)) != 0
+			if filled != slices.Contains(expected, i) {
+				t.Fatalf("filled bit of kv %d mismatch, expected: %v, actual: %v", i, !filled, filled)
+			}
+		}
+	}
+
+	var emptyCommit common.Hash
+	emptyCommit[HashSizeInContract] = blobFillingMask
+	sm, df := open()
+	for _, idx := range []uint64{1, 3, 4, 9} {
+		if success, err := sm.TryWrite(idx, []byte{}, emptyCommit); !success || err != nil {
+			t.Fatal("failed to fill empty blob", err)
+		}
+	}
+	// a blob synced over an empty filled kv is not empty any more
+	for _, idx := range []uint64{2, 4} {
+		blob, hash := createBlob(idx)
+		if success, err := sm.TryWrite(idx, blob, hash); !success || err != nil {
+			t.Fatal("failed to write blob", err)
+		}
+	}
+	expected := []uint64{1, 3, 9}
+	checkBitmap(sm, expected)
+	// the updates of the bitmap are written to disk in batches, and once the data file is closed
+	onDisk := make([]byte, 2)
+	if _, err := df.file.ReadAt(onDisk, df.filledOffset()); err != nil && !errors.Is(err, io.EOF) {
+		t.Fatal("failed to read filled bitmap", err)
+	}
+	if df.filledPending == 0 || !bytes.Equal(onDisk, make([]byte, 2)) {
+		t.Fatalf("filled bitmap should not be written on each update, pending %d, on disk %x", df.filledPending, onDisk)
+	}
+	if err := sm.Close(); err != nil {
+		t.Fatal("failed to close shard manager", err)
+	}
+
+	sm, df = open()
+	checkBitmap(sm, expected)
+	// the bitmap of a data file created before the bitmap is kept is derived from the metas without writing it
+	df.status &^= STATUS_FILLED_BITMAP
+	if err := df.writeHeader(); err != nil {
+		t.Fatal("failed to write header", err)
+	}
+	if err := sm.Close(); err != nil {
+		t.Fatal("failed to close shard manager", err)
+	}
+
+	sm, df = open()
+	checkBitmap(sm, expected)
+	if df.FilledBitmapKept() || df.status&STATUS_FILLED_BITMAP != 0 {
+		t.Fatal("filled bitmap should not be kept until the data file is migrated")
+	}
+	// the updates of a data file not migrated are kept in memory
+	if success, err := sm.TryWrite(5, []byte{}, emptyCommit); !success || err != nil {
+		t.Fatal("failed to fill empty blob", err)
+	}
+	expected = append(expected, 5)
+	checkBitmap(sm, expected)
+	if err := sm.Close(); err != nil {
+		t.Fatal("failed to close shard manager", err)
+	}
+
+	sm, df = open()
+	defer sm.Close()
+	if df.FilledBitmapKept() {
+		t.Fatal("data file should not be migrated by the writes")
+	}
+	if migrated, err := df.MigrateFilledBitmap(); !migrated || err != nil {
+		t.Fatal("failed to migrate filled bitmap", err)
+	}
+	if migrated, err := df.MigrateFilledBitmap(); migrated || err != nil {
+		t.Fatal("filled bitmap should be migrated only once", err)
+	}
+	df.filled = nil
+	if !df.FilledBitmapKept() || df.status&STATUS_FILLED_BITMAP == 0 {
+		t.Fatal("filled bitmap should be kept once migrated")
+	}
+	checkBitmap(sm, expected)
+}
+
+func TestBenchmarkEncode(t *testing.T) {
+	for _, encodeType := range []uint64{ENCODE_KECCAK_256, ENCODE_ETHASH, ENCODE_BLOB_POSEIDON} {
+		res, err := BenchmarkEncode(encodeType, 2)
+		if err != nil {
+			t.Fatalf("benchmark encode type %d failed: %v", encodeType, err)
+		}
+		if res.EncodeNsPerOp <= 0 || res.DecodeNsPerOp <= 0 || res.EncodeMBPerSec <= 0 || res.DecodeMBPerSec <= 0 {
+			t.Fatalf("throughput of encode type %d should be positive: %s", encodeType, res)
+		}
+		t.Log(res)
+	}
+	if _, err := BenchmarkEncode(ENCODE_END+1, 2); err == nil {
+		t.Fatalf("benchmark should fail for unsupported encode type")
+	}
+}
+
+func TestRegisterCustomCodec(t *testing.T) {
+	const customEncodeType = ENCODE_END + 16
+	// a trivial codec xoring the kv data with the commit hash
+	xor := func(kvIdx uint64, b []byte, hash common.Hash, providerAddr common.Address, encodeType uint64) ([]byte, bool, error) {
+		out := make([]byte, len(b))
+		for i := range b {
+			out[i] = b[i] ^ hash[i%len(hash)]
+		}
+		return out, true, nil
+	}
+	RegisterEncoder(customEncodeType, xor)
+	RegisterDecoder(customEncodeType, xor)
+
+	sm := NewShardManager(common.HexToAddress("0x0000000000000000000000000000000003330002"), 131072, kvEntries, 131072)
+	sm.AddDataShard(0)
+	blob, hash := createBlob(1)
+	encoded, ok, err := sm.EncodeKV(1, blob, hash, common.Address{}, customEncodeType)
+	if !ok || err != nil {
+		t.Fatalf("encode blob with custom encode type failed: %v", err)
+	}
+	if bytes.Equal(encoded, blob) {
+		t.Fatalf("blob should be encoded by the registered encoder")
+	}
+	decoded, ok, err := sm.DecodeKV(1, encoded, hash, common.Address{}, customEncodeType)
+	if !ok || err != nil {
+		t.Fatalf("decode blob with custom encode type failed: %v", err)
+	}
+	if !bytes.Equal(decoded, blob) {
+		t.Fatalf("decoded blob mismatches the original blob")
+	}
+	if _, _, err := sm.DecodeKV(1, encoded, hash, common.Address{}, customEncodeType+1); err == nil {
+		t.Fatalf("decode should fail for unregistered encode type")
+	}
+}
+
+// TestDataFileCustomEncodeType tests that a data file of a registered custom encode type is created, reopened and
+// read, and a shard is re-encoded to it, while a data file of an unregistered encode type is rejected.
+func TestDataFileCustomEncodeType(t *testing.T) {
+	const customEncodeType = ENCODE_END + 17
+	xor := func(kvIdx uint64, b []byte, hash common.Hash, providerAddr common.Address, encodeType uint64) ([]byte, bool, error) {
+		out := make([]byte, len(b))
+		for i := range b {
+			out[i] = b[i] ^ hash[i%len(hash)] ^ byte(kvIdx)
+		}
+		return out, true, nil
+	}
+	RegisterEncoder(customEncodeType, xor)
+	RegisterDecoder(customEncodeType, xor)
+
+	dir := t.TempDir()
+	open := func(fileName string) *ShardManager {
+		sm := NewShardManager(contractAddress, 131072, kvEntries, 131072)
+		sm.AddDataShard(0)
+		df, err := OpenDataFile(fileName)
+		if err != nil {
+			t.Fatal("failed to open data file", err)
+		}
+		if err := sm.AddDataFile(df); err != nil {
+			t.Fatal("failed to add data file", err)
+		}
+		return sm
+	}
+	checkBlobs := func(sm *ShardManager, kvIndexes []uint64) {
+		for _, idx := range kvIndexes {
+			expected, hash := createBlob(idx)
+			blob, success, err := sm.TryRead(idx, 131072, hash)
+			if !success || err != nil {
+				t.Fatalf("failed to read blob %d: %v", idx, err)
+			}
+			if !bytes.Equal(blob, expected) {
+				t.Fatalf("blob of kv %d mismatch", idx)
+			}
+		}
+	}
+	kvIndexes := []uint64{1, 2, 3}
+
+	fileName := dir + "/custom-0.dat"
+	if _, err := Create(fileName, 0, kvEntries, 0, 131072, customEncodeType, common.Address{}, 131072); err != nil {
+		t.Fatal("failed to create data file", err)
+	}
+	sm := open(fileName)
+	for _, idx := range kvIndexes {
+		blob, hash := createBlob(idx)
+		if success, err := sm.TryWrite(idx, blob, hash); !success || err != nil {
+			t.Fatal("failed to write blob", err)
+		}
+	}
+	sm.Close()
+
+	sm = open(fileName)
+	if encodeType := sm.ShardMap()[0].EncodeType(); encodeType != customEncodeType {
+		t.Fatalf("encode type of reopened data file mismatch, expected %d, actual %d", customEncodeType, encodeType)
+	}
+	blob, _ := createBlob(1)
+	if encoded, _, err := sm.TryReadEncoded(1, 131072); err != nil || bytes.Equal(encoded, blob) {
+		t.Fatalf("blob should be encoded by the registered encoder, err %v", err)
+	}
+	checkBlobs(sm, kvIndexes)
+	sm.Close()
+
+	// re-encode a shard of a built-in encode type to the custom one
+	fileName = dir + "/reencode-0.dat"
+	if _, err := Create(fileName, 0, kvEntries, 0, 131072, ENCODE_KECCAK_256, common.Address{}, 131072); err != nil {
+		t.Fatal("failed to create data file", err)
+	}
+	sm = open(fileName)
+	for _, idx := range kvIndexes {
+		blob, hash := createBlob(idx)
+		if success, err := sm.TryWrite(idx, blob, hash); !success || err != nil {
+			t.Fatal("failed to write blob", err)
+		}
+	}
+	ds := sm.ShardMap()[0]
+	if started, err := ds.StartReEncode(customEncodeType); !started || err != nil {
+		t.Fatal("failed to start re-encoding", err)
+	}
+	for idx := uint64(0); idx < kvEntries; idx++ {
+		if _, err := ds.ReEncodeKV(idx); err != nil {
+			t.Fatal("failed to re-encode kv", err)
+		}
+	}
+	if err := ds.FinishReEncode(); err != nil {
+		t.Fatal("failed to finish re-encoding", err)
+	}
+	sm.Close()
+	sm = open(fileName)
+	defer sm.Close()
+	checkBlobs(sm, kvIndexes)
+
+	if _, err := Create(dir+"/unregistered-0.dat", 0, kvEntries, 0, 131072, customEncodeType+1, common.Address{}, 131072); err != nil {
+		t.Fatal("failed to create data file", err)
+	}
+	if _, err := OpenDataFile(dir + "/unregistered-0.dat"); err == nil {
+		t.Fatal("data file of unregistered encode type should be rejected")
+	}
+	if _, err := ds.StartReEncode(customEncodeType + 1); err == nil {
+		t.Fatal("re-encoding to unregistered encode type should be rejected")
+	}
+}
+
+func TestShardManager_Warmup(t *testing.T) {
+	dir := t.TempDir()
+	sm := NewShardManager(contractAddress, 131072, kvEntries, 131072)
+	defer sm.Close()
+	fileNames := make([]string, 3)
+	for i := range fileNames {
+		fileNames[i] = fmt.Sprintf("%s/warmup-%d.dat", dir, i)
+		if _, err := Create(fileNames[i], uint64(i)*kvEntries, kvEntries, 0, 131072, ENCODE_KECCAK_256, common.Address{}, 131072); err != nil {
+			t.Fatal("failed to create data file", err)
+		}
+		df, err := OpenDataFile(fileNames[i])
+		if err != nil {
+			t.Fatal("failed to open data file", err)
+		}
+		if err := sm.AddDataFileAndShard(df); err != nil {
+			t.Fatal("failed to add data file", err)
+		}
+	}
+	if err := sm.Warmup(); err != nil {
+		t.Fatal("failed to warm up data files", err)
+	}
+
+	// truncate a data file and corrupt the header of another one after they are opened
+	if err := os.Truncate(fileNames[1], HEADER_SIZE); err != nil {
+		t.Fatal("failed to truncate data file", err)
+	}
+	f, err := os.OpenFile(fileNames[2], os.O_RDWR, 0755)
+	if err != nil {
+		t.Fatal("failed to open data file", err)
+	}
+	if _, err := f.WriteAt(make([]byte, 8), 0); err != nil {
+		t.Fatal("failed to corrupt data file", err)
+	}
+	f.Close()
+
+	err = sm.Warmup()
+	if err == nil {
+		t.Fatal("warm up should fail on the broken data files")
+	}
+	for i, fileName := range fileNames {
+		if broken := i > 0; strings.Contains(err.Error(), fileName) != broken {
+			t.Fatalf("data file %s should be reported: %v, error: %v", fileName, broken, err)
+		}
+	}
+}
+
+func TestShardManager_MinFreeDisk(t *testing.T) {
+	fileName := t.TempDir() + "/disk-0.dat"
+	if _, err := Create(fileName, 0, kvEntries, 0, 131072, ENCODE_KECCAK_256, common.Address{}, 131072); err != nil {
+		t.Fatal("failed to create data file", err)
+	}
+	sm := NewShardManager(contractAddress, 131072, kvEntries, 131072)
+	defer sm.Close()
+	df, err := OpenDataFile(fileName)
+	if err != nil {
+		t.Fatal("failed to open data file", err)
+	}
+	if err := sm.AddDataFileAndShard(df); err != nil {
+		t.Fatal("failed to add data file", err)
+	}
+	free := uint64(1 << 20)
+	sm.freeDisk = func(path string) (uint64, error) {
+		if path != fileName {
+			t.Fatalf("free disk space of %s is checked instead of the data file", path)
+		}
+		return free, nil
+	}
+	sm.SetMinFreeDisk(1 << 30)
+
+	blob, hash := createBlob(1)
+	if _, err := sm.TryWrite(1, blob, hash); !errors.Is(err, ErrDiskFull) {
+		t.Fatalf("write should fail with ErrDiskFull, got %v", err)
+	}
+	if _, err := sm.TryWriteEncoded(1, blob, hash); !errors.Is(err, ErrDiskFull) {
+		t.Fatalf("encoded write should fail with ErrDiskFull, got %v", err)
+	}
+
+	// the blob is written once the disk space is freed
+	free = 2 << 30
+	if success, err := sm.TryWrite(1, blob, hash); !success || err != nil {
+		t.Fatal("failed to write blob", err)
+	}
+	read, success, err := sm.TryRead(1, 131072, hash)
+	if !success || err != nil || !bytes.Equal(read, blob) {
+		t.Fatalf("failed to read blob: %v", err)
+	}
+}